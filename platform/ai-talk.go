@@ -21,7 +21,6 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 	"github.com/sashabaranov/go-openai"
 
@@ -1471,6 +1470,11 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 	ep := "/terraform/v1/ai-talk/stage/start"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		// The stage outlives the request, so it runs in the context of service.
+		parentCtx := ctx
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		createNewStage := func(ctx context.Context, room *SrsLiveRoom) (*Stage, error) {
 			ctx = logger.WithContext(ctx)
 
@@ -1512,7 +1516,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 		if err := func() error {
 			var token string
 			var roomUUID, roomToken string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token     *string `json:"token"`
 				RoomUUID  *string `json:"room"`
 				RoomToken *string `json:"roomToken"`
@@ -1559,14 +1563,14 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			// Allow to reuse exists stage.
 			stage := talkServer.QueryStage(room.StageUUID)
 			if stage != nil {
-				ctx = stage.loggingCtx
+				ctx = logger.AliasContext(ctx, stage.loggingCtx)
 				logger.Tf(ctx, "Stage: Reuse stage sid=%v, all=%v", stage.sid, talkServer.CountStage())
 			} else {
 				var err error
-				if stage, err = createNewStage(ctx, &room); err != nil {
+				if stage, err = createNewStage(parentCtx, &room); err != nil {
 					return err
 				}
-				ctx = stage.loggingCtx
+				ctx = logger.AliasContext(ctx, stage.loggingCtx)
 			}
 
 			// Keep alive the stage.
@@ -1581,7 +1585,8 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			user.KeepAlive()
 			stage.addUser(user)
 
-			go func() {
+			// The user outlives the request, so it expires in the context of stage.
+			go func(ctx context.Context) {
 				defer user.Close()
 
 				for ctx.Err() == nil {
@@ -1596,7 +1601,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 						}
 					}
 				}
-			}()
+			}(stage.loggingCtx)
 
 			type StageResult struct {
 				StageID   string `json:"sid"`
@@ -1613,22 +1618,25 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 				AIASREnabled: room.AIASREnabled,
 			}
 
-			ohttp.WriteData(ctx, w, r, r0)
+			httpWriteData(ctx, w, r, r0)
 			logger.Tf(ctx, "srs ai-talk create stage ok, room=%v, stage=%v, users=%v, subscribers=%v, requests=%v",
 				room.UUID, stage.sid, len(stage.users), len(stage.subscribers), len(stage.requests))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai-talk/stage/conversation"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var sid, roomUUID, roomToken string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token     *string `json:"token"`
 				RoomUUID  *string `json:"room"`
 				RoomToken *string `json:"roomToken"`
@@ -1667,7 +1675,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			// Keep alive the stage.
 			stage.KeepAlive()
 			// Switch to the context of stage.
-			ctx = stage.loggingCtx
+			ctx = logger.AliasContext(ctx, stage.loggingCtx)
 
 			// The rid is the request id, which identify this request, generally a question.
 			sreq := &StageRequest{rid: uuid.NewString(), stage: stage}
@@ -1679,7 +1687,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			stage.KeepAlive()
 
 			// Response the request UUID and pulling the response.
-			ohttp.WriteData(ctx, w, r, struct {
+			httpWriteData(ctx, w, r, struct {
 				RequestUUID string `json:"rid"`
 			}{
 				RequestUUID: sreq.rid,
@@ -1687,13 +1695,16 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "ai-talk new conversation, room=%v, sid=%v, rid=%v", roomUUID, sid, sreq.rid)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai-talk/stage/upload"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		var sreq *StageRequest
 		if err := func() error {
 			var token string
@@ -1702,7 +1713,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			var userMayInput float64
 			var audioBase64Data, textMessage string
 			var mergeMessages int
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token        *string  `json:"token"`
 				RoomUUID     *string  `json:"room"`
 				RoomToken    *string  `json:"roomToken"`
@@ -1759,7 +1770,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			// Keep alive the stage.
 			stage.KeepAlive()
 			// Switch to the context of stage.
-			ctx = stage.loggingCtx
+			ctx = logger.AliasContext(ctx, stage.loggingCtx)
 
 			// Query the request.
 			sreq = stage.queryRequest(rid)
@@ -1869,7 +1880,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			}
 
 			// Response the request UUID and pulling the response.
-			ohttp.WriteData(ctx, w, r, struct {
+			httpWriteData(ctx, w, r, struct {
 				RequestUUID string `json:"rid"`
 				ASR         string `json:"asr"`
 			}{
@@ -1883,18 +1894,21 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			if sreq != nil {
 				sreq.errs = append(sreq.errs, err)
 			}
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai-talk/stage/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var sid, rid string
 			var roomUUID, roomToken string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token       *string `json:"token"`
 				RoomUUID    *string `json:"room"`
 				RoomToken   *string `json:"roomToken"`
@@ -1938,7 +1952,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			// Keep alive the stage.
 			stage.KeepAlive()
 			// Switch to the context of stage.
-			ctx = stage.loggingCtx
+			ctx = logger.AliasContext(ctx, stage.loggingCtx)
 			logger.Tf(ctx, "Stage: Query sid=%v, rid=%v", sid, rid)
 
 			// Query the request.
@@ -1947,7 +1961,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Errorf("invalid sid=%v, rid=%v", sid, rid)
 			}
 
-			ohttp.WriteData(ctx, w, r, struct {
+			httpWriteData(ctx, w, r, struct {
 				Finished bool `json:"finished"`
 			}{
 				Finished: sreq.finished,
@@ -1955,13 +1969,16 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai-talk/stage/hello-voices/"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			filename := r.URL.Path[len("/terraform/v1/ai-talk/stage/hello-voices/"):]
 			if !strings.Contains(filename, ".") {
@@ -1972,7 +1989,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			q := r.URL.Query()
 			if sid := q.Get("sid"); sid != "" {
 				if stage := talkServer.QueryStage(sid); stage != nil {
-					ctx = stage.loggingCtx
+					ctx = logger.AliasContext(ctx, stage.loggingCtx)
 				}
 			}
 
@@ -1984,17 +2001,20 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			http.ServeFile(w, r, path.Join(aiTalkExampleDir, filename))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai-talk/stage/verify"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var roomToken string
 			var roomUUID string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				RoomUUID  *string `json:"room"`
 				RoomToken *string `json:"roomToken"`
 			}{
@@ -2018,21 +2038,26 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Errorf("invalid room token")
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "srs ai-talk verify popout token ok")
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai-talk/subscribe/start"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		// The subscriber outlives the request, so it runs in the context of service.
+		parentCtx := ctx
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var roomUUID, roomToken string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token     *string `json:"token"`
 				RoomUUID  *string `json:"room"`
 				RoomToken *string `json:"roomToken"`
@@ -2064,7 +2089,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			}
 
 			// TODO: FIXME: Cleanup subscribers for a room.
-			ctx = logger.WithContext(ctx)
+			ctx = logger.WithContext(parentCtx)
 			subscriber := NewStageSubscriber(func(subscriber *StageSubscriber) {
 				subscriber.loggingCtx = ctx
 				subscriber.room = stage.room
@@ -2106,18 +2131,21 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 				Voice:        stage.voice,
 			}
 
-			ohttp.WriteData(ctx, w, r, &r0)
+			httpWriteData(ctx, w, r, &r0)
 			logger.Tf(ctx, "Stage: create subscriber ok, room=%v, sid=%v, spid=%v",
 				stage.room.UUID, stage.sid, subscriber.spid)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai-talk/subscribe/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var sid, spid string
@@ -2125,7 +2153,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			// Optional, stream hosts has a userID, no this field for subscribers. Use as heartbeat to
 			// make user keep in alive.
 			var userID string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token        *string `json:"token"`
 				RoomUUID     *string `json:"room"`
 				RoomToken    *string `json:"roomToken"`
@@ -2177,7 +2205,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			stage.KeepAlive()
 			subscriber.KeepAlive()
 			// Switch to the context of stage.
-			ctx = stage.loggingCtx
+			ctx = logger.AliasContext(ctx, stage.loggingCtx)
 			// Note that we should disable detail meanless logs for subscribe.
 			//logger.Tf(ctx, "Stage: Query sid=%v, room=%v", sid, stage.room.UUID)
 
@@ -2187,7 +2215,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			}
 
 			msgs, pending := subscriber.flushMessages()
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				// Finished messages.
 				Messages []*StageMessage `json:"msgs"`
 				// Is there any pending messages.
@@ -2201,7 +2229,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			//logger.Tf(ctx, "srs ai-talk query subscriber stage ok")
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
@@ -2232,6 +2260,9 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 	ep = "/terraform/v1/ai-talk/subscribe/tts"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			q := r.URL.Query()
 
@@ -2287,7 +2318,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			stage.KeepAlive()
 			subscriber.KeepAlive()
 			// Switch to the context of stage.
-			ctx = stage.loggingCtx
+			ctx = logger.AliasContext(ctx, stage.loggingCtx)
 			logger.Tf(ctx, "Stage: Download sid=%v, spid=%v, asid=%v", sid, spid, asid)
 
 			// When the first subscriber got the segment, we log the elapsed time.
@@ -2304,18 +2335,21 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "srs ai-talk play tts subscriber stage ok")
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai-talk/subscribe/remove"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var sid, spid, asid string
 			var roomUUID, roomToken string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token            *string `json:"token"`
 				RoomUUID         *string `json:"room"`
 				RoomToken        *string `json:"roomToken"`
@@ -2373,7 +2407,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			stage.KeepAlive()
 			subscriber.KeepAlive()
 			// Switch to the context of stage.
-			ctx = stage.loggingCtx
+			ctx = logger.AliasContext(ctx, stage.loggingCtx)
 			logger.Tf(ctx, "Stage: Remove segment room=%v, sid=%v, spid=%v, asid=%v",
 				stage.room.UUID, sid, spid, asid)
 
@@ -2381,22 +2415,25 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Wrapf(err, "remove message asid=%v of sid=%v, spid=%v", asid, sid, spid)
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "srs ai-talk remove subscriber stage file ok")
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai-talk/user/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var sid, userID string
 			var roomUUID, roomToken string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token     *string `json:"token"`
 				RoomUUID  *string `json:"room"`
 				RoomToken *string `json:"roomToken"`
@@ -2445,26 +2482,29 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			stage.KeepAlive()
 			user.KeepAlive()
 			// Switch to the context of stage.
-			ctx = stage.loggingCtx
+			ctx = logger.AliasContext(ctx, stage.loggingCtx)
 			logger.Tf(ctx, "Stage: Query user room=%v, sid=%v, user=%v",
 				stage.room.UUID, sid, userID)
 
-			ohttp.WriteData(ctx, w, r, user)
+			httpWriteData(ctx, w, r, user)
 			logger.Tf(ctx, "srs ai-talk query user ok")
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai-talk/user/update"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var sid, userID, username, userLanguage string
 			var roomUUID, roomToken string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token        *string `json:"token"`
 				RoomUUID     *string `json:"room"`
 				RoomToken    *string `json:"roomToken"`
@@ -2516,7 +2556,7 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			stage.KeepAlive()
 			user.KeepAlive()
 			// Switch to the context of stage.
-			ctx = stage.loggingCtx
+			ctx = logger.AliasContext(ctx, stage.loggingCtx)
 			logger.Tf(ctx, "Stage: Update user room=%v, sid=%v, user=%v, name=%v, lang=%v",
 				stage.room.UUID, sid, userID, username, userLanguage)
 
@@ -2524,11 +2564,11 @@ func handleAITalkService(ctx context.Context, handler *http.ServeMux) error {
 			user.Language = userLanguage
 			user.Voice = helloVoiceFromLanguage(userLanguage)
 
-			ohttp.WriteData(ctx, w, r, user)
+			httpWriteData(ctx, w, r, user)
 			logger.Tf(ctx, "srs ai-talk update user ok, sid=%v, user=%v", sid, userID)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
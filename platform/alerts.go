@@ -0,0 +1,566 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The interval to evaluate the alerts.
+const alertEvaluateInterval = 1 * time.Minute
+
+// The directories to check the disk usage, the data and HLS files.
+var alertDiskPaths = []string{"containers/data", "containers/objs/nginx/html"}
+
+var alertWorker *AlertWorker
+
+// AlertSeverity is the severity of alert.
+type AlertSeverity string
+
+const (
+	AlertSeverityWarning  AlertSeverity = "warning"
+	AlertSeverityCritical AlertSeverity = "critical"
+)
+
+// The names of alerts, see alertDefinitions.
+const (
+	AlertCertExpiring    = "cert_expiring"
+	AlertDiskUsage       = "disk_usage"
+	AlertRedisLatency    = "redis_latency"
+	AlertStreamUnhealthy = "stream_unhealthy"
+	AlertTaskCrashLoop   = "task_crash_loop"
+	AlertUpgradeStuck    = "upgrade_stuck"
+)
+
+// AlertDefinition is the declarative definition of alert, which is evaluated periodically from the existing data.
+type AlertDefinition struct {
+	// The name of alert.
+	Name string `json:"name"`
+	// The severity of alert.
+	Severity AlertSeverity `json:"severity"`
+	// The default threshold, overridable by /terraform/v1/mgmt/alerts/settings
+	Threshold float64 `json:"threshold"`
+	// The description of threshold, with the unit.
+	Help string `json:"help"`
+	// Evaluate returns the message of firing alerts by the threshold, the key is the resource, for example, the path of
+	// disk or the task, empty for the global one. The alerts not in result are resolved.
+	Evaluate func(ctx context.Context, threshold float64) (map[string]string, error) `json:"-"`
+}
+
+// The definitions of alerts, replaced by tests.
+var alertDefinitions = []*AlertDefinition{
+	{
+		Name: AlertCertExpiring, Severity: AlertSeverityWarning, Threshold: 14,
+		Help: "The HTTPS certificate expires in days.", Evaluate: alertCertExpiring,
+	},
+	{
+		Name: AlertDiskUsage, Severity: AlertSeverityCritical, Threshold: 90,
+		Help: "The disk usage in percent.", Evaluate: alertDiskUsage,
+	},
+	{
+		Name: AlertRedisLatency, Severity: AlertSeverityWarning, Threshold: 100,
+		Help: "The latency of redis PING in milliseconds.", Evaluate: alertRedisLatency,
+	},
+	{
+		Name: AlertStreamUnhealthy, Severity: AlertSeverityWarning, Threshold: 60,
+		Help: "The best health score of stream in 5 minutes.", Evaluate: alertStreamUnhealthy,
+	},
+	{
+		Name: AlertTaskCrashLoop, Severity: AlertSeverityCritical, Threshold: 3,
+		Help: "The failures of a task in 10 minutes.", Evaluate: alertTaskCrashLoop,
+	},
+	{
+		Name: AlertUpgradeStuck, Severity: AlertSeverityCritical, Threshold: 30,
+		Help: "The upgrade is not done in minutes.", Evaluate: alertUpgradeStuck,
+	},
+}
+
+// Alert is an active alert, stored in SRS_ALERTS, the field is the key of alert.
+type Alert struct {
+	// The name and severity of alert.
+	Name     string        `json:"name"`
+	Severity AlertSeverity `json:"severity"`
+	// The resource of alert, for example, the path of disk, empty for the global one.
+	Resource string `json:"resource,omitempty"`
+	// The message of the latest evaluation.
+	Message string `json:"message"`
+	// The time when alert starts firing, and the time of the latest evaluation.
+	Start  string `json:"start"`
+	Update string `json:"update"`
+}
+
+func (v *Alert) String() string {
+	return fmt.Sprintf("name=%v, severity=%v, resource=%v, message=%v, start=%v, update=%v",
+		v.Name, v.Severity, v.Resource, v.Message, v.Start, v.Update,
+	)
+}
+
+// Key returns the identity of alert, such as disk_usage:containers/data or upgrade_stuck.
+func (v *Alert) Key() string {
+	if v.Resource == "" {
+		return v.Name
+	}
+	return fmt.Sprintf("%v:%v", v.Name, v.Resource)
+}
+
+// queryAlerts returns the active alerts, the earliest first.
+func queryAlerts(ctx context.Context) ([]*Alert, error) {
+	values, err := rdb.HGetAll(ctx, SRS_ALERTS).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_ALERTS)
+	}
+
+	alerts := make([]*Alert, 0, len(values))
+	for key, value := range values {
+		var alert Alert
+		if err := json.Unmarshal([]byte(value), &alert); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", key, value)
+		}
+		alerts = append(alerts, &alert)
+	}
+
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Start != alerts[j].Start {
+			return alerts[i].Start < alerts[j].Start
+		}
+		return alerts[i].Key() < alerts[j].Key()
+	})
+	return alerts, nil
+}
+
+// queryAlertThresholds returns the effective threshold of each alert, the overridden or the default one.
+func queryAlertThresholds(ctx context.Context) (map[string]float64, error) {
+	values, err := rdb.HGetAll(ctx, SRS_ALERT_SETTINGS).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_ALERT_SETTINGS)
+	}
+
+	thresholds := make(map[string]float64)
+	for _, definition := range alertDefinitions {
+		thresholds[definition.Name] = definition.Threshold
+		if value, ok := values[definition.Name]; ok {
+			if threshold, err := strconv.ParseFloat(value, 64); err != nil {
+				return nil, errors.Wrapf(err, "parse %v %v", definition.Name, value)
+			} else {
+				thresholds[definition.Name] = threshold
+			}
+		}
+	}
+	return thresholds, nil
+}
+
+// evaluateAlerts evaluates each definition, saves the firing alerts, and removes the resolved ones. Each transition
+// is published to the event bus. Note that the transitions are atomic in redis, so the event is published once even if
+// multiple replicas evaluate the same alert.
+func evaluateAlerts(ctx context.Context) error {
+	thresholds, err := queryAlertThresholds(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query thresholds")
+	}
+
+	actives, err := queryAlerts(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query alerts")
+	}
+
+	for _, definition := range alertDefinitions {
+		firing, err := definition.Evaluate(ctx, thresholds[definition.Name])
+		if err != nil {
+			// Keep the alerts as is, because the condition is unknown.
+			logger.Wf(ctx, "alert ignore evaluate %v err %+v", definition.Name, err)
+			continue
+		}
+
+		now := time.Now().Format(time.RFC3339)
+		for resource, message := range firing {
+			alert := &Alert{
+				Name: definition.Name, Severity: definition.Severity, Resource: resource, Message: message,
+				Start: now, Update: now,
+			}
+			for _, active := range actives {
+				if active.Key() == alert.Key() {
+					alert.Start = active.Start
+				}
+			}
+
+			b, err := json.Marshal(alert)
+			if err != nil {
+				return errors.Wrapf(err, "marshal %v", alert.String())
+			}
+			if alert.Start != now {
+				if err := rdb.HSet(ctx, SRS_ALERTS, alert.Key(), string(b)).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v %v %v", SRS_ALERTS, alert.Key(), string(b))
+				}
+				continue
+			}
+
+			if ok, err := rdb.HSetNX(ctx, SRS_ALERTS, alert.Key(), string(b)).Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hsetnx %v %v %v", SRS_ALERTS, alert.Key(), string(b))
+			} else if ok {
+				publishEvent(ctx, (*AlertFiringEvent)(alert))
+				logger.Wf(ctx, "alert firing %v", alert.String())
+			}
+		}
+
+		for _, active := range actives {
+			if _, ok := firing[active.Resource]; ok || active.Name != definition.Name {
+				continue
+			}
+
+			if n, err := rdb.HDel(ctx, SRS_ALERTS, active.Key()).Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_ALERTS, active.Key())
+			} else if n > 0 {
+				active.Update = now
+				publishEvent(ctx, (*AlertResolvedEvent)(active))
+				logger.Tf(ctx, "alert resolved %v", active.String())
+			}
+		}
+	}
+
+	// Remove the alerts whose definition is removed, for example, by upgrade.
+	for _, active := range actives {
+		var found bool
+		for _, definition := range alertDefinitions {
+			found = found || definition.Name == active.Name
+		}
+		if !found {
+			if err := rdb.HDel(ctx, SRS_ALERTS, active.Key()).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_ALERTS, active.Key())
+			}
+		}
+	}
+	return nil
+}
+
+// alertCertExpiring fires if the HTTPS certificate expires in threshold days.
+func alertCertExpiring(ctx context.Context, threshold float64) (map[string]string, error) {
+	if https, err := rdb.Get(ctx, SRS_HTTPS).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "get %v", SRS_HTTPS)
+	} else if https == "" {
+		return nil, nil
+	}
+
+	_, crt, err := certManager.QueryCertificate()
+	if err != nil {
+		return nil, errors.Wrapf(err, "query certificate")
+	}
+
+	block, _ := pem.Decode([]byte(crt))
+	if block == nil {
+		return nil, errors.New("invalid certificate pem")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse certificate")
+	}
+
+	days := time.Until(cert.NotAfter).Hours() / 24
+	if days >= threshold {
+		return nil, nil
+	}
+	return map[string]string{"": fmt.Sprintf("certificate expires at %v, %v days left",
+		cert.NotAfter.Format(time.RFC3339), int(math.Floor(days)),
+	)}, nil
+}
+
+// alertDiskUsage fires for each path whose disk usage exceeds threshold percent.
+func alertDiskUsage(ctx context.Context, threshold float64) (map[string]string, error) {
+	firing := make(map[string]string)
+	for _, dir := range alertDiskPaths {
+		var stat syscall.Statfs_t
+		if err := syscall.Statfs(dir, &stat); err != nil {
+			logger.Wf(ctx, "alert ignore statfs %v err %+v", dir, err)
+			continue
+		}
+
+		total, free := stat.Blocks*uint64(stat.Bsize), stat.Bavail*uint64(stat.Bsize)
+		if total == 0 {
+			continue
+		}
+
+		usage := float64(total-free) * 100 / float64(total)
+		if usage > threshold {
+			firing[dir] = fmt.Sprintf("disk usage %.1f%%, free %vMB", usage, free/1024/1024)
+		}
+	}
+	return firing, nil
+}
+
+// alertRedisLatency fires if the latency of redis exceeds threshold milliseconds, or redis is not available.
+func alertRedisLatency(ctx context.Context, threshold float64) (map[string]string, error) {
+	starttime := time.Now()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return map[string]string{"": fmt.Sprintf("ping redis err %v", err)}, nil
+	}
+
+	latency := float64(time.Since(starttime)) / float64(time.Millisecond)
+	if latency <= threshold {
+		return nil, nil
+	}
+	return map[string]string{"": fmt.Sprintf("ping redis cost %.1fms", latency)}, nil
+}
+
+// alertTaskCrashLoop fires for each task whose latest event is failed, and the failures in the window reach the
+// threshold, see taskHistoryFailureWindow.
+func alertTaskCrashLoop(ctx context.Context, threshold float64) (map[string]string, error) {
+	firing := make(map[string]string)
+	latest := make(map[string]bool)
+	if err := rangeTaskEvents(ctx, func(event *TaskEvent) error {
+		if latest[event.Task] {
+			return nil
+		}
+		latest[event.Task] = true
+
+		if event.Event != TaskEventFailed || float64(event.Failures) < threshold {
+			return nil
+		}
+		if t, err := time.Parse(time.RFC3339, event.Time); err != nil || time.Since(t) > taskHistoryFailureWindow {
+			return nil
+		}
+
+		firing[fmt.Sprintf("%v/%v", event.Worker, event.Task)] = fmt.Sprintf("%v failed %v times in %v, platform=%v, %v",
+			event.Worker, event.Failures, taskHistoryFailureWindow, event.Platform, event.Message,
+		)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "range events")
+	}
+	return firing, nil
+}
+
+// alertUpgradeStuck fires if the upgrade is not done in threshold minutes, for example, the container is not replaced.
+func alertUpgradeStuck(ctx context.Context, threshold float64) (map[string]string, error) {
+	values, err := rdb.HMGet(ctx, SRS_UPGRADING, "upgrading", "start").Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hmget %v upgrading start", SRS_UPGRADING)
+	}
+
+	upgrading, _ := values[0].(string)
+	start, _ := values[1].(string)
+	if upgrading != "1" || start == "" {
+		return nil, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse %v", start)
+	}
+	if elapsed := time.Since(t); elapsed.Minutes() > threshold {
+		return map[string]string{"": fmt.Sprintf("upgrade started at %v, not done in %v", start,
+			elapsed.Round(time.Second),
+		)}, nil
+	}
+	return nil, nil
+}
+
+// collectAlertMetrics writes the active alerts as gauge, and zero for the alert not firing, so that the metric is
+// never absent.
+func collectAlertMetrics(ctx context.Context, w *PrometheusWriter) {
+	alerts, err := queryAlerts(ctx)
+	if err != nil {
+		logger.Wf(ctx, "alert ignore collect err %+v", err)
+		return
+	}
+
+	for _, definition := range alertDefinitions {
+		var firing bool
+		for _, alert := range alerts {
+			if alert.Name == definition.Name {
+				w.Gauge("oryx_alert", "The active alert, 1 if firing.", 1,
+					"name", alert.Name, "severity", string(alert.Severity), "resource", alert.Resource,
+				)
+				firing = true
+			}
+		}
+		if !firing {
+			w.Gauge("oryx_alert", "The active alert, 1 if firing.", 0,
+				"name", definition.Name, "severity", string(definition.Severity), "resource", "",
+			)
+		}
+	}
+}
+
+// AlertWorker evaluates the alerts periodically.
+type AlertWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewAlertWorker() *AlertWorker {
+	return &AlertWorker{}
+}
+
+func (v *AlertWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *AlertWorker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "alert start a worker, interval=%v, definitions=%v", alertEvaluateInterval, len(alertDefinitions))
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			if err := evaluateAlerts(ctx); err != nil {
+				logger.Wf(ctx, "alert ignore err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(alertEvaluateInterval):
+			}
+		}
+	}()
+	return nil
+}
+
+func handleMgmtAlerts(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/alerts"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			alerts, err := queryAlerts(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query alerts")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Alerts []*Alert `json:"alerts"`
+			}{
+				Alerts: alerts,
+			})
+			logger.Tf(ctx, "alerts query ok, alerts=%v, token=%vB", len(alerts), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/alerts/settings"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action, name string
+			var threshold float64
+			if err := ParseBody(ctx, r, &struct {
+				Token     *string  `json:"token"`
+				Action    *string  `json:"action"`
+				Name      *string  `json:"name"`
+				Threshold *float64 `json:"threshold"`
+			}{
+				Token: &token, Action: &action, Name: &name, Threshold: &threshold,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if action != "" {
+				if action != "update" && action != "remove" {
+					return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+				}
+
+				var found bool
+				for _, definition := range alertDefinitions {
+					found = found || definition.Name == name
+				}
+				if !found {
+					return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid alert %v", name))
+				}
+
+				if action == "remove" {
+					if err := rdb.HDel(ctx, SRS_ALERT_SETTINGS, name).Err(); err != nil && err != redis.Nil {
+						return errors.Wrapf(err, "hdel %v %v", SRS_ALERT_SETTINGS, name)
+					}
+				} else {
+					if threshold <= 0 || math.IsInf(threshold, 0) || math.IsNaN(threshold) {
+						return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid threshold %v", threshold))
+					}
+
+					value := strconv.FormatFloat(threshold, 'f', -1, 64)
+					if err := rdb.HSet(ctx, SRS_ALERT_SETTINGS, name, value).Err(); err != nil && err != redis.Nil {
+						return errors.Wrapf(err, "hset %v %v %v", SRS_ALERT_SETTINGS, name, value)
+					}
+				}
+			}
+
+			thresholds, err := queryAlertThresholds(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query thresholds")
+			}
+
+			type AlertSetting struct {
+				*AlertDefinition
+				// The effective threshold, overridden or the default one.
+				Effective float64 `json:"effective"`
+			}
+			settings := make([]*AlertSetting, 0, len(alertDefinitions))
+			for _, definition := range alertDefinitions {
+				settings = append(settings, &AlertSetting{
+					AlertDefinition: definition, Effective: thresholds[definition.Name],
+				})
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Settings []*AlertSetting `json:"settings"`
+			}{
+				Settings: settings,
+			})
+			logger.Tf(ctx, "alerts settings %v ok, name=%v, threshold=%v, token=%vB", action, name, threshold, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
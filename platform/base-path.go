@@ -0,0 +1,79 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// platformBasePath returns the normalized PLATFORM_BASE_PATH, for example, /srs for https://ops.example.com/srs/, or
+// empty to serve at the root.
+func platformBasePath() string {
+	base := strings.Trim(strings.TrimSpace(envPlatformBasePath()), "/")
+	if base == "" {
+		return ""
+	}
+	return "/" + base
+}
+
+// withBasePath prefixes the absolute path by the base path, for redirects and generated URLs. The full URL, for
+// example, https://example.com/live, and the relative path are not changed.
+func withBasePath(p string) string {
+	if !strings.HasPrefix(p, "/") || strings.HasPrefix(p, "//") {
+		return p
+	}
+	return platformBasePath() + p
+}
+
+// basePathHandler strips the base path before the handler, so that the handlers always see the path from root. The
+// request not under the base path is 404, except the /healthz for the local probes.
+type basePathHandler struct {
+	handler http.Handler
+}
+
+func newBasePathHandler(handler http.Handler) http.Handler {
+	return &basePathHandler{handler: handler}
+}
+
+func (v *basePathHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	base := platformBasePath()
+	if base == "" || r.URL.Path == startupHealthzPath {
+		v.handler.ServeHTTP(w, r)
+		return
+	}
+
+	p, ok := stripBasePath(base, r.URL.Path)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	// Never modify the original request, see http.StripPrefix.
+	r2 := new(http.Request)
+	*r2 = *r
+	r2.URL = new(url.URL)
+	*r2.URL = *r.URL
+	r2.URL.Path = p
+	if r.URL.RawPath != "" {
+		if rp, ok := stripBasePath(base, r.URL.RawPath); ok {
+			r2.URL.RawPath = rp
+		} else {
+			r2.URL.RawPath = ""
+		}
+	}
+	v.handler.ServeHTTP(w, r2)
+}
+
+// stripBasePath removes the base path from p, returns false if p is not under it. The base path itself is the root.
+func stripBasePath(base, p string) (string, bool) {
+	if p == base {
+		return "/", true
+	}
+	if !strings.HasPrefix(p, base+"/") {
+		return "", false
+	}
+	return p[len(base):], true
+}
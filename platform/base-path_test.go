@@ -0,0 +1,138 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestBasePath_Normalize(t *testing.T) {
+	oldBase := os.Getenv("PLATFORM_BASE_PATH")
+	defer os.Setenv("PLATFORM_BASE_PATH", oldBase)
+
+	for _, c := range []struct {
+		env    string
+		expect string
+	}{
+		{"", ""}, {"/", ""}, {"srs", "/srs"}, {"/srs/", "/srs"}, {" /ops/srs ", "/ops/srs"},
+	} {
+		os.Setenv("PLATFORM_BASE_PATH", c.env)
+		if v := platformBasePath(); v != c.expect {
+			t.Errorf("Fail for env %v, base %v, expect %v", c.env, v, c.expect)
+		}
+	}
+
+	os.Setenv("PLATFORM_BASE_PATH", "/srs/")
+	for _, c := range []struct {
+		p      string
+		expect string
+	}{
+		{"/mgmt", "/srs/mgmt"}, {"https://example.com/live", "https://example.com/live"},
+		{"//example.com/live", "//example.com/live"}, {"live.m3u8", "live.m3u8"},
+	} {
+		if v := withBasePath(c.p); v != c.expect {
+			t.Errorf("Fail for %v, got %v, expect %v", c.p, v, c.expect)
+		}
+	}
+}
+
+func TestBasePath_Handler(t *testing.T) {
+	oldBase := os.Getenv("PLATFORM_BASE_PATH")
+	defer os.Setenv("PLATFORM_BASE_PATH", oldBase)
+
+	var served string
+	handler := newBasePathHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served = r.URL.Path
+	}))
+	request := func(p string) int {
+		served = ""
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, p, nil))
+		return w.Code
+	}
+
+	// Serve at root by default, without any change.
+	os.Setenv("PLATFORM_BASE_PATH", "")
+	if code := request("/mgmt/"); code != http.StatusOK || served != "/mgmt/" {
+		t.Errorf("Fail for code=%v, served=%v", code, served)
+	}
+
+	os.Setenv("PLATFORM_BASE_PATH", "/srs")
+	for _, c := range []struct {
+		p      string
+		code   int
+		served string
+	}{
+		{"/srs/mgmt/", http.StatusOK, "/mgmt/"},
+		{"/srs/terraform/v1/mgmt/envs", http.StatusOK, "/terraform/v1/mgmt/envs"},
+		{"/srs", http.StatusOK, "/"},
+		{"/healthz", http.StatusOK, "/healthz"},
+		{"/mgmt/", http.StatusNotFound, ""},
+		{"/srsx/mgmt/", http.StatusNotFound, ""},
+	} {
+		if code := request(c.p); code != c.code || served != c.served {
+			t.Errorf("Fail for %v, code=%v, served=%v", c.p, code, served)
+		}
+	}
+}
+
+func TestBasePath_Playback(t *testing.T) {
+	oldBase := os.Getenv("PLATFORM_BASE_PATH")
+	defer os.Setenv("PLATFORM_BASE_PATH", oldBase)
+
+	os.Setenv("PLATFORM_BASE_PATH", "/srs")
+	endpoints := NewPlaybackEndpoints()
+	endpoints.FLV.Base = "https://cdn.example.com"
+	urls := endpoints.URLs("live", "livestream")
+	if urls.HLS != "/srs/live/livestream.m3u8" || urls.FLV != "https://cdn.example.com/live/livestream.flv" ||
+		urls.WHEP != "/srs/rtc/v1/whep/?app=live&stream=livestream" {
+		t.Errorf("Fail for %v", urls)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/terraform/v1/mgmt/embed", nil)
+	r.Host = "ops.example.com"
+	if v := embedBaseURL(r); v != "http://ops.example.com/srs" {
+		t.Errorf("Fail for %v", v)
+	}
+}
+
+func TestBasePath_EmbedForwardedPrefix(t *testing.T) {
+	oldBase := os.Getenv("PLATFORM_BASE_PATH")
+	defer os.Setenv("PLATFORM_BASE_PATH", oldBase)
+	os.Setenv("PLATFORM_BASE_PATH", "/srs")
+
+	proxies, err := parseTrustedProxies("127.0.0.0/8")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	for _, e := range []struct {
+		remote   string
+		prefix   string
+		expected string
+	}{
+		// The forwarded headers from client are ignored.
+		{remote: "1.2.3.4:5678", prefix: "/oryx", expected: "http://ops.example.com/srs"},
+		{remote: "1.2.3.4:5678", prefix: "//evil.example.com", expected: "http://ops.example.com/srs"},
+		// The forwarded headers from trusted proxy.
+		{remote: "127.0.0.1:5678", prefix: "/oryx/", expected: "https://ops.example.com/oryx/srs"},
+		{remote: "127.0.0.1:5678", prefix: "/ops/oryx", expected: "https://ops.example.com/ops/oryx/srs"},
+		// The prefix which is not a clean path is ignored, even from trusted proxy.
+		{remote: "127.0.0.1:5678", prefix: "//evil.example.com", expected: "https://ops.example.com/srs"},
+		{remote: "127.0.0.1:5678", prefix: "/oryx/../x", expected: "https://ops.example.com/srs"},
+		{remote: "127.0.0.1:5678", prefix: "/oryx?x=1", expected: "https://ops.example.com/srs"},
+		{remote: "127.0.0.1:5678", prefix: "oryx", expected: "https://ops.example.com/srs"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/terraform/v1/mgmt/embed", nil)
+		r.Host, r.RemoteAddr = "ops.example.com", e.remote
+		r.Header.Set("X-Forwarded-Proto", "https")
+		r.Header.Set("X-Forwarded-Prefix", e.prefix)
+		if v := resolveEmbedBaseURL(r, proxies); v != e.expected {
+			t.Errorf("Fail for %v of %v, url=%v, expect %v", e.prefix, e.remote, v, e.expected)
+		}
+		if v := resolveEmbedBaseURL(r, nil); v != "http://ops.example.com/srs" {
+			t.Errorf("Fail for %v when trust proxy is off, url=%v", e.prefix, v)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max number of cached bilibili videos, the least recently used is evicted.
+const bilibiliCacheMaxEntries = 1000
+
+var bilibiliCache = NewBilibiliCache()
+
+// BilibiliCacheObject is the cached video information of a bvid.
+type BilibiliCacheObject struct {
+	// The update time.
+	Update string `json:"update"`
+	// The response data of bilibili API.
+	Res map[string]interface{} `json:"res"`
+}
+
+// BilibiliCacheMetrics is the statistic of cache.
+type BilibiliCacheMetrics struct {
+	Hits      int64 `json:"hits"`
+	Misses    int64 `json:"misses"`
+	Evictions int64 `json:"evictions"`
+}
+
+// BilibiliCache stores each bvid in a redis string with TTL, and uses a sorted set by access time to evict the
+// least recently used entries, so random bvids never exhaust the redis memory.
+type BilibiliCache struct {
+	// The max number of entries, default to bilibiliCacheMaxEntries.
+	maxEntries int64
+	metrics    BilibiliCacheMetrics
+}
+
+func NewBilibiliCache() *BilibiliCache {
+	return &BilibiliCache{maxEntries: bilibiliCacheMaxEntries}
+}
+
+// TTL is the logical cache duration.
+func (v *BilibiliCache) TTL() time.Duration {
+	if envNodeEnv() == "development" {
+		return time.Duration(300) * time.Second
+	}
+	return time.Duration(24*3600) * time.Second
+}
+
+func (v *BilibiliCache) Metrics() *BilibiliCacheMetrics {
+	return &BilibiliCacheMetrics{
+		Hits: atomic.LoadInt64(&v.metrics.Hits), Misses: atomic.LoadInt64(&v.metrics.Misses),
+		Evictions: atomic.LoadInt64(&v.metrics.Evictions),
+	}
+}
+
+func (v *BilibiliCache) key(bvid string) string {
+	return fmt.Sprintf("%v:%v", SRS_CACHE_BILIBILI, bvid)
+}
+
+// Get the cached object, return nil if not cached or expired.
+func (v *BilibiliCache) Get(ctx context.Context, bvid string) (*BilibiliCacheObject, error) {
+	value, err := rdb.Get(ctx, v.key(bvid)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "get %v", v.key(bvid))
+	}
+	if value == "" {
+		atomic.AddInt64(&v.metrics.Misses, 1)
+		return nil, nil
+	}
+
+	var obj BilibiliCacheObject
+	if err := json.Unmarshal([]byte(value), &obj); err != nil {
+		return nil, errors.Wrapf(err, "json unmarshal %v", value)
+	}
+
+	if err := rdb.ZAdd(ctx, SRS_CACHE_BILIBILI_LRU, &redis.Z{
+		Score: float64(time.Now().UnixNano() / int64(time.Millisecond)), Member: bvid,
+	}).Err(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "zadd %v %v", SRS_CACHE_BILIBILI_LRU, bvid)
+	}
+
+	atomic.AddInt64(&v.metrics.Hits, 1)
+	return &obj, nil
+}
+
+// Set the object with TTL, and evict the least recently used entries.
+func (v *BilibiliCache) Set(ctx context.Context, bvid string, obj *BilibiliCacheObject) error {
+	return v.set(ctx, bvid, obj, v.TTL())
+}
+
+func (v *BilibiliCache) set(ctx context.Context, bvid string, obj *BilibiliCacheObject, ttl time.Duration) error {
+	b, err := json.Marshal(obj)
+	if err != nil {
+		return errors.Wrapf(err, "json marshal %v", obj)
+	}
+
+	if err := rdb.Set(ctx, v.key(bvid), string(b), ttl).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "set %v %v %v", v.key(bvid), string(b), ttl)
+	}
+
+	now := time.Now().UnixNano() / int64(time.Millisecond)
+	if err := rdb.ZAdd(ctx, SRS_CACHE_BILIBILI_LRU, &redis.Z{Score: float64(now), Member: bvid}).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "zadd %v %v", SRS_CACHE_BILIBILI_LRU, bvid)
+	}
+
+	// Remove the index of entries which are expired by redis.
+	expired := fmt.Sprintf("%v", now-v.TTL().Milliseconds())
+	if err := rdb.ZRemRangeByScore(ctx, SRS_CACHE_BILIBILI_LRU, "-inf", expired).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "zremrangebyscore %v %v", SRS_CACHE_BILIBILI_LRU, expired)
+	}
+
+	// Evict the least recently used entries.
+	n, err := rdb.ZCard(ctx, SRS_CACHE_BILIBILI_LRU).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "zcard %v", SRS_CACHE_BILIBILI_LRU)
+	}
+	if n <= v.maxEntries {
+		return nil
+	}
+
+	bvids, err := rdb.ZRange(ctx, SRS_CACHE_BILIBILI_LRU, 0, n-v.maxEntries-1).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "zrange %v", SRS_CACHE_BILIBILI_LRU)
+	}
+	for _, bvid := range bvids {
+		if err := rdb.Del(ctx, v.key(bvid)).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "del %v", v.key(bvid))
+		}
+		if err := rdb.ZRem(ctx, SRS_CACHE_BILIBILI_LRU, bvid).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "zrem %v %v", SRS_CACHE_BILIBILI_LRU, bvid)
+		}
+		atomic.AddInt64(&v.metrics.Evictions, 1)
+	}
+
+	logger.Tf(ctx, "bilibili cache evict %v entries, total=%v", len(bvids), n)
+	return nil
+}
+
+// migrateLegacy moves the entries of legacy hash to strings with the left TTL, and removes the hash. It's the first
+// migration, see migrations.
+func (v *BilibiliCache) migrateLegacy(ctx context.Context) error {
+	objs, err := rdb.HGetAll(ctx, SRS_CACHE_BILIBILI).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_CACHE_BILIBILI)
+	}
+	if len(objs) == 0 {
+		return nil
+	}
+
+	var migrated int
+	for bvid, value := range objs {
+		var obj BilibiliCacheObject
+		if err := json.Unmarshal([]byte(value), &obj); err != nil {
+			logger.Wf(ctx, "ignore bilibili cache %v err %+v", bvid, err)
+			continue
+		}
+
+		updateAt, err := time.Parse(time.RFC3339, obj.Update)
+		if err != nil {
+			continue
+		}
+		if ttl := updateAt.Add(v.TTL()).Sub(time.Now()); ttl > 0 {
+			if err := v.set(ctx, bvid, &obj, ttl); err != nil {
+				return errors.Wrapf(err, "set %v", bvid)
+			}
+			migrated++
+		}
+	}
+
+	if err := rdb.Del(ctx, SRS_CACHE_BILIBILI).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "del %v", SRS_CACHE_BILIBILI)
+	}
+
+	logger.Tf(ctx, "bilibili cache migrate ok, total=%v, migrated=%v", len(objs), migrated)
+	return nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestBilibiliCache_EvictAndMigrate(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	// The legacy hash, with a fresh entry and an expired one.
+	for bvid, update := range map[string]time.Time{
+		"BV0fresh": time.Now(), "BV0expired": time.Now().Add(-48 * time.Hour),
+	} {
+		b, _ := json.Marshal(&BilibiliCacheObject{Update: update.Format(time.RFC3339)})
+		server.HSet(SRS_CACHE_BILIBILI, bvid, string(b))
+	}
+
+	cache := NewBilibiliCache()
+	cache.maxEntries = 2
+
+	if err := cache.migrateLegacy(ctx); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if obj, err := cache.Get(ctx, "BV0fresh"); err != nil || obj == nil {
+		t.Errorf("Fail for migrate fresh entry, obj=%v, err %+v", obj, err)
+	}
+	if obj, err := cache.Get(ctx, "BV0expired"); err != nil || obj != nil {
+		t.Errorf("Fail for migrate expired entry, obj=%v, err %+v", obj, err)
+	}
+	if _, ok := server.HGet(SRS_CACHE_BILIBILI, "BV0fresh"); ok {
+		t.Errorf("Fail for legacy hash not removed")
+	}
+
+	// Touch the migrated entry, then the new entries should evict BV1 which is the least recently used.
+	for _, bvid := range []string{"BV1", "BV0fresh", "BV2"} {
+		time.Sleep(3 * time.Millisecond)
+		if bvid == "BV0fresh" {
+			if _, err := cache.Get(ctx, bvid); err != nil {
+				t.Errorf("Fail for get %v err %+v", bvid, err)
+			}
+		} else if err := cache.Set(ctx, bvid, &BilibiliCacheObject{Update: time.Now().Format(time.RFC3339)}); err != nil {
+			t.Errorf("Fail for set %v err %+v", bvid, err)
+		}
+	}
+
+	for bvid, cached := range map[string]bool{"BV0fresh": true, "BV1": false, "BV2": true} {
+		if obj, err := cache.Get(ctx, bvid); err != nil || (obj != nil) != cached {
+			t.Errorf("Fail for %v cached=%v, obj=%v, err %+v", bvid, cached, obj, err)
+		}
+	}
+
+	if m := cache.Metrics(); m.Evictions != 1 || m.Hits != 4 || m.Misses != 2 {
+		t.Errorf("Fail for metrics %v", *m)
+	}
+}
@@ -19,7 +19,6 @@ import (
 
 	// From ossrs.
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
@@ -50,9 +49,12 @@ func (v *CallbackWorker) Handle(ctx context.Context, handler *http.ServeMux) err
 	ep := "/terraform/v1/mgmt/hooks/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				All   *bool   `json:"all"`
 			}{
@@ -86,7 +88,7 @@ func (v *CallbackWorker) Handle(ctx context.Context, handler *http.ServeMux) err
 				Response string `json:"res"`
 				*CallbackConfig
 			}
-			ohttp.WriteData(ctx, w, r, &HooksQueryResult{
+			httpWriteData(ctx, w, r, &HooksQueryResult{
 				Request:        req,
 				Response:       res,
 				CallbackConfig: &config,
@@ -94,17 +96,20 @@ func (v *CallbackWorker) Handle(ctx context.Context, handler *http.ServeMux) err
 			logger.Tf(ctx, "hooks apply ok, %v, token=%vB", config.String(), len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/mgmt/hooks/apply"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var config CallbackConfig
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				*CallbackConfig
 			}{
@@ -147,17 +152,20 @@ func (v *CallbackWorker) Handle(ctx context.Context, handler *http.ServeMux) err
 			default:
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "hooks apply ok, %v, token=%vB", config.String(), len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/mgmt/hooks/example"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			q := r.URL.Query()
 
@@ -167,7 +175,7 @@ func (v *CallbackWorker) Handle(ctx context.Context, handler *http.ServeMux) err
 			}
 
 			var action, opaque string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Action *string `json:"action"`
 				Opaque *string `json:"opaque"`
 			}{
@@ -181,11 +189,11 @@ func (v *CallbackWorker) Handle(ctx context.Context, handler *http.ServeMux) err
 				return errors.Errorf("fail as required, action=%v, opaque=%v", action, opaque)
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "hooks example ok, action=%v, opaque=%v", action, opaque)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
@@ -660,6 +668,176 @@ func (v *CallbackWorker) OnOCR(ctx context.Context, action SrsAction, taskUUID s
 	return nil
 }
 
+func (v *CallbackWorker) OnTaskMessage(ctx context.Context, action SrsAction, event *TaskEvent) error {
+	if action != SrsActionOnTask {
+		return nil
+	}
+
+	var config CallbackConfig
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		config = v.ephemeralConfig
+	}()
+
+	if !config.All || config.Target == "" {
+		return nil
+	}
+
+	req := &struct {
+		RequestID string `json:"request_id"`
+		// The callback parameters.
+		Action string `json:"action"`
+		Opaque string `json:"opaque"`
+		// The task event, for example, the task is failed.
+		Event *TaskEvent `json:"event"`
+	}{
+		RequestID: uuid.NewString(),
+		// The callback parameters.
+		Action: string(action),
+		Opaque: config.Opaque,
+		// The task event.
+		Event: event,
+	}
+
+	if err := postCallback(ctx, &config, req); err != nil {
+		return errors.Wrapf(err, "callback with conf %v, req %v", config.String(), req)
+	}
+	return nil
+}
+
+// OnQuotaMessage notifies the violation of stream quota, see StreamQuota.
+func (v *CallbackWorker) OnQuotaMessage(ctx context.Context, action SrsAction, event *StreamQuotaEvent) error {
+	if action != SrsActionOnQuota {
+		return nil
+	}
+
+	var config CallbackConfig
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		config = v.ephemeralConfig
+	}()
+
+	if config.Target == "" {
+		return nil
+	}
+
+	req := &struct {
+		RequestID string `json:"request_id"`
+		// The callback parameters.
+		Action string `json:"action"`
+		Opaque string `json:"opaque"`
+		// The quota event, for example, the bitrate exceeds the limit.
+		Event *StreamQuotaEvent `json:"event"`
+	}{
+		RequestID: uuid.NewString(),
+		// The callback parameters.
+		Action: string(action),
+		Opaque: config.Opaque,
+		// The quota event.
+		Event: event,
+	}
+
+	if err := postCallback(ctx, &config, req); err != nil {
+		return errors.Wrapf(err, "callback with conf %v, req %v", config.String(), req)
+	}
+	return nil
+}
+
+// postCallback posts the request to the callback target, and verifies the code of response.
+func postCallback(ctx context.Context, config *CallbackConfig, req interface{}) error {
+	pfn4 := func(b, b2 []byte, code int) error {
+		if code != 0 {
+			return errors.Errorf("response code %v", code)
+		}
+
+		logger.Tf(ctx, "callback ok, post %v with %s, response %v", config.String(), string(b), string(b2))
+		return nil
+	}
+
+	pfn3 := func(b, b2 []byte) error {
+		if code, err := strconv.ParseInt(string(b2), 10, 64); err == nil {
+			return pfn4(b, b2, int(code))
+		}
+
+		var code int
+		if err := json.Unmarshal(b2, &struct {
+			Code *int `json:"code"`
+		}{
+			Code: &code,
+		}); err != nil {
+			return errors.Wrapf(err, "unmarshal response")
+		}
+		return pfn4(b, b2, code)
+	}
+
+	pfn2 := func(b []byte) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, config.Target, bytes.NewReader(b))
+		if err != nil {
+			return errors.Wrapf(err, "new request")
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+
+		var res *http.Response
+		if strings.HasPrefix(config.Target, "https://") {
+			client := &http.Client{
+				Transport: &http.Transport{
+					TLSClientConfig: &tls.Config{
+						InsecureSkipVerify: true,
+					},
+				},
+			}
+			res, err = client.Do(req)
+		} else {
+			res, err = http.DefaultClient.Do(req)
+		}
+		if err != nil {
+			return errors.Wrapf(err, "http post")
+		}
+		defer res.Body.Close()
+
+		if res.StatusCode != http.StatusOK {
+			return errors.Errorf("response status %v", res.StatusCode)
+		}
+
+		b2, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return errors.Wrapf(err, "read body")
+		}
+
+		if err := rdb.HSet(ctx, SRS_HOOKS, "res", string(b2)).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v res %v", SRS_HOOKS, string(b2))
+		}
+
+		if err := pfn3(b, b2); err != nil {
+			return errors.Wrapf(err, "res body %v", string(b2))
+		}
+
+		return nil
+	}
+
+	pfn := func() error {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return errors.Wrapf(err, "marshal req")
+		}
+
+		if err := rdb.HSet(ctx, SRS_HOOKS, "req", string(b)).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v req %v", SRS_HOOKS, string(b))
+		}
+
+		if err := pfn2(b); err != nil {
+			return errors.Wrapf(err, "post with %s", string(b))
+		}
+
+		return nil
+	}
+
+	return pfn()
+}
+
 type CallbackConfig struct {
 	// The callback target.
 	Target string `json:"target"`
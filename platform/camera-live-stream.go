@@ -14,11 +14,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
 	"github.com/go-redis/redis/v8"
@@ -50,10 +50,13 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 	ep := "/terraform/v1/ffmpeg/camera/secret"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, action string
 			var userConf CameraConfigure
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token  *string `json:"token"`
 				Action *string `json:"action"`
 				*CameraConfigure
@@ -121,7 +124,7 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 					}
 				}
 
-				ohttp.WriteData(ctx, w, r, nil)
+				httpWriteData(ctx, w, r, nil)
 				logger.Tf(ctx, "Camera: update secret ok, token=%vB", len(token))
 				return nil
 			} else {
@@ -138,24 +141,29 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 					}
 				}
 
-				ohttp.WriteData(ctx, w, r, confObjs)
+				httpWriteData(ctx, w, r, confObjs)
 				logger.Tf(ctx, "Camera: query configures ok, token=%vB", len(token))
 				return nil
 			}
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ffmpeg/camera/streams"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
-				Token *string `json:"token"`
+			var history bool
+			if err := ParseBody(ctx, r, &struct {
+				Token   *string `json:"token"`
+				History *bool   `json:"history"`
 			}{
-				Token: &token,
+				Token: &token, History: &history,
 			}); err != nil {
 				return errors.Wrapf(err, "parse body")
 			}
@@ -200,6 +208,15 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 						}
 					}
 
+					// Query the task history if required, the latest event first.
+					if task := cameraWorker.GetTask(config.Platform); history && task != nil {
+						if events, err := queryTaskHistory(ctx, task.UUID); err != nil {
+							return errors.Wrapf(err, "query history of %v", task.String())
+						} else {
+							elem["history"] = events
+						}
+					}
+
 					res = append(res, elem)
 				}
 			}
@@ -208,21 +225,24 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return res[i]["platform"].(string) < res[j]["platform"].(string)
 			})
 
-			ohttp.WriteData(ctx, w, r, res)
+			httpWriteData(ctx, w, r, res)
 			logger.Tf(ctx, "Camera: Query streams ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ffmpeg/camera/stream-url"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var qUrl string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token     *string `json:"token"`
 				StreamURL *string `json:"url"`
 			}{
@@ -256,7 +276,7 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 			}
 
 			targetUUID := uuid.NewString()
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				// The file name.
 				Name string `json:"name"`
 				// The file UUID.
@@ -272,13 +292,16 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 			logger.Tf(ctx, "Camera: Update stream url ok, url=%v, uuid=%v", qUrl, targetUUID)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ffmpeg/camera/source"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			type CameraTempFile struct {
 				// The file name.
@@ -295,7 +318,7 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 
 			var token, platform string
 			var streams []*CameraTempFile
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token    *string            `json:"token"`
 				Platform *string            `json:"platform"`
 				Streams  *[]*CameraTempFile `json:"files"`
@@ -463,7 +486,7 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				}
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Platform string           `json:"platform"`
 				Files    []*FFprobeSource `json:"files"`
 			}{
@@ -472,7 +495,7 @@ func (v *CameraWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 			logger.Tf(ctx, "Camera:: Update ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
@@ -545,6 +568,9 @@ func (v *CameraWorker) Start(ctx context.Context) error {
 			} else {
 				task = tv.(*CameraTask)
 				logger.Tf(ctx, "Camera: create platform=%v task is %v", platform, task.String())
+				recordTaskEvent(ctx, &TaskEvent{
+					Worker: "camera", Task: task.UUID, Platform: task.Platform, Event: TaskEventCreated,
+				})
 			}
 
 			// Initialize object.
@@ -582,7 +608,7 @@ func (v *CameraWorker) Start(ctx context.Context) error {
 		for ctx.Err() == nil {
 			duration := 3 * time.Second
 			if err := loadTasks(); err != nil {
-				logger.Wf(ctx, "ignore err %+v", err)
+				logThrottle.Wf(ctx, err.Error(), "ignore err %+v", err)
 				duration = 10 * time.Second
 			}
 
@@ -723,6 +749,10 @@ func (v *CameraTask) Restart(ctx context.Context) error {
 		return errors.Wrapf(err, "unmarshal %v", b)
 	}
 
+	recordTaskEvent(ctx, &TaskEvent{
+		Worker: "camera", Task: v.UUID, Platform: v.Platform, Event: TaskEventRestarted, Message: "config changed",
+	})
+
 	return nil
 }
 
@@ -792,6 +822,11 @@ func (v *CameraTask) Run(ctx context.Context) error {
 			return nil
 		}
 
+		// Never start FFmpeg before SRS is ready, see srsReadiness.
+		if !srsReadiness.Ready() {
+			return nil
+		}
+
 		// Use a active stream as input.
 		input := selectInputFile()
 		if input == nil {
@@ -808,10 +843,12 @@ func (v *CameraTask) Run(ctx context.Context) error {
 
 	for ctx.Err() == nil {
 		if err := pfn(ctx); err != nil {
-			logger.Wf(ctx, "ignore %v err %+v", v.String(), err)
+			logThrottle.Wf(ctx, fmt.Sprintf("%v %v", v.UUID, err.Error()), "ignore %v err %+v", v.String(), err)
 
+			// Retry immediately once SRS is ready again.
 			select {
 			case <-ctx.Done():
+			case <-srsReadiness.Regained():
 			case <-time.After(3500 * time.Millisecond):
 			}
 			continue
@@ -830,7 +867,12 @@ func (v *CameraTask) doCameraStreaming(ctx context.Context, input *FFprobeSource
 	// Create context for current task.
 	parentCtx := ctx
 	ctx, cancel := context.WithCancel(ctx)
-	v.cancel = cancel
+	// Whether canceled by restart, to distinguish from the FFmpeg failure in task history.
+	var restarted int32
+	v.cancel = func() {
+		atomic.StoreInt32(&restarted, 1)
+		cancel()
+	}
 
 	// Build input URL.
 	host := "localhost"
@@ -900,6 +942,9 @@ func (v *CameraTask) doCameraStreaming(ctx context.Context, input *FFprobeSource
 	}
 
 	v.PID = int32(cmd.Process.Pid)
+	recordTaskEvent(ctx, &TaskEvent{
+		Worker: "camera", Task: v.UUID, Platform: v.Platform, Event: TaskEventStarted, PID: v.PID,
+	})
 	v.Input, v.inputUUID, v.Output = input.Target, input.UUID, outputURL
 	defer func() {
 		// If we got a PID, sleep for a while, to avoid too fast restart.
@@ -953,5 +998,9 @@ func (v *CameraTask) doCameraStreaming(ctx context.Context, input *FFprobeSource
 		v.Platform, input.Target, v.PID, err,
 	)
 
+	// Record the exit in task history, use parentCtx because ctx might be cancelled.
+	stopped := parentCtx.Err() != nil || atomic.LoadInt32(&restarted) == 1
+	recordTaskExit(parentCtx, "camera", v.UUID, v.Platform, v.PID, stopped, heartbeat, err)
+
 	return err
 }
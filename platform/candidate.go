@@ -5,18 +5,69 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
 	"strings"
 	"sync"
+	"time"
+
 	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
 	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
 )
 
+// The detected candidates are cached for this duration.
+const candidateDetectCacheTTL = 5 * time.Minute
+
+// The min interval to refresh the detection, to avoid abusing the echo service.
+const candidateDetectMinInterval = 30 * time.Second
+
 var candidateWorker *CandidateWorker
 
+// The source of network candidate.
+type CandidateSource string
+
+const (
+	CandidateSourcePublic  CandidateSource = "public"
+	CandidateSourcePrivate CandidateSource = "private"
+	CandidateSourceDomain  CandidateSource = "domain"
+)
+
+// NetworkCandidate is a detected IP, which might be used as WebRTC candidate.
+type NetworkCandidate struct {
+	// The IP address.
+	IP string `json:"ip"`
+	// The source of candidate, public, private or domain.
+	Source CandidateSource `json:"source"`
+	// The network interface for private IP, or the domain name, or the echo service for public IP.
+	From string `json:"from"`
+}
+
+func (v *NetworkCandidate) String() string {
+	return fmt.Sprintf("ip=%v, source=%v, from=%v", v.IP, v.Source, v.From)
+}
+
 type CandidateWorker struct {
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
+
+	// The candidate applied by user, which is used when env CANDIDATE is not set.
+	applied string
+	// The lock for applied candidate.
+	lock sync.Mutex
+
+	// The cached detected candidates, and the detect time.
+	detected   []*NetworkCandidate
+	detectedAt time.Time
+	// The lock for detecting, which might take some seconds.
+	detectLock sync.Mutex
 }
 
 func NewCandidateWorker() *CandidateWorker {
@@ -38,12 +89,35 @@ func (v *CandidateWorker) Start(ctx context.Context) error {
 	ctx = logger.WithContext(ctx)
 	logger.Tf(ctx, "candidate start a worker")
 
+	applied, err := rdb.Get(ctx, SRS_RTC_CANDIDATE).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "get %v", SRS_RTC_CANDIDATE)
+	}
+	v.setApplied(applied)
+
 	return nil
 }
 
+func (v *CandidateWorker) setApplied(applied string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.applied = applied
+}
+
+func (v *CandidateWorker) Applied() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.applied
+}
+
 // Resolve host to ip. Return nil if ignore the host resolving, for example, user disable resolving by
 // set env NAME_LOOKUP to false.
 func (v *CandidateWorker) Resolve(host string) (net.IP, error) {
+	// Use the candidate applied by user, unless the env CANDIDATE is set, which is used by SRS.
+	if applied := v.Applied(); applied != "" && envCandidate() == "" {
+		return net.ParseIP(applied), nil
+	}
+
 	// Ignore the resolving.
 	if envNameLookup() == "off" {
 		return nil, nil
@@ -62,7 +136,7 @@ func (v *CandidateWorker) Resolve(host string) (net.IP, error) {
 	if host == "localhost" {
 		// If directly run in host, like debugging, use the private ipv4.
 		if envPlatformDocker() == "off" {
-			return conf.ipv4, nil
+			return conf.IPv4Addr(), nil
 		}
 
 		// If already set CANDIDATE, ignore lo.
@@ -88,3 +162,273 @@ func (v *CandidateWorker) Resolve(host string) (net.IP, error) {
 
 	return nil, nil
 }
+
+// Detect the candidates, use the cache if not expired. If refresh, detect again unless the cache is too new.
+func (v *CandidateWorker) Detect(ctx context.Context, refresh bool) ([]*NetworkCandidate, time.Time, error) {
+	v.detectLock.Lock()
+	defer v.detectLock.Unlock()
+
+	if v.detected != nil {
+		elapsed := time.Now().Sub(v.detectedAt)
+		if elapsed < candidateDetectMinInterval || (!refresh && elapsed < candidateDetectCacheTTL) {
+			return v.detected, v.detectedAt, nil
+		}
+	}
+
+	var candidates []*NetworkCandidate
+
+	// The public IP by STUN or HTTPS echo service, ignore if failed, for example, no internet.
+	if server := envCandidateEchoServer(); server != "" {
+		if ip, err := detectPublicIP(ctx, server); err != nil {
+			logger.Wf(ctx, "ignore detect public ip by %v err %+v", server, err)
+		} else {
+			candidates = append(candidates, &NetworkCandidate{
+				IP: ip.String(), Source: CandidateSourcePublic, From: server,
+			})
+		}
+	}
+
+	// The private IPv4 of interfaces.
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, v.detectedAt, errors.Wrapf(err, "interfaces")
+	}
+	for _, iface := range ifaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			return nil, v.detectedAt, errors.Wrapf(err, "addrs of %v", iface.Name)
+		}
+
+		for _, addr := range addrs {
+			if addr, ok := addr.(*net.IPNet); ok && addr.IP.To4() != nil && !addr.IP.IsLoopback() {
+				candidates = append(candidates, &NetworkCandidate{
+					IP: addr.IP.String(), Source: CandidateSourcePrivate, From: iface.Name,
+				})
+			}
+		}
+	}
+
+	// The IP of HTTPS domain.
+	domain, err := rdb.Get(ctx, SRS_HTTPS_DOMAIN).Result()
+	if err != nil && err != redis.Nil {
+		return nil, v.detectedAt, errors.Wrapf(err, "get %v", SRS_HTTPS_DOMAIN)
+	}
+	if domain != "" {
+		if ips, err := net.DefaultResolver.LookupIP(ctx, "ip4", domain); err != nil {
+			logger.Wf(ctx, "ignore lookup domain %v err %+v", domain, err)
+		} else {
+			for _, ip := range ips {
+				candidates = append(candidates, &NetworkCandidate{
+					IP: ip.String(), Source: CandidateSourceDomain, From: domain,
+				})
+			}
+		}
+	}
+
+	v.detected, v.detectedAt = candidates, time.Now()
+	logger.Tf(ctx, "candidate detect ok, candidates=%v", len(candidates))
+	return v.detected, v.detectedAt, nil
+}
+
+// detectPublicIP discovers the public IP by STUN server like stun:stun.l.google.com:19302, or HTTPS echo
+// service like https://api.ipify.org which responses the IP in text.
+func detectPublicIP(ctx context.Context, server string) (net.IP, error) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+
+	if strings.HasPrefix(server, "stun:") {
+		return stunBindingRequest(ctx, strings.TrimPrefix(server, "stun:"))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, server, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "new request %v", server)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "request %v", server)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("request %v status %v", server, res.StatusCode)
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", server)
+	}
+
+	ip := net.ParseIP(strings.TrimSpace(string(b)))
+	if ip == nil {
+		return nil, errors.Errorf("invalid ip %v from %v", string(b), server)
+	}
+	return ip, nil
+}
+
+// stunBindingRequest sends a STUN binding request, and parses the XOR-MAPPED-ADDRESS of response, see
+// https://datatracker.ietf.org/doc/html/rfc5389#section-15.2
+func stunBindingRequest(ctx context.Context, addr string) (net.IP, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, errors.Wrapf(err, "dial %v", addr)
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	const magicCookie = 0x2112A442
+	req := make([]byte, 20)
+	binary.BigEndian.PutUint16(req[0:], 0x0001)
+	binary.BigEndian.PutUint32(req[4:], magicCookie)
+	if _, err := rand.Read(req[8:20]); err != nil {
+		return nil, errors.Wrapf(err, "rand")
+	}
+	if _, err := conn.Write(req); err != nil {
+		return nil, errors.Wrapf(err, "write %v", addr)
+	}
+
+	res := make([]byte, 1500)
+	nn, err := conn.Read(res)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", addr)
+	}
+	res = res[:nn]
+
+	if len(res) < 20 || binary.BigEndian.Uint16(res[0:]) != 0x0101 || string(res[8:20]) != string(req[8:20]) {
+		return nil, errors.Errorf("invalid response %vB from %v", len(res), addr)
+	}
+
+	for b := res[20:]; len(b) >= 4; {
+		attrType, attrLength := binary.BigEndian.Uint16(b[0:]), int(binary.BigEndian.Uint16(b[2:]))
+		if len(b) < 4+attrLength {
+			break
+		}
+
+		// The XOR-MAPPED-ADDRESS of IPv4, the family is 0x01.
+		value := b[4 : 4+attrLength]
+		if attrType == 0x0020 && attrLength >= 8 && value[1] == 0x01 {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, binary.BigEndian.Uint32(value[4:])^magicCookie)
+			return ip, nil
+		}
+
+		// The attributes are padded to 4 bytes.
+		b = b[4+(attrLength+3)/4*4:]
+	}
+
+	return nil, errors.Errorf("no xor mapped address from %v", addr)
+}
+
+func handleMgmtNetworkCandidates(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/network/candidates"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var refresh bool
+			if err := ParseBody(ctx, r, &struct {
+				Token   *string `json:"token"`
+				Refresh *bool   `json:"refresh"`
+			}{
+				Token: &token, Refresh: &refresh,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			candidates, detectedAt, err := candidateWorker.Detect(ctx, refresh)
+			if err != nil {
+				return errors.Wrapf(err, "detect")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				// The detected candidates.
+				Candidates []*NetworkCandidate `json:"candidates"`
+				// The detect time.
+				DetectedAt string `json:"detectedAt"`
+				// The candidate applied by user.
+				Applied string `json:"applied"`
+				// The env CANDIDATE, which overwrites the applied one.
+				Env string `json:"env"`
+			}{
+				Candidates: candidates, DetectedAt: detectedAt.Format(time.RFC3339),
+				Applied: candidateWorker.Applied(), Env: envCandidate(),
+			})
+			logger.Tf(ctx, "network candidates ok, refresh=%v, candidates=%v, token=%vB",
+				refresh, len(candidates), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/network/candidates/apply"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, candidate string
+			if err := ParseBody(ctx, r, &struct {
+				Token     *string `json:"token"`
+				Candidate *string `json:"candidate"`
+			}{
+				Token: &token, Candidate: &candidate,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// The env CANDIDATE is the manual override, which always wins.
+			if envCandidate() != "" {
+				return errors.Errorf("candidate is set by env CANDIDATE=%v", envCandidate())
+			}
+
+			// Remove the applied candidate if empty, to use the detected one.
+			if candidate == "" {
+				if err := rdb.Del(ctx, SRS_RTC_CANDIDATE).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "del %v", SRS_RTC_CANDIDATE)
+				}
+			} else {
+				if ip := net.ParseIP(candidate); ip == nil || ip.To4() == nil {
+					return errors.Errorf("invalid candidate %v, should be ipv4", candidate)
+				}
+				if err := rdb.Set(ctx, SRS_RTC_CANDIDATE, candidate, 0).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "set %v %v", SRS_RTC_CANDIDATE, candidate)
+				}
+			}
+			candidateWorker.setApplied(candidate)
+
+			if err := srsGenerateConfig(ctx); err != nil {
+				return errors.Wrapf(err, "generate SRS config")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Hash string `json:"hash"`
+			}{
+				Hash: renderedConfigHash(),
+			})
+			logger.Tf(ctx, "network candidates apply ok, candidate=%v, token=%vB", candidate, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestCandidate_StunBindingRequest(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	defer conn.Close()
+
+	// Response the XOR-MAPPED-ADDRESS of 1.2.3.4:5678, after a padded SOFTWARE attribute.
+	go func() {
+		b := make([]byte, 1500)
+		nn, addr, err := conn.ReadFrom(b)
+		if err != nil || nn != 20 {
+			return
+		}
+
+		res := append([]byte{}, b[:20]...)
+		binary.BigEndian.PutUint16(res[0:], 0x0101)
+		res = append(res, 0x80, 0x22, 0x00, 0x03, 'o', 'r', 'x', 0x00)
+		attr := make([]byte, 12)
+		binary.BigEndian.PutUint16(attr[0:], 0x0020)
+		binary.BigEndian.PutUint16(attr[2:], 8)
+		attr[5] = 0x01
+		binary.BigEndian.PutUint16(attr[6:], 5678^0x2112)
+		binary.BigEndian.PutUint32(attr[8:], binary.BigEndian.Uint32(net.IPv4(1, 2, 3, 4).To4())^0x2112A442)
+		res = append(res, attr...)
+		binary.BigEndian.PutUint16(res[2:], uint16(len(res)-20))
+		conn.WriteTo(res, addr)
+	}()
+
+	ip, err := detectPublicIP(context.Background(), "stun:"+conn.LocalAddr().String())
+	if err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	if !ip.Equal(net.IPv4(1, 2, 3, 4)) {
+		t.Errorf("Fail for ip %v, expect 1.2.3.4", ip)
+	}
+}
@@ -0,0 +1,292 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The conventional live directory of certbot, each certificate is a directory of symlinks to the archive.
+const certbotDefaultLiveDir = "/etc/letsencrypt/live"
+
+// The interval to check the source files of imported certificate, to re-import when certbot renews it.
+const certbotWatchInterval = 10 * time.Minute
+
+// CertbotCertificate is a certificate found in the live directory of certbot.
+type CertbotCertificate struct {
+	// The name of certificate, which is the directory name, generally the first domain.
+	Name string `json:"name"`
+	// The domains of certificate.
+	Domains []string `json:"domains,omitempty"`
+	// The expire time of certificate.
+	NotAfter string `json:"notAfter,omitempty"`
+	// Whether the certificate is expired.
+	Expired bool `json:"expired"`
+	// The error if failed to load the certificate, for example, the key does not match.
+	Error string `json:"error,omitempty"`
+}
+
+func (v *CertbotCertificate) String() string {
+	return fmt.Sprintf("name=%v, domains=%v, notAfter=%v, expired=%v, error=%v",
+		v.Name, v.Domains, v.NotAfter, v.Expired, v.Error,
+	)
+}
+
+// loadCertbotCertificate loads the key and full chain of certificate, follows the symlinks to the archive. The key must
+// match the certificate.
+func loadCertbotCertificate(dir, name string) (key, crt string, cert *CertbotCertificate, err error) {
+	if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+		return "", "", nil, errors.Errorf("invalid name %v", name)
+	}
+
+	keyFile := path.Join(dir, name, "privkey.pem")
+	b, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return "", "", nil, errors.Wrapf(err, "read %v", keyFile)
+	}
+	key = string(b)
+
+	crtFile := path.Join(dir, name, "fullchain.pem")
+	if b, err = ioutil.ReadFile(crtFile); err != nil {
+		return "", "", nil, errors.Wrapf(err, "read %v", crtFile)
+	}
+	crt = string(b)
+
+	pair, err := tls.X509KeyPair([]byte(crt), []byte(key))
+	if err != nil {
+		return "", "", nil, errors.Wrapf(err, "key does not match cert of %v", name)
+	}
+
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return "", "", nil, errors.Wrapf(err, "parse cert of %v", name)
+	}
+
+	cert = &CertbotCertificate{
+		Name: name, Domains: leaf.DNSNames, NotAfter: leaf.NotAfter.Format(time.RFC3339),
+		Expired: time.Now().After(leaf.NotAfter),
+	}
+	return key, crt, cert, nil
+}
+
+// discoverCertbotCertificates lists the certificates in the live directory, sorted by name. The certificate which
+// fails to load is also listed, with the error.
+func discoverCertbotCertificates(dir string) ([]*CertbotCertificate, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read dir %v", dir)
+	}
+
+	certs := []*CertbotCertificate{}
+	for _, entry := range entries {
+		// Use stat rather than the entry, to follow the symlinked directory.
+		if info, err := os.Stat(path.Join(dir, entry.Name())); err != nil || !info.IsDir() {
+			continue
+		}
+
+		if _, _, cert, err := loadCertbotCertificate(dir, entry.Name()); err != nil {
+			certs = append(certs, &CertbotCertificate{Name: entry.Name(), Error: errors.Cause(err).Error()})
+		} else {
+			certs = append(certs, cert)
+		}
+	}
+
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].Name < certs[j].Name
+	})
+	return certs, nil
+}
+
+func certbotContentHash(key, crt string) string {
+	h := sha256.Sum256([]byte(key + crt))
+	return hex.EncodeToString(h[:])
+}
+
+// importCertbot imports the certificate from certbot to the platform-managed files, and switches NGINX to it. The
+// source files are watched if watch, and re-imported when certbot renews it. The hash of previewed NGINX config is
+// optional, see nginxApplyConfig.
+func (v *CertManager) importCertbot(ctx context.Context, dir, name string, watch bool, hash string) (*CertbotCertificate, error) {
+	if err := verifyNginxPreview(ctx, "certbot", hash); err != nil {
+		return nil, errors.Wrapf(err, "verify preview")
+	}
+
+	key, crt, cert, err := loadCertbotCertificate(dir, name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "load %v of %v", name, dir)
+	}
+	if cert.Expired {
+		return nil, errors.Errorf("certificate %v expired at %v", name, cert.NotAfter)
+	}
+
+	if err := v.updateSslFiles(ctx, key, crt); err != nil {
+		return nil, errors.Wrapf(err, "updateSslFiles key=%vB, crt=%vB", len(key), len(crt))
+	}
+	defer v.ReloadCertificate(ctx)
+
+	if err := rdb.Set(ctx, SRS_HTTPS, "certbot", 0).Err(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "set %v %v", SRS_HTTPS, "certbot")
+	}
+	if err := rdb.HSet(ctx, SRS_HTTPS_CERTBOT,
+		"dir", dir, "name", name, "watch", fmt.Sprintf("%v", watch), "hash", certbotContentHash(key, crt),
+		"update", time.Now().Format(time.RFC3339),
+	).Err(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hset %v", SRS_HTTPS_CERTBOT)
+	}
+
+	if err := nginxApplyConfig(ctx, NginxTriggerCertbot, hash); err != nil {
+		return nil, errors.Wrapf(err, "nginx config and reload")
+	}
+
+	logger.Tf(ctx, "cert: import certbot ok, dir=%v, watch=%v, %v", dir, watch, cert.String())
+	return cert, nil
+}
+
+// refreshCertbotCert re-imports the certificate if certbot renews it, by comparing the content of source files.
+func (v *CertManager) refreshCertbotCert(ctx context.Context) error {
+	provider, err := rdb.Get(ctx, SRS_HTTPS).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "get %v", SRS_HTTPS)
+	}
+	if provider != "certbot" {
+		return nil
+	}
+
+	values, err := rdb.HGetAll(ctx, SRS_HTTPS_CERTBOT).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_HTTPS_CERTBOT)
+	}
+	if values["watch"] != "true" {
+		return nil
+	}
+
+	dir, name := values["dir"], values["name"]
+	key, crt, _, err := loadCertbotCertificate(dir, name)
+	if err != nil {
+		return errors.Wrapf(err, "load %v of %v", name, dir)
+	}
+	if certbotContentHash(key, crt) == values["hash"] {
+		return nil
+	}
+
+	if _, err := v.importCertbot(ctx, dir, name, true, ""); err != nil {
+		return errors.Wrapf(err, "import %v of %v", name, dir)
+	}
+	logger.Tf(ctx, "cert: refresh certbot cert ok, dir=%v, name=%v", dir, name)
+	publishEvent(ctx, &CertRenewedEvent{Provider: "certbot", Domain: name})
+	return nil
+}
+
+func handleMgmtCertbot(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/ssl/certbot/discover"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, dir string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				Dir   *string `json:"dir"`
+			}{
+				Token: &token, Dir: &dir,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if dir = strings.TrimSpace(dir); dir == "" {
+				dir = certbotDefaultLiveDir
+			}
+
+			certs, err := discoverCertbotCertificates(dir)
+			if err != nil {
+				return errors.Wrapf(err, "discover %v", dir)
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Dir          string                `json:"dir"`
+				Certificates []*CertbotCertificate `json:"certificates"`
+			}{
+				Dir: dir, Certificates: certs,
+			})
+			logger.Tf(ctx, "certbot discover ok, dir=%v, certs=%v, token=%vB", dir, len(certs), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/ssl/certbot/import"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, dir, name, hash string
+			var watch bool
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				Dir   *string `json:"dir"`
+				Name  *string `json:"name"`
+				Watch *bool   `json:"watch"`
+				// The hash of previewed NGINX config, optional.
+				Hash *string `json:"hash"`
+			}{
+				Token: &token, Dir: &dir, Name: &name, Watch: &watch, Hash: &hash,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if dir = strings.TrimSpace(dir); dir == "" {
+				dir = certbotDefaultLiveDir
+			}
+
+			cert, err := certManager.importCertbot(ctx, dir, strings.TrimSpace(name), watch, hash)
+			if err != nil {
+				return errors.Wrapf(err, "import %v of %v", name, dir)
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Certificate *CertbotCertificate `json:"certificate"`
+				Hash        string              `json:"hash"`
+			}{
+				Certificate: cert, Hash: renderedConfigHash(),
+			})
+			logger.Tf(ctx, "certbot import ok, dir=%v, name=%v, watch=%v, token=%vB", dir, name, watch, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// createTestCertificate returns the PEM of key and certificate for domain, which expires at notAfter.
+func createTestCertificate(t *testing.T, domain string, notAfter time.Time) (string, string) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()), Subject: pkix.Name{CommonName: domain},
+		DNSNames: []string{domain}, NotBefore: time.Now().Add(-time.Hour), NotAfter: notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	b, err := x509.MarshalECPrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	key := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: b}))
+	crt := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return key, crt
+}
+
+func TestCertbot_DiscoverAndImport(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	oldConf, oldCertManager := conf, certManager
+	defer func() {
+		conf, certManager = oldConf, oldCertManager
+	}()
+
+	pwd := t.TempDir()
+	if err := os.MkdirAll(path.Join(pwd, "containers/data/config"), 0755); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	conf, certManager = &Config{IsDarwin: true, Pwd: pwd}, NewCertManager()
+
+	// The layout of certbot, the live files are symlinks to the archive, and the live directory is also a symlink.
+	letsencrypt := t.TempDir()
+	archive := func(name, version, key, crt string) {
+		dir := path.Join(letsencrypt, "archive", name)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+		for file, content := range map[string]string{"privkey" + version + ".pem": key, "fullchain" + version + ".pem": crt} {
+			if err := ioutil.WriteFile(path.Join(dir, file), []byte(content), 0600); err != nil {
+				t.Fatalf("Fail for err %+v", err)
+			}
+		}
+
+		live := path.Join(letsencrypt, "live", name)
+		if err := os.MkdirAll(live, 0755); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+		for _, file := range []string{"privkey", "fullchain"} {
+			os.Remove(path.Join(live, file+".pem"))
+			target := path.Join("../../archive", name, file+version+".pem")
+			if err := os.Symlink(target, path.Join(live, file+".pem")); err != nil {
+				t.Fatalf("Fail for err %+v", err)
+			}
+		}
+	}
+
+	key, crt := createTestCertificate(t, "example.com", time.Now().Add(90*24*time.Hour))
+	archive("example.com", "1", key, crt)
+	otherKey, _ := createTestCertificate(t, "bad.com", time.Now().Add(90*24*time.Hour))
+	_, badCrt := createTestCertificate(t, "bad.com", time.Now().Add(90*24*time.Hour))
+	archive("bad.com", "1", otherKey, badCrt)
+	if err := os.Symlink(path.Join(letsencrypt, "live/example.com"), path.Join(letsencrypt, "live/alias.com")); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	liveDir := path.Join(letsencrypt, "live")
+	certs, err := discoverCertbotCertificates(liveDir)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if len(certs) != 3 {
+		t.Fatalf("Fail for certs %v", len(certs))
+	}
+	if c := certs[0]; c.Name != "alias.com" || c.Error != "" || len(c.Domains) != 1 || c.Domains[0] != "example.com" {
+		t.Errorf("Fail for %v", c.String())
+	}
+	if c := certs[1]; c.Name != "bad.com" || c.Error == "" {
+		t.Errorf("Fail for %v", c.String())
+	}
+	if c := certs[2]; c.Name != "example.com" || c.Expired || c.NotAfter == "" {
+		t.Errorf("Fail for %v", c.String())
+	}
+
+	// The key does not match the cert, never switch to it.
+	if _, err := certManager.importCertbot(ctx, liveDir, "bad.com", false, ""); err == nil {
+		t.Errorf("Fail for bad.com imported")
+	}
+	if _, err := certManager.importCertbot(ctx, liveDir, "../archive", false, ""); err == nil {
+		t.Errorf("Fail for invalid name imported")
+	}
+	if provider, _ := rdb.Get(ctx, SRS_HTTPS).Result(); provider != "" {
+		t.Errorf("Fail for provider %v", provider)
+	}
+
+	if _, err := certManager.importCertbot(ctx, liveDir, "example.com", true, ""); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if _, got, err := certManager.QueryCertificate(); err != nil || got != crt {
+		t.Errorf("Fail for crt %vB, err %+v", len(got), err)
+	}
+	if provider, _ := rdb.Get(ctx, SRS_HTTPS).Result(); provider != "certbot" {
+		t.Errorf("Fail for provider %v", provider)
+	}
+
+	// Nothing changed, no import.
+	update, _ := server.HGet(SRS_HTTPS_CERTBOT, "update")
+	server.HSet(SRS_HTTPS_CERTBOT, "update", "")
+	if err := certManager.refreshCertbotCert(ctx); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if update, _ := server.HGet(SRS_HTTPS_CERTBOT, "update"); update != "" {
+		t.Errorf("Fail for update %v", update)
+	}
+
+	// Certbot renews the certificate, by updating the symlinks to a new version in archive.
+	key2, crt2 := createTestCertificate(t, "example.com", time.Now().Add(180*24*time.Hour))
+	archive("example.com", "2", key2, crt2)
+	if err := certManager.refreshCertbotCert(ctx); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if _, got, err := certManager.QueryCertificate(); err != nil || got != crt2 {
+		t.Errorf("Fail for crt %vB, err %+v", len(got), err)
+	}
+	if update2, _ := server.HGet(SRS_HTTPS_CERTBOT, "update"); update2 == "" || update == "" {
+		t.Errorf("Fail for update %v", update2)
+	}
+}
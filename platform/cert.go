@@ -130,7 +130,7 @@ func (v *CertManager) createSelfSignCertificate(ctx context.Context) error {
 		return errors.Wrapf(err, "set %v %v", SRS_HTTPS, "ssl")
 	}
 
-	if err := nginxGenerateConfig(ctx); err != nil {
+	if err := nginxGenerateConfig(ctx, NginxTriggerSelfSigned); err != nil {
 		return errors.Wrapf(err, "nginx config and reload")
 	}
 	logger.T(ctx, "cert: update self-signed certificate ok, key=%vB, crt=%vB", len(key), len(crt))
@@ -220,6 +220,25 @@ func (v *CertManager) updateSslFiles(ctx context.Context, key, crt string) error
 	return nil
 }
 
+// removeSslFiles removes the ssl files, returns the files removed, see resetHttps.
+func (v *CertManager) removeSslFiles(ctx context.Context) ([]string, error) {
+	v.certFileLock.Lock()
+	defer v.certFileLock.Unlock()
+
+	var files []string
+	for _, name := range []string{"nginx.key", "nginx.crt"} {
+		file := path.Join(conf.Pwd, "containers/data/config", name)
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return files, errors.Wrapf(err, "remove %v", file)
+		} else if err == nil {
+			files = append(files, file)
+		}
+	}
+
+	logger.Tf(ctx, "cert: remove ssl files ok, files=%v", files)
+	return files, nil
+}
+
 // updateLetsEncrypt request letsencrypt and update the ssl files.
 func (v *CertManager) updateLetsEncrypt(ctx context.Context, domain string) error {
 	v.certFileLock.Lock()
@@ -336,9 +355,10 @@ func (v *CertManager) refreshSSLCert(ctx context.Context) error {
 		return err
 	} else {
 		logger.Tf(ctx, "cert: renew ssl cert ok")
+		publishEvent(ctx, &CertRenewedEvent{Provider: "lets", Domain: domain})
 	}
 
-	if err := nginxGenerateConfig(ctx); err != nil {
+	if err := nginxGenerateConfig(ctx, NginxTriggerRenew); err != nil {
 		return errors.Wrapf(err, "nginx config and reload")
 	}
 
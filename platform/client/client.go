@@ -0,0 +1,390 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+
+// Package client is the Go client of Oryx HTTP API, for other Go services to automate Oryx.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The default max retries for the 429 and 503 responses.
+const defaultMaxRetries = 3
+
+// The default interval to retry, doubled for each retry.
+const defaultRetryInterval = time.Second
+
+// Refresh the token if it expires within this duration.
+const tokenRefreshBefore = 24 * time.Hour
+
+// Error is the error response of API.
+type Error struct {
+	// The HTTP status code.
+	Status int
+	// The error code of Oryx, for example, 2001 for authentication, zero if no code.
+	Code int
+	// The localized message of error code, empty if no code.
+	Message string
+	// The detail of error.
+	Detail string
+
+	// The Retry-After of response, zero if not set.
+	retryAfter time.Duration
+}
+
+func (v *Error) Error() string {
+	if v.Code != 0 {
+		return fmt.Sprintf("status=%v, code=%v, message=%v, error=%v", v.Status, v.Code, v.Message, v.Detail)
+	}
+	return fmt.Sprintf("status=%v, error=%v", v.Status, v.Detail)
+}
+
+// Client is the client of Oryx HTTP API. Either the Secret or Password is required to authenticate.
+type Client struct {
+	// The endpoint of Oryx, for example, http://localhost:2022
+	Endpoint string
+	// The api secret SRS_PLATFORM_SECRET, used as bearer token if not empty.
+	Secret string
+	// The password MGMT_PASSWORD, used to acquire and refresh the token if no secret.
+	Password string
+	// The HTTP client, use http.DefaultClient if nil.
+	HTTPClient *http.Client
+	// The max retries for the 429 and 503 responses, default to 3, negative to disable.
+	MaxRetries int
+	// The interval to retry, default to 1s, doubled for each retry.
+	RetryInterval time.Duration
+
+	// The token acquired by password.
+	token    *Token
+	tokenMux sync.Mutex
+}
+
+// NewClient create a client of endpoint, for example, http://localhost:2022
+func NewClient(endpoint string) *Client {
+	return &Client{Endpoint: strings.TrimSuffix(endpoint, "/")}
+}
+
+// Token is the JWT token to access the API.
+type Token struct {
+	Token    string `json:"token"`
+	CreateAt string `json:"createAt"`
+	ExpireAt string `json:"expireAt"`
+}
+
+// Releases is the current, latest and stable version.
+type Releases struct {
+	Version string `json:"version"`
+	Stable  string `json:"stable"`
+	Latest  string `json:"latest"`
+}
+
+// UpgradeDrain is the draining state before upgrade.
+type UpgradeDrain struct {
+	Start    string   `json:"start"`
+	Deadline string   `json:"deadline"`
+	Streams  []string `json:"streams"`
+}
+
+// LockState is the distributed lock held by a replica of Oryx.
+type LockState struct {
+	Holder   string `json:"holder"`
+	Token    int64  `json:"token"`
+	Acquired string `json:"acquired"`
+}
+
+// Status is the response of /terraform/v1/mgmt/status
+type Status struct {
+	Version           string        `json:"version"`
+	Releases          Releases      `json:"releases"`
+	VersionsRefreshed string        `json:"versionsRefreshed"`
+	Upgrading         bool          `json:"upgrading"`
+	Strategy          string        `json:"strategy"`
+	Drain             *UpgradeDrain `json:"drain"`
+	// The locks of upgrade and nginx, nil if not held.
+	Locks map[string]*LockState `json:"locks"`
+}
+
+// UpgradeRequest is the request of /terraform/v1/mgmt/upgrade
+type UpgradeRequest struct {
+	// Whether upgrade even if there are live streams.
+	Force bool `json:"force,omitempty"`
+	// Whether drain the live streams before upgrade.
+	Drain bool `json:"drain,omitempty"`
+	// The max wait in seconds for draining.
+	MaxWait int `json:"maxWait,omitempty"`
+}
+
+// UpgradeResponse is the response of /terraform/v1/mgmt/upgrade
+type UpgradeResponse struct {
+	Upgrading bool          `json:"upgrading"`
+	Drain     *UpgradeDrain `json:"drain"`
+}
+
+// ForwardConfig is the configure of forwarding to a platform.
+type ForwardConfig struct {
+	Platform string `json:"platform"`
+	Stream   string `json:"stream"`
+	Server   string `json:"server"`
+	Secret   string `json:"secret"`
+	Enabled  bool   `json:"enabled"`
+	Custom   bool   `json:"custom"`
+	Label    string `json:"label"`
+}
+
+// Login by password, and save the token for other API.
+func (v *Client) Login(ctx context.Context) (*Token, error) {
+	var token Token
+	if err := v.do(ctx, "/terraform/v1/mgmt/login", &struct {
+		Password string `json:"password"`
+	}{
+		Password: v.Password,
+	}, &token, ""); err != nil {
+		return nil, fmt.Errorf("login: %w", err)
+	}
+
+	v.tokenMux.Lock()
+	defer v.tokenMux.Unlock()
+	v.token = &token
+	return &token, nil
+}
+
+// Status query the version and upgrade status.
+func (v *Client) Status(ctx context.Context) (*Status, error) {
+	var res Status
+	if err := v.Call(ctx, "/terraform/v1/mgmt/status", nil, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// Upgrade start the upgrade, which fails with code 2005 if there are live streams.
+func (v *Client) Upgrade(ctx context.Context, req *UpgradeRequest) (*UpgradeResponse, error) {
+	var res UpgradeResponse
+	if err := v.Call(ctx, "/terraform/v1/mgmt/upgrade", req, &res); err != nil {
+		return nil, err
+	}
+	return &res, nil
+}
+
+// CancelUpgrade cancel the draining of upgrade.
+func (v *Client) CancelUpgrade(ctx context.Context) error {
+	return v.Call(ctx, "/terraform/v1/mgmt/upgrade/cancel", nil, nil)
+}
+
+// ForwardConfigs query the configures of forwarding, the key is platform.
+func (v *Client) ForwardConfigs(ctx context.Context) (map[string]*ForwardConfig, error) {
+	res := make(map[string]*ForwardConfig)
+	if err := v.Call(ctx, "/terraform/v1/ffmpeg/forward/secret", nil, &res); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// UpdateForward update the configure of forwarding, and restart it if running.
+func (v *Client) UpdateForward(ctx context.Context, config *ForwardConfig) error {
+	return v.Call(ctx, "/terraform/v1/ffmpeg/forward/secret", &struct {
+		Action string `json:"action"`
+		*ForwardConfig
+	}{
+		Action: "update", ForwardConfig: config,
+	}, nil)
+}
+
+// Call the API with authentication, the req is marshaled as JSON body, and the data of response is unmarshaled to res
+// if not nil. The token is acquired or refreshed by password if no secret, and acquired again if expired.
+func (v *Client) Call(ctx context.Context, api string, req, res interface{}) error {
+	if v.Secret != "" {
+		return v.do(ctx, api, req, res, "")
+	}
+
+	token, err := v.acquireToken(ctx)
+	if err != nil {
+		return fmt.Errorf("acquire token: %w", err)
+	}
+
+	err = v.do(ctx, api, req, res, token)
+	if r0, ok := err.(*Error); !ok || r0.Status != http.StatusUnauthorized {
+		return err
+	}
+
+	// The token might be invalid because the api secret is changed, so login again.
+	if _, err := v.Login(ctx); err != nil {
+		return err
+	}
+	return v.do(ctx, api, req, res, v.currentToken())
+}
+
+func (v *Client) currentToken() string {
+	v.tokenMux.Lock()
+	defer v.tokenMux.Unlock()
+	if v.token == nil {
+		return ""
+	}
+	return v.token.Token
+}
+
+// acquireToken returns the token, login if no token, or refresh it if about to expire.
+func (v *Client) acquireToken(ctx context.Context) (string, error) {
+	v.tokenMux.Lock()
+	token := v.token
+	v.tokenMux.Unlock()
+
+	if token == nil {
+		if token, err := v.Login(ctx); err != nil {
+			return "", err
+		} else {
+			return token.Token, nil
+		}
+	}
+
+	if expireAt, err := time.Parse(time.RFC3339, token.ExpireAt); err == nil && time.Until(expireAt) < tokenRefreshBefore {
+		var refreshed Token
+		if err := v.do(ctx, "/terraform/v1/mgmt/token", nil, &refreshed, token.Token); err != nil {
+			if token, err := v.Login(ctx); err != nil {
+				return "", err
+			} else {
+				return token.Token, nil
+			}
+		}
+
+		v.tokenMux.Lock()
+		v.token = &refreshed
+		v.tokenMux.Unlock()
+		return refreshed.Token, nil
+	}
+	return token.Token, nil
+}
+
+// do request the API, with retry for 429 and 503.
+func (v *Client) do(ctx context.Context, api string, req, res interface{}, token string) error {
+	body, err := v.buildBody(req, token)
+	if err != nil {
+		return fmt.Errorf("build body: %w", err)
+	}
+
+	maxRetries, interval := v.MaxRetries, v.RetryInterval
+	if maxRetries == 0 {
+		maxRetries = defaultMaxRetries
+	}
+	if interval <= 0 {
+		interval = defaultRetryInterval
+	}
+
+	for i := 0; ; i++ {
+		err := v.doOnce(ctx, api, body, res)
+		if r0, ok := err.(*Error); !ok || i >= maxRetries ||
+			(r0.Status != http.StatusTooManyRequests && r0.Status != http.StatusServiceUnavailable) {
+			return err
+		}
+
+		wait := interval
+		if r0 := err.(*Error); r0.retryAfter > wait {
+			wait = r0.retryAfter
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+		interval *= 2
+	}
+}
+
+// buildBody marshal the req as JSON object, with the token if not empty.
+func (v *Client) buildBody(req interface{}, token string) ([]byte, error) {
+	obj := make(map[string]json.RawMessage)
+	if req != nil {
+		if b, err := json.Marshal(req); err != nil {
+			return nil, fmt.Errorf("marshal %v: %w", req, err)
+		} else if err := json.Unmarshal(b, &obj); err != nil {
+			return nil, fmt.Errorf("request %s is not object: %w", string(b), err)
+		}
+	}
+
+	if token != "" {
+		obj["token"], _ = json.Marshal(token)
+	}
+	return json.Marshal(obj)
+}
+
+func (v *Client) doOnce(ctx context.Context, api string, body []byte, res interface{}) error {
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, v.Endpoint+api, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("new request %v: %w", api, err)
+	}
+	r.Header.Set("Content-Type", "application/json")
+	if v.Secret != "" {
+		r.Header.Set("Authorization", fmt.Sprintf("Bearer %v", v.Secret))
+	}
+
+	httpClient := v.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	resp, err := httpClient.Do(r)
+	if err != nil {
+		return fmt.Errorf("request %v: %w", api, err)
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("read %v: %w", api, err)
+	}
+
+	// The response is {code, data}, and the data is {message, error} if code is not zero. Note that the error without
+	// code is plain text.
+	var envelope struct {
+		Code int             `json:"code"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &envelope); err != nil {
+		return &Error{
+			Status: resp.StatusCode, Detail: strings.TrimSpace(string(b)), retryAfter: retryAfter(resp.Header),
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK || envelope.Code != 0 {
+		r0 := &Error{Status: resp.StatusCode, Code: envelope.Code, retryAfter: retryAfter(resp.Header)}
+		var data struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+		if err := json.Unmarshal(envelope.Data, &data); err == nil {
+			r0.Message, r0.Detail = data.Message, data.Error
+		} else {
+			r0.Detail = string(envelope.Data)
+		}
+		if r0.Status == http.StatusOK {
+			r0.Status = http.StatusInternalServerError
+		}
+		return r0
+	}
+
+	if res != nil && len(envelope.Data) > 0 {
+		if err := json.Unmarshal(envelope.Data, res); err != nil {
+			return fmt.Errorf("unmarshal %v: %w", string(envelope.Data), err)
+		}
+	}
+	return nil
+}
+
+// retryAfter parse the Retry-After header in seconds, zero if not set.
+func retryAfter(header http.Header) time.Duration {
+	if v, err := strconv.Atoi(header.Get("Retry-After")); err == nil && v > 0 {
+		return time.Duration(v) * time.Second
+	}
+	return 0
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"platform/client"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestClient_AgainstHandlers(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	oldDiagnostics := diagnostics
+	oldPassword := os.Getenv("MGMT_PASSWORD")
+	diagnostics = NewDiagnostics()
+	os.Setenv("MGMT_PASSWORD", "password")
+	defer func() {
+		diagnostics = oldDiagnostics
+		os.Setenv("MGMT_PASSWORD", oldPassword)
+	}()
+
+	handler := http.NewServeMux()
+	handleMgmtLogin(ctx, handler)
+	handleMgmtToken(ctx, handler)
+	handleMgmtStatus(ctx, handler)
+	handleMgmtUpgrade(ctx, handler)
+	defer useFakeUpgradeScript(t, "exit 0")()
+	if err := NewForwardWorker().Handle(ctx, handler); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	// Response 503 for the first request, to verify the retry.
+	var requests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			http.Error(w, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer backend.Close()
+
+	// Login by password, and use the token for API.
+	c := client.NewClient(backend.URL)
+	c.Password, c.RetryInterval = "password", time.Millisecond
+	if status, err := c.Status(ctx); err != nil || status.Strategy != "manual" || status.Upgrading {
+		t.Errorf("Fail for status %v, err %+v", status, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Fail for requests %v", n)
+	}
+
+	if err := c.UpdateForward(ctx, &client.ForwardConfig{
+		Platform: "wx", Server: "rtmp://localhost/live", Secret: "livestream", Enabled: true,
+	}); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if configs, err := c.ForwardConfigs(ctx); err != nil || configs["wx"] == nil || configs["wx"].Secret != "livestream" {
+		t.Errorf("Fail for configs %v, err %+v", configs, err)
+	}
+
+	// The error code of envelope, for upgrade with live streams.
+	server.HSet(SRS_STREAM_ACTIVE, "live/livestream", `{"app":"live","stream":"livestream"}`)
+	if _, err := c.Upgrade(ctx, &client.UpgradeRequest{}); err == nil {
+		t.Errorf("Fail for upgrade with live streams")
+	} else if r0, ok := err.(*client.Error); !ok || r0.Status != http.StatusConflict || r0.Code != int(SrsStackErrorStreamsLive) {
+		t.Errorf("Fail for err %+v", err)
+	}
+
+	// Use the api secret as bearer token, and the invalid one is rejected.
+	c = client.NewClient(backend.URL)
+	c.Secret = "test-platform-secret"
+	if _, err := c.Status(ctx); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	c.Secret = "invalid"
+	if _, err := c.Status(ctx); err == nil {
+		t.Errorf("Fail for invalid secret")
+	} else if r0, ok := err.(*client.Error); !ok || r0.Status != http.StatusUnauthorized || r0.Code != int(SrsStackErrorAuth) {
+		t.Errorf("Fail for err %+v", err)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The trusted proxies, only initialized when MGMT_TRUST_PROXY is on. Note that we never trust any proxy by default,
+// because the headers X-Forwarded-For and X-Real-IP are easy to spoof.
+var trustedProxies []*net.IPNet
+
+// initTrustedProxies parse the CIDRs of env MGMT_TRUSTED_PROXIES, if MGMT_TRUST_PROXY is on.
+func initTrustedProxies(ctx context.Context) error {
+	if envMgmtTrustProxy() != "on" {
+		trustedProxies = nil
+		logger.Tf(ctx, "client ip use peer address, trust proxy is %v", envMgmtTrustProxy())
+		return nil
+	}
+
+	proxies, err := parseTrustedProxies(envMgmtTrustedProxies())
+	if err != nil {
+		return errors.Wrapf(err, "parse %v", envMgmtTrustedProxies())
+	}
+
+	trustedProxies = proxies
+	logger.Tf(ctx, "client ip trust proxies %v", envMgmtTrustedProxies())
+	return nil
+}
+
+// parseTrustedProxies parse the comma separated CIDRs or IPs, for example, 127.0.0.0/8,10.0.0.1
+func parseTrustedProxies(value string) ([]*net.IPNet, error) {
+	var proxies []*net.IPNet
+	for _, s := range strings.Split(value, ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip == nil {
+				return nil, errors.Errorf("invalid ip %v", s)
+			} else if ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+
+		_, ipnet, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse cidr %v", s)
+		}
+		proxies = append(proxies, ipnet)
+	}
+	return proxies, nil
+}
+
+// clientIP returns the IP of client, which is the peer address, or the address in X-Forwarded-For or X-Real-IP if
+// the peer is a trusted proxy. All components that record or check the client IP should use this helper.
+func clientIP(r *http.Request) string {
+	return resolveClientIP(r, trustedProxies)
+}
+
+// isTrustedProxy returns whether the peer of request is a trusted proxy, so the forwarded headers are trusted, for
+// example, the X-Forwarded-Prefix.
+func isTrustedProxy(r *http.Request, proxies []*net.IPNet) bool {
+	return isTrustedIP(peerIP(r), proxies)
+}
+
+func isTrustedIP(ip string, proxies []*net.IPNet) bool {
+	if parsed := net.ParseIP(ip); parsed != nil {
+		for _, proxy := range proxies {
+			if proxy.Contains(parsed) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func peerIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func resolveClientIP(r *http.Request, proxies []*net.IPNet) string {
+	isTrusted := func(ip string) bool {
+		return isTrustedIP(ip, proxies)
+	}
+
+	peer := peerIP(r)
+	if !isTrusted(peer) {
+		return peer
+	}
+
+	// The X-Forwarded-For is client, proxy1, proxy2, and each proxy appends the peer address, so we use the right
+	// most address which is not a trusted proxy, because the left ones might be spoofed by client.
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := strings.TrimSpace(hops[i])
+			if net.ParseIP(hop) == nil {
+				break
+			}
+			if !isTrusted(hop) || i == 0 {
+				return hop
+			}
+		}
+	}
+
+	if ip := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(ip) != nil {
+		return ip
+	}
+	return peer
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP_TrustedProxies(t *testing.T) {
+	proxies, err := parseTrustedProxies("127.0.0.0/8, 10.0.0.1,::1/128")
+	if err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	if _, err := parseTrustedProxies("10.0.0.300"); err == nil {
+		t.Errorf("Fail for invalid ip")
+	}
+
+	for _, e := range []struct {
+		name     string
+		remote   string
+		xff      string
+		realIP   string
+		expected string
+	}{
+		{name: "direct", remote: "1.2.3.4:5678", expected: "1.2.3.4"},
+		{name: "spoofed xff from untrusted peer", remote: "1.2.3.4:5678", xff: "9.9.9.9", expected: "1.2.3.4"},
+		{name: "spoofed real ip from untrusted peer", remote: "1.2.3.4:5678", realIP: "9.9.9.9", expected: "1.2.3.4"},
+		{name: "trusted proxy", remote: "127.0.0.1:5678", xff: "1.2.3.4", expected: "1.2.3.4"},
+		{name: "spoofed xff via trusted proxy", remote: "127.0.0.1:5678", xff: "9.9.9.9, 1.2.3.4", expected: "1.2.3.4"},
+		{name: "chained trusted proxies", remote: "127.0.0.1:5678", xff: "9.9.9.9, 1.2.3.4, 10.0.0.1", expected: "1.2.3.4"},
+		{name: "all hops trusted", remote: "127.0.0.1:5678", xff: "10.0.0.1", expected: "10.0.0.1"},
+		{name: "malformed xff", remote: "127.0.0.1:5678", xff: "1.2.3.4, unknown", realIP: "5.6.7.8", expected: "5.6.7.8"},
+		{name: "real ip via trusted proxy", remote: "[::1]:5678", realIP: "1.2.3.4", expected: "1.2.3.4"},
+		{name: "trusted proxy without headers", remote: "127.0.0.1:5678", expected: "127.0.0.1"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, "/terraform/v1/mgmt/login", nil)
+		r.RemoteAddr = e.remote
+		if e.xff != "" {
+			r.Header.Set("X-Forwarded-For", e.xff)
+		}
+		if e.realIP != "" {
+			r.Header.Set("X-Real-IP", e.realIP)
+		}
+		if ip := resolveClientIP(r, proxies); ip != e.expected {
+			t.Errorf("Fail for %v, ip=%v, expect %v", e.name, ip, e.expected)
+		}
+		if peer, _, _ := net.SplitHostPort(e.remote); resolveClientIP(r, nil) != peer {
+			t.Errorf("Fail for %v when trust proxy is off, ip=%v", e.name, resolveClientIP(r, nil))
+		}
+	}
+}
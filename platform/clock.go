@@ -0,0 +1,208 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// The max clock skew to the internet, warn if exceeded, because the token and certificate might be invalid.
+const clockMaxSkew = 30 * time.Second
+
+var clockChecker = NewClockChecker()
+
+// ClockState is the last measured clock offset, for diagnose and self-check.
+type ClockState struct {
+	// Whether the check is disabled by CLOCK_CHECK_INTERVAL, for air-gapped installs.
+	Disabled bool `json:"disabled,omitempty"`
+	// The server to compare with, by the Date header.
+	Server string `json:"server,omitempty"`
+	// The offset of local clock to server in milliseconds, positive if local is ahead.
+	Offset int64 `json:"offset"`
+	// Whether the offset exceeds the max skew.
+	Drift bool `json:"drift"`
+	// The time of last check in RFC3339, empty if never checked.
+	Checked string `json:"checked,omitempty"`
+	// The error of last check.
+	Error string `json:"error,omitempty"`
+}
+
+// ClockChecker measures the offset of local clock, by comparing with the Date header of an HTTPS server, when startup
+// and periodically, to warn the drift which breaks the token and scheduled features subtly.
+type ClockChecker struct {
+	// The last measured offset, and whether it's known.
+	offset time.Duration
+	known  bool
+	// The server and time of last check, and the error.
+	server  string
+	checked time.Time
+	err     error
+	// The lock for state.
+	lock sync.Mutex
+}
+
+func NewClockChecker() *ClockChecker {
+	return &ClockChecker{}
+}
+
+// Start checks the clock when startup, then every CLOCK_CHECK_INTERVAL, which is off for air-gapped installs.
+func (v *ClockChecker) Start(ctx context.Context, wg *sync.WaitGroup) error {
+	// Use the same format as VERSIONS_REFRESH_INTERVAL.
+	interval, err := parseVersionsRefreshInterval(envClockCheckInterval())
+	if err != nil {
+		return errors.Wrapf(err, "parse CLOCK_CHECK_INTERVAL")
+	}
+
+	if interval <= 0 {
+		logger.Tf(ctx, "clock: disable checking clock")
+		return nil
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		safeRestart(ctx, func() {
+			for {
+				if _, err := v.Check(ctx); err != nil {
+					logger.Wf(ctx, "clock: ignore err %+v", err)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(jitterInterval(interval)):
+				}
+			}
+		})
+	}()
+	return nil
+}
+
+// Check measures the offset to the server, stores it and warns if drift.
+func (v *ClockChecker) Check(ctx context.Context) (time.Duration, error) {
+	server, err := clockCheckServer()
+	if err != nil {
+		return 0, errors.Wrapf(err, "clock server")
+	}
+
+	offset, err := measureClockOffset(ctx, server)
+
+	v.lock.Lock()
+	v.server, v.checked, v.err = server, time.Now(), err
+	if err == nil {
+		v.offset, v.known = offset, true
+	}
+	v.lock.Unlock()
+
+	if err != nil {
+		return 0, errors.Wrapf(err, "measure clock offset")
+	}
+
+	if isClockDrift(offset) {
+		logger.Wf(ctx, "clock: drift %v to %v exceeds %v, please sync clock by NTP", offset, server, clockMaxSkew)
+	} else {
+		logger.Tf(ctx, "clock: offset %v to %v", offset, server)
+	}
+	return offset, nil
+}
+
+// State returns the last measured state.
+func (v *ClockChecker) State() *ClockState {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	r := &ClockState{Server: v.server, Offset: int64(v.offset / time.Millisecond), Drift: v.known && isClockDrift(v.offset)}
+	if interval, err := parseVersionsRefreshInterval(envClockCheckInterval()); err == nil && interval <= 0 {
+		r.Disabled = true
+	}
+	if !v.checked.IsZero() {
+		r.Checked = v.checked.Format(time.RFC3339)
+	}
+	if v.err != nil {
+		r.Error = v.err.Error()
+	}
+	return r
+}
+
+// Hint returns the hint if the clock is known to drift, or empty.
+func (v *ClockChecker) Hint() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.known || !isClockDrift(v.offset) {
+		return ""
+	}
+	return fmt.Sprintf("clock drift %v to %v is known, please sync clock by NTP", v.offset, v.server)
+}
+
+func isClockDrift(offset time.Duration) bool {
+	return offset > clockMaxSkew || offset < -clockMaxSkew
+}
+
+// clockCheckServer returns the server by CLOCK_CHECK_SERVER, or the server of RELEASES_FEED.
+func clockCheckServer() (string, error) {
+	feed := envClockCheckServer()
+	if feed == "" {
+		feed = envReleasesFeed()
+	}
+
+	u, err := url.Parse(feed)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse %v", feed)
+	}
+	if u.Scheme == "" || u.Host == "" {
+		return "", errors.Errorf("invalid server %v", feed)
+	}
+	return fmt.Sprintf("%v://%v", u.Scheme, u.Host), nil
+}
+
+// measureClockOffset compares the local clock with the Date header of server.
+func measureClockOffset(ctx context.Context, server string) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, server, nil)
+	if err != nil {
+		return 0, errors.Wrapf(err, "new request %v", server)
+	}
+
+	starttime := time.Now()
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, errors.Wrapf(err, "head %v", server)
+	}
+	defer res.Body.Close()
+
+	serverTime, err := http.ParseTime(res.Header.Get("Date"))
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse date %v of %v", res.Header.Get("Date"), server)
+	}
+
+	// Use the middle of request as the local time, and the Date header is in seconds.
+	localTime := starttime.Add(time.Since(starttime) / 2)
+	return localTime.Sub(serverTime).Round(time.Second), nil
+}
+
+// withClockHint appends the hint to the error of token, if the token is expired or not valid yet, and the clock is
+// known to drift, because the user always blames the platform.
+func withClockHint(err error) error {
+	ve, ok := err.(*jwt.ValidationError)
+	if !ok || ve.Errors&(jwt.ValidationErrorExpired|jwt.ValidationErrorNotValidYet|jwt.ValidationErrorIssuedAt) == 0 {
+		return err
+	}
+
+	if hint := clockChecker.Hint(); hint != "" {
+		return errors.Wrapf(err, "%v", hint)
+	}
+	return err
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestClock_CheckAndHint(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	// The server clock is 2 minutes ahead of local.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(2*time.Minute).UTC().Format(http.TimeFormat))
+	}))
+	defer server.Close()
+
+	oldChecker, oldServer, oldInterval := clockChecker, os.Getenv("CLOCK_CHECK_SERVER"), os.Getenv("CLOCK_CHECK_INTERVAL")
+	clockChecker = NewClockChecker()
+	os.Setenv("CLOCK_CHECK_SERVER", server.URL+"/ignored/path")
+	os.Setenv("CLOCK_CHECK_INTERVAL", "1h")
+	defer func() {
+		clockChecker = oldChecker
+		os.Setenv("CLOCK_CHECK_SERVER", oldServer)
+		os.Setenv("CLOCK_CHECK_INTERVAL", oldInterval)
+	}()
+
+	// No hint before checked.
+	if hint := clockChecker.Hint(); hint != "" {
+		t.Errorf("Fail for hint %v", hint)
+	}
+
+	offset, err := clockChecker.Check(ctx)
+	if err != nil || offset > -time.Minute {
+		t.Errorf("Fail for offset %v, err %+v", offset, err)
+	}
+	if state := clockChecker.State(); !state.Drift || state.Server != server.URL || state.Offset > -60*1000 ||
+		state.Checked == "" || state.Disabled {
+		t.Errorf("Fail for state %v", state)
+	}
+	if msg, err := diagnoseClock(ctx); err == nil || !strings.Contains(err.Error(), "clock skew") {
+		t.Errorf("Fail for msg %v, err %+v", msg, err)
+	}
+
+	// The expired token gets the hint, while the invalid signature not.
+	apiSecret := "test-platform-secret"
+	expired, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Minute)),
+	}).SignedString([]byte(apiSecret))
+	if err := Authenticate(ctx, apiSecret, expired, http.Header{}); err == nil || !strings.Contains(err.Error(), "clock drift") {
+		t.Errorf("Fail for err %+v", err)
+	}
+	invalid, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{}).SignedString([]byte("other-secret"))
+	if err := Authenticate(ctx, apiSecret, invalid, http.Header{}); err == nil || strings.Contains(err.Error(), "clock drift") {
+		t.Errorf("Fail for err %+v", err)
+	}
+
+	// Keep the last known offset if failed to check.
+	server.Close()
+	if _, err := clockChecker.Check(ctx); err == nil {
+		t.Errorf("Fail for server closed")
+	}
+	if state := clockChecker.State(); !state.Drift || state.Error == "" || clockChecker.Hint() == "" {
+		t.Errorf("Fail for state %v", state)
+	}
+}
+
+func TestClock_Disabled(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	oldChecker, oldInterval := clockChecker, os.Getenv("CLOCK_CHECK_INTERVAL")
+	clockChecker = NewClockChecker()
+	defer func() {
+		clockChecker = oldChecker
+		os.Setenv("CLOCK_CHECK_INTERVAL", oldInterval)
+	}()
+
+	os.Setenv("CLOCK_CHECK_INTERVAL", "1s")
+	var wg sync.WaitGroup
+	if err := clockChecker.Start(ctx, &wg); err == nil {
+		t.Errorf("Fail for invalid interval")
+	}
+
+	os.Setenv("CLOCK_CHECK_INTERVAL", "off")
+	if err := clockChecker.Start(ctx, &wg); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	wg.Wait()
+
+	if state := clockChecker.State(); !state.Disabled || state.Checked != "" {
+		t.Errorf("Fail for state %v", state)
+	}
+	if msg, err := diagnoseClock(ctx); err != nil || !strings.Contains(msg, "disabled") {
+		t.Errorf("Fail for msg %v, err %+v", msg, err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The timeout to probe the metadata service, which is very fast in cloud, while never responds on bare metal, so we
+// must use a short timeout to avoid delaying the startup.
+const cloudMetadataTimeout = 2 * time.Second
+
+// The client to access the metadata service.
+var cloudMetadataClient = &http.Client{Timeout: cloudMetadataTimeout}
+
+// The metadata services, see https://cloud.tencent.com/document/product/213/4934 for Tencent, and
+// https://docs.aws.amazon.com/AWSEC2/latest/UserGuide/instancedata-data-retrieval.html for AWS, and
+// https://docs.digitalocean.com/reference/api/metadata-api/ for DigitalOcean.
+var tencentMetadataURL = "http://metadata.tencentyun.com/latest/meta-data"
+var awsMetadataURL = "http://169.254.169.254/latest"
+var doMetadataURL = "http://169.254.169.254/metadata/v1"
+
+// The provider of bare metal, or any host without metadata service.
+const cloudProviderBare = "BARE"
+
+// CloudMetadata is the normalized metadata of instance.
+type CloudMetadata struct {
+	// The cloud provider, for example, TENCENT, AWS, DO or BARE.
+	Provider string `json:"provider"`
+	// The region of instance, for example, ap-beijing.
+	Region string `json:"region,omitempty"`
+	// The instance id.
+	InstanceID string `json:"instanceId,omitempty"`
+	// The public IP of instance.
+	PublicIP string `json:"publicIP,omitempty"`
+	// The update time.
+	Update string `json:"update"`
+}
+
+func (v *CloudMetadata) String() string {
+	return fmt.Sprintf("provider=%v, region=%v, instanceId=%v, publicIP=%v, update=%v",
+		v.Provider, v.Region, v.InstanceID, v.PublicIP, v.Update,
+	)
+}
+
+// fetchCloudMetadata request the metadata service and returns the trimmed body.
+func fetchCloudMetadata(ctx context.Context, method, url string, headers map[string]string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "new request %v", url)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	res, err := cloudMetadataClient.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "request %v", url)
+	}
+	defer res.Body.Close()
+
+	b, err := io.ReadAll(res.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "read %v", url)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("request %v, code=%v, body=%v", url, res.StatusCode, string(b))
+	}
+	return strings.TrimSpace(string(b)), nil
+}
+
+func probeTencentMetadata(ctx context.Context) (*CloudMetadata, error) {
+	region, err := fetchCloudMetadata(ctx, http.MethodGet, tencentMetadataURL+"/placement/region", nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "region")
+	}
+
+	// The instance id and public IP are optional, for example, no public IP for some CVM.
+	instanceID, _ := fetchCloudMetadata(ctx, http.MethodGet, tencentMetadataURL+"/instance-id", nil)
+	publicIP, _ := fetchCloudMetadata(ctx, http.MethodGet, tencentMetadataURL+"/public-ipv4", nil)
+	return &CloudMetadata{Provider: "TENCENT", Region: region, InstanceID: instanceID, PublicIP: publicIP}, nil
+}
+
+func probeAwsMetadata(ctx context.Context) (*CloudMetadata, error) {
+	// Use IMDSv2, which requires a session token.
+	token, err := fetchCloudMetadata(ctx, http.MethodPut, awsMetadataURL+"/api/token", map[string]string{
+		"X-aws-ec2-metadata-token-ttl-seconds": "60",
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "token")
+	}
+
+	headers := map[string]string{"X-aws-ec2-metadata-token": token}
+	region, err := fetchCloudMetadata(ctx, http.MethodGet, awsMetadataURL+"/meta-data/placement/region", headers)
+	if err != nil {
+		return nil, errors.Wrapf(err, "region")
+	}
+
+	instanceID, _ := fetchCloudMetadata(ctx, http.MethodGet, awsMetadataURL+"/meta-data/instance-id", headers)
+	publicIP, _ := fetchCloudMetadata(ctx, http.MethodGet, awsMetadataURL+"/meta-data/public-ipv4", headers)
+	return &CloudMetadata{Provider: "AWS", Region: region, InstanceID: instanceID, PublicIP: publicIP}, nil
+}
+
+func probeDoMetadata(ctx context.Context) (*CloudMetadata, error) {
+	region, err := fetchCloudMetadata(ctx, http.MethodGet, doMetadataURL+"/region", nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "region")
+	}
+
+	instanceID, _ := fetchCloudMetadata(ctx, http.MethodGet, doMetadataURL+"/id", nil)
+	publicIP, _ := fetchCloudMetadata(ctx, http.MethodGet, doMetadataURL+"/interfaces/public/0/ipv4/address", nil)
+	return &CloudMetadata{Provider: "DO", Region: region, InstanceID: instanceID, PublicIP: publicIP}, nil
+}
+
+// detectCloudMetadata probe all metadata services in parallel, and returns the first detected one in the order of
+// probes, or bare metal if none.
+func detectCloudMetadata(ctx context.Context) *CloudMetadata {
+	probes := []func(ctx context.Context) (*CloudMetadata, error){
+		probeTencentMetadata, probeAwsMetadata, probeDoMetadata,
+	}
+
+	var wg sync.WaitGroup
+	results := make([]*CloudMetadata, len(probes))
+	for i, probe := range probes {
+		wg.Add(1)
+		go func(i int, probe func(ctx context.Context) (*CloudMetadata, error)) {
+			defer wg.Done()
+
+			if r, err := probe(ctx); err != nil {
+				logger.Tf(ctx, "cloud ignore probe err %v", err)
+			} else {
+				results[i] = r
+			}
+		}(i, probe)
+	}
+	wg.Wait()
+
+	metadata := &CloudMetadata{Provider: cloudProviderBare}
+	for _, r := range results {
+		if r != nil {
+			metadata = r
+			break
+		}
+	}
+	metadata.Update = time.Now().Format(time.RFC3339)
+	return metadata
+}
+
+// refreshCloudMetadata detect the cloud metadata and save to redis. If the instance is migrated to another region of
+// the same cloud, the region in SRS_TENCENT_LH is updated, because it's only discovered at startup.
+func refreshCloudMetadata(ctx context.Context) (*CloudMetadata, error) {
+	metadata := detectCloudMetadata(ctx)
+
+	if err := rdb.HSet(ctx, SRS_CLOUD_METADATA,
+		"provider", metadata.Provider, "region", metadata.Region, "instanceId", metadata.InstanceID,
+		"publicIP", metadata.PublicIP, "update", metadata.Update,
+	).Err(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hset %v %v", SRS_CLOUD_METADATA, metadata.String())
+	}
+
+	if metadata.Provider == conf.Cloud && metadata.Region != "" && metadata.Region != conf.Region() {
+		if err := rdb.HSet(ctx, SRS_TENCENT_LH, "region", metadata.Region).Err(); err != nil && err != redis.Nil {
+			return nil, errors.Wrapf(err, "hset %v region %v", SRS_TENCENT_LH, metadata.Region)
+		}
+		logger.Wf(ctx, "cloud update region from %v to %v", conf.Region(), metadata.Region)
+		conf.SetRegion(metadata.Region)
+	}
+
+	logger.Tf(ctx, "cloud refresh ok, %v", metadata.String())
+	return metadata, nil
+}
+
+func handleMgmtCloud(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/cloud/refresh"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			metadata, err := refreshCloudMetadata(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "refresh")
+			}
+
+			httpWriteData(ctx, w, r, metadata)
+			logger.Tf(ctx, "cloud refresh by api ok, %v, token=%vB", metadata.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
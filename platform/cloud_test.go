@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestCloud_RefreshMetadata(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	tencent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/placement/region":
+			w.Write([]byte("ap-shanghai\n"))
+		case "/instance-id":
+			w.Write([]byte("lhins-123"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer tencent.Close()
+
+	aws := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer aws.Close()
+
+	oldConf := conf
+	oldTencent, oldAws, oldDo := tencentMetadataURL, awsMetadataURL, doMetadataURL
+	defer func() {
+		conf = oldConf
+		tencentMetadataURL, awsMetadataURL, doMetadataURL = oldTencent, oldAws, oldDo
+	}()
+
+	// The instance is migrated from ap-beijing to ap-shanghai.
+	conf = &Config{Cloud: "TENCENT", region: "ap-beijing"}
+	tencentMetadataURL, awsMetadataURL, doMetadataURL = tencent.URL, aws.URL, aws.URL+"/metadata/v1"
+
+	metadata, err := refreshCloudMetadata(ctx)
+	if err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	if metadata.Provider != "TENCENT" || metadata.Region != "ap-shanghai" || metadata.InstanceID != "lhins-123" || metadata.PublicIP != "" {
+		t.Errorf("Fail for metadata %v", metadata.String())
+	}
+	if region, _ := server.HGet(SRS_TENCENT_LH, "region"); region != "ap-shanghai" || conf.Region() != "ap-shanghai" {
+		t.Errorf("Fail for region %v, conf %v", region, conf.Region())
+	}
+	if provider, _ := server.HGet(SRS_CLOUD_METADATA, "provider"); provider != "TENCENT" {
+		t.Errorf("Fail for provider %v", provider)
+	}
+
+	// Bare metal, without any metadata service.
+	tencentMetadataURL = aws.URL
+	if metadata := detectCloudMetadata(ctx); metadata.Provider != cloudProviderBare || metadata.Region != "" {
+		t.Errorf("Fail for metadata %v", metadata.String())
+	}
+}
@@ -0,0 +1,529 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The interval to poll the health of remote nodes.
+const clusterHealthInterval = 30 * time.Second
+
+// The timeout to request a remote node, for health or proxy.
+const clusterRequestTimeout = 10 * time.Second
+
+// The max number of nodes to poll at the same time.
+const clusterHealthConcurrency = 4
+
+// The max size of request and response body to proxy.
+const clusterProxyMaxBody = 4 * 1024 * 1024
+
+// The APIs of remote node which are allowed to proxy, relative to /terraform/v1/mgmt/.
+var clusterProxyAPIs = map[string]bool{
+	"versions":      true,
+	"check":         true,
+	"envs":          true,
+	"streams/query": true,
+	"streams/audit": true,
+	"stats/viewers": true,
+	"nginx/status":  true,
+}
+
+// The name of node, used in the proxy path, so only letters, numbers, dash and underscore.
+var clusterNodeNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+var clusterWorker *ClusterWorker
+
+// ClusterNode is a remote Oryx node, managed by this node.
+type ClusterNode struct {
+	// The unique name of node.
+	Name string `json:"name"`
+	// The base URL of node, for example, https://node1.example.com.
+	URL string `json:"url"`
+	// The api secret of node, encrypted by api secret of this node, see encryptByApiSecret.
+	Secret string `json:"secret"`
+	// The update time.
+	Update string `json:"update"`
+}
+
+func (v *ClusterNode) String() string {
+	return fmt.Sprintf("name=%v, url=%v, secret=%vB, update=%v", v.Name, v.URL, len(v.Secret), v.Update)
+}
+
+// ClusterNodeHealth is the health of remote node, polled by versions and check.
+type ClusterNodeHealth struct {
+	// Whether the node is ok, or the error.
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+	// The version of node.
+	Version string `json:"version,omitempty"`
+	// The time and cost in milliseconds of the check.
+	Check string `json:"check"`
+	Cost  int64  `json:"cost"`
+}
+
+func (v *ClusterNodeHealth) String() string {
+	return fmt.Sprintf("ok=%v, error=%v, version=%v, check=%v, cost=%vms", v.OK, v.Error, v.Version, v.Check, v.Cost)
+}
+
+// queryClusterNodes returns all nodes, the key is the name.
+func queryClusterNodes(ctx context.Context) (map[string]*ClusterNode, error) {
+	values, err := rdb.HGetAll(ctx, SRS_CLUSTER_NODES).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_CLUSTER_NODES)
+	}
+
+	nodes := make(map[string]*ClusterNode)
+	for name, value := range values {
+		var node ClusterNode
+		if err := json.Unmarshal([]byte(value), &node); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+		nodes[name] = &node
+	}
+	return nodes, nil
+}
+
+// validateClusterNodeURL checks the base URL of node, which should be HTTP or HTTPS without path.
+func validateClusterNodeURL(nodeURL string) error {
+	u, err := url.Parse(nodeURL)
+	if err != nil {
+		return errors.Wrapf(err, "parse %v", nodeURL)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("invalid scheme %v", u.Scheme)
+	}
+	if u.Host == "" || u.User != nil || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+		return errors.Errorf("invalid url %v, should be like https://host:port", nodeURL)
+	}
+	return nil
+}
+
+// requestClusterNode requests the mgmt api of node, for example, versions, with body, and returns the data of
+// response. The request is signed by the secret of node.
+func requestClusterNode(ctx context.Context, node *ClusterNode, api string, body []byte) (json.RawMessage, error) {
+	secret, err := decryptByApiSecret(node.Secret)
+	if err != nil {
+		return nil, errors.Wrapf(err, "decrypt secret of %v", node.Name)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, clusterRequestTimeout)
+	defer cancel()
+
+	endpoint := fmt.Sprintf("%v/terraform/v1/mgmt/%v", strings.TrimSuffix(node.URL, "/"), api)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "new request %v", endpoint)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", secret))
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "post %v", endpoint)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, clusterProxyMaxBody))
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", endpoint)
+	}
+
+	// Never echo the whole body of error, which might be large.
+	snippet := string(b)
+	if len(snippet) > 1024 {
+		snippet = snippet[:1024]
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("post %v, status=%v, body=%v", endpoint, res.StatusCode, snippet)
+	}
+
+	var r struct {
+		Code int             `json:"code"`
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", snippet)
+	} else if r.Code != 0 {
+		return nil, errors.Errorf("post %v, code=%v, body=%v", endpoint, r.Code, snippet)
+	}
+	return r.Data, nil
+}
+
+// checkClusterNode polls the versions and check of node.
+func checkClusterNode(ctx context.Context, node *ClusterNode) *ClusterNodeHealth {
+	starttime := time.Now()
+	health := &ClusterNodeHealth{Check: starttime.Format(time.RFC3339)}
+
+	if err := func() error {
+		data, err := requestClusterNode(ctx, node, "versions", nil)
+		if err != nil {
+			return errors.Wrapf(err, "versions")
+		}
+
+		var versions struct {
+			Version string `json:"version"`
+		}
+		if err := json.Unmarshal(data, &versions); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", string(data))
+		}
+		health.Version = versions.Version
+
+		if _, err := requestClusterNode(ctx, node, "check", nil); err != nil {
+			return errors.Wrapf(err, "check")
+		}
+		return nil
+	}(); err != nil {
+		health.Error = err.Error()
+	} else {
+		health.OK = true
+	}
+
+	health.Cost = int64(time.Since(starttime) / time.Millisecond)
+	return health
+}
+
+// ClusterWorker polls the health of remote nodes, and proxies the APIs to nodes.
+type ClusterWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewClusterWorker() *ClusterWorker {
+	return &ClusterWorker{}
+}
+
+func (v *ClusterWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *ClusterWorker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "cluster start a worker, interval=%v", clusterHealthInterval)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		safeRestart(ctx, func() {
+			for {
+				if err := v.checkNodes(ctx); err != nil {
+					logger.Wf(ctx, "cluster ignore check err %+v", err)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(clusterHealthInterval):
+				}
+			}
+		})
+	}()
+
+	return nil
+}
+
+// checkNodes polls all nodes concurrently, and the failure of a node never affects others.
+func (v *ClusterWorker) checkNodes(ctx context.Context) error {
+	nodes, err := queryClusterNodes(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query nodes")
+	}
+	if len(nodes) == 0 {
+		return nil
+	}
+
+	var lock sync.Mutex
+	healths := make(map[string]*ClusterNodeHealth)
+
+	pool := NewBoundedPool(ctx, clusterHealthConcurrency)
+	for _, node := range nodes {
+		node := node
+		pool.Go(func() {
+			health := checkClusterNode(ctx, node)
+			if !health.OK {
+				logger.Wf(ctx, "cluster node %v unhealthy, %v", node.Name, health.String())
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			healths[node.Name] = health
+		})
+	}
+	pool.Wait()
+
+	for name, health := range healths {
+		if b, err := json.Marshal(health); err != nil {
+			return errors.Wrapf(err, "marshal %v", health.String())
+		} else if err := rdb.HSet(ctx, SRS_CLUSTER_HEALTH, name, string(b)).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v %v %v", SRS_CLUSTER_HEALTH, name, string(b))
+		}
+	}
+
+	logger.Tf(ctx, "cluster check ok, nodes=%v", len(healths))
+	return nil
+}
+
+func (v *ClusterWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/mgmt/nodes/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			nodes, err := queryClusterNodes(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query nodes")
+			}
+
+			healths, err := rdb.HGetAll(ctx, SRS_CLUSTER_HEALTH).Result()
+			if err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hgetall %v", SRS_CLUSTER_HEALTH)
+			}
+
+			// Never response the secret of node.
+			res := make([]map[string]interface{}, 0, len(nodes))
+			for name, node := range nodes {
+				elem := map[string]interface{}{
+					"name":   node.Name,
+					"url":    node.URL,
+					"secret": node.Secret != "",
+					"update": node.Update,
+				}
+
+				if value, ok := healths[name]; ok {
+					var health ClusterNodeHealth
+					if err := json.Unmarshal([]byte(value), &health); err != nil {
+						return errors.Wrapf(err, "unmarshal %v", value)
+					}
+					elem["health"] = &health
+				}
+
+				res = append(res, elem)
+			}
+
+			sort.Slice(res, func(i, j int) bool {
+				return res[i]["name"].(string) < res[j]["name"].(string)
+			})
+
+			httpWriteData(ctx, w, r, res)
+			logger.Tf(ctx, "cluster query nodes ok, nodes=%v, token=%vB", len(res), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/nodes/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var userConf ClusterNode
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				*ClusterNode
+			}{
+				Token: &token, ClusterNode: &userConf,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if !clusterNodeNameRegexp.MatchString(userConf.Name) {
+				return errors.Errorf("invalid name %v", userConf.Name)
+			}
+			userConf.URL = strings.TrimSuffix(strings.TrimSpace(userConf.URL), "/")
+			if err := validateClusterNodeURL(userConf.URL); err != nil {
+				return errors.Wrapf(err, "validate url")
+			}
+
+			nodes, err := queryClusterNodes(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query nodes")
+			}
+
+			// Encrypt the secret, or use the previous one if not changed.
+			if userConf.Secret = strings.TrimSpace(userConf.Secret); userConf.Secret != "" {
+				if userConf.Secret, err = encryptByApiSecret(userConf.Secret); err != nil {
+					return errors.Wrapf(err, "encrypt secret")
+				}
+			} else if previous, ok := nodes[userConf.Name]; ok {
+				userConf.Secret = previous.Secret
+			} else {
+				return errors.New("no secret")
+			}
+			userConf.Update = time.Now().Format(time.RFC3339)
+
+			if b, err := json.Marshal(&userConf); err != nil {
+				return errors.Wrapf(err, "marshal %v", userConf.String())
+			} else if err := rdb.HSet(ctx, SRS_CLUSTER_NODES, userConf.Name, string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v %v", SRS_CLUSTER_NODES, userConf.Name)
+			}
+
+			// The health of previous config is invalid.
+			if err := rdb.HDel(ctx, SRS_CLUSTER_HEALTH, userConf.Name).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_CLUSTER_HEALTH, userConf.Name)
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "cluster update node ok, %v, token=%vB", userConf.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/nodes/remove"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, name string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				Name  *string `json:"name"`
+			}{
+				Token: &token, Name: &name,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			for _, key := range []string{SRS_CLUSTER_NODES, SRS_CLUSTER_HEALTH} {
+				if err := rdb.HDel(ctx, key, name).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", key, name)
+				}
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "cluster remove node ok, name=%v, token=%vB", name, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	// Proxy the API to node, for example, /terraform/v1/mgmt/nodes/node1/streams/query to the
+	// /terraform/v1/mgmt/streams/query of node1.
+	ep = "/terraform/v1/mgmt/nodes/"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			body := make(map[string]interface{})
+			if err := ParseBody(ctx, r, &body); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+			if v, ok := body["token"].(string); ok {
+				token = v
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			name, api := strings.TrimPrefix(r.URL.Path, ep), ""
+			if index := strings.Index(name, "/"); index > 0 {
+				name, api = name[:index], name[index+1:]
+			}
+			if !clusterProxyAPIs[api] {
+				return newHttpStatusError(http.StatusNotFound, errors.Errorf("invalid api %v", api))
+			}
+
+			nodes, err := queryClusterNodes(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query nodes")
+			}
+			node, ok := nodes[name]
+			if !ok {
+				return newHttpStatusError(http.StatusNotFound, errors.Errorf("no node %v", name))
+			}
+
+			// Never forward the token of this node, the request is signed by the secret of node.
+			delete(body, "token")
+			b, err := json.Marshal(body)
+			if err != nil {
+				return errors.Wrapf(err, "marshal body")
+			}
+
+			data, err := requestClusterNode(ctx, node, api, b)
+			if err != nil {
+				return newHttpStatusError(http.StatusBadGateway, errors.Wrapf(err, "node %v", name))
+			}
+
+			w.Header().Set("X-Oryx-Node", name)
+			httpWriteData(ctx, w, r, &struct {
+				Node string          `json:"node"`
+				Data json.RawMessage `json:"data"`
+			}{
+				Node: name, Data: data,
+			})
+			logger.Tf(ctx, "cluster proxy ok, node=%v, api=%v, token=%vB", name, api, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
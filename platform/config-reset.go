@@ -0,0 +1,506 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The subsystems to reset, see resetSubsystem.
+const (
+	ConfigResetHttps      = "https"
+	ConfigResetForward    = "forward"
+	ConfigResetVLive      = "vlive"
+	ConfigResetHooks      = "hooks"
+	ConfigResetStreamKeys = "stream-keys"
+)
+
+// The subsystems in order of factory reset. Note that the admin password is never reset, which is in the .env file.
+var configResetSubsystems = []string{
+	ConfigResetForward, ConfigResetVLive, ConfigResetHooks, ConfigResetStreamKeys, ConfigResetHttps,
+}
+
+// The confirmation of factory reset, which is the extra step with a one-time code.
+const configResetFactoryConfirm = "factory-reset"
+
+// The duration of the one-time code of factory reset, should confirm again after it expired.
+var configResetFactoryCodeExpire = 5 * time.Minute
+
+// The max number of resets in audit log.
+const configResetAuditMaxEntries = 1000
+
+// ConfigResetResult is what is removed by reset of a subsystem.
+type ConfigResetResult struct {
+	// The subsystem, for example, forward.
+	Subsystem string `json:"subsystem"`
+	// The redis keys or fields removed.
+	Keys []string `json:"keys"`
+	// The files removed.
+	Files []string `json:"files"`
+	// The number of running tasks stopped.
+	Tasks int `json:"tasks"`
+}
+
+func (v *ConfigResetResult) String() string {
+	return fmt.Sprintf("subsystem=%v, keys=%v, files=%v, tasks=%v", v.Subsystem, len(v.Keys), len(v.Files), v.Tasks)
+}
+
+// ConfigResetAudit is a reset of subsystem, done or failed.
+type ConfigResetAudit struct {
+	// The time of reset.
+	Time string `json:"time"`
+	// The client IP of caller.
+	IP string `json:"ip"`
+	// The subsystem to reset.
+	Subsystem string `json:"subsystem"`
+	// Whether reset by factory reset.
+	Factory bool `json:"factory,omitempty"`
+	// The number of redis keys or fields, files and tasks removed.
+	Keys  int `json:"keys"`
+	Files int `json:"files"`
+	Tasks int `json:"tasks"`
+	// The error if failed.
+	Error string `json:"error,omitempty"`
+}
+
+func (v *ConfigResetAudit) String() string {
+	return fmt.Sprintf("time=%v, ip=%v, subsystem=%v, factory=%v, keys=%v, files=%v, tasks=%v, error=%v",
+		v.Time, v.IP, v.Subsystem, v.Factory, v.Keys, v.Files, v.Tasks, v.Error,
+	)
+}
+
+// recordConfigResetAudit saves the reset to audit log. It never fails, because the audit should not change the result.
+func recordConfigResetAudit(ctx context.Context, r *http.Request, subsystem string, factory bool, result *ConfigResetResult, err error) {
+	audit := &ConfigResetAudit{
+		Time: time.Now().Format(time.RFC3339), IP: clientIP(r), Subsystem: subsystem, Factory: factory,
+	}
+	if result != nil {
+		audit.Keys, audit.Files, audit.Tasks = len(result.Keys), len(result.Files), result.Tasks
+	}
+	if err != nil {
+		audit.Error = err.Error()
+	}
+
+	if err := func() error {
+		b, err := json.Marshal(audit)
+		if err != nil {
+			return errors.Wrapf(err, "marshal %v", audit.String())
+		}
+
+		return bufferedRedisWrite(ctx, "reset audit", func(ctx context.Context, pipe redis.Pipeliner) {
+			pipe.LPush(ctx, SRS_RESET_AUDIT, string(b))
+			pipe.LTrim(ctx, SRS_RESET_AUDIT, 0, configResetAuditMaxEntries-1)
+		})
+	}(); err != nil {
+		logger.Wf(ctx, "reset audit ignore %v err %+v", audit.String(), err)
+		return
+	}
+
+	logger.Tf(ctx, "reset audit ok, %v", audit.String())
+}
+
+// resetSubsystem removes the redis keys and files of subsystem, stops its running tasks, and regenerates the config
+// depends on it. It's done in this order, so the removed tasks are not created again by the configures.
+func resetSubsystem(ctx context.Context, subsystem string) (*ConfigResetResult, error) {
+	result := &ConfigResetResult{Subsystem: subsystem, Keys: []string{}, Files: []string{}}
+
+	var err error
+	switch subsystem {
+	case ConfigResetHttps:
+		err = resetHttps(ctx, result)
+	case ConfigResetForward:
+		err = resetForward(ctx, result)
+	case ConfigResetVLive:
+		err = resetVLive(ctx, result)
+	case ConfigResetHooks:
+		err = resetHooks(ctx, result)
+	case ConfigResetStreamKeys:
+		err = resetStreamKeys(ctx, result)
+	default:
+		return nil, newHttpStatusError(http.StatusBadRequest, errors.Errorf(
+			"invalid subsystem %v, should be one of %v", subsystem, strings.Join(configResetSubsystems, ","),
+		))
+	}
+	if err != nil {
+		return result, errors.Wrapf(err, "reset %v", subsystem)
+	}
+
+	logger.Tf(ctx, "reset ok, %v", result.String())
+	return result, nil
+}
+
+// resetRedisKeys removes the keys, and saves the existing ones to result.
+func resetRedisKeys(ctx context.Context, result *ConfigResetResult, keys ...string) error {
+	for _, key := range keys {
+		if n, err := rdb.Del(ctx, key).Result(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "del %v", key)
+		} else if n > 0 {
+			result.Keys = append(result.Keys, key)
+		}
+	}
+	return nil
+}
+
+// resetHttps removes the settings and certificate of HTTPS, then creates the self-signed certificate if enabled by
+// AUTO_SELF_SIGNED_CERTIFICATE, and regenerates the config of NGINX.
+func resetHttps(ctx context.Context, result *ConfigResetResult) error {
+	if err := resetRedisKeys(ctx, result, SRS_HTTPS, SRS_HTTPS_DOMAIN, SRS_HTTPS_CERTBOT); err != nil {
+		return errors.Wrapf(err, "reset keys")
+	}
+
+	files, err := certManager.removeSslFiles(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "remove ssl files")
+	}
+	result.Files = append(result.Files, files...)
+
+	if envSelfSignedCertificate() == "on" {
+		if err := certManager.createSelfSignCertificate(ctx); err != nil {
+			return errors.Wrapf(err, "create self-signed certificate")
+		}
+		return nil
+	}
+
+	if err := nginxGenerateConfig(ctx, NginxTriggerReset); err != nil {
+		return errors.Wrapf(err, "nginx config and reload")
+	}
+	return nil
+}
+
+// resetForward removes the configures, templates, rules and integrations of forwarding, and stops all tasks.
+func resetForward(ctx context.Context, result *ConfigResetResult) error {
+	if err := resetRedisKeys(ctx, result,
+		SRS_FORWARD_CONFIG, SRS_FORWARD_TEMPLATES, SRS_FORWARD_RULES, SRS_FORWARD_INTEGRATIONS,
+	); err != nil {
+		return errors.Wrapf(err, "reset keys")
+	}
+
+	if forwardWorker != nil {
+		result.Tasks = forwardWorker.Reset(ctx, "reset")
+	}
+
+	if err := resetRedisKeys(ctx, result, SRS_FORWARD_TASK); err != nil {
+		return errors.Wrapf(err, "reset tasks")
+	}
+	return nil
+}
+
+// resetVLive removes the configures of vLive, and the files uploaded for them, and stops all tasks. Note that the
+// files in media library not uploaded for the configures are kept, see removeVLiveLibraryFile.
+func resetVLive(ctx context.Context, result *ConfigResetResult) error {
+	configs, err := queryVLiveLibraryConfigs(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query configs")
+	}
+
+	if err := resetRedisKeys(ctx, result, SRS_VLIVE_CONFIG); err != nil {
+		return errors.Wrapf(err, "reset keys")
+	}
+
+	if vLiveWorker != nil {
+		result.Tasks = vLiveWorker.Reset(ctx, "reset")
+	}
+
+	if err := resetRedisKeys(ctx, result, SRS_VLIVE_TASK); err != nil {
+		return errors.Wrapf(err, "reset tasks")
+	}
+
+	// Only the uploaded files are removed, which are moved to the vLive directory and named by UUID.
+	for _, config := range configs {
+		for _, file := range config.Files {
+			if file.Type != FFprobeSourceTypeUpload || file.UUID == "" {
+				continue
+			}
+			if file.Target != path.Join(dirVLivePath, fmt.Sprintf("%v%v", file.UUID, path.Ext(file.Target))) {
+				continue
+			}
+
+			if err := os.Remove(file.Target); err != nil && !os.IsNotExist(err) {
+				return errors.Wrapf(err, "remove %v", file.Target)
+			} else if err == nil {
+				result.Files = append(result.Files, file.Target)
+			}
+		}
+	}
+	return nil
+}
+
+// resetHooks removes the webhook target and its options, and notifies the callback worker.
+func resetHooks(ctx context.Context, result *ConfigResetResult) error {
+	if err := resetRedisKeys(ctx, result, SRS_HOOKS); err != nil {
+		return errors.Wrapf(err, "reset keys")
+	}
+
+	if callbackWorker != nil {
+		select {
+		case callbackWorker.updateConfig <- true:
+		case <-ctx.Done():
+		default:
+		}
+	}
+	return nil
+}
+
+// resetStreamKeys removes the publish keys of streams and the quotas, and kicks off the streams published by them.
+// Note that the global publish secret is kept, see SRS_SECRET_PUBLISH.
+func resetStreamKeys(ctx context.Context, result *ConfigResetResult) error {
+	fields, err := rdb.HKeys(ctx, SRS_AUTH_SECRET).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hkeys %v", SRS_AUTH_SECRET)
+	}
+
+	prefix := GenerateRoomPublishKey("")
+	streams := make(map[string]bool)
+	for _, field := range fields {
+		if !strings.HasPrefix(field, prefix) {
+			continue
+		}
+
+		if err := rdb.HDel(ctx, SRS_AUTH_SECRET, field).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hdel %v %v", SRS_AUTH_SECRET, field)
+		}
+		result.Keys = append(result.Keys, fmt.Sprintf("%v/%v", SRS_AUTH_SECRET, field))
+		streams[strings.TrimPrefix(field, prefix)] = true
+	}
+
+	if err := resetRedisKeys(ctx, result, SRS_STREAM_QUOTA, SRS_STREAM_QUOTA_EVENTS); err != nil {
+		return errors.Wrapf(err, "reset keys")
+	}
+
+	actives, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
+	}
+	for streamURL, value := range actives {
+		var stream SrsStream
+		if err := json.Unmarshal([]byte(value), &stream); err != nil {
+			logger.Wf(ctx, "reset ignore stream %v err %+v", value, err)
+			continue
+		}
+		if !streams[stream.Stream] {
+			continue
+		}
+
+		if _, err := kickoffStream(ctx, &stream); err != nil {
+			logger.Wf(ctx, "reset ignore kickoff %v err %+v", streamURL, err)
+			continue
+		}
+		result.Tasks++
+	}
+	return nil
+}
+
+// createConfigResetCode creates the one-time code of factory reset, which replaces the previous one.
+func createConfigResetCode(ctx context.Context) (string, time.Time, error) {
+	code := uuid.NewString()
+	expire := time.Now().Add(configResetFactoryCodeExpire)
+	if err := rdb.Set(ctx, SRS_RESET_CODE, code, configResetFactoryCodeExpire).Err(); err != nil && err != redis.Nil {
+		return "", expire, errors.Wrapf(err, "set %v", SRS_RESET_CODE)
+	}
+	return code, expire, nil
+}
+
+// consumeConfigResetCode verifies the one-time code of factory reset, and removes it, so it's single-use.
+func consumeConfigResetCode(ctx context.Context, code string) error {
+	expected, err := rdb.Get(ctx, SRS_RESET_CODE).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "get %v", SRS_RESET_CODE)
+	}
+	if expected == "" || subtle.ConstantTimeCompare([]byte(code), []byte(expected)) != 1 {
+		return newHttpCodeError(http.StatusForbidden, SrsStackErrorResetConfirm,
+			errors.New("invalid or expired code, please confirm again"),
+		)
+	}
+
+	if err := rdb.Del(ctx, SRS_RESET_CODE).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "del %v", SRS_RESET_CODE)
+	}
+	return nil
+}
+
+// rangeConfigResetAudits callback for each reset in audit log, the latest first.
+func rangeConfigResetAudits(ctx context.Context, handler func(audit *ConfigResetAudit) error) error {
+	return rangeRedisList(ctx, SRS_RESET_AUDIT, configResetAuditMaxEntries, func(value string) error {
+		var audit ConfigResetAudit
+		if err := json.Unmarshal([]byte(value), &audit); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", value)
+		}
+		return handler(&audit)
+	})
+}
+
+func handleMgmtConfigReset(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/reset"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, subsystem, confirm string
+			if err := ParseBody(ctx, r, &struct {
+				Token     *string `json:"token"`
+				Subsystem *string `json:"subsystem"`
+				Confirm   *string `json:"confirm"`
+			}{
+				Token: &token, Subsystem: &subsystem, Confirm: &confirm,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if subsystem == "" || confirm != subsystem {
+				return newHttpCodeError(http.StatusBadRequest, SrsStackErrorResetConfirm, errors.Errorf(
+					"confirm %v mismatch subsystem %v", confirm, subsystem,
+				))
+			}
+
+			result, err := resetSubsystem(ctx, subsystem)
+			if cause, ok := errors.Cause(err).(*httpStatusError); !ok || cause.status != http.StatusBadRequest {
+				recordConfigResetAudit(ctx, r, subsystem, false, result, err)
+			}
+			if err != nil {
+				return errors.Wrapf(err, "reset %v", subsystem)
+			}
+
+			httpWriteData(ctx, w, r, result)
+			logger.Tf(ctx, "reset ok, %v, token=%vB", result.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/reset/factory"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, confirm, code string
+			if err := ParseBody(ctx, r, &struct {
+				Token   *string `json:"token"`
+				Confirm *string `json:"confirm"`
+				Code    *string `json:"code"`
+			}{
+				Token: &token, Confirm: &confirm, Code: &code,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if confirm != configResetFactoryConfirm {
+				return newHttpCodeError(http.StatusBadRequest, SrsStackErrorResetConfirm, errors.Errorf(
+					"confirm %v mismatch %v", confirm, configResetFactoryConfirm,
+				))
+			}
+
+			// The first step, response the one-time code, which should be confirmed by the second step.
+			if code == "" {
+				code, expire, err := createConfigResetCode(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "create code")
+				}
+
+				httpWriteData(ctx, w, r, &struct {
+					Code       string   `json:"code"`
+					Expire     string   `json:"expire"`
+					Subsystems []string `json:"subsystems"`
+				}{
+					Code: code, Expire: expire.Format(time.RFC3339), Subsystems: configResetSubsystems,
+				})
+				logger.Tf(ctx, "reset factory confirm, expire=%v, token=%vB", expire.Format(time.RFC3339), len(token))
+				return nil
+			}
+
+			if err := consumeConfigResetCode(ctx, code); err != nil {
+				return errors.Wrapf(err, "consume code")
+			}
+
+			// Reset all subsystems, and stop at the first failure, so the caller is able to retry.
+			results := []*ConfigResetResult{}
+			for _, subsystem := range configResetSubsystems {
+				result, err := resetSubsystem(ctx, subsystem)
+				recordConfigResetAudit(ctx, r, subsystem, true, result, err)
+				if err != nil {
+					return errors.Wrapf(err, "reset %v", subsystem)
+				}
+				results = append(results, result)
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Results []*ConfigResetResult `json:"results"`
+			}{
+				Results: results,
+			})
+			logger.Tf(ctx, "reset factory ok, subsystems=%v, token=%vB", len(results), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/reset/audit"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Stream the audits, in the same envelope of httpWriteData, see JSONArrayWriter.
+			aw := NewJSONArrayWriter(w, "audits")
+			if err := rangeConfigResetAudits(ctx, func(audit *ConfigResetAudit) error {
+				return aw.Write(audit)
+			}); err != nil {
+				return errors.Wrapf(err, "range audits")
+			}
+			if err := aw.Close(); err != nil {
+				return errors.Wrapf(err, "close")
+			}
+			logger.Tf(ctx, "reset audit query ok, audits=%v, token=%vB", aw.Elements(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
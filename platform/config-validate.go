@@ -0,0 +1,211 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The code of config issue, which is stable for UI to translate, while the message is for human.
+const (
+	// The field is required but empty.
+	ConfigIssueRequired = "required"
+	// The value of field is not allowed.
+	ConfigIssueInvalid = "invalid"
+	// The type of field is wrong, for example, a number for string.
+	ConfigIssueInvalidType = "invalid_type"
+	// The field is not a valid stream URL.
+	ConfigIssueInvalidURL = "invalid_url"
+	// The field is not known, it's a warning for older or newer UI.
+	ConfigIssueUnknownField = "unknown_field"
+	// The value is shorter or longer than allowed.
+	ConfigIssueTooShort = "too_short"
+	ConfigIssueTooLong  = "too_long"
+	// The value contains the characters not allowed, for example, newline.
+	ConfigIssueInvalidChar = "invalid_char"
+	// The value does not match the complexity rules, for example, no digit in password.
+	ConfigIssueWeak = "weak"
+)
+
+// ConfigIssue is a problem of a field in the configuration.
+type ConfigIssue struct {
+	// The field in JSON, for example, server or files[0].target.
+	Field string `json:"field"`
+	// The code of issue, see ConfigIssueRequired for example.
+	Code string `json:"code"`
+	// The message for human.
+	Message string `json:"message"`
+}
+
+func (v *ConfigIssue) String() string {
+	return fmt.Sprintf("field=%v, code=%v, message=%v", v.Field, v.Code, v.Message)
+}
+
+// ConfigValidation collects all the problems of configuration, rather than fail on the first one. The errors reject
+// the configuration, while the warnings do not.
+type ConfigValidation struct {
+	Errors   []*ConfigIssue `json:"errors,omitempty"`
+	Warnings []*ConfigIssue `json:"warnings,omitempty"`
+}
+
+func (v *ConfigValidation) AddError(field, code, format string, a ...interface{}) {
+	v.Errors = append(v.Errors, &ConfigIssue{Field: field, Code: code, Message: fmt.Sprintf(format, a...)})
+}
+
+func (v *ConfigValidation) AddWarning(field, code, format string, a ...interface{}) {
+	v.Warnings = append(v.Warnings, &ConfigIssue{Field: field, Code: code, Message: fmt.Sprintf(format, a...)})
+}
+
+// Err returns the error with all issues as details if there is any error, or nil.
+func (v *ConfigValidation) Err() error {
+	if len(v.Errors) == 0 {
+		return nil
+	}
+
+	fields := make([]string, 0, len(v.Errors))
+	for _, issue := range v.Errors {
+		fields = append(fields, fmt.Sprintf("%v:%v", issue.Field, issue.Code))
+	}
+
+	err := newHttpCodeError(http.StatusBadRequest, SrsStackErrorConfigInvalid,
+		errors.Errorf("invalid config, %v", strings.Join(fields, ", ")),
+	)
+	err.details = v
+	return err
+}
+
+// parseConfigBody reads the body to v like ParseBody, but never fails on the first wrong field. Each field is parsed
+// alone, so the wrong type of a field is an issue in validation, and the unknown field is a warning.
+func parseConfigBody(ctx context.Context, r *http.Request, v interface{}) (*ConfigValidation, error) {
+	validation := &ConfigValidation{}
+
+	// Check the Content-Type and whether malformed, by ParseBody.
+	raw := make(map[string]json.RawMessage)
+	if err := ParseBody(ctx, r, &raw); err != nil {
+		return nil, errors.Wrapf(err, "parse body")
+	}
+
+	// Match the field case-insensitively, like encoding/json.
+	targets := make(map[string]interface{})
+	collectConfigFields(reflect.ValueOf(v), targets)
+
+	// Sort the keys, so the issues are stable.
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := raw[key]
+		target, ok := targets[strings.ToLower(key)]
+		if !ok {
+			validation.AddWarning(key, ConfigIssueUnknownField, "unknown field %v is ignored", key)
+			continue
+		}
+
+		if err := json.Unmarshal(value, target); err != nil {
+			if r0, ok := err.(*json.UnmarshalTypeError); ok {
+				validation.AddError(key, ConfigIssueInvalidType, "expect %v but got %v", r0.Type, r0.Value)
+			} else {
+				validation.AddError(key, ConfigIssueInvalidType, "invalid value of %v", key)
+			}
+		}
+	}
+
+	return validation, nil
+}
+
+// collectConfigFields collects the pointers of fields in struct v, the key is the lower JSON name. The embedded
+// struct pointer is flattened, and the pointer field is the target itself.
+func collectConfigFields(v reflect.Value, targets map[string]interface{}) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return
+	}
+
+	for i := 0; i < v.NumField(); i++ {
+		field, value := v.Type().Field(i), v.Field(i)
+		if field.Anonymous {
+			collectConfigFields(value, targets)
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		} else if name == "" {
+			name = field.Name
+		}
+
+		if value.Kind() == reflect.Ptr {
+			if value.IsNil() {
+				value.Set(reflect.New(field.Type.Elem()))
+			}
+			targets[strings.ToLower(name)] = value.Interface()
+		} else {
+			targets[strings.ToLower(name)] = value.Addr().Interface()
+		}
+	}
+}
+
+// validateConfigAction validates the action of configuration, empty action to query.
+func validateConfigAction(validation *ConfigValidation, action string, allowed []string) {
+	if action != "" && !slicesContains(allowed, action) {
+		validation.AddError("action", ConfigIssueInvalid, "action %v should be %v", action, strings.Join(allowed, ","))
+	}
+}
+
+// validateConfigPlatform validates the platform, which should be the specified one, or a custom one with prefix.
+func validateConfigPlatform(validation *ConfigValidation, platform string, allowed []string, prefix string) {
+	if platform == "" {
+		validation.AddError("platform", ConfigIssueRequired, "platform is required")
+	} else if !slicesContains(allowed, platform) && !strings.Contains(platform, prefix) {
+		validation.AddError("platform", ConfigIssueInvalid, "platform %v should be %v or %vxxx",
+			platform, strings.Join(allowed, ","), prefix,
+		)
+	}
+}
+
+// validateConfigTarget validates the server and secret, which is the URL to publish stream to.
+func validateConfigTarget(validation *ConfigValidation, server, secret string) {
+	if server == "" {
+		validation.AddError("server", ConfigIssueRequired, "server is required")
+		return
+	}
+
+	outputServer := server
+	if !strings.HasSuffix(outputServer, "/") && !strings.HasPrefix(secret, "/") && secret != "" {
+		outputServer += "/"
+	}
+	outputURL := fmt.Sprintf("%v%v", outputServer, secret)
+
+	allowedSchemes := []string{"rtmp", "rtmps", "srt"}
+	if u, err := RebuildStreamURL(outputURL); err != nil {
+		validation.AddError("server", ConfigIssueInvalidURL, "server is not a valid URL")
+	} else if !slicesContains(allowedSchemes, u.Scheme) {
+		validation.AddError("server", ConfigIssueInvalidURL, "scheme %v should be %v",
+			u.Scheme, strings.Join(allowedSchemes, ","),
+		)
+	} else if u.Hostname() == "" {
+		validation.AddError("server", ConfigIssueInvalidURL, "no host in server")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestConfigValidate_ForwardAndVLive(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	// The issues in form of field:code, sorted by field.
+	issues := func(arr []*ConfigIssue) string {
+		var r []string
+		for _, issue := range arr {
+			r = append(r, issue.Field+":"+issue.Code)
+		}
+		return strings.Join(r, ",")
+	}
+
+	parse := func(body string, conf interface{}) (string, *ConfigValidation) {
+		r := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+
+		var action string
+		var validation *ConfigValidation
+		var err error
+		switch conf := conf.(type) {
+		case *ForwardConfigure:
+			validation, err = parseConfigBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Action *string `json:"action"`
+				Push   *bool   `json:"push"`
+				*ForwardConfigure
+			}{
+				Action: &action, ForwardConfigure: conf,
+			})
+		case *VLiveConfigure:
+			validation, err = parseConfigBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Action *string `json:"action"`
+				Push   *bool   `json:"push"`
+				*VLiveConfigure
+			}{
+				Action: &action, VLiveConfigure: conf,
+			})
+		}
+		if err != nil {
+			t.Fatalf("Fail for %v, err %+v", body, err)
+		}
+		return action, validation
+	}
+
+	for _, c := range []struct {
+		name     string
+		vlive    bool
+		body     string
+		errors   string
+		warnings string
+	}{
+		{"forward ok", false, `{"action":"update","platform":"wx","server":"rtmp://localhost/live","secret":"livestream"}`, "", ""},
+		{"forward custom", false, `{"action":"update","platform":"forwarding-1","server":"srt://localhost:10080","enabled":true}`, "", ""},
+		{"forward query", false, `{}`, "", ""},
+		{"forward all issues", false, `{"action":"update","platform":"youtube","server":"http://localhost/live"}`, "platform:invalid,server:invalid_url", ""},
+		{"forward empty", false, `{"action":"update"}`, "platform:required,server:required", ""},
+		{"forward validate", false, `{"action":"validate","platform":"wx","server":"http://localhost/live"}`, "", ""},
+		{"forward action", false, `{"action":"remove","platform":"wx","server":"rtmp://localhost/live"}`, "action:invalid", ""},
+		{"forward type", false, `{"action":"update","platform":"wx","server":"rtmp://localhost/live","enabled":"yes","secret":1}`, "enabled:invalid_type,secret:invalid_type", ""},
+		{"forward unknown", false, `{"action":"update","PLATFORM":"wx","server":"rtmp://localhost/live","foo":1,"bar":"x"}`, "", "bar:unknown_field,foo:unknown_field"},
+		{"vlive ok", true, `{"action":"update","platform":"vlive-1","server":"rtmp://localhost/live","secret":"s","files":[{"target":"upload/a.mp4"}]}`, "", ""},
+		{"vlive no files", true, `{"action":"update","platform":"wx","server":"rtmp://localhost/live"}`, "files:required", ""},
+		{"vlive files", true, `{"action":"update","platform":"wx","server":"rtmp://localhost/live","files":[{"target":"a.mp4"},null,{"name":"b"}]}`, "files[1]:invalid,files[2].target:required", ""},
+		{"vlive all issues", true, `{"action":"update","platform":"forwarding-1","custom":"x","files":[],"x":1}`, "custom:invalid_type,platform:invalid,server:required,files:required", "x:unknown_field"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			var action string
+			var validation *ConfigValidation
+			if c.vlive {
+				var conf VLiveConfigure
+				action, validation = parse(c.body, &conf)
+				validateConfigAction(validation, action, []string{"update", "validate"})
+				if action != "" {
+					conf.Validate(validation, action == "update")
+				}
+			} else {
+				var conf ForwardConfigure
+				action, validation = parse(c.body, &conf)
+				validateConfigAction(validation, action, []string{"update", "validate"})
+				if action != "" {
+					conf.Validate(validation, action == "update", nil)
+				}
+			}
+
+			if r := issues(validation.Errors); r != c.errors {
+				t.Errorf("Fail for errors %v, expect %v", r, c.errors)
+			}
+			if r := issues(validation.Warnings); r != c.warnings {
+				t.Errorf("Fail for warnings %v, expect %v", r, c.warnings)
+			}
+			if err := validation.Err(); (err == nil) != (c.errors == "") {
+				t.Errorf("Fail for err %+v", err)
+			}
+		})
+	}
+}
+
+func TestConfigValidate_ResponseDetails(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	validation := &ConfigValidation{}
+	validation.AddError("platform", ConfigIssueRequired, "platform is required")
+	validation.AddError("server", ConfigIssueInvalidURL, "server is not a valid URL")
+	validation.AddWarning("foo", ConfigIssueUnknownField, "unknown field foo is ignored")
+
+	r := httptest.NewRequest(http.MethodPost, "/terraform/v1/ffmpeg/forward/secret", nil)
+	w := httptest.NewRecorder()
+	httpWriteError(ctx, w, r, errors.Wrapf(validation.Err(), "validate"))
+
+	var res struct {
+		Code SrsStackError `json:"code"`
+		Data struct {
+			Message string            `json:"message"`
+			Details *ConfigValidation `json:"details"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatalf("Fail for body %v, err %+v", w.Body.String(), err)
+	}
+	if w.Code != http.StatusBadRequest || res.Code != SrsStackErrorConfigInvalid || res.Data.Message == "" {
+		t.Errorf("Fail for code=%v, body=%v", w.Code, w.Body.String())
+	}
+	if d := res.Data.Details; d == nil || len(d.Errors) != 2 || len(d.Warnings) != 1 || d.Errors[1].Field != "server" {
+		t.Errorf("Fail for body %v", w.Body.String())
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestConfig_NginxGenerateSerialized(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	setupFakeRedis(t)
+
+	oldConf, oldCertManager := conf, certManager
+	defer func() {
+		conf, certManager = oldConf, oldCertManager
+	}()
+
+	pwd, err := ioutil.TempDir("", "oryx-config-")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(pwd)
+	if err := os.MkdirAll(path.Join(pwd, "containers/data/config"), 0755); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	conf, certManager = &Config{IsDarwin: true, Pwd: pwd}, NewCertManager()
+
+	if err := nginxGenerateConfig(ctx, NginxTriggerBoot); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	hash := renderedConfigHash()
+
+	// One request changes the setting then regenerates, while others regenerate concurrently, the last generation
+	// must contain the change, no matter how they interleave.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if i == 3 {
+				if err := rdb.Set(ctx, SRS_HTTPS, "ssl", 0).Err(); err != nil {
+					t.Errorf("Fail for err %+v", err)
+				}
+			}
+			if err := nginxGenerateConfig(ctx, NginxTriggerBoot); err != nil {
+				t.Errorf("Fail for err %+v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if b, err := ioutil.ReadFile(path.Join(pwd, "containers/data/config/nginx.server.conf")); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	} else if !strings.Contains(string(b), "listen       443 ssl;") {
+		t.Errorf("Fail for no ssl in %v", string(b))
+	}
+
+	if newHash := renderedConfigHash(); newHash == hash {
+		t.Errorf("Fail for hash not changed %v", hash)
+	}
+}
@@ -5,6 +5,8 @@ package main
 
 import (
 	"context"
+	"math/rand"
+	"strings"
 	"sync"
 	"time"
 
@@ -32,63 +34,115 @@ func (v *CrontabWorker) Start(ctx context.Context) error {
 	go func() {
 		defer v.wg.Done()
 
-		for {
-			if err := fastCache.Refresh(ctx); err != nil {
-				logger.Wf(ctx, "crontab: refresh fast cache err %v", err)
+		safeRestart(ctx, func() {
+			for {
+				if err := fastCache.Refresh(ctx); err != nil {
+					logThrottle.Wf(ctx, err.Error(), "crontab: refresh fast cache err %v", err)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(3 * time.Second):
+				}
 			}
-
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(3 * time.Second):
-			}
-		}
+		})
 	}()
 
+	if err := clockChecker.Start(ctx, &v.wg); err != nil {
+		return errors.Wrapf(err, "start clock checker")
+	}
+
+	versionsInterval, err := parseVersionsRefreshInterval(envVersionsRefreshInterval())
+	if err != nil {
+		return errors.Wrapf(err, "parse VERSIONS_REFRESH_INTERVAL")
+	}
+
+	if versionsInterval <= 0 {
+		logger.Tf(ctx, "crontab: disable refreshing latest version")
+	} else {
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+
+			safeRestart(ctx, func() {
+				for {
+					// The version is queried when startup, so wait for a while, and use jitter to avoid all instances
+					// request at the same time.
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(jitterInterval(versionsInterval)):
+					}
+
+					logger.Tf(ctx, "crontab: start to query latest version")
+					if versions, err := queryLatestVersion(ctx); err != nil {
+						logger.Wf(ctx, "crontab: ignore err %v", err)
+					} else if versions != nil && versions.Latest.Version != "" {
+						conf.SetVersions(versions)
+						logger.Tf(ctx, "crontab: query version ok, result is %v", versions.String())
+					}
+				}
+			})
+		}()
+	}
+
 	v.wg.Add(1)
 	go func() {
 		defer v.wg.Done()
 
-		// Start the crontab when system startup for a while.
-		select {
-		case <-ctx.Done():
-			return
-		case <-time.After(5 * time.Minute):
-		}
-
-		for {
-			logger.Tf(ctx, "crontab: start to query latest version")
-			if versions, err := queryLatestVersion(ctx); err != nil {
-				logger.Wf(ctx, "crontab: ignore err %v", err)
-			} else if versions != nil && versions.Latest != "" {
-				conf.Versions = *versions
-				logger.Tf(ctx, "crontab: query version ok, result is %v", versions.String())
-			}
-
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(15 * time.Minute):
+		safeRestart(ctx, func() {
+			for {
+				logger.Tf(ctx, "crontab: start to refresh ssl cert")
+				if err := certManager.refreshSSLCert(ctx); err != nil {
+					logger.Wf(ctx, "crontab: ignore err %v", err)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(24 * time.Hour):
+				}
 			}
-		}
+		})
 	}()
 
 	v.wg.Add(1)
 	go func() {
 		defer v.wg.Done()
 
-		for {
-			logger.Tf(ctx, "crontab: start to refresh ssl cert")
-			if err := certManager.refreshSSLCert(ctx); err != nil {
-				logger.Wf(ctx, "crontab: ignore err %v", err)
+		safeRestart(ctx, func() {
+			for {
+				if err := certManager.refreshCertbotCert(ctx); err != nil {
+					logger.Wf(ctx, "crontab: ignore certbot err %+v", err)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(certbotWatchInterval):
+				}
 			}
+		})
+	}()
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
 
-			select {
-			case <-ctx.Done():
-				return
-			case <-time.After(24 * time.Hour):
+		safeRestart(ctx, func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(housekeepingInterval):
+				}
+
+				if _, err := housekeeper.Sweep(ctx); err != nil {
+					logger.Wf(ctx, "crontab: ignore housekeeping err %+v", err)
+				}
 			}
-		}
+		})
 	}()
 
 	if err := certManager.Initialize(ctx); err != nil {
@@ -99,20 +153,48 @@ func (v *CrontabWorker) Start(ctx context.Context) error {
 	go func() {
 		defer v.wg.Done()
 
-		for {
-			logger.Tf(ctx, "crontab: start to refresh certificate file")
-			if err := certManager.reloadCertificateFile(ctx); err != nil {
-				logger.Wf(ctx, "crontab: ignore err %v", err)
-			}
-
-			select {
-			case <-ctx.Done():
-				return
-			case <-certManager.httpCertificateReload:
-			case <-time.After(time.Duration(1*3600) * time.Second):
+		safeRestart(ctx, func() {
+			for {
+				logger.Tf(ctx, "crontab: start to refresh certificate file")
+				if err := certManager.reloadCertificateFile(ctx); err != nil {
+					logger.Wf(ctx, "crontab: ignore err %v", err)
+				}
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-certManager.httpCertificateReload:
+				case <-time.After(time.Duration(1*3600) * time.Second):
+				}
 			}
-		}
+		})
 	}()
 
 	return nil
 }
+
+// parseVersionsRefreshInterval parse the interval to refresh the latest version, such as 6h, returns zero if disabled
+// by off or 0, for example, the air-gapped installs.
+func parseVersionsRefreshInterval(v string) (time.Duration, error) {
+	if v == "" || v == "0" || strings.ToLower(v) == "off" {
+		return 0, nil
+	}
+
+	interval, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse %v", v)
+	}
+	if interval < time.Minute {
+		return 0, errors.Errorf("interval %v should not less than 1m", interval)
+	}
+	return interval, nil
+}
+
+// jitterInterval returns the interval with a random jitter in [-10%, +10%].
+func jitterInterval(interval time.Duration) time.Duration {
+	jitter := int64(interval) / 10
+	if jitter <= 0 {
+		return interval
+	}
+	return interval - time.Duration(jitter) + time.Duration(rand.Int63n(2*jitter+1))
+}
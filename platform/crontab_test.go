@@ -0,0 +1,57 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCrontab_VersionsRefreshInterval(t *testing.T) {
+	for _, v := range []string{"", "0", "off", "OFF"} {
+		if interval, err := parseVersionsRefreshInterval(v); err != nil || interval != 0 {
+			t.Errorf("Fail for %v, interval=%v, err %+v", v, interval, err)
+		}
+	}
+	if interval, err := parseVersionsRefreshInterval("6h"); err != nil || interval != 6*time.Hour {
+		t.Errorf("Fail for interval=%v, err %+v", interval, err)
+	}
+	for _, v := range []string{"10s", "6x"} {
+		if _, err := parseVersionsRefreshInterval(v); err == nil {
+			t.Errorf("Fail for %v should fail", v)
+		}
+	}
+
+	for i := 0; i < 100; i++ {
+		if interval := jitterInterval(time.Hour); interval < 54*time.Minute || interval > 66*time.Minute {
+			t.Errorf("Fail for jitter %v", interval)
+		}
+	}
+}
+
+func TestCrontab_VersionsConcurrency(t *testing.T) {
+	c := NewConfig()
+	if !c.VersionsRefreshed().IsZero() {
+		t.Errorf("Fail for refreshed %v", c.VersionsRefreshed())
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			c.SetVersions(&Versions{
+				Platform: ComponentVersion{Version: "v5.14.1"}, Latest: ComponentVersion{Version: "v5.14.2"},
+				Stable: ComponentVersion{Version: "v5.12.0"},
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			_ = c.Versions().String()
+		}()
+	}
+	wg.Wait()
+
+	if versions := c.Versions(); versions.Latest.Version != "v5.14.2" || c.VersionsRefreshed().IsZero() {
+		t.Errorf("Fail for versions %v", versions.String())
+	}
+}
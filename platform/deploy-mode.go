@@ -0,0 +1,426 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// DeployMode is how SRS and platform are deployed, in docker containers, or as host processes such as systemd services.
+type DeployMode string
+
+const (
+	DeployModeDocker DeployMode = "docker"
+	DeployModeHost   DeployMode = "host"
+)
+
+// The files to detect docker, the docker socket, or the file created by docker in container.
+var deployModeDockerFiles = []string{"/var/run/docker.sock", "/.dockerenv"}
+
+// The directory of pidfiles for host mode, the pidfile of service is {name}.pid
+var deployModePidDir = "/var/run"
+
+// detectDeployMode returns the mode by env PLATFORM_DEPLOY_MODE, or detects docker by files.
+func detectDeployMode() (DeployMode, error) {
+	switch mode := DeployMode(envPlatformDeployMode()); mode {
+	case DeployModeDocker, DeployModeHost:
+		return mode, nil
+	case "":
+	default:
+		return "", errors.Errorf("invalid PLATFORM_DEPLOY_MODE %v, should be %v or %v", mode, DeployModeDocker, DeployModeHost)
+	}
+
+	for _, file := range deployModeDockerFiles {
+		if _, err := os.Stat(file); err == nil {
+			return DeployModeDocker, nil
+		}
+	}
+	return DeployModeHost, nil
+}
+
+// errHostModeNotSupported returns the error for the feature which requires docker.
+func errHostModeNotSupported(feature string) error {
+	return newHttpCodeError(http.StatusNotImplemented, SrsStackErrorHostModeNotSupported,
+		errors.Errorf("%v is not supported in %v mode", feature, DeployModeHost),
+	)
+}
+
+// DeployService is the state of a service, the container in docker mode, or the process in host mode.
+type DeployService struct {
+	// The name of container or service, for example, srs-server or srs.
+	Name string `json:"name"`
+	// Whether the service is enabled, always true in host mode.
+	Enabled bool `json:"enabled"`
+	// Whether the service is running, nil if unknown, for example, failed to query docker.
+	Running *bool `json:"running,omitempty"`
+	// The state of container in docker mode, for example, running or exited, empty if the container does not exist.
+	State string `json:"state,omitempty"`
+	// The pid of process, 0 if unknown.
+	PID int `json:"pid,omitempty"`
+	// How the state is queried, pidfile or systemctl.
+	Source string `json:"source,omitempty"`
+	// The error message if failed to query.
+	Error string `json:"error,omitempty"`
+}
+
+func (v *DeployService) String() string {
+	return fmt.Sprintf("name=%v, enabled=%v, running=%v, pid=%v, source=%v, error=%v",
+		v.Name, v.Enabled, v.Running != nil && *v.Running, v.PID, v.Source, v.Error,
+	)
+}
+
+// hostServiceAdapter queries the state of service in host mode, by the pidfile, or by systemctl if no pidfile.
+type hostServiceAdapter struct {
+	// The directory of pidfiles.
+	pidDir string
+	// Run systemctl is-active, returns the output.
+	isActive func(ctx context.Context, name string) (string, error)
+}
+
+func newHostServiceAdapter() *hostServiceAdapter {
+	return &hostServiceAdapter{
+		pidDir: deployModePidDir,
+		isActive: func(ctx context.Context, name string) (string, error) {
+			toCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+			defer cancel()
+
+			// Note that is-active exits with non-zero if not active, so we only use the output.
+			b, err := exec.CommandContext(toCtx, "systemctl", "is-active", name).Output()
+			if len(b) == 0 && err != nil {
+				return "", errors.Wrapf(err, "systemctl is-active %v", name)
+			}
+			return strings.TrimSpace(string(b)), nil
+		},
+	}
+}
+
+func (v *hostServiceAdapter) Query(ctx context.Context, name string) *DeployService {
+	service := &DeployService{Name: name, Enabled: true}
+
+	pidFile := path.Join(v.pidDir, fmt.Sprintf("%v.pid", name))
+	if b, err := ioutil.ReadFile(pidFile); err == nil {
+		service.Source = "pidfile"
+		if pid, err := strconv.Atoi(strings.TrimSpace(string(b))); err != nil || pid <= 0 {
+			service.Error = fmt.Sprintf("invalid pid %v in %v", strings.TrimSpace(string(b)), pidFile)
+		} else {
+			// Signal 0 checks whether process exists, EPERM means it exists but owned by another user.
+			err := syscall.Kill(pid, 0)
+			running := err == nil || err == syscall.EPERM
+			service.PID, service.Running = pid, &running
+		}
+		return service
+	}
+
+	service.Source = "systemctl"
+	if state, err := v.isActive(ctx, name); err != nil {
+		service.Error = err.Error()
+	} else {
+		running := state == "active"
+		service.Running = &running
+	}
+	return service
+}
+
+// queryDeployServices returns the state of services and when the state is queried. In docker mode, it's the
+// containers of SRS, which is enabled or disabled, with the state in docker cached for containerStatesTTL, unless
+// fresh. In host mode, it's the services in env PLATFORM_HOST_SERVICES, always queried now.
+func queryDeployServices(ctx context.Context, mode DeployMode, adapter *hostServiceAdapter, fresh bool) ([]*DeployService, time.Time, error) {
+	var services []*DeployService
+	if mode == DeployModeHost {
+		for _, name := range strings.Split(envPlatformHostServices(), ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				services = append(services, adapter.Query(ctx, name))
+			}
+		}
+		return services, time.Now(), nil
+	}
+
+	services, err := queryContainerServices(ctx, deployContainerNames)
+	if err != nil {
+		return nil, time.Time{}, errors.Wrapf(err, "query containers")
+	}
+
+	// Never fail the query if docker is not available, the enabled flag is still useful.
+	states, err := queryContainerStates(ctx, fresh)
+	if err != nil {
+		for _, service := range services {
+			service.Error = err.Error()
+		}
+		return services, time.Now(), nil
+	}
+
+	for _, service := range services {
+		running := states.States[service.Name] == "running"
+		service.State, service.Running = states.States[service.Name], &running
+	}
+	return services, states.AsOf, nil
+}
+
+// The containers managed in docker mode, in the order of response.
+var deployContainerNames = []string{srsDockerName, srsDevDockerName}
+
+// queryContainerServices returns the containers with the enabled flag, by one HGETALL of SRS_CONTAINER_DISABLED no
+// matter how many containers, so the round-trip of redis is fixed for each poll. The container is enabled if it's not
+// in the hash, and the names not managed are ignored.
+func queryContainerServices(ctx context.Context, names []string) ([]*DeployService, error) {
+	disabled, err := rdb.HGetAll(ctx, SRS_CONTAINER_DISABLED).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_CONTAINER_DISABLED)
+	}
+
+	services := make([]*DeployService, 0, len(names))
+	for _, name := range names {
+		services = append(services, &DeployService{Name: name, Enabled: disabled[name] != "true"})
+	}
+	return services, nil
+}
+
+// The TTL of the state of containers cached in redis, so the dashboard which polls the containers queries docker at
+// most once in the TTL, no matter how many pages or platform replicas.
+const containerStatesTTL = 5 * time.Second
+
+// ContainerStates is the state of containers queried from docker, cached in SRS_CONTAINER_STATES.
+type ContainerStates struct {
+	// The state of container by name, for example, running or exited.
+	States map[string]string `json:"states"`
+	// When the states are queried from docker.
+	AsOf time.Time `json:"asOf"`
+}
+
+// The lock to query docker once when cache expires, for the concurrent polls of this platform.
+var containerStatesLock sync.Mutex
+
+// queryContainerStates returns the state of containers in cache, or queries docker if expired or fresh.
+func queryContainerStates(ctx context.Context, fresh bool) (*ContainerStates, error) {
+	query := func() (*ContainerStates, error) {
+		var states ContainerStates
+		if b, err := rdb.Get(ctx, SRS_CONTAINER_STATES).Result(); err != nil && err != redis.Nil {
+			return nil, errors.Wrapf(err, "get %v", SRS_CONTAINER_STATES)
+		} else if b == "" {
+			return nil, nil
+		} else if err := json.Unmarshal([]byte(b), &states); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", b)
+		}
+		return &states, nil
+	}
+
+	if !fresh {
+		if states, err := query(); err != nil || states != nil {
+			return states, err
+		}
+	}
+
+	containerStatesLock.Lock()
+	defer containerStatesLock.Unlock()
+
+	// Another poll might have queried docker while waiting for the lock.
+	if !fresh {
+		if states, err := query(); err != nil || states != nil {
+			return states, err
+		}
+	}
+
+	r0, err := queryDockerContainers(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query docker")
+	}
+
+	states := &ContainerStates{States: r0, AsOf: time.Now()}
+	if b, err := json.Marshal(states); err != nil {
+		return nil, errors.Wrapf(err, "marshal states")
+	} else if err := rdb.Set(ctx, SRS_CONTAINER_STATES, string(b), containerStatesTTL).Err(); err != nil {
+		return nil, errors.Wrapf(err, "set %v %v", SRS_CONTAINER_STATES, string(b))
+	}
+	return states, nil
+}
+
+// invalidateContainerStates removes the cache of containers, after the container is changed by platform, for example,
+// removed or upgraded, so the next poll queries docker.
+func invalidateContainerStates(ctx context.Context) {
+	if err := rdb.Del(ctx, SRS_CONTAINER_STATES).Err(); err != nil && err != redis.Nil {
+		logger.Wf(ctx, "ignore del %v err %+v", SRS_CONTAINER_STATES, err)
+	}
+}
+
+// queryDockerContainers returns the state of all containers by name, by the Docker Engine API if the socket is
+// visible, or the docker CLI.
+var queryDockerContainers = func(ctx context.Context) (map[string]string, error) {
+	toCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	if docker := NewDockerApi(envPlatformDockerSocket()); docker.Available() {
+		defer docker.Close()
+		return docker.ListContainers(toCtx)
+	}
+
+	b, err := exec.CommandContext(toCtx, "docker", "ps", "-a", "--format", "{{.Names}} {{.State}}").CombinedOutput()
+	if err != nil {
+		return nil, errors.Wrapf(err, "docker ps, %v", strings.TrimSpace(string(b)))
+	}
+
+	states := make(map[string]string)
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			states[fields[0]] = fields[1]
+		}
+	}
+	return states, nil
+}
+
+// execApi runs the container operation in docker mode, for example, rmContainer to stop and remove the container, so
+// it's not restarted until enabled, or version to check whether docker is ready. It returns the error with the output
+// of docker. The Docker Engine API is used if the socket is visible, or fallback to the docker CLI, for example, the
+// docker is configured by DOCKER_HOST.
+var execApi = func(ctx context.Context, api string, args ...string) error {
+	if docker := NewDockerApi(envPlatformDockerSocket()); docker.Available() {
+		defer docker.Close()
+		return execDockerApi(ctx, docker, api, args...)
+	}
+
+	switch api {
+	case "rmContainer":
+		toCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		name := args[0]
+		if b, err := exec.CommandContext(toCtx, "docker", "rm", "-f", name).CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "docker rm -f %v, %v", name, strings.TrimSpace(string(b)))
+		}
+		return nil
+	case "version":
+		// Query the version of docker server, which is cheap to check whether docker is ready.
+		if b, err := exec.CommandContext(ctx, "docker", "version", "--format", "{{.Server.Version}}").CombinedOutput(); err != nil {
+			return errors.Wrapf(err, "docker version, %v", strings.TrimSpace(string(b)))
+		}
+		return nil
+	default:
+		return errors.Errorf("invalid api %v", api)
+	}
+}
+
+// toggleContainer enables or disables the container. The disabled flag is set before removing the container, to
+// avoid restarting it, and is restored if failed to remove, so the flag always matches the container. Note that enable
+// only clears the flag, the container is started by the bootstrap of Oryx which checks the flag, rather than platform.
+func toggleContainer(ctx context.Context, name string, enabled bool) error {
+	if name != srsDockerName && name != srsDevDockerName {
+		return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid container %v", name))
+	}
+
+	previous, err := rdb.HGet(ctx, SRS_CONTAINER_DISABLED, name).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hget %v %v", SRS_CONTAINER_DISABLED, name)
+	}
+
+	disabled := fmt.Sprintf("%v", !enabled)
+	if err := rdb.HSet(ctx, SRS_CONTAINER_DISABLED, name, disabled).Err(); err != nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_CONTAINER_DISABLED, name, disabled)
+	}
+
+	if enabled {
+		return nil
+	}
+
+	defer invalidateContainerStates(ctx)
+	if err := execApi(ctx, "rmContainer", name); err != nil {
+		var r0 error
+		if previous == "" {
+			r0 = rdb.HDel(ctx, SRS_CONTAINER_DISABLED, name).Err()
+		} else {
+			r0 = rdb.HSet(ctx, SRS_CONTAINER_DISABLED, name, previous).Err()
+		}
+		if r0 != nil {
+			return errors.Wrapf(err, "rm container %v, restore %v %v=%v failed, r0 %+v",
+				name, SRS_CONTAINER_DISABLED, name, previous, r0,
+			)
+		}
+		logger.Wf(ctx, "restore %v %v=%v ok", SRS_CONTAINER_DISABLED, name, previous)
+		return errors.Wrapf(err, "rm container %v", name)
+	}
+	return nil
+}
+
+func handleMgmtContainers(ctx context.Context, handler *http.ServeMux) {
+	adapter := newHostServiceAdapter()
+
+	ep := "/terraform/v1/mgmt/containers"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action, name string
+			var enabled bool
+			if err := ParseBody(ctx, r, &struct {
+				Token   *string `json:"token"`
+				Action  *string `json:"action"`
+				Name    *string `json:"name"`
+				Enabled *bool   `json:"enabled"`
+			}{
+				Token: &token, Action: &action, Name: &name, Enabled: &enabled,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			switch action {
+			case "":
+			case "enabled":
+				if conf.DeployMode == DeployModeHost {
+					return errHostModeNotSupported("toggle container")
+				}
+				if err := toggleContainer(ctx, name, enabled); err != nil {
+					return errors.Wrapf(err, "toggle container %v enabled=%v", name, enabled)
+				}
+				logger.Tf(ctx, "toggle container %v enabled=%v ok", name, enabled)
+			default:
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+			}
+
+			// Bypass the cache of containers by fresh=true, note that the cache is removed after the container is removed.
+			fresh := r.URL.Query().Get("fresh") == "true"
+			services, asOf, err := queryDeployServices(ctx, conf.DeployMode, adapter, fresh)
+			if err != nil {
+				return errors.Wrapf(err, "query services")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Mode     DeployMode       `json:"mode"`
+				Services []*DeployService `json:"services"`
+				// When the state of services is queried, for UI to show the age of data.
+				AsOf time.Time `json:"asOf"`
+			}{
+				Mode: conf.DeployMode, Services: services, AsOf: asOf,
+			})
+			logger.Tf(ctx, "containers ok, mode=%v, action=%v, fresh=%v, services=%v, asOf=%v, token=%vB",
+				conf.DeployMode, action, fresh, len(services), asOf.Format(time.RFC3339), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
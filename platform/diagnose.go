@@ -0,0 +1,418 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The timeout for each diagnose check, so a hung check never stalls the response.
+const diagnoseCheckTimeout = 5 * time.Second
+
+// The max number of checks running at the same time.
+const diagnoseConcurrency = 4
+
+// The certificate is about to expire in days, which should be renewed.
+const diagnoseCertificateExpireDays = 7
+
+// DiagnoseCheck is the result of a diagnose check.
+type DiagnoseCheck struct {
+	// The name of check, for example, redis, srs-api or rtmp.
+	Name string `json:"name"`
+	// Whether the check is passed.
+	OK bool `json:"ok"`
+	// The detail of check, which might be sensitive, so only for authenticated request.
+	Message string `json:"message,omitempty"`
+	// The remediation hint if failed.
+	Hint string `json:"hint,omitempty"`
+	// The elapsed time in milliseconds.
+	Elapsed int64 `json:"elapsed"`
+}
+
+// DiagnoseResult is the result of all diagnose checks.
+type DiagnoseResult struct {
+	// Whether all checks are passed.
+	OK bool `json:"ok"`
+	// Whether the result is full, or reduced for unauthenticated request.
+	Full bool `json:"full"`
+	// The result of each check, in order.
+	Checks []*DiagnoseCheck `json:"checks"`
+	// The elapsed time in milliseconds.
+	Elapsed int64 `json:"elapsed"`
+}
+
+func (v *DiagnoseResult) String() string {
+	var checks []string
+	for _, check := range v.Checks {
+		checks = append(checks, fmt.Sprintf("%v:%v", check.Name, check.OK))
+	}
+	return fmt.Sprintf("ok=%v, full=%v, checks=[%v], elapsed=%vms",
+		v.OK, v.Full, strings.Join(checks, ","), v.Elapsed,
+	)
+}
+
+// diagnoseCheckFunc is a check, which returns the detail if passed, or error if failed.
+type diagnoseCheckFunc func(ctx context.Context) (string, error)
+
+// diagnoseChecker is a named check with remediation hint.
+type diagnoseChecker struct {
+	name string
+	hint string
+	fn   diagnoseCheckFunc
+}
+
+// diagnoseCheckers returns all checks to validate an install end to end.
+func diagnoseCheckers() []*diagnoseChecker {
+	return []*diagnoseChecker{
+		{
+			name: "redis", fn: diagnoseRedis,
+			hint: "Make sure the redis server is running, and the REDIS_HOST, REDIS_PORT and REDIS_PASSWORD are correct.",
+		},
+		{
+			name: "redis-persistence", fn: diagnoseRedisPersistence,
+			hint: "Enable redis RDB or AOF persistence, or all settings are lost after restart.",
+		},
+		{
+			name: "redis-memory", fn: diagnoseRedisMemory,
+			hint: "Set redis maxmemory-policy to noeviction, or increase the maxmemory.",
+		},
+		{
+			name: "srs-api", fn: diagnoseSrsApi,
+			hint: "Make sure SRS is running, and the SRS_API_SERVER is correct.",
+		},
+		{
+			name: "rtmp", fn: diagnoseRtmp,
+			hint: "Make sure SRS is running, and the RTMP port is not used by other process.",
+		},
+		{
+			name: "hls-dir", fn: diagnoseHlsDir,
+			hint: "Make sure the HLS directory is writable and the disk is not full.",
+		},
+		{
+			name: "nginx-config", fn: diagnoseNginxConfig,
+			hint: "Restart Oryx to regenerate the NGINX config.",
+		},
+		{
+			name: "domain", fn: diagnoseDomain,
+			hint: "Update the DNS A record of your domain to the public IP of this host.",
+		},
+		{
+			name: "certificate", fn: diagnoseCertificate,
+			hint: "Renew the HTTPS certificate, or request a new one by Let's Encrypt.",
+		},
+		{
+			name: "clock", fn: diagnoseClock,
+			hint: "Sync the system clock by NTP, or the token and certificate might be invalid.",
+		},
+	}
+}
+
+// runDiagnose runs all checks concurrently in a bounded pool, each with a timeout. If not full, omit the sensitive
+// details.
+func runDiagnose(ctx context.Context, checkers []*diagnoseChecker, full bool) *DiagnoseResult {
+	starttime := time.Now()
+	r := &DiagnoseResult{OK: true, Full: full, Checks: make([]*DiagnoseCheck, len(checkers))}
+
+	pool := NewBoundedPool(ctx, diagnoseConcurrency)
+	for i, checker := range checkers {
+		i, checker := i, checker
+		pool.Go(func() {
+			r.Checks[i] = runDiagnoseCheck(ctx, checker)
+		})
+	}
+	pool.Wait()
+
+	for _, check := range r.Checks {
+		if !check.OK {
+			r.OK = false
+		} else {
+			check.Hint = ""
+		}
+		if !full {
+			check.Message = ""
+		}
+	}
+
+	r.Elapsed = int64(time.Since(starttime) / time.Millisecond)
+	return r
+}
+
+// runDiagnoseCheck runs the check with timeout, and never wait for the check which ignores the context.
+func runDiagnoseCheck(ctx context.Context, checker *diagnoseChecker) *DiagnoseCheck {
+	starttime := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, diagnoseCheckTimeout)
+	defer cancel()
+
+	type result struct {
+		msg string
+		err error
+	}
+	done := make(chan *result, 1)
+	go safe(ctx, func() {
+		// Report the panic as failed check, and let safe log it.
+		defer func() {
+			if r := recover(); r != nil {
+				done <- &result{err: errors.Errorf("check panic %v", r)}
+				panic(r)
+			}
+		}()
+
+		msg, err := checker.fn(ctx)
+		done <- &result{msg, err}
+	})
+
+	r := &DiagnoseCheck{Name: checker.name, Hint: checker.hint}
+	select {
+	case res := <-done:
+		r.OK, r.Message = res.err == nil, res.msg
+		if res.err != nil {
+			r.Message = res.err.Error()
+		}
+	case <-ctx.Done():
+		r.Message = fmt.Sprintf("timeout after %v", diagnoseCheckTimeout)
+	}
+
+	r.Elapsed = int64(time.Since(starttime) / time.Millisecond)
+	return r
+}
+
+func diagnoseRedis(ctx context.Context) (string, error) {
+	starttime := time.Now()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return "", errors.Wrapf(err, "ping redis %v:%v", envRedisHost(), envRedisPort())
+	}
+
+	latency := float64(time.Since(starttime)) / float64(time.Millisecond)
+	if latency > redisHealthSlowLatency {
+		return "", errors.Errorf("redis %v:%v is slow, latency=%.1fms", envRedisHost(), envRedisPort(), latency)
+	}
+	return fmt.Sprintf("redis %v:%v is reachable, latency=%.1fms", envRedisHost(), envRedisPort(), latency), nil
+}
+
+func diagnoseRedisPersistence(ctx context.Context) (string, error) {
+	health, err := queryRedisHealth(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "query redis")
+	}
+
+	if err := redisHealthError(health.WarningsOf("no-persistence", "save-failed", "stale-save")); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("rdb=%v, aof=%v, lastSave=%vs", health.RDB, health.AOF, health.LastSave), nil
+}
+
+func diagnoseRedisMemory(ctx context.Context) (string, error) {
+	health, err := queryRedisHealth(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "query redis")
+	}
+
+	if err := redisHealthError(health.WarningsOf("eviction", "memory")); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("memory=%vMB, maxmemory=%vMB, policy=%v",
+		health.UsedMemory/1024/1024, health.MaxMemory/1024/1024, health.EvictionPolicy,
+	), nil
+}
+
+func diagnoseSrsApi(ctx context.Context) (string, error) {
+	api := fmt.Sprintf("%v/api/v1/versions", envSrsApiServer())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "new request %v", api)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "get %v", api)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("get %v, code=%v", api, res.StatusCode)
+	}
+	return fmt.Sprintf("srs api %v is reachable", envSrsApiServer()), nil
+}
+
+func diagnoseRtmp(ctx context.Context) (string, error) {
+	addr := net.JoinHostPort("127.0.0.1", envRtmpPort())
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return "", errors.Wrapf(err, "dial %v", addr)
+	}
+	defer conn.Close()
+
+	return fmt.Sprintf("rtmp %v is accepting", addr), nil
+}
+
+func diagnoseHlsDir(ctx context.Context) (string, error) {
+	hlsDir := path.Join(conf.Pwd, "containers/objs/nginx/html")
+	f, err := ioutil.TempFile(hlsDir, ".diagnose-*")
+	if err != nil {
+		publishEvent(ctx, &DiskWarningEvent{Path: hlsDir, Message: err.Error()})
+		return "", errors.Wrapf(err, "create file in %v", hlsDir)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write([]byte("diagnose")); err != nil {
+		publishEvent(ctx, &DiskWarningEvent{Path: hlsDir, Message: err.Error()})
+		return "", errors.Wrapf(err, "write %v", f.Name())
+	}
+	return fmt.Sprintf("%v is writable", hlsDir), nil
+}
+
+func diagnoseNginxConfig(ctx context.Context) (string, error) {
+	for _, name := range []string{"nginx.http.conf", "nginx.server.conf"} {
+		fileName := path.Join(conf.Pwd, "containers/data/config", name)
+		b, err := os.ReadFile(fileName)
+		if err != nil {
+			return "", errors.Wrapf(err, "read %v", fileName)
+		}
+		if !isNginxConfigComplete(string(b)) {
+			return "", errors.Errorf("incomplete %v", fileName)
+		}
+	}
+	return "nginx config is complete", nil
+}
+
+func diagnoseDomain(ctx context.Context) (string, error) {
+	domain, err := rdb.Get(ctx, SRS_HTTPS_DOMAIN).Result()
+	if err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "get %v", SRS_HTTPS_DOMAIN)
+	}
+	if domain == "" {
+		return "no domain", nil
+	}
+
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, domain)
+	if err != nil {
+		return "", errors.Wrapf(err, "lookup %v", domain)
+	}
+
+	hostIPs := make(map[string]bool)
+	if candidateWorker != nil {
+		if applied := candidateWorker.Applied(); applied != "" {
+			hostIPs[applied] = true
+		}
+		if candidates, _, err := candidateWorker.Detect(ctx, false); err == nil {
+			for _, candidate := range candidates {
+				if candidate.Source != CandidateSourceDomain {
+					hostIPs[candidate.IP] = true
+				}
+			}
+		}
+	}
+
+	var resolved []string
+	for _, addr := range addrs {
+		if hostIPs[addr.IP.String()] {
+			return fmt.Sprintf("%v resolves to %v", domain, addr.IP.String()), nil
+		}
+		resolved = append(resolved, addr.IP.String())
+	}
+	return "", errors.Errorf("%v resolves to %v, not this host", domain, strings.Join(resolved, ","))
+}
+
+func diagnoseCertificate(ctx context.Context) (string, error) {
+	if https, err := rdb.Get(ctx, SRS_HTTPS).Result(); err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "get %v", SRS_HTTPS)
+	} else if https == "" {
+		return "no https", nil
+	}
+
+	_, crt, err := certManager.QueryCertificate()
+	if err != nil {
+		return "", errors.Wrapf(err, "query certificate")
+	}
+
+	block, _ := pem.Decode([]byte(crt))
+	if block == nil {
+		return "", errors.New("invalid certificate pem")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse certificate")
+	}
+
+	days := int(math.Floor(time.Until(cert.NotAfter).Hours() / 24))
+	if days < diagnoseCertificateExpireDays {
+		return "", errors.Errorf("certificate expires at %v, %v days left", cert.NotAfter.Format(time.RFC3339), days)
+	}
+	return fmt.Sprintf("certificate expires at %v, %v days left", cert.NotAfter.Format(time.RFC3339), days), nil
+}
+
+// diagnoseClock compares the system clock with the Date header of the clock server, and updates the measured offset.
+func diagnoseClock(ctx context.Context) (string, error) {
+	if clockChecker.State().Disabled {
+		return "clock check is disabled", nil
+	}
+
+	offset, err := clockChecker.Check(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "check clock")
+	}
+
+	server := clockChecker.State().Server
+	if isClockDrift(offset) {
+		return "", errors.Errorf("clock skew %v to %v", offset, server)
+	}
+	return fmt.Sprintf("clock skew %v to %v", offset, server), nil
+}
+
+func handleMgmtDiagnose(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/diagnose"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			// Allow unauthenticated request in reduced mode, for users who are unable to login, for example,
+			// the redis is down. However, the credentials must be valid if specified.
+			full := token != "" || r.Header.Get("Authorization") != ""
+			if full {
+				apiSecret := envApiSecret()
+				if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+					return errors.Wrapf(err, "authenticate")
+				}
+			}
+
+			res := runDiagnose(ctx, diagnoseCheckers(), full)
+			httpWriteData(ctx, w, r, res)
+			logger.Tf(ctx, "diagnose ok, %v, token=%vB", res.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
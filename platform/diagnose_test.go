@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestDiagnose_RunConcurrently(t *testing.T) {
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 300*time.Millisecond)
+	defer cancel()
+
+	hung := make(chan bool)
+	defer close(hung)
+
+	starttime := time.Now()
+	res := runDiagnose(ctx, []*diagnoseChecker{
+		{name: "ok", hint: "none", fn: func(ctx context.Context) (string, error) {
+			return "secret detail", nil
+		}},
+		{name: "fail", hint: "fix it", fn: func(ctx context.Context) (string, error) {
+			return "", errors.New("secret error")
+		}},
+		{name: "hung", hint: "wait", fn: func(ctx context.Context) (string, error) {
+			// Never respect the context, the runner should not wait for it.
+			<-hung
+			return "", nil
+		}},
+	}, false)
+
+	if elapsed := time.Since(starttime); elapsed > 2*time.Second {
+		t.Errorf("Fail for stalled by hung check, elapsed=%v", elapsed)
+	}
+	if res.OK || res.Full || len(res.Checks) != 3 {
+		t.Errorf("Fail for result %v", res.String())
+		return
+	}
+
+	for i, e := range []struct {
+		name string
+		ok   bool
+		hint string
+	}{
+		{name: "ok", ok: true}, {name: "fail", hint: "fix it"}, {name: "hung", hint: "wait"},
+	} {
+		if check := res.Checks[i]; check.Name != e.name || check.OK != e.ok || check.Hint != e.hint {
+			t.Errorf("Fail for check %v, %v", i, *check)
+		} else if check.Message != "" {
+			t.Errorf("Fail for sensitive message %v in reduced mode", check.Message)
+		}
+	}
+
+	if res := runDiagnose(logger.WithContext(context.Background()), []*diagnoseChecker{{name: "fail", fn: func(ctx context.Context) (string, error) {
+		return "", errors.New("detail")
+	}}}, true); res.Checks[0].Message != "detail" {
+		t.Errorf("Fail for no message in full mode, %v", *res.Checks[0])
+	}
+}
+
+func TestDiagnose_NginxConfigComplete(t *testing.T) {
+	for _, e := range []struct {
+		content  string
+		complete bool
+	}{
+		{content: "# !!! Important: This file is produced by Oryx.\nlisten 443;\n\n", complete: true},
+		{content: "# !!! Important: This file is produced by Oryx.\nlisten 4", complete: false},
+		{content: "listen 443;\n\n", complete: false},
+	} {
+		if complete := isNginxConfigComplete(e.content); complete != e.complete {
+			t.Errorf("Fail for %v, complete=%v", e.content, complete)
+		}
+	}
+}
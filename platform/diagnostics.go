@@ -0,0 +1,466 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max number of captured requests in redis.
+const diagnosticsMaxCaptures = 1000
+
+// The max size of body to capture, the larger body is ignored.
+const diagnosticsMaxBodySize = 4 * 1024
+
+// The default and max duration of capture mode, which is turned off automatically when expired.
+const diagnosticsDefaultDuration = 10 * time.Minute
+const diagnosticsMaxDuration = 1 * time.Hour
+
+// The endpoints which bodies are never captured, because they are for authentication or credentials.
+var diagnosticsNoBodyPrefixes = []string{
+	"/terraform/v1/mgmt/init",
+	"/terraform/v1/mgmt/login",
+	"/terraform/v1/mgmt/recover/",
+	"/terraform/v1/mgmt/token",
+	"/terraform/v1/mgmt/secret/",
+	"/terraform/v1/mgmt/openai/",
+	"/terraform/v1/mgmt/storage/",
+	"/terraform/v1/mgmt/speedtest/",
+	"/terraform/v1/hooks/srs/secret",
+	"/terraform/v1/tencent/cam/secret",
+	"/terraform/v1/ai-talk/user/",
+}
+
+// The JSON field names to scrub, for example, token, apiSecret or password.
+var diagnosticsSecretField = regexp.MustCompile(`(?i)(token|secret|password|passwd|key|authorization|credential)`)
+
+var diagnostics *Diagnostics
+
+// DiagnosticsState is the capture mode of diagnostics.
+type DiagnosticsState struct {
+	// Whether capture is enabled.
+	Enabled bool `json:"enabled"`
+	// The endpoint prefixes to capture, empty for all APIs.
+	Prefixes []string `json:"prefixes"`
+	// The time to turn off capture automatically.
+	ExpireAt string `json:"expireAt"`
+}
+
+func (v *DiagnosticsState) String() string {
+	return fmt.Sprintf("enabled=%v, prefixes=%v, expireAt=%v", v.Enabled, v.Prefixes, v.ExpireAt)
+}
+
+// DiagnosticsCapture is a captured request and response, without any secret.
+type DiagnosticsCapture struct {
+	// The request time.
+	Time string `json:"time"`
+	// The client IP, see clientIP.
+	IP string `json:"ip"`
+	// The request method and path, the query is scrubbed.
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Query  string `json:"query,omitempty"`
+	// The request headers.
+	UserAgent     string `json:"userAgent,omitempty"`
+	ContentType   string `json:"contentType,omitempty"`
+	ContentLength int64  `json:"contentLength"`
+	// The response status and the cost in ms.
+	Status int   `json:"status"`
+	Cost   int64 `json:"cost"`
+	// The scrubbed JSON body of request and response, only captured when small.
+	RequestBody  json.RawMessage `json:"requestBody,omitempty"`
+	ResponseBody json.RawMessage `json:"responseBody,omitempty"`
+}
+
+// Diagnostics captures the requests and responses of APIs, for users to download as support bundle.
+type Diagnostics struct {
+	// The capture state, which is cached in memory.
+	state *DiagnosticsState
+	// The expire time of capture.
+	expireAt time.Time
+	// The lock for state.
+	lock sync.Mutex
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewDiagnostics() *Diagnostics {
+	return &Diagnostics{state: &DiagnosticsState{}}
+}
+
+func (v *Diagnostics) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *Diagnostics) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "diagnostics start a worker")
+
+	// Restore the capture state, which might be enabled before restart.
+	if value, err := rdb.HGet(ctx, SRS_DIAGNOSTICS, "state").Result(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hget %v state", SRS_DIAGNOSTICS)
+	} else if value != "" {
+		var state DiagnosticsState
+		if err := json.Unmarshal([]byte(value), &state); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", value)
+		}
+		v.setState(&state)
+	}
+
+	// Turn off the capture when expired.
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			if state, expired := v.State(), v.expired(); state.Enabled && expired {
+				if err := v.Update(ctx, &DiagnosticsState{}); err != nil {
+					logger.Wf(ctx, "ignore diagnostics turn off err %+v", err)
+				} else {
+					logger.Tf(ctx, "diagnostics turn off for expired, %v", state.String())
+				}
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(time.Second):
+			}
+		}
+	}()
+
+	return nil
+}
+
+func (v *Diagnostics) setState(state *DiagnosticsState) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.state = state
+	v.expireAt, _ = time.Parse(time.RFC3339, state.ExpireAt)
+}
+
+func (v *Diagnostics) expired() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return time.Now().After(v.expireAt)
+}
+
+// State returns a copy of the capture state.
+func (v *Diagnostics) State() *DiagnosticsState {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	state := *v.state
+	return &state
+}
+
+// Update the capture state, and save to redis.
+func (v *Diagnostics) Update(ctx context.Context, state *DiagnosticsState) error {
+	if b, err := json.Marshal(state); err != nil {
+		return errors.Wrapf(err, "marshal %v", state.String())
+	} else if err := rdb.HSet(ctx, SRS_DIAGNOSTICS, "state", string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v state %v", SRS_DIAGNOSTICS, string(b))
+	}
+
+	v.setState(state)
+	return nil
+}
+
+// match returns whether capture the request of path.
+func (v *Diagnostics) match(path string) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.state.Enabled || time.Now().After(v.expireAt) {
+		return false
+	}
+
+	// Never capture the diagnostics itself.
+	if strings.HasPrefix(path, "/terraform/v1/mgmt/diagnostics/") {
+		return false
+	}
+
+	if len(v.state.Prefixes) == 0 {
+		return strings.HasPrefix(path, "/terraform/v1/")
+	}
+	for _, prefix := range v.state.Prefixes {
+		if strings.HasPrefix(path, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ServeHTTP serves the request by handler, and capture the request and response if enabled.
+func (v *Diagnostics) ServeHTTP(w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	if !v.match(r.URL.Path) {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	capture := &DiagnosticsCapture{
+		Time: time.Now().Format(time.RFC3339), IP: clientIP(r), Method: r.Method, Path: r.URL.Path,
+		Query: scrubDiagnosticsQuery(r.URL.Query().Encode()), UserAgent: r.UserAgent(),
+		ContentType: r.Header.Get("Content-Type"), ContentLength: r.ContentLength,
+	}
+
+	// Only capture the small JSON body of request, and restore it for handler.
+	captureBody := true
+	for _, prefix := range diagnosticsNoBodyPrefixes {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			captureBody = false
+			break
+		}
+	}
+	if captureBody && r.Body != nil && r.ContentLength > 0 && r.ContentLength <= diagnosticsMaxBodySize {
+		if b, err := ioutil.ReadAll(r.Body); err == nil {
+			r.Body = ioutil.NopCloser(bytes.NewReader(b))
+			capture.RequestBody = scrubDiagnosticsBody(capture.ContentType, b)
+		}
+	}
+
+	starttime := time.Now()
+	cw := &diagnosticsResponseWriter{ResponseWriter: w, status: http.StatusOK}
+	handler.ServeHTTP(cw, r)
+
+	capture.Status, capture.Cost = cw.status, time.Now().Sub(starttime).Milliseconds()
+	if captureBody && cw.body.Len() <= diagnosticsMaxBodySize {
+		capture.ResponseBody = scrubDiagnosticsBody(cw.Header().Get("Content-Type"), cw.body.Bytes())
+
+		// Only keep the code of error, because the error message might contain the request values.
+		if cw.status >= http.StatusBadRequest && capture.ResponseBody != nil {
+			var res struct {
+				Code int `json:"code"`
+			}
+			if err := json.Unmarshal(capture.ResponseBody, &res); err != nil {
+				capture.ResponseBody = nil
+			} else {
+				capture.ResponseBody = json.RawMessage(fmt.Sprintf(`{"code":%v}`, res.Code))
+			}
+		}
+	}
+
+	ctx := logger.WithContext(context.Background())
+	if b, err := json.Marshal(capture); err != nil {
+		logger.Wf(ctx, "ignore diagnostics marshal err %+v", err)
+	} else if err := rdb.LPush(ctx, SRS_DIAGNOSTICS_CAPTURES, string(b)).Err(); err != nil {
+		logger.Wf(ctx, "ignore diagnostics lpush err %+v", err)
+	} else if err := rdb.LTrim(ctx, SRS_DIAGNOSTICS_CAPTURES, 0, diagnosticsMaxCaptures-1).Err(); err != nil {
+		logger.Wf(ctx, "ignore diagnostics ltrim err %+v", err)
+	}
+}
+
+// diagnosticsResponseWriter records the status and the head of body.
+type diagnosticsResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (v *diagnosticsResponseWriter) WriteHeader(status int) {
+	v.status = status
+	v.ResponseWriter.WriteHeader(status)
+}
+
+func (v *diagnosticsResponseWriter) Write(b []byte) (int, error) {
+	// Keep one more byte than the max size, to know whether body is too large.
+	if left := diagnosticsMaxBodySize + 1 - v.body.Len(); left > 0 {
+		if len(b) < left {
+			left = len(b)
+		}
+		v.body.Write(b[:left])
+	}
+	return v.ResponseWriter.Write(b)
+}
+
+func (v *diagnosticsResponseWriter) Flush() {
+	if f, ok := v.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// scrubDiagnosticsQuery removes the secret values from the encoded query.
+func scrubDiagnosticsQuery(query string) string {
+	var pairs []string
+	for _, pair := range strings.Split(query, "&") {
+		if k := strings.SplitN(pair, "=", 2)[0]; diagnosticsSecretField.MatchString(k) {
+			pair = fmt.Sprintf("%v=***", k)
+		}
+		if pair != "" {
+			pairs = append(pairs, pair)
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// scrubDiagnosticsBody returns the JSON body with secret fields replaced, or nil if not JSON.
+func scrubDiagnosticsBody(contentType string, b []byte) json.RawMessage {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+		return nil
+	}
+
+	var obj interface{}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil
+	}
+
+	var scrub func(obj interface{}) interface{}
+	scrub = func(obj interface{}) interface{} {
+		switch obj := obj.(type) {
+		case map[string]interface{}:
+			for k, v := range obj {
+				if diagnosticsSecretField.MatchString(k) {
+					obj[k] = "***"
+				} else {
+					obj[k] = scrub(v)
+				}
+			}
+		case []interface{}:
+			for i, v := range obj {
+				obj[i] = scrub(v)
+			}
+		}
+		return obj
+	}
+
+	if b, err := json.Marshal(scrub(obj)); err == nil {
+		return b
+	}
+	return nil
+}
+
+func handleMgmtDiagnostics(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/diagnostics/capture"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var enabled bool
+			var prefixes []string
+			var duration int
+			if err := ParseBody(ctx, r, &struct {
+				Token    *string   `json:"token"`
+				Enabled  *bool     `json:"enabled"`
+				Prefixes *[]string `json:"prefixes"`
+				Duration *int      `json:"duration"`
+			}{
+				Token: &token, Enabled: &enabled, Prefixes: &prefixes, Duration: &duration,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			state := &DiagnosticsState{}
+			if enabled {
+				expire := diagnosticsDefaultDuration
+				if duration > 0 {
+					expire = time.Duration(duration) * time.Second
+				}
+				if expire > diagnosticsMaxDuration {
+					return errors.Errorf("duration %v exceed %v", expire, diagnosticsMaxDuration)
+				}
+
+				for _, prefix := range prefixes {
+					if !strings.HasPrefix(prefix, "/") {
+						return errors.Errorf("invalid prefix %v", prefix)
+					}
+				}
+
+				state = &DiagnosticsState{
+					Enabled: true, Prefixes: prefixes, ExpireAt: time.Now().Add(expire).Format(time.RFC3339),
+				}
+			}
+
+			if err := diagnostics.Update(ctx, state); err != nil {
+				return errors.Wrapf(err, "update %v", state.String())
+			}
+
+			httpWriteData(ctx, w, r, state)
+			logger.Tf(ctx, "diagnostics capture ok, %v, token=%vB", state.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/diagnostics/bundle"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			values, err := rdb.LRange(ctx, SRS_DIAGNOSTICS_CAPTURES, 0, -1).Result()
+			if err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "lrange %v", SRS_DIAGNOSTICS_CAPTURES)
+			}
+
+			captures := make([]json.RawMessage, 0, len(values))
+			for _, value := range values {
+				captures = append(captures, json.RawMessage(value))
+			}
+
+			w.Header().Set("Content-Disposition", fmt.Sprintf(
+				"attachment; filename=%q", fmt.Sprintf("oryx-diagnostics-%v.json", time.Now().Format("20060102150405")),
+			))
+			httpWriteData(ctx, w, r, &struct {
+				Version  string            `json:"version"`
+				State    *DiagnosticsState `json:"state"`
+				Captures []json.RawMessage `json:"captures"`
+			}{
+				Version: conf.Versions().Platform.Version, State: diagnostics.State(), Captures: captures,
+			})
+			logger.Tf(ctx, "diagnostics bundle ok, captures=%v, token=%vB", len(captures), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDiagnostics_ScrubSecrets(t *testing.T) {
+	body := scrubDiagnosticsBody("application/json; charset=utf-8",
+		[]byte(`{"token":"t0","name":"live","secret":{"k":"v"},"items":[{"apiSecret":"s0","stream":"livestream"}]}`),
+	)
+	if body == nil {
+		t.Errorf("Fail for no body")
+		return
+	}
+	for _, secret := range []string{"t0", `"k"`, "s0"} {
+		if strings.Contains(string(body), secret) {
+			t.Errorf("Fail for %v in %v", secret, string(body))
+		}
+	}
+	for _, value := range []string{"live", "livestream"} {
+		if !strings.Contains(string(body), value) {
+			t.Errorf("Fail for no %v in %v", value, string(body))
+		}
+	}
+
+	if body := scrubDiagnosticsBody("multipart/form-data", []byte(`{"token":"t0"}`)); body != nil {
+		t.Errorf("Fail for non-JSON body %v", string(body))
+	}
+
+	if query := scrubDiagnosticsQuery("app=live&token=t0&secret=s0"); query != "app=live&token=***&secret=***" {
+		t.Errorf("Fail for query %v", query)
+	}
+}
+
+func TestDiagnostics_MatchPrefixes(t *testing.T) {
+	v := NewDiagnostics()
+	if v.match("/terraform/v1/mgmt/status") {
+		t.Errorf("Fail for capture when disabled")
+	}
+
+	v.setState(&DiagnosticsState{
+		Enabled: true, Prefixes: []string{"/terraform/v1/ffmpeg/"}, ExpireAt: "2099-01-01T00:00:00Z",
+	})
+	if !v.match("/terraform/v1/ffmpeg/forward/streams") || v.match("/terraform/v1/mgmt/status") {
+		t.Errorf("Fail for prefixes %v", v.State().String())
+	}
+
+	v.setState(&DiagnosticsState{Enabled: true, ExpireAt: "2020-01-01T00:00:00Z"})
+	if v.match("/terraform/v1/mgmt/status") {
+		t.Errorf("Fail for capture when expired")
+	}
+}
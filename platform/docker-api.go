@@ -0,0 +1,156 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// DockerApi is the client of Docker Engine API over the unix socket, to manage containers without the docker CLI.
+// See https://docs.docker.com/engine/api/v1.41/
+type DockerApi struct {
+	// The unix socket of docker, for example, /var/run/docker.sock
+	socket string
+	// The client to request the socket.
+	client *http.Client
+}
+
+func NewDockerApi(socket string) *DockerApi {
+	return &DockerApi{
+		socket: socket,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// Close closes the idle connections to the socket.
+func (v *DockerApi) Close() {
+	v.client.CloseIdleConnections()
+}
+
+// Available returns whether the socket is visible to platform, for example, it's not mounted to the container of
+// platform, or in host mode.
+func (v *DockerApi) Available() bool {
+	info, err := os.Stat(v.socket)
+	return err == nil && info.Mode()&os.ModeSocket != 0
+}
+
+// request sends the API to docker, returns the status and body, or error with the message of docker if failed.
+func (v *DockerApi) request(ctx context.Context, method, api string) (int, []byte, error) {
+	// The host is ignored, because we always dial the socket.
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://docker%v", api), nil)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "new request %v %v", method, api)
+	}
+
+	res, err := v.client.Do(req)
+	if err != nil {
+		return 0, nil, errors.Wrapf(err, "%v %v by %v", method, api, v.socket)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(res.Body, 1024*1024))
+	if err != nil {
+		return res.StatusCode, nil, errors.Wrapf(err, "read %v %v", method, api)
+	}
+
+	// Docker responses the error as {"message":"xxx"}, use the same text as docker CLI.
+	if res.StatusCode >= http.StatusBadRequest {
+		var r0 struct {
+			Message string `json:"message"`
+		}
+		if err := json.Unmarshal(b, &r0); err != nil || r0.Message == "" {
+			r0.Message = strings.TrimSpace(string(b))
+		}
+		return res.StatusCode, b, errors.Errorf("%v %v status=%v, Error response from daemon: %v",
+			method, api, res.StatusCode, r0.Message,
+		)
+	}
+	return res.StatusCode, b, nil
+}
+
+// Version returns the version of docker server, which is cheap to check whether docker is ready.
+func (v *DockerApi) Version(ctx context.Context) (string, error) {
+	_, b, err := v.request(ctx, http.MethodGet, "/version")
+	if err != nil {
+		return "", errors.Wrapf(err, "version")
+	}
+
+	var res struct {
+		Version string `json:"Version"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return "", errors.Wrapf(err, "unmarshal %v", string(b))
+	}
+	return res.Version, nil
+}
+
+// RemoveContainer stops and removes the container, like docker rm -f, and it's ok if the container does not exist.
+func (v *DockerApi) RemoveContainer(ctx context.Context, name string) error {
+	api := fmt.Sprintf("/containers/%v?force=true", url.PathEscape(name))
+	if status, _, err := v.request(ctx, http.MethodDelete, api); err != nil && status != http.StatusNotFound {
+		return errors.Wrapf(err, "remove container %v", name)
+	}
+	return nil
+}
+
+// ListContainers returns the state of all containers by name, for example, running or exited, like docker ps -a.
+func (v *DockerApi) ListContainers(ctx context.Context) (map[string]string, error) {
+	_, b, err := v.request(ctx, http.MethodGet, "/containers/json?all=true")
+	if err != nil {
+		return nil, errors.Wrapf(err, "list containers")
+	}
+
+	var containers []struct {
+		Names []string `json:"Names"`
+		State string   `json:"State"`
+	}
+	if err := json.Unmarshal(b, &containers); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", string(b))
+	}
+
+	// The name of container is prefixed by slash, for example, /srs-server.
+	states := make(map[string]string)
+	for _, container := range containers {
+		for _, name := range container.Names {
+			states[strings.TrimPrefix(name, "/")] = container.State
+		}
+	}
+	return states, nil
+}
+
+// execDockerApi runs the api of execApi by the Docker Engine API.
+func execDockerApi(ctx context.Context, docker *DockerApi, api string, args ...string) error {
+	switch api {
+	case "rmContainer":
+		toCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		defer cancel()
+
+		return docker.RemoveContainer(toCtx, args[0])
+	case "version":
+		_, err := docker.Version(ctx)
+		return err
+	default:
+		return errors.Errorf("invalid api %v", api)
+	}
+}
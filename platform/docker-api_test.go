@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// newFakeDockerApi starts a fake Docker Engine API server on the unix socket in dir.
+func newFakeDockerApi(t testing.TB, dir string, handler http.Handler) (*httptest.Server, string) {
+	socket := path.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	server := httptest.NewUnstartedServer(handler)
+	server.Listener.Close()
+	server.Listener = listener
+	server.Start()
+	return server, socket
+}
+
+func TestDockerApi_Containers(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	dir, err := ioutil.TempDir("", "docker-api")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var requests []string
+	server, socket := newFakeDockerApi(t, dir, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests = append(requests, r.Method+" "+r.URL.String())
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/version":
+			w.Write([]byte(`{"Version":"24.0.7","ApiVersion":"1.43"}`))
+		case r.Method == http.MethodGet && r.URL.Path == "/containers/json":
+			w.Write([]byte(`[{"Names":["/srs-server"],"State":"running"},{"Names":["/srs-dev"],"State":"exited"}]`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/containers/srs-server":
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodDelete && r.URL.Path == "/containers/srs-dev":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"message":"No such container: srs-dev"}`))
+		default:
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"message":"removal of container is already in progress"}`))
+		}
+	}))
+	defer server.Close()
+
+	docker := NewDockerApi(socket)
+	defer docker.Close()
+
+	if !docker.Available() {
+		t.Errorf("Fail for socket %v", socket)
+	}
+	if NewDockerApi(path.Join(dir, "none.sock")).Available() {
+		t.Errorf("Fail for no socket")
+	}
+
+	if version, err := docker.Version(ctx); err != nil || version != "24.0.7" {
+		t.Errorf("Fail for version=%v, err %+v", version, err)
+	}
+
+	// The name of container is without slash.
+	if states, err := docker.ListContainers(ctx); err != nil || len(states) != 2 ||
+		states["srs-server"] != "running" || states["srs-dev"] != "exited" {
+		t.Errorf("Fail for states=%v, err %+v", states, err)
+	}
+
+	// Force to remove the container, and it's ok if not exists, like docker rm -f.
+	if err := docker.RemoveContainer(ctx, "srs-server"); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if err := docker.RemoveContainer(ctx, "srs-dev"); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if len(requests) != 4 || requests[2] != "DELETE /containers/srs-server?force=true" {
+		t.Errorf("Fail for requests %v", requests)
+	}
+
+	// Respond the message of docker, which is shown to user.
+	if err := docker.RemoveContainer(ctx, "redis"); err == nil ||
+		!strings.Contains(err.Error(), "Error response from daemon: removal of container is already in progress") {
+		t.Errorf("Fail for err %+v", err)
+	}
+}
+
+func TestDockerApi_ExecApi(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	dir, err := ioutil.TempDir("", "docker-api")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var removed []string
+	server, socket := newFakeDockerApi(t, dir, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodDelete {
+			removed = append(removed, path.Base(r.URL.Path))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write([]byte(`{"Version":"24.0.7"}`))
+	}))
+	defer server.Close()
+
+	oldSocket := os.Getenv("PLATFORM_DOCKER_SOCKET")
+	os.Setenv("PLATFORM_DOCKER_SOCKET", socket)
+	defer os.Setenv("PLATFORM_DOCKER_SOCKET", oldSocket)
+
+	// Use the Docker Engine API rather than docker CLI, if the socket is visible.
+	if err := execApi(ctx, "version"); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if err := execApi(ctx, "rmContainer", "srs-server"); err != nil || len(removed) != 1 || removed[0] != "srs-server" {
+		t.Errorf("Fail for removed=%v, err %+v", removed, err)
+	}
+	if err := execApi(ctx, "restart", "srs-server"); err == nil {
+		t.Errorf("Fail for invalid api")
+	}
+}
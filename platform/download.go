@@ -0,0 +1,321 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The directories allowed to download files from, relative to the working directory.
+var downloadAllowedDirs = []string{"record", "dvr", "vod"}
+
+// The default and max expire duration of download token.
+const downloadTokenDefaultExpire = 5 * time.Minute
+const downloadTokenMaxExpire = 1 * time.Hour
+
+// The max number of concurrent readers of a file, for example, a download manager fetches ranges in parallel.
+const downloadMaxReaders = 8
+
+// The MIME types of media files, which might not be available in system.
+var downloadContentTypes = map[string]string{
+	".mp4":  "video/mp4",
+	".ts":   "video/mp2t",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".flv":  "video/x-flv",
+	".mp3":  "audio/mpeg",
+	".aac":  "audio/aac",
+}
+
+// DownloadToken is a short-lived token to download a specified file. It's reusable until expired, so the client is
+// able to resume the download, or read ranges of file concurrently.
+type DownloadToken struct {
+	// The file path, which is bound to token exactly.
+	File string `json:"file"`
+	// The expire time.
+	ExpireAt string `json:"expireAt"`
+	// The storage driver which the file is archived to, empty for local disk.
+	Storage StorageDriverName `json:"storage,omitempty"`
+}
+
+// DownloadReaders counts the concurrent readers of each file, to limit the handlers tied up by a file.
+type DownloadReaders struct {
+	readers map[string]int
+	lock    sync.Mutex
+}
+
+func NewDownloadReaders() *DownloadReaders {
+	return &DownloadReaders{readers: make(map[string]int)}
+}
+
+// Acquire returns false if the readers of file exceed downloadMaxReaders, or user should Release it.
+func (v *DownloadReaders) Acquire(file string) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.readers[file] >= downloadMaxReaders {
+		return false
+	}
+	v.readers[file]++
+	return true
+}
+
+func (v *DownloadReaders) Release(file string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.readers[file]--; v.readers[file] <= 0 {
+		delete(v.readers, file)
+	}
+}
+
+var downloadReaders = NewDownloadReaders()
+
+// GenerateDownloadTokenKey to build the redis key of download token.
+func GenerateDownloadTokenKey(token string) string {
+	return fmt.Sprintf("%v:%v", SRS_DOWNLOAD_TOKEN, token)
+}
+
+// cleanDownloadFile returns the cleaned file path if it's a regular file in the allowed directories.
+func cleanDownloadFile(file string) (string, error) {
+	if file == "" {
+		return "", errors.New("no file")
+	}
+	if filepath.IsAbs(file) || strings.Contains(file, "..") {
+		return "", errors.Errorf("invalid file %v", file)
+	}
+
+	cleaned := path.Clean(file)
+	var allowed bool
+	for _, dir := range downloadAllowedDirs {
+		if strings.HasPrefix(cleaned, dir+"/") {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return "", errors.Errorf("invalid file %v, should in %v", file, downloadAllowedDirs)
+	}
+
+	if info, err := os.Stat(cleaned); err != nil {
+		return "", errors.Wrapf(err, "stat %v", cleaned)
+	} else if !info.Mode().IsRegular() {
+		return "", errors.Errorf("invalid file %v, not regular", cleaned)
+	}
+	return cleaned, nil
+}
+
+// resolveDownloadFile returns the cleaned file, and the storage driver if the file is not in local disk, because the
+// record is archived to the storage driver, see archiveArtifact.
+func resolveDownloadFile(ctx context.Context, file string) (string, StorageDriverName, error) {
+	cleaned, err := cleanDownloadFile(file)
+	if err == nil {
+		return cleaned, "", nil
+	} else if !os.IsNotExist(errors.Cause(err)) {
+		return "", "", err
+	}
+
+	// Only the record is archived, such as record/3ECF0239-708C-42E4-96E1-5AE935C6E6A9/index.mp4
+	parts := strings.SplitN(path.Clean(file), "/", 3)
+	if len(parts) != 3 || parts[0] != "record" {
+		return "", "", err
+	}
+
+	value, r0 := rdb.HGet(ctx, SRS_RECORD_M3U8_ARTIFACT, parts[1]).Result()
+	if r0 != nil && r0 != redis.Nil {
+		return "", "", errors.Wrapf(r0, "hget %v %v", SRS_RECORD_M3U8_ARTIFACT, parts[1])
+	} else if value == "" {
+		return "", "", err
+	}
+
+	var artifact M3u8VoDArtifact
+	if r0 := json.Unmarshal([]byte(value), &artifact); r0 != nil {
+		return "", "", errors.Wrapf(r0, "unmarshal %v", value)
+	}
+	if artifact.Storage == "" || artifact.Storage == StorageDriverLocal {
+		return "", "", err
+	}
+	return path.Clean(file), artifact.Storage, nil
+}
+
+// createDownloadToken creates a token for the cleaned file, and returns the download URL. The storage is the driver
+// to download from, or empty for local disk.
+func createDownloadToken(ctx context.Context, cleaned string, storage StorageDriverName, duration time.Duration) (string, *DownloadToken, error) {
+	downloadToken := strings.ReplaceAll(uuid.NewString(), "-", "")
+	obj := &DownloadToken{File: cleaned, ExpireAt: time.Now().Add(duration).Format(time.RFC3339), Storage: storage}
+	key := GenerateDownloadTokenKey(downloadToken)
+	if b, err := json.Marshal(obj); err != nil {
+		return "", nil, errors.Wrapf(err, "marshal %v", obj)
+	} else if err := rdb.Set(ctx, key, string(b), duration).Err(); err != nil && err != redis.Nil {
+		return "", nil, errors.Wrapf(err, "set %v %v %v", key, string(b), duration)
+	}
+
+	return fmt.Sprintf("/terraform/v1/mgmt/download?token=%v", downloadToken), obj, nil
+}
+
+func handleMgmtDownload(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/download/create"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, file string
+			var expire int
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				File   *string `json:"file"`
+				Expire *int    `json:"expire"`
+			}{
+				Token: &token, File: &file, Expire: &expire,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			cleaned, storage, err := resolveDownloadFile(ctx, file)
+			if err != nil {
+				return errors.Wrapf(err, "check file %v", file)
+			}
+
+			duration := downloadTokenDefaultExpire
+			if expire > 0 {
+				duration = time.Duration(expire) * time.Second
+			}
+			if duration > downloadTokenMaxExpire {
+				return errors.Errorf("expire %v exceed %v", duration, downloadTokenMaxExpire)
+			}
+
+			url, obj, err := createDownloadToken(ctx, cleaned, storage, duration)
+			if err != nil {
+				return errors.Wrapf(err, "create token for %v", cleaned)
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				URL      string `json:"url"`
+				ExpireAt string `json:"expireAt"`
+			}{
+				URL:      url,
+				ExpireAt: obj.ExpireAt,
+			})
+			logger.Tf(ctx, "download create token ok, file=%v, storage=%v, expire=%v, token=%vB",
+				cleaned, storage, duration, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/download"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			downloadToken := r.URL.Query().Get("token")
+			if downloadToken == "" {
+				return errors.New("no token")
+			}
+
+			// The token is expired by redis, and reused by the range requests before expired.
+			key := GenerateDownloadTokenKey(downloadToken)
+			value, err := rdb.Get(ctx, key).Result()
+			if err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "get %v", key)
+			} else if value == "" {
+				return errors.New("invalid or expired token")
+			}
+
+			var obj DownloadToken
+			if err := json.Unmarshal([]byte(value), &obj); err != nil {
+				return errors.Wrapf(err, "unmarshal %v", value)
+			}
+
+			// Redirect to the signed URL of the storage driver, which serves the ranges by itself.
+			if obj.Storage != "" && obj.Storage != StorageDriverLocal {
+				expireAt, err := time.Parse(time.RFC3339, obj.ExpireAt)
+				if err != nil {
+					return errors.Wrapf(err, "parse expire %v", obj.ExpireAt)
+				}
+
+				driver, err := queryStorageDriverByName(ctx, obj.Storage)
+				if err != nil {
+					return errors.Wrapf(err, "query driver %v", obj.Storage)
+				}
+
+				signedURL, err := driver.SignedURL(ctx, obj.File, time.Until(expireAt).Round(time.Second)+time.Second)
+				if err != nil {
+					return errors.Wrapf(err, "sign %v of %v", obj.File, driver.Name())
+				}
+
+				http.Redirect(w, r, signedURL, http.StatusFound)
+				logger.Tf(ctx, "download redirect ok, file=%v, storage=%v, range=%v", obj.File, obj.Storage, r.Header.Get("Range"))
+				return nil
+			}
+
+			// Check the file again, because it might be removed or changed.
+			cleaned, err := cleanDownloadFile(obj.File)
+			if err != nil {
+				return errors.Wrapf(err, "check file %v", obj.File)
+			} else if cleaned != obj.File {
+				return errors.Errorf("file %v mismatch %v", cleaned, obj.File)
+			}
+
+			if !downloadReaders.Acquire(cleaned) {
+				return newHttpCodeError(http.StatusTooManyRequests, SrsStackErrorTooManyRequests,
+					errors.Errorf("exceed %v readers of %v", downloadMaxReaders, cleaned),
+				)
+			}
+			defer downloadReaders.Release(cleaned)
+
+			f, err := os.Open(cleaned)
+			if err != nil {
+				return errors.Wrapf(err, "open %v", cleaned)
+			}
+			defer f.Close()
+
+			info, err := f.Stat()
+			if err != nil {
+				return errors.Wrapf(err, "stat %v", cleaned)
+			}
+
+			if contentType, ok := downloadContentTypes[path.Ext(cleaned)]; ok {
+				w.Header().Set("Content-Type", contentType)
+			}
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", path.Base(cleaned)))
+			// The strong validator for If-Range, so the client never resumes with the ranges of a changed file.
+			w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size()))
+
+			// ServeContent handles the range requests, If-Range and HEAD, and copies the ranges from file with a
+			// small buffer or by sendfile, rather than read the whole file to memory.
+			http.ServeContent(w, r, path.Base(cleaned), info.ModTime(), f)
+			logger.Tf(ctx, "download file ok, file=%v, size=%v, range=%v", cleaned, info.Size(), r.Header.Get("Range"))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
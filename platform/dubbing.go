@@ -21,7 +21,6 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 	"github.com/sashabaranov/go-openai"
 )
@@ -48,10 +47,13 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 	ep := "/terraform/v1/dubbing/create"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, title string
 			var files []*FFprobeSource
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				// Project title.
 				Title *string `json:"title"`
@@ -131,20 +133,23 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Wrapf(err, "save dubbing project %v", dubbing.String())
 			}
 
-			ohttp.WriteData(ctx, w, r, &dubbing)
+			httpWriteData(ctx, w, r, &dubbing)
 			logger.Tf(ctx, "srs dubbing create ok, title=%v, project=%v", title, dubbing.String())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/dubbing/list"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -170,7 +175,7 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				}
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Projects []*SrsDubbingProject `json:"projects"`
 			}{
 				Projects: projects,
@@ -178,16 +183,19 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "srs dubbing projects list ok, projects=%v", len(projects))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/dubbing/remove"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, dubbingUUID string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token       *string `json:"token"`
 				DubbingUUID *string `json:"uuid"`
 			}{
@@ -220,20 +228,23 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				}
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "srs remove dubbing ok, uuid=%v", dubbingUUID)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/dubbing/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, dubbingUUID string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token       *string `json:"token"`
 				DubbingUUID *string `json:"uuid"`
 			}{
@@ -258,21 +269,24 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				dubbing.SourceUUID, dubbing.SourcePath = "", ""
 			}
 
-			ohttp.WriteData(ctx, w, r, &dubbing)
+			httpWriteData(ctx, w, r, &dubbing)
 			logger.Tf(ctx, "srs dubbing query ok, uuid=%v, dubbing=%v", dubbingUUID, dubbing.String())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/dubbing/update"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var dubbing SrsDubbingProject
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				*SrsDubbingProject
 			}{
@@ -305,17 +319,20 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 			case <-time.After(300 * time.Millisecond):
 			}
 
-			ohttp.WriteData(ctx, w, r, &dubbing)
+			httpWriteData(ctx, w, r, &dubbing)
 			logger.Tf(ctx, "srs dubbing update ok, dubbing=%v", dubbing.String())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/dubbing/play"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			q := r.URL.Query()
 
@@ -357,21 +374,24 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 			w.Header().Set("Content-Type", contentType)
 			http.ServeFile(w, r, filename)
 
-			ohttp.WriteData(ctx, w, r, &dubbing)
+			httpWriteData(ctx, w, r, &dubbing)
 			logger.Tf(ctx, "srs dubbing get play src ok, uuid=%v, dubbing=%v", dubbingUUID, dubbing.String())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/dubbing/export"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var dubbingUUID, taskUUID string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token    *string `json:"token"`
 				UUID     *string `json:"uuid"`
 				TaskUUID *string `json:"task"`
@@ -559,17 +579,22 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "srs dubbing artifact download ok, dubbing=%v, export=%v", dubbing.String(), absExportFile)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/dubbing/task-start"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		// The dubbing task outlives the request, so it runs in the context of service.
+		parentCtx := ctx
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var dubbingUUID string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				UUID  *string `json:"uuid"`
 			}{
@@ -623,7 +648,7 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				}
 
 				// Start the task for dubbing project.
-				if err := task.Start(ctx); err != nil {
+				if err := task.Start(logger.AliasContext(parentCtx, ctx)); err != nil {
 					return errors.Wrapf(err, "start dubbing task %v", task.String())
 				}
 			}
@@ -634,7 +659,7 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 			case <-time.After(300 * time.Millisecond):
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				// Dubbing task UUID, equals to the dubbing project UUID.
 				UUID string `json:"uuid"`
 				// The task session UUID.
@@ -647,17 +672,20 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "srs dubbing start task ok, dubbing=%v", dubbing.String())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/dubbing/task-rephrase"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var dubbingUUID, taskUUID, groupUUID string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token     *string `json:"token"`
 				UUID      *string `json:"uuid"`
 				TaskUUID  *string `json:"task"`
@@ -753,7 +781,7 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Wrapf(err, "save")
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Status SrsDubbingTaskStatus `json:"status"`
 				*SrsDubbingTask
 			}{
@@ -763,17 +791,20 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				dubbing.String(), task.String(), group)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/dubbing/task-merge"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var dubbingUUID, taskUUID, groupUUID, direction string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token     *string `json:"token"`
 				UUID      *string `json:"uuid"`
 				TaskUUID  *string `json:"task"`
@@ -832,7 +863,7 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Wrapf(err, "save")
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Status SrsDubbingTaskStatus `json:"status"`
 				*SrsDubbingTask
 			}{
@@ -842,17 +873,20 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				dubbing.String(), task.String(), group)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/dubbing/task-query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var dubbingUUID, taskUUID string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token    *string `json:"token"`
 				UUID     *string `json:"uuid"`
 				TaskUUID *string `json:"task"`
@@ -885,7 +919,7 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Errorf("task %v not exists", taskUUID)
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Status SrsDubbingTaskStatus `json:"status"`
 				*SrsDubbingTask
 			}{
@@ -894,13 +928,16 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "srs dubbing query task ok, dubbing=%v, task=%v", dubbing.String(), task.String())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/dubbing/task-tts"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			q := r.URL.Query()
 
@@ -954,18 +991,21 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 			w.Header().Set("Content-Type", contentType)
 			http.ServeFile(w, r, filename)
 
-			ohttp.WriteData(ctx, w, r, &dubbing)
+			httpWriteData(ctx, w, r, &dubbing)
 			logger.Tf(ctx, "srs dubbing get tts src ok, uuid=%v, group=%v, dubbing=%v",
 				dubbingUUID, groupUUID, dubbing.String())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/dubbing/source"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			type DubbingTempFile struct {
 				// The file name.
@@ -984,7 +1024,7 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 
 			var token string
 			var files []*DubbingTempFile
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string             `json:"token"`
 				Files *[]*DubbingTempFile `json:"files"`
 			}{
@@ -1120,7 +1160,7 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 				logger.Tf(ctx, "Dubbing: Process file %v", parsedFile.String())
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Files []*FFprobeSource `json:"files"`
 			}{
 				Files: parsedFiles,
@@ -1128,7 +1168,7 @@ func handleDubbingService(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "Dubbing: Update dubbing ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
@@ -5,6 +5,8 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -12,12 +14,12 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
 	"github.com/go-redis/redis/v8"
@@ -30,6 +32,37 @@ const (
 	RecordPostProcessCpFile RecordPostProcess = "post-cp-file"
 )
 
+// RecordMode is the DVR mode of record, whether convert the HLS VoD to MP4.
+type RecordMode string
+
+const (
+	// Archive the HLS as VoD, and convert it to MP4, which is the default mode.
+	RecordModeMp4 RecordMode = "mp4"
+	// Only archive the HLS as VoD, which is playable immediately without converting.
+	RecordModeHls RecordMode = "hls"
+)
+
+// The interval for janitor to remove the records exceed the retention.
+const recordJanitorInterval = 1 * time.Hour
+
+// recordPlaybackURL returns the HLS VoD playback URL of record, served by the record hls handler.
+func recordPlaybackURL(uuid string) string {
+	return withBasePath(fmt.Sprintf("/terraform/v1/hooks/record/hls/%v/index.m3u8", uuid))
+}
+
+// queryRecordMode returns the DVR mode of record, default to MP4.
+func queryRecordMode(ctx context.Context) (RecordMode, error) {
+	mode, err := rdb.HGet(ctx, SRS_RECORD_PATTERNS, "mode").Result()
+	if err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "hget %v mode", SRS_RECORD_PATTERNS)
+	}
+
+	if mode == "" {
+		return RecordModeMp4, nil
+	}
+	return RecordMode(mode), nil
+}
+
 var recordWorker *RecordWorker
 
 type RecordWorker struct {
@@ -52,9 +85,12 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 	ep := "/terraform/v1/hooks/record/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -73,6 +109,10 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Wrapf(err, "hget %v globs", SRS_RECORD_PATTERNS)
 			} else if processCpDir, err := rdb.HGet(ctx, SRS_RECORD_PATTERNS, string(RecordPostProcessCpFile)).Result(); err != nil && err != redis.Nil {
 				return errors.Wrapf(err, "hget %v %v", SRS_RECORD_PATTERNS, string(RecordPostProcessCpFile))
+			} else if mode, err := queryRecordMode(ctx); err != nil {
+				return errors.Wrapf(err, "query mode")
+			} else if retention, err := rdb.HGet(ctx, SRS_RECORD_PATTERNS, "retention").Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hget %v retention", SRS_RECORD_PATTERNS)
 			} else {
 				globFilters := []string{}
 				if globs != "" {
@@ -90,28 +130,36 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 					Globs []string `json:"globs"`
 					// The post process to copy file to dir for record.
 					ProcessCpDir string `json:"processCpDir"`
+					// The DVR mode, mp4 or hls.
+					Mode RecordMode `json:"mode"`
+					// The retention days of records, 0 to keep forever.
+					Retention int `json:"retention"`
 				}
 
-				ohttp.WriteData(ctx, w, r, &RecordQueryResult{
+				retentionDays, _ := strconv.Atoi(retention)
+				httpWriteData(ctx, w, r, &RecordQueryResult{
 					All: all == "true", Home: "/data/record", Globs: globFilters,
-					ProcessCpDir: processCpDir,
+					ProcessCpDir: processCpDir, Mode: mode, Retention: retentionDays,
 				})
 			}
 
 			logger.Tf(ctx, "record query ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/record/apply"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var all bool
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				All   *bool   `json:"all"`
 			}{
@@ -129,21 +177,24 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Wrapf(err, "hset %v all %v", SRS_RECORD_PATTERNS, all)
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "record apply ok, all=%v, token=%vB", all, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/record/globs"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var globs []string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string   `json:"token"`
 				Globs *[]string `json:"globs"`
 			}{
@@ -170,21 +221,24 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Wrapf(err, "hset %v globs %v", SRS_RECORD_PATTERNS, string(b))
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "record update globs ok, glob=%v, token=%vB", filteredGlobs, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/record/post-processing"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var postProcess, PostCpDir string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token       *string `json:"token"`
 				PostProcess *string `json:"postProcess"`
 				PostCpDir   *string `json:"postCpDir"`
@@ -212,21 +266,73 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_PATTERNS, RecordPostProcessCpFile, PostCpDir)
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "record update post processing ok, postProcess=%v, postCpDir=%v, token=%vB",
 				postProcess, PostCpDir, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/dvr"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, mode string
+			var retention int
+			if err := ParseBody(ctx, r, &struct {
+				Token     *string `json:"token"`
+				Mode      *string `json:"mode"`
+				Retention *int    `json:"retention"`
+			}{
+				Token: &token, Mode: &mode, Retention: &retention,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if mode == "" {
+				mode = string(RecordModeMp4)
+			}
+			if RecordMode(mode) != RecordModeMp4 && RecordMode(mode) != RecordModeHls {
+				return errors.Errorf("invalid mode %v", mode)
+			}
+			if retention < 0 {
+				return errors.Errorf("invalid retention %v", retention)
+			}
+
+			if err := rdb.HSet(ctx, SRS_RECORD_PATTERNS, "mode", mode).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v mode %v", SRS_RECORD_PATTERNS, mode)
+			}
+			if err := rdb.HSet(ctx, SRS_RECORD_PATTERNS, "retention", fmt.Sprintf("%v", retention)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v retention %v", SRS_RECORD_PATTERNS, retention)
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "record update dvr ok, mode=%v, retention=%v, token=%vB", mode, retention, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/record/remove"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, uuid string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				UUID  *string `json:"uuid"`
 			}{
@@ -253,50 +359,72 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Wrapf(err, "parse %v", M3u8VoDMetadata)
 			}
 
-			// Remove all ts files.
-			for _, file := range metadata.Files {
-				if _, err := os.Stat(file.Key); err == nil {
-					os.Remove(file.Key)
-				}
+			if err := removeRecordArtifact(ctx, &metadata); err != nil {
+				return errors.Wrapf(err, "remove %v", uuid)
 			}
 
-			// Remove m3u8 file.
-			m3u8File := path.Join("record", uuid, "index.m3u8")
-			if _, err := os.Stat(m3u8File); err == nil {
-				os.Remove(m3u8File)
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "record remove ok, uuid=%v, token=%vB", uuid, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/metadata"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			// Only the specified fields are updated, for example, set labels to [] to remove all labels.
+			var token, uuid string
+			var title, notes *string
+			var labels *[]string
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string    `json:"token"`
+				UUID   *string    `json:"uuid"`
+				Title  **string   `json:"title"`
+				Labels **[]string `json:"labels"`
+				Notes  **string   `json:"notes"`
+			}{
+				Token: &token, UUID: &uuid, Title: &title, Labels: &labels, Notes: &notes,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
 			}
 
-			// Remove mp4 file.
-			mp4File := path.Join("record", uuid, "index.mp4")
-			if _, err := os.Stat(mp4File); err == nil {
-				os.Remove(mp4File)
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
 			}
 
-			// Remove ts directory.
-			m3u8Directory := path.Join("record", uuid)
-			if _, err := os.Stat(m3u8Directory); err == nil {
-				os.RemoveAll(m3u8Directory)
+			if uuid == "" {
+				return errors.New("no uuid")
 			}
 
-			// Remove HLS from list.
-			if err := rdb.HDel(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid).Err(); err != nil && err != redis.Nil {
-				return errors.Wrapf(err, "hdel %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid)
+			metadata, err := updateRecordMetadata(ctx, uuid, title, labels, notes)
+			if err != nil {
+				return errors.Wrapf(err, "update metadata of %v", uuid)
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
-			logger.Tf(ctx, "record remove ok, uuid=%v, token=%vB", uuid, len(token))
+			httpWriteData(ctx, w, r, metadata)
+			logger.Tf(ctx, "record metadata ok, uuid=%v, %v, token=%vB", uuid, metadata.String(), len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/record/end"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, uuid string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				UUID  *string `json:"uuid"`
 			}{
@@ -322,23 +450,28 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 			// Make the task to expire, to end it ASAP.
 			task.Expired = true
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "record end ok, uuid=%v, token=%vB", uuid, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/record/files"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			var filter RecordFilter
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
+				*RecordFilter
 			}{
-				Token: &token,
+				Token: &token, RecordFilter: &filter,
 			}); err != nil {
 				return errors.Wrapf(err, "parse body")
 			}
@@ -348,47 +481,23 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Wrapf(err, "authenticate")
 			}
 
-			keys, cursor, err := rdb.HScan(ctx, SRS_RECORD_M3U8_ARTIFACT, 0, "*", 100).Result()
-			if err != nil && err != redis.Nil {
-				return errors.Wrapf(err, "hscan %v 0 * 100", SRS_RECORD_M3U8_ARTIFACT)
-			}
-
-			files := []map[string]interface{}{}
-			for i := 0; i < len(keys); i += 2 {
-				var metadata M3u8VoDArtifact
-				if err := json.Unmarshal([]byte(keys[i+1]), &metadata); err != nil {
-					return errors.Wrapf(err, "json parse %v", keys[i+1])
-				}
-
-				var duration float64
-				var size uint64
-				for _, file := range metadata.Files {
-					duration += file.Duration
-					size += file.Size
-				}
-
-				files = append(files, map[string]interface{}{
-					"uuid":     metadata.UUID,
-					"vhost":    metadata.Vhost,
-					"app":      metadata.App,
-					"stream":   metadata.Stream,
-					"progress": metadata.Processing,
-					"update":   metadata.Update,
-					"nn":       len(metadata.Files),
-					"duration": duration,
-					"size":     size,
-				})
+			files, total, err := queryRecordFiles(ctx, &filter)
+			if err != nil {
+				return errors.Wrapf(err, "query files by %v", filter.String())
 			}
 
-			ohttp.WriteData(ctx, w, r, files)
-			logger.Tf(ctx, "record files ok, cursor=%v, token=%vB", cursor, len(token))
+			// The total number of matched recordings, for pagination.
+			w.Header().Set("X-Total-Count", fmt.Sprintf("%v", total))
+			httpWriteData(ctx, w, r, files)
+			logger.Tf(ctx, "record files ok, %v, total=%v, files=%v, token=%vB",
+				filter.String(), total, len(files), len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
-	m3u8Handler := func(w http.ResponseWriter, r *http.Request) error {
+	m3u8Handler := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 		// Format is :uuid.m3u8 or :uuid/index.m3u8
 		filename := r.URL.Path[len("/terraform/v1/hooks/record/hls/"):]
 		// Format is :uuid.m3u8
@@ -419,7 +528,7 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 		return nil
 	}
 
-	tsHandler := func(w http.ResponseWriter, r *http.Request) error {
+	tsHandler := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 		// Format is :dir/:m3u8/:uuid.ts
 		filename := r.URL.Path[len("/terraform/v1/hooks/record/hls/"):]
 		fileDir, fileBase := path.Dir(filename), path.Base(filename)
@@ -452,7 +561,7 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 		return nil
 	}
 
-	mp4Handler := func(w http.ResponseWriter, r *http.Request) error {
+	mp4Handler := func(ctx context.Context, w http.ResponseWriter, r *http.Request) error {
 		// Format is :uuid/index.mp4
 		filename := r.URL.Path[len("/terraform/v1/hooks/record/hls/"):]
 		uuid := path.Dir(filename)
@@ -470,67 +579,69 @@ func (v *RecordWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 		}
 
 		mp4FilePath := path.Join("record", uuid, "index.mp4")
-		stats, err := os.Stat(mp4FilePath)
-		if err != nil {
-			return errors.Wrapf(err, "no mp4 file %v", mp4FilePath)
+		if !downloadReaders.Acquire(mp4FilePath) {
+			return newHttpCodeError(http.StatusTooManyRequests, SrsStackErrorTooManyRequests,
+				errors.Errorf("exceed %v readers of %v", downloadMaxReaders, mp4FilePath),
+			)
 		}
+		defer downloadReaders.Release(mp4FilePath)
 
 		mp4File, err := os.Open(mp4FilePath)
 		if err != nil {
-			return errors.Wrapf(err, "open file %v", mp4FilePath)
+			return errors.Wrapf(err, "no mp4 file %v", mp4FilePath)
 		}
 		defer mp4File.Close()
 
-		// No range request.
-		rangeHeader := r.Header.Get("Range")
-		if rangeHeader == "" {
-			w.Header().Set("Content-Type", "video/mp4")
-			io.Copy(w, mp4File)
-			logger.T(ctx, "record serve full mp4=%v", mp4FilePath)
-			return nil
-		}
-
-		// Support range request.
-		var start, end int64
-		fmt.Sscanf(rangeHeader, "bytes=%u-%u", &start, &end)
-		if end == 0 {
-			end = stats.Size() - 1
-		}
-
-		if _, err := mp4File.Seek(start, io.SeekStart); err != nil {
-			return errors.Wrapf(err, "seek to %v of %v", start, mp4FilePath)
+		stats, err := mp4File.Stat()
+		if err != nil {
+			return errors.Wrapf(err, "stat %v", mp4FilePath)
 		}
 
-		w.Header().Set("ccept-Ranges", "bytes")
-		w.Header().Set("Content-Length", fmt.Sprintf("%v", end+1-start))
-		w.Header().Set("Content-Range", fmt.Sprintf("bytes %v-%v/%v", start, end, stats.Size()))
-
-		w.WriteHeader(http.StatusPartialContent)
 		w.Header().Set("Content-Type", "video/mp4")
-		io.CopyN(w, mp4File, end+1-start)
+		// The strong validator for If-Range, so the player never resumes with the ranges of a changed file.
+		w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, stats.ModTime().UnixNano(), stats.Size()))
 
-		logger.Tf(ctx, "record serve partial ok, uuid=%v, mp4=%v", uuid, mp4FilePath)
+		// ServeContent handles the range requests, If-Range and HEAD, see handleMgmtDownload.
+		http.ServeContent(w, r, path.Base(mp4FilePath), stats.ModTime(), mp4File)
+		logger.Tf(ctx, "record serve mp4 ok, uuid=%v, mp4=%v, range=%v", uuid, mp4FilePath, r.Header.Get("Range"))
 		return nil
 	}
 
 	ep = "/terraform/v1/hooks/record/hls/"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			if strings.HasSuffix(r.URL.Path, ".m3u8") {
-				return m3u8Handler(w, r)
+				return m3u8Handler(ctx, w, r)
 			} else if strings.HasSuffix(r.URL.Path, ".ts") {
-				return tsHandler(w, r)
+				return tsHandler(ctx, w, r)
 			} else if strings.HasSuffix(r.URL.Path, ".mp4") {
-				return mp4Handler(w, r)
+				return mp4Handler(ctx, w, r)
+			} else if strings.HasSuffix(r.URL.Path, ".jpg") || strings.HasSuffix(r.URL.Path, ".vtt") {
+				return serveRecordPreview(ctx, w, r.URL.Path[len("/terraform/v1/hooks/record/hls/"):])
 			}
 
 			return errors.Errorf("invalid handler for %v", r.URL.Path)
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
+	v.handleRetention(ctx, handler)
+	v.handleVodCallback(ctx, handler)
+
+	return nil
+}
+
+// HandleRecordings registers the routes to manage the recordings, which are under /terraform/v1/mgmt/recordings/
+// rather than the hooks of record.
+func (v *RecordWorker) HandleRecordings(ctx context.Context, handler *http.ServeMux) error {
+	v.handleClip(ctx, handler)
+	v.handleVerify(ctx, handler)
+	v.handleExport(ctx, handler)
 	return nil
 }
 
@@ -601,6 +712,7 @@ func (v *RecordWorker) Start(ctx context.Context) error {
 	logger.Tf(ctx, "Record: start a worker")
 
 	// Load all objects from redis.
+	workingUUIDs := make(map[string]bool)
 	if objs, err := rdb.HGetAll(ctx, SRS_RECORD_M3U8_WORKING).Result(); err != nil && err != redis.Nil {
 		return errors.Wrapf(err, "hgetall %v", SRS_RECORD_M3U8_WORKING)
 	} else if len(objs) > 0 {
@@ -619,6 +731,7 @@ func (v *RecordWorker) Start(ctx context.Context) error {
 
 			// Save in memory object.
 			v.streams.Store(m3u8URL, &m3u8LocalObj)
+			workingUUIDs[m3u8LocalObj.UUID] = true
 
 			wg.Add(1)
 			go func() {
@@ -630,6 +743,74 @@ func (v *RecordWorker) Start(ctx context.Context) error {
 		}
 	}
 
+	// Finish the artifacts interrupted by crash, which have no working object to finish them.
+	if err := recoverRecordArtifacts(ctx, workingUUIDs); err != nil {
+		return errors.Wrapf(err, "recover artifacts")
+	}
+
+	// Remove the records exceed the retention.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for ctx.Err() == nil {
+			if err := removeExpiredRecords(ctx); err != nil {
+				logger.Wf(ctx, "record janitor ignore err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(recordJanitorInterval):
+			}
+		}
+	}()
+
+	// Export the finished records to cloud VOD, and retry the failed ones.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for ctx.Err() == nil {
+			if err := exportRecords(ctx, queryStorageExporter); err != nil {
+				logger.Wf(ctx, "record export ignore err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(recordExportInterval):
+			}
+		}
+	}()
+
+	// Generate the previews of the finished records, with limited number of ffmpeg.
+	previewInterval, err := parseRecordPreviewInterval(envRecordPreviewInterval())
+	if err != nil {
+		return errors.Wrapf(err, "parse preview interval")
+	}
+	previewConcurrency, err := parseRecordPreviewConcurrency(envRecordPreviewConcurrency())
+	if err != nil {
+		return errors.Wrapf(err, "parse preview concurrency")
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		generate := func(ctx context.Context, artifact *M3u8VoDArtifact) (*RecordPreview, error) {
+			return generateRecordPreview(ctx, artifact, previewInterval)
+		}
+		for ctx.Err() == nil {
+			if err := previewRecords(ctx, previewConcurrency, generate); err != nil {
+				logger.Wf(ctx, "record preview ignore err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(recordPreviewSweepInterval):
+			}
+		}
+	}()
+
 	// Create M3u8 object from message.
 	buildM3u8Object := func(ctx context.Context, msg *SrsOnHlsObject) error {
 		logger.Tf(ctx, "Record: Got message %v", msg.String())
@@ -809,7 +990,9 @@ func (v *RecordM3u8Stream) finishArtifact(ctx context.Context, artifact *M3u8VoD
 	defer v.lock.Unlock()
 
 	artifact.Processing = false
+	artifact.PlaybackURL = recordPlaybackURL(artifact.UUID)
 	artifact.Update = time.Now().Format(time.RFC3339)
+	artifact.Done = artifact.Update
 }
 
 func (v *RecordM3u8Stream) addMessage(ctx context.Context, msg *SrsOnHlsObject) {
@@ -966,6 +1149,21 @@ func (v *RecordM3u8Stream) Run(ctx context.Context) error {
 			return errors.Wrapf(err, "post processing")
 		}
 
+		// Archive to the storage driver, keep the local files if failed.
+		if err := v.archiveArtifact(ctx); err != nil {
+			logger.Wf(ctx, "ignore archive %v err %+v", v.artifact.String(), err)
+		}
+
+		// Export to cloud VOD by the worker, which retries if failed.
+		if err := enqueueRecordExport(ctx, v.artifact.UUID); err != nil {
+			logger.Wf(ctx, "ignore export %v err %+v", v.artifact.String(), err)
+		}
+
+		// Generate the preview by the worker, which never blocks the record.
+		if err := enqueueRecordPreview(ctx, v.artifact.UUID); err != nil {
+			logger.Wf(ctx, "ignore preview %v err %+v", v.artifact.String(), err)
+		}
+
 		// Now HLS is done
 		logger.Tf(ctx, "Record is done, hls is %v, artifact is %v", v.String(), v.artifact.String())
 		cancel()
@@ -1041,15 +1239,27 @@ func (v *RecordM3u8Stream) finishM3u8(ctx context.Context) error {
 	}
 	logger.Tf(ctx, "record to %v ok, type=%v, duration=%v", hls, contentType, duration)
 
-	mp4 := path.Join("record", v.UUID, "index.mp4")
-	if b, err := exec.CommandContext(ctx, "ffmpeg", "-i", hls, "-c", "copy", "-y", mp4).Output(); err != nil {
-		return errors.Wrapf(err, "covert to mp4 %v err %v", mp4, string(b))
+	// Convert to MP4, unless only archive the HLS VoD.
+	if mode, err := queryRecordMode(ctx); err != nil {
+		return errors.Wrapf(err, "query mode")
+	} else if mode != RecordModeHls {
+		mp4 := path.Join("record", v.UUID, "index.mp4")
+		if b, err := exec.CommandContext(ctx, "ffmpeg", "-i", hls, "-c", "copy", "-y", mp4).Output(); err != nil {
+			return errors.Wrapf(err, "covert to mp4 %v err %v", mp4, string(b))
+		}
+		logger.Tf(ctx, "record to %v ok", mp4)
 	}
-	logger.Tf(ctx, "record to %v ok", mp4)
 
 	// Remove object from worker.
 	v.recordWorker.streams.Delete(v.M3u8URL)
 
+	// Store the checksums of final files, to verify the integrity when archive or by verify job.
+	if checksums, err := checksumRecordFiles(ctx, v.UUID); err != nil {
+		logger.Wf(ctx, "record ignore checksum %v err %+v", v.UUID, err)
+	} else {
+		v.artifact.Checksums = checksums
+	}
+
 	// Update artifact after finally.
 	v.finishArtifact(ctx, v.artifact)
 	r0 := v.saveArtifact(ctx, v.artifact)
@@ -1076,7 +1286,13 @@ func (v *RecordM3u8Stream) postProcessing(ctx context.Context) error {
 		return nil
 	}
 
+	// Ignore if no MP4 file, for example, only archive the HLS VoD.
 	artifactPath := path.Join("record", v.UUID, "index.mp4")
+	if _, err := os.Stat(artifactPath); err != nil && os.IsNotExist(err) {
+		logger.Tf(ctx, "record post process ignore, no %v", artifactPath)
+		return nil
+	}
+
 	targetPath := path.Join(processCpDir, fmt.Sprintf("%v.mp4", v.artifact.UUID))
 	if err = exec.CommandContext(ctx, "cp", "-f", artifactPath, targetPath).Run(); err != nil {
 		return errors.Wrapf(err, "cp %v to %v", artifactPath, targetPath)
@@ -1086,6 +1302,57 @@ func (v *RecordM3u8Stream) postProcessing(ctx context.Context) error {
 	return nil
 }
 
+// archiveArtifact puts the files of record to the active storage driver, and stores the driver name in the
+// artifact, so the files are still able to be removed after switching to another driver.
+func (v *RecordM3u8Stream) archiveArtifact(ctx context.Context) error {
+	driver, err := queryStorageDriver(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query driver")
+	}
+
+	// Ignore for local disk, the files are already there.
+	if driver.Name() == StorageDriverLocal {
+		return nil
+	}
+
+	objects, err := localStorage.List(ctx, fmt.Sprintf("record/%v/", v.UUID))
+	if err != nil {
+		return errors.Wrapf(err, "list record %v", v.UUID)
+	}
+
+	for _, object := range objects {
+		if err := func() error {
+			f, err := localStorage.Get(ctx, object.Key)
+			if err != nil {
+				return errors.Wrapf(err, "get %v", object.Key)
+			}
+			defer f.Close()
+
+			// Hash the file while uploading, to make sure the archived one is the same as when finalized.
+			h := sha256.New()
+			if err := driver.Put(ctx, object.Key, io.TeeReader(f, h), object.Size); err != nil {
+				return errors.Wrapf(err, "put %v to %v", object.Key, driver.Name())
+			}
+			if checksum := findFileChecksum(v.artifact.Checksums, object.Key); checksum != nil {
+				if sum := hex.EncodeToString(h.Sum(nil)); sum != checksum.SHA256 {
+					return errors.Errorf("checksum mismatch %v, expect %v, actual %v", object.Key, checksum.SHA256, sum)
+				}
+			}
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+
+	v.artifact.Storage = driver.Name()
+	if err := v.saveArtifact(ctx, v.artifact); err != nil {
+		return errors.Wrapf(err, "save artifact %v", v.artifact.String())
+	}
+
+	logger.Tf(ctx, "record archive ok, driver=%v, files=%v", driver.Name(), len(objects))
+	return nil
+}
+
 func (v *RecordM3u8Stream) callbackBegin(ctx context.Context) (*SrsOnHlsObject, error) {
 	messages := v.copyMessages()
 	if len(messages) == 0 {
@@ -1111,3 +1378,122 @@ func (v *RecordM3u8Stream) callbackEnd(ctx context.Context, message *SrsOnHlsObj
 
 	return nil
 }
+
+// removeRecordArtifact removes the files and the index of record.
+func removeRecordArtifact(ctx context.Context, metadata *M3u8VoDArtifact) error {
+	// Remove the archived files by the driver which stores them, rather than the active one.
+	if metadata.Storage != "" && metadata.Storage != StorageDriverLocal {
+		driver, err := queryStorageDriverByName(ctx, metadata.Storage)
+		if err != nil {
+			return errors.Wrapf(err, "query driver %v", metadata.Storage)
+		}
+
+		prefix := fmt.Sprintf("record/%v/", metadata.UUID)
+		objects, err := driver.List(ctx, prefix)
+		if err != nil {
+			return errors.Wrapf(err, "list %v of %v", prefix, driver.Name())
+		}
+		for _, object := range objects {
+			if err := driver.Delete(ctx, object.Key); err != nil {
+				return errors.Wrapf(err, "delete %v of %v", object.Key, driver.Name())
+			}
+		}
+	}
+
+	// Remove all ts files.
+	for _, file := range metadata.Files {
+		if _, err := os.Stat(file.Key); err == nil {
+			os.Remove(file.Key)
+		}
+	}
+
+	// Remove m3u8 file.
+	m3u8File := path.Join("record", metadata.UUID, "index.m3u8")
+	if _, err := os.Stat(m3u8File); err == nil {
+		os.Remove(m3u8File)
+	}
+
+	// Remove mp4 file.
+	mp4File := path.Join("record", metadata.UUID, "index.mp4")
+	if _, err := os.Stat(mp4File); err == nil {
+		os.Remove(mp4File)
+	}
+
+	// Remove ts directory.
+	m3u8Directory := path.Join("record", metadata.UUID)
+	if _, err := os.Stat(m3u8Directory); err == nil {
+		os.RemoveAll(m3u8Directory)
+	}
+
+	// Remove HLS from list.
+	if err := rdb.HDel(ctx, SRS_RECORD_M3U8_ARTIFACT, metadata.UUID).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SRS_RECORD_M3U8_ARTIFACT, metadata.UUID)
+	}
+
+	// Remove the user metadata and the index of labels.
+	if err := removeRecordMetadata(ctx, metadata.UUID); err != nil {
+		return errors.Wrapf(err, "remove metadata of %v", metadata.UUID)
+	}
+
+	return nil
+}
+
+// recoverRecordArtifacts finishes the artifacts which are still processing but have no working object, for
+// example, the platform crashed while finishing it. The VoD playlist is generated from the existing segments.
+func recoverRecordArtifacts(ctx context.Context, workingUUIDs map[string]bool) error {
+	objs, err := rdb.HGetAll(ctx, SRS_RECORD_M3U8_ARTIFACT).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_RECORD_M3U8_ARTIFACT)
+	}
+
+	for uuid, obj := range objs {
+		var artifact M3u8VoDArtifact
+		if err := json.Unmarshal([]byte(obj), &artifact); err != nil {
+			return errors.Wrapf(err, "unmarshal %v %v", uuid, obj)
+		}
+
+		if !artifact.Processing || workingUUIDs[uuid] {
+			continue
+		}
+
+		// Only keep the segments which exist.
+		var files []*TsFile
+		for _, file := range artifact.Files {
+			if _, err := os.Stat(file.Key); err == nil {
+				files = append(files, file)
+			}
+		}
+
+		if len(files) == 0 {
+			if err := removeRecordArtifact(ctx, &artifact); err != nil {
+				return errors.Wrapf(err, "remove %v", uuid)
+			}
+			logger.Wf(ctx, "record recover remove empty artifact %v", artifact.String())
+			continue
+		}
+
+		_, m3u8Body, duration, err := buildVodM3u8ForLocal(ctx, files, false, "")
+		if err != nil {
+			return errors.Wrapf(err, "build vod of %v", uuid)
+		}
+
+		hls := path.Join("record", uuid, "index.m3u8")
+		if err := os.WriteFile(hls, []byte(m3u8Body), 0644); err != nil {
+			return errors.Wrapf(err, "write %v", hls)
+		}
+
+		artifact.Files, artifact.NN = files, len(files)
+		artifact.Processing = false
+		artifact.PlaybackURL = recordPlaybackURL(uuid)
+		artifact.Update = time.Now().Format(time.RFC3339)
+		artifact.Done = artifact.Update
+		if b, err := json.Marshal(&artifact); err != nil {
+			return errors.Wrapf(err, "marshal %v", artifact.String())
+		} else if err = rdb.HSet(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid, string(b)).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid, string(b))
+		}
+		logger.Wf(ctx, "record recover artifact %v, files=%v, duration=%v", uuid, len(files), duration)
+	}
+
+	return nil
+}
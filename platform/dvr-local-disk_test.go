@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestRecord_Mp4Ranges(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	// The record files are relative to the working directory.
+	pwd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	defer func() {
+		os.Chdir(pwd)
+	}()
+
+	body := strings.Repeat("0123456789", 10)
+	if err := os.MkdirAll("record/a", 0755); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if err := ioutil.WriteFile("record/a/index.mp4", []byte(body), 0644); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	b, _ := json.Marshal(&M3u8VoDArtifact{UUID: "a"})
+	server.HSet(SRS_RECORD_M3U8_ARTIFACT, "a", string(b))
+
+	handler := http.NewServeMux()
+	if err := NewRecordWorker().Handle(ctx, handler); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	mp4 := func(method string, headers ...string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, "/terraform/v1/hooks/record/hls/a/index.mp4", nil)
+		for i := 0; i < len(headers); i += 2 {
+			r.Header.Set(headers[i], headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := mp4(http.MethodGet)
+	if w.Code != http.StatusOK || w.Body.String() != body || w.Header().Get("Content-Type") != "video/mp4" {
+		t.Errorf("Fail for code=%v, type=%v, body=%vB", w.Code, w.Header().Get("Content-Type"), w.Body.Len())
+	}
+
+	// The open range and suffix range, which are not parsed by the format of bytes=%u-%u.
+	w = mp4(http.MethodGet, "Range", "bytes=90-")
+	if w.Code != http.StatusPartialContent || w.Body.String() != body[90:] || w.Header().Get("Content-Range") != "bytes 90-99/100" {
+		t.Errorf("Fail for code=%v, range=%v, body=%v", w.Code, w.Header().Get("Content-Range"), w.Body.String())
+	}
+	w = mp4(http.MethodGet, "Range", "bytes=-5")
+	if w.Code != http.StatusPartialContent || w.Body.String() != body[95:] {
+		t.Errorf("Fail for code=%v, range=%v, body=%v", w.Code, w.Header().Get("Content-Range"), w.Body.String())
+	}
+
+	// The end beyond EOF is truncated to the size of file.
+	w = mp4(http.MethodGet, "Range", "bytes=95-200")
+	if w.Code != http.StatusPartialContent || w.Body.String() != body[95:] || w.Header().Get("Content-Range") != "bytes 95-99/100" {
+		t.Errorf("Fail for code=%v, range=%v, body=%v", w.Code, w.Header().Get("Content-Range"), w.Body.String())
+	}
+
+	// The overlapping ranges are in multipart.
+	w = mp4(http.MethodGet, "Range", "bytes=0-9,5-14")
+	if w.Code != http.StatusPartialContent || !strings.HasPrefix(w.Header().Get("Content-Type"), "multipart/byteranges") ||
+		!strings.Contains(w.Body.String(), "Content-Range: bytes 0-9/100") ||
+		!strings.Contains(w.Body.String(), "Content-Range: bytes 5-14/100") {
+		t.Errorf("Fail for code=%v, type=%v", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	// The range starts beyond EOF is not satisfiable.
+	w = mp4(http.MethodGet, "Range", "bytes=100-")
+	if w.Code != http.StatusRequestedRangeNotSatisfiable || w.Header().Get("Content-Range") != "bytes */100" {
+		t.Errorf("Fail for code=%v, range=%v", w.Code, w.Header().Get("Content-Range"))
+	}
+
+	// The HEAD has the headers only.
+	w = mp4(http.MethodHead)
+	if w.Code != http.StatusOK || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "100" ||
+		w.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("Fail for code=%v, length=%v, body=%vB", w.Code, w.Header().Get("Content-Length"), w.Body.Len())
+	}
+	w = mp4(http.MethodHead, "Range", "bytes=10-19")
+	if w.Code != http.StatusPartialContent || w.Body.Len() != 0 || w.Header().Get("Content-Length") != "10" {
+		t.Errorf("Fail for code=%v, length=%v, body=%vB", w.Code, w.Header().Get("Content-Length"), w.Body.Len())
+	}
+
+	// The whole file if changed, by the stale If-Range.
+	w = mp4(http.MethodGet, "Range", "bytes=10-19", "If-Range", `"stale"`)
+	if w.Code != http.StatusOK || w.Body.String() != body {
+		t.Errorf("Fail for code=%v, body=%vB", w.Code, w.Body.Len())
+	}
+}
@@ -17,7 +17,6 @@ import (
 	"time"
 
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
@@ -58,9 +57,12 @@ func (v *DvrWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 	ep := "/terraform/v1/hooks/dvr/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -82,7 +84,7 @@ func (v *DvrWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 			secretId, _ := rdb.HGet(ctx, SRS_TENCENT_CAM, "secretId").Result()
 			secretKey, _ := rdb.HGet(ctx, SRS_TENCENT_CAM, "secretKey").Result()
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				All    bool `json:"all"`
 				Secret bool `json:"secret"`
 			}{
@@ -93,17 +95,20 @@ func (v *DvrWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "dvr query ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/dvr/apply"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var all bool
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				All   *bool   `json:"all"`
 			}{
@@ -121,20 +126,23 @@ func (v *DvrWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Wrapf(err, "hset %v all %v", SRS_DVR_PATTERNS, all)
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "dvr query ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/dvr/files"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -182,17 +190,20 @@ func (v *DvrWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 				})
 			}
 
-			ohttp.WriteData(ctx, w, r, files)
+			httpWriteData(ctx, w, r, files)
 			logger.Tf(ctx, "dvr files ok, cursor=%v, token=%vB", cursor, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/dvr/hls/"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			// Format is :uuid.m3u8 or :uuid/index.m3u8
 			filename := r.URL.Path[len("/terraform/v1/hooks/dvr/hls/"):]
@@ -224,7 +235,7 @@ func (v *DvrWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "dvr generate m3u8 ok, uuid=%v, duration=%v", uuid, duration)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
@@ -433,7 +444,7 @@ func (v *DvrWorker) updateCredential(ctx context.Context) error {
 		v.secretKey != previous.SecretKey
 	credentialOK := v.secretId != "" && v.secretKey != "" && v.bucketName != ""
 	if (v.cosClient == nil || changed) && credentialOK {
-		location := fmt.Sprintf("%v.cos.%v.myqcloud.com", v.bucketName, conf.Region)
+		location := fmt.Sprintf("%v.cos.%v.myqcloud.com", v.bucketName, conf.Region())
 		u, err := url.Parse(fmt.Sprintf("https://%v", location))
 		if err != nil {
 			return errors.Wrapf(err, "parse %v", fmt.Sprintf("https://%v", location))
@@ -623,7 +634,7 @@ func (v *DvrM3u8Stream) Initialize(ctx context.Context, r *DvrWorker) error {
 
 		// For DVR required parameters.
 		v.artifact.Bucket = r.bucketName
-		v.artifact.Region = conf.Region
+		v.artifact.Region = conf.Region()
 
 		if err := v.saveArtifact(ctx, v.artifact); err != nil {
 			return errors.Wrapf(err, "save artifact %v", v.artifact.String())
@@ -18,7 +18,6 @@ import (
 	"time"
 
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
@@ -62,9 +61,12 @@ func (v *VodWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 	ep := "/terraform/v1/hooks/vod/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -90,7 +92,7 @@ func (v *VodWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 			service, _ := rdb.HGet(ctx, SRS_TENCENT_VOD, "service").Result()
 			storage, _ := rdb.HGet(ctx, SRS_TENCENT_VOD, "storage").Result()
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				All     bool `json:"all"`
 				Secret  bool `json:"secret"`
 				Service bool `json:"service"`
@@ -106,17 +108,20 @@ func (v *VodWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "vod query ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/vod/apply"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var all bool
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				All   *bool   `json:"all"`
 			}{
@@ -134,20 +139,23 @@ func (v *VodWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Wrapf(err, "hset %v all %v", SRS_VOD_PATTERNS, all)
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "vod apply ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/vod/files"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -272,17 +280,20 @@ func (v *VodWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 				})
 			}
 
-			ohttp.WriteData(ctx, w, r, files)
+			httpWriteData(ctx, w, r, files)
 			logger.Tf(ctx, "vod files ok, cursor=%v, token=%vB", cursor, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/vod/hls/"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			// Format is :uuid.m3u8 or :uuid/index.m3u8
 			filename := r.URL.Path[len("/terraform/v1/hooks/vod/hls/"):]
@@ -314,7 +325,7 @@ func (v *VodWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "vod generate m3u8 ok, uuid=%v, duration=%v", uuid, duration)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
@@ -530,9 +541,9 @@ func (v *VodWorker) updateCredential(ctx context.Context) error {
 		cpf := profile.NewClientProfile()
 		cpf.HttpProfile.Endpoint = TENCENT_CLOUD_VOD_ENDPOINT
 
-		client, err := vod.NewClient(common.NewCredential(v.secretId, v.secretKey), conf.Region, cpf)
+		client, err := vod.NewClient(common.NewCredential(v.secretId, v.secretKey), conf.Region(), cpf)
 		if err != nil {
-			return errors.Wrapf(err, "create vod sdk client, region=%v", conf.Region)
+			return errors.Wrapf(err, "create vod sdk client, region=%v", conf.Region())
 		}
 		v.vodClient = client
 		logger.Tf(ctx, "create vod client ok, appid=%v", v.vodAppID)
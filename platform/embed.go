@@ -0,0 +1,424 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"fmt"
+	"html/template"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// The audience of playback token, which is only for playing the stream.
+const playbackTokenAudience = "play"
+
+// The max expire of playback token, and the default size of iframe.
+const (
+	playbackTokenMaxExpire = 365 * 24 * time.Hour
+	embedDefaultWidth      = 640
+	embedDefaultHeight     = 360
+)
+
+// playbackTokenKey derives the key from api secret, so that the playback token, which is public in the embed code,
+// is never accepted as the token of API.
+func playbackTokenKey(apiSecret string) []byte {
+	h := hmac.New(sha256.New, []byte(apiSecret))
+	h.Write([]byte("oryx-playback-token"))
+	return h.Sum(nil)
+}
+
+// createPlaybackToken creates the signed token to play the stream app/stream, before expireAt.
+func createPlaybackToken(apiSecret, app, stream string, expireAt time.Time) (string, error) {
+	if err := checkApiSecret(apiSecret); err != nil {
+		return "", errors.Wrapf(err, "check api secret")
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    tokenIssuer,
+		Subject:   fmt.Sprintf("%v/%v", app, stream),
+		Audience:  jwt.ClaimStrings{playbackTokenAudience},
+		ExpiresAt: jwt.NewNumericDate(expireAt),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	}).SignedString(playbackTokenKey(apiSecret))
+	if err != nil {
+		return "", errors.Wrapf(err, "jwt sign")
+	}
+	return token, nil
+}
+
+// verifyPlaybackToken verifies the token is signed for the stream app/stream, and not expired.
+func verifyPlaybackToken(apiSecret, token, app, stream string) error {
+	if err := checkApiSecret(apiSecret); err != nil {
+		return errors.Wrapf(err, "check api secret")
+	}
+
+	var claims jwt.RegisteredClaims
+	if _, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.Errorf("invalid signing method %v", token.Header["alg"])
+		}
+		return playbackTokenKey(apiSecret), nil
+	}); err != nil {
+		return errors.Wrapf(withClockHint(err), "verify token")
+	}
+
+	if !claims.VerifyAudience(playbackTokenAudience, true) {
+		return errors.Errorf("invalid audience %v", claims.Audience)
+	}
+	if subject := fmt.Sprintf("%v/%v", app, stream); claims.Subject != subject {
+		return errors.Errorf("token is for %v, not %v", claims.Subject, subject)
+	}
+	return nil
+}
+
+// verifyPlay verifies the playback token in param of the play request, if any. The stream without token is allowed
+// to play, as before.
+func verifyPlay(ctx context.Context, streamObj *SrsStream) error {
+	q, err := url.ParseQuery(strings.TrimPrefix(streamObj.Param, "?"))
+	if err != nil {
+		return errors.Wrapf(err, "parse param %v", streamObj.Param)
+	}
+
+	token := q.Get("token")
+	if token == "" {
+		return nil
+	}
+
+	if err := verifyPlaybackToken(envApiSecret(), token, streamObj.App, streamObj.Stream); err != nil {
+		return errors.Wrapf(err, "verify playback token of %v", streamObj.StreamURL())
+	}
+	return nil
+}
+
+// The source of frame-ancestors, for example, https://example.com or *.example.com, see
+// https://developer.mozilla.org/en-US/docs/Web/HTTP/Headers/Content-Security-Policy/frame-ancestors
+var frameAncestorSource = regexp.MustCompile(`^([a-z][a-z0-9+.-]*://)?(\*\.)?[A-Za-z0-9.-]+(:([0-9]+|\*))?$`)
+
+// embedFrameAncestors returns the sources of frame-ancestors CSP, by the allowlist of PLAYER_FRAME_ANCESTORS. The
+// invalid source is ignored, and the page could only be embedded by itself if no valid source.
+func embedFrameAncestors() string {
+	var sources []string
+	for _, source := range strings.FieldsFunc(envPlayerFrameAncestors(), func(r rune) bool {
+		return r == ' ' || r == ','
+	}) {
+		if source == "*" || source == "'self'" || source == "'none'" || frameAncestorSource.MatchString(source) {
+			sources = append(sources, source)
+		}
+	}
+
+	if len(sources) == 0 {
+		return "'self'"
+	}
+	return strings.Join(sources, " ")
+}
+
+// embedStreamName returns the stream of player page /players/{stream}, or empty if it's not the player page, for
+// example, the static files like /players/srs_player.html and /players/js/hls.min.js.
+func embedStreamName(p string) string {
+	stream := strings.TrimPrefix(p, "/players/")
+	if stream == p || stream == "" || strings.ContainsAny(stream, "/.") {
+		return ""
+	}
+	return stream
+}
+
+// withPlaybackToken appends the token to query of URL, if any.
+func withPlaybackToken(u, token string) string {
+	if u == "" || token == "" {
+		return u
+	}
+	if strings.Contains(u, "?") {
+		return fmt.Sprintf("%v&token=%v", u, url.QueryEscape(token))
+	}
+	return fmt.Sprintf("%v?token=%v", u, url.QueryEscape(token))
+}
+
+// The player page tries WebRTC first, and degrades to HLS, then HTTP-FLV. All URLs are relative to the page, so it
+// works when platform is behind a path prefix.
+var embedPlayerTemplate = template.Must(template.New("player").Parse(`<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="utf-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1">
+    <title>{{.Stream}}</title>
+    <style>
+        html, body { margin: 0; padding: 0; width: 100%; height: 100%; background: #000; overflow: hidden; }
+        video { width: 100%; height: 100%; object-fit: contain; }
+    </style>
+</head>
+<body>
+<video id="player" controls playsinline {{if .Autoplay}}autoplay muted{{end}} {{if .Poster}}poster="{{.Poster}}"{{end}}></video>
+<script src="js/adapter-7.4.0.min.js"></script>
+<script src="js/srs.sdk.js"></script>
+<script src="js/hls-1.4.14.min.js"></script>
+<script src="js/mpegts-1.7.3.min.js"></script>
+<script>
+    var urls = {{.URLs}};
+    var video = document.getElementById('player');
+
+    var playFLV = function() {
+        if (!urls.flv || !window.mpegts || !mpegts.getFeatureList().mseLivePlayback) {
+            return console.warn('No player for stream');
+        }
+        var player = mpegts.createPlayer({type: 'flv', url: urls.flv, isLive: true});
+        player.attachMediaElement(video);
+        player.load();
+    };
+
+    var playHLS = function() {
+        if (!urls.hls) return playFLV();
+        if (video.canPlayType('application/vnd.apple.mpegurl')) {
+            video.src = urls.hls;
+        } else if (window.Hls && Hls.isSupported()) {
+            var hls = new Hls();
+            hls.loadSource(urls.hls);
+            hls.attachMedia(video);
+        } else {
+            playFLV();
+        }
+    };
+
+    var playWHEP = function() {
+        var sdk = new SrsRtcWhipWhepAsync();
+        video.srcObject = sdk.stream;
+        sdk.play(urls.whep).catch(function(reason) {
+            console.warn('Degrade to HLS, WebRTC failed', reason);
+            sdk.close();
+            video.srcObject = null;
+            playHLS();
+        });
+    };
+
+    if (urls.whep && window.RTCPeerConnection && window.SrsRtcWhipWhepAsync) {
+        playWHEP();
+    } else {
+        playHLS();
+    }
+</script>
+</body>
+</html>
+`))
+
+// serveEmbedPlayer serves the player page /players/{stream}?app=live&token=xxx&autoplay=1&poster=xxx, returns false if
+// it's not the player page.
+func serveEmbedPlayer(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	stream := embedStreamName(r.URL.Path)
+	if stream == "" {
+		return false
+	}
+
+	w.Header().Set("Content-Security-Policy", fmt.Sprintf("frame-ancestors %v", embedFrameAncestors()))
+	w.Header().Set("Cache-Control", "no-cache, max-age=0")
+
+	if err := func() error {
+		q := r.URL.Query()
+		app, token := q.Get("app"), q.Get("token")
+		if app == "" {
+			app = "live"
+		}
+
+		// Reject the invalid token, rather than failing in player, because the token is expired typically.
+		if token != "" {
+			if err := verifyPlaybackToken(envApiSecret(), token, app, stream); err != nil {
+				return newHttpStatusError(http.StatusForbidden, errors.Wrapf(err, "verify playback token"))
+			}
+		}
+
+		endpoints, err := queryPlaybackEndpoints(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "query playback")
+		}
+
+		// Use the URLs relative to /players/ if no base URL, for the path prefix.
+		for _, ep := range []*PlaybackEndpoint{&endpoints.HLS, &endpoints.FLV, &endpoints.WHEP} {
+			if ep.Base == "" {
+				ep.Base = ".."
+			}
+		}
+		urls := endpoints.URLs(app, stream)
+		urls.HLS, urls.FLV = withPlaybackToken(urls.HLS, token), withPlaybackToken(urls.FLV, token)
+		urls.WHEP = withPlaybackToken(urls.WHEP, token)
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := embedPlayerTemplate.Execute(w, &struct {
+			Stream   string
+			Autoplay bool
+			Poster   string
+			URLs     *PlaybackURLs
+		}{
+			Stream: stream, Autoplay: q.Get("autoplay") == "1" || q.Get("autoplay") == "true",
+			Poster: q.Get("poster"), URLs: urls,
+		}); err != nil {
+			return errors.Wrapf(err, "render player")
+		}
+
+		logger.Tf(ctx, "embed: serve player ok, app=%v, stream=%v, token=%vB", app, stream, len(token))
+		return nil
+	}(); err != nil {
+		httpWriteError(ctx, w, r, err)
+	}
+	return true
+}
+
+// EmbedCode is the code to embed the player page into other sites.
+type EmbedCode struct {
+	// The URL of player page.
+	URL string `json:"url"`
+	// The iframe code to paste into the site.
+	Code string `json:"code"`
+	// The expire time of token in RFC3339, empty if not signed.
+	ExpireAt string `json:"expireAt,omitempty"`
+}
+
+// The path prefix of proxy, for example, /oryx or /ops/oryx, see embedBaseURL.
+var embedPrefixRegex = regexp.MustCompile(`^(/[A-Za-z0-9._~-]+)+$`)
+
+// embedBaseURL returns the base URL of platform, by the request and the configured base path, with the path prefix
+// of proxy only if the peer is a trusted proxy, because the X-Forwarded-Prefix is easy to spoof.
+func embedBaseURL(r *http.Request) string {
+	return resolveEmbedBaseURL(r, trustedProxies)
+}
+
+func resolveEmbedBaseURL(r *http.Request, proxies []*net.IPNet) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	var prefix string
+	if isTrustedProxy(r, proxies) {
+		if proto := r.Header.Get("X-Forwarded-Proto"); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+
+		// Ignore the prefix which is not a clean absolute path, for example, with the query or another host.
+		if v := strings.TrimSuffix(r.Header.Get("X-Forwarded-Prefix"), "/"); embedPrefixRegex.MatchString(v) &&
+			path.Clean(v) == v {
+			prefix = v
+		}
+	}
+
+	return fmt.Sprintf("%v://%v%v%v", scheme, r.Host, prefix, platformBasePath())
+}
+
+func handleMgmtEmbed(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/embed"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, base, app, stream, poster string
+			var expire, width, height int
+			var autoplay bool
+			if err := ParseBody(ctx, r, &struct {
+				Token    *string `json:"token"`
+				Base     *string `json:"base"`
+				App      *string `json:"app"`
+				Stream   *string `json:"stream"`
+				Expire   *int    `json:"expire"`
+				Autoplay *bool   `json:"autoplay"`
+				Poster   *string `json:"poster"`
+				Width    *int    `json:"width"`
+				Height   *int    `json:"height"`
+			}{
+				Token: &token, Base: &base, App: &app, Stream: &stream, Expire: &expire, Autoplay: &autoplay,
+				Poster: &poster, Width: &width, Height: &height,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if app == "" {
+				app = "live"
+			}
+			if embedStreamName(fmt.Sprintf("/players/%v", stream)) == "" || strings.ContainsAny(app, "/?&#") {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid app=%v, stream=%v", app, stream))
+			}
+			if expire < 0 || time.Duration(expire)*time.Second > playbackTokenMaxExpire {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid expire %v, should in [0, %v]",
+					expire, int(playbackTokenMaxExpire/time.Second)))
+			}
+			if width < 0 || height < 0 {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid size %vx%v", width, height))
+			}
+			if poster != "" {
+				if u, err := url.Parse(poster); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+					return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid poster %v", poster))
+				}
+			}
+
+			// Use the base URL of request, if not specified.
+			if base = strings.TrimSuffix(base, "/"); base == "" {
+				base = embedBaseURL(r)
+			}
+			if u, err := url.Parse(base); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+				u.RawQuery != "" || u.Fragment != "" {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid base %v", base))
+			}
+
+			q := url.Values{}
+			if app != "live" {
+				q.Set("app", app)
+			}
+			if autoplay {
+				q.Set("autoplay", "1")
+			}
+			if poster != "" {
+				q.Set("poster", poster)
+			}
+
+			var code EmbedCode
+			if expire > 0 {
+				expireAt := time.Now().Add(time.Duration(expire) * time.Second)
+				playToken, err := createPlaybackToken(apiSecret, app, stream, expireAt)
+				if err != nil {
+					return errors.Wrapf(err, "create playback token")
+				}
+				q.Set("token", playToken)
+				code.ExpireAt = expireAt.Format(time.RFC3339)
+			}
+
+			code.URL = fmt.Sprintf("%v/players/%v", base, url.PathEscape(stream))
+			if len(q) > 0 {
+				code.URL = fmt.Sprintf("%v?%v", code.URL, q.Encode())
+			}
+
+			if width == 0 {
+				width = embedDefaultWidth
+			}
+			if height == 0 {
+				height = embedDefaultHeight
+			}
+			code.Code = fmt.Sprintf(`<iframe src="%v" width="%v" height="%v" frameborder="0" allow="autoplay; fullscreen" allowfullscreen></iframe>`,
+				template.HTMLEscapeString(code.URL), width, height)
+
+			httpWriteData(ctx, w, r, &code)
+			logger.Tf(ctx, "embed: create ok, app=%v, stream=%v, expire=%v, autoplay=%v, base=%v, token=%vB",
+				app, stream, expire, autoplay, base, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,247 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	"github.com/joho/godotenv"
+)
+
+// The number of backups of .env file, the latest is .env.bak, then .env.bak.1 and so on.
+const envFileBackups = 3
+
+// The keys which must not be lost or cleared once exists, or the stack is unable to boot.
+var envFileMandatoryKeys = []string{
+	"SRS_PLATFORM_SECRET", "MGMT_PASSWORD", "CLOUD", "REGION", "SOURCE", "REGISTRY",
+}
+
+// For test only, to simulate crash after the temporary file is written and before rename.
+var envFileBeforeRename func() error
+
+// The lock for writing .env file, because it's read-modify-write.
+var envFileLock sync.Mutex
+
+// envFilePath returns the path of .env file.
+func envFilePath() string {
+	return path.Join(conf.Pwd, "containers/data/config/.env")
+}
+
+// envFileBackup returns the path of the index backup file.
+func envFileBackup(envFile string, index int) string {
+	if index == 0 {
+		return fmt.Sprintf("%v.bak", envFile)
+	}
+	return fmt.Sprintf("%v.bak.%v", envFile, index)
+}
+
+// updateEnvFile read the .env file if exists, update it by pfn, and write it by writeEnvFile.
+func updateEnvFile(ctx context.Context, envFile string, pfn func(envs map[string]string)) error {
+	envFileLock.Lock()
+	defer envFileLock.Unlock()
+
+	envs := map[string]string{}
+	if _, err := os.Stat(envFile); err == nil {
+		if envs, err = godotenv.Read(envFile); err != nil {
+			return errors.Wrapf(err, "load envs from %v", envFile)
+		}
+	} else if err := os.MkdirAll(path.Dir(envFile), 0755); err != nil {
+		return errors.Wrapf(err, "create dir %v", path.Dir(envFile))
+	}
+
+	pfn(envs)
+	return writeEnvFile(ctx, envFile, envs)
+}
+
+// writeEnvFile is the only way to write the .env file. It writes to a temporary file, validates it, keeps the previous
+// version as backup, then renames it atomically, so the .env file is always valid even if crash.
+func writeEnvFile(ctx context.Context, envFile string, envs map[string]string) error {
+	var previous map[string]string
+	if _, err := os.Stat(envFile); err == nil {
+		if previous, err = godotenv.Read(envFile); err != nil {
+			logger.Wf(ctx, "env ignore invalid previous %v, err %+v", envFile, err)
+		}
+	}
+
+	content, err := godotenv.Marshal(envs)
+	if err != nil {
+		return errors.Wrapf(err, "marshal envs")
+	}
+
+	if err := validateEnvFile(content, previous); err != nil {
+		return errors.Wrapf(err, "validate")
+	}
+
+	// Never leave the temporary file if failed, because it contains the secrets.
+	tmpFile := fmt.Sprintf("%v.tmp", envFile)
+	if err := replaceEnvFile(envFile, tmpFile, content, envs, previous != nil); err != nil {
+		if r0 := os.Remove(tmpFile); r0 != nil && !os.IsNotExist(r0) {
+			logger.Wf(ctx, "env ignore remove %v err %+v", tmpFile, r0)
+		}
+		return errors.Wrapf(err, "replace %v", envFile)
+	}
+
+	logger.Tf(ctx, "env write %v ok, envs=%v", envFile, len(envs))
+	return nil
+}
+
+// replaceEnvFile writes the content to tmpFile, verifies it's the same as envs, backup the envFile if exists, then
+// renames the tmpFile to envFile.
+func replaceEnvFile(envFile, tmpFile, content string, envs map[string]string, backup bool) error {
+	if err := func() error {
+		f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+		if err != nil {
+			return errors.Wrapf(err, "open %v", tmpFile)
+		}
+		defer f.Close()
+
+		if _, err := f.WriteString(content + "\n"); err != nil {
+			return errors.Wrapf(err, "write %v", tmpFile)
+		}
+		if err := f.Sync(); err != nil {
+			return errors.Wrapf(err, "sync %v", tmpFile)
+		}
+		return nil
+	}(); err != nil {
+		return errors.Wrapf(err, "write temporary file")
+	}
+
+	// Validate the written file, to make sure it's the same as what we write. Never show the value, which might be
+	// secret.
+	written, err := godotenv.Read(tmpFile)
+	if err != nil {
+		return errors.Wrapf(err, "read %v", tmpFile)
+	} else if len(written) != len(envs) {
+		return errors.Errorf("written %v envs, expect %v", len(written), len(envs))
+	}
+	for k, v := range envs {
+		if value, ok := written[k]; !ok || value != v {
+			return errors.Errorf("written %v is %vB, expect %vB", k, len(value), len(v))
+		}
+	}
+
+	if envFileBeforeRename != nil {
+		if err := envFileBeforeRename(); err != nil {
+			return errors.Wrapf(err, "before rename")
+		}
+	}
+
+	if backup {
+		if err := rotateEnvFileBackups(envFile); err != nil {
+			return errors.Wrapf(err, "backup")
+		}
+	}
+
+	if err := os.Rename(tmpFile, envFile); err != nil {
+		return errors.Wrapf(err, "rename %v to %v", tmpFile, envFile)
+	}
+	return nil
+}
+
+// validateEnvFile verify the content is parsed, and never lose or clear the mandatory keys of the previous one.
+func validateEnvFile(content string, previous map[string]string) error {
+	envs, err := godotenv.Unmarshal(content)
+	if err != nil {
+		return errors.Wrapf(err, "parse")
+	}
+
+	for _, key := range envFileMandatoryKeys {
+		if previous[key] != "" && envs[key] == "" {
+			return errors.Errorf("mandatory %v is lost", key)
+		}
+	}
+	return nil
+}
+
+// rotateEnvFileBackups copy the .env to .env.bak, and rotate the previous backups.
+func rotateEnvFileBackups(envFile string) error {
+	for i := envFileBackups - 1; i > 0; i-- {
+		if _, err := os.Stat(envFileBackup(envFile, i-1)); err != nil {
+			continue
+		}
+		if err := os.Rename(envFileBackup(envFile, i-1), envFileBackup(envFile, i)); err != nil {
+			return errors.Wrapf(err, "rename %v", envFileBackup(envFile, i-1))
+		}
+	}
+
+	b, err := os.ReadFile(envFile)
+	if err != nil {
+		return errors.Wrapf(err, "read %v", envFile)
+	}
+	if err := os.WriteFile(envFileBackup(envFile, 0), b, 0644); err != nil {
+		return errors.Wrapf(err, "write %v", envFileBackup(envFile, 0))
+	}
+	return nil
+}
+
+// restoreEnvFile rolls back the .env file to the latest backup. Note that the current .env file is also backup, so the
+// restore is able to be undone.
+func restoreEnvFile(ctx context.Context, envFile string) error {
+	envFileLock.Lock()
+	defer envFileLock.Unlock()
+
+	backup := envFileBackup(envFile, 0)
+	if _, err := os.Stat(backup); err != nil {
+		return errors.Wrapf(err, "no backup %v", backup)
+	}
+
+	envs, err := godotenv.Read(backup)
+	if err != nil {
+		return errors.Wrapf(err, "read %v", backup)
+	}
+
+	if err := writeEnvFile(ctx, envFile, envs); err != nil {
+		return errors.Wrapf(err, "write %v", envFile)
+	}
+	return nil
+}
+
+func handleMgmtEnvsRestore(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/envs/restore"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			envFile := envFilePath()
+			if err := restoreEnvFile(ctx, envFile); err != nil {
+				return errors.Wrapf(err, "restore %v", envFile)
+			}
+
+			if err := godotenv.Overload(envFile); err != nil {
+				return errors.Wrapf(err, "load %v", envFile)
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "env restore ok, file=%v, token=%vB", envFile, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
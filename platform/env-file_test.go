@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/joho/godotenv"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestEnvFile_CrashBeforeRename(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	pwd, err := ioutil.TempDir("", "oryx-env-")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(pwd)
+	envFile := path.Join(pwd, ".env")
+
+	if err := updateEnvFile(ctx, envFile, func(envs map[string]string) {
+		envs["SRS_PLATFORM_SECRET"], envs["CLOUD"] = "secret", "DOCKER"
+	}); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+
+	// Crash after the temporary file is written, the .env should be the previous one.
+	envFileBeforeRename = func() error {
+		return errors.New("crash")
+	}
+	err = updateEnvFile(ctx, envFile, func(envs map[string]string) {
+		envs["CLOUD"] = "TENCENT"
+	})
+	envFileBeforeRename = nil
+	if err == nil {
+		t.Errorf("Fail for no crash")
+	}
+	if envs, err := godotenv.Read(envFile); err != nil || envs["CLOUD"] != "DOCKER" || envs["SRS_PLATFORM_SECRET"] != "secret" {
+		t.Errorf("Fail for envs %v, err %+v", envs, err)
+	}
+
+	// Recover from crash, the temporary file is overwritten.
+	if err := updateEnvFile(ctx, envFile, func(envs map[string]string) {
+		envs["CLOUD"] = "TENCENT"
+	}); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if envs, err := godotenv.Read(envFile); err != nil || envs["CLOUD"] != "TENCENT" {
+		t.Errorf("Fail for envs %v, err %+v", envs, err)
+	}
+	if envs, err := godotenv.Read(envFile + ".bak"); err != nil || envs["CLOUD"] != "DOCKER" {
+		t.Errorf("Fail for backup %v, err %+v", envs, err)
+	}
+}
+
+func TestEnvFile_RejectLostMandatoryKeys(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	pwd, err := ioutil.TempDir("", "oryx-env-")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(pwd)
+	envFile := path.Join(pwd, ".env")
+
+	if err := writeEnvFile(ctx, envFile, map[string]string{"SRS_PLATFORM_SECRET": "secret", "MGMT_PASSWORD": "pwd"}); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if err := writeEnvFile(ctx, envFile, map[string]string{"SRS_PLATFORM_SECRET": "secret"}); err == nil {
+		t.Errorf("Fail for lost MGMT_PASSWORD")
+	}
+	if envs, err := godotenv.Read(envFile); err != nil || envs["MGMT_PASSWORD"] != "pwd" {
+		t.Errorf("Fail for envs %v, err %+v", envs, err)
+	}
+}
+
+func TestEnvFile_RestoreAndRotate(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	pwd, err := ioutil.TempDir("", "oryx-env-")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(pwd)
+	envFile := path.Join(pwd, ".env")
+
+	for _, region := range []string{"r0", "r1", "r2", "r3", "r4"} {
+		if err := updateEnvFile(ctx, envFile, func(envs map[string]string) {
+			envs["REGION"] = region
+		}); err != nil {
+			t.Errorf("Fail for err %+v", err)
+		}
+	}
+
+	for i, expect := range []string{"r3", "r2", "r1"} {
+		if envs, err := godotenv.Read(envFileBackup(envFile, i)); err != nil || envs["REGION"] != expect {
+			t.Errorf("Fail for backup %v, envs %v, err %+v", i, envs, err)
+		}
+	}
+	if _, err := os.Stat(envFileBackup(envFile, envFileBackups)); err == nil {
+		t.Errorf("Fail for too many backups")
+	}
+
+	// Restore to the previous one, and able to undo it.
+	if err := restoreEnvFile(ctx, envFile); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if envs, err := godotenv.Read(envFile); err != nil || envs["REGION"] != "r3" {
+		t.Errorf("Fail for envs %v, err %+v", envs, err)
+	}
+	if err := restoreEnvFile(ctx, envFile); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if envs, err := godotenv.Read(envFile); err != nil || envs["REGION"] != "r4" {
+		t.Errorf("Fail for envs %v, err %+v", envs, err)
+	}
+}
+
+func TestEnvFile_SpecialCharsAndNoTemporaryFile(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	pwd, err := ioutil.TempDir("", "oryx-env-")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(pwd)
+	envFile := path.Join(pwd, ".env")
+
+	// The values read back must be the same as written, for the special chars of shell and escape.
+	for _, password := range []string{`pa$$word`, `$HOME`, `${SRS_PLATFORM_SECRET}`, `back\slash\`, `\n\t`, `q"u'o` + "`te"} {
+		if err := writeEnvFile(ctx, envFile, map[string]string{"SRS_PLATFORM_SECRET": "secret", "MGMT_PASSWORD": password}); err != nil {
+			t.Errorf("Fail for %q, err %+v", password, err)
+		} else if envs, err := godotenv.Read(envFile); err != nil || envs["MGMT_PASSWORD"] != password {
+			t.Errorf("Fail for %q, envs %v, err %+v", password, envs, err)
+		}
+	}
+
+	// Never leave the temporary file, which contains the secrets, if failed.
+	envFileBeforeRename = func() error {
+		return errors.New("crash")
+	}
+	err = writeEnvFile(ctx, envFile, map[string]string{"SRS_PLATFORM_SECRET": "secret", "MGMT_PASSWORD": "new"})
+	envFileBeforeRename = nil
+	if err == nil {
+		t.Errorf("Fail for no crash")
+	}
+	if _, err := os.Stat(envFile + ".tmp"); err == nil {
+		t.Errorf("Fail for temporary file exists")
+	}
+	if envs, err := godotenv.Read(envFile); err != nil || envs["MGMT_PASSWORD"] != `q"u'o`+"`te" {
+		t.Errorf("Fail for envs %v, err %+v", envs, err)
+	}
+}
@@ -0,0 +1,523 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The max length of event stream, the oldest events are trimmed, so a sink which falls too far behind loses events,
+// rather than the stream grows unbounded.
+const eventBusMaxLen = 10000
+
+// The recent events to replay for a new sink, which subscribes later than the events.
+const eventBusReplay = 10 * time.Minute
+
+// The max number of events to read for each batch, and the time to block if no event.
+const (
+	eventBusBatch = 100
+	eventBusBlock = 3 * time.Second
+)
+
+// The interval to retry when sink fails, and the max attempts before dropping the event.
+const (
+	eventBusRetryInterval = 3 * time.Second
+	eventBusMaxAttempts   = 5
+)
+
+// The consumer name of this replica in the group of sink. Use the hostname, which is stable when restart, so the
+// pending events are delivered again.
+var eventBusConsumer = func() string {
+	if hostname, _ := os.Hostname(); hostname != "" {
+		return hostname
+	}
+	return "platform"
+}()
+
+var eventBus = NewEventBus()
+
+// EventType is the type of event on bus.
+type EventType string
+
+const (
+	EventStreamPublish   EventType = "stream.publish"
+	EventStreamUnpublish EventType = "stream.unpublish"
+	EventUpgradeFailed   EventType = "upgrade.failed"
+	EventCertRenewed     EventType = "cert.renewed"
+	EventDiskWarning     EventType = "disk.warning"
+	EventTaskFailed      EventType = "task.failed"
+	EventAlertFiring     EventType = "alert.firing"
+	EventAlertResolved   EventType = "alert.resolved"
+)
+
+// EventData is the typed data of event.
+type EventData interface {
+	EventType() EventType
+}
+
+// StreamPublishEvent is the event when a stream publishes.
+type StreamPublishEvent struct {
+	Vhost  string `json:"vhost"`
+	App    string `json:"app"`
+	Stream string `json:"stream"`
+	Client string `json:"client"`
+}
+
+func (v *StreamPublishEvent) EventType() EventType {
+	return EventStreamPublish
+}
+
+// StreamUnpublishEvent is the event when a stream unpublishes.
+type StreamUnpublishEvent StreamPublishEvent
+
+func (v *StreamUnpublishEvent) EventType() EventType {
+	return EventStreamUnpublish
+}
+
+// UpgradeFailedEvent is the event when failed to start the upgrade.
+type UpgradeFailedEvent struct {
+	Version string `json:"version"`
+	Error   string `json:"error"`
+}
+
+func (v *UpgradeFailedEvent) EventType() EventType {
+	return EventUpgradeFailed
+}
+
+// CertRenewedEvent is the event when the certificate is renewed, by Let's Encrypt or certbot.
+type CertRenewedEvent struct {
+	Provider string `json:"provider"`
+	Domain   string `json:"domain"`
+}
+
+func (v *CertRenewedEvent) EventType() EventType {
+	return EventCertRenewed
+}
+
+// DiskWarningEvent is the event when the disk is not writable or full.
+type DiskWarningEvent struct {
+	Path    string `json:"path"`
+	Message string `json:"message"`
+}
+
+func (v *DiskWarningEvent) EventType() EventType {
+	return EventDiskWarning
+}
+
+// TaskFailedEvent is the event when a task such as forwarding fails, see TaskEventFailed.
+type TaskFailedEvent struct {
+	Worker   string `json:"worker"`
+	Task     string `json:"task"`
+	Platform string `json:"platform"`
+	Message  string `json:"message"`
+}
+
+func (v *TaskFailedEvent) EventType() EventType {
+	return EventTaskFailed
+}
+
+// AlertFiringEvent is the event when an alert starts firing, see Alert.
+type AlertFiringEvent Alert
+
+func (v *AlertFiringEvent) EventType() EventType {
+	return EventAlertFiring
+}
+
+// AlertResolvedEvent is the event when the condition of alert resolves.
+type AlertResolvedEvent Alert
+
+func (v *AlertResolvedEvent) EventType() EventType {
+	return EventAlertResolved
+}
+
+// BusEvent is the event on bus.
+type BusEvent struct {
+	// The ID in redis stream, for example, 1700000000000-0.
+	ID string `json:"id"`
+	// The type and time of event.
+	Type EventType `json:"type"`
+	Time string    `json:"time"`
+	// The typed data of event, see EventData.
+	Data json.RawMessage `json:"data"`
+}
+
+func (v *BusEvent) String() string {
+	return fmt.Sprintf("id=%v, type=%v, time=%v, data=%vB", v.ID, v.Type, v.Time, len(v.Data))
+}
+
+func parseBusEvent(msg *redis.XMessage) *BusEvent {
+	event := &BusEvent{ID: msg.ID}
+	if value, ok := msg.Values["type"].(string); ok {
+		event.Type = EventType(value)
+	}
+	if value, ok := msg.Values["time"].(string); ok {
+		event.Time = value
+	}
+	if value, ok := msg.Values["data"].(string); ok {
+		event.Data = json.RawMessage(value)
+	}
+	return event
+}
+
+// publishEvent adds the event to bus. It never fails, because the event is only to notify the sinks, and should never
+// break the hooks or workers.
+func publishEvent(ctx context.Context, data EventData) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		logger.Wf(ctx, "event: ignore marshal %v err %+v", data.EventType(), err)
+		return
+	}
+
+	if err := rdb.XAdd(ctx, &redis.XAddArgs{
+		Stream: SRS_EVENT_BUS, MaxLen: eventBusMaxLen, Approx: true, Values: []string{
+			"type", string(data.EventType()), "time", time.Now().Format(time.RFC3339), "data", string(b),
+		},
+	}).Err(); err != nil {
+		logger.Wf(ctx, "event: ignore publish %v %s err %+v", data.EventType(), b, err)
+	}
+
+	// Notify the clients of event stream on this replica, which never blocks.
+	eventBusStream.Publish(ctx, string(data.EventType()), data, false)
+}
+
+// EventSink consumes the events in a consumer group, so each sink tracks its own offset.
+type EventSink struct {
+	// The name of sink, also the name of consumer group.
+	Name string
+	// The handler of event, the event is delivered again if failed.
+	Handler func(ctx context.Context, event *BusEvent) error
+	// The attempts of failed events, key is the event ID.
+	attempts map[string]int
+	// Whether the consumer group is created.
+	created bool
+}
+
+// EventBus is the durable fan-out of events to sinks, by redis stream and consumer groups. The events are shared by
+// all platform replicas, and each event is delivered once to each sink.
+type EventBus struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The sinks subscribed, before Start.
+	sinks []*EventSink
+	lock  sync.Mutex
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{}
+}
+
+// Subscribe adds a sink, which is started by Start. A new sink replays the events in eventBusReplay.
+func (v *EventBus) Subscribe(name string, handler func(ctx context.Context, event *BusEvent) error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.sinks = append(v.sinks, &EventSink{Name: name, Handler: handler, attempts: make(map[string]int)})
+}
+
+func (v *EventBus) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *EventBus) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "event: start bus, sinks=%v, consumer=%v", len(v.sinks), eventBusConsumer)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, sink := range v.sinks {
+		sink := sink
+
+		v.wg.Add(1)
+		go func() {
+			defer v.wg.Done()
+
+			safeRestart(ctx, func() {
+				// Deliver the pending events first, which are read but not acknowledged, for example, the platform
+				// restarts or the sink fails.
+				id := "0"
+				for ctx.Err() == nil {
+					next, err := v.consume(ctx, sink, id)
+					if err != nil {
+						logger.Wf(ctx, "event: ignore sink %v err %+v", sink.Name, err)
+
+						select {
+						case <-ctx.Done():
+						case <-time.After(eventBusRetryInterval):
+						}
+					}
+					id = next
+				}
+			})
+		}()
+	}
+
+	return nil
+}
+
+// createGroup creates the consumer group of sink, to replay the recent events in eventBusReplay.
+func (v *EventBus) createGroup(ctx context.Context, sink *EventSink) error {
+	start := fmt.Sprintf("%v-0", time.Now().Add(-eventBusReplay).UnixNano()/int64(time.Millisecond))
+	if err := rdb.XGroupCreateMkStream(ctx, SRS_EVENT_BUS, sink.Name, start).Err(); err != nil {
+		if strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return nil
+		}
+		return errors.Wrapf(err, "xgroup create %v %v %v", SRS_EVENT_BUS, sink.Name, start)
+	}
+	logger.Tf(ctx, "event: create group %v from %v", sink.Name, start)
+	return nil
+}
+
+// consume reads a batch of events from id, 0 for the pending events and > for the new events, and returns the id to
+// read the next batch. The event is acknowledged if sink handles it, or drops after eventBusMaxAttempts.
+func (v *EventBus) consume(ctx context.Context, sink *EventSink, id string) (string, error) {
+	if !sink.created {
+		if err := v.createGroup(ctx, sink); err != nil {
+			return id, errors.Wrapf(err, "create group")
+		}
+		sink.created = true
+	}
+
+	streams, err := rdb.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group: sink.Name, Consumer: eventBusConsumer, Streams: []string{SRS_EVENT_BUS, id},
+		Count: eventBusBatch, Block: eventBusBlock,
+	}).Result()
+	if err == redis.Nil {
+		return ">", nil
+	} else if err != nil {
+		// The group is removed with the stream, for example, redis is flushed.
+		if strings.HasPrefix(err.Error(), "NOGROUP") {
+			sink.created = false
+		}
+		return id, errors.Wrapf(err, "xreadgroup %v %v %v", SRS_EVENT_BUS, sink.Name, id)
+	}
+
+	var messages []redis.XMessage
+	for _, stream := range streams {
+		messages = append(messages, stream.Messages...)
+	}
+	// No pending events, read the new events.
+	if len(messages) == 0 {
+		return ">", nil
+	}
+
+	for _, msg := range messages {
+		event := parseBusEvent(&msg)
+		if err := sink.Handler(ctx, event); err != nil {
+			if sink.attempts[event.ID]++; sink.attempts[event.ID] < eventBusMaxAttempts {
+				return "0", errors.Wrapf(err, "handle %v, attempts=%v", event.String(), sink.attempts[event.ID])
+			}
+			logger.Wf(ctx, "event: sink %v drop %v for attempts=%v, err %+v",
+				sink.Name, event.String(), sink.attempts[event.ID], err)
+		}
+
+		delete(sink.attempts, event.ID)
+		if err := rdb.XAck(ctx, SRS_EVENT_BUS, sink.Name, event.ID).Err(); err != nil {
+			return "0", errors.Wrapf(err, "xack %v %v %v", SRS_EVENT_BUS, sink.Name, event.ID)
+		}
+	}
+
+	return id, nil
+}
+
+// subscribeEventSinks subscribes the builtin sinks of events.
+func subscribeEventSinks(bus *EventBus) {
+	// The webhook sink, notify by the on_event callback.
+	bus.Subscribe("webhook", func(ctx context.Context, event *BusEvent) error {
+		if callbackWorker == nil {
+			return nil
+		}
+		return callbackWorker.OnEventMessage(ctx, SrsActionOnEvent, event)
+	})
+
+	// The audit sink, write the events to log.
+	bus.Subscribe("audit", func(ctx context.Context, event *BusEvent) error {
+		logger.Tf(ctx, "event: audit %v, %s", event.String(), event.Data)
+		return nil
+	})
+}
+
+// EventBusGroup is the state of a sink.
+type EventBusGroup struct {
+	// The name of sink.
+	Name string `json:"name"`
+	// The number of events read but not acknowledged.
+	Pending int64 `json:"pending"`
+	// The last event ID delivered to the sink.
+	LastDeliveredID string `json:"lastDeliveredId"`
+}
+
+// queryEventBusGroups returns the state of sinks. Note that we parse the XINFO GROUPS by ourselves, because the reply
+// has more fields in newer redis.
+func queryEventBusGroups(ctx context.Context) ([]*EventBusGroup, error) {
+	res, err := rdb.Do(ctx, "xinfo", "groups", SRS_EVENT_BUS).Result()
+	if err != nil && err != redis.Nil {
+		if strings.Contains(err.Error(), "no such key") {
+			return []*EventBusGroup{}, nil
+		}
+		return nil, errors.Wrapf(err, "xinfo groups %v", SRS_EVENT_BUS)
+	}
+
+	groups := []*EventBusGroup{}
+	values, _ := res.([]interface{})
+	for _, value := range values {
+		fields, _ := value.([]interface{})
+
+		group := &EventBusGroup{}
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch key, _ := fields[i].(string); key {
+			case "name":
+				group.Name = fmt.Sprintf("%v", fields[i+1])
+			case "pending":
+				group.Pending, _ = fields[i+1].(int64)
+			case "last-delivered-id":
+				group.LastDeliveredID = fmt.Sprintf("%v", fields[i+1])
+			}
+		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// queryRecentEvents returns the recent events of each type, the latest first, at most max for each type.
+func queryRecentEvents(ctx context.Context, eventType EventType, max int) (map[EventType][]*BusEvent, error) {
+	messages, err := rdb.XRevRangeN(ctx, SRS_EVENT_BUS, "+", "-", eventBusMaxLen).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "xrevrange %v", SRS_EVENT_BUS)
+	}
+
+	events := make(map[EventType][]*BusEvent)
+	for _, msg := range messages {
+		event := parseBusEvent(&msg)
+		if eventType != "" && event.Type != eventType {
+			continue
+		}
+		if len(events[event.Type]) < max {
+			events[event.Type] = append(events[event.Type], event)
+		}
+	}
+	return events, nil
+}
+
+// OnEventMessage notifies the event on bus, which is the webhook sink of event bus.
+func (v *CallbackWorker) OnEventMessage(ctx context.Context, action SrsAction, event *BusEvent) error {
+	if action != SrsActionOnEvent {
+		return nil
+	}
+
+	var config CallbackConfig
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		config = v.ephemeralConfig
+	}()
+
+	if !config.All || config.Target == "" {
+		return nil
+	}
+
+	req := &struct {
+		RequestID string `json:"request_id"`
+		// The callback parameters.
+		Action string `json:"action"`
+		Opaque string `json:"opaque"`
+		// The event on bus, for example, the certificate is renewed.
+		Event *BusEvent `json:"event"`
+	}{
+		RequestID: uuid.NewString(),
+		// The callback parameters.
+		Action: string(action),
+		Opaque: config.Opaque,
+		// The bus event.
+		Event: event,
+	}
+
+	if err := postCallback(ctx, &config, req); err != nil {
+		return errors.Wrapf(err, "callback with conf %v, req %v", config.String(), req)
+	}
+	return nil
+}
+
+// handleMgmtEventBus is for debugging, list the recent events of each type and the state of sinks.
+func handleMgmtEventBus(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/events/recent"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, eventType string
+			var limit int
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				Type  *string `json:"type"`
+				Limit *int    `json:"limit"`
+			}{
+				Token: &token, Type: &eventType, Limit: &limit,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if limit <= 0 {
+				limit = 10
+			}
+
+			length, err := rdb.XLen(ctx, SRS_EVENT_BUS).Result()
+			if err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "xlen %v", SRS_EVENT_BUS)
+			}
+
+			groups, err := queryEventBusGroups(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query groups")
+			}
+
+			events, err := queryRecentEvents(ctx, EventType(eventType), limit)
+			if err != nil {
+				return errors.Wrapf(err, "query events")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Length int64                     `json:"length"`
+				Groups []*EventBusGroup          `json:"groups"`
+				Events map[EventType][]*BusEvent `json:"events"`
+			}{
+				Length: length, Groups: groups, Events: events,
+			})
+			logger.Tf(ctx, "event bus recent ok, type=%v, length=%v, groups=%v, types=%v, token=%vB",
+				eventType, length, len(groups), len(events), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,363 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+const (
+	// The capacity of ring buffer of each subscriber, the oldest events are dropped if the client is slow.
+	eventStreamRingSize = 64
+	// The deadline to write the events to client, the client is evicted if exceeded.
+	eventStreamWriteTimeout = 10 * time.Second
+	// The interval of heartbeat, to keep the connection alive through proxies.
+	eventStreamHeartbeat = 15 * time.Second
+)
+
+// The connection class of event stream, for the metrics of dropped events.
+const eventStreamClassSSE = "sse"
+
+// The broadcasters of event stream, the progress of upgrade, the events on bus published by this replica, and the
+// health of streams evaluated by this replica.
+var upgradeProgress = NewEventBroadcaster("upgrade")
+var eventBusStream = NewEventBroadcaster("events")
+var streamHealthStream = NewEventBroadcaster("health")
+
+// StreamEvent is an event sent to the subscribers of a broadcaster.
+type StreamEvent struct {
+	// The sequence of event in broadcaster, the gap means the events are dropped for the slow client.
+	ID uint64 `json:"id"`
+	// The type and data of event.
+	Type string          `json:"type"`
+	Data json.RawMessage `json:"data"`
+	// Whether the event is the terminal state, the stream ends after it.
+	Terminal bool `json:"terminal,omitempty"`
+}
+
+func (v *StreamEvent) String() string {
+	return fmt.Sprintf("id=%v, type=%v, data=%vB, terminal=%v", v.ID, v.Type, len(v.Data), v.Terminal)
+}
+
+// EventSubscriber buffers the events for a client in a ring, and drops the oldest one if full, so the producer never
+// blocks on a slow client, and the memory is bounded.
+type EventSubscriber struct {
+	// The connection class and topic, for metrics.
+	class, topic string
+	// Notify the writer that there are events, never block.
+	notify chan struct{}
+
+	// The ring of events, and the number of dropped events.
+	ring    []*StreamEvent
+	head    int
+	size    int
+	dropped int64
+	lock    sync.Mutex
+}
+
+func newEventSubscriber(class, topic string, size int) *EventSubscriber {
+	return &EventSubscriber{
+		class: class, topic: topic, notify: make(chan struct{}, 1), ring: make([]*StreamEvent, size),
+	}
+}
+
+func (v *EventSubscriber) push(event *StreamEvent) {
+	v.lock.Lock()
+	if v.size == len(v.ring) {
+		v.head, v.size = (v.head+1)%len(v.ring), v.size-1
+		v.dropped++
+		eventStreamMetrics.onDropped(v.class, v.topic)
+	}
+	v.ring[(v.head+v.size)%len(v.ring)] = event
+	v.size++
+	v.lock.Unlock()
+
+	select {
+	case v.notify <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the buffered events in order, and the number of events dropped since last pop.
+func (v *EventSubscriber) pop() ([]*StreamEvent, int64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	events := make([]*StreamEvent, 0, v.size)
+	for ; v.size > 0; v.size-- {
+		events = append(events, v.ring[v.head])
+		v.ring[v.head] = nil
+		v.head = (v.head + 1) % len(v.ring)
+	}
+
+	dropped := v.dropped
+	v.dropped = 0
+	return events, dropped
+}
+
+// EventBroadcaster fans out the events of a topic to subscribers. The latest event is kept, and replayed to the new
+// subscriber, so the client always knows the current state.
+type EventBroadcaster struct {
+	topic string
+
+	seq         uint64
+	last        *StreamEvent
+	subscribers map[*EventSubscriber]bool
+	lock        sync.Mutex
+}
+
+func NewEventBroadcaster(topic string) *EventBroadcaster {
+	return &EventBroadcaster{topic: topic, subscribers: make(map[*EventSubscriber]bool)}
+}
+
+// Publish sends the event to all subscribers, which never blocks. It never fails, because the event is only to
+// notify the clients, and should never break the producer.
+func (v *EventBroadcaster) Publish(ctx context.Context, eventType string, data interface{}, terminal bool) {
+	b, err := json.Marshal(data)
+	if err != nil {
+		logger.Wf(ctx, "stream: ignore marshal %v of %v err %+v", eventType, v.topic, err)
+		return
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.seq++
+	event := &StreamEvent{ID: v.seq, Type: eventType, Data: b, Terminal: terminal}
+	v.last = event
+
+	for subscriber := range v.subscribers {
+		subscriber.push(event)
+	}
+}
+
+// Subscribe adds a subscriber of class, with the latest event if any.
+func (v *EventBroadcaster) Subscribe(class string) *EventSubscriber {
+	subscriber := newEventSubscriber(class, v.topic, eventStreamRingSize)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.last != nil {
+		subscriber.push(v.last)
+	}
+	v.subscribers[subscriber] = true
+	eventStreamMetrics.onSubscribe(class, v.topic, 1)
+	return subscriber
+}
+
+func (v *EventBroadcaster) Unsubscribe(subscriber *EventSubscriber) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.subscribers[subscriber] {
+		delete(v.subscribers, subscriber)
+		eventStreamMetrics.onSubscribe(subscriber.class, v.topic, -1)
+	}
+}
+
+// EventStreamMetrics is the metrics of event stream of a connection class and topic.
+type EventStreamMetrics struct {
+	Class string `json:"class"`
+	Topic string `json:"topic"`
+	// The number of connected subscribers.
+	Subscribers int64 `json:"subscribers"`
+	// The number of events dropped for slow clients.
+	Dropped int64 `json:"dropped"`
+	// The number of clients evicted for write timeout.
+	Evicted int64 `json:"evicted"`
+}
+
+type eventStreamMetricsTable struct {
+	metrics map[string]*EventStreamMetrics
+	lock    sync.Mutex
+}
+
+var eventStreamMetrics = &eventStreamMetricsTable{metrics: make(map[string]*EventStreamMetrics)}
+
+func (v *eventStreamMetricsTable) get(class, topic string) *EventStreamMetrics {
+	key := fmt.Sprintf("%v/%v", class, topic)
+	m, ok := v.metrics[key]
+	if !ok {
+		m = &EventStreamMetrics{Class: class, Topic: topic}
+		v.metrics[key] = m
+	}
+	return m
+}
+
+func (v *eventStreamMetricsTable) onDropped(class, topic string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.get(class, topic).Dropped++
+}
+
+func (v *eventStreamMetricsTable) onEvicted(class, topic string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.get(class, topic).Evicted++
+}
+
+func (v *eventStreamMetricsTable) onSubscribe(class, topic string, delta int64) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.get(class, topic).Subscribers += delta
+}
+
+// Metrics returns the snapshot of metrics, sorted by class and topic.
+func (v *eventStreamMetricsTable) Metrics() []*EventStreamMetrics {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	metrics := make([]*EventStreamMetrics, 0, len(v.metrics))
+	for _, m := range v.metrics {
+		copied := *m
+		metrics = append(metrics, &copied)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		if metrics[i].Class != metrics[j].Class {
+			return metrics[i].Class < metrics[j].Class
+		}
+		return metrics[i].Topic < metrics[j].Topic
+	})
+	return metrics
+}
+
+type httpConnContextKey struct{}
+
+// httpConnContext keeps the connection in the context of request, for the per-connection write deadline of streaming
+// response, see http.Server.ConnContext.
+func httpConnContext(ctx context.Context, c net.Conn) context.Context {
+	return context.WithValue(ctx, httpConnContextKey{}, c)
+}
+
+func httpConnFromContext(ctx context.Context) net.Conn {
+	if c, ok := ctx.Value(httpConnContextKey{}).(net.Conn); ok {
+		return c
+	}
+	return nil
+}
+
+// serveEventStream writes the events of broadcaster to client as SSE, until the terminal event, or the client is gone
+// or evicted for the write takes longer than timeout.
+func serveEventStream(ctx context.Context, w http.ResponseWriter, broadcaster *EventBroadcaster, timeout time.Duration) error {
+	subscriber := broadcaster.Subscribe(eventStreamClassSSE)
+	defer broadcaster.Unsubscribe(subscriber)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Write with deadline of connection, which unblocks the write of dead client. The deadline is also checked by
+	// the duration, for the writer without connection.
+	conn := httpConnFromContext(ctx)
+	if conn != nil {
+		defer conn.SetWriteDeadline(time.Time{})
+	}
+	write := func(b []byte) error {
+		starttime := time.Now()
+		if conn != nil {
+			conn.SetWriteDeadline(starttime.Add(timeout))
+		}
+
+		if _, err := w.Write(b); err != nil {
+			return errors.Wrapf(err, "write %vB", len(b))
+		}
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+
+		if cost := time.Since(starttime); cost >= timeout {
+			return errors.Errorf("write %vB cost %v exceeds %v", len(b), cost, timeout)
+		}
+		return nil
+	}
+
+	for {
+		events, dropped := subscriber.pop()
+
+		var b []byte
+		if dropped > 0 {
+			b = append(b, fmt.Sprintf("event: dropped\ndata: {\"dropped\":%v}\n\n", dropped)...)
+		}
+		var terminal bool
+		for _, event := range events {
+			b = append(b, fmt.Sprintf("id: %v\nevent: %v\ndata: %s\n\n", event.ID, event.Type, event.Data)...)
+			if terminal = event.Terminal; terminal {
+				break
+			}
+		}
+
+		if len(b) > 0 {
+			if err := write(b); err != nil {
+				eventStreamMetrics.onEvicted(subscriber.class, subscriber.topic)
+				return errors.Wrapf(err, "evict %v subscriber", broadcaster.topic)
+			}
+		}
+		if terminal {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-subscriber.notify:
+		case <-time.After(eventStreamHeartbeat):
+			if err := write([]byte(": heartbeat\n\n")); err != nil {
+				eventStreamMetrics.onEvicted(subscriber.class, subscriber.topic)
+				return errors.Wrapf(err, "evict %v subscriber", broadcaster.topic)
+			}
+		}
+	}
+}
+
+func handleMgmtEventStream(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/events/stream"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, eventStreamHandler(ctx, eventBusStream))
+
+	ep = "/terraform/v1/mgmt/upgrade/progress"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, eventStreamHandler(ctx, upgradeProgress))
+
+	ep = "/terraform/v1/mgmt/streams/health"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, eventStreamHandler(ctx, streamHealthStream))
+}
+
+func eventStreamHandler(ctx context.Context, broadcaster *EventBroadcaster) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			// The EventSource of browser is unable to set header, so the token is in query.
+			token := r.URL.Query().Get("token")
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			logger.Tf(ctx, "stream: subscribe %v, token=%vB", broadcaster.topic, len(token))
+			return serveEventStream(ctx, w, broadcaster, eventStreamWriteTimeout)
+		}(); err != nil {
+			if httpResponseWritten(w) {
+				logger.Wf(ctx, "stream: %v quit, err %+v", broadcaster.topic, err)
+				return
+			}
+			httpWriteError(ctx, w, r, err)
+		}
+	}
+}
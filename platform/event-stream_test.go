@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// slowResponseWriter is an artificially slow client, each write takes delay.
+type slowResponseWriter struct {
+	header http.Header
+	delay  time.Duration
+	body   bytes.Buffer
+	lock   sync.Mutex
+}
+
+func (v *slowResponseWriter) Header() http.Header {
+	return v.header
+}
+
+func (v *slowResponseWriter) WriteHeader(status int) {
+}
+
+func (v *slowResponseWriter) Write(b []byte) (int, error) {
+	time.Sleep(v.delay)
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.body.Write(b)
+}
+
+func (v *slowResponseWriter) String() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.body.String()
+}
+
+func waitEventSubscribers(t *testing.T, broadcaster *EventBroadcaster, n int) {
+	for i := 0; i < 100; i++ {
+		broadcaster.lock.Lock()
+		subscribers := len(broadcaster.subscribers)
+		broadcaster.lock.Unlock()
+		if subscribers == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Fail for no %v subscribers", n)
+}
+
+func TestEventStream_Ring(t *testing.T) {
+	subscriber := newEventSubscriber(eventStreamClassSSE, "ring", 3)
+	for i := 1; i <= 5; i++ {
+		subscriber.push(&StreamEvent{ID: uint64(i)})
+	}
+
+	// Drop the oldest events, keep the order of the rest.
+	events, dropped := subscriber.pop()
+	if len(events) != 3 || events[0].ID != 3 || events[2].ID != 5 || dropped != 2 {
+		t.Errorf("Fail for events %v, dropped %v", events, dropped)
+	}
+	if events, dropped := subscriber.pop(); len(events) != 0 || dropped != 0 {
+		t.Errorf("Fail for events %v, dropped %v", events, dropped)
+	}
+
+	// Replay the latest event to new subscriber.
+	broadcaster := NewEventBroadcaster("ring")
+	broadcaster.Publish(context.Background(), "draining", &UpgradeProgress{Stage: UpgradeStageDraining}, false)
+	subscriber = broadcaster.Subscribe(eventStreamClassSSE)
+	defer broadcaster.Unsubscribe(subscriber)
+	if events, _ := subscriber.pop(); len(events) != 1 || events[0].Type != "draining" {
+		t.Errorf("Fail for events %v", events)
+	}
+}
+
+func TestEventStream_SlowClient(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	broadcaster := NewEventBroadcaster("slow")
+	w := &slowResponseWriter{header: make(http.Header), delay: 20 * time.Millisecond}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serveEventStream(ctx, w, broadcaster, time.Second)
+	}()
+	waitEventSubscribers(t, broadcaster, 1)
+
+	// The producer never blocks on the slow client.
+	starttime := time.Now()
+	for i := 0; i < 1000; i++ {
+		broadcaster.Publish(ctx, UpgradeStageScript, &UpgradeProgress{Stage: UpgradeStageScript, Message: "line"}, false)
+	}
+	broadcaster.Publish(ctx, UpgradeStageDone, &UpgradeProgress{Stage: UpgradeStageDone}, true)
+	if cost := time.Since(starttime); cost > 500*time.Millisecond {
+		t.Errorf("Fail for producer cost %v", cost)
+	}
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Fail for slow client not done")
+	}
+
+	// The events are lossy, but in order, and end with the terminal state.
+	var ids []int
+	var last string
+	for _, line := range strings.Split(w.String(), "\n") {
+		if strings.HasPrefix(line, "id: ") {
+			id, _ := strconv.Atoi(strings.TrimPrefix(line, "id: "))
+			ids = append(ids, id)
+		} else if strings.HasPrefix(line, "event: ") {
+			last = strings.TrimPrefix(line, "event: ")
+		}
+	}
+	if len(ids) == 0 || len(ids) >= 1001 || ids[len(ids)-1] != 1001 || last != UpgradeStageDone {
+		t.Fatalf("Fail for ids %v, last %v", len(ids), last)
+	}
+	for i := 1; i < len(ids); i++ {
+		if ids[i] <= ids[i-1] {
+			t.Errorf("Fail for ids %v then %v", ids[i-1], ids[i])
+		}
+	}
+	if !strings.Contains(w.String(), "event: dropped") {
+		t.Errorf("Fail for no dropped event")
+	}
+
+	var dropped int64
+	for _, m := range eventStreamMetrics.Metrics() {
+		if m.Class == eventStreamClassSSE && m.Topic == "slow" {
+			dropped = m.Dropped
+		}
+	}
+	if dropped == 0 {
+		t.Errorf("Fail for no dropped metrics")
+	}
+	waitEventSubscribers(t, broadcaster, 0)
+}
+
+func TestEventStream_Evict(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	queryEvicted := func() int64 {
+		for _, m := range eventStreamMetrics.Metrics() {
+			if m.Class == eventStreamClassSSE && m.Topic == "evict" {
+				return m.Evicted
+			}
+		}
+		return 0
+	}
+	evicted := queryEvicted()
+
+	broadcaster := NewEventBroadcaster("evict")
+	w := &slowResponseWriter{header: make(http.Header), delay: 100 * time.Millisecond}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- serveEventStream(ctx, w, broadcaster, 50*time.Millisecond)
+	}()
+	waitEventSubscribers(t, broadcaster, 1)
+	broadcaster.Publish(ctx, "test", nil, false)
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("Fail for dead client not evicted")
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatalf("Fail for dead client not evicted")
+	}
+
+	if v := queryEvicted(); v != evicted+1 {
+		t.Errorf("Fail for evicted %v, expect %v", v, evicted+1)
+	}
+	waitEventSubscribers(t, broadcaster, 0)
+}
+
+func TestEventStream_Authenticate(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	oldSecret := os.Getenv("SRS_PLATFORM_SECRET")
+	os.Setenv("SRS_PLATFORM_SECRET", "test-platform-secret")
+	defer os.Setenv("SRS_PLATFORM_SECRET", oldSecret)
+
+	handler := http.NewServeMux()
+	handleMgmtEventStream(ctx, handler)
+
+	for _, ep := range []string{"/terraform/v1/mgmt/upgrade/progress", "/terraform/v1/mgmt/events/stream"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, ep+"?token=invalid", nil))
+		if w.Code == http.StatusOK || strings.Contains(w.Header().Get("Content-Type"), "event-stream") {
+			t.Errorf("Fail for %v, code=%v", ep, w.Code)
+		}
+	}
+}
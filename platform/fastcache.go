@@ -3,7 +3,10 @@
 // SPDX-License-Identifier: MIT
 package main
 
-import "context"
+import (
+	"context"
+	"sync"
+)
 
 var fastCache *FastCache
 
@@ -12,6 +15,11 @@ type FastCache struct {
 	HLSHighPerformance bool
 	// Whether deliver HLS in low latency mode.
 	HLSLowLatency bool
+
+	// The HLS profile of streams, key is stream URL such as live/livestream.
+	hlsProfiles map[string]HLSProfile
+	// The lock for hlsProfiles.
+	lock sync.RWMutex
 }
 
 func NewFastCache() *FastCache {
@@ -31,5 +39,22 @@ func (v *FastCache) Refresh(ctx context.Context) error {
 		v.HLSHighPerformance = false
 	}
 
+	if profiles, err := queryHLSProfiles(ctx); err == nil {
+		v.lock.Lock()
+		v.hlsProfiles = profiles
+		v.lock.Unlock()
+	}
+
 	return nil
 }
+
+// HLSProfile returns the HLS profile of stream, such as live/livestream.
+func (v *FastCache) HLSProfile(streamURL string) HLSProfile {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+
+	if profile, ok := v.hlsProfiles[streamURL]; ok {
+		return profile
+	}
+	return HLSProfileNormal
+}
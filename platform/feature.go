@@ -0,0 +1,241 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// Feature is a feature which is able to be disabled per install, for example, by the hosting provider whose plan does
+// not include it. All features are enabled by default.
+type Feature string
+
+const (
+	FeatureForward   Feature = "forward"
+	FeatureVLive     Feature = "vlive"
+	FeatureRecord    Feature = "record"
+	FeatureTranscode Feature = "transcode"
+	FeatureSRT       Feature = "srt"
+	FeatureRTC       Feature = "rtc"
+)
+
+// The registry of features, in the order for UI.
+var allFeatures = []Feature{
+	FeatureForward, FeatureVLive, FeatureRecord, FeatureTranscode, FeatureSRT, FeatureRTC,
+}
+
+// Valid returns whether the feature is in the registry.
+func (v Feature) Valid() bool {
+	for _, feature := range allFeatures {
+		if v == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// queryFeatures returns whether each feature is enabled. The disabled feature is off in SRS_FEATURES.
+func queryFeatures(ctx context.Context) (map[Feature]bool, error) {
+	values, err := rdb.HGetAll(ctx, SRS_FEATURES).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_FEATURES)
+	}
+
+	features := make(map[Feature]bool)
+	for _, feature := range allFeatures {
+		features[feature] = values[string(feature)] != "off"
+	}
+	return features, nil
+}
+
+// isFeatureEnabled returns whether the feature is enabled.
+func isFeatureEnabled(ctx context.Context, feature Feature) (bool, error) {
+	value, err := rdb.HGet(ctx, SRS_FEATURES, string(feature)).Result()
+	if err != nil && err != redis.Nil {
+		return false, errors.Wrapf(err, "hget %v %v", SRS_FEATURES, feature)
+	}
+	return value != "off", nil
+}
+
+// verifyFeature returns a forbidden error if the feature is disabled.
+func verifyFeature(ctx context.Context, feature Feature) error {
+	if enabled, err := isFeatureEnabled(ctx, feature); err != nil {
+		return errors.Wrapf(err, "query feature")
+	} else if !enabled {
+		return newHttpCodeError(http.StatusForbidden, SrsStackErrorFeatureDisabled,
+			errors.Errorf("feature %v is disabled", feature),
+		)
+	}
+	return nil
+}
+
+// handleFeatureWorker registers the routes of worker under the prefix, which are rejected if the feature is disabled.
+func handleFeatureWorker(
+	ctx context.Context, handler *http.ServeMux, feature Feature, prefix string,
+	pfn func(ctx context.Context, handler *http.ServeMux) error,
+) error {
+	mux := http.NewServeMux()
+	if err := pfn(ctx, mux); err != nil {
+		return err
+	}
+
+	handler.HandleFunc(prefix, func(w http.ResponseWriter, r *http.Request) {
+		if err := verifyFeature(ctx, feature); err != nil {
+			httpWriteError(ctx, w, r, err)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+	return nil
+}
+
+// stopFeatureTasks stops the running tasks of the disabled feature, and records the reason in task history. The tasks
+// keep in disabled status until the feature is enabled again.
+func stopFeatureTasks(ctx context.Context, feature Feature) {
+	reason := fmt.Sprintf("feature %v disabled", feature)
+
+	switch feature {
+	case FeatureForward:
+		if forwardWorker != nil {
+			forwardWorker.tasks.Range(func(key, value interface{}) bool {
+				value.(*ForwardTask).Stop(ctx, reason)
+				return true
+			})
+		}
+	case FeatureVLive:
+		if vLiveWorker != nil {
+			vLiveWorker.tasks.Range(func(key, value interface{}) bool {
+				value.(*VLiveTask).Stop(ctx, reason)
+				return true
+			})
+		}
+	case FeatureTranscode:
+		if transcodeWorker != nil {
+			transcodeWorker.task.Stop(ctx, reason)
+		}
+	case FeatureSRT, FeatureRTC:
+		key := SRS_STREAM_SRT_ACTIVE
+		if feature == FeatureRTC {
+			key = SRS_STREAM_RTC_ACTIVE
+		}
+
+		streams, err := rdb.HGetAll(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			logger.Wf(ctx, "feature ignore hgetall %v err %+v", key, err)
+		}
+		for streamURL, value := range streams {
+			var stream SrsStream
+			if err := json.Unmarshal([]byte(value), &stream); err != nil {
+				logger.Wf(ctx, "feature ignore stream %v err %+v", value, err)
+				continue
+			}
+
+			if _, err := kickoffStream(ctx, &stream); err != nil {
+				logger.Wf(ctx, "feature ignore kickoff %v err %+v", streamURL, err)
+				continue
+			}
+			recordTaskEvent(ctx, &TaskEvent{
+				Worker: string(feature), Task: streamURL, Platform: streamURL, Event: TaskEventStopped, Message: reason,
+			})
+		}
+	case FeatureRecord:
+		// The new segments are not recorded, so the recording ends normally after the last segment.
+		if recordWorker != nil {
+			recordWorker.streams.Range(func(key, value interface{}) bool {
+				stream := value.(*RecordM3u8Stream)
+				recordTaskEvent(ctx, &TaskEvent{
+					Worker: "record", Task: stream.UUID, Platform: stream.M3u8URL, Event: TaskEventStopped,
+					Message: reason,
+				})
+				return true
+			})
+		}
+	}
+}
+
+func handleMgmtFeatures(ctx context.Context, handler *http.ServeMux) {
+	// Without authentication, because the UI reads it to hide the panels, before login.
+	ep := "/terraform/v1/mgmt/features"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			features, err := queryFeatures(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query features")
+			}
+
+			httpWriteData(ctx, w, r, features)
+			logger.Tf(ctx, "features query ok, features=%v", features)
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/features/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var feature Feature
+			var enabled bool
+			if err := ParseBody(ctx, r, &struct {
+				Token   *string  `json:"token"`
+				Feature *Feature `json:"feature"`
+				Enabled *bool    `json:"enabled"`
+			}{
+				Token: &token, Feature: &feature, Enabled: &enabled,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if !feature.Valid() {
+				return errors.Errorf("invalid feature %v", feature)
+			}
+
+			if enabled {
+				if err := rdb.HDel(ctx, SRS_FEATURES, string(feature)).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", SRS_FEATURES, feature)
+				}
+			} else {
+				if err := rdb.HSet(ctx, SRS_FEATURES, string(feature), "off").Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v %v off", SRS_FEATURES, feature)
+				}
+				stopFeatureTasks(ctx, feature)
+			}
+
+			features, err := queryFeatures(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query features")
+			}
+
+			httpWriteData(ctx, w, r, features)
+			logger.Tf(ctx, "features update ok, feature=%v, enabled=%v, token=%vB", feature, enabled, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,588 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The providers of API integration of forward destinations, see forwardDestinationPlugins.
+const (
+	ForwardIntegrationYouTube = "youtube"
+	ForwardIntegrationTwitch  = "twitch"
+)
+
+// Refresh the access token if it expires in this duration, to avoid expiring during the request.
+const forwardIntegrationRefreshAhead = 60 * time.Second
+
+// The client to request the API of destinations, which should never take too long.
+var forwardIntegrationClient = &http.Client{Timeout: 10 * time.Second}
+
+// To serialize the refresh of tokens, because the refresh token might be rotated by the provider, for example, Twitch.
+var forwardIntegrationLock sync.Mutex
+
+// ForwardIntegration is the API integration of a forward destination, to update the metadata of remote broadcast when
+// the forward starts. The secrets are encrypted in redis, see encryptByApiSecret.
+type ForwardIntegration struct {
+	// The platform of forward configure, for example, forwarding-youtube.
+	Platform string `json:"platform"`
+	// The provider of API, youtube or twitch.
+	Provider string `json:"provider"`
+	// The OAuth client ID and secret, to refresh the access token.
+	ClientID     string `json:"clientId"`
+	ClientSecret string `json:"clientSecret,omitempty"`
+	// The OAuth access and refresh token.
+	AccessToken  string `json:"accessToken,omitempty"`
+	RefreshToken string `json:"refreshToken,omitempty"`
+	// The expire time of access token, in RFC3339, refresh if empty or expired.
+	Expire string `json:"expire,omitempty"`
+	// The channel ID, the broadcaster ID of Twitch, queried by token if empty.
+	ChannelID string `json:"channelId,omitempty"`
+	// Whether the refresh token is set, only in response, the secrets are never responded.
+	Authorized bool `json:"authorized,omitempty"`
+}
+
+func (v *ForwardIntegration) String() string {
+	return fmt.Sprintf("platform=%v, provider=%v, clientId=%v, clientSecret=%vB, accessToken=%vB, "+
+		"refreshToken=%vB, expire=%v, channelId=%v",
+		v.Platform, v.Provider, v.ClientID, len(v.ClientSecret), len(v.AccessToken), len(v.RefreshToken), v.Expire,
+		v.ChannelID,
+	)
+}
+
+// Redacted returns the integration without secrets, for response.
+func (v *ForwardIntegration) Redacted() *ForwardIntegration {
+	return &ForwardIntegration{
+		Platform: v.Platform, Provider: v.Provider, ClientID: v.ClientID, Expire: v.Expire, ChannelID: v.ChannelID,
+		Authorized: v.RefreshToken != "",
+	}
+}
+
+// Expired returns whether the access token is empty or about to expire.
+func (v *ForwardIntegration) Expired() bool {
+	if v.AccessToken == "" {
+		return true
+	}
+	expire, err := time.Parse(time.RFC3339, v.Expire)
+	return err != nil || time.Now().Add(forwardIntegrationRefreshAhead).After(expire)
+}
+
+// ForwardDestinationPlugin is the API of a destination platform, to update the metadata of remote broadcast.
+type ForwardDestinationPlugin interface {
+	// TokenURL is the OAuth endpoint to refresh the access token.
+	TokenURL() string
+	// UpdateMetadata updates the remote broadcast of integration with the metadata, by the access token.
+	UpdateMetadata(ctx context.Context, integration *ForwardIntegration, metadata *StreamMetadata) error
+}
+
+// The plugins of destinations with API integration, key is the provider.
+var forwardDestinationPlugins = map[string]ForwardDestinationPlugin{
+	ForwardIntegrationYouTube: &youtubeDestination{
+		api: "https://www.googleapis.com/youtube/v3", token: "https://oauth2.googleapis.com/token",
+	},
+	ForwardIntegrationTwitch: &twitchDestination{
+		api: "https://api.twitch.tv/helix", token: "https://id.twitch.tv/oauth2/token",
+	},
+}
+
+// forwardIntegrationError is the error response of the API of destination.
+type forwardIntegrationError struct {
+	status int
+	body   string
+}
+
+func (v *forwardIntegrationError) Error() string {
+	return fmt.Sprintf("status %v, body %v", v.status, v.body)
+}
+
+// forwardIntegrationUnauthorized returns whether the access token is rejected, which should be refreshed.
+func forwardIntegrationUnauthorized(err error) bool {
+	if r0, ok := errors.Cause(err).(*forwardIntegrationError); ok {
+		return r0.status == http.StatusUnauthorized
+	}
+	return false
+}
+
+// forwardIntegrationRequest requests the API of destination by JSON, and parses the response to res if not nil.
+func forwardIntegrationRequest(ctx context.Context, method, api string, header http.Header, req, res interface{}) error {
+	var body io.Reader
+	if req != nil {
+		b, err := json.Marshal(req)
+		if err != nil {
+			return errors.Wrapf(err, "marshal %v", req)
+		}
+		body = bytes.NewReader(b)
+	}
+
+	r, err := http.NewRequestWithContext(ctx, method, api, body)
+	if err != nil {
+		return errors.Wrapf(err, "new request %v %v", method, api)
+	}
+	for k, v := range header {
+		r.Header[k] = v
+	}
+	if req != nil {
+		r.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := forwardIntegrationClient.Do(r)
+	if err != nil {
+		return errors.Wrapf(err, "%v %v", method, api)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return errors.Wrapf(err, "read body of %v %v", method, api)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Wrapf(&forwardIntegrationError{status: resp.StatusCode, body: string(b)}, "%v %v", method, api)
+	}
+
+	if res != nil && len(b) > 0 {
+		if err := json.Unmarshal(b, res); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", string(b))
+		}
+	}
+	return nil
+}
+
+// refreshForwardIntegration refreshes the access token by the refresh token, the standard OAuth refresh flow of both
+// Google and Twitch, and saves the new tokens.
+func refreshForwardIntegration(ctx context.Context, plugin ForwardDestinationPlugin, integration *ForwardIntegration) error {
+	if integration.RefreshToken == "" {
+		return errors.Errorf("no refresh token of %v", integration.Platform)
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "refresh_token")
+	form.Set("refresh_token", integration.RefreshToken)
+	form.Set("client_id", integration.ClientID)
+	form.Set("client_secret", integration.ClientSecret)
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, plugin.TokenURL(), strings.NewReader(form.Encode()))
+	if err != nil {
+		return errors.Wrapf(err, "new request")
+	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := forwardIntegrationClient.Do(r)
+	if err != nil {
+		return errors.Wrapf(err, "post %v", plugin.TokenURL())
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	if err != nil {
+		return errors.Wrapf(err, "read body")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return errors.Wrapf(&forwardIntegrationError{status: resp.StatusCode, body: string(b)}, "refresh token")
+	}
+
+	var res struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		ExpiresIn    int    `json:"expires_in"`
+	}
+	if err := json.Unmarshal(b, &res); err != nil {
+		return errors.Wrapf(err, "unmarshal %vB", len(b))
+	}
+	if res.AccessToken == "" {
+		return errors.Errorf("no access token, expires=%v", res.ExpiresIn)
+	}
+
+	integration.AccessToken = res.AccessToken
+	integration.Expire = time.Now().Add(time.Duration(res.ExpiresIn) * time.Second).Format(time.RFC3339)
+	// The refresh token is only responded if rotated.
+	if res.RefreshToken != "" {
+		integration.RefreshToken = res.RefreshToken
+	}
+
+	if err := saveForwardIntegration(ctx, integration); err != nil {
+		return errors.Wrapf(err, "save %v", integration.String())
+	}
+	logger.Tf(ctx, "forward integration refresh ok, %v", integration.String())
+	return nil
+}
+
+// updateForwardIntegrationMetadata updates the remote broadcast with the metadata, refreshes the token if expired, or
+// rejected by the destination.
+func updateForwardIntegrationMetadata(ctx context.Context, integration *ForwardIntegration, metadata *StreamMetadata) error {
+	plugin := forwardDestinationPlugins[integration.Provider]
+	if plugin == nil {
+		return errors.Errorf("invalid provider %v", integration.Provider)
+	}
+
+	forwardIntegrationLock.Lock()
+	defer forwardIntegrationLock.Unlock()
+
+	if integration.Expired() {
+		if err := refreshForwardIntegration(ctx, plugin, integration); err != nil {
+			return errors.Wrapf(err, "refresh token")
+		}
+	}
+
+	err := plugin.UpdateMetadata(ctx, integration, metadata)
+	if forwardIntegrationUnauthorized(err) {
+		if err := refreshForwardIntegration(ctx, plugin, integration); err != nil {
+			return errors.Wrapf(err, "refresh token")
+		}
+		err = plugin.UpdateMetadata(ctx, integration, metadata)
+	}
+	if err != nil {
+		return errors.Wrapf(err, "update %v", integration.Provider)
+	}
+	return nil
+}
+
+// youtubeDestination updates the live broadcast by YouTube Data API.
+type youtubeDestination struct {
+	// The base URL of API and token endpoint.
+	api, token string
+}
+
+func (v *youtubeDestination) TokenURL() string {
+	return v.token
+}
+
+func (v *youtubeDestination) UpdateMetadata(ctx context.Context, integration *ForwardIntegration, metadata *StreamMetadata) error {
+	header := http.Header{}
+	header.Set("Authorization", fmt.Sprintf("Bearer %v", integration.AccessToken))
+
+	type snippet struct {
+		Title              string `json:"title"`
+		Description        string `json:"description"`
+		ScheduledStartTime string `json:"scheduledStartTime,omitempty"`
+		CategoryID         string `json:"categoryId,omitempty"`
+	}
+	type resource struct {
+		ID      string   `json:"id"`
+		Snippet *snippet `json:"snippet"`
+	}
+
+	// The broadcast bound to the stream key, which is active when the forward starts, or upcoming if not yet.
+	var broadcast *resource
+	for _, status := range []string{"active", "upcoming"} {
+		var res struct {
+			Items []*resource `json:"items"`
+		}
+		api := fmt.Sprintf("%v/liveBroadcasts?part=id,snippet&broadcastType=all&broadcastStatus=%v", v.api, status)
+		if err := forwardIntegrationRequest(ctx, http.MethodGet, api, header, nil, &res); err != nil {
+			return errors.Wrapf(err, "list %v broadcasts", status)
+		}
+		if len(res.Items) > 0 && res.Items[0].Snippet != nil {
+			broadcast = res.Items[0]
+			break
+		}
+	}
+	if broadcast == nil {
+		return errors.New("no active or upcoming broadcast")
+	}
+
+	// The title and scheduled start time are required, so keep the current ones if not set.
+	if metadata.Title != "" {
+		broadcast.Snippet.Title = metadata.Title
+	}
+	if metadata.Description != "" {
+		broadcast.Snippet.Description = metadata.Description
+	}
+	api := fmt.Sprintf("%v/liveBroadcasts?part=snippet", v.api)
+	if err := forwardIntegrationRequest(ctx, http.MethodPut, api, header, broadcast, nil); err != nil {
+		return errors.Wrapf(err, "update broadcast %v", broadcast.ID)
+	}
+
+	// The category is of the video of broadcast, which has the same ID.
+	if metadata.Category != "" {
+		video := &resource{ID: broadcast.ID, Snippet: &snippet{
+			Title: broadcast.Snippet.Title, Description: broadcast.Snippet.Description, CategoryID: metadata.Category,
+		}}
+		api := fmt.Sprintf("%v/videos?part=snippet", v.api)
+		if err := forwardIntegrationRequest(ctx, http.MethodPut, api, header, video, nil); err != nil {
+			return errors.Wrapf(err, "update category of video %v", broadcast.ID)
+		}
+	}
+	return nil
+}
+
+// twitchDestination updates the channel information by Twitch Helix API, which has no description.
+type twitchDestination struct {
+	// The base URL of API and token endpoint.
+	api, token string
+}
+
+func (v *twitchDestination) TokenURL() string {
+	return v.token
+}
+
+func (v *twitchDestination) UpdateMetadata(ctx context.Context, integration *ForwardIntegration, metadata *StreamMetadata) error {
+	header := http.Header{}
+	header.Set("Authorization", fmt.Sprintf("Bearer %v", integration.AccessToken))
+	header.Set("Client-Id", integration.ClientID)
+
+	type data struct {
+		ID string `json:"id"`
+	}
+
+	// The broadcaster is the user of token if not specified.
+	broadcasterID := integration.ChannelID
+	if broadcasterID == "" {
+		var res struct {
+			Data []*data `json:"data"`
+		}
+		if err := forwardIntegrationRequest(ctx, http.MethodGet, fmt.Sprintf("%v/users", v.api), header, nil, &res); err != nil {
+			return errors.Wrapf(err, "query user")
+		}
+		if len(res.Data) == 0 {
+			return errors.New("no user of token")
+		}
+		broadcasterID = res.Data[0].ID
+	}
+
+	channel := make(map[string]string)
+	if metadata.Title != "" {
+		channel["title"] = metadata.Title
+	}
+	if metadata.Category != "" {
+		var res struct {
+			Data []*data `json:"data"`
+		}
+		api := fmt.Sprintf("%v/games?name=%v", v.api, url.QueryEscape(metadata.Category))
+		if err := forwardIntegrationRequest(ctx, http.MethodGet, api, header, nil, &res); err != nil {
+			return errors.Wrapf(err, "query category %v", metadata.Category)
+		}
+		if len(res.Data) == 0 {
+			return errors.Errorf("no category %v", metadata.Category)
+		}
+		channel["game_id"] = res.Data[0].ID
+	}
+	if len(channel) == 0 {
+		return nil
+	}
+
+	api := fmt.Sprintf("%v/channels?broadcaster_id=%v", v.api, url.QueryEscape(broadcasterID))
+	if err := forwardIntegrationRequest(ctx, http.MethodPatch, api, header, channel, nil); err != nil {
+		return errors.Wrapf(err, "update channel %v", broadcasterID)
+	}
+	return nil
+}
+
+// saveForwardIntegration saves the integration, with the secrets encrypted.
+func saveForwardIntegration(ctx context.Context, integration *ForwardIntegration) error {
+	stored := *integration
+	stored.Authorized = false
+	for _, secret := range []*string{&stored.ClientSecret, &stored.AccessToken, &stored.RefreshToken} {
+		if *secret == "" {
+			continue
+		}
+
+		ciphertext, err := encryptByApiSecret(*secret)
+		if err != nil {
+			return errors.Wrapf(err, "encrypt")
+		}
+		*secret = ciphertext
+	}
+
+	if b, err := json.Marshal(&stored); err != nil {
+		return errors.Wrapf(err, "marshal %v", integration.String())
+	} else if err := rdb.HSet(ctx, SRS_FORWARD_INTEGRATIONS, integration.Platform, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v", SRS_FORWARD_INTEGRATIONS, integration.Platform)
+	}
+	return nil
+}
+
+// parseForwardIntegration parses the integration in redis, with the secrets decrypted.
+func parseForwardIntegration(value string) (*ForwardIntegration, error) {
+	var integration ForwardIntegration
+	if err := json.Unmarshal([]byte(value), &integration); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %vB", len(value))
+	}
+
+	for _, secret := range []*string{&integration.ClientSecret, &integration.AccessToken, &integration.RefreshToken} {
+		if *secret == "" {
+			continue
+		}
+
+		plaintext, err := decryptByApiSecret(*secret)
+		if err != nil {
+			return nil, errors.Wrapf(err, "decrypt %v", integration.Platform)
+		}
+		*secret = plaintext
+	}
+	return &integration, nil
+}
+
+// queryForwardIntegration returns the integration of forward platform, nil if not configured.
+func queryForwardIntegration(ctx context.Context, platform string) (*ForwardIntegration, error) {
+	value, err := rdb.HGet(ctx, SRS_FORWARD_INTEGRATIONS, platform).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_FORWARD_INTEGRATIONS, platform)
+	}
+	if value == "" {
+		return nil, nil
+	}
+	return parseForwardIntegration(value)
+}
+
+// queryForwardIntegrations returns all integrations without secrets, sorted by platform.
+func queryForwardIntegrations(ctx context.Context) ([]*ForwardIntegration, error) {
+	values, err := rdb.HGetAll(ctx, SRS_FORWARD_INTEGRATIONS).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_FORWARD_INTEGRATIONS)
+	}
+
+	integrations := make([]*ForwardIntegration, 0, len(values))
+	for platform, value := range values {
+		integration, err := parseForwardIntegration(value)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse %v", platform)
+		}
+		integrations = append(integrations, integration.Redacted())
+	}
+	sort.Slice(integrations, func(i, j int) bool {
+		return integrations[i].Platform < integrations[j].Platform
+	})
+	return integrations, nil
+}
+
+// updateMetadata updates the metadata of remote broadcast by the integration of destination, when the forward starts.
+// It never fails the forwarding, the failure is the warning of task status.
+func (v *ForwardTask) updateMetadata(ctx context.Context, input *SrsStream) {
+	err := func() error {
+		integration, err := queryForwardIntegration(ctx, v.Platform)
+		if err != nil {
+			return errors.Wrapf(err, "query integration")
+		} else if integration == nil {
+			return nil
+		}
+
+		metadata, err := queryStreamMetadata(ctx, input.Stream)
+		if err != nil {
+			return errors.Wrapf(err, "query metadata")
+		} else if metadata == nil {
+			return nil
+		}
+
+		if err := updateForwardIntegrationMetadata(ctx, integration, metadata); err != nil {
+			return errors.Wrapf(err, "update metadata %v", metadata.String())
+		}
+		logger.Tf(ctx, "forward update metadata ok, platform=%v, stream=%v, %v",
+			v.Platform, input.StreamURL(), metadata.String(),
+		)
+		return nil
+	}()
+	if err != nil && ctx.Err() == nil {
+		logger.Wf(ctx, "forward ignore metadata of platform=%v, stream=%v, err %+v", v.Platform, input.StreamURL(), err)
+	}
+
+	// The warning is cleared if ok, or the forward is stopped.
+	if ctx.Err() == nil {
+		v.setWarning(err)
+	}
+}
+
+func handleFFmpegForwardIntegrations(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/ffmpeg/forward/integrations"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action string
+			var integration ForwardIntegration
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Action *string `json:"action"`
+				*ForwardIntegration
+			}{
+				Token: &token, Action: &action, ForwardIntegration: &integration,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if action != "" && action != "update" && action != "remove" {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+			}
+			if action != "" && integration.Platform == "" {
+				return newHttpStatusError(http.StatusBadRequest, errors.New("no platform"))
+			}
+
+			if action == "update" {
+				if forwardDestinationPlugins[integration.Provider] == nil {
+					return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid provider %v", integration.Provider))
+				}
+				if integration.ClientID == "" {
+					return newHttpStatusError(http.StatusBadRequest, errors.New("no client id"))
+				}
+
+				// Keep the secrets if not changed, because they are never responded.
+				if existing, err := queryForwardIntegration(ctx, integration.Platform); err != nil {
+					return errors.Wrapf(err, "query integration")
+				} else if existing != nil && existing.Provider == integration.Provider {
+					if integration.ClientSecret == "" {
+						integration.ClientSecret = existing.ClientSecret
+					}
+					if integration.RefreshToken == "" {
+						integration.RefreshToken = existing.RefreshToken
+					}
+					if integration.AccessToken == "" && integration.RefreshToken == existing.RefreshToken {
+						integration.AccessToken, integration.Expire = existing.AccessToken, existing.Expire
+					}
+				}
+				if integration.RefreshToken == "" {
+					return newHttpStatusError(http.StatusBadRequest, errors.New("no refresh token"))
+				}
+				// Refresh the access token when used, if not set with expire.
+				if integration.AccessToken == "" {
+					integration.Expire = ""
+				}
+
+				if err := saveForwardIntegration(ctx, &integration); err != nil {
+					return errors.Wrapf(err, "save %v", integration.String())
+				}
+				logger.Tf(ctx, "forward integration update ok, %v", integration.String())
+			} else if action == "remove" {
+				if err := rdb.HDel(ctx, SRS_FORWARD_INTEGRATIONS, integration.Platform).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", SRS_FORWARD_INTEGRATIONS, integration.Platform)
+				}
+				logger.Tf(ctx, "forward integration remove ok, platform=%v", integration.Platform)
+			}
+
+			integrations, err := queryForwardIntegrations(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query integrations")
+			}
+
+			httpWriteData(ctx, w, r, integrations)
+			logger.Tf(ctx, "forward integrations ok, action=%v, integrations=%v, token=%vB", action, len(integrations), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,458 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The syntax of pattern of forward rule, to match the stream name.
+const (
+	ForwardRuleSyntaxGlob  = "glob"
+	ForwardRuleSyntaxRegex = "regex"
+)
+
+// The name of forward rule, which is part of the platform of task.
+var forwardRuleNamePattern = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// ForwardRule forwards any published stream which matches the pattern, for example, show-* to the backup origin.
+// The task is created when the stream is published, and removed when unpublished. The explicit configure of the
+// same stream takes precedence, see ForwardConfigure.
+type ForwardRule struct {
+	// The name of rule, for example, backup.
+	Name string `json:"name"`
+	// The pattern to match the stream name, for example, show-*
+	Pattern string `json:"pattern"`
+	// The syntax of pattern, glob or regex, default to glob. The regex matches the whole stream name.
+	Syntax string `json:"syntax,omitempty"`
+	// The destination template, the {app} and {stream} is replaced by the published stream, for example, the
+	// server rtmp://backup-origin/{app} and the secret {stream}.
+	Server string `json:"server"`
+	Secret string `json:"secret"`
+	// The destination template, see ForwardConfigure.
+	Template string `json:"template,omitempty"`
+	Region   string `json:"region,omitempty"`
+	// Whether enabled.
+	Enabled bool `json:"enabled"`
+	// The label for this rule.
+	Label string `json:"label,omitempty"`
+}
+
+func (v *ForwardRule) String() string {
+	return fmt.Sprintf("name=%v, pattern=%v, syntax=%v, server=%v, secret=%v, template=%v, region=%v, enabled=%v, "+
+		"label=%v",
+		v.Name, v.Pattern, v.Syntax, v.Server, v.Secret, v.Template, v.Region, v.Enabled, v.Label,
+	)
+}
+
+// compile returns the regex of pattern, which matches the whole stream name.
+func (v *ForwardRule) compile() (*regexp.Regexp, error) {
+	return regexp.Compile(fmt.Sprintf("^(?:%v)$", v.Pattern))
+}
+
+// Match returns whether the stream name matches the pattern.
+func (v *ForwardRule) Match(stream string) bool {
+	if v.Syntax == ForwardRuleSyntaxRegex {
+		re, err := v.compile()
+		return err == nil && re.MatchString(stream)
+	}
+	matched, err := path.Match(v.Pattern, stream)
+	return err == nil && matched
+}
+
+// Configure returns the configure of task for the published stream, by the destination template.
+func (v *ForwardRule) Configure(stream *SrsStream) *ForwardConfigure {
+	replacer := strings.NewReplacer("{app}", stream.App, "{stream}", stream.Stream)
+	return &ForwardConfigure{
+		Platform: forwardRulePlatform(v.Name, stream.Stream), Stream: stream.Stream,
+		Server: replacer.Replace(v.Server), Secret: replacer.Replace(v.Secret),
+		Template: v.Template, Region: v.Region, Enabled: true, Customed: true, Label: v.Label,
+	}
+}
+
+// Validate collects all issues of the rule. The template should be loaded by queryForwardTemplate, nil if not found.
+func (v *ForwardRule) Validate(validation *ConfigValidation, template *ForwardTemplate) {
+	if v.Name == "" {
+		validation.AddError("name", ConfigIssueRequired, "name is required")
+	} else if !forwardRuleNamePattern.MatchString(v.Name) {
+		validation.AddError("name", ConfigIssueInvalid, "name %v should match %v", v.Name, forwardRuleNamePattern)
+	}
+
+	if v.Pattern == "" {
+		validation.AddError("pattern", ConfigIssueRequired, "pattern is required")
+	} else if v.Syntax == "" || v.Syntax == ForwardRuleSyntaxGlob {
+		if _, err := path.Match(v.Pattern, ""); err != nil {
+			validation.AddError("pattern", ConfigIssueInvalid, "pattern %v is not a valid glob", v.Pattern)
+		}
+	} else if v.Syntax == ForwardRuleSyntaxRegex {
+		if _, err := v.compile(); err != nil {
+			validation.AddError("pattern", ConfigIssueInvalid, "pattern %v is not a valid regex", v.Pattern)
+		}
+	} else {
+		validation.AddError("syntax", ConfigIssueInvalid, "syntax %v should be %v or %v",
+			v.Syntax, ForwardRuleSyntaxGlob, ForwardRuleSyntaxRegex,
+		)
+	}
+
+	// Validate the destination by an example stream.
+	config := v.Configure(&SrsStream{App: "live", Stream: "livestream"})
+	if v.Template != "" {
+		if template == nil {
+			validation.AddError("template", ConfigIssueInvalid, "template %v not found", v.Template)
+			return
+		}
+		template.Validate(validation, config.Region, config.Secret)
+	}
+
+	server, secret := config.Target(template)
+	validateConfigTarget(validation, server, secret)
+}
+
+// forwardRulePlatform returns the platform of task created by rule for stream, which never conflicts with the
+// platform of configure, see validateConfigPlatform.
+func forwardRulePlatform(rule, stream string) string {
+	return fmt.Sprintf("rule:%v:%v", rule, stream)
+}
+
+// queryForwardRules returns all the rules, sorted by name.
+func queryForwardRules(ctx context.Context) ([]*ForwardRule, error) {
+	values, err := rdb.HGetAll(ctx, SRS_FORWARD_RULES).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_FORWARD_RULES)
+	}
+
+	rules := make([]*ForwardRule, 0, len(values))
+	for name, value := range values {
+		var rule ForwardRule
+		if err := json.Unmarshal([]byte(value), &rule); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", name, value)
+		}
+		rules = append(rules, &rule)
+	}
+
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Name < rules[j].Name
+	})
+	return rules, nil
+}
+
+// evaluateRules creates the tasks of rules for the published streams, and removes the tasks whose stream is
+// unpublished, or the rule is disabled or removed, or the stream has an explicit configure which takes precedence.
+// It's called when the stream is published or unpublished, and periodically to recover the missed hooks.
+func (v *ForwardWorker) evaluateRules(ctx context.Context) error {
+	// Ignore if the worker is not started.
+	if v.ctx == nil {
+		return nil
+	}
+
+	v.rulesLock.Lock()
+	defer v.rulesLock.Unlock()
+
+	rules, err := queryForwardRules(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query rules")
+	}
+
+	// The streams forwarded by explicit configures.
+	explicit := make(map[string]bool)
+	if configs, err := rdb.HGetAll(ctx, SRS_FORWARD_CONFIG).Result(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_FORWARD_CONFIG)
+	} else {
+		for platform, value := range configs {
+			var config ForwardConfigure
+			if err := json.Unmarshal([]byte(value), &config); err != nil {
+				return errors.Wrapf(err, "unmarshal %v %v", platform, value)
+			}
+			if config.Enabled && config.Stream != "" {
+				explicit[config.Stream] = true
+			}
+		}
+	}
+
+	// The tasks should be running, key is platform.
+	desired := make(map[string]*ForwardConfigure)
+	desiredRules := make(map[string]string)
+	if streams, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
+	} else {
+		for streamURL, value := range streams {
+			var stream SrsStream
+			if err := json.Unmarshal([]byte(value), &stream); err != nil {
+				return errors.Wrapf(err, "unmarshal %v %v", streamURL, value)
+			}
+			if explicit[stream.Stream] {
+				continue
+			}
+
+			for _, rule := range rules {
+				if rule.Enabled && rule.Match(stream.Stream) {
+					config := rule.Configure(&stream)
+					desired[config.Platform], desiredRules[config.Platform] = config, rule.Name
+				}
+			}
+		}
+	}
+
+	// Remove the tasks not desired, or the configure is changed.
+	v.tasks.Range(func(key, value interface{}) bool {
+		task := value.(*ForwardTask)
+		if task.Rule == "" {
+			return true
+		}
+
+		config := desired[task.Platform]
+		if config != nil && *config == task.queryConfig() {
+			delete(desired, task.Platform)
+			return true
+		}
+
+		reason := "stream unpublished"
+		if config != nil {
+			reason = "rule changed"
+		} else if explicit[task.queryConfig().Stream] {
+			reason = "explicit configure"
+		}
+		v.removeRuleTask(ctx, task, reason)
+		return true
+	})
+
+	// Create the tasks, limited by the max number of forwarding.
+	limit := 10
+	if iv, err := strconv.Atoi(envForwardLimit()); err == nil && iv > 0 {
+		limit = iv
+	}
+
+	platforms := make([]string, 0, len(desired))
+	for platform := range desired {
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+
+	for _, platform := range platforms {
+		var tasks int
+		v.tasks.Range(func(key, value interface{}) bool {
+			tasks++
+			return true
+		})
+		if tasks >= limit {
+			logThrottle.Wf(ctx, platform, "forward: ignore rule task %v, exceed limit %v", platform, limit)
+			continue
+		}
+
+		v.createRuleTask(ctx, desiredRules[platform], desired[platform])
+	}
+
+	return nil
+}
+
+// createRuleTask creates a task for rule, which runs until removed by removeRuleTask.
+func (v *ForwardWorker) createRuleTask(ctx context.Context, rule string, config *ForwardConfigure) {
+	taskCtx, cancel := context.WithCancel(v.ctx)
+	task := &ForwardTask{
+		UUID: uuid.NewString(), Platform: config.Platform, Rule: rule, config: config, close: cancel,
+	}
+
+	if err := task.Initialize(ctx, v); err != nil {
+		cancel()
+		logger.Wf(ctx, "forward: ignore rule task %v err %+v", task.String(), err)
+		return
+	}
+
+	v.tasks.Store(task.Platform, task)
+	recordTaskEvent(ctx, &TaskEvent{
+		Worker: "forward", Task: task.UUID, Platform: task.Platform, Event: TaskEventCreated,
+		Message: fmt.Sprintf("rule %v", rule),
+	})
+	logger.Tf(ctx, "forward: create rule task %v", task.String())
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		if err := task.Run(taskCtx); err != nil {
+			logger.Wf(taskCtx, "run task %v err %+v", task.String(), err)
+		}
+
+		// Remove the task after FFmpeg quit, use the worker context because the task context is cancelled.
+		if err := rdb.HDel(v.ctx, SRS_FORWARD_TASK, task.UUID).Err(); err != nil && err != redis.Nil {
+			logger.Wf(v.ctx, "forward: ignore hdel %v %v err %+v", SRS_FORWARD_TASK, task.UUID, err)
+		}
+	}()
+}
+
+// removeRuleTask stops and removes the task of rule.
+func (v *ForwardWorker) removeRuleTask(ctx context.Context, task *ForwardTask, reason string) {
+	v.tasks.Delete(task.Platform)
+	task.Stop(ctx, reason)
+	if task.close != nil {
+		task.close()
+	}
+	logger.Tf(ctx, "forward: remove rule task %v, reason=%v", task.String(), reason)
+}
+
+// OnStreamPublish evaluates the rules when the stream is published, see evaluateRules.
+func (v *ForwardWorker) OnStreamPublish(ctx context.Context, stream *SrsStream) {
+	if err := v.evaluateRules(ctx); err != nil {
+		logger.Wf(ctx, "forward: ignore rules for publish %v err %+v", stream.StreamURL(), err)
+	}
+}
+
+// OnStreamUnpublish removes the tasks of rules when the stream is unpublished, see evaluateRules.
+func (v *ForwardWorker) OnStreamUnpublish(ctx context.Context, stream *SrsStream) {
+	if err := v.evaluateRules(ctx); err != nil {
+		logger.Wf(ctx, "forward: ignore rules for unpublish %v err %+v", stream.StreamURL(), err)
+	}
+}
+
+// queryRuleStreams returns the status of tasks created by rules, with the name of rule.
+func (v *ForwardWorker) queryRuleStreams(ctx context.Context, history bool) ([]map[string]interface{}, error) {
+	var tasks []*ForwardTask
+	v.tasks.Range(func(key, value interface{}) bool {
+		if task := value.(*ForwardTask); task.Rule != "" {
+			tasks = append(tasks, task)
+		}
+		return true
+	})
+
+	res := make([]map[string]interface{}, 0, len(tasks))
+	for _, task := range tasks {
+		config := task.queryConfig()
+		pid, streamURL, frame, update, starttime, ready := task.queryFrame()
+		status, taskErr := task.queryStatus()
+
+		elem := map[string]interface{}{
+			"platform": task.Platform,
+			"rule":     task.Rule,
+			"source":   config.Stream,
+			"enabled":  config.Enabled,
+			"custom":   config.Customed,
+			"label":    config.Label,
+			"status":   status,
+		}
+
+		if taskErr != "" {
+			elem["error"] = taskErr
+		}
+
+		if pid > 0 {
+			elem["stream"] = streamURL
+			elem["start"] = starttime
+			elem["ready"] = ready
+			elem["frame"] = map[string]string{
+				"log":    frame,
+				"update": update,
+			}
+		}
+
+		if history {
+			if events, err := queryTaskHistory(ctx, task.UUID); err != nil {
+				return nil, errors.Wrapf(err, "query history of %v", task.String())
+			} else {
+				elem["history"] = events
+			}
+		}
+
+		res = append(res, elem)
+	}
+
+	return res, nil
+}
+
+func (v *ForwardWorker) handleRules(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/ffmpeg/forward/rules"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action string
+			var rule ForwardRule
+			validation, err := parseConfigBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Action *string `json:"action"`
+				*ForwardRule
+			}{
+				Token: &token, Action: &action, ForwardRule: &rule,
+			})
+			if err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			validateConfigAction(validation, action, []string{"update", "remove"})
+			if action == "update" {
+				var template *ForwardTemplate
+				if rule.Template != "" {
+					if template, err = queryForwardTemplate(ctx, rule.Template); err != nil {
+						return errors.Wrapf(err, "query template %v", rule.Template)
+					}
+				}
+				rule.Validate(validation, template)
+			} else if action == "remove" && rule.Name == "" {
+				validation.AddError("name", ConfigIssueRequired, "name is required")
+			}
+			if err := validation.Err(); err != nil {
+				return errors.Wrapf(err, "validate %v", rule.String())
+			}
+			for _, issue := range validation.Warnings {
+				logger.Wf(ctx, "Forward ignore rule issue, %v", issue.String())
+			}
+
+			if action == "" {
+				rules, err := queryForwardRules(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "query rules")
+				}
+
+				httpWriteData(ctx, w, r, rules)
+				logger.Tf(ctx, "forward query rules ok, rules=%v, token=%vB", len(rules), len(token))
+				return nil
+			}
+
+			if action == "update" {
+				if b, err := json.Marshal(&rule); err != nil {
+					return errors.Wrapf(err, "marshal %v", rule.String())
+				} else if err = rdb.HSet(ctx, SRS_FORWARD_RULES, rule.Name, string(b)).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v %v %v", SRS_FORWARD_RULES, rule.Name, string(b))
+				}
+			} else {
+				if err := rdb.HDel(ctx, SRS_FORWARD_RULES, rule.Name).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", SRS_FORWARD_RULES, rule.Name)
+				}
+			}
+
+			// Apply the rule to the published streams.
+			if err := v.evaluateRules(ctx); err != nil {
+				return errors.Wrapf(err, "evaluate rules")
+			}
+
+			httpWriteData(ctx, w, r, validation)
+			logger.Tf(ctx, "forward %v rule ok, %v, token=%vB", action, rule.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
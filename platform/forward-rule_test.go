@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestForwardRule_Match(t *testing.T) {
+	for _, c := range []struct {
+		rule    ForwardRule
+		stream  string
+		matched bool
+	}{
+		{ForwardRule{Pattern: "show-*"}, "show-1", true},
+		{ForwardRule{Pattern: "show-*"}, "show", false},
+		{ForwardRule{Pattern: "show-*", Syntax: ForwardRuleSyntaxGlob}, "other-show-1", false},
+		{ForwardRule{Pattern: "show-[0-9]+", Syntax: ForwardRuleSyntaxRegex}, "show-12", true},
+		{ForwardRule{Pattern: "show-[0-9]+", Syntax: ForwardRuleSyntaxRegex}, "show-12x", false},
+		{ForwardRule{Pattern: "a|b", Syntax: ForwardRuleSyntaxRegex}, "ab", false},
+		{ForwardRule{Pattern: "(", Syntax: ForwardRuleSyntaxRegex}, "(", false},
+	} {
+		if matched := c.rule.Match(c.stream); matched != c.matched {
+			t.Errorf("Fail for %v, stream=%v, matched=%v", c.rule.String(), c.stream, matched)
+		}
+	}
+
+	rule := &ForwardRule{Name: "backup", Server: "rtmp://backup/{app}", Secret: "{stream}?from=oryx", Label: "Backup"}
+	config := rule.Configure(&SrsStream{App: "live", Stream: "show-1"})
+	if config.Platform != "rule:backup:show-1" || config.Stream != "show-1" || !config.Enabled ||
+		config.Server != "rtmp://backup/live" || config.Secret != "show-1?from=oryx" || config.Label != "Backup" {
+		t.Errorf("Fail for %v", config.String())
+	}
+}
+
+func TestForwardRule_Validate(t *testing.T) {
+	for _, c := range []struct {
+		rule  ForwardRule
+		field string
+	}{
+		{ForwardRule{Name: "backup", Pattern: "show-*", Server: "rtmp://backup/{app}", Secret: "{stream}"}, ""},
+		{ForwardRule{Name: "", Pattern: "show-*", Server: "rtmp://backup/live", Secret: "{stream}"}, "name"},
+		{ForwardRule{Name: "a b", Pattern: "show-*", Server: "rtmp://backup/live", Secret: "{stream}"}, "name"},
+		{ForwardRule{Name: "backup", Pattern: "", Server: "rtmp://backup/live", Secret: "{stream}"}, "pattern"},
+		{ForwardRule{Name: "backup", Pattern: "[", Server: "rtmp://backup/live", Secret: "{stream}"}, "pattern"},
+		{ForwardRule{Name: "backup", Pattern: "(", Syntax: ForwardRuleSyntaxRegex, Server: "rtmp://backup/live", Secret: "{stream}"}, "pattern"},
+		{ForwardRule{Name: "backup", Pattern: "*", Syntax: "other", Server: "rtmp://backup/live", Secret: "{stream}"}, "syntax"},
+		{ForwardRule{Name: "backup", Pattern: "*", Server: "http://backup/live", Secret: "{stream}"}, "server"},
+		{ForwardRule{Name: "backup", Pattern: "*", Template: "youtube", Secret: "{stream}"}, "template"},
+	} {
+		validation := &ConfigValidation{}
+		c.rule.Validate(validation, nil)
+
+		var fields []string
+		for _, issue := range validation.Errors {
+			fields = append(fields, issue.Field)
+		}
+		if c.field == "" && len(fields) > 0 {
+			t.Errorf("Fail for %v, errors=%v", c.rule.String(), fields)
+		} else if c.field != "" && (len(fields) == 0 || fields[0] != c.field) {
+			t.Errorf("Fail for %v, errors=%v, expect %v", c.rule.String(), fields, c.field)
+		}
+	}
+}
+
+func TestForwardRule_Evaluate(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	// Never start FFmpeg in test.
+	server.HSet(SRS_FEATURES, string(FeatureForward), "off")
+
+	worker := NewForwardWorker()
+	ctx, worker.cancel = context.WithCancel(ctx)
+	worker.ctx = ctx
+	defer worker.Close()
+
+	rules := func() []string {
+		var platforms []string
+		worker.tasks.Range(func(key, value interface{}) bool {
+			if task := value.(*ForwardTask); task.Rule != "" {
+				platforms = append(platforms, task.Platform)
+			}
+			return true
+		})
+		sort.Strings(platforms)
+		return platforms
+	}
+
+	server.HSet(SRS_FORWARD_RULES, "backup", `{"name":"backup","pattern":"show-*","server":"rtmp://backup/{app}","secret":"{stream}","enabled":true}`)
+	server.HSet(SRS_FORWARD_RULES, "disabled", `{"name":"disabled","pattern":"*","server":"rtmp://other/live","secret":"{stream}","enabled":false}`)
+	server.HSet(SRS_FORWARD_CONFIG, "wx", `{"platform":"wx","stream":"show-2","server":"rtmp://wx/live","secret":"test","enabled":true}`)
+
+	// Create task for the published stream, but ignore the stream with explicit configure.
+	server.HSet(SRS_STREAM_ACTIVE, "live/show-1", `{"vhost":"__defaultVhost__","app":"live","stream":"show-1"}`)
+	server.HSet(SRS_STREAM_ACTIVE, "live/show-2", `{"vhost":"__defaultVhost__","app":"live","stream":"show-2"}`)
+	server.HSet(SRS_STREAM_ACTIVE, "live/other", `{"vhost":"__defaultVhost__","app":"live","stream":"other"}`)
+	worker.OnStreamPublish(ctx, &SrsStream{App: "live", Stream: "show-1"})
+	if platforms := rules(); len(platforms) != 1 || platforms[0] != "rule:backup:show-1" {
+		t.Fatalf("Fail for platforms %v", platforms)
+	}
+
+	task := worker.GetTask("rule:backup:show-1")
+	if config := task.queryConfig(); task.Rule != "backup" || config.Server != "rtmp://backup/live" || config.Secret != "show-1" {
+		t.Errorf("Fail for %v", task.String())
+	}
+	if value, ok := server.HGet(SRS_FORWARD_TASK, task.UUID); !ok || value == "" {
+		t.Errorf("Fail for task %v", task.UUID)
+	}
+	if elems, err := worker.queryRuleStreams(ctx, false); err != nil || len(elems) != 1 ||
+		elems[0]["rule"] != "backup" || elems[0]["source"] != "show-1" {
+		t.Errorf("Fail for elems %v, err %+v", elems, err)
+	}
+
+	// The task is not changed if evaluated again.
+	if err := worker.evaluateRules(ctx); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	} else if worker.GetTask("rule:backup:show-1") != task {
+		t.Errorf("Fail for task changed")
+	}
+
+	// The explicit configure takes precedence, when the stream is unpublished.
+	if err := rdb.HDel(ctx, SRS_FORWARD_CONFIG, "wx").Err(); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if err := worker.evaluateRules(ctx); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	} else if platforms := rules(); len(platforms) != 2 || platforms[1] != "rule:backup:show-2" {
+		t.Errorf("Fail for platforms %v", platforms)
+	}
+	server.HSet(SRS_FORWARD_CONFIG, "wx", `{"platform":"wx","stream":"show-2","server":"rtmp://wx/live","secret":"test","enabled":true}`)
+	if err := worker.evaluateRules(ctx); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	} else if platforms := rules(); len(platforms) != 1 || platforms[0] != "rule:backup:show-1" {
+		t.Errorf("Fail for platforms %v", platforms)
+	}
+
+	// Remove the task when the stream is unpublished.
+	if err := rdb.HDel(ctx, SRS_STREAM_ACTIVE, "live/show-1").Err(); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	worker.OnStreamUnpublish(ctx, &SrsStream{App: "live", Stream: "show-1"})
+	if platforms := rules(); len(platforms) != 0 {
+		t.Errorf("Fail for platforms %v", platforms)
+	}
+}
@@ -0,0 +1,264 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The placeholders in the server pattern of forward template.
+const (
+	forwardTemplateRegion = "{region}"
+	forwardTemplateKey    = "{key}"
+)
+
+// ForwardTemplateRegion is an ingest region of platform.
+type ForwardTemplateRegion struct {
+	// The name for UI, for example, global.
+	Name string `json:"name"`
+	// The value to replace the {region} in server.
+	Value string `json:"value"`
+}
+
+// ForwardTemplate is a destination of popular platform, so user only needs to set the stream key, and the worker
+// composes the final URL.
+type ForwardTemplate struct {
+	// The template name, for example, youtube.
+	Name string `json:"name"`
+	// The label for UI, for example, YouTube.
+	Label string `json:"label"`
+	// The URL pattern of server, with {region} for region and {key} for stream key. The key is appended to the path
+	// if no {key} in pattern.
+	Server string `json:"server"`
+	// The regions to replace {region}, the first one is the default.
+	Regions []*ForwardTemplateRegion `json:"regions,omitempty"`
+	// The regular expression of stream key, to detect the mistyped keys, no check if empty.
+	KeyPattern string `json:"keyPattern,omitempty"`
+	// The example of stream key, for UI placeholder.
+	KeyExample string `json:"keyExample,omitempty"`
+	// The recommended keyframe interval in seconds, of the encoder which publishes the source stream.
+	Keyframe int `json:"keyframe,omitempty"`
+	// Whether overridden or added by operator in redis.
+	Custom bool `json:"custom,omitempty"`
+}
+
+func (v *ForwardTemplate) String() string {
+	return fmt.Sprintf("name=%v, label=%v, server=%v, regions=%v, keyPattern=%v, keyframe=%v, custom=%v",
+		v.Name, v.Label, v.Server, len(v.Regions), v.KeyPattern, v.Keyframe, v.Custom,
+	)
+}
+
+// The builtin templates of popular platforms, which can be overridden by SRS_FORWARD_TEMPLATES.
+var forwardBuiltinTemplates = []*ForwardTemplate{
+	{
+		Name: "youtube", Label: "YouTube", Server: "rtmp://{region}.rtmp.youtube.com/live2/{key}",
+		Regions: []*ForwardTemplateRegion{
+			{Name: "primary", Value: "a"},
+			{Name: "backup", Value: "b"},
+		},
+		KeyPattern: `^[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4}$`,
+		KeyExample: "xxxx-xxxx-xxxx-xxxx-xxxx", Keyframe: 2,
+	},
+	{
+		Name: "twitch", Label: "Twitch", Server: "rtmp://{region}/app/{key}",
+		Regions: []*ForwardTemplateRegion{
+			{Name: "global", Value: "ingest.global-contribute.live-video.net"},
+			{Name: "us-east", Value: "jfk.contribute.live-video.net"},
+			{Name: "eu-central", Value: "fra05.contribute.live-video.net"},
+			{Name: "asia-tokyo", Value: "tyo05.contribute.live-video.net"},
+		},
+		KeyPattern: `^live_[0-9]+_[A-Za-z0-9]+$`, KeyExample: "live_123456789_xxxxxxxx", Keyframe: 2,
+	},
+	{
+		Name: "bilibili", Label: "Bilibili", Server: "rtmp://live-push.bilivideo.com/live-bvc/{key}",
+		KeyPattern: `^\?streamname=live_[^&]+&key=[^&]+`, KeyExample: "?streamname=live_xxx&key=xxx", Keyframe: 2,
+	},
+	{
+		Name: "facebook", Label: "Facebook", Server: "rtmps://live-api-s.facebook.com:443/rtmp/{key}",
+		KeyPattern: `^FB-[0-9]+-`, KeyExample: "FB-123456789-0-xxxxxxxx", Keyframe: 2,
+	},
+}
+
+// Compose builds the server and secret, to publish to the region with the stream key. Use the first region if not
+// specified.
+func (v *ForwardTemplate) Compose(region, key string) (server, secret string) {
+	server = v.Server
+	if strings.Contains(server, forwardTemplateRegion) {
+		if region == "" && len(v.Regions) > 0 {
+			region = v.Regions[0].Value
+		}
+		for _, r := range v.Regions {
+			if r.Name == region {
+				region = r.Value
+			}
+		}
+		server = strings.ReplaceAll(server, forwardTemplateRegion, region)
+	}
+
+	// The key is in the server, so the secret is empty.
+	if strings.Contains(server, forwardTemplateKey) {
+		return strings.ReplaceAll(server, forwardTemplateKey, key), ""
+	}
+	return server, key
+}
+
+// Validate checks the region and stream key of forward config by template.
+func (v *ForwardTemplate) Validate(validation *ConfigValidation, region, key string) {
+	if region != "" && len(v.Regions) > 0 {
+		var found bool
+		for _, r := range v.Regions {
+			found = found || r.Name == region || r.Value == region
+		}
+		if !found {
+			var names []string
+			for _, r := range v.Regions {
+				names = append(names, r.Name)
+			}
+			validation.AddError("region", ConfigIssueInvalid, "region %v should be %v", region, strings.Join(names, ","))
+		}
+	}
+
+	if key == "" {
+		validation.AddError("secret", ConfigIssueRequired, "stream key is required by template %v", v.Name)
+	} else if v.KeyPattern != "" {
+		if re, err := regexp.Compile(v.KeyPattern); err != nil {
+			validation.AddError("template", ConfigIssueInvalid, "invalid key pattern of template %v", v.Name)
+		} else if !re.MatchString(key) {
+			validation.AddError("secret", ConfigIssueInvalid, "stream key of %v should be like %v",
+				v.Label, v.KeyExample,
+			)
+		}
+	}
+}
+
+// queryForwardTemplates returns the builtin templates, overridden or extended by SRS_FORWARD_TEMPLATES, sorted by
+// name.
+func queryForwardTemplates(ctx context.Context) ([]*ForwardTemplate, error) {
+	templates := make(map[string]*ForwardTemplate)
+	for _, t := range forwardBuiltinTemplates {
+		templates[t.Name] = t
+	}
+
+	items, err := rdb.HGetAll(ctx, SRS_FORWARD_TEMPLATES).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_FORWARD_TEMPLATES)
+	}
+	for name, item := range items {
+		var t ForwardTemplate
+		if err := json.Unmarshal([]byte(item), &t); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", name, item)
+		}
+		t.Name, t.Custom = name, true
+		templates[name] = &t
+	}
+
+	r := make([]*ForwardTemplate, 0, len(templates))
+	for _, t := range templates {
+		r = append(r, t)
+	}
+	sort.Slice(r, func(i, j int) bool {
+		return r[i].Name < r[j].Name
+	})
+	return r, nil
+}
+
+// queryForwardTemplate returns the template by name, or nil if not found.
+func queryForwardTemplate(ctx context.Context, name string) (*ForwardTemplate, error) {
+	templates, err := queryForwardTemplates(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query templates")
+	}
+
+	for _, t := range templates {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, nil
+}
+
+func handleFFmpegForwardTemplates(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/ffmpeg/forward/templates"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action string
+			var template ForwardTemplate
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Action *string `json:"action"`
+				*ForwardTemplate
+			}{
+				Token: &token, Action: &action, ForwardTemplate: &template,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if action != "" && action != "update" && action != "remove" {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+			}
+			if action != "" && template.Name == "" {
+				return newHttpStatusError(http.StatusBadRequest, errors.New("no name"))
+			}
+
+			if action == "update" {
+				if template.Server == "" {
+					return newHttpStatusError(http.StatusBadRequest, errors.New("no server"))
+				}
+				if strings.Contains(template.Server, forwardTemplateRegion) && len(template.Regions) == 0 {
+					return newHttpStatusError(http.StatusBadRequest, errors.Errorf("no regions for %v", template.Server))
+				}
+				if _, err := regexp.Compile(template.KeyPattern); err != nil {
+					return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "key pattern %v", template.KeyPattern))
+				}
+
+				template.Custom = false
+				if b, err := json.Marshal(&template); err != nil {
+					return errors.Wrapf(err, "marshal %v", template.String())
+				} else if err := rdb.HSet(ctx, SRS_FORWARD_TEMPLATES, template.Name, string(b)).Err(); err != nil {
+					return errors.Wrapf(err, "hset %v %v %v", SRS_FORWARD_TEMPLATES, template.Name, string(b))
+				}
+				logger.Tf(ctx, "forward template update ok, %v", template.String())
+			} else if action == "remove" {
+				// Only remove the template in redis, the builtin one is restored if overridden.
+				if err := rdb.HDel(ctx, SRS_FORWARD_TEMPLATES, template.Name).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", SRS_FORWARD_TEMPLATES, template.Name)
+				}
+				logger.Tf(ctx, "forward template remove ok, name=%v", template.Name)
+			}
+
+			templates, err := queryForwardTemplates(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query templates")
+			}
+
+			httpWriteData(ctx, w, r, templates)
+			logger.Tf(ctx, "forward templates ok, action=%v, templates=%v, token=%vB", action, len(templates), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
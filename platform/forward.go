@@ -12,12 +12,12 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	// From ossrs.
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
@@ -28,9 +28,13 @@ import (
 var forwardWorker *ForwardWorker
 
 type ForwardWorker struct {
+	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 
+	// To evaluate the rules one by one, see evaluateRules.
+	rulesLock sync.Mutex
+
 	// The tasks we have started to forward streams,, key is platform in string, value is *ForwardTask.
 	tasks sync.Map
 }
@@ -50,16 +54,23 @@ func (v *ForwardWorker) Handle(ctx context.Context, handler *http.ServeMux) erro
 	ep := "/terraform/v1/ffmpeg/forward/secret"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, action string
+			var push bool
 			var userConf ForwardConfigure
-			if err := ParseBody(ctx, r.Body, &struct {
+			validation, err := parseConfigBody(ctx, r, &struct {
 				Token  *string `json:"token"`
 				Action *string `json:"action"`
+				// For validate action, whether push a test stream to the target.
+				Push *bool `json:"push"`
 				*ForwardConfigure
 			}{
-				Token: &token, Action: &action, ForwardConfigure: &userConf,
-			}); err != nil {
+				Token: &token, Action: &action, Push: &push, ForwardConfigure: &userConf,
+			})
+			if err != nil {
 				return errors.Wrapf(err, "parse body")
 			}
 
@@ -68,31 +79,39 @@ func (v *ForwardWorker) Handle(ctx context.Context, handler *http.ServeMux) erro
 				return errors.Wrapf(err, "authenticate")
 			}
 
-			allowedActions := []string{"update"}
-			allowedPlatforms := []string{"wx", "bilibili", "kuaishou"}
-			if action != "" {
-				if !slicesContains(allowedActions, action) {
-					return errors.Errorf("invalid action=%v", action)
-				}
-
-				if userConf.Platform == "" {
-					return errors.New("no platform")
-				}
-
-				// Platform should be specified platforms, or starts with forwarding-.
-				if !slicesContains(allowedPlatforms, userConf.Platform) && !strings.Contains(userConf.Platform, "forwarding-") {
-					return errors.Errorf("invalid platform=%v", userConf.Platform)
+			var template *ForwardTemplate
+			if userConf.Template != "" {
+				if template, err = queryForwardTemplate(ctx, userConf.Template); err != nil {
+					return errors.Wrapf(err, "query template %v", userConf.Template)
 				}
+			}
 
-				if userConf.Server == "" {
-					return errors.New("no server")
-				}
-				if userConf.Server == "" && userConf.Secret == "" {
-					return errors.New("no secret")
+			validateConfigAction(validation, action, []string{"update", "validate"})
+			if action != "" {
+				userConf.Validate(validation, action == "update", template)
+			}
+			if err := validation.Err(); err != nil {
+				return errors.Wrapf(err, "validate %v", userConf.String())
+			}
+			for _, issue := range validation.Warnings {
+				logger.Wf(ctx, "Forward ignore config issue, %v", issue.String())
+			}
+			if action == "update" && userConf.Stream != "" {
+				if err := verifyStreamName(ctx, userConf.Stream); err != nil {
+					return errors.Wrapf(err, "verify stream name")
 				}
 			}
 
-			if action == "update" {
+			if action == "validate" {
+				checker := NewStreamChecker()
+				server, secret := userConf.Target(template)
+				checker.CheckTarget(ctx, server, secret, push)
+
+				httpWriteData(ctx, w, r, checker)
+				logger.Tf(ctx, "Forward validate secret ok, platform=%v, push=%v, %v, token=%vB",
+					userConf.Platform, push, checker.String(), len(token))
+				return nil
+			} else if action == "update" {
 				var targetConf ForwardConfigure
 				if config, err := rdb.HGet(ctx, SRS_FORWARD_CONFIG, userConf.Platform).Result(); err != nil && err != redis.Nil {
 					return errors.Wrapf(err, "hget %v %v", SRS_FORWARD_CONFIG, userConf.Platform)
@@ -118,8 +137,8 @@ func (v *ForwardWorker) Handle(ctx context.Context, handler *http.ServeMux) erro
 					}
 				}
 
-				ohttp.WriteData(ctx, w, r, nil)
-				logger.Tf(ctx, "Forward update secret ok, token=%vB", len(token))
+				httpWriteData(ctx, w, r, validation)
+				logger.Tf(ctx, "Forward update secret ok, warnings=%v, token=%vB", len(validation.Warnings), len(token))
 				return nil
 			} else {
 				confObjs := make(map[string]*ForwardConfigure)
@@ -135,24 +154,29 @@ func (v *ForwardWorker) Handle(ctx context.Context, handler *http.ServeMux) erro
 					}
 				}
 
-				ohttp.WriteData(ctx, w, r, confObjs)
+				httpWriteData(ctx, w, r, confObjs)
 				logger.Tf(ctx, "forward query configures ok, token=%vB", len(token))
 				return nil
 			}
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ffmpeg/forward/streams"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
-				Token *string `json:"token"`
+			var history bool
+			if err := ParseBody(ctx, r, &struct {
+				Token   *string `json:"token"`
+				History *bool   `json:"history"`
 			}{
-				Token: &token,
+				Token: &token, History: &history,
 			}); err != nil {
 				return errors.Wrapf(err, "parse body")
 			}
@@ -173,9 +197,15 @@ func (v *ForwardWorker) Handle(ctx context.Context, handler *http.ServeMux) erro
 					}
 
 					var pid int32
-					var streamURL, frame, update, starttime, ready string
+					var streamURL, frame, update, starttime, ready, warning string
+					status, taskErr := TaskStatusWaiting, ""
 					if task := v.GetTask(config.Platform); task != nil {
 						pid, streamURL, frame, update, starttime, ready = task.queryFrame()
+						status, taskErr = task.queryStatus()
+						warning = task.queryWarning()
+					}
+					if !config.Enabled {
+						status, taskErr = TaskStatusDisabled, ""
 					}
 
 					elem := map[string]interface{}{
@@ -183,6 +213,14 @@ func (v *ForwardWorker) Handle(ctx context.Context, handler *http.ServeMux) erro
 						"enabled":  config.Enabled,
 						"custom":   config.Customed,
 						"label":    config.Label,
+						"status":   status,
+					}
+
+					if taskErr != "" {
+						elem["error"] = taskErr
+					}
+					if warning != "" {
+						elem["warning"] = warning
 					}
 
 					if pid > 0 {
@@ -195,22 +233,42 @@ func (v *ForwardWorker) Handle(ctx context.Context, handler *http.ServeMux) erro
 						}
 					}
 
+					// Query the task history if required, the latest event first.
+					if task := v.GetTask(config.Platform); history && task != nil {
+						if events, err := queryTaskHistory(ctx, task.UUID); err != nil {
+							return errors.Wrapf(err, "query history of %v", task.String())
+						} else {
+							elem["history"] = events
+						}
+					}
+
 					res = append(res, elem)
 				}
 			}
 
+			// The tasks created by rules for the published streams.
+			if elems, err := v.queryRuleStreams(ctx, history); err != nil {
+				return errors.Wrapf(err, "query rule streams")
+			} else {
+				res = append(res, elems...)
+			}
+
 			sort.Slice(res, func(i, j int) bool {
 				return res[i]["platform"].(string) < res[j]["platform"].(string)
 			})
 
-			ohttp.WriteData(ctx, w, r, res)
+			httpWriteData(ctx, w, r, res)
 			logger.Tf(ctx, "Query forward streams ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
+	handleFFmpegForwardTemplates(ctx, handler)
+	handleFFmpegForwardIntegrations(ctx, handler)
+	v.handleRules(ctx, handler)
+
 	return nil
 }
 
@@ -222,6 +280,24 @@ func (v *ForwardWorker) Close() error {
 	return nil
 }
 
+// Reset stops and removes all tasks, including the tasks of rules, returns the number of tasks. The configures should
+// be removed before, or the tasks are created again, see resetForward.
+func (v *ForwardWorker) Reset(ctx context.Context, reason string) int {
+	var n int
+	v.tasks.Range(func(key, value interface{}) bool {
+		task := value.(*ForwardTask)
+		v.tasks.Delete(key)
+		task.Stop(ctx, reason)
+		if task.close != nil {
+			task.close()
+		}
+		logger.Tf(ctx, "forward: reset task %v, reason=%v", task.String(), reason)
+		n++
+		return true
+	})
+	return n
+}
+
 func (v *ForwardWorker) Start(ctx context.Context) error {
 	wg := &v.wg
 
@@ -229,28 +305,13 @@ func (v *ForwardWorker) Start(ctx context.Context) error {
 	v.cancel = cancel
 
 	ctx = logger.WithContext(ctx)
+	v.ctx = ctx
 	logger.Tf(ctx, "forward start a worker")
 
-	// Load tasks from redis and force to kill all.
-	if objs, err := rdb.HGetAll(ctx, SRS_FORWARD_TASK).Result(); err != nil && err != redis.Nil {
-		return errors.Wrapf(err, "hgetall %v", SRS_FORWARD_TASK)
-	} else if len(objs) > 0 {
-		for uuid, obj := range objs {
-			logger.Tf(ctx, "Load task %v object %v", uuid, obj)
-
-			var task ForwardTask
-			if err = json.Unmarshal([]byte(obj), &task); err != nil {
-				return errors.Wrapf(err, "unmarshal %v %v", uuid, obj)
-			}
-
-			if task.PID > 0 {
-				task.cleanup(ctx)
-			}
-		}
-
-		if err = rdb.Del(ctx, SRS_FORWARD_TASK).Err(); err != nil && err != redis.Nil {
-			return errors.Wrapf(err, "del %v", SRS_FORWARD_TASK)
-		}
+	// Reconcile the tasks in redis with the configures, and force to kill all.
+	taskUUIDs, err := v.reconcileTasks(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "reconcile tasks")
 	}
 
 	// Load all configurations from redis.
@@ -269,17 +330,31 @@ func (v *ForwardWorker) Start(ctx context.Context) error {
 				return errors.Wrapf(err, "unmarshal %v %v", platform, configItem)
 			}
 
+			// Restore the task with the same UUID after restart.
+			taskUUID := taskUUIDs[config.Platform]
+			if taskUUID == "" {
+				taskUUID = uuid.NewString()
+			}
+
+			// The task quits when the worker quits, or closed by Reset.
+			taskCtx, taskClose := context.WithCancel(ctx)
+
 			var task *ForwardTask
 			if tv, loaded := v.tasks.LoadOrStore(config.Platform, &ForwardTask{
-				UUID:     uuid.NewString(),
+				UUID:     taskUUID,
 				Platform: config.Platform,
 				config:   &config,
+				close:    taskClose,
 			}); loaded {
 				// Ignore if exists.
+				taskClose()
 				continue
 			} else {
 				task = tv.(*ForwardTask)
 				logger.Tf(ctx, "Forward create platform=%v task is %v", platform, task.String())
+				recordTaskEvent(ctx, &TaskEvent{
+					Worker: "forward", Task: task.UUID, Platform: task.Platform, Event: TaskEventCreated,
+				})
 			}
 
 			// Initialize object.
@@ -294,9 +369,16 @@ func (v *ForwardWorker) Start(ctx context.Context) error {
 			go func() {
 				defer wg.Done()
 
-				if err := task.Run(ctx); err != nil {
+				if err := task.Run(taskCtx); err != nil {
 					logger.Wf(ctx, "run task %v err %+v", task.String(), err)
 				}
+
+				// Remove the task closed by Reset, but keep it to restore after restart if the worker quits.
+				if ctx.Err() == nil {
+					if err := rdb.HDel(ctx, SRS_FORWARD_TASK, task.UUID).Err(); err != nil && err != redis.Nil {
+						logger.Wf(ctx, "ignore hdel %v %v err %+v", SRS_FORWARD_TASK, task.UUID, err)
+					}
+				}
 			}()
 		}
 
@@ -317,7 +399,12 @@ func (v *ForwardWorker) Start(ctx context.Context) error {
 		for ctx.Err() == nil {
 			duration := 3 * time.Second
 			if err := loadTasks(); err != nil {
-				logger.Wf(ctx, "ignore err %+v", err)
+				logThrottle.Wf(ctx, err.Error(), "ignore err %+v", err)
+				duration = 10 * time.Second
+			}
+			// Recover the tasks of rules, for example, the hook is missed.
+			if err := v.evaluateRules(ctx); err != nil {
+				logThrottle.Wf(ctx, err.Error(), "ignore rules err %+v", err)
 				duration = 10 * time.Second
 			}
 
@@ -331,6 +418,59 @@ func (v *ForwardWorker) Start(ctx context.Context) error {
 	return nil
 }
 
+// reconcileTasks reconciles the task records in redis, which is the runtime state, with the configures,
+// which is the desired state. It kills the stale FFmpeg, removes the tasks whose configure is gone, and
+// returns the UUID of other tasks, key is platform, so that the tasks are restored after restart.
+func (v *ForwardWorker) reconcileTasks(ctx context.Context) (map[string]string, error) {
+	configs, err := rdb.HGetAll(ctx, SRS_FORWARD_CONFIG).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_FORWARD_CONFIG)
+	}
+
+	objs, err := rdb.HGetAll(ctx, SRS_FORWARD_TASK).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_FORWARD_TASK)
+	}
+
+	taskUUIDs := make(map[string]string)
+	for id, obj := range objs {
+		logger.Tf(ctx, "Load task %v object %v", id, obj)
+
+		var task ForwardTask
+		if err = json.Unmarshal([]byte(obj), &task); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", id, obj)
+		}
+
+		if task.PID > 0 {
+			task.cleanup(ctx)
+		}
+
+		// Remove the task if its configure is gone, or there is already a task for the platform.
+		configItem, ok := configs[task.Platform]
+		if !ok || taskUUIDs[task.Platform] != "" {
+			if err = rdb.HDel(ctx, SRS_FORWARD_TASK, id).Err(); err != nil && err != redis.Nil {
+				return nil, errors.Wrapf(err, "hdel %v %v", SRS_FORWARD_TASK, id)
+			}
+			logger.Tf(ctx, "forward remove stale task %v, platform=%v", id, task.Platform)
+			continue
+		}
+
+		task.config = &ForwardConfigure{}
+		if err = json.Unmarshal([]byte(configItem), task.config); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", task.Platform, configItem)
+		}
+
+		// Reset the runtime state, which is updated when task runs.
+		task.PID, task.Status, task.Error = 0, TaskStatusWaiting, ""
+		if err = task.saveTask(ctx); err != nil {
+			return nil, errors.Wrapf(err, "save task")
+		}
+		taskUUIDs[task.Platform] = task.UUID
+	}
+
+	return taskUUIDs, nil
+}
+
 // ForwardConfigure is the configure for forwarding.
 type ForwardConfigure struct {
 	// The platform name, for example, wx
@@ -347,11 +487,17 @@ type ForwardConfigure struct {
 	Customed bool `json:"custom"`
 	// The label for this configure.
 	Label string `json:"label"`
+	// The destination template, for example, youtube, then the secret is the stream key and the server is
+	// composed by template, see ForwardTemplate.
+	Template string `json:"template,omitempty"`
+	// The region of template, use the first region of template if empty.
+	Region string `json:"region,omitempty"`
 }
 
 func (v *ForwardConfigure) String() string {
-	return fmt.Sprintf("platform=%v, stream=%v, server=%v, secret=%v, enabled=%v, customed=%v, label=%v",
-		v.Platform, v.Stream, v.Server, v.Secret, v.Enabled, v.Customed, v.Label,
+	return fmt.Sprintf("platform=%v, stream=%v, server=%v, secret=%v, enabled=%v, customed=%v, label=%v, "+
+		"template=%v, region=%v",
+		v.Platform, v.Stream, v.Server, v.Secret, v.Enabled, v.Customed, v.Label, v.Template, v.Region,
 	)
 }
 
@@ -363,15 +509,51 @@ func (v *ForwardConfigure) Update(u *ForwardConfigure) error {
 	v.Label = u.Label
 	v.Enabled = u.Enabled
 	v.Customed = u.Customed
+	v.Template = u.Template
+	v.Region = u.Region
 	return nil
 }
 
+// Target returns the server and secret to publish to, which is composed by template if specified.
+func (v *ForwardConfigure) Target(template *ForwardTemplate) (server, secret string) {
+	if v.Template != "" && template != nil {
+		return template.Compose(v.Region, v.Secret)
+	}
+	return v.Server, v.Secret
+}
+
+// Validate collects all issues of the configure, the target URL is only validated for update, because the validate
+// action reports it by the checker. The template should be loaded by queryForwardTemplate, nil if not found.
+func (v *ForwardConfigure) Validate(validation *ConfigValidation, update bool, template *ForwardTemplate) {
+	// Platform should be specified platforms, or starts with forwarding-.
+	validateConfigPlatform(validation, v.Platform, []string{"wx", "bilibili", "kuaishou"}, "forwarding-")
+
+	if v.Template != "" {
+		if template == nil {
+			validation.AddError("template", ConfigIssueInvalid, "template %v not found", v.Template)
+			return
+		}
+		template.Validate(validation, v.Region, v.Secret)
+	}
+
+	server, secret := v.Target(template)
+	if !update {
+		if server == "" {
+			validation.AddError("server", ConfigIssueRequired, "server is required")
+		}
+	} else {
+		validateConfigTarget(validation, server, secret)
+	}
+}
+
 // ForwardTask is a task for FFmpeg to forward stream, with a configure.
 type ForwardTask struct {
 	// The ID for task.
 	UUID string `json:"uuid"`
 	// The platform for task.
 	Platform string `json:"platform"`
+	// The name of rule which creates the task, empty for the task of configure, see ForwardRule.
+	Rule string `json:"rule,omitempty"`
 
 	// The input url.
 	Input string `json:"input"`
@@ -382,6 +564,12 @@ type ForwardTask struct {
 
 	// FFmpeg pid.
 	PID int32 `json:"pid"`
+	// The runtime status of task.
+	Status TaskStatus `json:"status"`
+	// The last error of task, if status is error.
+	Error string `json:"error,omitempty"`
+	// The warning of task, for example, failed to update the metadata of destination, see updateMetadata.
+	Warning string `json:"warning,omitempty"`
 	// FFmpeg last frame.
 	frame string
 	// The last update time.
@@ -393,6 +581,8 @@ type ForwardTask struct {
 
 	// The context for current task.
 	cancel context.CancelFunc
+	// To quit the task, see removeRuleTask and Reset.
+	close context.CancelFunc
 
 	// The configure for forwarding task.
 	config *ForwardConfigure
@@ -447,6 +637,11 @@ func (v *ForwardTask) Restart(ctx context.Context) error {
 		v.cancel()
 	}
 
+	// The configure of rule task is never changed, see evaluateRules.
+	if v.Rule != "" {
+		return nil
+	}
+
 	// Reload config from redis.
 	if b, err := rdb.HGet(ctx, SRS_FORWARD_CONFIG, v.Platform).Result(); err != nil {
 		return errors.Wrapf(err, "hget %v %v", SRS_FORWARD_CONFIG, v.Platform)
@@ -454,9 +649,74 @@ func (v *ForwardTask) Restart(ctx context.Context) error {
 		return errors.Wrapf(err, "unmarshal %v", b)
 	}
 
+	recordTaskEvent(ctx, &TaskEvent{
+		Worker: "forward", Task: v.UUID, Platform: v.Platform, Event: TaskEventRestarted, Message: "config changed",
+	})
+
 	return nil
 }
 
+// Stop the FFmpeg if running, for example, the feature is disabled, and record the reason.
+func (v *ForwardTask) Stop(ctx context.Context, reason string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.cancel == nil || v.PID <= 0 {
+		return
+	}
+	v.cancel()
+
+	recordTaskEvent(ctx, &TaskEvent{
+		Worker: "forward", Task: v.UUID, Platform: v.Platform, Event: TaskEventStopped, PID: v.PID, Message: reason,
+	})
+}
+
+// updateStatus updates the runtime status, and returns whether it's changed.
+func (v *ForwardTask) updateStatus(status TaskStatus, err error) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var msg string
+	if err != nil {
+		msg = err.Error()
+	}
+
+	changed := v.Status != status || v.Error != msg
+	v.Status, v.Error = status, msg
+	return changed
+}
+
+// setStatus updates the runtime status, and saves the task if changed.
+func (v *ForwardTask) setStatus(ctx context.Context, status TaskStatus, err error) error {
+	if !v.updateStatus(status, err) {
+		return nil
+	}
+	return v.saveTask(ctx)
+}
+
+// setWarning sets the warning of task, which never changes the status, clear it if err is nil.
+func (v *ForwardTask) setWarning(err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.Warning = ""
+	if err != nil {
+		v.Warning = err.Error()
+	}
+}
+
+func (v *ForwardTask) queryWarning() string {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.Warning
+}
+
+func (v *ForwardTask) queryStatus() (TaskStatus, string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.Status, v.Error
+}
+
 func (v *ForwardTask) updateFrame(frame string) {
 	v.lock.Lock()
 	defer v.lock.Unlock()
@@ -467,6 +727,12 @@ func (v *ForwardTask) updateFrame(frame string) {
 	v.update = &now
 }
 
+func (v *ForwardTask) queryConfig() ForwardConfigure {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return *v.config
+}
+
 func (v *ForwardTask) queryFrame() (int32, string, string, string, string, string) {
 	v.lock.Lock()
 	defer v.lock.Unlock()
@@ -557,9 +823,21 @@ func (v *ForwardTask) Run(ctx context.Context) error {
 	}
 
 	pfn := func(ctx context.Context) error {
+		// Ignore when the feature is disabled for this install.
+		if enabled, err := isFeatureEnabled(ctx, FeatureForward); err != nil {
+			return errors.Wrapf(err, "query feature")
+		} else if !enabled {
+			return v.setStatus(ctx, TaskStatusDisabled, nil)
+		}
+
 		// Ignore when not enabled.
 		if !v.config.Enabled {
-			return nil
+			return v.setStatus(ctx, TaskStatusDisabled, nil)
+		}
+
+		// Hold the FFmpeg until SRS is accepting connections, rather than failing and delaying by the backoff.
+		if !srsReadiness.Ready() {
+			return v.setStatus(ctx, TaskStatusWaitingSrs, nil)
 		}
 
 		// Use a active stream as input.
@@ -568,8 +846,9 @@ func (v *ForwardTask) Run(ctx context.Context) error {
 			return errors.Wrapf(err, "select input")
 		}
 
+		// Wait for the source stream to be published.
 		if input == nil {
-			return nil
+			return v.setStatus(ctx, TaskStatusWaiting, nil)
 		}
 
 		// Start forward task.
@@ -582,10 +861,18 @@ func (v *ForwardTask) Run(ctx context.Context) error {
 
 	for ctx.Err() == nil {
 		if err := pfn(ctx); err != nil {
-			logger.Wf(ctx, "ignore %v err %+v", v.String(), err)
+			logThrottle.Wf(ctx, fmt.Sprintf("%v %v", v.UUID, err.Error()), "ignore %v err %+v", v.String(), err)
+
+			if ctx.Err() == nil {
+				if err := v.setStatus(ctx, TaskStatusError, err); err != nil {
+					logger.Wf(ctx, "ignore save status err %+v", err)
+				}
+			}
 
+			// Reset the backoff if SRS is ready again, for example, the FFmpeg fails because SRS restarts.
 			select {
 			case <-ctx.Done():
+			case <-srsReadiness.Regained():
 			case <-time.After(3500 * time.Millisecond):
 			}
 			continue
@@ -604,18 +891,35 @@ func (v *ForwardTask) doForward(ctx context.Context, input *SrsStream) error {
 	// Create context for current task.
 	parentCtx := ctx
 	ctx, cancel := context.WithCancel(ctx)
-	v.cancel = cancel
+	// Whether canceled by restart, to distinguish from the FFmpeg failure in task history.
+	var restarted int32
+	v.cancel = func() {
+		atomic.StoreInt32(&restarted, 1)
+		cancel()
+	}
 
 	// Build input URL.
 	host := "localhost"
 	inputURL := fmt.Sprintf("rtmp://%v/%v/%v", host, input.App, input.Stream)
 
-	// Build output URL.
-	outputServer := strings.ReplaceAll(v.config.Server, "localhost", host)
-	if !strings.HasSuffix(outputServer, "/") && !strings.HasPrefix(v.config.Secret, "/") && v.config.Secret != "" {
+	// Build output URL, compose by the template if specified.
+	var template *ForwardTemplate
+	if v.config.Template != "" {
+		if t, err := queryForwardTemplate(ctx, v.config.Template); err != nil {
+			return errors.Wrapf(err, "query template %v", v.config.Template)
+		} else if t == nil {
+			return errors.Errorf("template %v not found", v.config.Template)
+		} else {
+			template = t
+		}
+	}
+	server, secret := v.config.Target(template)
+
+	outputServer := strings.ReplaceAll(server, "localhost", host)
+	if !strings.HasSuffix(outputServer, "/") && !strings.HasPrefix(secret, "/") && secret != "" {
 		outputServer += "/"
 	}
-	outputURL := fmt.Sprintf("%v%v", outputServer, v.config.Secret)
+	outputURL := fmt.Sprintf("%v%v", outputServer, secret)
 
 	// Create a heartbeat to poll and manage the status of FFmpeg process.
 	heartbeat := NewFFmpegHeartbeat(cancel)
@@ -663,6 +967,9 @@ func (v *ForwardTask) doForward(ctx context.Context, input *SrsStream) error {
 	}
 
 	v.PID = int32(cmd.Process.Pid)
+	recordTaskEvent(ctx, &TaskEvent{
+		Worker: "forward", Task: v.UUID, Platform: v.Platform, Event: TaskEventStarted, PID: v.PID,
+	})
 	v.Input, v.inputStreamURL, v.Output = inputURL, input.StreamURL(), outputURL
 	defer func() {
 		// If we got a PID, sleep for a while, to avoid too fast restart.
@@ -679,10 +986,14 @@ func (v *ForwardTask) doForward(ctx context.Context, input *SrsStream) error {
 	}()
 	logger.Tf(ctx, "forward start, platform=%v, stream=%v, pid=%v", v.Platform, input.StreamURL(), v.PID)
 
+	v.updateStatus(TaskStatusRunning, nil)
 	if err := v.saveTask(ctx); err != nil {
 		return errors.Wrapf(err, "save task %v", v.String())
 	}
 
+	// Update the metadata of destination, which never blocks or fails the forwarding.
+	go v.updateMetadata(ctx, input)
+
 	// Pull the latest log frame.
 	heartbeat.Polling(ctx, stderr)
 	go func() {
@@ -717,5 +1028,9 @@ func (v *ForwardTask) doForward(ctx context.Context, input *SrsStream) error {
 		v.Platform, input.StreamURL(), v.PID, err,
 	)
 
+	// Record the exit in task history, use parentCtx because ctx might be cancelled.
+	stopped := parentCtx.Err() != nil || atomic.LoadInt32(&restarted) == 1
+	recordTaskExit(parentCtx, "forward", v.UUID, v.Platform, v.PID, stopped, heartbeat, err)
+
 	return err
 }
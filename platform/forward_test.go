@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestForward_RestoreTasksAfterRestart(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	// Use a fake FFmpeg, which runs until killed.
+	binDir := t.TempDir()
+	if err := os.WriteFile(path.Join(binDir, "ffmpeg"), []byte("#!/bin/sh\nexec sleep 30\n"), 0755); err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", fmt.Sprintf("%v:%v", binDir, oldPath))
+	defer os.Setenv("PATH", oldPath)
+
+	server := setupFakeRedis(t)
+
+	// The desired state, and the runtime state left by last run.
+	server.HSet(SRS_FORWARD_CONFIG, "wx", `{"platform":"wx","server":"rtmp://127.0.0.1/live","secret":"test","enabled":true}`)
+	server.HSet(SRS_FORWARD_CONFIG, "bilibili", `{"platform":"bilibili","stream":"other","server":"rtmp://127.0.0.1/live","secret":"test","enabled":true}`)
+	server.HSet(SRS_FORWARD_CONFIG, "kuaishou", `{"platform":"kuaishou","server":"rtmp://127.0.0.1/live","secret":"test","enabled":false}`)
+	server.HSet(SRS_FORWARD_TASK, "task-wx", `{"uuid":"task-wx","platform":"wx","status":"running"}`)
+	server.HSet(SRS_FORWARD_TASK, "task-gone", `{"uuid":"task-gone","platform":"gone","status":"running"}`)
+	server.HSet(SRS_STREAM_ACTIVE, "live/livestream", `{"vhost":"__defaultVhost__","app":"live","stream":"livestream"}`)
+
+	worker := NewForwardWorker()
+	if err := worker.Start(ctx); err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	defer worker.Close()
+
+	// The task of removed platform should be cleaned up.
+	if _, ok := server.HGet(SRS_FORWARD_TASK, "task-gone"); ok {
+		t.Errorf("Fail for task-gone not removed")
+	}
+
+	// Wait for tasks to be restored.
+	expects := map[string]TaskStatus{
+		"wx": TaskStatusRunning, "bilibili": TaskStatusWaiting, "kuaishou": TaskStatusDisabled,
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for platform, expect := range expects {
+		for {
+			var status TaskStatus
+			if task := worker.GetTask(platform); task != nil {
+				status, _ = task.queryStatus()
+			}
+			if status == expect {
+				break
+			}
+
+			if time.Now().After(deadline) {
+				t.Errorf("Fail for platform %v status %v, should be %v", platform, status, expect)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+
+	// The task should be restored with the same UUID.
+	if task := worker.GetTask("wx"); task.UUID != "task-wx" {
+		t.Errorf("Fail for task %v, should be task-wx", task.UUID)
+	} else if pid, _, _, _, _, _ := task.queryFrame(); pid <= 0 {
+		t.Errorf("Fail for pid %v, should be running", pid)
+	}
+}
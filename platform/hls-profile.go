@@ -0,0 +1,244 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// HLSProfile is the latency profile of HLS stream.
+type HLSProfile string
+
+const (
+	// The normal HLS, about 10s latency, with larger fragment and window, and longer playlist cache.
+	HLSProfileNormal HLSProfile = "normal"
+	// The low latency HLS, about 3s latency, with smaller fragment and window, and shorter playlist cache.
+	HLSProfileLow HLSProfile = "low"
+)
+
+// Fragment returns the HLS fragment duration in seconds.
+func (v HLSProfile) Fragment() int {
+	if v == HLSProfileLow {
+		return 2
+	}
+	return 10
+}
+
+// Window returns the HLS window duration in seconds.
+func (v HLSProfile) Window() int {
+	if v == HLSProfileLow {
+		return 16
+	}
+	return 60
+}
+
+// PlaylistMaxAge returns the cache max-age of m3u8 in seconds, which should be smaller than the fragment.
+func (v HLSProfile) PlaylistMaxAge() int {
+	if v == HLSProfileLow {
+		return 1
+	}
+	return 10
+}
+
+// HLSProfileState is the configured and effective profile of a stream.
+type HLSProfileState struct {
+	// The profile configured for this stream.
+	Profile HLSProfile `json:"profile"`
+	// The profile in effect, which is low if the global low latency HLS is enabled.
+	Effective HLSProfile `json:"effective"`
+	// The effective fragment duration in seconds.
+	Fragment int `json:"fragment"`
+}
+
+// queryHLSProfiles returns the profiles of streams, the key is stream URL such as live/livestream. The streams not in
+// the result use the normal profile.
+func queryHLSProfiles(ctx context.Context) (map[string]HLSProfile, error) {
+	values, err := rdb.HGetAll(ctx, SRS_HLS_PROFILE).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_HLS_PROFILE)
+	}
+
+	profiles := make(map[string]HLSProfile)
+	for streamURL, value := range values {
+		profiles[streamURL] = HLSProfile(value)
+	}
+	return profiles, nil
+}
+
+// queryHLSProfileStates returns the effective profile of streams.
+func queryHLSProfileStates(ctx context.Context, streamURLs []string) (map[string]*HLSProfileState, error) {
+	profiles, err := queryHLSProfiles(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query profiles")
+	}
+
+	hlsLowLatency, err := rdb.HGet(ctx, SRS_LL_HLS, "hlsLowLatency").Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v hlsLowLatency", SRS_LL_HLS)
+	}
+
+	states := make(map[string]*HLSProfileState)
+	for _, streamURL := range streamURLs {
+		profile, ok := profiles[streamURL]
+		if !ok {
+			profile = HLSProfileNormal
+		}
+
+		effective := profile
+		if hlsLowLatency == "true" {
+			effective = HLSProfileLow
+		}
+		states[streamURL] = &HLSProfileState{Profile: profile, Effective: effective, Fragment: effective.Fragment()}
+	}
+	return states, nil
+}
+
+// validateHLSProfile verify the profile, and the keyframe interval in seconds, which is zero if unknown. Because SRS
+// only cuts the fragment at keyframe, the fragment is never smaller than the keyframe interval.
+func validateHLSProfile(profile HLSProfile, gop float64) error {
+	if profile != HLSProfileNormal && profile != HLSProfileLow {
+		return errors.Errorf("invalid profile %v", profile)
+	}
+
+	if gop > float64(profile.Fragment()) {
+		return errors.Errorf("keyframe interval %.1fs exceeds the %v fragment %vs", gop, profile, profile.Fragment())
+	}
+	return nil
+}
+
+func handleMgmtHlsProfile(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/hls/profile/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, app, stream string
+			var profile HLSProfile
+			if err := ParseBody(ctx, r, &struct {
+				Token   *string     `json:"token"`
+				App     *string     `json:"app"`
+				Stream  *string     `json:"stream"`
+				Profile *HLSProfile `json:"profile"`
+			}{
+				Token: &token, App: &app, Stream: &stream, Profile: &profile,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if app == "" {
+				app = "live"
+			}
+			if stream == "" || strings.ContainsAny(app+stream, "/ \t\r\n") {
+				return errors.Errorf("invalid app=%v, stream=%v", app, stream)
+			}
+			if err := verifyStreamName(ctx, stream); err != nil {
+				return errors.Wrapf(err, "verify stream name")
+			}
+			streamURL := fmt.Sprintf("%v/%v", app, stream)
+
+			// Use the keyframe interval of the latest probe, if the stream is previewed.
+			var gop float64
+			if preview := streamPreviewer.Cached(streamURL); preview != nil {
+				gop = preview.GOP
+			}
+			if err := validateHLSProfile(profile, gop); err != nil {
+				return errors.Wrapf(err, "validate")
+			}
+
+			if profile == HLSProfileNormal {
+				if err := rdb.HDel(ctx, SRS_HLS_PROFILE, streamURL).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", SRS_HLS_PROFILE, streamURL)
+				}
+			} else if err := rdb.HSet(ctx, SRS_HLS_PROFILE, streamURL, string(profile)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v %v %v", SRS_HLS_PROFILE, streamURL, profile)
+			}
+
+			// Reload SRS, which starts a new fragment by the new config, so the live stream is not dropped.
+			if err := srsGenerateConfig(ctx); err != nil {
+				return errors.Wrapf(err, "generate SRS config")
+			}
+			if err := fastCache.Refresh(ctx); err != nil {
+				return errors.Wrapf(err, "refresh cache")
+			}
+
+			states, err := queryHLSProfileStates(ctx, []string{streamURL})
+			if err != nil {
+				return errors.Wrapf(err, "query states")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				*HLSProfileState
+				Hash string `json:"hash"`
+			}{
+				HLSProfileState: states[streamURL], Hash: renderedConfigHash(),
+			})
+			logger.Tf(ctx, "hls profile update ok, stream=%v, profile=%v, gop=%v, token=%vB",
+				streamURL, profile, gop, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/hls/profile/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			profiles, err := queryHLSProfiles(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query profiles")
+			}
+
+			var streamURLs []string
+			for streamURL := range profiles {
+				streamURLs = append(streamURLs, streamURL)
+			}
+
+			states, err := queryHLSProfileStates(ctx, streamURLs)
+			if err != nil {
+				return errors.Wrapf(err, "query states")
+			}
+
+			httpWriteData(ctx, w, r, states)
+			logger.Tf(ctx, "hls profile query ok, profiles=%v, token=%vB", len(states), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
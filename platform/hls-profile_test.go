@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestHLSProfile_Validate(t *testing.T) {
+	if err := validateHLSProfile(HLSProfileLow, 0); err != nil {
+		t.Errorf("Fail for unknown gop, err %+v", err)
+	}
+	if err := validateHLSProfile(HLSProfileLow, 2); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if err := validateHLSProfile(HLSProfileLow, 4); err == nil {
+		t.Errorf("Fail for gop 4s larger than fragment")
+	}
+	if err := validateHLSProfile(HLSProfileNormal, 4); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if err := validateHLSProfile("ultra", 0); err == nil {
+		t.Errorf("Fail for invalid profile")
+	}
+}
+
+func TestHLSProfile_EffectiveProfile(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	server.HSet(SRS_HLS_PROFILE, "live/show", string(HLSProfileLow))
+
+	states, err := queryHLSProfileStates(ctx, []string{"live/show", "live/livestream"})
+	if err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	if s := states["live/show"]; s.Profile != HLSProfileLow || s.Effective != HLSProfileLow || s.Fragment != 2 {
+		t.Errorf("Fail for state %v", s)
+	}
+	if s := states["live/livestream"]; s.Profile != HLSProfileNormal || s.Effective != HLSProfileNormal || s.Fragment != 10 {
+		t.Errorf("Fail for state %v", s)
+	}
+
+	// The global low latency overwrites the profile of each stream.
+	server.HSet(SRS_LL_HLS, "hlsLowLatency", "true")
+	if states, err := queryHLSProfileStates(ctx, []string{"live/livestream"}); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	} else if s := states["live/livestream"]; s.Profile != HLSProfileNormal || s.Effective != HLSProfileLow {
+		t.Errorf("Fail for state %v", s)
+	}
+
+	// The playlist cache is per stream.
+	cache := NewFastCache()
+	if err := cache.Refresh(ctx); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if cache.HLSProfile("live/show").PlaylistMaxAge() != 1 || cache.HLSProfile("live/livestream").PlaylistMaxAge() != 10 {
+		t.Errorf("Fail for profiles %v", cache.hlsProfiles)
+	}
+}
@@ -0,0 +1,593 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max duration in seconds to rewind a time-shift stream.
+const hlsTimeShiftMaxDuration = 3600
+
+// The interval for janitor to trim the time-shift streams, and remove the segments of disabled streams.
+const hlsTimeShiftJanitorInterval = 10 * time.Second
+
+// The default disk budget in MB for all time-shift streams, see HLS_TIMESHIFT_BUDGET.
+const hlsTimeShiftDefaultBudget = 10240
+
+// The retained segment is named as seq-duration.ts, the duration in milliseconds, with a -d suffix if there is a
+// discontinuity before it, for example, 100-10010.ts or 101-9980-d.ts
+var hlsTimeShiftSegmentName = regexp.MustCompile(`^(\d+)-(\d+)(-d)?\.ts$`)
+
+var hlsTimeShiftWorker *HLSTimeShiftWorker
+
+// HLSTimeShift is the time-shift of a stream, stored in SRS_HLS_TIMESHIFT, the field is stream URL such as
+// live/livestream.
+//
+// Because SRS only supports HLS window of vhost, we never extend the window of all streams, but retain the segments
+// of the time-shift streams by on_hls, and render a longer playlist at timeshift/live/livestream.m3u8, which is
+// served from the same HLS directory as the live playlist.
+type HLSTimeShift struct {
+	// The max duration in seconds to rewind.
+	Duration int `json:"duration"`
+	// The update time of time-shift.
+	Update string `json:"update,omitempty"`
+}
+
+func (v *HLSTimeShift) String() string {
+	return fmt.Sprintf("duration=%v, update=%v", v.Duration, v.Update)
+}
+
+// HLSTimeShiftSegment is a retained segment of time-shift stream on disk.
+type HLSTimeShiftSegment struct {
+	// The sequence number of segment, increased by one for each retained segment.
+	SeqNo uint64
+	// The duration of segment in seconds.
+	Duration float64
+	// Whether there is a discontinuity before this segment, for example, the stream is republished.
+	Discontinuity bool
+	// The size of segment in bytes.
+	Size int64
+}
+
+// Name returns the file name of segment.
+func (v *HLSTimeShiftSegment) Name() string {
+	name := fmt.Sprintf("%v-%v", v.SeqNo, int64(math.Round(v.Duration*1000)))
+	if v.Discontinuity {
+		name += "-d"
+	}
+	return name + ".ts"
+}
+
+// HLSTimeShiftState is the configured and available rewind of a time-shift stream.
+type HLSTimeShiftState struct {
+	// The max duration in seconds to rewind, zero if disabled but the segments are not cleaned yet.
+	Duration int `json:"duration"`
+	// The duration in seconds available to rewind now, computed from the segments on disk.
+	Rewind float64 `json:"rewind"`
+	// The number and size in bytes of segments on disk.
+	Segments int   `json:"segments"`
+	Size     int64 `json:"size"`
+	// The disk space in bytes reserved for this stream.
+	Reserved int64 `json:"reserved"`
+	// The path of time-shift playlist, such as timeshift/live/livestream.m3u8
+	Playlist string `json:"playlist,omitempty"`
+}
+
+// parseHlsTimeShiftBudget parses the disk budget in MB, and returns the budget in bytes.
+func parseHlsTimeShiftBudget(v string) (int64, error) {
+	budget := hlsTimeShiftDefaultBudget
+	if v != "" {
+		if iv, err := strconv.Atoi(v); err != nil {
+			return 0, errors.Wrapf(err, "parse %v", v)
+		} else if iv < 1 {
+			return 0, errors.Errorf("budget %vMB should not less than 1MB", iv)
+		} else {
+			budget = iv
+		}
+	}
+	return int64(budget) * 1024 * 1024, nil
+}
+
+// queryHLSTimeShifts returns the time-shift of streams, the key is stream URL such as live/livestream.
+func queryHLSTimeShifts(ctx context.Context) (map[string]*HLSTimeShift, error) {
+	values, err := rdb.HGetAll(ctx, SRS_HLS_TIMESHIFT).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_HLS_TIMESHIFT)
+	}
+
+	shifts := make(map[string]*HLSTimeShift)
+	for streamURL, value := range values {
+		var shift HLSTimeShift
+		if err := json.Unmarshal([]byte(value), &shift); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", streamURL, value)
+		}
+		shifts[streamURL] = &shift
+	}
+	return shifts, nil
+}
+
+// reserveHLSTimeShifts splits the disk budget to the time-shift streams by the duration, so that each stream has its
+// reserved space, and a stream with high bitrate never starves the others.
+func reserveHLSTimeShifts(shifts map[string]*HLSTimeShift, budget int64) map[string]int64 {
+	var total int64
+	for _, shift := range shifts {
+		total += int64(shift.Duration)
+	}
+
+	reserved := make(map[string]int64)
+	for streamURL, shift := range shifts {
+		if total > 0 {
+			reserved[streamURL] = budget * int64(shift.Duration) / total
+		}
+	}
+	return reserved
+}
+
+// queryHLSTimeShiftSegments returns the retained segments of stream on disk, sorted by the sequence number.
+func queryHLSTimeShiftSegments(streamURL string) ([]*HLSTimeShiftSegment, error) {
+	dir := path.Join(dirTimeShiftPath, streamURL)
+	files, err := ioutil.ReadDir(dir)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "read dir %v", dir)
+	}
+
+	var segments []*HLSTimeShiftSegment
+	for _, file := range files {
+		matches := hlsTimeShiftSegmentName.FindStringSubmatch(file.Name())
+		if file.IsDir() || len(matches) != 4 {
+			continue
+		}
+
+		seqNo, _ := strconv.ParseUint(matches[1], 10, 64)
+		duration, _ := strconv.ParseInt(matches[2], 10, 64)
+		segments = append(segments, &HLSTimeShiftSegment{
+			SeqNo: seqNo, Duration: float64(duration) / 1000, Discontinuity: matches[3] != "", Size: file.Size(),
+		})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].SeqNo < segments[j].SeqNo
+	})
+	return segments, nil
+}
+
+// queryHLSTimeShiftStreams returns the stream URLs which have segments on disk.
+func queryHLSTimeShiftStreams() ([]string, error) {
+	apps, err := ioutil.ReadDir(dirTimeShiftPath)
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "read dir %v", dirTimeShiftPath)
+	}
+
+	var streamURLs []string
+	for _, app := range apps {
+		if !app.IsDir() {
+			continue
+		}
+
+		streams, err := ioutil.ReadDir(path.Join(dirTimeShiftPath, app.Name()))
+		if err != nil {
+			return nil, errors.Wrapf(err, "read dir %v", app.Name())
+		}
+
+		for _, stream := range streams {
+			if stream.IsDir() {
+				streamURLs = append(streamURLs, fmt.Sprintf("%v/%v", app.Name(), stream.Name()))
+			}
+		}
+	}
+	return streamURLs, nil
+}
+
+// queryHLSTimeShiftStates returns the state of time-shift streams, and the streams which are disabled but not cleaned.
+func queryHLSTimeShiftStates(ctx context.Context) (map[string]*HLSTimeShiftState, error) {
+	shifts, err := queryHLSTimeShifts(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query time-shifts")
+	}
+
+	budget, err := parseHlsTimeShiftBudget(envHlsTimeShiftBudget())
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse budget")
+	}
+	reserved := reserveHLSTimeShifts(shifts, budget)
+
+	streamURLs, err := queryHLSTimeShiftStreams()
+	if err != nil {
+		return nil, errors.Wrapf(err, "query streams")
+	}
+	for streamURL := range shifts {
+		streamURLs = append(streamURLs, streamURL)
+	}
+
+	states := make(map[string]*HLSTimeShiftState)
+	for _, streamURL := range streamURLs {
+		if _, ok := states[streamURL]; ok {
+			continue
+		}
+
+		state := &HLSTimeShiftState{Reserved: reserved[streamURL]}
+		if shift, ok := shifts[streamURL]; ok {
+			state.Duration = shift.Duration
+		}
+
+		segments, err := queryHLSTimeShiftSegments(streamURL)
+		if err != nil {
+			return nil, errors.Wrapf(err, "query segments of %v", streamURL)
+		}
+		for _, segment := range segments {
+			state.Rewind += segment.Duration
+			state.Size += segment.Size
+		}
+		state.Rewind = math.Round(state.Rewind*1000) / 1000
+		state.Segments = len(segments)
+		if len(segments) > 0 {
+			state.Playlist = fmt.Sprintf("timeshift/%v.m3u8", streamURL)
+		}
+
+		states[streamURL] = state
+	}
+	return states, nil
+}
+
+// HLSTimeShiftWorker retains the segments of time-shift streams, and the janitor trims the segments by the duration
+// and the reserved disk space.
+type HLSTimeShiftWorker struct {
+	// The last SRS sequence number of streams, to identify the discontinuity.
+	seqs map[string]uint64
+	// The lock for segments on disk.
+	lock sync.Mutex
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewHLSTimeShiftWorker() *HLSTimeShiftWorker {
+	return &HLSTimeShiftWorker{seqs: make(map[string]uint64)}
+}
+
+func (v *HLSTimeShiftWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *HLSTimeShiftWorker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "timeshift start a worker, budget=%v", envHlsTimeShiftBudget())
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			if err := v.cleanup(ctx); err != nil {
+				logger.Wf(ctx, "timeshift janitor ignore err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(hlsTimeShiftJanitorInterval):
+			}
+		}
+	}()
+	return nil
+}
+
+// OnHlsTsMessage retains the ts file if the stream is time-shift, and renders the time-shift playlist.
+func (v *HLSTimeShiftWorker) OnHlsTsMessage(ctx context.Context, msg *SrsOnHlsMessage) error {
+	streamURL := fmt.Sprintf("%v/%v", msg.App, msg.Stream)
+
+	shifts, err := queryHLSTimeShifts(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query time-shifts")
+	}
+	if _, ok := shifts[streamURL]; !ok {
+		return nil
+	}
+
+	budget, err := parseHlsTimeShiftBudget(envHlsTimeShiftBudget())
+	if err != nil {
+		return errors.Wrapf(err, "parse budget")
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	segments, err := queryHLSTimeShiftSegments(streamURL)
+	if err != nil {
+		return errors.Wrapf(err, "query segments")
+	}
+
+	// Identify the discontinuity by the SRS sequence number, for example, the stream is republished, or the platform is
+	// restarted with segments on disk.
+	segment := &HLSTimeShiftSegment{Duration: msg.Duration}
+	if len(segments) > 0 {
+		last, ok := v.seqs[streamURL]
+		segment.SeqNo = segments[len(segments)-1].SeqNo + 1
+		segment.Discontinuity = !ok || msg.SeqNo != last+1
+	}
+	v.seqs[streamURL] = msg.SeqNo
+
+	dir := path.Join(dirTimeShiftPath, streamURL)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return errors.Wrapf(err, "mkdir %v", dir)
+	}
+
+	// Use hard link to avoid copying, because SRS only removes its own link of the ts file. Fallback to copy if the HLS
+	// directory is on another device.
+	tsfile := path.Join(dir, segment.Name())
+	if err := os.Link(msg.File, tsfile); err != nil {
+		if err := exec.CommandContext(ctx, "cp", "-f", msg.File, tsfile).Run(); err != nil {
+			return errors.Wrapf(err, "copy file %v to %v", msg.File, tsfile)
+		}
+	}
+
+	if err := trimHLSTimeShift(ctx, streamURL, shifts[streamURL], reserveHLSTimeShifts(shifts, budget)[streamURL]); err != nil {
+		return errors.Wrapf(err, "trim %v", streamURL)
+	}
+	return nil
+}
+
+// Remove removes all segments and the playlist of stream, for example, the time-shift is disabled.
+func (v *HLSTimeShiftWorker) Remove(ctx context.Context, streamURL string) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	delete(v.seqs, streamURL)
+	return removeHLSTimeShift(ctx, streamURL)
+}
+
+// cleanup trims the time-shift streams, and removes the streams which are disabled, for example, by other platform
+// or the segments left by crash.
+func (v *HLSTimeShiftWorker) cleanup(ctx context.Context) error {
+	shifts, err := queryHLSTimeShifts(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query time-shifts")
+	}
+
+	budget, err := parseHlsTimeShiftBudget(envHlsTimeShiftBudget())
+	if err != nil {
+		return errors.Wrapf(err, "parse budget")
+	}
+	reserved := reserveHLSTimeShifts(shifts, budget)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	streamURLs, err := queryHLSTimeShiftStreams()
+	if err != nil {
+		return errors.Wrapf(err, "query streams")
+	}
+
+	for _, streamURL := range streamURLs {
+		if shift, ok := shifts[streamURL]; ok {
+			if err := trimHLSTimeShift(ctx, streamURL, shift, reserved[streamURL]); err != nil {
+				return errors.Wrapf(err, "trim %v", streamURL)
+			}
+			continue
+		}
+
+		delete(v.seqs, streamURL)
+		if err := removeHLSTimeShift(ctx, streamURL); err != nil {
+			return errors.Wrapf(err, "remove %v", streamURL)
+		}
+	}
+	return nil
+}
+
+// trimHLSTimeShift removes the oldest segments exceed the duration or the reserved space, and renders the playlist.
+func trimHLSTimeShift(ctx context.Context, streamURL string, shift *HLSTimeShift, reserved int64) error {
+	segments, err := queryHLSTimeShiftSegments(streamURL)
+	if err != nil {
+		return errors.Wrapf(err, "query segments")
+	}
+
+	var duration float64
+	var size int64
+	for _, segment := range segments {
+		duration, size = duration+segment.Duration, size+segment.Size
+	}
+
+	// Always keep the latest segment, even if it exceeds the reserved space.
+	var removed int
+	for len(segments) > 1 {
+		first := segments[0]
+		if duration-first.Duration < float64(shift.Duration) && size <= reserved {
+			break
+		}
+
+		tsfile := path.Join(dirTimeShiftPath, streamURL, first.Name())
+		if err := os.Remove(tsfile); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "remove %v", tsfile)
+		}
+
+		duration, size = duration-first.Duration, size-first.Size
+		segments, removed = segments[1:], removed+1
+	}
+	if removed > 0 && duration < float64(shift.Duration) {
+		logger.Wf(ctx, "timeshift %v exceeds reserved %vB, rewind=%.1fs, %v", streamURL, reserved, duration, shift.String())
+	}
+
+	if err := writeHLSTimeShiftPlaylist(streamURL, segments); err != nil {
+		return errors.Wrapf(err, "write playlist")
+	}
+	return nil
+}
+
+// writeHLSTimeShiftPlaylist renders the playlist of retained segments, for example, timeshift/live/livestream.m3u8
+// for segments in timeshift/live/livestream/
+func writeHLSTimeShiftPlaylist(streamURL string, segments []*HLSTimeShiftSegment) error {
+	m3u8File := path.Join(dirTimeShiftPath, fmt.Sprintf("%v.m3u8", streamURL))
+	if len(segments) == 0 {
+		if err := os.Remove(m3u8File); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "remove %v", m3u8File)
+		}
+		return nil
+	}
+
+	var target float64
+	for _, segment := range segments {
+		target = math.Max(target, segment.Duration)
+	}
+
+	m3u8 := []string{
+		"#EXTM3U",
+		"#EXT-X-VERSION:3",
+		fmt.Sprintf("#EXT-X-TARGETDURATION:%v", math.Ceil(target)),
+		fmt.Sprintf("#EXT-X-MEDIA-SEQUENCE:%v", segments[0].SeqNo),
+	}
+	for index, segment := range segments {
+		if index > 0 && segment.Discontinuity {
+			m3u8 = append(m3u8, "#EXT-X-DISCONTINUITY")
+		}
+		m3u8 = append(m3u8, fmt.Sprintf("#EXTINF:%.3f, no desc", segment.Duration))
+		m3u8 = append(m3u8, fmt.Sprintf("%v/%v", path.Base(streamURL), segment.Name()))
+	}
+
+	// Write to a temporary file then rename, so that the player never reads a partial playlist.
+	tmpFile := fmt.Sprintf("%v.tmp", m3u8File)
+	if err := os.WriteFile(tmpFile, []byte(strings.Join(m3u8, "\n")+"\n"), 0644); err != nil {
+		return errors.Wrapf(err, "write %v", tmpFile)
+	}
+	if err := os.Rename(tmpFile, m3u8File); err != nil {
+		return errors.Wrapf(err, "rename %v to %v", tmpFile, m3u8File)
+	}
+	return nil
+}
+
+// removeHLSTimeShift removes the segments and playlist of stream.
+func removeHLSTimeShift(ctx context.Context, streamURL string) error {
+	dir := path.Join(dirTimeShiftPath, streamURL)
+	if err := os.RemoveAll(dir); err != nil {
+		return errors.Wrapf(err, "remove %v", dir)
+	}
+
+	m3u8File := path.Join(dirTimeShiftPath, fmt.Sprintf("%v.m3u8", streamURL))
+	if err := os.Remove(m3u8File); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "remove %v", m3u8File)
+	}
+
+	logger.Tf(ctx, "timeshift remove %v", streamURL)
+	return nil
+}
+
+func handleMgmtHlsTimeShift(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/hls/timeshift"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action, app, stream string
+			var duration int
+			if err := ParseBody(ctx, r, &struct {
+				Token    *string `json:"token"`
+				Action   *string `json:"action"`
+				App      *string `json:"app"`
+				Stream   *string `json:"stream"`
+				Duration *int    `json:"duration"`
+			}{
+				Token: &token, Action: &action, App: &app, Stream: &stream, Duration: &duration,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if action == "" {
+				states, err := queryHLSTimeShiftStates(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "query states")
+				}
+
+				httpWriteData(ctx, w, r, states)
+				logger.Tf(ctx, "hls timeshift query ok, streams=%v, token=%vB", len(states), len(token))
+				return nil
+			}
+
+			if action != "update" && action != "remove" {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+			}
+			if app == "" {
+				app = "live"
+			}
+			if stream == "" || strings.ContainsAny(app+stream, "/ \t\r\n") || strings.Contains(app+"/"+stream, "..") {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid app=%v, stream=%v", app, stream))
+			}
+			streamURL := fmt.Sprintf("%v/%v", app, stream)
+
+			if action == "remove" {
+				// Remove the segments immediately, rather than waiting for the janitor.
+				if err := rdb.HDel(ctx, SRS_HLS_TIMESHIFT, streamURL).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", SRS_HLS_TIMESHIFT, streamURL)
+				}
+				if err := hlsTimeShiftWorker.Remove(ctx, streamURL); err != nil {
+					return errors.Wrapf(err, "remove %v", streamURL)
+				}
+			} else {
+				if duration <= 0 || duration > hlsTimeShiftMaxDuration {
+					return newHttpStatusError(http.StatusBadRequest,
+						errors.Errorf("duration %v should in (0, %v] seconds", duration, hlsTimeShiftMaxDuration),
+					)
+				}
+				if err := verifyStreamName(ctx, stream); err != nil {
+					return errors.Wrapf(err, "verify stream name")
+				}
+
+				shift := &HLSTimeShift{Duration: duration, Update: time.Now().Format(time.RFC3339)}
+				if b, err := json.Marshal(shift); err != nil {
+					return errors.Wrapf(err, "marshal %v", shift.String())
+				} else if err := rdb.HSet(ctx, SRS_HLS_TIMESHIFT, streamURL, string(b)).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v %v %v", SRS_HLS_TIMESHIFT, streamURL, string(b))
+				}
+			}
+
+			states, err := queryHLSTimeShiftStates(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query states")
+			}
+
+			httpWriteData(ctx, w, r, states[streamURL])
+			logger.Tf(ctx, "hls timeshift %v ok, stream=%v, duration=%v, token=%vB", action, streamURL, duration, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
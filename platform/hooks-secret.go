@@ -0,0 +1,376 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The query parameter of the SRS callback URL, to carry the hooks secret, because SRS never sets any header.
+const hooksSecretQuery = "hooks_secret"
+
+// The fingerprint of callbacks without the hooks secret.
+const hooksSecretNone = "none"
+
+var hooksSecretPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{16,128}$`)
+
+type HooksSecretAction string
+
+const (
+	// Register the new secret as additionally valid, and reload SRS to use it.
+	HooksSecretActionBegin HooksSecretAction = "begin"
+	// Retire the old secret, only the new secret is valid.
+	HooksSecretActionFinalize HooksSecretAction = "finalize"
+	// Retire the new secret, and reload SRS to use the old one.
+	HooksSecretActionCancel HooksSecretAction = "cancel"
+)
+
+// HooksSecret is the shared secret for SRS to callback the platform, it's carried by the query of callback URL in the
+// generated SRS config. Empty current secret means the callbacks without secret are allowed, for compatibility.
+type HooksSecret struct {
+	// The secret in use.
+	Current string `json:"current,omitempty"`
+	// The new secret while rotating, which is used by SRS, and both current and next are valid.
+	Next string `json:"next,omitempty"`
+	// The secret to retire, which is still valid until SRS is reloaded without it.
+	Retiring string `json:"retiring,omitempty"`
+	// The time to begin the rotation, in RFC3339.
+	Begin string `json:"begin,omitempty"`
+	// The last update time, in RFC3339.
+	Update string `json:"update,omitempty"`
+}
+
+func (v *HooksSecret) String() string {
+	return fmt.Sprintf("current=%v, next=%v, retiring=%v, begin=%v",
+		hooksSecretFingerprint(v.Current), hooksSecretFingerprint(v.Next), hooksSecretFingerprint(v.Retiring), v.Begin,
+	)
+}
+
+// Active returns the secret for SRS to use, the next one while rotating, or empty if no secret.
+func (v *HooksSecret) Active() string {
+	if v.Next != "" {
+		return v.Next
+	}
+	return v.Current
+}
+
+// Valid returns the fingerprint of secret and whether it's valid.
+func (v *HooksSecret) Valid(secret string) (string, bool) {
+	if secret == "" {
+		return hooksSecretNone, v.Current == ""
+	}
+
+	for _, candidate := range []string{v.Current, v.Next, v.Retiring} {
+		if candidate != "" && subtle.ConstantTimeCompare([]byte(candidate), []byte(secret)) == 1 {
+			return hooksSecretFingerprint(secret), true
+		}
+	}
+	return hooksSecretFingerprint(secret), false
+}
+
+// hooksSecretFingerprint returns a short hash of secret, to identify the secret in logs and status without leaking it.
+func hooksSecretFingerprint(secret string) string {
+	if secret == "" {
+		return hooksSecretNone
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])[:8]
+}
+
+func queryHooksSecret(ctx context.Context) (*HooksSecret, error) {
+	value, err := rdb.HGet(ctx, SRS_HOOKS_SECRET, "secret").Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v secret", SRS_HOOKS_SECRET)
+	}
+
+	var secret HooksSecret
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), &secret); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+	}
+	return &secret, nil
+}
+
+func (v *HooksSecret) save(ctx context.Context) error {
+	v.Update = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(v); err != nil {
+		return errors.Wrapf(err, "marshal %v", v.String())
+	} else if err := rdb.HSet(ctx, SRS_HOOKS_SECRET, "secret", string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v secret %v", SRS_HOOKS_SECRET, v.String())
+	}
+	return nil
+}
+
+// verifyHooksSecret verifies the hooks secret of SRS callback, and tracks which secret is used, so the operator knows
+// when it's safe to finalize the rotation.
+func verifyHooksSecret(ctx context.Context, r *http.Request) error {
+	secret, err := queryHooksSecret(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query secret")
+	}
+
+	fingerprint, ok := secret.Valid(r.URL.Query().Get(hooksSecretQuery))
+	if err := bufferedRedisWrite(ctx, "hooks secret seen", func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.HIncrBy(ctx, SRS_HOOKS_SECRET_SEEN, fingerprint, 1)
+		pipe.HSet(ctx, SRS_HOOKS_SECRET_SEEN, fmt.Sprintf("%v:last", fingerprint), time.Now().Format(time.RFC3339))
+	}); err != nil {
+		return errors.Wrapf(err, "track %v", fingerprint)
+	}
+
+	if !ok {
+		return newHttpStatusError(http.StatusUnauthorized, errors.Errorf("invalid hooks secret %v", fingerprint))
+	}
+	return nil
+}
+
+// buildSrsHooksConf returns the http_hooks of SRS with the secret, or nil to use the default one without secret.
+func buildSrsHooksConf(server, secret string) []string {
+	if secret == "" {
+		return nil
+	}
+
+	server = strings.TrimSuffix(server, "/")
+	verify := fmt.Sprintf("%v/terraform/v1/hooks/srs/verify?%v=%v", server, hooksSecretQuery, secret)
+	hls := fmt.Sprintf("%v/terraform/v1/hooks/srs/hls?%v=%v", server, hooksSecretQuery, secret)
+	return []string{
+		"",
+		"http_hooks {",
+		"    enabled on;",
+		fmt.Sprintf("    on_publish %v;", verify),
+		fmt.Sprintf("    on_unpublish %v;", verify),
+		fmt.Sprintf("    on_play %v;", verify),
+		fmt.Sprintf("    on_stop %v;", verify),
+		fmt.Sprintf("    on_hls %v;", hls),
+		"}",
+	}
+}
+
+// HooksSecretUsage is the callbacks with a secret, to know whether SRS uses it.
+type HooksSecretUsage struct {
+	// The fingerprint of secret, or none for callbacks without secret.
+	Fingerprint string `json:"fingerprint"`
+	// The number of callbacks.
+	Callbacks int64 `json:"callbacks"`
+	// The time of last callback, in RFC3339.
+	Last string `json:"last,omitempty"`
+}
+
+// HooksSecretStatus is the status of rotation, without the secrets.
+type HooksSecretStatus struct {
+	// Whether the callbacks without secret are rejected.
+	Enabled bool `json:"enabled"`
+	// Whether rotating, that both current and next secrets are valid.
+	Rotating bool `json:"rotating"`
+	// The time to begin the rotation, in RFC3339.
+	Begin string `json:"begin,omitempty"`
+	// The usage of current, next and retiring secrets.
+	Current  *HooksSecretUsage `json:"current"`
+	Next     *HooksSecretUsage `json:"next,omitempty"`
+	Retiring *HooksSecretUsage `json:"retiring,omitempty"`
+	// Whether the callbacks with the next secret are seen after the rotation begins, so it's safe to finalize.
+	SafeToFinalize bool `json:"safeToFinalize"`
+}
+
+func queryHooksSecretStatus(ctx context.Context, secret *HooksSecret) (*HooksSecretStatus, error) {
+	seen, err := rdb.HGetAll(ctx, SRS_HOOKS_SECRET_SEEN).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_HOOKS_SECRET_SEEN)
+	}
+
+	usageOf := func(secret string) *HooksSecretUsage {
+		fingerprint := hooksSecretFingerprint(secret)
+		callbacks, _ := strconv.ParseInt(seen[fingerprint], 10, 64)
+		return &HooksSecretUsage{
+			Fingerprint: fingerprint, Callbacks: callbacks, Last: seen[fmt.Sprintf("%v:last", fingerprint)],
+		}
+	}
+
+	status := &HooksSecretStatus{
+		Enabled: secret.Current != "", Rotating: secret.Next != "", Begin: secret.Begin,
+		Current: usageOf(secret.Current),
+	}
+	if secret.Next != "" {
+		status.Next = usageOf(secret.Next)
+		status.SafeToFinalize = status.Next.Callbacks > 0 && status.Next.Last >= secret.Begin
+	}
+	if secret.Retiring != "" {
+		status.Retiring = usageOf(secret.Retiring)
+	}
+	return status, nil
+}
+
+// rotateHooksSecret does the action of rotation, and reloads SRS if the secret it should use is changed. The retired
+// secret is still valid until SRS is reloaded, so no callback is rejected by a mistimed rotation.
+func rotateHooksSecret(ctx context.Context, action HooksSecretAction, newSecret string, force bool,
+	reload func(ctx context.Context) error,
+) (*HooksSecret, error) {
+	secret, err := queryHooksSecret(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query secret")
+	}
+
+	switch action {
+	case HooksSecretActionBegin:
+		if secret.Next != "" {
+			return nil, newHttpStatusError(http.StatusBadRequest, errors.Errorf("already rotating, %v", secret.String()))
+		}
+		if newSecret == "" {
+			newSecret = strings.ReplaceAll(uuid.NewString(), "-", "")
+		} else if !hooksSecretPattern.MatchString(newSecret) {
+			return nil, newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid secret %vB, should match %v",
+				len(newSecret), hooksSecretPattern.String()))
+		}
+		if newSecret == secret.Current {
+			return nil, newHttpStatusError(http.StatusBadRequest, errors.New("same as current secret"))
+		}
+		secret.Next, secret.Begin = newSecret, time.Now().Format(time.RFC3339)
+	case HooksSecretActionFinalize:
+		if secret.Next == "" {
+			return nil, newHttpStatusError(http.StatusBadRequest, errors.New("not rotating"))
+		}
+		if !force {
+			if status, err := queryHooksSecretStatus(ctx, secret); err != nil {
+				return nil, errors.Wrapf(err, "query status")
+			} else if !status.SafeToFinalize {
+				return nil, newHttpStatusError(http.StatusBadRequest, errors.Errorf(
+					"no callback with next secret %v yet, wait or force it", status.Next.Fingerprint))
+			}
+		}
+		secret.Current, secret.Next, secret.Retiring, secret.Begin = secret.Next, "", secret.Current, ""
+	case HooksSecretActionCancel:
+		if secret.Next == "" {
+			return nil, newHttpStatusError(http.StatusBadRequest, errors.New("not rotating"))
+		}
+		secret.Next, secret.Retiring, secret.Begin = "", secret.Next, ""
+	default:
+		return nil, newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+	}
+
+	// Save the secret before reload, so the secret for SRS to use is always valid.
+	if err := secret.save(ctx); err != nil {
+		return nil, errors.Wrapf(err, "save %v", secret.String())
+	}
+	if err := reload(ctx); err != nil {
+		return nil, errors.Wrapf(err, "reload SRS, %v", secret.String())
+	}
+
+	// Now SRS never uses the retired secret, remove it and its usage.
+	if retiring := secret.Retiring; retiring != "" {
+		secret.Retiring = ""
+		if err := secret.save(ctx); err != nil {
+			return nil, errors.Wrapf(err, "save %v", secret.String())
+		}
+
+		fingerprint := hooksSecretFingerprint(retiring)
+		if err := rdb.HDel(ctx, SRS_HOOKS_SECRET_SEEN, fingerprint, fmt.Sprintf("%v:last", fingerprint)).Err(); err != nil && err != redis.Nil {
+			return nil, errors.Wrapf(err, "hdel %v %v", SRS_HOOKS_SECRET_SEEN, fingerprint)
+		}
+	}
+	return secret, nil
+}
+
+func handleMgmtHooksSecret(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/srs/hooks-secret/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			secret, err := queryHooksSecret(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query secret")
+			}
+
+			status, err := queryHooksSecretStatus(ctx, secret)
+			if err != nil {
+				return errors.Wrapf(err, "query status")
+			}
+
+			httpWriteData(ctx, w, r, status)
+			logger.Tf(ctx, "hooks secret query ok, %v, token=%vB", secret.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/srs/hooks-secret/rotate"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, secret string
+			var action HooksSecretAction
+			var force bool
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string            `json:"token"`
+				Action *HooksSecretAction `json:"action"`
+				Secret *string            `json:"secret"`
+				Force  *bool              `json:"force"`
+			}{
+				Token: &token, Action: &action, Secret: &secret, Force: &force,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			hooksSecret, err := rotateHooksSecret(ctx, action, secret, force, srsGenerateConfig)
+			if err != nil {
+				return errors.Wrapf(err, "rotate %v", action)
+			}
+
+			status, err := queryHooksSecretStatus(ctx, hooksSecret)
+			if err != nil {
+				return errors.Wrapf(err, "query status")
+			}
+
+			httpWriteData(ctx, w, r, status)
+			logger.Tf(ctx, "hooks secret rotate ok, action=%v, force=%v, %v, token=%vB",
+				action, force, hooksSecret.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
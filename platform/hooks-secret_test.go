@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestHooksSecret_Conf(t *testing.T) {
+	if lines := buildSrsHooksConf("http://localhost:2022", ""); lines != nil {
+		t.Errorf("Fail for lines %v", lines)
+	}
+
+	conf := strings.Join(buildSrsHooksConf("http://localhost:2022/", "abcdefghijklmnop"), "\n")
+	if !strings.Contains(conf, "on_publish http://localhost:2022/terraform/v1/hooks/srs/verify?hooks_secret=abcdefghijklmnop;") ||
+		!strings.Contains(conf, "on_hls http://localhost:2022/terraform/v1/hooks/srs/hls?hooks_secret=abcdefghijklmnop;") {
+		t.Errorf("Fail for conf %v", conf)
+	}
+
+	secret := &HooksSecret{Current: "current-secret-0001", Next: "next-secret-00001"}
+	for s, ok := range map[string]bool{"current-secret-0001": true, "next-secret-00001": true, "": false, "other": false} {
+		if _, valid := secret.Valid(s); valid != ok {
+			t.Errorf("Fail for %v, valid=%v", s, valid)
+		}
+	}
+	if secret.Active() != "next-secret-00001" || strings.Contains(secret.String(), "secret-") {
+		t.Errorf("Fail for %v", secret.String())
+	}
+}
+
+func TestHooksSecret_Rotate(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	setupFakeRedis(t)
+
+	// The secret SRS uses after each reload.
+	var active string
+	var reloadErr error
+	reload := func(ctx context.Context) error {
+		if reloadErr != nil {
+			return reloadErr
+		}
+		secret, err := queryHooksSecret(ctx)
+		if err != nil {
+			return err
+		}
+		active = secret.Active()
+		return nil
+	}
+	callback := func(secret string) error {
+		r := httptest.NewRequest(http.MethodPost, "/terraform/v1/hooks/srs/verify", nil)
+		if secret != "" {
+			r = httptest.NewRequest(http.MethodPost, "/terraform/v1/hooks/srs/verify?hooks_secret="+secret, nil)
+		}
+		return verifyHooksSecret(ctx, r)
+	}
+	status := func() *HooksSecretStatus {
+		secret, _ := queryHooksSecret(ctx)
+		status, err := queryHooksSecretStatus(ctx, secret)
+		if err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+		return status
+	}
+
+	// Allow callbacks without secret, for compatibility.
+	if err := callback(""); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+
+	// Begin, both the old and new are valid.
+	secret, err := rotateHooksSecret(ctx, HooksSecretActionBegin, "", false, reload)
+	if err != nil || secret.Next == "" || active != secret.Next {
+		t.Fatalf("Fail for secret %v, active=%v, err %+v", secret, active, err)
+	}
+	first := secret.Next
+	if err := callback(""); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if _, err := rotateHooksSecret(ctx, HooksSecretActionBegin, "", false, reload); err == nil {
+		t.Errorf("Fail for begin twice")
+	}
+
+	// Never finalize if SRS never uses the new secret, unless forced.
+	if _, err := rotateHooksSecret(ctx, HooksSecretActionFinalize, "", false, reload); err == nil {
+		t.Errorf("Fail for finalize without callbacks")
+	}
+	if s := status(); !s.Rotating || s.SafeToFinalize || s.Current.Fingerprint != hooksSecretNone || s.Current.Callbacks != 2 {
+		t.Errorf("Fail for status %v", s)
+	}
+	if err := callback(first); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if s := status(); !s.SafeToFinalize || s.Next.Callbacks != 1 || s.Next.Fingerprint != hooksSecretFingerprint(first) {
+		t.Errorf("Fail for status %v", s)
+	}
+
+	// Finalize, only the new secret is valid.
+	if secret, err = rotateHooksSecret(ctx, HooksSecretActionFinalize, "", false, reload); err != nil ||
+		secret.Current != first || secret.Next != "" || secret.Retiring != "" || active != first {
+		t.Errorf("Fail for secret %v, err %+v", secret, err)
+	}
+	if err := callback(""); err == nil {
+		t.Errorf("Fail for callback without secret")
+	} else if r0, ok := errors.Cause(err).(*httpStatusError); !ok || r0.status != http.StatusUnauthorized {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if s := status(); !s.Enabled || s.Rotating || s.Current.Callbacks != 1 {
+		t.Errorf("Fail for status %v", s)
+	}
+
+	// The new secret is still valid if failed to reload, until canceled.
+	if _, err := rotateHooksSecret(ctx, HooksSecretActionBegin, "short", false, reload); err == nil {
+		t.Errorf("Fail for invalid secret")
+	}
+	reloadErr = errors.New("mock reload failed")
+	if _, err := rotateHooksSecret(ctx, HooksSecretActionBegin, "second-secret-0001", false, reload); err == nil {
+		t.Errorf("Fail for reload")
+	}
+	if err := callback("second-secret-0001"); err != nil || active != first {
+		t.Errorf("Fail for active=%v, err %+v", active, err)
+	}
+
+	reloadErr = nil
+	if secret, err = rotateHooksSecret(ctx, HooksSecretActionCancel, "", false, reload); err != nil ||
+		secret.Current != first || secret.Next != "" || secret.Retiring != "" || active != first {
+		t.Errorf("Fail for secret %v, err %+v", secret, err)
+	}
+	if err := callback("second-secret-0001"); err == nil {
+		t.Errorf("Fail for canceled secret")
+	}
+	if err := callback(first); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The interval to sweep the transient keys.
+const housekeepingInterval = 10 * time.Minute
+
+// The COUNT hint of SCAN, and the max number of keys to sample by MEMORY USAGE for each category.
+const (
+	housekeepingScanCount     = 500
+	housekeepingMemorySamples = 16
+)
+
+var housekeeper = NewHousekeeper()
+
+// HousekeepingCategory is a kind of transient keys created by platform, which should always expire. The key is
+// the prefix and an id, for example, SRS_DOWNLOAD_TOKEN:xxx.
+type HousekeepingCategory struct {
+	// The name of category, for example, download-token.
+	Name string
+	// The prefix of keys, for example, SRS_DOWNLOAD_TOKEN:
+	Prefix string
+	// The TTL to set, if the key has no TTL.
+	TTL time.Duration
+}
+
+// housekeepingCategories returns the known transient keys. Note that the keys are set with TTL when created, and the
+// sweeper only fixes the keys without TTL, for example, created by old version or the write failed partially.
+func housekeepingCategories() []*HousekeepingCategory {
+	return []*HousekeepingCategory{
+		{Name: "download-token", Prefix: SRS_DOWNLOAD_TOKEN + ":", TTL: downloadTokenMaxExpire},
+		{Name: "bilibili-cache", Prefix: SRS_CACHE_BILIBILI + ":", TTL: bilibiliCache.TTL()},
+		{Name: "task-history", Prefix: SRS_TASK_HISTORY + ":", TTL: taskHistoryExpire},
+		{Name: "viewers-hls", Prefix: SRS_STAT_VIEWERS_HLS + ":", TTL: 3 * viewerSampleInterval},
+		{Name: "viewers-sample", Prefix: SRS_STAT_VIEWERS_SAMPLE + ":", TTL: 2 * viewerSampleInterval},
+		{Name: "viewers-unique", Prefix: SRS_STAT_VIEWERS_UNIQUE + ":", TTL: viewerHistoryExpire + 24*time.Hour},
+	}
+}
+
+// HousekeepingStat is the state of a category of transient keys.
+type HousekeepingStat struct {
+	// The name and prefix of category.
+	Name   string `json:"name"`
+	Prefix string `json:"prefix"`
+	// The TTL in seconds, for the keys without TTL.
+	TTL int `json:"ttl"`
+	// The number of keys.
+	Keys int `json:"keys"`
+	// The number of keys without TTL, which is fixed if sweep.
+	NoExpire int `json:"noExpire"`
+	// The number of keys set with TTL by sweep.
+	Fixed int `json:"fixed"`
+	// The memory in bytes, estimated by the average of sampled keys.
+	Memory int64 `json:"memory"`
+	// The number of keys sampled by MEMORY USAGE, zero if not supported.
+	Sampled int `json:"sampled"`
+}
+
+func (v *HousekeepingStat) String() string {
+	return fmt.Sprintf("name=%v, prefix=%v, ttl=%v, keys=%v, noExpire=%v, fixed=%v, memory=%v, sampled=%v",
+		v.Name, v.Prefix, v.TTL, v.Keys, v.NoExpire, v.Fixed, v.Memory, v.Sampled,
+	)
+}
+
+// HousekeepingMetrics is the statistic of sweeper.
+type HousekeepingMetrics struct {
+	// The number of sweeps, and the time of last sweep.
+	Sweeps    int64  `json:"sweeps"`
+	LastSweep string `json:"lastSweep,omitempty"`
+	// The total number of keys set with TTL.
+	Fixed int64 `json:"fixed"`
+	// The state of categories in last sweep.
+	Categories []*HousekeepingStat `json:"categories"`
+}
+
+// Housekeeper owns the TTL policy of transient keys, to avoid the redis memory growing on busy installs. It never
+// touches the keys outside the prefixes of housekeepingCategories.
+type Housekeeper struct {
+	metrics HousekeepingMetrics
+	lock    sync.Mutex
+}
+
+func NewHousekeeper() *Housekeeper {
+	return &Housekeeper{}
+}
+
+func (v *Housekeeper) Metrics() *HousekeepingMetrics {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	r := v.metrics
+	r.Categories = append([]*HousekeepingStat{}, v.metrics.Categories...)
+	return &r
+}
+
+// Sweep sets the TTL for the transient keys without TTL, and updates the metrics.
+func (v *Housekeeper) Sweep(ctx context.Context) ([]*HousekeepingStat, error) {
+	stats, err := v.inspect(ctx, true)
+	if err != nil {
+		return nil, errors.Wrapf(err, "inspect")
+	}
+
+	var fixed int
+	for _, stat := range stats {
+		fixed += stat.Fixed
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.metrics.Sweeps++
+	v.metrics.LastSweep = time.Now().Format(time.RFC3339)
+	v.metrics.Fixed += int64(fixed)
+	v.metrics.Categories = stats
+
+	if fixed > 0 {
+		logger.Tf(ctx, "housekeeping sweep ok, fixed=%v, categories=%v", fixed, len(stats))
+	}
+	return stats, nil
+}
+
+// Summary returns the state of transient keys, without any change.
+func (v *Housekeeper) Summary(ctx context.Context) ([]*HousekeepingStat, error) {
+	return v.inspect(ctx, false)
+}
+
+func (v *Housekeeper) inspect(ctx context.Context, sweep bool) ([]*HousekeepingStat, error) {
+	var stats []*HousekeepingStat
+	for _, category := range housekeepingCategories() {
+		stat, err := v.inspectCategory(ctx, category, sweep)
+		if err != nil {
+			return nil, errors.Wrapf(err, "inspect %v", category.Name)
+		}
+		stats = append(stats, stat)
+	}
+	return stats, nil
+}
+
+func (v *Housekeeper) inspectCategory(ctx context.Context, category *HousekeepingCategory, sweep bool) (*HousekeepingStat, error) {
+	stat := &HousekeepingStat{Name: category.Name, Prefix: category.Prefix, TTL: int(category.TTL.Seconds())}
+
+	var samples []string
+	var cursor uint64
+	for {
+		keys, next, err := rdb.Scan(ctx, cursor, category.Prefix+"*", housekeepingScanCount).Result()
+		if err != nil && err != redis.Nil {
+			return nil, errors.Wrapf(err, "scan %v*", category.Prefix)
+		}
+
+		for _, key := range keys {
+			// Never touch the keys outside the prefix, even if the pattern matches it.
+			if !strings.HasPrefix(key, category.Prefix) {
+				continue
+			}
+			stat.Keys++
+
+			if len(samples) < housekeepingMemorySamples {
+				samples = append(samples, key)
+			}
+
+			// The TTL is -1 if no expire, or -2 if not exists.
+			ttl, err := rdb.TTL(ctx, key).Result()
+			if err != nil && err != redis.Nil {
+				return nil, errors.Wrapf(err, "ttl %v", key)
+			}
+			if ttl != -1 {
+				continue
+			}
+
+			stat.NoExpire++
+			if !sweep {
+				continue
+			}
+			if err := rdb.Expire(ctx, key, category.TTL).Err(); err != nil && err != redis.Nil {
+				return nil, errors.Wrapf(err, "expire %v %v", key, category.TTL)
+			}
+			stat.Fixed++
+		}
+
+		if cursor = next; cursor == 0 {
+			break
+		}
+	}
+
+	// The MEMORY USAGE might be disabled by some redis service, so ignore the error and no estimate.
+	var memory int64
+	for _, key := range samples {
+		if n, err := rdb.MemoryUsage(ctx, key).Result(); err != nil && err != redis.Nil {
+			logger.Wf(ctx, "housekeeping ignore memory usage %v err %+v", key, err)
+			break
+		} else {
+			memory += n
+			stat.Sampled++
+		}
+	}
+	if stat.Sampled > 0 {
+		stat.Memory = memory * int64(stat.Keys) / int64(stat.Sampled)
+	}
+
+	return stat, nil
+}
+
+func handleMgmtStorageRedis(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/storage/redis"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action string
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Action *string `json:"action"`
+			}{
+				Token: &token, Action: &action,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			var stats []*HousekeepingStat
+			var err error
+			if action == "sweep" {
+				stats, err = housekeeper.Sweep(ctx)
+			} else if action == "" {
+				stats, err = housekeeper.Summary(ctx)
+			} else {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+			}
+			if err != nil {
+				return errors.Wrapf(err, "inspect keys, action=%v", action)
+			}
+
+			var keys int
+			var memory int64
+			for _, stat := range stats {
+				keys, memory = keys+stat.Keys, memory+stat.Memory
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Keys       int                 `json:"keys"`
+				Memory     int64               `json:"memory"`
+				Categories []*HousekeepingStat `json:"categories"`
+			}{
+				Keys: keys, Memory: memory, Categories: stats,
+			})
+			logger.Tf(ctx, "storage redis ok, action=%v, keys=%v, memory=%v, token=%vB", action, keys, memory, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
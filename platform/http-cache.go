@@ -0,0 +1,366 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The max age of public endpoints, which are polled by UI, so the proxies should only cache shortly.
+const httpCachePublicMaxAge = 10 * time.Second
+
+// HttpCachePolicy is the Cache-Control policy of a route.
+type HttpCachePolicy string
+
+const (
+	// Never cache, for the authenticated or dynamic endpoints, while the handler could override it, for example,
+	// the HLS files.
+	HttpCachePolicyNoStore HttpCachePolicy = "no-store"
+	// Cache shortly by proxies, with ETag to revalidate by 304, for the public endpoints without authentication.
+	HttpCachePolicyPublic HttpCachePolicy = "public"
+	// The handler sets the headers itself, for example, the static files and media files.
+	HttpCachePolicyHandler HttpCachePolicy = "handler"
+)
+
+// The cache policy of each route, by the pattern registered to the service handler. The pattern matches exactly, or
+// matches the prefix if ends with slash, except the root. Every route should have a policy, which is verified by
+// test, so please add the policy for new route.
+var httpRouteCachePolicies = map[string]HttpCachePolicy{
+	// The static files, UI, and the proxy to SRS, set by handler.
+	"/":      HttpCachePolicyHandler,
+	"/mgmt":  HttpCachePolicyHandler,
+	"/mgmt/": HttpCachePolicyHandler,
+
+	// The public endpoints without authentication, which are polled by UI.
+	"/terraform/v1/host/versions":      HttpCachePolicyPublic,
+	"/terraform/v1/mgmt/versions":      HttpCachePolicyPublic,
+	"/terraform/v1/ffmpeg/versions":    HttpCachePolicyPublic,
+	"/terraform/v1/hooks/versions":     HttpCachePolicyPublic,
+	"/terraform/v1/tencent/versions":   HttpCachePolicyPublic,
+	"/terraform/v1/mgmt/features":      HttpCachePolicyPublic,
+	"/terraform/v1/mgmt/playback":      HttpCachePolicyPublic,
+	"/terraform/v1/mgmt/public/status": HttpCachePolicyPublic,
+
+	// The media files, set by handler.
+	"/terraform/v1/ai/ocr/image/":               HttpCachePolicyHandler,
+	"/terraform/v1/ai/transcript/hls/original/": HttpCachePolicyHandler,
+	"/terraform/v1/ai/transcript/hls/overlay/":  HttpCachePolicyHandler,
+	"/terraform/v1/ai/transcript/hls/webvtt/":   HttpCachePolicyHandler,
+	"/terraform/v1/ai-talk/stage/hello-voices/": HttpCachePolicyHandler,
+	"/terraform/v1/dubbing/play":                HttpCachePolicyHandler,
+	"/terraform/v1/dubbing/source":              HttpCachePolicyHandler,
+	"/terraform/v1/hooks/dvr/hls/":              HttpCachePolicyHandler,
+	"/terraform/v1/hooks/vod/hls/":              HttpCachePolicyHandler,
+
+	// The features, which the routes are under the prefix.
+	"/terraform/v1/ffmpeg/forward/":   HttpCachePolicyNoStore,
+	"/terraform/v1/ffmpeg/transcode/": HttpCachePolicyNoStore,
+	"/terraform/v1/ffmpeg/vlive/":     HttpCachePolicyNoStore,
+	"/terraform/v1/hooks/record/":     HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/recordings/":  HttpCachePolicyNoStore,
+	"/terraform/v1/srs/proxy/":        HttpCachePolicyNoStore,
+
+	// For AI talk, OCR, transcript and dubbing.
+	"/terraform/v1/ai-talk/stage/conversation":   HttpCachePolicyNoStore,
+	"/terraform/v1/ai-talk/stage/query":          HttpCachePolicyNoStore,
+	"/terraform/v1/ai-talk/stage/start":          HttpCachePolicyNoStore,
+	"/terraform/v1/ai-talk/stage/upload":         HttpCachePolicyNoStore,
+	"/terraform/v1/ai-talk/stage/verify":         HttpCachePolicyNoStore,
+	"/terraform/v1/ai-talk/subscribe/query":      HttpCachePolicyNoStore,
+	"/terraform/v1/ai-talk/subscribe/remove":     HttpCachePolicyNoStore,
+	"/terraform/v1/ai-talk/subscribe/start":      HttpCachePolicyNoStore,
+	"/terraform/v1/ai-talk/subscribe/tts":        HttpCachePolicyNoStore,
+	"/terraform/v1/ai-talk/user/query":           HttpCachePolicyNoStore,
+	"/terraform/v1/ai-talk/user/update":          HttpCachePolicyNoStore,
+	"/terraform/v1/ai/ocr/apply":                 HttpCachePolicyNoStore,
+	"/terraform/v1/ai/ocr/callback-queue":        HttpCachePolicyNoStore,
+	"/terraform/v1/ai/ocr/check":                 HttpCachePolicyNoStore,
+	"/terraform/v1/ai/ocr/cleanup-queue":         HttpCachePolicyNoStore,
+	"/terraform/v1/ai/ocr/live-queue":            HttpCachePolicyNoStore,
+	"/terraform/v1/ai/ocr/ocr-queue":             HttpCachePolicyNoStore,
+	"/terraform/v1/ai/ocr/query":                 HttpCachePolicyNoStore,
+	"/terraform/v1/ai/ocr/reset":                 HttpCachePolicyNoStore,
+	"/terraform/v1/ai/transcript/apply":          HttpCachePolicyNoStore,
+	"/terraform/v1/ai/transcript/asr-queue":      HttpCachePolicyNoStore,
+	"/terraform/v1/ai/transcript/check":          HttpCachePolicyNoStore,
+	"/terraform/v1/ai/transcript/clear-subtitle": HttpCachePolicyNoStore,
+	"/terraform/v1/ai/transcript/fix-queue":      HttpCachePolicyNoStore,
+	"/terraform/v1/ai/transcript/live-queue":     HttpCachePolicyNoStore,
+	"/terraform/v1/ai/transcript/overlay-queue":  HttpCachePolicyNoStore,
+	"/terraform/v1/ai/transcript/query":          HttpCachePolicyNoStore,
+	"/terraform/v1/ai/transcript/reset":          HttpCachePolicyNoStore,
+	"/terraform/v1/dubbing/create":               HttpCachePolicyNoStore,
+	"/terraform/v1/dubbing/export":               HttpCachePolicyNoStore,
+	"/terraform/v1/dubbing/list":                 HttpCachePolicyNoStore,
+	"/terraform/v1/dubbing/query":                HttpCachePolicyNoStore,
+	"/terraform/v1/dubbing/remove":               HttpCachePolicyNoStore,
+	"/terraform/v1/dubbing/task-merge":           HttpCachePolicyNoStore,
+	"/terraform/v1/dubbing/task-query":           HttpCachePolicyNoStore,
+	"/terraform/v1/dubbing/task-rephrase":        HttpCachePolicyNoStore,
+	"/terraform/v1/dubbing/task-start":           HttpCachePolicyNoStore,
+	"/terraform/v1/dubbing/task-tts":             HttpCachePolicyNoStore,
+	"/terraform/v1/dubbing/update":               HttpCachePolicyNoStore,
+	"/terraform/v1/debug/goroutines":             HttpCachePolicyNoStore,
+
+	// For camera, relay and alias.
+	"/terraform/v1/ffmpeg/alias/remove":      HttpCachePolicyNoStore,
+	"/terraform/v1/ffmpeg/alias/streams":     HttpCachePolicyNoStore,
+	"/terraform/v1/ffmpeg/alias/update":      HttpCachePolicyNoStore,
+	"/terraform/v1/ffmpeg/camera/secret":     HttpCachePolicyNoStore,
+	"/terraform/v1/ffmpeg/camera/source":     HttpCachePolicyNoStore,
+	"/terraform/v1/ffmpeg/camera/stream-url": HttpCachePolicyNoStore,
+	"/terraform/v1/ffmpeg/camera/streams":    HttpCachePolicyNoStore,
+	"/terraform/v1/ffmpeg/relay/remove":      HttpCachePolicyNoStore,
+	"/terraform/v1/ffmpeg/relay/streams":     HttpCachePolicyNoStore,
+	"/terraform/v1/ffmpeg/relay/update":      HttpCachePolicyNoStore,
+
+	// For hooks of SRS, DVR and VoD.
+	"/terraform/v1/hooks/dvr/apply":          HttpCachePolicyNoStore,
+	"/terraform/v1/hooks/dvr/files":          HttpCachePolicyNoStore,
+	"/terraform/v1/hooks/dvr/query":          HttpCachePolicyNoStore,
+	"/terraform/v1/hooks/srs/hls":            HttpCachePolicyNoStore,
+	"/terraform/v1/hooks/srs/secret":         HttpCachePolicyNoStore,
+	"/terraform/v1/hooks/srs/secret/disable": HttpCachePolicyNoStore,
+	"/terraform/v1/hooks/srs/secret/query":   HttpCachePolicyNoStore,
+	"/terraform/v1/hooks/srs/secret/update":  HttpCachePolicyNoStore,
+	"/terraform/v1/hooks/srs/verify":         HttpCachePolicyNoStore,
+	"/terraform/v1/hooks/vod/apply":          HttpCachePolicyNoStore,
+	"/terraform/v1/hooks/vod/files":          HttpCachePolicyNoStore,
+	"/terraform/v1/hooks/vod/query":          HttpCachePolicyNoStore,
+	"/terraform/v1/tencent/cam/secret":       HttpCachePolicyNoStore,
+
+	// For live room.
+	"/terraform/v1/live/room/create": HttpCachePolicyNoStore,
+	"/terraform/v1/live/room/list":   HttpCachePolicyNoStore,
+	"/terraform/v1/live/room/query":  HttpCachePolicyNoStore,
+	"/terraform/v1/live/room/remove": HttpCachePolicyNoStore,
+	"/terraform/v1/live/room/update": HttpCachePolicyNoStore,
+
+	// For management.
+	"/terraform/v1/mgmt/alerts":                        HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/alerts/settings":               HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/auto-self-signed-certificate":  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/beian/query":                   HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/beian/update":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/bilibili":                      HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/cert/query":                    HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/check":                         HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/cloud/refresh":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/containers":                    HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/deprecations":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/diagnose":                      HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/diagnostics/bundle":            HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/diagnostics/capture":           HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/download":                      HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/download/create":               HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/embed":                         HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/envs":                          HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/events/recent":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/events/stream":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/envs/restore":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/features/update":               HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/hls/profile/query":             HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/hls/profile/update":            HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/hls/timeshift":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/hlsll/query":                   HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/hlsll/update":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/hooks/apply":                   HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/hooks/events":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/hooks/example":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/hooks/query":                   HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/hphls/query":                   HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/hphls/update":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/init":                          HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/letsencrypt":                   HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/limits/query":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/limits/update":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/log/throttle":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/login":                         HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/metrics":                       HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/motd/update":                   HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/network/candidates":            HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/network/candidates/apply":      HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/nginx/preview":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/nginx/status":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/nodes/":                        HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/nodes/query":                   HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/nodes/remove":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/nodes/update":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/openai/query":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/openai/update":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/password":                      HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/playback/update":               HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/prometheus":                    HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/public/status/settings":        HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/recover/audit":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/recover/finish":                HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/recover/start":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/redirects":                     HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/releases":                      HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/releases/versions":             HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/reset":                         HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/reset/audit":                   HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/reset/factory":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/schedules/create":              HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/schedules/query":               HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/schedules/remove":              HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/schedules/update":              HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/secret/audit":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/secret/query":                  HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/selfcheck":                     HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/speedtest/ingest":              HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/speedtest/token":               HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/ssl":                           HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/ssl/certbot/discover":          HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/ssl/certbot/import":            HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/stats/viewers":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/srs/hooks-secret/query":        HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/srs/hooks-secret/rotate":       HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/status":                        HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/storage/query":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/storage/redis":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/storage/update":                HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/audit":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/guest":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/health":                HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/keys/export":           HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/keys/import":           HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/keys/quota":            HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/kickoff":               HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/metadata":              HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/naming/query":          HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/naming/update":         HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/preview":               HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/query":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/streams/snapshot/":             HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/timeouts":                      HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/token":                         HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/token/introspect":              HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/token/introspect/auth-request": HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/token/introspect/key":          HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/upgrade":                       HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/upgrade/audit":                 HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/upgrade/cancel":                HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/upgrade/progress":              HttpCachePolicyNoStore,
+	"/terraform/v1/mgmt/upgrade/safe":                  HttpCachePolicyNoStore,
+}
+
+// queryHttpCachePolicy returns the cache policy of route pattern, false if no policy.
+func queryHttpCachePolicy(pattern string) (HttpCachePolicy, bool) {
+	if policy, ok := httpRouteCachePolicies[pattern]; ok {
+		return policy, true
+	}
+
+	// Use the longest prefix, except the root which matches all routes.
+	var matched string
+	for prefix := range httpRouteCachePolicies {
+		if prefix != "/" && len(prefix) > len(matched) && matchHttpRoute(prefix, pattern) {
+			matched = prefix
+		}
+	}
+	if matched == "" {
+		return "", false
+	}
+	return httpRouteCachePolicies[matched], true
+}
+
+// serveHttpCache applies the cache policy of the route pattern to the response of handler.
+func serveHttpCache(ctx context.Context, w http.ResponseWriter, r *http.Request, pattern string, handler http.Handler) {
+	policy, ok := queryHttpCachePolicy(pattern)
+	if !ok {
+		logThrottle.Wf(ctx, pattern, "cache: no policy for %v, use %v", pattern, HttpCachePolicyNoStore)
+		policy = HttpCachePolicyNoStore
+	}
+
+	switch policy {
+	case HttpCachePolicyHandler:
+		handler.ServeHTTP(w, r)
+	case HttpCachePolicyPublic:
+		// Only the GET and HEAD could be cached, and revalidated by ETag.
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Cache-Control", "no-store")
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &httpCacheResponseWriter{ResponseWriter: w}
+		handler.ServeHTTP(cw, r)
+		cw.finish(r)
+	default:
+		w.Header().Set("Cache-Control", "no-store")
+		handler.ServeHTTP(w, r)
+	}
+}
+
+// httpCacheResponseWriter buffers the response of public endpoint, to generate the ETag by the body.
+type httpCacheResponseWriter struct {
+	http.ResponseWriter
+	// The status and body of response.
+	status int
+	body   bytes.Buffer
+}
+
+func (v *httpCacheResponseWriter) WriteHeader(status int) {
+	if v.status == 0 {
+		v.status = status
+	}
+}
+
+func (v *httpCacheResponseWriter) Write(b []byte) (int, error) {
+	if v.status == 0 {
+		v.status = http.StatusOK
+	}
+	return v.body.Write(b)
+}
+
+// finish writes the buffered response, or 304 if the ETag matches. The error response is never cached.
+func (v *httpCacheResponseWriter) finish(r *http.Request) {
+	if v.status == 0 {
+		v.status = http.StatusOK
+	}
+
+	h := v.ResponseWriter.Header()
+	if v.status != http.StatusOK {
+		h.Set("Cache-Control", "no-store")
+		v.ResponseWriter.WriteHeader(v.status)
+		v.ResponseWriter.Write(v.body.Bytes())
+		return
+	}
+
+	// Keep the Cache-Control of handler, for example, the public status has its own max age.
+	if h.Get("Cache-Control") == "" {
+		h.Set("Cache-Control", fmt.Sprintf("public, max-age=%v", int(httpCachePublicMaxAge.Seconds())))
+	}
+
+	sum := sha256.Sum256(v.body.Bytes())
+	etag := fmt.Sprintf(`"%x"`, sum[:16])
+	h.Set("ETag", etag)
+
+	if httpETagMatch(r.Header.Get("If-None-Match"), etag) {
+		h.Del("Content-Type")
+		h.Del("Content-Length")
+		v.ResponseWriter.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	v.ResponseWriter.WriteHeader(v.status)
+	v.ResponseWriter.Write(v.body.Bytes())
+}
+
+// httpETagMatch whether the If-None-Match matches the etag, by the weak comparison, see
+// https://www.rfc-editor.org/rfc/rfc9110#field.if-none-match
+func httpETagMatch(ifNoneMatch, etag string) bool {
+	for _, v := range strings.Split(ifNoneMatch, ",") {
+		if v = strings.TrimPrefix(strings.TrimSpace(v), "W/"); v == "*" || v == etag {
+			return true
+		}
+	}
+	return false
+}
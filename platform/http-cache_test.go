@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// parseHttpRoutes returns the routes registered in source files, by the ep variable, HandleFunc and the prefix of
+// handleFeatureWorker, because the ServeMux never exposes the patterns.
+func parseHttpRoutes(t *testing.T) map[string]string {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	fset := token.NewFileSet()
+	parsed := make(map[string]*ast.File)
+	consts := make(map[string]string)
+	for _, file := range files {
+		if strings.HasSuffix(file, "_test.go") {
+			continue
+		}
+
+		f, err := parser.ParseFile(fset, file, nil, 0)
+		if err != nil {
+			t.Fatalf("Fail for parse %v err %+v", file, err)
+		}
+		parsed[file] = f
+
+		// The string constants, for example, the prefix of routes.
+		for _, decl := range f.Decls {
+			if d, ok := decl.(*ast.GenDecl); ok && d.Tok == token.CONST {
+				for _, spec := range d.Specs {
+					vs := spec.(*ast.ValueSpec)
+					for i, name := range vs.Names {
+						if i < len(vs.Values) {
+							if lit, ok := vs.Values[i].(*ast.BasicLit); ok && lit.Kind == token.STRING {
+								consts[name.Name], _ = strconv.Unquote(lit.Value)
+							}
+						}
+					}
+				}
+			}
+		}
+	}
+
+	var eval func(e ast.Expr) (string, bool)
+	eval = func(e ast.Expr) (string, bool) {
+		switch v := e.(type) {
+		case *ast.BasicLit:
+			s, err := strconv.Unquote(v.Value)
+			return s, v.Kind == token.STRING && err == nil
+		case *ast.Ident:
+			s, ok := consts[v.Name]
+			return s, ok
+		case *ast.BinaryExpr:
+			x, ok0 := eval(v.X)
+			y, ok1 := eval(v.Y)
+			return x + y, ok0 && ok1 && v.Op == token.ADD
+		}
+		return "", false
+	}
+
+	routes := make(map[string]string)
+	for file, f := range parsed {
+		ast.Inspect(f, func(n ast.Node) bool {
+			switch v := n.(type) {
+			case *ast.AssignStmt:
+				if len(v.Lhs) == 1 && len(v.Rhs) == 1 {
+					if id, ok := v.Lhs[0].(*ast.Ident); ok && id.Name == "ep" {
+						if s, ok := eval(v.Rhs[0]); ok && strings.HasPrefix(s, "/") {
+							routes[s] = file
+						}
+					}
+				}
+			case *ast.CallExpr:
+				if sel, ok := v.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "HandleFunc" && len(v.Args) == 2 {
+					if s, ok := eval(v.Args[0]); ok {
+						routes[s] = file
+					}
+				}
+				if id, ok := v.Fun.(*ast.Ident); ok && id.Name == "handleFeatureWorker" && len(v.Args) == 5 {
+					if s, ok := eval(v.Args[3]); ok {
+						routes[s] = file
+					}
+				}
+			}
+			return true
+		})
+	}
+	return routes
+}
+
+func TestHttpCache_EveryRouteHasPolicy(t *testing.T) {
+	routes := parseHttpRoutes(t)
+	if len(routes) < 100 {
+		t.Fatalf("Fail for routes %v", len(routes))
+	}
+
+	for route, file := range routes {
+		if _, ok := queryHttpCachePolicy(route); !ok {
+			t.Errorf("Fail for no cache policy of %v in %v, please add to httpRouteCachePolicies", route, file)
+		}
+	}
+
+	// Never keep the policy of removed route.
+	for pattern := range httpRouteCachePolicies {
+		if _, ok := routes[pattern]; !ok {
+			t.Errorf("Fail for policy of %v, which is not registered", pattern)
+		}
+	}
+}
+
+func TestHttpCache_Policies(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	status, body := http.StatusOK, `{"code":0,"data":{"version":"v5.0.0"}}`
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	})
+
+	serve := func(method, pattern, ifNoneMatch string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, pattern, nil)
+		if ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		serveHttpCache(ctx, w, r, pattern, handler)
+		return w
+	}
+
+	// The public endpoint is cached shortly, and revalidated by ETag.
+	w := serve(http.MethodGet, "/terraform/v1/mgmt/versions", "")
+	etag := w.Header().Get("ETag")
+	if w.Code != http.StatusOK || w.Body.String() != body || etag == "" ||
+		w.Header().Get("Cache-Control") != "public, max-age=10" {
+		t.Errorf("Fail for code=%v, headers=%v, body=%v", w.Code, w.Header(), w.Body.String())
+	}
+	for _, match := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		if w := serve(http.MethodGet, "/terraform/v1/mgmt/versions", match); w.Code != http.StatusNotModified ||
+			w.Body.Len() != 0 || w.Header().Get("ETag") != etag {
+			t.Errorf("Fail for %v, code=%v, headers=%v", match, w.Code, w.Header())
+		}
+	}
+
+	// The ETag changes with body.
+	body = `{"code":0,"data":{"version":"v5.0.1"}}`
+	if w := serve(http.MethodGet, "/terraform/v1/mgmt/versions", etag); w.Code != http.StatusOK ||
+		w.Header().Get("ETag") == etag || w.Body.String() != body {
+		t.Errorf("Fail for code=%v, headers=%v", w.Code, w.Header())
+	}
+
+	// Never cache the POST or error of public endpoint.
+	if w := serve(http.MethodPost, "/terraform/v1/mgmt/versions", ""); w.Code != http.StatusOK ||
+		w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("ETag") != "" {
+		t.Errorf("Fail for code=%v, headers=%v", w.Code, w.Header())
+	}
+	status = http.StatusInternalServerError
+	if w := serve(http.MethodGet, "/terraform/v1/mgmt/versions", ""); w.Code != http.StatusInternalServerError ||
+		w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("ETag") != "" || w.Body.String() != body {
+		t.Errorf("Fail for code=%v, headers=%v", w.Code, w.Header())
+	}
+	status = http.StatusOK
+
+	// The authenticated endpoint, and the unknown route, are never cached.
+	for _, pattern := range []string{"/terraform/v1/mgmt/status", "/terraform/v1/ffmpeg/forward/", "/unknown"} {
+		if w := serve(http.MethodGet, pattern, ""); w.Code != http.StatusOK ||
+			w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("ETag") != "" {
+			t.Errorf("Fail for %v, code=%v, headers=%v", pattern, w.Code, w.Header())
+		}
+	}
+
+	// The handler sets the headers itself.
+	if w := serve(http.MethodGet, "/", ""); w.Code != http.StatusOK || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("Fail for code=%v, headers=%v", w.Code, w.Header())
+	}
+}
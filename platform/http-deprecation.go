@@ -0,0 +1,269 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The max size of body to detect the deprecated shape, the larger body is ignored.
+const httpDeprecationMaxBodySize = 64 * 1024
+
+// HttpDeprecationCondition is when the request uses the deprecated shape of a route.
+type HttpDeprecationCondition string
+
+const (
+	// The whole route is deprecated.
+	HttpDeprecationAlways HttpDeprecationCondition = "always"
+	// The token is in JSON body, without the Authorization header, see Authenticate.
+	HttpDeprecationTokenInBody HttpDeprecationCondition = "token-in-body"
+	// The route is requested by GET, which should be POST.
+	HttpDeprecationMethodGet HttpDeprecationCondition = "method-get"
+)
+
+// HttpDeprecation is a deprecated shape of a route, which is changed or removed after the sunset date.
+type HttpDeprecation struct {
+	// The route pattern, matches exactly, or matches the prefix if ends with slash, see httpRouteCachePolicies.
+	Route string `json:"route"`
+	// When the request uses the deprecated shape.
+	Condition HttpDeprecationCondition `json:"condition"`
+	// The date deprecated, and the date the behavior changes, in YYYY-MM-DD, UTC.
+	Deprecated string `json:"deprecated"`
+	Sunset     string `json:"sunset"`
+	// How to migrate, for human.
+	Message string `json:"message"`
+	// The document to migrate, empty if none.
+	Link string `json:"link,omitempty"`
+}
+
+func (v *HttpDeprecation) String() string {
+	return fmt.Sprintf("route=%v, condition=%v, deprecated=%v, sunset=%v",
+		v.Route, v.Condition, v.Deprecated, v.Sunset,
+	)
+}
+
+// The deprecations of routes, please add an entry rather than changing the handler, and remove the entry after the
+// behavior is changed at the sunset date. Each entry is verified by test.
+var httpDeprecations = []*HttpDeprecation{
+	{
+		Route: "/terraform/v1/", Condition: HttpDeprecationTokenInBody,
+		Deprecated: "2026-10-15", Sunset: "2027-10-15",
+		Message: "The token in body is deprecated, please use the Authorization: Bearer header",
+		Link:    "https://github.com/ossrs/oryx/blob/main/DEVELOPER.md#http-openapi",
+	},
+}
+
+// HttpDeprecations detects the deprecated shape of requests, to set the Deprecation and Sunset headers, and warn
+// once per client per day.
+type HttpDeprecations struct {
+	deprecations []*HttpDeprecation
+	// The day of warned clients, in YYYY-MM-DD, UTC.
+	day string
+	// The warned clients of day, the key is the route, condition and client IP.
+	warned map[string]bool
+	// The number of warned clients of day, the key is the route and condition.
+	clients map[string]int
+	lock    sync.Mutex
+}
+
+func NewHttpDeprecations(deprecations []*HttpDeprecation) *HttpDeprecations {
+	return &HttpDeprecations{
+		deprecations: deprecations, warned: make(map[string]bool), clients: make(map[string]int),
+	}
+}
+
+var httpDeprecationsDetector = NewHttpDeprecations(httpDeprecations)
+
+// parseHttpDeprecationDate parses the date in YYYY-MM-DD, UTC.
+func parseHttpDeprecationDate(date string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02", date)
+	if err != nil {
+		return t, errors.Wrapf(err, "parse %v", date)
+	}
+	return t, nil
+}
+
+// hasTokenInBody returns whether the JSON body has a token without the Authorization header. It restores the body,
+// and ignores the large or chunked body.
+func hasTokenInBody(r *http.Request) bool {
+	if r.Header.Get("Authorization") != "" || r.Body == nil {
+		return false
+	}
+	if r.ContentLength <= 0 || r.ContentLength > httpDeprecationMaxBodySize {
+		return false
+	}
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		return false
+	}
+
+	b, err := ioutil.ReadAll(r.Body)
+	r.Body = ioutil.NopCloser(bytes.NewReader(b))
+	if err != nil {
+		return false
+	}
+
+	var obj struct {
+		Token string `json:"token"`
+	}
+	return json.Unmarshal(b, &obj) == nil && obj.Token != ""
+}
+
+// Match returns the deprecations matched by the route pattern and request, which is active at t.
+func (v *HttpDeprecations) Match(pattern string, r *http.Request, t time.Time) []*HttpDeprecation {
+	var matched []*HttpDeprecation
+	var tokenInBody *bool
+	for _, d := range v.deprecations {
+		if !matchHttpRoute(d.Route, pattern) {
+			continue
+		}
+		if sunset, err := parseHttpDeprecationDate(d.Sunset); err == nil && !t.Before(sunset.AddDate(0, 0, 1)) {
+			continue
+		}
+
+		switch d.Condition {
+		case HttpDeprecationAlways:
+		case HttpDeprecationMethodGet:
+			if r.Method != http.MethodGet {
+				continue
+			}
+		case HttpDeprecationTokenInBody:
+			// Only read the body once, for multiple deprecations.
+			if tokenInBody == nil {
+				ok := hasTokenInBody(r)
+				tokenInBody = &ok
+			}
+			if !*tokenInBody {
+				continue
+			}
+		default:
+			continue
+		}
+
+		matched = append(matched, d)
+	}
+	return matched
+}
+
+// warn returns whether to warn the client for the deprecation, only once a day.
+func (v *HttpDeprecations) warn(d *HttpDeprecation, client string, t time.Time) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if day := t.UTC().Format("2006-01-02"); day != v.day {
+		v.day, v.warned, v.clients = day, make(map[string]bool), make(map[string]int)
+	}
+
+	key := fmt.Sprintf("%v %v %v", d.Route, d.Condition, client)
+	if v.warned[key] {
+		return false
+	}
+	v.warned[key] = true
+	v.clients[fmt.Sprintf("%v %v", d.Route, d.Condition)]++
+	return true
+}
+
+// Clients returns the number of clients using the deprecation today.
+func (v *HttpDeprecations) Clients(d *HttpDeprecation) int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.day != time.Now().UTC().Format("2006-01-02") {
+		return 0
+	}
+	return v.clients[fmt.Sprintf("%v %v", d.Route, d.Condition)]
+}
+
+// Active returns the deprecations before the sunset date.
+func (v *HttpDeprecations) Active(t time.Time) []*HttpDeprecation {
+	deprecations := []*HttpDeprecation{}
+	for _, d := range v.deprecations {
+		if sunset, err := parseHttpDeprecationDate(d.Sunset); err == nil && !t.Before(sunset.AddDate(0, 0, 1)) {
+			continue
+		}
+		deprecations = append(deprecations, d)
+	}
+	return deprecations
+}
+
+// ServeHTTP sets the Deprecation and Sunset headers if the request uses the deprecated shape of route, see RFC 9745
+// and RFC 8594, and warns once per client per day.
+func (v *HttpDeprecations) ServeHTTP(ctx context.Context, w http.ResponseWriter, r *http.Request, pattern string) {
+	now := time.Now()
+	for _, d := range v.Match(pattern, r, now) {
+		if deprecated, err := parseHttpDeprecationDate(d.Deprecated); err == nil {
+			w.Header().Set("Deprecation", fmt.Sprintf("@%v", deprecated.Unix()))
+		}
+		if sunset, err := parseHttpDeprecationDate(d.Sunset); err == nil {
+			w.Header().Set("Sunset", sunset.Format(http.TimeFormat))
+		}
+		if d.Link != "" {
+			w.Header().Add("Link", fmt.Sprintf(`<%v>; rel="deprecation"`, d.Link))
+		}
+
+		if client := clientIP(r); v.warn(d, client, now) {
+			logger.Wf(ctx, "deprecation: %v uses deprecated %v, client=%v, sunset=%v, %v",
+				r.URL.Path, d.Condition, client, d.Sunset, d.Message,
+			)
+		}
+	}
+}
+
+func handleMgmtDeprecations(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/deprecations"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			type deprecation struct {
+				*HttpDeprecation
+				// The number of clients using the deprecated shape today.
+				Clients int `json:"clients"`
+			}
+			deprecations := []*deprecation{}
+			for _, d := range httpDeprecationsDetector.Active(time.Now()) {
+				deprecations = append(deprecations, &deprecation{
+					HttpDeprecation: d, Clients: httpDeprecationsDetector.Clients(d),
+				})
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Deprecations []*deprecation `json:"deprecations"`
+			}{
+				Deprecations: deprecations,
+			})
+			logger.Tf(ctx, "deprecations query ok, deprecations=%v, token=%vB", len(deprecations), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
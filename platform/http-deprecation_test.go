@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestHttpDeprecation_Table(t *testing.T) {
+	for _, d := range httpDeprecations {
+		deprecated, err := parseHttpDeprecationDate(d.Deprecated)
+		if err != nil {
+			t.Errorf("Fail for %v, err %+v", d, err)
+		}
+		if sunset, err := parseHttpDeprecationDate(d.Sunset); err != nil || !sunset.After(deprecated) {
+			t.Errorf("Fail for %v, err %+v", d, err)
+		}
+		if !strings.HasPrefix(d.Route, "/terraform/v1/") || d.Message == "" {
+			t.Errorf("Fail for %v", d)
+		}
+		switch d.Condition {
+		case HttpDeprecationAlways, HttpDeprecationTokenInBody, HttpDeprecationMethodGet:
+		default:
+			t.Errorf("Fail for condition %v", d)
+		}
+	}
+}
+
+func TestHttpDeprecation_Match(t *testing.T) {
+	v := NewHttpDeprecations([]*HttpDeprecation{
+		{Route: "/terraform/v1/mgmt/", Condition: HttpDeprecationTokenInBody, Deprecated: "2024-01-01", Sunset: "2024-06-30"},
+		{Route: "/terraform/v1/mgmt/status", Condition: HttpDeprecationMethodGet, Deprecated: "2024-01-01", Sunset: "2024-06-30"},
+		{Route: "/terraform/v1/mgmt/old", Condition: HttpDeprecationAlways, Deprecated: "2024-01-01", Sunset: "2024-03-01"},
+	})
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	request := func(method, path, body string) *http.Request {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		return r
+	}
+
+	// Match the token in body, and restore the body for handler.
+	r := request(http.MethodPost, "/terraform/v1/mgmt/status", `{"token":"xxx"}`)
+	if matched := v.Match("/terraform/v1/mgmt/status", r, now); len(matched) != 1 || matched[0].Condition != HttpDeprecationTokenInBody {
+		t.Errorf("Fail for matched %v", matched)
+	}
+	if b, _ := ioutil.ReadAll(r.Body); string(b) != `{"token":"xxx"}` {
+		t.Errorf("Fail for body %v", string(b))
+	}
+
+	// Never match the bearer, the empty token, or the other routes.
+	r = request(http.MethodPost, "/terraform/v1/mgmt/status", `{"token":"xxx"}`)
+	r.Header.Set("Authorization", "Bearer xxx")
+	if matched := v.Match("/terraform/v1/mgmt/status", r, now); len(matched) != 0 {
+		t.Errorf("Fail for matched %v", matched)
+	}
+	if matched := v.Match("/terraform/v1/mgmt/status", request(http.MethodPost, "/terraform/v1/mgmt/status", `{}`), now); len(matched) != 0 {
+		t.Errorf("Fail for matched %v", matched)
+	}
+	if matched := v.Match("/terraform/v1/hooks/srs/verify", request(http.MethodPost, "/terraform/v1/hooks/srs/verify", `{"token":"xxx"}`), now); len(matched) != 0 {
+		t.Errorf("Fail for matched %v", matched)
+	}
+
+	// Match the method and the whole route, until the end of sunset date.
+	if matched := v.Match("/terraform/v1/mgmt/status", request(http.MethodGet, "/terraform/v1/mgmt/status", ""), now); len(matched) != 1 {
+		t.Errorf("Fail for matched %v", matched)
+	}
+	if matched := v.Match("/terraform/v1/mgmt/old", request(http.MethodPost, "/terraform/v1/mgmt/old", ""), now); len(matched) != 1 {
+		t.Errorf("Fail for matched %v", matched)
+	}
+	if matched := v.Match("/terraform/v1/mgmt/old", request(http.MethodPost, "/terraform/v1/mgmt/old", ""), now.AddDate(0, 0, 1)); len(matched) != 0 {
+		t.Errorf("Fail for matched %v", matched)
+	}
+	if active := v.Active(now.AddDate(0, 0, 1)); len(active) != 2 {
+		t.Errorf("Fail for active %v", len(active))
+	}
+}
+
+func TestHttpDeprecation_ServeHTTP(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	sunset := time.Now().AddDate(0, 1, 0).UTC().Format("2006-01-02")
+	v := NewHttpDeprecations([]*HttpDeprecation{{
+		Route: "/terraform/v1/mgmt/", Condition: HttpDeprecationTokenInBody, Deprecated: "2024-01-01", Sunset: sunset,
+		Link: "https://example.com/deprecations",
+	}})
+
+	serve := func(ip string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/terraform/v1/mgmt/status", strings.NewReader(`{"token":"xxx"}`))
+		r.Header.Set("Content-Type", "application/json")
+		r.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		v.ServeHTTP(ctx, w, r, "/terraform/v1/mgmt/status")
+		return w
+	}
+
+	w := serve("10.0.0.1")
+	expectSunset, _ := parseHttpDeprecationDate(sunset)
+	if w.Header().Get("Deprecation") != "@1704067200" || w.Header().Get("Sunset") != expectSunset.Format(http.TimeFormat) ||
+		w.Header().Get("Link") != `<https://example.com/deprecations>; rel="deprecation"` {
+		t.Errorf("Fail for headers %v", w.Header())
+	}
+
+	// Warn once per client per day.
+	serve("10.0.0.1")
+	serve("10.0.0.2")
+	if n := v.Clients(v.deprecations[0]); n != 2 {
+		t.Errorf("Fail for clients %v", n)
+	}
+	if v.warn(v.deprecations[0], "10.0.0.1", time.Now().AddDate(0, 0, 1)) != true {
+		t.Errorf("Fail for next day")
+	}
+}
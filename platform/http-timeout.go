@@ -0,0 +1,284 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The default timeout for each HTTP API request, to cancel the slow redis or backend API calls.
+const httpRequestTimeout = 30 * time.Second
+
+// The max timeout of a route, to avoid setting a timeout which never expires by mistake.
+const httpRequestMaxTimeout = time.Hour
+
+// The builtin timeout of routes, which differs from the default. The path matches exactly, or matches the prefix if
+// ends with slash.
+var httpRouteTimeouts = map[string]time.Duration{
+	// The upgrade waits for the lock and runs the upgrade script, which takes long.
+	"/terraform/v1/mgmt/upgrade": 10 * time.Minute,
+	// The ASR, chat and TTS of AI talk wait for the AI services, which might be slow.
+	"/terraform/v1/ai-talk/stage/upload": 5 * time.Minute,
+	// The envs is requested by UI for each page, which should be fast.
+	"/terraform/v1/mgmt/envs": time.Second,
+}
+
+// The long-poll or streaming routes, which are exempt from the timeout, because the response might last as long as
+// the client wants, for example, downloading a large file.
+var httpTimeoutExemptEndpoints = []string{
+	"/terraform/v1/mgmt/download",
+	"/terraform/v1/mgmt/events/stream",
+	"/terraform/v1/mgmt/streams/health",
+	"/terraform/v1/mgmt/upgrade/progress",
+	// The upload and youtube-dl of vLive files last as long as the transfer of the file.
+	"/terraform/v1/ffmpeg/vlive/upload/",
+	"/terraform/v1/ffmpeg/vlive/ytdl",
+	// The media and exported file of dubbing might be large.
+	"/terraform/v1/dubbing/play",
+	"/terraform/v1/dubbing/export",
+}
+
+var httpTimeouts = NewHttpTimeouts(httpRequestTimeout, httpRouteTimeouts, httpTimeoutExemptEndpoints)
+
+// HttpRouteTimeout is the timeout of a route.
+type HttpRouteTimeout struct {
+	// The route path, match exactly, or match the prefix if ends with slash.
+	Path string `json:"path"`
+	// The timeout in milliseconds, 0 if exempt.
+	Timeout int64 `json:"timeout"`
+	// Whether the route is exempt from timeout, for long-poll or streaming.
+	Exempt bool `json:"exempt,omitempty"`
+	// Whether the timeout is overridden by the settings API.
+	Override bool `json:"override,omitempty"`
+}
+
+// HttpTimeoutsState is the snapshot of timeouts, in milliseconds.
+type HttpTimeoutsState struct {
+	// The default timeout of routes.
+	Default int64 `json:"default"`
+	// The routes which differ from the default, sorted by path.
+	Routes []*HttpRouteTimeout `json:"routes"`
+}
+
+func (v *HttpTimeoutsState) String() string {
+	return fmt.Sprintf("default=%vms, routes=%v", v.Default, len(v.Routes))
+}
+
+// HttpTimeouts is the table of timeouts for routes, applied by the deadline of request context, see
+// httpRequestContext. The builtin timeouts can be overridden by the settings API for debugging, which are not
+// persisted, and are restored when platform restarts.
+type HttpTimeouts struct {
+	// The builtin default timeout and timeouts of routes.
+	builtinDefault time.Duration
+	builtinRoutes  map[string]time.Duration
+	// The exempt routes, never timeout.
+	exempts []string
+	// The default timeout and routes overridden by settings API.
+	overrideDefault time.Duration
+	overrideRoutes  map[string]time.Duration
+	// The lock for overrides.
+	lock sync.Mutex
+}
+
+func NewHttpTimeouts(defaultTimeout time.Duration, routes map[string]time.Duration, exempts []string) *HttpTimeouts {
+	return &HttpTimeouts{
+		builtinDefault: defaultTimeout, builtinRoutes: routes, exempts: exempts,
+		overrideRoutes: make(map[string]time.Duration),
+	}
+}
+
+func matchHttpRoute(pattern, path string) bool {
+	return pattern == path || (strings.HasSuffix(pattern, "/") && strings.HasPrefix(path, pattern))
+}
+
+// Timeout returns the timeout of path, or 0 if exempt.
+func (v *HttpTimeouts) Timeout(path string) time.Duration {
+	for _, ep := range v.exempts {
+		if matchHttpRoute(ep, path) {
+			return 0
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	for _, routes := range []map[string]time.Duration{v.overrideRoutes, v.builtinRoutes} {
+		if timeout, ok := routes[path]; ok {
+			return timeout
+		}
+		for pattern, timeout := range routes {
+			if matchHttpRoute(pattern, path) {
+				return timeout
+			}
+		}
+	}
+
+	if v.overrideDefault > 0 {
+		return v.overrideDefault
+	}
+	return v.builtinDefault
+}
+
+// Update overrides the default timeout if path is empty, or the timeout of path. Restore the builtin timeout if
+// timeout is 0.
+func (v *HttpTimeouts) Update(path string, timeout time.Duration) error {
+	if timeout < 0 || timeout > httpRequestMaxTimeout {
+		return errors.Errorf("invalid timeout %v, should in [0, %v]", timeout, httpRequestMaxTimeout)
+	}
+	if path != "" && !strings.HasPrefix(path, "/") {
+		return errors.Errorf("invalid path %v, should starts with /", path)
+	}
+	for _, ep := range v.exempts {
+		if path != "" && matchHttpRoute(ep, path) {
+			return errors.Errorf("path %v is exempt from timeout", path)
+		}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if path == "" {
+		v.overrideDefault = timeout
+	} else if timeout == 0 {
+		delete(v.overrideRoutes, path)
+	} else {
+		v.overrideRoutes[path] = timeout
+	}
+	return nil
+}
+
+// State returns the snapshot of timeouts.
+func (v *HttpTimeouts) State() *HttpTimeoutsState {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	state := &HttpTimeoutsState{Default: int64(v.builtinDefault / time.Millisecond)}
+	if v.overrideDefault > 0 {
+		state.Default = int64(v.overrideDefault / time.Millisecond)
+	}
+
+	for path, timeout := range v.builtinRoutes {
+		if _, ok := v.overrideRoutes[path]; !ok {
+			state.Routes = append(state.Routes, &HttpRouteTimeout{Path: path, Timeout: int64(timeout / time.Millisecond)})
+		}
+	}
+	for path, timeout := range v.overrideRoutes {
+		state.Routes = append(state.Routes, &HttpRouteTimeout{
+			Path: path, Timeout: int64(timeout / time.Millisecond), Override: true,
+		})
+	}
+	for _, path := range v.exempts {
+		state.Routes = append(state.Routes, &HttpRouteTimeout{Path: path, Exempt: true})
+	}
+
+	sort.Slice(state.Routes, func(i, j int) bool {
+		return state.Routes[i].Path < state.Routes[j].Path
+	})
+	return state
+}
+
+// httpRequestDeadline is the timeout of request, to build the error when deadline exceeded.
+type httpRequestDeadline struct {
+	start   time.Time
+	timeout time.Duration
+}
+
+type httpRequestDeadlineKey struct{}
+
+// httpRequestContext create a context for HTTP request, which is cancelled when client disconnects or
+// timeout of route, see httpTimeouts. Note that the ctx should be the long-lived service context, we only use its
+// log cid.
+func httpRequestContext(ctx context.Context, r *http.Request) (context.Context, context.CancelFunc) {
+	ctx = logger.AliasContext(r.Context(), ctx)
+
+	timeout := httpTimeouts.Timeout(r.URL.Path)
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+
+	ctx = context.WithValue(ctx, httpRequestDeadlineKey{}, &httpRequestDeadline{start: time.Now(), timeout: timeout})
+	return context.WithTimeout(ctx, timeout)
+}
+
+// httpDeadlineError returns the error with 504 if the deadline of request is exceeded, while the client is still
+// waiting, or nil if not.
+func httpDeadlineError(ctx context.Context, r *http.Request, err error) *httpStatusError {
+	if ctx.Err() != context.DeadlineExceeded || r.Context().Err() != nil {
+		return nil
+	}
+
+	deadline, ok := ctx.Value(httpRequestDeadlineKey{}).(*httpRequestDeadline)
+	if !ok {
+		return nil
+	}
+
+	elapsed := time.Since(deadline.start)
+	r0 := newHttpCodeError(http.StatusGatewayTimeout, SrsStackErrorRequestTimeout, errors.Wrapf(err,
+		"timeout %v, elapsed %v", deadline.timeout, elapsed,
+	))
+	r0.details = &struct {
+		// The elapsed and timeout in milliseconds.
+		Elapsed int64 `json:"elapsed"`
+		Timeout int64 `json:"timeout"`
+	}{
+		Elapsed: int64(elapsed / time.Millisecond), Timeout: int64(deadline.timeout / time.Millisecond),
+	}
+	return r0
+}
+
+func handleMgmtTimeouts(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/timeouts"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, path string
+			var timeout *int64
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				// The route to update, or the default timeout if empty.
+				Path *string `json:"path"`
+				// The timeout in milliseconds, 0 to restore the builtin timeout.
+				Timeout **int64 `json:"timeout"`
+			}{
+				Token: &token, Path: &path, Timeout: &timeout,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Update the timeout if any, or query it.
+			if timeout != nil {
+				d := time.Duration(*timeout) * time.Millisecond
+				if err := httpTimeouts.Update(path, d); err != nil {
+					return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "update"))
+				}
+				logger.Tf(ctx, "timeouts update ok, path=%v, timeout=%v", path, d)
+			}
+
+			state := httpTimeouts.State()
+			httpWriteData(ctx, w, r, state)
+			logger.Tf(ctx, "timeouts ok, %v, token=%vB", state.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
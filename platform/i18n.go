@@ -0,0 +1,128 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The default language, which is also the fallback for missing translations.
+const defaultLanguage = "en"
+
+// The localized messages of error codes, please add messages for all languages when define a new code.
+var srsStackErrorCatalogs = map[string]map[SrsStackError]string{
+	"en": {
+		SrsStackErrorCallbackRecord:       "Failed to callback the record event",
+		SrsStackErrorAuth:                 "Authentication failed, the token might be expired, please login again",
+		SrsStackErrorInvalidBody:          "The request body is malformed or has invalid fields",
+		SrsStackErrorContentType:          "The request body should be JSON with Content-Type application/json",
+		SrsStackErrorTooManyRequests:      "Too many requests, please retry later",
+		SrsStackErrorStreamsLive:          "There are live streams, please stop them, or drain or force to upgrade",
+		SrsStackErrorLockBusy:             "The operation is in progress on another instance, please retry later",
+		SrsStackErrorFeatureDisabled:      "The feature is not available for this install",
+		SrsStackErrorSrtStreamID:          "The SRT streamid is malformed, should be like #!::r=livestream,key=secret",
+		SrsStackErrorInternal:             "Internal error, please report it with the request ID",
+		SrsStackErrorNginx:                "Failed to apply Nginx config, see /terraform/v1/mgmt/nginx/status for the error",
+		SrsStackErrorNotConfigured:        "The platform is not configured, SRS_PLATFORM_SECRET is empty or too short",
+		SrsStackErrorConfigInvalid:        "The configuration is invalid, please fix the fields in details",
+		SrsStackErrorHostModeNotSupported: "The feature is not supported in host mode, it requires docker",
+		SrsStackErrorAdminRequired:        "Admin permission required, please login again or enter the password",
+		SrsStackErrorRequestTimeout:       "The request timeout, please try again later",
+		SrsStackErrorStartingUp:           "The service is starting up, please try again later",
+		SrsStackErrorStreamName:           "The stream name is not allowed, see /terraform/v1/mgmt/streams/naming/query for the rules",
+		SrsStackErrorMediaInUse:           "The file is used by an active virtual live, please stop it, or force to remove",
+		SrsStackErrorRecoverCode:          "The recovery code is invalid or expired, please check it or request a new one",
+		SrsStackErrorNginxPreview:         "The NGINX config changed since preview, please preview and review it again",
+		SrsStackErrorResetConfirm:         "The confirmation of reset is invalid or expired, please confirm it again",
+		SrsStackErrorImageVerify:          "The image to upgrade failed the digest or signature verification, the upgrade is aborted",
+		SrsStackErrorUpgradeNotConfigured: "The upgrade is not configured, please set PLATFORM_UPGRADE_SCRIPT to upgrade",
+	},
+	"zh": {
+		SrsStackErrorCallbackRecord:       "录制事件回调失败",
+		SrsStackErrorAuth:                 "认证失败，令牌可能已过期，请重新登录",
+		SrsStackErrorInvalidBody:          "请求体格式错误或字段无效",
+		SrsStackErrorContentType:          "请求体必须是 JSON，且 Content-Type 为 application/json",
+		SrsStackErrorTooManyRequests:      "请求过多，请稍后重试",
+		SrsStackErrorStreamsLive:          "存在正在直播的流，请先停止推流，或等待推流结束后升级，或强制升级",
+		SrsStackErrorLockBusy:             "其他实例正在执行该操作，请稍后重试",
+		SrsStackErrorFeatureDisabled:      "当前安装不支持该功能",
+		SrsStackErrorSrtStreamID:          "SRT streamid 格式错误，应类似 #!::r=livestream,key=secret",
+		SrsStackErrorInternal:             "服务内部错误，请附带请求 ID 反馈",
+		SrsStackErrorNginx:                "应用 Nginx 配置失败，请查看 /terraform/v1/mgmt/nginx/status 获取错误详情",
+		SrsStackErrorNotConfigured:        "平台未配置，SRS_PLATFORM_SECRET 为空或太短",
+		SrsStackErrorConfigInvalid:        "配置无效，请根据详情修正字段",
+		SrsStackErrorHostModeNotSupported: "主机模式不支持该功能，需要使用 Docker 部署",
+		SrsStackErrorAdminRequired:        "需要管理员权限，请重新登录或输入密码",
+		SrsStackErrorRequestTimeout:       "请求超时，请稍后重试",
+		SrsStackErrorStartingUp:           "服务正在启动，请稍后重试",
+		SrsStackErrorStreamName:           "流名称不符合命名规则，请查看 /terraform/v1/mgmt/streams/naming/query 获取规则",
+		SrsStackErrorMediaInUse:           "文件正在被虚拟直播使用，请先停止，或强制删除",
+		SrsStackErrorRecoverCode:          "找回密码的验证码无效或已过期，请检查或重新获取",
+		SrsStackErrorNginxPreview:         "NGINX配置在预览后已变更，请重新预览并确认",
+		SrsStackErrorResetConfirm:         "重置的确认无效或已过期，请重新确认",
+		SrsStackErrorImageVerify:          "升级镜像的摘要或签名校验失败，已中止升级",
+		SrsStackErrorUpgradeNotConfigured: "未配置升级，请设置 PLATFORM_UPGRADE_SCRIPT 后再升级",
+	},
+}
+
+// negotiateLanguage returns the supported language by query lang, or the header Accept-Language, for example,
+// zh-CN,zh;q=0.9,en;q=0.8 is zh. Return the defaultLanguage if not supported.
+func negotiateLanguage(r *http.Request) string {
+	matchLanguage := func(tag string) string {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		for lang := range srsStackErrorCatalogs {
+			if tag == lang || strings.HasPrefix(tag, lang+"-") || strings.HasPrefix(tag, lang+"_") {
+				return lang
+			}
+		}
+		return ""
+	}
+
+	if lang := matchLanguage(r.URL.Query().Get("lang")); lang != "" {
+		return lang
+	}
+
+	type weightedLanguage struct {
+		lang string
+		q    float64
+	}
+	var languages []weightedLanguage
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, q := part, 1.0
+		if index := strings.Index(part, ";"); index >= 0 {
+			tag = part[:index]
+			if params := strings.TrimSpace(part[index+1:]); strings.HasPrefix(params, "q=") {
+				if fv, err := strconv.ParseFloat(params[2:], 64); err == nil {
+					q = fv
+				}
+			}
+		}
+
+		if lang := matchLanguage(tag); lang != "" && q > 0 {
+			languages = append(languages, weightedLanguage{lang: lang, q: q})
+		}
+	}
+
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].q > languages[j].q
+	})
+	if len(languages) > 0 {
+		return languages[0].lang
+	}
+	return defaultLanguage
+}
+
+// localizedErrorMessage returns the message of code in lang, fallback to defaultLanguage.
+func localizedErrorMessage(lang string, code SrsStackError) string {
+	if msg, ok := srsStackErrorCatalogs[lang][code]; ok {
+		return msg
+	}
+	if msg, ok := srsStackErrorCatalogs[defaultLanguage][code]; ok {
+		return msg
+	}
+	return http.StatusText(http.StatusInternalServerError)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestI18n_AllCodesHaveMessages(t *testing.T) {
+	// Parse all the error codes defined in srs-errors.go, so a new code without messages always fails.
+	f, err := parser.ParseFile(token.NewFileSet(), "srs-errors.go", nil, 0)
+	if err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+
+	codes := make(map[SrsStackError]string)
+	for _, decl := range f.Decls {
+		if decl, ok := decl.(*ast.GenDecl); ok && decl.Tok == token.CONST {
+			for _, spec := range decl.Specs {
+				spec := spec.(*ast.ValueSpec)
+				for i, name := range spec.Names {
+					if value, err := strconv.Atoi(spec.Values[i].(*ast.BasicLit).Value); err != nil {
+						t.Errorf("Fail for %v err %+v", name.Name, err)
+					} else {
+						codes[SrsStackError(value)] = name.Name
+					}
+				}
+			}
+		}
+	}
+	if len(codes) == 0 {
+		t.Errorf("Fail for no error codes")
+	}
+
+	for lang, catalog := range srsStackErrorCatalogs {
+		for code, name := range codes {
+			if msg, ok := catalog[code]; !ok || msg == "" {
+				t.Errorf("Fail for %v no message of %v(%v)", lang, name, code)
+			}
+		}
+		if len(catalog) != len(codes) {
+			t.Errorf("Fail for %v has %v messages, expect %v", lang, len(catalog), len(codes))
+		}
+	}
+}
+
+func TestI18n_NegotiateLanguage(t *testing.T) {
+	for _, e := range []struct {
+		url            string
+		acceptLanguage string
+		lang           string
+	}{
+		{url: "/", acceptLanguage: "", lang: "en"},
+		{url: "/", acceptLanguage: "zh-CN,zh;q=0.9,en;q=0.8", lang: "zh"},
+		{url: "/", acceptLanguage: "en-US,en;q=0.9,zh;q=0.8", lang: "en"},
+		{url: "/", acceptLanguage: "fr-FR,zh;q=0.5,en;q=0.8", lang: "en"},
+		{url: "/", acceptLanguage: "fr-FR", lang: "en"},
+		{url: "/?lang=zh", acceptLanguage: "en-US", lang: "zh"},
+		{url: "/?lang=fr", acceptLanguage: "zh-TW", lang: "zh"},
+	} {
+		r := httptest.NewRequest(http.MethodPost, e.url, nil)
+		r.Header.Set("Accept-Language", e.acceptLanguage)
+		if lang := negotiateLanguage(r); lang != e.lang {
+			t.Errorf("Fail for %v %v lang %v, expect %v", e.url, e.acceptLanguage, lang, e.lang)
+		}
+	}
+}
+
+func TestI18n_ErrorEnvelope(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	r := httptest.NewRequest(http.MethodPost, "/terraform/v1/mgmt/test", nil)
+	r.Header.Set("Accept-Language", "zh-CN")
+	w := httptest.NewRecorder()
+	httpWriteError(ctx, w, r, errors.Wrapf(
+		newHttpCodeError(http.StatusUnauthorized, SrsStackErrorAuth, errors.New("invalid token")), "authenticate",
+	))
+
+	var res struct {
+		Code SrsStackError `json:"code"`
+		Data struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		} `json:"data"`
+	}
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("Fail for status %v", w.Code)
+	} else if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	} else if res.Code != SrsStackErrorAuth || res.Data.Message != srsStackErrorCatalogs["zh"][SrsStackErrorAuth] {
+		t.Errorf("Fail for response %v", w.Body.String())
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The number of elements to flush the response, so the client receives the data progressively.
+const jsonArrayFlushElements = 100
+
+// The number of values to load from a redis list in a batch, to avoid loading the whole list into memory.
+const redisListBatch = 100
+
+// JSONArrayWriter writes a large listing as JSON array incrementally, element by element, to avoid building the whole
+// slice in memory. The response is compatible with the envelope of ohttp.WriteData, that is:
+//
+//	{"code":0,"server":pid,"data":{"<field>":[elem,elem,...]}}
+//
+// The envelope is written first, then the elements are streamed into the data field. Note that the status and headers
+// are sent by the first element, so it's not possible to response an error after that, the response is truncated and
+// the client should fail to parse it.
+type JSONArrayWriter struct {
+	w   http.ResponseWriter
+	enc *json.Encoder
+	// The name of array field in data.
+	field string
+	// The number of elements written.
+	n int
+	// Whether the envelope is written.
+	started bool
+}
+
+func NewJSONArrayWriter(w http.ResponseWriter, field string) *JSONArrayWriter {
+	return &JSONArrayWriter{w: w, enc: json.NewEncoder(w), field: field}
+}
+
+// Elements returns the number of elements written.
+func (v *JSONArrayWriter) Elements() int {
+	return v.n
+}
+
+func (v *JSONArrayWriter) start() error {
+	if v.started {
+		return nil
+	}
+	v.started = true
+
+	field, err := json.Marshal(v.field)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %v", v.field)
+	}
+
+	ohttp.SetHeader(v.w)
+	v.w.Header().Set("Content-Type", ohttp.HttpJson)
+	if _, err := fmt.Fprintf(v.w, `{"code":0,"server":%v,"data":{%s:[`, os.Getpid(), field); err != nil {
+		return errors.Wrapf(err, "write envelope")
+	}
+	return nil
+}
+
+// Write encodes the element to response, and flushes for every jsonArrayFlushElements elements.
+func (v *JSONArrayWriter) Write(elem interface{}) error {
+	if err := v.start(); err != nil {
+		return err
+	}
+
+	if v.n > 0 {
+		if _, err := v.w.Write([]byte(",")); err != nil {
+			return errors.Wrapf(err, "write separator")
+		}
+	}
+	if err := v.enc.Encode(elem); err != nil {
+		return errors.Wrapf(err, "encode %v", v.n)
+	}
+
+	if v.n++; v.n%jsonArrayFlushElements == 0 {
+		if f, ok := v.w.(http.Flusher); ok {
+			f.Flush()
+		}
+	}
+	return nil
+}
+
+// Close ends the array and the envelope. It writes an empty array if no element.
+func (v *JSONArrayWriter) Close() error {
+	if err := v.start(); err != nil {
+		return err
+	}
+	if _, err := v.w.Write([]byte("]}}")); err != nil {
+		return errors.Wrapf(err, "write end")
+	}
+	return nil
+}
+
+// rangeRedisList loads the values of list in batches, at most max values, and callback for each value. Note that the
+// list might change between batches, so a value might be skipped or duplicated, which is acceptable for logs.
+func rangeRedisList(ctx context.Context, key string, max int, handler func(value string) error) error {
+	for start := 0; start < max; start += redisListBatch {
+		stop := start + redisListBatch - 1
+		if stop >= max {
+			stop = max - 1
+		}
+
+		values, err := rdb.LRange(ctx, key, int64(start), int64(stop)).Result()
+		if err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "lrange %v %v %v", key, start, stop)
+		}
+
+		for _, value := range values {
+			if err := handler(value); err != nil {
+				return errors.Wrapf(err, "handle %v", value)
+			}
+		}
+
+		if len(values) < stop-start+1 {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"testing"
+
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestJSONArrayWriter_Envelope(t *testing.T) {
+	for _, n := range []int{0, 1, jsonArrayFlushElements + 1} {
+		w := httptest.NewRecorder()
+		aw := NewJSONArrayWriter(w, "audits")
+		for i := 0; i < n; i++ {
+			if err := aw.Write(&PublishAudit{Stream: fmt.Sprintf("live/%v", i), Allowed: true}); err != nil {
+				t.Fatalf("Fail for err %+v", err)
+			}
+		}
+		if err := aw.Close(); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+
+		var res struct {
+			Code int `json:"code"`
+			Data struct {
+				Audits []*PublishAudit `json:"audits"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatalf("Fail for n=%v, body %v, err %+v", n, w.Body.String(), err)
+		}
+		if res.Code != 0 || res.Data.Audits == nil || len(res.Data.Audits) != n || aw.Elements() != n {
+			t.Errorf("Fail for n=%v, body %v", n, w.Body.String())
+		}
+		if n > 0 && res.Data.Audits[n-1].Stream != fmt.Sprintf("live/%v", n-1) {
+			t.Errorf("Fail for n=%v, last %v", n, res.Data.Audits[n-1].String())
+		}
+		if ct := w.Header().Get("Content-Type"); ct != ohttp.HttpJson {
+			t.Errorf("Fail for n=%v, content type %v", n, ct)
+		}
+		if n > jsonArrayFlushElements && !w.Flushed {
+			t.Errorf("Fail for n=%v, not flushed", n)
+		}
+	}
+}
+
+func TestJSONArrayWriter_RangeRedisList(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	setupFakeRedis(t)
+
+	// Push the oldest first, so the latest v0 is the head.
+	for i := redisListBatch*2 + 50 - 1; i >= 0; i-- {
+		if err := rdb.LPush(ctx, "list", fmt.Sprintf("v%v", i)).Err(); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+	}
+
+	for _, e := range []struct {
+		max, expect int
+	}{
+		{max: redisListBatch*2 + 20, expect: redisListBatch*2 + 20},
+		{max: redisListBatch * 2, expect: redisListBatch * 2},
+		{max: redisListBatch * 10, expect: redisListBatch*2 + 50},
+	} {
+		var values []string
+		if err := rangeRedisList(ctx, "list", e.max, func(value string) error {
+			values = append(values, value)
+			return nil
+		}); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+		if len(values) != e.expect || values[0] != "v0" || values[len(values)-1] != fmt.Sprintf("v%v", e.expect-1) {
+			t.Errorf("Fail for max=%v, values %v", e.max, len(values))
+		}
+	}
+
+	var values int
+	if err := rangeRedisList(ctx, "not-exists", 10, func(value string) error {
+		values++
+		return nil
+	}); err != nil || values != 0 {
+		t.Errorf("Fail for values=%v, err %+v", values, err)
+	}
+}
+
+// discardResponseWriter is a response writer which drops the body, to measure the memory of response.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (v *discardResponseWriter) Header() http.Header {
+	return v.header
+}
+
+func (v *discardResponseWriter) Write(b []byte) (int, error) {
+	return ioutil.Discard.Write(b)
+}
+
+func (v *discardResponseWriter) WriteHeader(status int) {
+}
+
+// BenchmarkJSONArrayWriter compares the peak heap of streaming 100k entries to marshaling the whole slice, the heap of
+// streaming should be bounded, no matter how many entries.
+func BenchmarkJSONArrayWriter(b *testing.B) {
+	const entries = 100000
+	newAudit := func(i int) *PublishAudit {
+		return &PublishAudit{
+			Time: "2024-01-01T00:00:00Z", Protocol: "rtmp", Stream: fmt.Sprintf("live/livestream-%v", i),
+			Client: fmt.Sprintf("client-%v", i), Allowed: true,
+		}
+	}
+
+	// Sample the heap for every 10k entries, report the max growth as peak heap.
+	measure := func(b *testing.B, fn func(sample func())) {
+		var peak uint64
+		for i := 0; i < b.N; i++ {
+			runtime.GC()
+			var base runtime.MemStats
+			runtime.ReadMemStats(&base)
+
+			fn(func() {
+				var m runtime.MemStats
+				runtime.ReadMemStats(&m)
+				if m.HeapInuse > base.HeapInuse && m.HeapInuse-base.HeapInuse > peak {
+					peak = m.HeapInuse - base.HeapInuse
+				}
+			})
+		}
+		b.ReportMetric(float64(peak), "peak-heap-B")
+	}
+
+	b.Run("stream", func(b *testing.B) {
+		b.ReportAllocs()
+		measure(b, func(sample func()) {
+			aw := NewJSONArrayWriter(&discardResponseWriter{header: http.Header{}}, "audits")
+			for i := 0; i < entries; i++ {
+				if err := aw.Write(newAudit(i)); err != nil {
+					b.Fatalf("Fail for err %+v", err)
+				}
+				if i%10000 == 0 {
+					sample()
+				}
+			}
+			if err := aw.Close(); err != nil {
+				b.Fatalf("Fail for err %+v", err)
+			}
+		})
+	})
+
+	b.Run("slice", func(b *testing.B) {
+		b.ReportAllocs()
+		measure(b, func(sample func()) {
+			audits := make([]*PublishAudit, 0, entries)
+			for i := 0; i < entries; i++ {
+				audits = append(audits, newAudit(i))
+				if i%10000 == 0 {
+					sample()
+				}
+			}
+			bb, err := json.Marshal(&struct {
+				Audits []*PublishAudit `json:"audits"`
+			}{
+				Audits: audits,
+			})
+			if err != nil {
+				b.Fatalf("Fail for err %+v", err)
+			}
+			sample()
+			ioutil.Discard.Write(bb)
+		})
+	})
+}
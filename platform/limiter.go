@@ -0,0 +1,287 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The max duration for excess request to wait for a slot, before response 503.
+const httpLimiterWaitTimeout = 3 * time.Second
+
+// The default concurrency of each endpoint, which is generous enough for a single UI user.
+const httpLimiterDefaultExecConcurrency = 4
+const httpLimiterDefaultFFmpegConcurrency = 8
+
+// The endpoints which run external commands, such as lego or youtube-dl, or probe the network.
+var httpLimiterExecEndpoints = []string{
+	"/terraform/v1/mgmt/auto-self-signed-certificate",
+	"/terraform/v1/mgmt/ssl",
+	"/terraform/v1/mgmt/letsencrypt",
+	"/terraform/v1/ffmpeg/vlive/ytdl",
+	"/terraform/v1/mgmt/diagnose",
+	"/terraform/v1/mgmt/cloud/refresh",
+}
+
+// The endpoints which spawn FFmpeg or FFprobe.
+var httpLimiterFFmpegEndpoints = []string{
+	"/terraform/v1/mgmt/streams/preview",
+	"/terraform/v1/mgmt/streams/snapshot/",
+	"/terraform/v1/mgmt/recordings/clip",
+	"/terraform/v1/ffmpeg/vlive/source",
+	"/terraform/v1/ffmpeg/vlive/stream-url",
+	"/terraform/v1/ffmpeg/vlive/streamUrl",
+	"/terraform/v1/ffmpeg/camera/source",
+	"/terraform/v1/ffmpeg/camera/stream-url",
+	"/terraform/v1/ai-talk/stage/conversation",
+	"/terraform/v1/ai-talk/stage/upload",
+	"/terraform/v1/dubbing/source",
+	"/terraform/v1/dubbing/export",
+}
+
+var httpLimiter *HttpLimiter
+
+// HttpLimiterEndpoint limits the concurrency of an endpoint by a semaphore.
+type HttpLimiterEndpoint struct {
+	// The endpoint path, match exactly, or match the prefix if ends with slash.
+	Path string `json:"path"`
+	// The max number of requests in flight.
+	Limit int `json:"limit"`
+	// The number of requests in flight.
+	InFlight int64 `json:"inflight"`
+	// The number of requests waiting for a slot.
+	Waiting int64 `json:"waiting"`
+	// The total number of requests rejected by 503.
+	Rejected int64 `json:"rejected"`
+
+	// The semaphore of requests in flight.
+	slots chan bool
+}
+
+func (v *HttpLimiterEndpoint) String() string {
+	return fmt.Sprintf("path=%v, limit=%v, inflight=%v, waiting=%v, rejected=%v",
+		v.Path, v.Limit, atomic.LoadInt64(&v.InFlight), atomic.LoadInt64(&v.Waiting),
+		atomic.LoadInt64(&v.Rejected),
+	)
+}
+
+// HttpLimiter is a middleware to limit the concurrency of expensive endpoints, to avoid exhausting the system
+// resources, for example, forking lots of processes by a misbehaving client.
+type HttpLimiter struct {
+	// The endpoints to limit, the key is the path.
+	endpoints map[string]*HttpLimiterEndpoint
+	// The lock for endpoints.
+	lock sync.Mutex
+}
+
+func NewHttpLimiter() *HttpLimiter {
+	return &HttpLimiter{endpoints: make(map[string]*HttpLimiterEndpoint)}
+}
+
+// Initialize the limits of endpoints, the limits are configured by env SRS_EXEC_CONCURRENCY and
+// SRS_FFMPEG_CONCURRENCY.
+func (v *HttpLimiter) Initialize(ctx context.Context) error {
+	parseLimit := func(value string, defaultLimit int) (int, error) {
+		if value == "" {
+			return defaultLimit, nil
+		}
+		if iv, err := strconv.Atoi(value); err != nil {
+			return 0, errors.Wrapf(err, "parse %v", value)
+		} else if iv <= 0 {
+			return 0, errors.Errorf("invalid limit %v", value)
+		} else {
+			return iv, nil
+		}
+	}
+
+	execLimit, err := parseLimit(envExecConcurrency(), httpLimiterDefaultExecConcurrency)
+	if err != nil {
+		return errors.Wrapf(err, "exec concurrency")
+	}
+	for _, ep := range httpLimiterExecEndpoints {
+		v.SetLimit(ep, execLimit)
+	}
+
+	ffmpegLimit, err := parseLimit(envFFmpegConcurrency(), httpLimiterDefaultFFmpegConcurrency)
+	if err != nil {
+		return errors.Wrapf(err, "ffmpeg concurrency")
+	}
+	for _, ep := range httpLimiterFFmpegEndpoints {
+		v.SetLimit(ep, ffmpegLimit)
+	}
+
+	logger.Tf(ctx, "limiter init ok, exec=%v, ffmpeg=%v, endpoints=%v",
+		execLimit, ffmpegLimit, len(httpLimiterExecEndpoints)+len(httpLimiterFFmpegEndpoints),
+	)
+	return nil
+}
+
+// SetLimit set the concurrency limit of endpoint.
+func (v *HttpLimiter) SetLimit(path string, limit int) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.endpoints[path] = &HttpLimiterEndpoint{Path: path, Limit: limit, slots: make(chan bool, limit)}
+}
+
+// Endpoints returns the snapshot of endpoints, sorted by path.
+func (v *HttpLimiter) Endpoints() []*HttpLimiterEndpoint {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	endpoints := make([]*HttpLimiterEndpoint, 0, len(v.endpoints))
+	for _, ep := range v.endpoints {
+		endpoints = append(endpoints, &HttpLimiterEndpoint{
+			Path: ep.Path, Limit: ep.Limit, InFlight: atomic.LoadInt64(&ep.InFlight),
+			Waiting: atomic.LoadInt64(&ep.Waiting), Rejected: atomic.LoadInt64(&ep.Rejected),
+		})
+	}
+	sort.Slice(endpoints, func(i, j int) bool {
+		return endpoints[i].Path < endpoints[j].Path
+	})
+	return endpoints
+}
+
+func (v *HttpLimiter) match(path string) *HttpLimiterEndpoint {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if ep, ok := v.endpoints[path]; ok {
+		return ep
+	}
+	for _, ep := range v.endpoints {
+		if strings.HasSuffix(ep.Path, "/") && strings.HasPrefix(path, ep.Path) {
+			return ep
+		}
+	}
+	return nil
+}
+
+// ServeHTTP serves the request by handler, if there is a free slot in the wait timeout, or response 503.
+func (v *HttpLimiter) ServeHTTP(w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	ep := v.match(r.URL.Path)
+	if ep == nil {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	atomic.AddInt64(&ep.Waiting, 1)
+	select {
+	case ep.slots <- true:
+		atomic.AddInt64(&ep.Waiting, -1)
+	case <-r.Context().Done():
+		atomic.AddInt64(&ep.Waiting, -1)
+		return
+	case <-time.After(httpLimiterWaitTimeout):
+		atomic.AddInt64(&ep.Waiting, -1)
+		atomic.AddInt64(&ep.Rejected, 1)
+
+		ctx := logger.WithContext(r.Context())
+		logger.Wf(ctx, "limiter reject %v from %v, %v", r.URL.Path, clientIP(r), ep.String())
+
+		w.Header().Set("Retry-After", fmt.Sprintf("%v", int(httpLimiterWaitTimeout.Seconds())))
+		httpWriteError(ctx, w, r, newHttpCodeError(http.StatusServiceUnavailable, SrsStackErrorTooManyRequests,
+			errors.Errorf("too many requests, limit is %v", ep.Limit),
+		))
+		return
+	}
+
+	atomic.AddInt64(&ep.InFlight, 1)
+	defer func() {
+		atomic.AddInt64(&ep.InFlight, -1)
+		<-ep.slots
+	}()
+
+	handler.ServeHTTP(w, r)
+}
+
+func handleMgmtMetrics(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/metrics"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			metrics := &struct {
+				Limiter      []*HttpLimiterEndpoint   `json:"limiter"`
+				Bilibili     *BilibiliCacheMetrics    `json:"bilibili"`
+				Panics       *PanicMetrics            `json:"panics"`
+				Redis        *RedisWriteBufferMetrics `json:"redis,omitempty"`
+				Housekeeping *HousekeepingMetrics     `json:"housekeeping"`
+				Streams      []*EventStreamMetrics    `json:"streams"`
+			}{
+				Limiter: httpLimiter.Endpoints(), Bilibili: bilibiliCache.Metrics(), Panics: queryPanicMetrics(),
+				Housekeeping: housekeeper.Metrics(), Streams: eventStreamMetrics.Metrics(),
+			}
+			if redisWriteBuffer != nil {
+				metrics.Redis = redisWriteBuffer.Metrics()
+			}
+			httpWriteData(ctx, w, r, metrics)
+			logger.Tf(ctx, "metrics query ok, token=%vB", len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
+
+// ClientRateLimiter limits the number of requests from each client in a fixed window, for the endpoints which are
+// unauthenticated or called by other services.
+type ClientRateLimiter struct {
+	// The duration of window, and the max number of requests from a client in a window.
+	period time.Duration
+	limit  int
+	// The start of current window.
+	window time.Time
+	// The number of requests in current window, the key is client IP.
+	requests map[string]int
+	lock     sync.Mutex
+}
+
+func NewClientRateLimiter(period time.Duration, limit int) *ClientRateLimiter {
+	return &ClientRateLimiter{period: period, limit: limit, requests: make(map[string]int)}
+}
+
+// Allow returns whether the request of client is allowed at t.
+func (v *ClientRateLimiter) Allow(client string, t time.Time) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if t.Sub(v.window) >= v.period {
+		v.window, v.requests = t, make(map[string]int)
+	}
+
+	if v.requests[client] >= v.limit {
+		return false
+	}
+	v.requests[client]++
+	return true
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimiter_RejectExcessRequests(t *testing.T) {
+	limiter := NewHttpLimiter()
+	limiter.SetLimit("/terraform/v1/mgmt/streams/snapshot/", 1)
+
+	release := make(chan bool)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limiter.ServeHTTP(w, r, handler)
+	}))
+	defer server.Close()
+
+	// The first request holds the only slot.
+	first := make(chan int, 1)
+	go func() {
+		if res, err := http.Get(server.URL + "/terraform/v1/mgmt/streams/snapshot/a.jpg"); err == nil {
+			res.Body.Close()
+			first <- res.StatusCode
+		}
+	}()
+
+	for limiter.Endpoints()[0].InFlight != 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The excess request should be rejected after waiting.
+	res, err := http.Get(server.URL + "/terraform/v1/mgmt/streams/snapshot/b.jpg")
+	if err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusServiceUnavailable || res.Header.Get("Retry-After") == "" {
+		t.Errorf("Fail for status %v, retry-after %v", res.StatusCode, res.Header.Get("Retry-After"))
+	}
+	if ep := limiter.Endpoints()[0]; ep.Rejected != 1 {
+		t.Errorf("Fail for %v", ep.String())
+	}
+
+	// The first request should be served once released.
+	close(release)
+	if status := <-first; status != http.StatusOK {
+		t.Errorf("Fail for status %v", status)
+	}
+}
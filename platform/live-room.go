@@ -10,7 +10,6 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
 	"github.com/go-redis/redis/v8"
@@ -20,9 +19,12 @@ func handleLiveRoomService(ctx context.Context, handler *http.ServeMux) error {
 	ep := "/terraform/v1/live/room/create"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, title string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				Title *string `json:"title"`
 			}{
@@ -49,24 +51,27 @@ func handleLiveRoomService(ctx context.Context, handler *http.ServeMux) error {
 
 			// Note that we need to update the auth secret, because we do not use room uuid as stream name.
 			roomPublishAuthKey := GenerateRoomPublishKey(room.StreamName)
-			if err := rdb.HSet(ctx, SRS_AUTH_SECRET, roomPublishAuthKey, room.Secret).Err(); err != nil {
-				return errors.Wrapf(err, "hset %v %v %v", SRS_AUTH_SECRET, roomPublishAuthKey, room.Secret)
+			if err := rdb.HSet(ctx, SRS_AUTH_SECRET, roomPublishAuthKey, hashStreamSecret(room.Secret)).Err(); err != nil {
+				return errors.Wrapf(err, "hset %v %v", SRS_AUTH_SECRET, roomPublishAuthKey)
 			}
 
-			ohttp.WriteData(ctx, w, r, &room)
+			httpWriteData(ctx, w, r, &room)
 			logger.Tf(ctx, "srs live room create ok, title=%v, room=%v", title, room.String())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/live/room/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, rid string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token    *string `json:"token"`
 				RoomUUID *string `json:"uuid"`
 			}{
@@ -89,21 +94,24 @@ func handleLiveRoomService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Wrapf(err, "unmarshal %v %v", rid, r0)
 			}
 
-			ohttp.WriteData(ctx, w, r, &room)
+			httpWriteData(ctx, w, r, &room)
 			logger.Tf(ctx, "srs live room query ok, uuid=%v, room=%v", rid, room.String())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/live/room/update"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var room SrsLiveRoom
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				*SrsLiveRoom
 			}{
@@ -132,8 +140,8 @@ func handleLiveRoomService(ctx context.Context, handler *http.ServeMux) error {
 
 			// Note that we need to update the auth secret, because we do not use room uuid as stream name.
 			roomPublishAuthKey := GenerateRoomPublishKey(room.StreamName)
-			if err := rdb.HSet(ctx, SRS_AUTH_SECRET, roomPublishAuthKey, room.Secret).Err(); err != nil {
-				return errors.Wrapf(err, "hset %v %v %v", SRS_AUTH_SECRET, roomPublishAuthKey, room.Secret)
+			if err := rdb.HSet(ctx, SRS_AUTH_SECRET, roomPublishAuthKey, hashStreamSecret(room.Secret)).Err(); err != nil {
+				return errors.Wrapf(err, "hset %v %v", SRS_AUTH_SECRET, roomPublishAuthKey)
 			}
 
 			// Limit the changing rate for AI Assistant.
@@ -142,20 +150,23 @@ func handleLiveRoomService(ctx context.Context, handler *http.ServeMux) error {
 			case <-time.After(300 * time.Millisecond):
 			}
 
-			ohttp.WriteData(ctx, w, r, &room)
+			httpWriteData(ctx, w, r, &room)
 			logger.Tf(ctx, "srs live room update ok, room=%v", room.String())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/live/room/list"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -181,7 +192,7 @@ func handleLiveRoomService(ctx context.Context, handler *http.ServeMux) error {
 				}
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Rooms []*SrsLiveRoom `json:"rooms"`
 			}{
 				Rooms: rooms,
@@ -189,16 +200,19 @@ func handleLiveRoomService(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "srs live room list ok, rooms=%v", len(rooms))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/live/room/remove"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, roomUUID string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token    *string `json:"token"`
 				RoomUUID *string `json:"uuid"`
 			}{
@@ -230,12 +244,16 @@ func handleLiveRoomService(ctx context.Context, handler *http.ServeMux) error {
 			if err := rdb.HDel(ctx, SRS_AUTH_SECRET, roomPublishAuthKey).Err(); err != nil {
 				return errors.Wrapf(err, "hdel %v %v", SRS_AUTH_SECRET, roomPublishAuthKey)
 			}
+			// The quota lives with the key, see StreamQuota.
+			if err := saveStreamQuota(ctx, room.StreamName, nil); err != nil {
+				return errors.Wrapf(err, "remove quota of %v", room.StreamName)
+			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "srs remove room ok, uuid=%v", roomUUID)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
@@ -0,0 +1,197 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The TTL of distributed lock, which is renewed by the holder, so the lock is released by redis if holder crashes.
+const redisLockTTL = 30 * time.Second
+
+// The script to delete the lock only if it's still held by us.
+var redisLockReleaseScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("del", KEYS[1]) else return 0 end`)
+
+// The script to renew the lock only if it's still held by us.
+var redisLockRenewScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then return redis.call("pexpire", KEYS[1], ARGV[2]) else return 0 end`)
+
+// The identity of this platform replica, to show which replica holds the lock.
+var redisLockHolder = func() string {
+	hostname, _ := os.Hostname()
+	return fmt.Sprintf("%v/%v", hostname, os.Getpid())
+}()
+
+// RedisLockState is the value of lock in redis.
+type RedisLockState struct {
+	// The identity of replica which holds the lock, hostname/pid.
+	Holder string `json:"holder"`
+	// The fencing token, which increases for each acquire, so the mutation of a stale holder is able to be rejected.
+	Token int64 `json:"token"`
+	// The time when the lock is acquired, in RFC3339.
+	Acquired string `json:"acquired"`
+}
+
+func (v *RedisLockState) String() string {
+	return fmt.Sprintf("holder=%v, token=%v, acquired=%v", v.Holder, v.Token, v.Acquired)
+}
+
+// RedisLockBusyError is the error when the lock is held by other replica.
+type RedisLockBusyError struct {
+	Key   string
+	State *RedisLockState
+}
+
+func (v *RedisLockBusyError) Error() string {
+	return fmt.Sprintf("%v in progress elsewhere, %v", v.Key, v.State.String())
+}
+
+// RedisLock is a distributed lock held by this replica, which is renewed until released.
+type RedisLock struct {
+	// The key of lock.
+	Key string
+	// The state of lock, which is the value in redis.
+	State *RedisLockState
+
+	value  string
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// acquireRedisLock acquires the lock by SET NX with TTL, and renew it in background. Return RedisLockBusyError if the
+// lock is held by others. Note that the ctx of lock is cancelled if the lock is lost, for example, redis is down for a
+// long time and the lock expires, so the holder should stop the mutation.
+func acquireRedisLock(ctx context.Context, key string) (*RedisLock, error) {
+	token, err := rdb.Incr(ctx, SRS_LOCK_FENCING).Result()
+	if err != nil {
+		return nil, errors.Wrapf(err, "incr %v", SRS_LOCK_FENCING)
+	}
+
+	state := &RedisLockState{Holder: redisLockHolder, Token: token, Acquired: time.Now().Format(time.RFC3339)}
+	b, err := json.Marshal(state)
+	if err != nil {
+		return nil, errors.Wrapf(err, "marshal %v", state.String())
+	}
+
+	if ok, err := rdb.SetNX(ctx, key, string(b), redisLockTTL).Result(); err != nil {
+		return nil, errors.Wrapf(err, "set %v nx", key)
+	} else if !ok {
+		holder, err := queryRedisLock(ctx, key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "query %v", key)
+		} else if holder == nil {
+			// The lock is just released, let caller retry.
+			holder = &RedisLockState{}
+		}
+		return nil, &RedisLockBusyError{Key: key, State: holder}
+	}
+
+	v := &RedisLock{Key: key, State: state, value: string(b)}
+	v.ctx, v.cancel = context.WithCancel(ctx)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		defer v.cancel()
+
+		for {
+			select {
+			case <-v.ctx.Done():
+				return
+			case <-time.After(redisLockTTL / 3):
+			}
+
+			if ok, err := redisLockRenewScript.Run(v.ctx, rdb, []string{key}, v.value,
+				redisLockTTL.Milliseconds(),
+			).Int(); err != nil && v.ctx.Err() == nil {
+				logger.Wf(v.ctx, "lock: ignore renew %v err %+v", key, err)
+			} else if err == nil && ok == 0 {
+				logger.Wf(v.ctx, "lock: %v is lost, %v", key, state.String())
+				return
+			}
+		}
+	}()
+
+	logger.Tf(ctx, "lock: acquire %v ok, %v", key, state.String())
+	return v, nil
+}
+
+// Context returns the ctx which is cancelled when the lock is released or lost.
+func (v *RedisLock) Context() context.Context {
+	return v.ctx
+}
+
+// Release stop renewing and delete the lock if it's still held by us.
+func (v *RedisLock) Release(ctx context.Context) error {
+	v.cancel()
+	v.wg.Wait()
+
+	if err := redisLockReleaseScript.Run(ctx, rdb, []string{v.Key}, v.value).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "release %v", v.Key)
+	}
+
+	logger.Tf(ctx, "lock: release %v ok, %v", v.Key, v.State.String())
+	return nil
+}
+
+// withRedisLock run pfn with the lock held, and the ctx of pfn is cancelled if the lock is lost. Return a conflict error
+// with the holder if the lock is held by others. Note that the lock is not reentrant.
+func withRedisLock(ctx context.Context, key string, pfn func(ctx context.Context, lock *RedisLock) error) error {
+	lock, err := acquireRedisLock(ctx, key)
+	if err != nil {
+		if r0, ok := err.(*RedisLockBusyError); ok {
+			return newHttpCodeError(http.StatusConflict, SrsStackErrorLockBusy, r0)
+		}
+		return errors.Wrapf(err, "acquire %v", key)
+	}
+	defer func() {
+		if err := lock.Release(ctx); err != nil {
+			logger.Wf(ctx, "lock: ignore err %+v", err)
+		}
+	}()
+
+	return pfn(lock.Context(), lock)
+}
+
+// queryRedisLock returns the state of lock, or nil if not held.
+func queryRedisLock(ctx context.Context, key string) (*RedisLockState, error) {
+	value, err := rdb.Get(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "get %v", key)
+	} else if value == "" {
+		return nil, nil
+	}
+
+	var state RedisLockState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", value)
+	}
+	return &state, nil
+}
+
+// queryRedisLocks returns the state of locks for status, the key is the name of lock, nil if not held.
+func queryRedisLocks(ctx context.Context) (map[string]*RedisLockState, error) {
+	locks := make(map[string]*RedisLockState)
+	for name, key := range map[string]string{"upgrade": SRS_LOCK_UPGRADE, "nginx": SRS_LOCK_NGINX} {
+		state, err := queryRedisLock(ctx, key)
+		if err != nil {
+			return nil, errors.Wrapf(err, "query %v", key)
+		}
+		locks[name] = state
+	}
+	return locks, nil
+}
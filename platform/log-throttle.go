@@ -0,0 +1,229 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The default window to collapse the identical messages, and the max number of messages to track.
+const (
+	logThrottleDefaultWindow = time.Minute
+	logThrottleMaxEntries    = 1024
+)
+
+// The max window to collapse the identical messages, to avoid losing logs for too long.
+const logThrottleMaxWindow = time.Hour
+
+// The messages which are never throttled, because they are security-relevant, for example, the failed login or the
+// invalid token, which should be logged for each attempt. Match the format and key, case-insensitive.
+var logThrottleExemptions = []string{"authenticate", "login", "password", "token", "secret", "panic"}
+
+var logThrottle = NewLogThrottle(logThrottleDefaultWindow, logThrottleMaxEntries)
+
+type logThrottleEntry struct {
+	// The start of window, when the message is logged.
+	start time.Time
+	// The number of messages suppressed in window.
+	suppressed int
+}
+
+// LogThrottleState is the state of throttle, for the runtime log endpoint.
+type LogThrottleState struct {
+	// Whether throttle is enabled.
+	Enabled bool `json:"enabled"`
+	// The window in seconds.
+	Window int `json:"window"`
+	// The number of messages tracked, and the max number.
+	Entries    int `json:"entries"`
+	MaxEntries int `json:"maxEntries"`
+	// The total number of messages suppressed.
+	Suppressed int64 `json:"suppressed"`
+}
+
+func (v *LogThrottleState) String() string {
+	return fmt.Sprintf("enabled=%v, window=%v, entries=%v, maxEntries=%v, suppressed=%v",
+		v.Enabled, v.Window, v.Entries, v.MaxEntries, v.Suppressed,
+	)
+}
+
+// LogThrottle collapses the identical messages by format and key in a window, to avoid the logs of repetitive errors
+// drowning out the useful ones, for example, each poll of UI fails when redis is down. The first message in window is
+// logged, and the next one after window is logged with the number of suppressed messages.
+type LogThrottle struct {
+	enabled    bool
+	window     time.Duration
+	maxEntries int
+	suppressed int64
+	entries    map[string]*logThrottleEntry
+	lock       sync.Mutex
+}
+
+func NewLogThrottle(window time.Duration, maxEntries int) *LogThrottle {
+	return &LogThrottle{
+		enabled: true, window: window, maxEntries: maxEntries, entries: make(map[string]*logThrottleEntry),
+	}
+}
+
+func (v *LogThrottle) State() *LogThrottleState {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	return &LogThrottleState{
+		Enabled: v.enabled, Window: int(v.window.Seconds()), Entries: len(v.entries), MaxEntries: v.maxEntries,
+		Suppressed: v.suppressed,
+	}
+}
+
+// Update the throttle, and reset the tracked messages.
+func (v *LogThrottle) Update(enabled bool, window time.Duration) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	v.enabled, v.window = enabled, window
+	v.entries = make(map[string]*logThrottleEntry)
+}
+
+// allow returns whether to log the message, and the number of suppressed messages before it.
+func (v *LogThrottle) allow(format, key string, now time.Time) (int, bool) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.enabled {
+		return 0, true
+	}
+
+	id := fmt.Sprintf("%v|%v", format, key)
+	lowerID := strings.ToLower(id)
+	for _, exemption := range logThrottleExemptions {
+		if strings.Contains(lowerID, exemption) {
+			return 0, true
+		}
+	}
+
+	if entry, ok := v.entries[id]; ok {
+		if now.Sub(entry.start) < v.window {
+			entry.suppressed++
+			v.suppressed++
+			return 0, false
+		}
+
+		suppressed := entry.suppressed
+		entry.start, entry.suppressed = now, 0
+		return suppressed, true
+	}
+
+	// Bound the memory, remove the expired entries, then the oldest one if still full.
+	if len(v.entries) >= v.maxEntries {
+		var oldestID string
+		var oldest time.Time
+		for id, entry := range v.entries {
+			if now.Sub(entry.start) >= v.window {
+				delete(v.entries, id)
+			} else if oldestID == "" || entry.start.Before(oldest) {
+				oldestID, oldest = id, entry.start
+			}
+		}
+		if len(v.entries) >= v.maxEntries {
+			delete(v.entries, oldestID)
+		}
+	}
+
+	v.entries[id] = &logThrottleEntry{start: now}
+	return 0, true
+}
+
+// Wf logs the warning like logger.Wf, but collapses the identical messages by format and key in window. The key
+// identifies the message, for example, the error without stack.
+func (v *LogThrottle) Wf(ctx logger.Context, key, format string, a ...interface{}) {
+	if suppressed, ok := v.allow(format, key, time.Now()); !ok {
+		return
+	} else if suppressed > 0 {
+		logger.Wf(ctx, format+", repeated %v times", append(a, suppressed)...)
+	} else {
+		logger.Wf(ctx, format, a...)
+	}
+}
+
+// Ef logs the error like logger.Ef, see Wf.
+func (v *LogThrottle) Ef(ctx logger.Context, key, format string, a ...interface{}) {
+	if suppressed, ok := v.allow(format, key, time.Now()); !ok {
+		return
+	} else if suppressed > 0 {
+		logger.Ef(ctx, format+", repeated %v times", append(a, suppressed)...)
+	} else {
+		logger.Ef(ctx, format, a...)
+	}
+}
+
+// filterHttpError logs the error of ohttp.WriteError by throttle, see ohttp.FilterError.
+func filterHttpError(ctx logger.Context, w http.ResponseWriter, r *http.Request, err error) string {
+	logThrottle.Ef(ctx, fmt.Sprintf("%v %v", r.URL.Path, err.Error()), "Serve %v failed, err is %+v", r.URL, err)
+	return err.Error()
+}
+
+func handleMgmtLogThrottle(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/log/throttle"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var enabled *bool
+			var window *int
+			if err := ParseBody(ctx, r, &struct {
+				Token   *string `json:"token"`
+				Enabled **bool  `json:"enabled"`
+				Window  **int   `json:"window"`
+			}{
+				Token: &token, Enabled: &enabled, Window: &window,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Update the throttle if any field, or query it.
+			if enabled != nil || window != nil {
+				state := logThrottle.State()
+				newEnabled, newWindow := state.Enabled, time.Duration(state.Window)*time.Second
+				if enabled != nil {
+					newEnabled = *enabled
+				}
+				if window != nil {
+					newWindow = time.Duration(*window) * time.Second
+				}
+				if newWindow <= 0 || newWindow > logThrottleMaxWindow {
+					return newHttpStatusError(http.StatusBadRequest, errors.Errorf(
+						"invalid window %v, should in (0, %v]", newWindow, logThrottleMaxWindow,
+					))
+				}
+
+				logThrottle.Update(newEnabled, newWindow)
+				logger.Tf(ctx, "log throttle update ok, enabled=%v, window=%v", newEnabled, newWindow)
+			}
+
+			state := logThrottle.State()
+			httpWriteData(ctx, w, r, state)
+			logger.Tf(ctx, "log throttle ok, %v, token=%vB", state.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -19,6 +19,7 @@ import (
 	"time"
 
 	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
 	"github.com/go-redis/redis/v8"
@@ -35,6 +36,9 @@ func init() {
 
 	// We use polling to update some fast cache, for example, LLHLS config.
 	fastCache = NewFastCache()
+
+	// Collapse the repetitive errors of handlers, for example, when redis is down.
+	ohttp.FilterError = filterHttpError
 }
 
 func main() {
@@ -43,6 +47,12 @@ func main() {
 
 	if err := doMain(ctx); err != nil {
 		logger.Tf(ctx, "run err %+v", err)
+
+		// Exit with the distinct code, if the dependencies never come up.
+		if r0, ok := errors.Cause(err).(*startupError); ok {
+			logger.Ef(ctx, "exit %v for dependency %v is not ready", startupExitCode, r0.dependency)
+			os.Exit(startupExitCode)
+		}
 		return
 	}
 
@@ -120,6 +130,39 @@ func doMain(ctx context.Context) error {
 	// For feature control.
 	setEnvDefault("NAME_LOOKUP", "on")
 	setEnvDefault("PLATFORM_DOCKER", "off")
+	// The services to query in host mode, by pidfile or systemctl, and the script to upgrade them.
+	setEnvDefault("PLATFORM_HOST_SERVICES", "srs,oryx")
+	setEnvDefault("PLATFORM_UPGRADE_SCRIPT", "")
+	// The socket of Docker Engine API to manage containers in docker mode, fallback to docker CLI if not visible.
+	setEnvDefault("PLATFORM_DOCKER_SOCKET", "/var/run/docker.sock")
+	// The STUN or HTTPS echo service to detect the public IP, for example, stun:stun.l.google.com:19302
+	setEnvDefault("CANDIDATE_ECHO_SERVER", "https://api.ipify.org")
+	// Whether trust the X-Forwarded-For and X-Real-IP from the proxies, for example, the nginx.
+	setEnvDefault("MGMT_TRUST_PROXY", "off")
+	// Whether allow to query the api secret by admin, set to off for installs which never need it.
+	setEnvDefault("MGMT_SECRET_QUERY", "on")
+	// The releases feed for release notes, compatible with GitHub releases API, overwrite it for mirrors.
+	setEnvDefault("RELEASES_FEED", "https://api.github.com/repos/ossrs/oryx/releases/tags")
+	setEnvDefault("MGMT_TRUSTED_PROXIES", "127.0.0.0/8,::1/128")
+	// The interval to refresh the latest version in background, set to off for air-gapped installs.
+	setEnvDefault("VERSIONS_REFRESH_INTERVAL", "6h")
+	// The interval to check the clock drift, set to off for air-gapped installs. The server is the one of
+	// RELEASES_FEED if empty.
+	setEnvDefault("CLOCK_CHECK_INTERVAL", "1h")
+	setEnvDefault("CLOCK_CHECK_SERVER", "")
+	// The allowlist of sites to embed the player page by iframe, separated by space, * for any site.
+	setEnvDefault("PLAYER_FRAME_ANCESTORS", "*")
+	// Whether only log the pending data migrations in redis, without applying them.
+	setEnvDefault("MIGRATIONS_DRY_RUN", "off")
+	// The timeout to wait for redis and docker at startup, set to off to skip for development.
+	setEnvDefault("PLATFORM_STARTUP_TIMEOUT", "60s")
+	// The path prefix to serve platform, for example, /srs to deploy at https://ops.example.com/srs/ behind proxy.
+	setEnvDefault("PLATFORM_BASE_PATH", "")
+	// The interval between thumbnails of record preview, and the max number of ffmpeg to generate previews.
+	setEnvDefault("RECORD_PREVIEW_INTERVAL", "10s")
+	setEnvDefault("RECORD_PREVIEW_CONCURRENCY", "2")
+	// The disk budget in MB for the retained segments of all HLS time-shift streams.
+	setEnvDefault("HLS_TIMESHIFT_BUDGET", "10240")
 
 	// For multiple ports.
 	setEnvDefault("RTMP_PORT", "1935")
@@ -131,6 +174,20 @@ func doMain(ctx context.Context) error {
 	setEnvDefault("SRS_FORWARD_LIMIT", "10")
 	setEnvDefault("SRS_VLIVE_LIMIT", "10")
 	setEnvDefault("SRS_CAMERA_LIMIT", "10")
+	setEnvDefault("SRS_EXEC_CONCURRENCY", "4")
+	setEnvDefault("SRS_FFMPEG_CONCURRENCY", "8")
+
+	// For SRS HTTP API proxy.
+	setEnvDefault("SRS_API_SERVER", "http://127.0.0.1:1985")
+	setEnvDefault("SRS_API_PROXY_WRITE", "off")
+	// The server for SRS to callback, to generate the http_hooks with the hooks secret.
+	setEnvDefault("SRS_HOOKS_SERVER", "http://localhost:2022")
+
+	// The SMTP server to send the code to recover password, such as smtp.example.com:587, print to log if empty.
+	setEnvDefault("SMTP_SERVER", "")
+	setEnvDefault("SMTP_USERNAME", "")
+	setEnvDefault("SMTP_PASSWORD", "")
+	setEnvDefault("SMTP_FROM", "")
 
 	logger.Tf(ctx, "load .env as MGMT_PASSWORD=%vB, GO_PPROF=%v, "+
 		"SRS_PLATFORM_SECRET=%vB, CLOUD=%v, REGION=%v, SOURCE=%v, SRT_PORT=%v, RTC_PORT=%v, "+
@@ -138,7 +195,12 @@ func doMain(ctx context.Context) error {
 		"PUBLIC_URL=%v, BUILD_PATH=%v, REACT_APP_LOCALE=%v, PLATFORM_LISTEN=%v, HTTP_PORT=%v, "+
 		"REGISTRY=%v, MGMT_LISTEN=%v, HTTPS_LISTEN=%v, AUTO_SELF_SIGNED_CERTIFICATE=%v, "+
 		"NAME_LOOKUP=%v, PLATFORM_DOCKER=%v, SRS_FORWARD_LIMIT=%v, SRS_VLIVE_LIMIT=%v, "+
-		"SRS_CAMERA_LIMIT=%v, YTDL_PROXY=%v",
+		"SRS_CAMERA_LIMIT=%v, YTDL_PROXY=%v, SRS_API_SERVER=%v, SRS_API_PROXY_WRITE=%v, "+
+		"SRS_EXEC_CONCURRENCY=%v, SRS_FFMPEG_CONCURRENCY=%v, CANDIDATE_ECHO_SERVER=%v, "+
+		"MGMT_TRUST_PROXY=%v, MGMT_TRUSTED_PROXIES=%v, RELEASES_FEED=%v, VERSIONS_REFRESH_INTERVAL=%v, CLOCK_CHECK_INTERVAL=%v, CLOCK_CHECK_SERVER=%v, PLAYER_FRAME_ANCESTORS=%v, "+
+		"MIGRATIONS_DRY_RUN=%v, MGMT_SECRET_QUERY=%v, MGMT_PASSWORD_COMPLEXITY=%v, PLATFORM_DEPLOY_MODE=%v, PLATFORM_HOST_SERVICES=%v, PLATFORM_UPGRADE_SCRIPT=%v, PLATFORM_DOCKER_SOCKET=%v, "+
+		"PLATFORM_STARTUP_TIMEOUT=%v, PLATFORM_BASE_PATH=%v, RECORD_PREVIEW_INTERVAL=%v, RECORD_PREVIEW_CONCURRENCY=%v, HLS_TIMESHIFT_BUDGET=%v, SRS_HOOKS_SERVER=%v, "+
+		"SMTP_SERVER=%v, SMTP_USERNAME=%v, SMTP_PASSWORD=%vB, SMTP_FROM=%v",
 		len(envMgmtPassword()), envGoPprof(), len(envApiSecret()), envCloud(),
 		envRegion(), envSource(), envSrtListen(), envRtcListen(),
 		envNodeEnv(), envLocalRelease(),
@@ -148,9 +210,22 @@ func doMain(ctx context.Context) error {
 		envRegistry(), envMgmtListen(), envHttpListen(),
 		envSelfSignedCertificate(), envNameLookup(),
 		envPlatformDocker(), envForwardLimit(), envVLiveLimit(),
-		envCameraLimit(), envYtdlProxy(),
+		envCameraLimit(), envYtdlProxy(), envSrsApiServer(), envSrsApiProxyWrite(),
+		envExecConcurrency(), envFFmpegConcurrency(), envCandidateEchoServer(),
+		envMgmtTrustProxy(), envMgmtTrustedProxies(), envReleasesFeed(), envVersionsRefreshInterval(), envClockCheckInterval(), envClockCheckServer(), envPlayerFrameAncestors(),
+		envMigrationsDryRun(), envMgmtSecretQuery(), envMgmtPasswordComplexity(), envPlatformDeployMode(), envPlatformHostServices(), envPlatformUpgradeScript(), envPlatformDockerSocket(),
+		envPlatformStartupTimeout(), envPlatformBasePath(), envRecordPreviewInterval(), envRecordPreviewConcurrency(), envHlsTimeShiftBudget(), envSrsHooksServer(),
+		envSmtpServer(), envSmtpUsername(), len(envSmtpPassword()), envSmtpFrom(),
 	)
 
+	// Detect the deploy mode, after the env is loaded.
+	if mode, err := detectDeployMode(); err != nil {
+		return errors.Wrapf(err, "detect deploy mode")
+	} else {
+		conf.DeployMode = mode
+		logger.Tf(ctx, "deploy mode is %v", conf.DeployMode)
+	}
+
 	// Start the Go pprof if enabled.
 	if addr := envGoPprof(); addr != "" {
 		go func() {
@@ -170,6 +245,29 @@ func doMain(ctx context.Context) error {
 	}
 	logger.Tf(ctx, "init rdb(redis client) ok")
 
+	// Listen early to serve /healthz and starting up, then wait for the dependencies, skip if disabled by
+	// PLATFORM_STARTUP_TIMEOUT for development.
+	gate := newStartupGate()
+	httpService := NewHTTPService(gate)
+	defer httpService.Close()
+	if timeout, err := parseStartupTimeout(envPlatformStartupTimeout()); err != nil {
+		return errors.Wrapf(err, "parse PLATFORM_STARTUP_TIMEOUT")
+	} else if timeout <= 0 {
+		logger.Tf(ctx, "startup: disable waiting for dependencies")
+	} else {
+		if err := httpService.Start(ctx); err != nil {
+			return errors.Wrapf(err, "start http service")
+		}
+		if err := waitStartupDependencies(ctx, gate, queryStartupDependencies(), timeout); err != nil {
+			return errors.Wrapf(err, "wait for dependencies")
+		}
+	}
+
+	// Migrate the data in redis, before any worker or API uses it.
+	if err := runMigrations(ctx, migrations, envMigrationsDryRun() == "on"); err != nil {
+		return errors.Wrapf(err, "run migrations")
+	}
+
 	// For platform, we should initOS after redis.
 	// Setup the OS for redis, which should never depends on redis.
 	if err := initOS(ctx); err != nil {
@@ -185,7 +283,22 @@ func doMain(ctx context.Context) error {
 	if err := initMmgt(ctx); err != nil {
 		return errors.Wrapf(err, "init mgmt")
 	}
-	logger.Tf(ctx, "initialize platform region=%v, registry=%v, version=%v", conf.Region, conf.Registry, version)
+	logger.Tf(ctx, "initialize platform region=%v, registry=%v, version=%v", conf.Region(), conf.Registry(), version)
+
+	// Reconcile the stale state after unclean shutdown, before workers start.
+	if r, err := runSelfCheck(ctx); err != nil {
+		return errors.Wrapf(err, "self check")
+	} else {
+		selfCheckResult = r
+	}
+	defer stopSelfCheck(logger.WithContext(context.Background()))
+
+	// Create buffer for non-critical redis writes, which is closed after all workers, to drain the writes.
+	redisWriteBuffer = NewRedisWriteBuffer()
+	defer redisWriteBuffer.Close()
+	if err := redisWriteBuffer.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start redis write buffer")
+	}
 
 	// Create candidate worker for resolving domain to ip.
 	candidateWorker = NewCandidateWorker()
@@ -201,6 +314,34 @@ func doMain(ctx context.Context) error {
 		return errors.Wrapf(err, "start callback worker")
 	}
 
+	// Create event bus, to fan-out the events to sinks, such as webhook.
+	subscribeEventSinks(eventBus)
+	defer eventBus.Close()
+	if err := eventBus.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start event bus")
+	}
+
+	// Create alert worker to evaluate the alerts, after the event bus to publish the firing and resolution.
+	alertWorker = NewAlertWorker()
+	defer alertWorker.Close()
+	if err := alertWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start alert worker")
+	}
+
+	// Create stream health worker to score the publishing streams.
+	streamHealthWorker = NewStreamHealthWorker()
+	defer streamHealthWorker.Close()
+	if err := streamHealthWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start stream health worker")
+	}
+
+	// Create the readiness gate of SRS, before the workers which spawn FFmpeg.
+	srsReadiness = NewSrsReadiness()
+	defer srsReadiness.Close()
+	if err := srsReadiness.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start srs readiness")
+	}
+
 	// Create transcript worker for transcription.
 	transcriptWorker = NewTranscriptWorker()
 	defer transcriptWorker.Close()
@@ -272,6 +413,90 @@ func doMain(ctx context.Context) error {
 		return errors.Wrapf(err, "start IP camera worker")
 	}
 
+	// Create worker for relay, pull stream from other origin on demand.
+	relayWorker = NewRelayWorker()
+	defer relayWorker.Close()
+	if err := relayWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start relay worker")
+	}
+
+	// Create worker for stream alias, feed the logical stream by the sources in priority.
+	aliasWorker = NewAliasWorker()
+	defer aliasWorker.Close()
+	if err := aliasWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start alias worker")
+	}
+
+	// Create tracker for viewers of streams.
+	viewerTracker = NewViewerTracker()
+	defer viewerTracker.Close()
+	if err := viewerTracker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start viewer tracker")
+	}
+
+	// Create worker for HLS time-shift, to retain the segments of streams to rewind.
+	hlsTimeShiftWorker = NewHLSTimeShiftWorker()
+	defer hlsTimeShiftWorker.Close()
+	if err := hlsTimeShiftWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start hls time-shift worker")
+	}
+
+	// Create worker for remote nodes of cluster.
+	clusterWorker = NewClusterWorker()
+	defer clusterWorker.Close()
+	if err := clusterWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start cluster worker")
+	}
+
+	// Create previewer for probing live streams.
+	streamPreviewer = NewStreamPreviewer()
+
+	// Parse the trusted proxies for client IP.
+	if err := initTrustedProxies(ctx); err != nil {
+		return errors.Wrapf(err, "init trusted proxies")
+	}
+
+	// Create limiter for expensive endpoints.
+	httpLimiter = NewHttpLimiter()
+	if err := httpLimiter.Initialize(ctx); err != nil {
+		return errors.Wrapf(err, "init limiter")
+	}
+
+	// Create worker for diagnostics capture mode.
+	diagnostics = NewDiagnostics()
+	defer diagnostics.Close()
+	if err := diagnostics.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start diagnostics")
+	}
+
+	// Create worker for stream schedules.
+	streamScheduler = NewStreamScheduler()
+	defer streamScheduler.Close()
+	if err := streamScheduler.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start stream scheduler")
+	}
+
+	// Create worker for stream quotas.
+	streamQuotaWorker = NewStreamQuotaWorker()
+	defer streamQuotaWorker.Close()
+	if err := streamQuotaWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start stream quota worker")
+	}
+
+	// Create worker to purge the guest keys.
+	streamGuestWorker = NewStreamGuestWorker()
+	defer streamGuestWorker.Close()
+	if err := streamGuestWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start stream guest worker")
+	}
+
+	// Create worker for upgrade drain.
+	upgradeDrainWorker = NewUpgradeDrainWorker()
+	defer upgradeDrainWorker.Close()
+	if err := upgradeDrainWorker.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start upgrade drain worker")
+	}
+
 	// Create worker for crontab.
 	crontabWorker = NewCrontabWorker()
 	defer crontabWorker.Close()
@@ -280,8 +505,6 @@ func doMain(ctx context.Context) error {
 	}
 
 	// Run HTTP service.
-	httpService := NewHTTPService()
-	defer httpService.Close()
 	if err := httpService.Run(ctx); err != nil {
 		return errors.Wrapf(err, "start http service")
 	}
@@ -298,33 +521,45 @@ func initMgmtOS(ctx context.Context) (err error) {
 	}
 
 	// The redis is not available when os startup, so we must directly discover from env or network.
-	if conf.Cloud, conf.Region, err = discoverRegion(ctx); err != nil {
+	var region, registry string
+	if conf.Cloud, region, err = discoverRegion(ctx); err != nil {
 		return errors.Wrapf(err, "discover region")
 	}
+	conf.SetRegion(region)
 
 	// Always update the source, because it might change.
-	if conf.Source, err = discoverSource(ctx, conf.Cloud, conf.Region); err != nil {
+	if conf.Source, err = discoverSource(ctx, conf.Cloud, region); err != nil {
 		return errors.Wrapf(err, "discover source")
 	}
 
 	// Always update the registry, because it might change.
-	if conf.Registry, err = discoverRegistry(ctx, conf.Source); err != nil {
+	if registry, err = discoverRegistry(ctx, conf.Source); err != nil {
 		return errors.Wrapf(err, "discover registry")
 	}
+	conf.SetRegistry(registry)
 
 	logger.Tf(ctx, "initOS %v", conf.String())
 	return
 }
 
-// Initialize the source for redis, note that we don't change the env.
-func initOS(ctx context.Context) (err error) {
-	// Create api secret if not exists, see setupApiSecret
-	if token, err := rdb.HGet(ctx, SRS_PLATFORM_SECRET, "token").Result(); err != nil && err != redis.Nil {
+// Initialize the api secret, the redis is the source of truth, because the .env file might be lost when the volume
+// is recreated, while all the stored credentials and tokens depend on the secret in redis.
+func initApiSecret(ctx context.Context) error {
+	token, err := rdb.HGet(ctx, SRS_PLATFORM_SECRET, "token").Result()
+	if err != nil && err != redis.Nil {
 		return errors.Wrapf(err, "hget %v token", SRS_PLATFORM_SECRET)
-	} else if token == "" {
-		token = envApiSecret()
-		if token == "" {
+	}
+
+	// Create api secret if not exists in redis, use the env or generate a new one.
+	if token == "" {
+		if token = envApiSecret(); checkApiSecret(token) == nil {
+			conf.SecretSource = ApiSecretSourceEnv
+		} else {
+			if token != "" {
+				logger.Wf(ctx, "Platform ignore weak api secret %vB in env, generate a new one", len(token))
+			}
 			token = fmt.Sprintf("srs-v2-%v", strings.ReplaceAll(uuid.NewString(), "-", ""))
+			conf.SecretSource = ApiSecretSourceGenerated
 		}
 
 		if err = rdb.HSet(ctx, SRS_PLATFORM_SECRET, "token", token).Err(); err != nil {
@@ -335,18 +570,45 @@ func initOS(ctx context.Context) (err error) {
 		if err = rdb.HSet(ctx, SRS_PLATFORM_SECRET, "update", update).Err(); err != nil {
 			return errors.Wrapf(err, "hset %v update %v", SRS_PLATFORM_SECRET, update)
 		}
-		logger.Tf(ctx, "Platform update api secret, token=%vB, at=%v", len(token), update)
+		logger.Tf(ctx, "Platform update api secret, token=%vB, source=%v, at=%v", len(token), conf.SecretSource, update)
+	} else {
+		conf.SecretSource = ApiSecretSourceRedis
+
+		// Never replace the secret in redis, because the stored credentials are encrypted by it. The authenticated
+		// API fails with SrsStackErrorNotConfigured until the secret is reset.
+		if err := checkApiSecret(token); err != nil {
+			logger.Wf(ctx, "Platform api secret in redis is weak, err %+v", err)
+		}
 	}
 
-	// For platform, we must use the secret to access API of mgmt.
-	// Query the api secret from redis, cache it to env.
+	// For platform, we must use the secret to access API of mgmt, so we reconcile the env and .env file by redis.
+	if envApiSecret() == token {
+		return nil
+	}
+
+	envFile := envFilePath()
 	if envApiSecret() == "" {
-		if token, err := rdb.HGet(ctx, SRS_PLATFORM_SECRET, "token").Result(); err != nil && err != redis.Nil {
-			return errors.Wrapf(err, "hget %v token", SRS_PLATFORM_SECRET)
-		} else {
-			os.Setenv("SRS_PLATFORM_SECRET", token)
-			logger.Tf(ctx, "Update api secret to %vB", len(token))
-		}
+		logger.Tf(ctx, "Reconcile api secret, env is empty, use %v secret %vB, file=%v",
+			conf.SecretSource, len(token), envFile)
+	} else {
+		logger.Wf(ctx, "Reconcile api secret, env %vB differs from redis, use redis secret %vB, file=%v",
+			len(envApiSecret()), len(token), envFile)
+	}
+	os.Setenv("SRS_PLATFORM_SECRET", token)
+
+	if err := updateEnvFile(ctx, envFile, func(envs map[string]string) {
+		envs["SRS_PLATFORM_SECRET"] = token
+	}); err != nil {
+		return errors.Wrapf(err, "update %v", envFile)
+	}
+
+	return nil
+}
+
+// Initialize the source for redis, note that we don't change the env.
+func initOS(ctx context.Context) (err error) {
+	if err := initApiSecret(ctx); err != nil {
+		return errors.Wrapf(err, "init api secret")
 	}
 
 	// Load the platform from redis, initialized by mgmt.
@@ -362,11 +624,11 @@ func initOS(ctx context.Context) (err error) {
 	// Load the region first, because it never changed.
 	if region, err := rdb.HGet(ctx, SRS_TENCENT_LH, "region").Result(); err != nil && err != redis.Nil {
 		return errors.Wrapf(err, "hget %v region", SRS_TENCENT_LH)
-	} else if region == "" || conf.Region != region {
-		if err = rdb.HSet(ctx, SRS_TENCENT_LH, "region", conf.Region).Err(); err != nil && err != redis.Nil {
-			return errors.Wrapf(err, "hset %v region %v", SRS_TENCENT_LH, conf.Region)
+	} else if region == "" || conf.Region() != region {
+		if err = rdb.HSet(ctx, SRS_TENCENT_LH, "region", conf.Region()).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v region %v", SRS_TENCENT_LH, conf.Region())
 		}
-		logger.Tf(ctx, "Update region=%v", conf.Region)
+		logger.Tf(ctx, "Update region=%v", conf.Region())
 	}
 
 	// Always update the source, because it might change.
@@ -382,7 +644,7 @@ func initOS(ctx context.Context) (err error) {
 	if registry, err := rdb.HGet(ctx, SRS_TENCENT_LH, "registry").Result(); err != nil && err != redis.Nil {
 		return errors.Wrapf(err, "hget %v registry", SRS_TENCENT_LH)
 	} else if registry != "" {
-		conf.Registry = registry
+		conf.SetRegistry(registry)
 	}
 
 	// Discover and update the platform for stat only, not the OS platform.
@@ -398,11 +660,11 @@ func initOS(ctx context.Context) (err error) {
 	// Always update the registry, because it might change.
 	if registry, err := rdb.HGet(ctx, SRS_TENCENT_LH, "registry").Result(); err != nil && err != redis.Nil {
 		return errors.Wrapf(err, "hget %v registry", SRS_TENCENT_LH)
-	} else if registry == "" || conf.Registry != registry {
-		if err = rdb.HSet(ctx, SRS_TENCENT_LH, "registry", conf.Registry).Err(); err != nil && err != redis.Nil {
-			return errors.Wrapf(err, "hset %v registry %v", SRS_TENCENT_LH, conf.Registry)
+	} else if registry == "" || conf.Registry() != registry {
+		if err = rdb.HSet(ctx, SRS_TENCENT_LH, "registry", conf.Registry()).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v registry %v", SRS_TENCENT_LH, conf.Registry())
 		}
-		logger.Tf(ctx, "Update registry=%v", conf.Registry)
+		logger.Tf(ctx, "Update registry=%v", conf.Registry())
 	}
 
 	// Request the host platform OS, whether the OS is Darwin.
@@ -455,7 +717,7 @@ func initPlatform(ctx context.Context) error {
 		logger.Tf(ctx, "boot setup, v=%v, key=%v", bootRelease, SRS_FIRST_BOOT)
 
 		// Generate the dynamic config for NGINX.
-		if err := nginxGenerateConfig(ctx); err != nil {
+		if err := nginxGenerateConfig(ctx, NginxTriggerBoot); err != nil {
 			return errors.Wrapf(err, "nginx config and reload")
 		}
 
@@ -532,15 +794,6 @@ func initPlatform(ctx context.Context) error {
 		}
 	}
 
-	// Cancel upgrading.
-	if upgrading, err := rdb.HGet(ctx, SRS_UPGRADING, "upgrading").Result(); err != nil && err != redis.Nil {
-		return errors.Wrapf(err, "hget %v upgrading", SRS_UPGRADING)
-	} else if upgrading == "1" {
-		if err = rdb.HSet(ctx, SRS_UPGRADING, "upgrading", "0").Err(); err != nil && err != redis.Nil {
-			return errors.Wrapf(err, "hset %v upgrading 0", SRS_UPGRADING)
-		}
-	}
-
 	// Initialize the node id.
 	if nid, err := rdb.HGet(ctx, SRS_TENCENT_LH, "node").Result(); err != nil && err != redis.Nil {
 		return errors.Wrapf(err, "hget %v node", SRS_TENCENT_LH)
@@ -573,26 +826,17 @@ func initMmgt(ctx context.Context) error {
 	}
 
 	// Refresh the env file.
-	envs := map[string]string{}
-	envFile := path.Join(conf.Pwd, "containers/data/config/.env")
-	if _, err := os.Stat(envFile); err == nil {
-		if v, err := godotenv.Read(envFile); err != nil {
-			return errors.Wrapf(err, "load envs")
-		} else {
-			envs = v
+	envFile := envFilePath()
+	if err := updateEnvFile(ctx, envFile, func(envs map[string]string) {
+		envs["CLOUD"] = conf.Cloud
+		envs["REGION"] = conf.Region()
+		envs["SOURCE"] = conf.Source
+		envs["REGISTRY"] = conf.Registry()
+		if envMgmtPassword() != "" {
+			envs["MGMT_PASSWORD"] = envMgmtPassword()
 		}
-	}
-
-	envs["CLOUD"] = conf.Cloud
-	envs["REGION"] = conf.Region
-	envs["SOURCE"] = conf.Source
-	envs["REGISTRY"] = conf.Registry
-	if envMgmtPassword() != "" {
-		envs["MGMT_PASSWORD"] = envMgmtPassword()
-	}
-
-	if err := godotenv.Write(envs, envFile); err != nil {
-		return errors.Wrapf(err, "write %v", envFile)
+	}); err != nil {
+		return errors.Wrapf(err, "update %v", envFile)
 	}
 	logger.Tf(ctx, "Refresh %v ok", envFile)
 
@@ -606,9 +850,9 @@ func refreshLatestVersion(ctx context.Context) error {
 		ctx := logger.WithContext(ctx)
 		for ctx.Err() == nil {
 			versions, err := queryLatestVersion(ctx)
-			if err == nil && versions != nil && versions.Latest != "" {
+			if err == nil && versions != nil && versions.Latest.Version != "" {
 				logger.Tf(ctx, "query version ok, result is %v", versions.String())
-				conf.Versions = *versions
+				conf.SetVersions(versions)
 				versionsCancel()
 
 				// CrontabWorker will start a goroutine to refresh the version.
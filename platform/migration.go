@@ -0,0 +1,133 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// Migration is a run-once change of the data layout in redis. The migration might be run again if the platform crashes
+// before it's recorded, so it must be idempotent.
+type Migration struct {
+	// The number of migration, which must be increasing, and never be changed once released.
+	ID int
+	// The name for logging.
+	Name string
+	// The function to migrate the data.
+	Migrate func(ctx context.Context) error
+}
+
+func (v *Migration) String() string {
+	return fmt.Sprintf("id=%v, name=%v", v.ID, v.Name)
+}
+
+// The migrations in order, please append new migration to the end with the next ID.
+var migrations = []*Migration{
+	// Move the bilibili cache from a hash without TTL, to strings with TTL and LRU eviction.
+	{ID: 1, Name: "bilibili-cache-ttl", Migrate: func(ctx context.Context) error {
+		return bilibiliCache.migrateLegacy(ctx)
+	}},
+	// Grandfather the stream names in use, which violate the default naming policy.
+	{ID: 2, Name: "stream-name-exceptions", Migrate: func(ctx context.Context) error {
+		policy, err := queryStreamNamingPolicy(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "query policy")
+		}
+		if _, err := grandfatherStreamNames(ctx, policy); err != nil {
+			return errors.Wrapf(err, "grandfather names")
+		}
+		return nil
+	}},
+	// Hash the publish keys of live room, which are saved in plaintext.
+	{ID: 3, Name: "hash-stream-keys", Migrate: func(ctx context.Context) error {
+		return migrateStreamSecrets(ctx)
+	}},
+}
+
+// runMigrations apply the migrations which are not recorded in SRS_SCHEMA_MIGRATIONS, in order, before the platform
+// serves any request. It holds SRS_LOCK_MIGRATION, so only one platform replica migrates the data, and it stops at the
+// first failure, because the later migrations might depend on it. For dry run, it only logs the pending migrations.
+func runMigrations(ctx context.Context, migrations []*Migration, dryRun bool) error {
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].ID <= migrations[i-1].ID {
+			return errors.Errorf("migration %v should after %v", migrations[i].String(), migrations[i-1].String())
+		}
+	}
+
+	// Wait for other replica to finish the migrations.
+	var lock *RedisLock
+	for {
+		var err error
+		if lock, err = acquireRedisLock(ctx, SRS_LOCK_MIGRATION); err == nil {
+			break
+		} else if r0, ok := err.(*RedisLockBusyError); !ok {
+			return errors.Wrapf(err, "acquire %v", SRS_LOCK_MIGRATION)
+		} else {
+			logger.Tf(ctx, "migration: wait for %v", r0.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+	defer func() {
+		if err := lock.Release(ctx); err != nil {
+			logger.Wf(ctx, "migration: ignore err %+v", err)
+		}
+	}()
+
+	return applyMigrations(lock.Context(), migrations, dryRun)
+}
+
+// applyMigrations apply the pending migrations, with SRS_LOCK_MIGRATION held.
+func applyMigrations(ctx context.Context, migrations []*Migration, dryRun bool) error {
+	applied, err := rdb.HGetAll(ctx, SRS_SCHEMA_MIGRATIONS).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_SCHEMA_MIGRATIONS)
+	}
+
+	var pending []*Migration
+	for _, m := range migrations {
+		if _, ok := applied[strconv.Itoa(m.ID)]; !ok {
+			pending = append(pending, m)
+		}
+	}
+
+	if dryRun {
+		for _, m := range pending {
+			logger.Tf(ctx, "migration: dry run, pending %v", m.String())
+		}
+		logger.Tf(ctx, "migration: dry run ok, applied=%v, pending=%v", len(applied), len(pending))
+		return nil
+	}
+
+	for _, m := range pending {
+		starttime := time.Now()
+		if err := m.Migrate(ctx); err != nil {
+			logger.Ef(ctx, "migration: %v failed, stop platform and fix it, err %+v", m.String(), err)
+			return errors.Wrapf(err, "migrate %v", m.String())
+		}
+
+		id, now := strconv.Itoa(m.ID), time.Now().Format(time.RFC3339)
+		if err := rdb.HSet(ctx, SRS_SCHEMA_MIGRATIONS, id, now).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v %v %v", SRS_SCHEMA_MIGRATIONS, id, now)
+		}
+		logger.Tf(ctx, "migration: apply %v ok, cost=%v", m.String(), time.Since(starttime))
+	}
+
+	logger.Tf(ctx, "migration: done, applied=%v, pending=%v", len(applied), len(pending))
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestMigration_RunOnceInOrder(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	var applied []int
+	var broken bool
+	migrations := []*Migration{
+		{ID: 1, Name: "first", Migrate: func(ctx context.Context) error {
+			applied = append(applied, 1)
+			return nil
+		}},
+		{ID: 2, Name: "second", Migrate: func(ctx context.Context) error {
+			if broken {
+				return errors.New("mock error")
+			}
+			applied = append(applied, 2)
+			return nil
+		}},
+		{ID: 3, Name: "third", Migrate: func(ctx context.Context) error {
+			applied = append(applied, 3)
+			return nil
+		}},
+	}
+
+	// Dry run never applies or records the migrations.
+	if err := runMigrations(ctx, migrations, true); err != nil || len(applied) != 0 {
+		t.Errorf("Fail for applied %v, err %+v", applied, err)
+	}
+
+	// Stop at the failed migration, and never run the later ones.
+	broken = true
+	if err := runMigrations(ctx, migrations, false); err == nil || len(applied) != 1 {
+		t.Errorf("Fail for applied %v, err %+v", applied, err)
+	}
+	if _, ok := server.HGet(SRS_SCHEMA_MIGRATIONS, "2"); ok {
+		t.Errorf("Fail for failed migration recorded")
+	}
+
+	// Continue from the failed one, and the lock is released even failed.
+	broken = false
+	if err := runMigrations(ctx, migrations, false); err != nil || len(applied) != 3 || applied[1] != 2 {
+		t.Errorf("Fail for applied %v, err %+v", applied, err)
+	}
+	if v, ok := server.HGet(SRS_SCHEMA_MIGRATIONS, "3"); !ok {
+		t.Errorf("Fail for not recorded")
+	} else if _, err := time.Parse(time.RFC3339, v); err != nil {
+		t.Errorf("Fail for applied time %v, err %+v", v, err)
+	}
+
+	// Idempotent re-run.
+	if err := runMigrations(ctx, migrations, false); err != nil || len(applied) != 3 {
+		t.Errorf("Fail for applied %v, err %+v", applied, err)
+	}
+
+	// Reject the migrations out of order.
+	if err := runMigrations(ctx, []*Migration{migrations[1], migrations[0]}, false); err == nil {
+		t.Errorf("Fail for out of order")
+	}
+}
+
+func TestMigration_BilibiliCache(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	b, _ := json.Marshal(&BilibiliCacheObject{Update: time.Now().Format(time.RFC3339)})
+	server.HSet(SRS_CACHE_BILIBILI, "BV0fresh", string(b))
+
+	if err := runMigrations(ctx, migrations, false); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if _, ok := server.HGet(SRS_CACHE_BILIBILI, "BV0fresh"); ok {
+		t.Errorf("Fail for legacy hash not removed")
+	}
+	if obj, err := bilibiliCache.Get(ctx, "BV0fresh"); err != nil || obj == nil {
+		t.Errorf("Fail for obj %v, err %+v", obj, err)
+	}
+}
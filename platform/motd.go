@@ -0,0 +1,169 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max number of characters of MOTD message, before HTML-escaped.
+const motdMaxLength = 512
+
+// The severity of MOTD, for UI to choose the style.
+const (
+	MotdSeverityInfo     = "info"
+	MotdSeverityWarning  = "warning"
+	MotdSeverityCritical = "critical"
+)
+
+// Motd is the message of the day, a notice for everyone who opens the UI, for example, the scheduled maintenance.
+type Motd struct {
+	// The message, which is HTML-escaped, so it's safe for UI to render.
+	Message string `json:"message"`
+	// The severity, info, warning or critical.
+	Severity string `json:"severity"`
+	// The expire time, empty if never expire until cleared.
+	ExpireAt string `json:"expireAt,omitempty"`
+	// The update time.
+	Update string `json:"update"`
+}
+
+func (v *Motd) String() string {
+	return fmt.Sprintf("message=%vB, severity=%v, expireAt=%v, update=%v",
+		len(v.Message), v.Severity, v.ExpireAt, v.Update,
+	)
+}
+
+// newMotd creates the MOTD by raw message, which is capped and HTML-escaped.
+func newMotd(message, severity, expireAt string, now time.Time) (*Motd, error) {
+	if message = strings.TrimSpace(message); message == "" {
+		return nil, errors.New("no message")
+	}
+	if n := utf8.RuneCountInString(message); n > motdMaxLength {
+		return nil, errors.Errorf("message too long %v, max %v", n, motdMaxLength)
+	}
+
+	if severity == "" {
+		severity = MotdSeverityInfo
+	}
+	if severity != MotdSeverityInfo && severity != MotdSeverityWarning && severity != MotdSeverityCritical {
+		return nil, errors.Errorf("invalid severity %v", severity)
+	}
+
+	if expireAt != "" {
+		if t, err := time.Parse(time.RFC3339, expireAt); err != nil {
+			return nil, errors.Wrapf(err, "parse expireAt %v", expireAt)
+		} else if !t.After(now) {
+			return nil, errors.Errorf("expireAt %v should be in future", expireAt)
+		}
+	}
+
+	return &Motd{
+		Message: html.EscapeString(message), Severity: severity, ExpireAt: expireAt,
+		Update: now.Format(time.RFC3339),
+	}, nil
+}
+
+// queryMotd returns the active MOTD, or nil if not set or expired.
+func queryMotd(ctx context.Context) (*Motd, error) {
+	value, err := rdb.Get(ctx, SRS_MOTD).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "get %v", SRS_MOTD)
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	var motd Motd
+	if err := json.Unmarshal([]byte(value), &motd); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", value)
+	}
+
+	// The key expires by redis, however, check it again in case the TTL is lost.
+	if motd.ExpireAt != "" {
+		if t, err := time.Parse(time.RFC3339, motd.ExpireAt); err == nil && !t.After(time.Now()) {
+			return nil, nil
+		}
+	}
+	return &motd, nil
+}
+
+func handleMgmtMotd(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/motd/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action, message, severity, expireAt string
+			if err := ParseBody(ctx, r, &struct {
+				Token    *string `json:"token"`
+				Action   *string `json:"action"`
+				Message  *string `json:"message"`
+				Severity *string `json:"severity"`
+				ExpireAt *string `json:"expireAt"`
+			}{
+				Token: &token, Action: &action, Message: &message, Severity: &severity, ExpireAt: &expireAt,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if action == "clear" {
+				if err := rdb.Del(ctx, SRS_MOTD).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "del %v", SRS_MOTD)
+				}
+
+				httpWriteData(ctx, w, r, nil)
+				logger.Tf(ctx, "motd: clear ok, token=%vB", len(token))
+				return nil
+			} else if action != "set" {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+			}
+
+			now := time.Now()
+			motd, err := newMotd(message, severity, expireAt, now)
+			if err != nil {
+				return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "new motd"))
+			}
+
+			var ttl time.Duration
+			if motd.ExpireAt != "" {
+				t, _ := time.Parse(time.RFC3339, motd.ExpireAt)
+				ttl = t.Sub(now)
+			}
+
+			if b, err := json.Marshal(motd); err != nil {
+				return errors.Wrapf(err, "marshal %v", motd.String())
+			} else if err := rdb.Set(ctx, SRS_MOTD, string(b), ttl).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "set %v %v %v", SRS_MOTD, string(b), ttl)
+			}
+
+			httpWriteData(ctx, w, r, motd)
+			logger.Tf(ctx, "motd: set ok, %v, token=%vB", motd.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestMotd_SetAndClear(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	setupFakeRedis(t)
+
+	handler := http.NewServeMux()
+	handleMgmtMotd(ctx, handler)
+	handleMgmtEnvs(ctx, handler)
+
+	request := func(api, authorization, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, api, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// Only the authenticated caller is allowed to set it.
+	if w := request("/terraform/v1/mgmt/motd/update", "", `{"action":"set","message":"hi"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("Fail for code=%v, body=%v", w.Code, w.Body.String())
+	}
+
+	expireAt := time.Now().Add(time.Hour).Format(time.RFC3339)
+	for _, c := range []struct {
+		body string
+		code int
+	}{
+		{`{"action":"set","message":"` + strings.Repeat("x", motdMaxLength+1) + `"}`, http.StatusBadRequest},
+		{`{"action":"set","message":"  "}`, http.StatusBadRequest},
+		{`{"action":"set","message":"hi","severity":"fatal"}`, http.StatusBadRequest},
+		{`{"action":"set","message":"hi","expireAt":"` + time.Now().Add(-time.Hour).Format(time.RFC3339) + `"}`, http.StatusBadRequest},
+		{`{"action":"remove"}`, http.StatusBadRequest},
+		{`{"action":"set","message":"<script>alert(1)</script> upgrade at 02:00","severity":"warning","expireAt":"` + expireAt + `"}`, http.StatusOK},
+	} {
+		if w := request("/terraform/v1/mgmt/motd/update", "Bearer test-platform-secret", c.body); w.Code != c.code {
+			t.Errorf("Fail for %.64v, code=%v, body=%v", c.body, w.Code, w.Body.String())
+		}
+	}
+
+	// The login page gets the escaped message, without authentication.
+	var res struct {
+		Data struct {
+			Motd *Motd `json:"motd"`
+		} `json:"data"`
+	}
+	w := request("/terraform/v1/mgmt/envs", "", `{}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Data.Motd == nil {
+		t.Fatalf("Fail for body %v, err %+v", w.Body.String(), err)
+	}
+	if m := res.Data.Motd; m.Message != "&lt;script&gt;alert(1)&lt;/script&gt; upgrade at 02:00" || m.Severity != MotdSeverityWarning || m.ExpireAt != expireAt {
+		t.Errorf("Fail for %v", m.String())
+	}
+	if ttl, _ := rdb.TTL(ctx, SRS_MOTD).Result(); ttl <= 0 || ttl > time.Hour {
+		t.Errorf("Fail for ttl %v", ttl)
+	}
+
+	// The expired message disappears, even if the TTL is lost.
+	rdb.Set(ctx, SRS_MOTD, `{"message":"old","severity":"info","expireAt":"2020-01-01T00:00:00Z"}`, 0)
+	if motd, err := queryMotd(ctx); err != nil || motd != nil {
+		t.Errorf("Fail for %v, err %+v", motd, err)
+	}
+
+	request("/terraform/v1/mgmt/motd/update", "Bearer test-platform-secret", `{"action":"set","message":"hi"}`)
+	if motd, err := queryMotd(ctx); err != nil || motd == nil || motd.Severity != MotdSeverityInfo || motd.ExpireAt != "" {
+		t.Errorf("Fail for %v, err %+v", motd, err)
+	}
+	request("/terraform/v1/mgmt/motd/update", "Bearer test-platform-secret", `{"action":"clear"}`)
+	if motd, err := queryMotd(ctx); err != nil || motd != nil {
+		t.Errorf("Fail for %v, err %+v", motd, err)
+	}
+}
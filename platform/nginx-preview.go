@@ -0,0 +1,438 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The timeout to validate the NGINX config by nginx -t.
+const nginxPreviewTimeout = 10 * time.Second
+
+// The lines of context in diff.
+const nginxPreviewDiffContext = 3
+
+// NginxSettings is the settings to render the NGINX config, see renderNginxConfig.
+type NginxSettings struct {
+	// The HTTPS mode, empty for disabled, or ssl, lets or certbot, see SRS_HTTPS.
+	HTTPS string `json:"https"`
+}
+
+func (v *NginxSettings) String() string {
+	return fmt.Sprintf("https=%v", v.HTTPS)
+}
+
+func (v *NginxSettings) Validate() error {
+	if v.HTTPS != "" && v.HTTPS != "ssl" && v.HTTPS != "lets" && v.HTTPS != "certbot" {
+		return errors.Errorf("invalid https %v", v.HTTPS)
+	}
+	return nil
+}
+
+// queryNginxSettings returns the current settings of NGINX config.
+func queryNginxSettings(ctx context.Context) (*NginxSettings, error) {
+	settings := &NginxSettings{}
+	if ssl, err := rdb.Get(ctx, SRS_HTTPS).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "get %v", SRS_HTTPS)
+	} else if ssl == "ssl" || ssl == "lets" || ssl == "certbot" {
+		settings.HTTPS = ssl
+	}
+	return settings, nil
+}
+
+// nginxConfigDir returns the directory of NGINX config files.
+func nginxConfigDir() string {
+	return path.Join(conf.Pwd, "containers/data/config")
+}
+
+// renderNginxConfig returns the NGINX config files by settings, key is the file name, for example, nginx.http.conf.
+func renderNginxConfig(settings *NginxSettings) map[string]string {
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Build the SSL/TLS config.
+	sslConf := []string{}
+	if settings.HTTPS != "" {
+		sslConf = []string{
+			"",
+			"# For SSL/TLS config.",
+			"listen       443 ssl;",
+			"listen       [::]:443 ssl;",
+			"ssl_certificate /data/config/nginx.crt;",
+			"ssl_certificate_key /data/config/nginx.key;",
+			"ssl_protocols TLSv1.1 TLSv1.2 TLSv1.3;",
+			`add_header Strict-Transport-Security "max-age=0";`,
+			"ssl_session_cache shared:SSL:10m;",
+			"ssl_session_timeout 10m;",
+			"",
+		}
+	}
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Build the default root.
+	// Note that it's been removed, see SRS_HTTP_PROXY.
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Build the upload limit for uploader(vLive).
+	uploadLimit := []string{
+		"",
+		"# Limit for upload file size",
+		"client_max_body_size 100g;",
+	}
+
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Build the config for NGINX.
+	files := make(map[string]string)
+	if true {
+		confLines := []string{
+			"# !!! Important: This file is produced and maintained by the Oryx, please never modify it.",
+		}
+		confLines = append(confLines, "", "")
+		files["nginx.http.conf"] = strings.Join(confLines, "\n")
+	}
+	if true {
+		confLines := []string{
+			"# !!! Important: This file is produced and maintained by the Oryx, please never modify it.",
+		}
+		confLines = append(confLines, uploadLimit...)
+		confLines = append(confLines, sslConf...)
+		confLines = append(confLines, "", "")
+		files["nginx.server.conf"] = strings.Join(confLines, "\n")
+	}
+	return files
+}
+
+// nginxFilesHash returns the checksum of NGINX config files, which equals to nginxConfigHash after applied.
+func nginxFilesHash(files map[string]string) string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := sha256.New()
+	for _, name := range names {
+		h.Write([]byte(fmt.Sprintf("%v=%x\n", name, sha256.Sum256([]byte(files[name])))))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// The status of NginxValidation, the config is not validated if skipped, which is neither valid nor invalid.
+const (
+	NginxValidationValid   = "valid"
+	NginxValidationInvalid = "invalid"
+	NginxValidationSkipped = "skipped"
+)
+
+// NginxValidation is the result of nginx -t for the candidate config.
+type NginxValidation struct {
+	// The status of validation, see NginxValidationValid.
+	Status string `json:"status"`
+	// Whether skipped, for example, no nginx in the container of platform.
+	Skipped bool `json:"skipped,omitempty"`
+	// Whether the config is valid, always false if skipped, because it's not validated.
+	OK bool `json:"ok"`
+	// The output of nginx -t.
+	Output string `json:"output"`
+	// The exit code of nginx -t.
+	ExitCode int `json:"exitCode,omitempty"`
+}
+
+// NginxPreview is the candidate config to review before applying, nothing is reloaded.
+type NginxPreview struct {
+	// The checksum of candidate config, to apply exactly the reviewed config.
+	Hash string `json:"hash"`
+	// The settings to render the config.
+	Settings *NginxSettings `json:"settings"`
+	// Whether the candidate differs from the active config, and the unified diff.
+	Changed bool   `json:"changed"`
+	Diff    string `json:"diff"`
+	// The validation by nginx -t.
+	Validation *NginxValidation `json:"validation"`
+}
+
+// validateNginxConfig runs nginx -t for the files in a temporary directory, which include the files by a minimum
+// main config, and use the certificates of platform.
+func validateNginxConfig(ctx context.Context, files map[string]string) (*NginxValidation, error) {
+	binary, err := exec.LookPath("nginx")
+	if err != nil {
+		return &NginxValidation{Status: NginxValidationSkipped, Skipped: true, Output: "no nginx to validate"}, nil
+	}
+
+	dir, err := ioutil.TempDir("", "nginx-preview-")
+	if err != nil {
+		return nil, errors.Wrapf(err, "create temp dir")
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range files {
+		content = strings.ReplaceAll(content, "/data/config/", nginxConfigDir()+"/")
+		if err := ioutil.WriteFile(path.Join(dir, name), []byte(content), 0644); err != nil {
+			return nil, errors.Wrapf(err, "write %v", name)
+		}
+	}
+
+	mainConf := strings.Join([]string{
+		fmt.Sprintf("pid %v;", path.Join(dir, "nginx.pid")),
+		fmt.Sprintf("error_log %v;", path.Join(dir, "error.log")),
+		"events {}",
+		"http {",
+		"    access_log off;",
+		fmt.Sprintf("    include %v;", path.Join(dir, "nginx.http.conf")),
+		"    server {",
+		"        listen 80;",
+		fmt.Sprintf("        include %v;", path.Join(dir, "nginx.server.conf")),
+		"    }",
+		"}",
+		"",
+	}, "\n")
+	mainFile := path.Join(dir, "nginx.conf")
+	if err := ioutil.WriteFile(mainFile, []byte(mainConf), 0644); err != nil {
+		return nil, errors.Wrapf(err, "write %v", mainFile)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, nginxPreviewTimeout)
+	defer cancel()
+
+	b, err := exec.CommandContext(ctx, binary, "-t", "-p", dir, "-c", mainFile).CombinedOutput()
+	validation := &NginxValidation{
+		Status: NginxValidationValid, OK: err == nil, Output: strings.TrimSpace(string(b)), ExitCode: nginxExitCode(err),
+	}
+	if !validation.OK {
+		validation.Status = NginxValidationInvalid
+	}
+	return validation, nil
+}
+
+// previewNginxConfig renders the candidate config by settings, validates it, and diffs with the active config.
+func previewNginxConfig(ctx context.Context, settings *NginxSettings) (*NginxPreview, error) {
+	files := renderNginxConfig(settings)
+	preview := &NginxPreview{Hash: nginxFilesHash(files), Settings: settings}
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var diffs []string
+	for _, name := range names {
+		var active string
+		if b, err := ioutil.ReadFile(path.Join(nginxConfigDir(), name)); err != nil && !os.IsNotExist(err) {
+			return nil, errors.Wrapf(err, "read %v", name)
+		} else {
+			active = string(b)
+		}
+
+		if diff := unifiedDiff(name, active, files[name]); diff != "" {
+			diffs = append(diffs, diff)
+		}
+	}
+	preview.Changed, preview.Diff = len(diffs) > 0, strings.Join(diffs, "")
+
+	validation, err := validateNginxConfig(ctx, files)
+	if err != nil {
+		return nil, errors.Wrapf(err, "validate")
+	}
+	preview.Validation = validation
+
+	return preview, nil
+}
+
+// verifyNginxPreview returns error if the hash is not empty, and differs from the config rendered by the current
+// settings overwritten by the https, to reject before any change, see nginxApplyConfig.
+func verifyNginxPreview(ctx context.Context, https, hash string) error {
+	if hash == "" {
+		return nil
+	}
+
+	settings, err := queryNginxSettings(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query settings")
+	}
+	settings.HTTPS = https
+
+	if nginxFilesHash(renderNginxConfig(settings)) != hash {
+		return newHttpCodeError(http.StatusConflict, SrsStackErrorNginxPreview,
+			errors.Errorf("config changed since preview, hash=%v, settings is %v", hash, settings.String()),
+		)
+	}
+	return nil
+}
+
+// unifiedDiff returns the unified diff from a to b, empty if no change.
+func unifiedDiff(name, a, b string) string {
+	if a == b {
+		return ""
+	}
+
+	// Split lines, ignore the last empty line.
+	split := func(s string) []string {
+		if s == "" {
+			return nil
+		}
+		return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+	}
+	x, y := split(a), split(b)
+
+	// The length of LCS of x[i:] and y[j:].
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	// The edit script, op is ' ', '-' or '+', with the line number of x and y.
+	type edit struct {
+		op   byte
+		line string
+		i, j int
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		if i < len(x) && j < len(y) && x[i] == y[j] {
+			edits = append(edits, edit{' ', x[i], i, j})
+			i, j = i+1, j+1
+		} else if i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]) {
+			edits = append(edits, edit{'-', x[i], i, j})
+			i++
+		} else {
+			edits = append(edits, edit{'+', y[j], i, j})
+			j++
+		}
+	}
+
+	// Group the changes with context to hunks.
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("--- a/%v\n+++ b/%v\n", name, name))
+	for start := 0; start < len(edits); {
+		// Find the next change.
+		for start < len(edits) && edits[start].op == ' ' {
+			start++
+		}
+		if start == len(edits) {
+			break
+		}
+
+		// Extend the hunk, until the unchanged lines exceed twice of context.
+		end := start
+		for k := start; k < len(edits); k++ {
+			if edits[k].op != ' ' {
+				end = k + 1
+			} else if k-end >= 2*nginxPreviewDiffContext {
+				break
+			}
+		}
+
+		from, to := start-nginxPreviewDiffContext, end+nginxPreviewDiffContext
+		if from < 0 {
+			from = 0
+		}
+		if to > len(edits) {
+			to = len(edits)
+		}
+
+		var na, nb int
+		for _, e := range edits[from:to] {
+			if e.op != '+' {
+				na++
+			}
+			if e.op != '-' {
+				nb++
+			}
+		}
+		sa, sbb := edits[from].i+1, edits[from].j+1
+		if na == 0 {
+			sa--
+		}
+		if nb == 0 {
+			sbb--
+		}
+
+		sb.WriteString(fmt.Sprintf("@@ -%v,%v +%v,%v @@\n", sa, na, sbb, nb))
+		for _, e := range edits[from:to] {
+			sb.WriteString(fmt.Sprintf("%c%v\n", e.op, e.line))
+		}
+		start = to
+	}
+	return sb.String()
+}
+
+func handleMgmtNginxPreview(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/nginx/preview"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var https *string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string  `json:"token"`
+				HTTPS **string `json:"https"`
+			}{
+				Token: &token, HTTPS: &https,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Use the current settings, overwritten by the proposed ones.
+			settings, err := queryNginxSettings(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query settings")
+			}
+			if https != nil {
+				settings.HTTPS = *https
+			}
+			if err := settings.Validate(); err != nil {
+				return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "validate"))
+			}
+
+			preview, err := previewNginxConfig(ctx, settings)
+			if err != nil {
+				return errors.Wrapf(err, "preview %v", settings.String())
+			}
+
+			httpWriteData(ctx, w, r, preview)
+			logger.Tf(ctx, "nginx preview ok, %v, hash=%v, changed=%v, validation=%v, token=%vB",
+				settings.String(), preview.Hash, preview.Changed, preview.Validation.Status, len(token),
+			)
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestNginxPreview_UnifiedDiff(t *testing.T) {
+	if diff := unifiedDiff("a.conf", "x\ny\n", "x\ny\n"); diff != "" {
+		t.Errorf("Fail for diff %v", diff)
+	}
+
+	a := "1\n2\n3\n4\n5\n6\n7\n8\n9\n10\n"
+	b := "1\n2\n3\n4\nfive\n6\n7\n8\n9\n10\n11\n"
+	// The hunks are merged if the unchanged lines are less than twice of context.
+	expect := strings.Join([]string{
+		"--- a/a.conf",
+		"+++ b/a.conf",
+		"@@ -2,9 +2,10 @@",
+		" 2", " 3", " 4", "-5", "+five", " 6", " 7", " 8", " 9", " 10", "+11",
+		"",
+	}, "\n")
+	if diff := unifiedDiff("a.conf", a, b); diff != expect {
+		t.Errorf("Fail for diff\n%v", diff)
+	}
+
+	// The hunks are separated if the unchanged lines are more than twice of context.
+	b = "one\n2\n3\n4\n5\n6\n7\n8\n9\nten\n"
+	expect = strings.Join([]string{
+		"--- a/a.conf",
+		"+++ b/a.conf",
+		"@@ -1,4 +1,4 @@",
+		"-1", "+one", " 2", " 3", " 4",
+		"@@ -7,4 +7,4 @@",
+		" 7", " 8", " 9", "-10", "+ten",
+		"",
+	}, "\n")
+	if diff := unifiedDiff("a.conf", a, b); diff != expect {
+		t.Errorf("Fail for diff\n%v", diff)
+	}
+
+	// Diff from empty file.
+	if diff := unifiedDiff("b.conf", "", "x\n"); diff != "--- a/b.conf\n+++ b/b.conf\n@@ -0,0 +1,1 @@\n+x\n" {
+		t.Errorf("Fail for diff\n%v", diff)
+	}
+}
+
+func TestNginxPreview_ApplyPreviewed(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	setupFakeRedis(t)
+
+	// The hashes of config files, which might be written by other tests.
+	oldConf, oldCertManager, oldConfigHashes := conf, certManager, configHashes
+	configHashes = make(map[string]string)
+	defer func() {
+		conf, certManager, configHashes = oldConf, oldCertManager, oldConfigHashes
+	}()
+
+	pwd, err := ioutil.TempDir("", "oryx-nginx-")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(pwd)
+	if err := os.MkdirAll(path.Join(pwd, "containers/data/config"), 0755); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	conf, certManager = &Config{IsDarwin: true, Pwd: pwd}, NewCertManager()
+
+	if err := nginxGenerateConfig(ctx, NginxTriggerBoot); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	// No change for the current settings.
+	if preview, err := previewNginxConfig(ctx, &NginxSettings{}); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	} else if preview.Changed || preview.Diff != "" || preview.Validation == nil {
+		t.Errorf("Fail for preview %v", preview)
+	}
+
+	// Preview the HTTPS, nothing is changed.
+	preview, err := previewNginxConfig(ctx, &NginxSettings{HTTPS: "ssl"})
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	} else if !preview.Changed || !strings.Contains(preview.Diff, "+listen       443 ssl;") {
+		t.Errorf("Fail for preview %v", preview)
+	}
+	if b, err := ioutil.ReadFile(path.Join(pwd, "containers/data/config/nginx.server.conf")); err != nil ||
+		strings.Contains(string(b), "443") {
+		t.Errorf("Fail for config %v, err %+v", string(b), err)
+	}
+
+	// Reject if the previewed config is not the one to apply.
+	err = verifyNginxPreview(ctx, "lets", "invalid")
+	if cause, ok := errors.Cause(err).(*httpStatusError); !ok || cause.code != SrsStackErrorNginxPreview {
+		t.Errorf("Fail for err %+v", err)
+	}
+	err = nginxApplyConfig(ctx, NginxTriggerSsl, preview.Hash)
+	if cause, ok := errors.Cause(err).(*httpStatusError); !ok || cause.code != SrsStackErrorNginxPreview {
+		t.Errorf("Fail for err %+v", err)
+	}
+
+	// Apply the previewed config, the hash equals to the active config.
+	if err := verifyNginxPreview(ctx, "ssl", preview.Hash); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if err := rdb.Set(ctx, SRS_HTTPS, "ssl", 0).Err(); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if err := nginxApplyConfig(ctx, NginxTriggerSsl, preview.Hash); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if status, err := queryNginxStatus(ctx); err != nil || status.Active == nil || status.Active.Hash != preview.Hash ||
+		len(status.Reloads) != 2 {
+		t.Errorf("Fail for status %v, err %+v", status, err)
+	}
+}
+
+func TestNginxPreview_NotValidated(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	pwd, err := ioutil.TempDir("", "oryx-nginx-")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(pwd)
+
+	oldPath := os.Getenv("PATH")
+	defer os.Setenv("PATH", oldPath)
+
+	// No nginx to validate, the config is not validated, which is not valid.
+	os.Setenv("PATH", pwd)
+	files := renderNginxConfig(&NginxSettings{})
+	if v, err := validateNginxConfig(ctx, files); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	} else if v.Status != NginxValidationSkipped || !v.Skipped || v.OK {
+		t.Errorf("Fail for validation %v", v)
+	}
+
+	// Validated by nginx -t, valid or invalid.
+	for _, c := range []struct {
+		script string
+		status string
+		ok     bool
+	}{
+		{"exit 0", NginxValidationValid, true},
+		{"echo 'nginx: [emerg] unknown directive' >&2; exit 1", NginxValidationInvalid, false},
+	} {
+		if err := ioutil.WriteFile(path.Join(pwd, "nginx"), []byte("#!/bin/sh\n"+c.script+"\n"), 0755); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+		if v, err := validateNginxConfig(ctx, files); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		} else if v.Status != c.status || v.Skipped || v.OK != c.ok {
+			t.Errorf("Fail for validation %v of %v", v, c.script)
+		}
+	}
+}
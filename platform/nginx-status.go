@@ -0,0 +1,232 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max number of NGINX reloads in history.
+const nginxReloadMaxEntries = 50
+
+// The trigger of NGINX config generation, to know which operation causes the failure.
+const (
+	NginxTriggerBoot        = "boot"
+	NginxTriggerSelfCheck   = "selfcheck"
+	NginxTriggerSelfSigned  = "self-signed"
+	NginxTriggerRenew       = "renew"
+	NginxTriggerSsl         = "ssl"
+	NginxTriggerLetsEncrypt = "letsencrypt"
+	NginxTriggerCertbot     = "certbot"
+	NginxTriggerReset       = "reset"
+)
+
+// NginxReload is the outcome of a generate and reload cycle of NGINX.
+type NginxReload struct {
+	// The time of reload.
+	Time string `json:"time"`
+	// The operation which triggers the reload.
+	Trigger string `json:"trigger"`
+	// Whether the config is generated and the reload is signaled.
+	OK bool `json:"ok"`
+	// The error if failed.
+	Error string `json:"error,omitempty"`
+	// The checksum of NGINX config files.
+	Hash string `json:"hash,omitempty"`
+	// The output and exit code of the failed nginx command, such as nginx -t or nginx -s reload.
+	Output   string `json:"output,omitempty"`
+	ExitCode int    `json:"exitCode,omitempty"`
+}
+
+func (v *NginxReload) String() string {
+	return fmt.Sprintf("time=%v, trigger=%v, ok=%v, error=%v, hash=%v, exitCode=%v",
+		v.Time, v.Trigger, v.OK, v.Error, v.Hash, v.ExitCode,
+	)
+}
+
+// NginxCommandError is the error of nginx command, with the output for users to fix the config.
+type NginxCommandError struct {
+	// The command, for example, nginx -t.
+	Command string
+	// The output of command, both stdout and stderr.
+	Output string
+	// The exit code of command, or -1 if not exited, for example, killed by timeout.
+	ExitCode int
+}
+
+func (v *NginxCommandError) Error() string {
+	return fmt.Sprintf("%v exit %v, %v", v.Command, v.ExitCode, v.Output)
+}
+
+// nginxExitCode returns the exit code of nginx command, 0 for success, or -1 if not exited.
+func nginxExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if r0, ok := err.(*exec.ExitError); ok {
+		return r0.ExitCode()
+	}
+	return -1
+}
+
+// reloadNginxByCommand reloads NGINX by nginx -s reload, which is used in host mode, because there is no NGINX
+// container to handle the signal file.
+func reloadNginxByCommand(ctx context.Context, binary string) error {
+	ctx, cancel := context.WithTimeout(ctx, nginxPreviewTimeout)
+	defer cancel()
+
+	b, err := exec.CommandContext(ctx, binary, "-s", "reload").CombinedOutput()
+	if err != nil {
+		return &NginxCommandError{
+			Command: "nginx -s reload", Output: strings.TrimSpace(string(b)), ExitCode: nginxExitCode(err),
+		}
+	}
+	return nil
+}
+
+// NginxStatus is the status of NGINX config, for users to diagnose the failure.
+type NginxStatus struct {
+	// The active config, which is the last successful reload.
+	Active *NginxReload `json:"active,omitempty"`
+	// The last reloads, the latest first.
+	Reloads []*NginxReload `json:"reloads"`
+}
+
+// nginxConfigHash returns the checksum of NGINX config files, the caller should hold configLock.
+func nginxConfigHash() string {
+	fileNames := make([]string, 0, len(configHashes))
+	for fileName := range configHashes {
+		if strings.HasPrefix(path.Base(fileName), "nginx.") {
+			fileNames = append(fileNames, fileName)
+		}
+	}
+	sort.Strings(fileNames)
+
+	h := sha256.New()
+	for _, fileName := range fileNames {
+		h.Write([]byte(fmt.Sprintf("%v=%v\n", path.Base(fileName), configHashes[fileName])))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
+// recordNginxReload saves the outcome of reload, and the active config if success. It never fails, because it
+// should not cover the error of reload.
+func recordNginxReload(ctx context.Context, trigger string, hash string, err error) {
+	reload := &NginxReload{Time: time.Now().Format(time.RFC3339), Trigger: trigger, OK: err == nil}
+	if err != nil {
+		reload.Error = err.Error()
+		if r0, ok := errors.Cause(err).(*NginxCommandError); ok {
+			reload.Output, reload.ExitCode = r0.Output, r0.ExitCode
+		}
+	} else {
+		reload.Hash = hash
+	}
+
+	if err := func() error {
+		b, err := json.Marshal(reload)
+		if err != nil {
+			return errors.Wrapf(err, "marshal %v", reload.String())
+		}
+
+		if err := rdb.LPush(ctx, SRS_NGINX_RELOADS, string(b)).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "lpush %v %v", SRS_NGINX_RELOADS, string(b))
+		}
+		if err := rdb.LTrim(ctx, SRS_NGINX_RELOADS, 0, nginxReloadMaxEntries-1).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "ltrim %v", SRS_NGINX_RELOADS)
+		}
+
+		if reload.OK {
+			if err := rdb.HSet(ctx, SRS_NGINX_STATUS, "active", string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v active %v", SRS_NGINX_STATUS, string(b))
+			}
+		}
+		return nil
+	}(); err != nil {
+		logger.Wf(ctx, "nginx status ignore %v err %+v", reload.String(), err)
+		return
+	}
+
+	logger.Tf(ctx, "nginx status ok, %v", reload.String())
+}
+
+// queryNginxStatus returns the active config and the last reloads.
+func queryNginxStatus(ctx context.Context) (*NginxStatus, error) {
+	status := &NginxStatus{Reloads: []*NginxReload{}}
+
+	if value, err := rdb.HGet(ctx, SRS_NGINX_STATUS, "active").Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v active", SRS_NGINX_STATUS)
+	} else if value != "" {
+		var active NginxReload
+		if err := json.Unmarshal([]byte(value), &active); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+		status.Active = &active
+	}
+
+	values, err := rdb.LRange(ctx, SRS_NGINX_RELOADS, 0, nginxReloadMaxEntries-1).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "lrange %v", SRS_NGINX_RELOADS)
+	}
+	for _, value := range values {
+		var reload NginxReload
+		if err := json.Unmarshal([]byte(value), &reload); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+		status.Reloads = append(status.Reloads, &reload)
+	}
+
+	return status, nil
+}
+
+func handleMgmtNginxStatus(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/nginx/status"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			status, err := queryNginxStatus(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query status")
+			}
+
+			httpWriteData(ctx, w, r, status)
+			logger.Tf(ctx, "nginx status ok, reloads=%v, token=%vB", len(status.Reloads), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestNginxStatus_RecordReloads(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	setupFakeRedis(t)
+
+	oldConf, oldCertManager := conf, certManager
+	defer func() {
+		conf, certManager = oldConf, oldCertManager
+	}()
+
+	pwd, err := ioutil.TempDir("", "oryx-nginx-")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(pwd)
+	if err := os.MkdirAll(path.Join(pwd, "containers/data/config"), 0755); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	conf, certManager = &Config{IsDarwin: true, Pwd: pwd}, NewCertManager()
+
+	if err := nginxGenerateConfig(ctx, NginxTriggerBoot); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	// Fail to write the config, the error has code for users to check the status.
+	if err := os.RemoveAll(path.Join(pwd, "containers/data/config")); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	err = nginxGenerateConfig(ctx, NginxTriggerSsl)
+	if cause, ok := errors.Cause(err).(*httpStatusError); !ok || cause.code != SrsStackErrorNginx {
+		t.Errorf("Fail for err %+v", err)
+	}
+
+	status, err := queryNginxStatus(ctx)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if len(status.Reloads) != 2 {
+		t.Fatalf("Fail for reloads %v", len(status.Reloads))
+	}
+	if r0 := status.Reloads[0]; r0.OK || r0.Trigger != NginxTriggerSsl || r0.Error == "" || r0.Hash != "" {
+		t.Errorf("Fail for reload %v", r0.String())
+	}
+	if r1 := status.Reloads[1]; !r1.OK || r1.Trigger != NginxTriggerBoot || r1.Hash == "" {
+		t.Errorf("Fail for reload %v", r1.String())
+	}
+
+	// The active config is still the last successful one.
+	if a := status.Active; a == nil || a.Trigger != NginxTriggerBoot || a.Hash != status.Reloads[1].Hash {
+		t.Errorf("Fail for active %v", a)
+	}
+}
+
+func TestNginxStatus_FakeNginx(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	setupFakeRedis(t)
+
+	oldConf, oldCertManager, oldConfigHashes, oldPath := conf, certManager, configHashes, os.Getenv("PATH")
+	configHashes = make(map[string]string)
+	defer func() {
+		conf, certManager, configHashes = oldConf, oldCertManager, oldConfigHashes
+		os.Setenv("PATH", oldPath)
+	}()
+
+	pwd, err := ioutil.TempDir("", "oryx-nginx-")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(pwd)
+	if err := os.MkdirAll(path.Join(pwd, "containers/data/config"), 0755); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	conf, certManager = &Config{Pwd: pwd, DeployMode: DeployModeHost}, NewCertManager()
+
+	// Use a fake nginx, which responses nginx -t and nginx -s reload by the script.
+	binDir := path.Join(pwd, "bin")
+	if err := os.MkdirAll(binDir, 0755); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	os.Setenv("PATH", binDir+":"+oldPath)
+	fakeNginx := func(test, reload string) {
+		script := "#!/bin/sh\nif [ \"$1\" = \"-t\" ]; then\n" + test + "\nfi\n" + reload + "\n"
+		if err := ioutil.WriteFile(path.Join(binDir, "nginx"), []byte(script), 0755); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+	}
+
+	fakeNginx("echo 'syntax is ok'; exit 0", "exit 0")
+	if err := nginxGenerateConfig(ctx, NginxTriggerBoot); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	active, err := ioutil.ReadFile(path.Join(pwd, "containers/data/config/nginx.server.conf"))
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	// The config fails nginx -t is never written, and the output is in status.
+	fakeNginx("echo 'nginx: [emerg] unknown directive \"foo\"' >&2; exit 1", "exit 0")
+	if err := rdb.Set(ctx, SRS_HTTPS, "ssl", 0).Err(); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	err = nginxGenerateConfig(ctx, NginxTriggerSsl)
+	if cause, ok := errors.Cause(err).(*httpStatusError); !ok || cause.code != SrsStackErrorNginx {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if b, err := ioutil.ReadFile(path.Join(pwd, "containers/data/config/nginx.server.conf")); err != nil || string(b) != string(active) {
+		t.Errorf("Fail for config %v, err %+v", string(b), err)
+	}
+
+	// The exit code of reload is in status.
+	fakeNginx("exit 0", "echo 'nginx: [error] invalid PID number' >&2; exit 2")
+	err = nginxGenerateConfig(ctx, NginxTriggerSsl)
+	if cause, ok := errors.Cause(err).(*httpStatusError); !ok || cause.code != SrsStackErrorNginx {
+		t.Errorf("Fail for err %+v", err)
+	}
+
+	status, err := queryNginxStatus(ctx)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if len(status.Reloads) != 3 {
+		t.Fatalf("Fail for reloads %v", len(status.Reloads))
+	}
+	if r0 := status.Reloads[0]; r0.OK || r0.ExitCode != 2 || !strings.Contains(r0.Output, "invalid PID number") ||
+		!strings.Contains(r0.Error, "nginx -s reload") {
+		t.Errorf("Fail for reload %v", r0.String())
+	}
+	if r1 := status.Reloads[1]; r1.OK || r1.ExitCode != 1 || !strings.Contains(r1.Output, `unknown directive "foo"`) ||
+		!strings.Contains(r1.Error, "nginx -t") {
+		t.Errorf("Fail for reload %v", r1.String())
+	}
+	if a := status.Active; a == nil || a.Trigger != NginxTriggerBoot || a.Hash != status.Reloads[2].Hash {
+		t.Errorf("Fail for active %v", a)
+	}
+}
@@ -19,7 +19,6 @@ import (
 
 	// From ossrs.
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
 	"github.com/go-redis/redis/v8"
@@ -62,9 +61,12 @@ func (v *OCRWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 	ep := "/terraform/v1/ai/ocr/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -94,23 +96,26 @@ func (v *OCRWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 			}
 			resp.Task.UUID = v.task.UUID
 
-			ohttp.WriteData(ctx, w, r, resp)
+			httpWriteData(ctx, w, r, resp)
 			logger.Tf(ctx, "ocr query ok, config=<%v>, uuid=%v, token=%vB",
 				config, v.task.UUID, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/ocr/apply"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var uuid string
 			var config OCRConfig
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				UUID  *string `json:"uuid"`
 				*OCRConfig
@@ -142,24 +147,27 @@ func (v *OCRWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 			type ApplyResponse struct {
 				UUID string `json:"uuid"`
 			}
-			ohttp.WriteData(ctx, w, r, &ApplyResponse{
+			httpWriteData(ctx, w, r, &ApplyResponse{
 				UUID: v.task.UUID,
 			})
 			logger.Tf(ctx, "ocr apply ok, config=<%v>, uuid=%v, token=%vB",
 				config, v.task.UUID, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/ocr/check"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var ocrConfig OCRConfig
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				*OCRConfig
 			}{
@@ -205,22 +213,25 @@ func (v *OCRWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Wrapf(err, "create chat")
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "ocr check ok, config=<%v>, model=<%v>, msg=<%v>, token=%vB",
 				ocrConfig, model.ID, resp.Choices[0].Message.Content, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/ocr/reset"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var uuid string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				UUID  *string `json:"uuid"`
 			}{
@@ -246,22 +257,25 @@ func (v *OCRWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 			type ResetResponse struct {
 				UUID string `json:"uuid"`
 			}
-			ohttp.WriteData(ctx, w, r, &ResetResponse{
+			httpWriteData(ctx, w, r, &ResetResponse{
 				UUID: v.task.UUID,
 			})
 			logger.Tf(ctx, "ocr reset ok, uuid=%v, new=%v, token=%vB", uuid, v.task.UUID, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/ocr/live-queue"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -300,20 +314,23 @@ func (v *OCRWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 
 			res.Count = len(res.Segments)
 
-			ohttp.WriteData(ctx, w, r, res)
+			httpWriteData(ctx, w, r, res)
 			logger.Tf(ctx, "ocr query live ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/ocr/ocr-queue"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -360,20 +377,23 @@ func (v *OCRWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 
 			res.Count = len(res.Segments)
 
-			ohttp.WriteData(ctx, w, r, res)
+			httpWriteData(ctx, w, r, res)
 			logger.Tf(ctx, "ocr query ocr ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/ocr/callback-queue"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -428,20 +448,23 @@ func (v *OCRWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 
 			res.Count = len(res.Segments)
 
-			ohttp.WriteData(ctx, w, r, res)
+			httpWriteData(ctx, w, r, res)
 			logger.Tf(ctx, "ocr query callback ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/ocr/cleanup-queue"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -500,17 +523,20 @@ func (v *OCRWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 
 			res.Count = len(res.Segments)
 
-			ohttp.WriteData(ctx, w, r, res)
+			httpWriteData(ctx, w, r, res)
 			logger.Tf(ctx, "ocr query cleanup ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/ocr/image/"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			// Format is /image/:uuid.jpg
 			filename := r.URL.Path[len("/terraform/v1/ai/ocr/image/"):]
@@ -536,7 +562,7 @@ func (v *OCRWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "ocr preview image ok, uuid=%v", uuid)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
@@ -0,0 +1,459 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max length of admin email, see RFC 5321.
+const mgmtAdminEmailMaxLength = 254
+
+// The one-time code to recover the password, which is expired in 15 minutes, and invalidated after some failed
+// attempts, to prevent guessing the code.
+const (
+	mgmtRecoverCodeDigits      = 8
+	mgmtRecoverCodeExpire      = 15 * time.Minute
+	mgmtRecoverCodeMaxFailures = 5
+)
+
+// The max number of requests from a client in the window, for start and finish.
+const (
+	mgmtRecoverRateWindow      = 15 * time.Minute
+	mgmtRecoverStartRateLimit  = 3
+	mgmtRecoverFinishRateLimit = 10
+)
+
+// The max number of recovery attempts in audit log.
+const mgmtRecoverAuditMaxEntries = 1000
+
+// How the one-time code is delivered, by email, or printed to the log as a break-glass when SMTP is not configured.
+const (
+	mgmtRecoverDeliveryEmail = "email"
+	mgmtRecoverDeliveryLog   = "log"
+)
+
+// The actions of recovery.
+const (
+	mgmtRecoverActionStart  = "start"
+	mgmtRecoverActionFinish = "finish"
+)
+
+// The function to send the one-time code by email, which is replaced for testing.
+var mgmtRecoverSendMail = sendMgmtRecoverMail
+
+// The lock to verify and consume the one-time code, so it's never used twice.
+var mgmtRecoverLock sync.Mutex
+
+// RecoverAudit is an attempt to recover the password, allowed or rejected.
+type RecoverAudit struct {
+	// The time of attempt.
+	Time string `json:"time"`
+	// The client IP of caller.
+	IP string `json:"ip"`
+	// The action of recovery, start or finish.
+	Action string `json:"action"`
+	// How the code is delivered for start, email or log.
+	Delivery string `json:"delivery,omitempty"`
+	// Whether the attempt is allowed.
+	Allowed bool `json:"allowed"`
+	// The error code if rejected. Note that we never log the code or password.
+	Code SrsStackError `json:"code,omitempty"`
+}
+
+func (v *RecoverAudit) String() string {
+	return fmt.Sprintf("time=%v, ip=%v, action=%v, delivery=%v, allowed=%v, code=%v",
+		v.Time, v.IP, v.Action, v.Delivery, v.Allowed, v.Code,
+	)
+}
+
+// validateAdminEmail validates the admin email to recover the password, which should be a bare address.
+func validateAdminEmail(email string) error {
+	validation := &ConfigValidation{}
+
+	if len(email) > mgmtAdminEmailMaxLength {
+		validation.AddError("email", ConfigIssueTooLong, "email should be at most %v bytes", mgmtAdminEmailMaxLength)
+	} else if addr, err := mail.ParseAddress(email); err != nil || addr.Name != "" || addr.Address != email {
+		validation.AddError("email", ConfigIssueInvalid, "email should be an address like admin@example.com")
+	}
+
+	return validation.Err()
+}
+
+// maskAdminEmail masks the admin email for response and log, for example, a***@example.com.
+func maskAdminEmail(email string) string {
+	if index := strings.LastIndex(email, "@"); index > 0 {
+		return fmt.Sprintf("%v***%v", email[:1], email[index:])
+	}
+	return ""
+}
+
+func queryAdminEmail(ctx context.Context) (string, error) {
+	email, err := rdb.Get(ctx, SRS_ADMIN_EMAIL).Result()
+	if err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "get %v", SRS_ADMIN_EMAIL)
+	}
+	return email, nil
+}
+
+func saveAdminEmail(ctx context.Context, email string) error {
+	if err := rdb.Set(ctx, SRS_ADMIN_EMAIL, email, 0).Err(); err != nil {
+		return errors.Wrapf(err, "set %v %v", SRS_ADMIN_EMAIL, email)
+	}
+	return nil
+}
+
+func hashMgmtRecoverCode(code string) string {
+	b := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(b[:])
+}
+
+// sendMgmtRecoverMail sends the one-time code to the admin email, by the SMTP server, see SMTP_SERVER.
+func sendMgmtRecoverMail(ctx context.Context, email, code string) error {
+	server, username, password, from := envSmtpServer(), envSmtpUsername(), envSmtpPassword(), envSmtpFrom()
+	if from == "" {
+		from = username
+	}
+
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return errors.Wrapf(err, "parse smtp server %v", server)
+	}
+
+	var auth smtp.Auth
+	if username != "" {
+		auth = smtp.PlainAuth("", username, password, host)
+	}
+
+	msg := strings.Join([]string{
+		fmt.Sprintf("From: %v", from),
+		fmt.Sprintf("To: %v", email),
+		"Subject: Oryx password recovery code",
+		fmt.Sprintf("Date: %v", time.Now().Format(time.RFC1123Z)),
+		"Content-Type: text/plain; charset=UTF-8",
+		"",
+		fmt.Sprintf("Your one-time code to reset the password of Oryx is %v, which expires in %v.", code, mgmtRecoverCodeExpire),
+		"",
+		"If you did not request it, please ignore this email, and check the recovery audit log.",
+	}, "\r\n")
+	if err := smtp.SendMail(server, auth, from, []string{email}, []byte(msg)); err != nil {
+		return errors.Wrapf(err, "send mail to %v by %v", maskAdminEmail(email), server)
+	}
+	return nil
+}
+
+// startMgmtRecover generates a one-time code, which replaces the previous one, and sends it to the admin email. If
+// no SMTP server or no admin email, the code is printed to the log as a break-glass. It returns the delivery.
+func startMgmtRecover(ctx context.Context) (string, error) {
+	if envMgmtPassword() == "" {
+		return "", newHttpStatusError(http.StatusBadRequest, errors.New("not init"))
+	}
+
+	email, err := queryAdminEmail(ctx)
+	if err != nil {
+		return "", errors.Wrapf(err, "query email")
+	}
+
+	n, err := rand.Int(rand.Reader, new(big.Int).Exp(big.NewInt(10), big.NewInt(mgmtRecoverCodeDigits), nil))
+	if err != nil {
+		return "", errors.Wrapf(err, "generate code")
+	}
+	code := fmt.Sprintf("%0*d", mgmtRecoverCodeDigits, n.Int64())
+	expire := time.Now().Add(mgmtRecoverCodeExpire)
+
+	mgmtRecoverLock.Lock()
+	defer mgmtRecoverLock.Unlock()
+
+	if err := rdb.Del(ctx, SRS_RECOVER_CODE).Err(); err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "del %v", SRS_RECOVER_CODE)
+	}
+	if err := rdb.HSet(ctx, SRS_RECOVER_CODE,
+		"code", hashMgmtRecoverCode(code), "expire", expire.Format(time.RFC3339), "failures", 0,
+	).Err(); err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "hset %v", SRS_RECOVER_CODE)
+	}
+	if err := rdb.Expire(ctx, SRS_RECOVER_CODE, mgmtRecoverCodeExpire).Err(); err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "expire %v", SRS_RECOVER_CODE)
+	}
+
+	if envSmtpServer() == "" || email == "" {
+		logger.Wf(ctx, "Recover password by break-glass, no SMTP server or admin email, code=%v, expire=%v",
+			code, expire.Format(time.RFC3339))
+		return mgmtRecoverDeliveryLog, nil
+	}
+
+	if err := mgmtRecoverSendMail(ctx, email, code); err != nil {
+		return "", errors.Wrapf(err, "send mail")
+	}
+	return mgmtRecoverDeliveryEmail, nil
+}
+
+// consumeMgmtRecoverCode verifies the one-time code, and removes it if ok, so it's single-use. The code is removed
+// after too many failures, so it's impossible to guess.
+func consumeMgmtRecoverCode(ctx context.Context, code string) error {
+	mgmtRecoverLock.Lock()
+	defer mgmtRecoverLock.Unlock()
+
+	values, err := rdb.HGetAll(ctx, SRS_RECOVER_CODE).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_RECOVER_CODE)
+	}
+
+	invalid := func(format string, a ...interface{}) error {
+		return newHttpCodeError(http.StatusForbidden, SrsStackErrorRecoverCode, errors.Errorf(format, a...))
+	}
+	if values["code"] == "" {
+		return invalid("no code, please start again")
+	}
+
+	if expire, err := time.Parse(time.RFC3339, values["expire"]); err != nil || time.Now().After(expire) {
+		if err := rdb.Del(ctx, SRS_RECOVER_CODE).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "del %v", SRS_RECOVER_CODE)
+		}
+		return invalid("code expired at %v, please start again", values["expire"])
+	}
+
+	if subtle.ConstantTimeCompare([]byte(hashMgmtRecoverCode(code)), []byte(values["code"])) != 1 {
+		failures, err := rdb.HIncrBy(ctx, SRS_RECOVER_CODE, "failures", 1).Result()
+		if err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hincrby %v failures", SRS_RECOVER_CODE)
+		}
+
+		if failures >= mgmtRecoverCodeMaxFailures {
+			if err := rdb.Del(ctx, SRS_RECOVER_CODE).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "del %v", SRS_RECOVER_CODE)
+			}
+			return invalid("invalid code, failures=%v, please start again", failures)
+		}
+		return invalid("invalid code, failures=%v", failures)
+	}
+
+	if err := rdb.Del(ctx, SRS_RECOVER_CODE).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "del %v", SRS_RECOVER_CODE)
+	}
+	return nil
+}
+
+// recordRecoverAudit saves the attempt to audit log. It never fails, because the audit should not change the result.
+func recordRecoverAudit(ctx context.Context, r *http.Request, action, delivery string, err error) {
+	audit := &RecoverAudit{
+		Time: time.Now().Format(time.RFC3339), IP: clientIP(r), Action: action, Delivery: delivery,
+		Allowed: err == nil,
+	}
+	if cause, ok := errors.Cause(err).(*httpStatusError); ok {
+		audit.Code = cause.code
+	}
+
+	if err := func() error {
+		b, err := json.Marshal(audit)
+		if err != nil {
+			return errors.Wrapf(err, "marshal %v", audit.String())
+		}
+
+		return bufferedRedisWrite(ctx, "recover audit", func(ctx context.Context, pipe redis.Pipeliner) {
+			pipe.LPush(ctx, SRS_RECOVER_AUDIT, string(b))
+			pipe.LTrim(ctx, SRS_RECOVER_AUDIT, 0, mgmtRecoverAuditMaxEntries-1)
+		})
+	}(); err != nil {
+		logger.Wf(ctx, "recover audit ignore %v err %+v", audit.String(), err)
+		return
+	}
+
+	logger.Tf(ctx, "recover audit ok, %v", audit.String())
+}
+
+// queryRecoverAudits returns the attempts in audit log, the latest first.
+func queryRecoverAudits(ctx context.Context) ([]*RecoverAudit, error) {
+	audits := []*RecoverAudit{}
+	if err := rangeRedisList(ctx, SRS_RECOVER_AUDIT, mgmtRecoverAuditMaxEntries, func(value string) error {
+		var audit RecoverAudit
+		if err := json.Unmarshal([]byte(value), &audit); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", value)
+		}
+		audits = append(audits, &audit)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "range audits")
+	}
+	return audits, nil
+}
+
+// allowMgmtRecover returns an error if the client exceeds the rate limit.
+func allowMgmtRecover(w http.ResponseWriter, r *http.Request, limiter *ClientRateLimiter) error {
+	if !limiter.Allow(clientIP(r), time.Now()) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(mgmtRecoverRateWindow.Seconds())))
+		return newHttpCodeError(http.StatusTooManyRequests, SrsStackErrorTooManyRequests,
+			errors.Errorf("too many requests from %v", clientIP(r)),
+		)
+	}
+	return nil
+}
+
+func handleMgmtRecover(ctx context.Context, handler *http.ServeMux) {
+	startLimiter := NewClientRateLimiter(mgmtRecoverRateWindow, mgmtRecoverStartRateLimit)
+	finishLimiter := NewClientRateLimiter(mgmtRecoverRateWindow, mgmtRecoverFinishRateLimit)
+
+	// Without authentication, because the admin forgets the password.
+	ep := "/terraform/v1/mgmt/recover/start"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		var delivery string
+		err := func() error {
+			if err := allowMgmtRecover(w, r, startLimiter); err != nil {
+				return errors.Wrapf(err, "rate limit")
+			}
+
+			var err error
+			if delivery, err = startMgmtRecover(ctx); err != nil {
+				return errors.Wrapf(err, "start recover")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Delivery string `json:"delivery"`
+				ExpireIn int    `json:"expireIn"`
+			}{
+				Delivery: delivery, ExpireIn: int(mgmtRecoverCodeExpire.Seconds()),
+			})
+			logger.Tf(ctx, "recover password start ok, ip=%v, delivery=%v", clientIP(r), delivery)
+			return nil
+		}()
+		recordRecoverAudit(ctx, r, mgmtRecoverActionStart, delivery, err)
+		if err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/recover/finish"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		err := func() error {
+			if err := allowMgmtRecover(w, r, finishLimiter); err != nil {
+				return errors.Wrapf(err, "rate limit")
+			}
+
+			var code, password string
+			if err := ParseLimitedBody(ctx, w, r, mgmtPasswordMaxBody, &struct {
+				Code     *string `json:"code"`
+				Password *string `json:"password"`
+			}{
+				Code: &code, Password: &password,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			if envMgmtPassword() == "" {
+				return newHttpStatusError(http.StatusBadRequest, errors.New("not init"))
+			}
+
+			// Validate before consuming the code, so a weak password does not waste the code.
+			if err := validateMgmtPassword(password); err != nil {
+				return errors.Wrapf(err, "validate password")
+			}
+
+			if err := consumeMgmtRecoverCode(ctx, code); err != nil {
+				return errors.Wrapf(err, "consume code")
+			}
+
+			// The same write path as changing password, see handleMgmtPassword.
+			if err := saveMgmtPassword(ctx, password); err != nil {
+				return errors.Wrapf(err, "save password")
+			}
+
+			apiSecret := envApiSecret()
+			expireAt, createAt, token, err := createTokenWithScope(ctx, apiSecret, tokenScopeAdmin)
+			if err != nil {
+				return errors.Wrapf(err, "build token")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Token    string `json:"token"`
+				CreateAt string `json:"createAt"`
+				ExpireAt string `json:"expireAt"`
+			}{
+				Token: token, CreateAt: createAt.Format(time.RFC3339), ExpireAt: expireAt.Format(time.RFC3339),
+			})
+			logger.Tf(ctx, "recover password finish ok, ip=%v, password=%vB", clientIP(r), len(password))
+			return nil
+		}()
+		recordRecoverAudit(ctx, r, mgmtRecoverActionFinish, "", err)
+		if err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/recover/audit"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			email, err := queryAdminEmail(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query email")
+			}
+
+			audits, err := queryRecoverAudits(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query audits")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				// The masked admin email, empty if not set.
+				Email string `json:"email"`
+				// Whether SMTP is configured, or the code is printed to the log.
+				Smtp   bool            `json:"smtp"`
+				Audits []*RecoverAudit `json:"audits"`
+			}{
+				Email: maskAdminEmail(email), Smtp: envSmtpServer() != "", Audits: audits,
+			})
+			logger.Tf(ctx, "recover audit query ok, audits=%v, token=%vB", len(audits), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
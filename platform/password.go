@@ -0,0 +1,157 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	"github.com/joho/godotenv"
+)
+
+// The length of mgmt password in bytes. Note that the max length is to avoid writing a huge blob to .env file.
+const (
+	mgmtPasswordMinLength = 8
+	mgmtPasswordMaxLength = 256
+)
+
+// The max size of body which contains the password, to avoid reading a huge blob.
+const mgmtPasswordMaxBody = 4 * 1024
+
+// The complexity rules of mgmt password, configured by MGMT_PASSWORD_COMPLEXITY, for example, lower,upper,digit.
+var mgmtPasswordComplexityRules = map[string]func(r rune) bool{
+	"lower": unicode.IsLower,
+	"upper": unicode.IsUpper,
+	"digit": unicode.IsDigit,
+	"symbol": func(r rune) bool {
+		return unicode.IsPunct(r) || unicode.IsSymbol(r)
+	},
+}
+
+// validateMgmtPassword validates the password to set by init or change password, so the rules never drift. It
+// returns the error with the failed rules as details, see ConfigValidation, and never contains the password.
+func validateMgmtPassword(password string) error {
+	validation := &ConfigValidation{}
+
+	if len(password) < mgmtPasswordMinLength {
+		validation.AddError("password", ConfigIssueTooShort, "password should be at least %v bytes", mgmtPasswordMinLength)
+	} else if len(password) > mgmtPasswordMaxLength {
+		validation.AddError("password", ConfigIssueTooLong, "password should be at most %v bytes", mgmtPasswordMaxLength)
+	}
+
+	// The newline and NUL break the quoting of .env file.
+	if !utf8.ValidString(password) {
+		validation.AddError("password", ConfigIssueInvalidChar, "password should be valid UTF-8")
+	} else if strings.ContainsAny(password, "\r\n\x00") {
+		validation.AddError("password", ConfigIssueInvalidChar, "password should not contain newline or NUL")
+	}
+
+	for _, rule := range strings.Split(envMgmtPasswordComplexity(), ",") {
+		if rule = strings.TrimSpace(rule); rule == "" {
+			continue
+		}
+
+		match, ok := mgmtPasswordComplexityRules[rule]
+		if !ok {
+			continue
+		}
+		if strings.IndexFunc(password, match) < 0 {
+			validation.AddError("password", ConfigIssueWeak, "password should contain %v character", rule)
+		}
+	}
+
+	return validation.Err()
+}
+
+// saveMgmtPassword saves the password to .env file, and reloads the envs.
+func saveMgmtPassword(ctx context.Context, password string) error {
+	envFile := envFilePath()
+	if err := updateEnvFile(ctx, envFile, func(envs map[string]string) {
+		envs["MGMT_PASSWORD"] = password
+	}); err != nil {
+		return errors.Wrapf(err, "update %v", envFile)
+	}
+
+	if err := godotenv.Overload(envFile); err != nil {
+		return errors.Wrapf(err, "load %v", envFile)
+	}
+	return nil
+}
+
+func handleMgmtPassword(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/password"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, password, newPassword string
+			if err := ParseLimitedBody(ctx, w, r, mgmtPasswordMaxBody, &struct {
+				Token       *string `json:"token"`
+				Password    *string `json:"password"`
+				NewPassword *string `json:"newPassword"`
+			}{
+				Token: &token, Password: &password, NewPassword: &newPassword,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Require the current password, so a leaked token is not able to change the password.
+			mgmtPassword := envMgmtPassword()
+			if mgmtPassword == "" {
+				return errors.New("not init")
+			}
+			if subtle.ConstantTimeCompare([]byte(password), []byte(mgmtPassword)) != 1 {
+				wait := 10 * time.Second
+				logger.Wf(ctx, "Invalid password from %v, wait for %v", clientIP(r), wait)
+
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+				}
+				return newHttpStatusError(http.StatusForbidden, errors.Errorf("invalid password, wait %v", wait))
+			}
+
+			if err := validateMgmtPassword(newPassword); err != nil {
+				return errors.Wrapf(err, "validate password")
+			}
+
+			if err := saveMgmtPassword(ctx, newPassword); err != nil {
+				return errors.Wrapf(err, "save password")
+			}
+
+			expireAt, createAt, token, err := createTokenWithScope(ctx, apiSecret, tokenScopeAdmin)
+			if err != nil {
+				return errors.Wrapf(err, "build token")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Token    string `json:"token"`
+				CreateAt string `json:"createAt"`
+				ExpireAt string `json:"expireAt"`
+			}{
+				Token: token, CreateAt: createAt.Format(time.RFC3339), ExpireAt: expireAt.Format(time.RFC3339),
+			})
+			logger.Tf(ctx, "change password ok, ip=%v, password=%vB", clientIP(r), len(newPassword))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
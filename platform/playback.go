@@ -0,0 +1,195 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// PlaybackEndpoint is the base URL of a playback protocol, for example, the CDN for HLS.
+type PlaybackEndpoint struct {
+	// Whether the protocol is enabled for playback.
+	Enabled bool `json:"enabled"`
+	// The base URL, for example, https://cdn.example.com, empty to use the host of page.
+	Base string `json:"base"`
+}
+
+func (v *PlaybackEndpoint) String() string {
+	return fmt.Sprintf("enabled=%v, base=%v", v.Enabled, v.Base)
+}
+
+// PlaybackEndpoints is the setting of playback URLs, because the host of admin panel might not be the one for
+// viewers, for example, behind CDN.
+type PlaybackEndpoints struct {
+	HLS  PlaybackEndpoint `json:"hls"`
+	FLV  PlaybackEndpoint `json:"flv"`
+	WHEP PlaybackEndpoint `json:"whep"`
+	// The update time, empty if default.
+	Update string `json:"update,omitempty"`
+}
+
+func NewPlaybackEndpoints() *PlaybackEndpoints {
+	return &PlaybackEndpoints{
+		HLS: PlaybackEndpoint{Enabled: true}, FLV: PlaybackEndpoint{Enabled: true},
+		WHEP: PlaybackEndpoint{Enabled: true},
+	}
+}
+
+func (v *PlaybackEndpoints) String() string {
+	return fmt.Sprintf("hls=(%v), flv=(%v), whep=(%v), update=%v",
+		v.HLS.String(), v.FLV.String(), v.WHEP.String(), v.Update,
+	)
+}
+
+// Validate the base URLs, which should be http or https without query, and normalize by removing the tail slash.
+func (v *PlaybackEndpoints) Validate() error {
+	for name, ep := range map[string]*PlaybackEndpoint{"hls": &v.HLS, "flv": &v.FLV, "whep": &v.WHEP} {
+		if ep.Base = strings.TrimSuffix(strings.TrimSpace(ep.Base), "/"); ep.Base == "" {
+			continue
+		}
+
+		u, err := url.Parse(ep.Base)
+		if err != nil {
+			return errors.Wrapf(err, "parse %v base %v", name, ep.Base)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return errors.Errorf("invalid %v base %v, scheme should be http or https", name, ep.Base)
+		}
+		if u.Host == "" {
+			return errors.Errorf("invalid %v base %v, no host", name, ep.Base)
+		}
+		if u.RawQuery != "" || u.Fragment != "" || u.User != nil {
+			return errors.Errorf("invalid %v base %v, no query, fragment or user allowed", name, ep.Base)
+		}
+	}
+	return nil
+}
+
+// PlaybackURLs is the URLs to play a stream, empty if the protocol is disabled. The URL is relative to the host of
+// page, if no base URL.
+type PlaybackURLs struct {
+	HLS  string `json:"hls,omitempty"`
+	FLV  string `json:"flv,omitempty"`
+	WHEP string `json:"whep,omitempty"`
+}
+
+// baseURL returns the base URL, or the base path of platform if no base URL, because the stream is served by the
+// platform under the base path.
+func (v *PlaybackEndpoint) baseURL() string {
+	if v.Base == "" {
+		return platformBasePath()
+	}
+	return v.Base
+}
+
+// URLs builds the playback URLs of stream, for example, live/livestream.
+func (v *PlaybackEndpoints) URLs(app, stream string) *PlaybackURLs {
+	r := &PlaybackURLs{}
+	if v.HLS.Enabled {
+		r.HLS = fmt.Sprintf("%v/%v/%v.m3u8", v.HLS.baseURL(), app, stream)
+	}
+	if v.FLV.Enabled {
+		r.FLV = fmt.Sprintf("%v/%v/%v.flv", v.FLV.baseURL(), app, stream)
+	}
+	if v.WHEP.Enabled {
+		r.WHEP = fmt.Sprintf("%v/rtc/v1/whep/?app=%v&stream=%v", v.WHEP.baseURL(), url.QueryEscape(app), url.QueryEscape(stream))
+	}
+	return r
+}
+
+// queryPlaybackEndpoints returns the setting of playback URLs, or the default if not set.
+func queryPlaybackEndpoints(ctx context.Context) (*PlaybackEndpoints, error) {
+	value, err := rdb.Get(ctx, SRS_PLAYBACK).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "get %v", SRS_PLAYBACK)
+	}
+
+	endpoints := NewPlaybackEndpoints()
+	if value != "" {
+		if err := json.Unmarshal([]byte(value), endpoints); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+	}
+	return endpoints, nil
+}
+
+func handleMgmtPlayback(ctx context.Context, handler *http.ServeMux) {
+	// For the player page, so there is no authentication.
+	ep := "/terraform/v1/mgmt/playback"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			endpoints, err := queryPlaybackEndpoints(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query playback")
+			}
+
+			httpWriteData(ctx, w, r, endpoints)
+			logger.Tf(ctx, "playback: query ok, %v", endpoints.String())
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/playback/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			endpoints := NewPlaybackEndpoints()
+			if err := ParseBody(ctx, r, &struct {
+				Token *string           `json:"token"`
+				HLS   *PlaybackEndpoint `json:"hls"`
+				FLV   *PlaybackEndpoint `json:"flv"`
+				WHEP  *PlaybackEndpoint `json:"whep"`
+			}{
+				Token: &token, HLS: &endpoints.HLS, FLV: &endpoints.FLV, WHEP: &endpoints.WHEP,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if err := endpoints.Validate(); err != nil {
+				return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "validate"))
+			}
+
+			endpoints.Update = time.Now().Format(time.RFC3339)
+			if b, err := json.Marshal(endpoints); err != nil {
+				return errors.Wrapf(err, "marshal %v", endpoints.String())
+			} else if err := rdb.Set(ctx, SRS_PLAYBACK, string(b), 0).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "set %v %v", SRS_PLAYBACK, string(b))
+			}
+
+			httpWriteData(ctx, w, r, endpoints)
+			logger.Tf(ctx, "playback: update ok, %v, token=%vB", endpoints.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestPlayback_EndpointsAndURLs(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	handler := http.NewServeMux()
+	handleMgmtPlayback(ctx, handler)
+	handleMgmtStreamKeys(ctx, handler)
+
+	request := func(api, authorization, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, api, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	// The default URLs are relative to the host of page.
+	endpoints, err := queryPlaybackEndpoints(ctx)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if u := endpoints.URLs("live", "livestream"); u.HLS != "/live/livestream.m3u8" || u.FLV != "/live/livestream.flv" ||
+		u.WHEP != "/rtc/v1/whep/?app=live&stream=livestream" {
+		t.Errorf("Fail for %v", u)
+	}
+
+	for _, c := range []struct {
+		authorization, body string
+		code                int
+	}{
+		{"", `{"hls":{"enabled":true,"base":"https://cdn.example.com"}}`, http.StatusUnauthorized},
+		{"Bearer test-platform-secret", `{"hls":{"enabled":true,"base":"ftp://cdn.example.com"}}`, http.StatusBadRequest},
+		{"Bearer test-platform-secret", `{"hls":{"enabled":true,"base":"https://"}}`, http.StatusBadRequest},
+		{"Bearer test-platform-secret", `{"flv":{"enabled":true,"base":"https://cdn.example.com/?a=b"}}`, http.StatusBadRequest},
+		{"Bearer test-platform-secret", `{"hls":{"enabled":true,"base":"https://cdn.example.com/hls/"},"flv":{"enabled":false},"whep":{"enabled":true,"base":"https://rtc.example.com"}}`, http.StatusOK},
+	} {
+		if w := request("/terraform/v1/mgmt/playback/update", c.authorization, c.body); w.Code != c.code {
+			t.Errorf("Fail for %v, code=%v, body=%v", c.body, w.Code, w.Body.String())
+		}
+	}
+
+	// The player page queries the setting without authentication.
+	var res struct {
+		Data *PlaybackEndpoints `json:"data"`
+	}
+	w := request("/terraform/v1/mgmt/playback", "", "")
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Data == nil {
+		t.Fatalf("Fail for body %v, err %+v", w.Body.String(), err)
+	}
+	if d := res.Data; d.HLS.Base != "https://cdn.example.com/hls" || d.FLV.Enabled || d.Update == "" {
+		t.Errorf("Fail for %v", d.String())
+	}
+
+	// The stream keys compose the URLs by the setting.
+	server.HSet(SRS_AUTH_SECRET, GenerateRoomPublishKey("room1"), "secret")
+	var keys struct {
+		Data struct {
+			Keys []*StreamKey `json:"keys"`
+		} `json:"data"`
+	}
+	w = request("/terraform/v1/mgmt/streams/keys/export", "Bearer test-platform-secret", "{}")
+	if err := json.Unmarshal(w.Body.Bytes(), &keys); err != nil || len(keys.Data.Keys) != 1 || keys.Data.Keys[0].Playback == nil {
+		t.Fatalf("Fail for body %v, err %+v", w.Body.String(), err)
+	}
+	if u := keys.Data.Keys[0].Playback; u.HLS != "https://cdn.example.com/hls/live/room1.m3u8" || u.FLV != "" ||
+		u.WHEP != "https://rtc.example.com/rtc/v1/whep/?app=live&stream=room1" {
+		t.Errorf("Fail for %v", u)
+	}
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The content type of Prometheus text format.
+const prometheusContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// PrometheusWriter writes the metrics in Prometheus text format. The samples of a metric are grouped as a family with
+// the HELP and TYPE, in the order of the first sample, so the collectors are able to write the same metric, for
+// example, the up of each component.
+type PrometheusWriter struct {
+	// The families in order, and the samples of each family.
+	order    []string
+	families map[string]*prometheusFamily
+}
+
+type prometheusFamily struct {
+	help, kind string
+	samples    bytes.Buffer
+}
+
+func NewPrometheusWriter() *PrometheusWriter {
+	return &PrometheusWriter{families: make(map[string]*prometheusFamily)}
+}
+
+// Gauge writes a sample of gauge, the labels are pairs of name and value, for example, "stream", "live/livestream".
+func (v *PrometheusWriter) Gauge(name, help string, value float64, labels ...string) {
+	v.sample(name, "gauge", help, value, labels...)
+}
+
+// Counter writes a sample of counter, which only increases.
+func (v *PrometheusWriter) Counter(name, help string, value float64, labels ...string) {
+	v.sample(name, "counter", help, value, labels...)
+}
+
+func (v *PrometheusWriter) sample(name, kind, help string, value float64, labels ...string) {
+	family, ok := v.families[name]
+	if !ok {
+		family = &prometheusFamily{help: help, kind: kind}
+		v.families[name] = family
+		v.order = append(v.order, name)
+	}
+
+	family.samples.WriteString(name)
+	if len(labels) > 0 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			pairs = append(pairs, fmt.Sprintf(`%v="%v"`, labels[i], prometheusEscape(labels[i+1])))
+		}
+		fmt.Fprintf(&family.samples, "{%v}", strings.Join(pairs, ","))
+	}
+	fmt.Fprintf(&family.samples, " %v\n", value)
+}
+
+func (v *PrometheusWriter) Bytes() []byte {
+	var b bytes.Buffer
+	for _, name := range v.order {
+		family := v.families[name]
+		fmt.Fprintf(&b, "# HELP %v %v\n# TYPE %v %v\n", name, family.help, name, family.kind)
+		b.Write(family.samples.Bytes())
+	}
+	return b.Bytes()
+}
+
+// prometheusEscape escapes the label value, see https://prometheus.io/docs/instrumenting/exposition_formats/
+func prometheusEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// collectPlatformMetrics writes the metrics of platform, see handleMgmtMetrics for the JSON ones.
+func collectPlatformMetrics(ctx context.Context, w *PrometheusWriter) {
+	w.Gauge("up", "Whether the component is up.", 1, "component", "platform")
+
+	if httpLimiter != nil {
+		endpoints := httpLimiter.Endpoints()
+		for _, ep := range endpoints {
+			w.Gauge("oryx_http_inflight", "The number of HTTP requests in flight.", float64(ep.InFlight), "path", ep.Path)
+		}
+		for _, ep := range endpoints {
+			w.Counter("oryx_http_rejected_total", "The number of HTTP requests rejected by limiter.",
+				float64(ep.Rejected), "path", ep.Path,
+			)
+		}
+	}
+
+	streams := eventStreamMetrics.Metrics()
+	for _, m := range streams {
+		w.Gauge("oryx_event_stream_subscribers", "The number of connected clients of event stream.",
+			float64(m.Subscribers), "class", m.Class, "topic", m.Topic,
+		)
+	}
+	for _, m := range streams {
+		w.Counter("oryx_event_stream_dropped_total", "The number of events dropped for slow clients of event stream.",
+			float64(m.Dropped), "class", m.Class, "topic", m.Topic,
+		)
+	}
+	for _, m := range streams {
+		w.Counter("oryx_event_stream_evicted_total", "The number of clients of event stream evicted for write timeout.",
+			float64(m.Evicted), "class", m.Class, "topic", m.Topic,
+		)
+	}
+
+	if alertWorker != nil {
+		collectAlertMetrics(ctx, w)
+	}
+
+	panics := queryPanicMetrics()
+	w.Counter("oryx_panics_total", "The number of recovered panics.", float64(panics.HTTP), "where", "http")
+	w.Counter("oryx_panics_total", "The number of recovered panics.", float64(panics.Goroutine), "where", "goroutine")
+}
+
+func handleMgmtPrometheus(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/prometheus"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			// Prometheus scrapes by GET, with the Bearer token in header.
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			pw := NewPrometheusWriter()
+			collectPlatformMetrics(ctx, pw)
+			srsExporter.Collect(ctx, pw)
+
+			w.Header().Set("Content-Type", prometheusContentType)
+			w.Write(pw.Bytes())
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
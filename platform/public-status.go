@@ -0,0 +1,227 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max-age of public status, also the duration we cache the status in memory.
+const publicStatusMaxAge = 10 * time.Second
+
+// The max number of public status requests from a client in a window.
+const (
+	publicStatusRateWindow = time.Minute
+	publicStatusRateLimit  = 30
+)
+
+// The max length of the custom message.
+const publicStatusMaxMessage = 512
+
+// The overall health of public status.
+const (
+	PublicStatusOperational = "operational"
+	PublicStatusDegraded    = "degraded"
+	PublicStatusMaintenance = "maintenance"
+)
+
+// PublicStatusConfig is the fields to expose by public status, curated by operator.
+type PublicStatusConfig struct {
+	// Whether the public status is enabled, default to disabled.
+	Enabled bool `json:"enabled"`
+	// Whether to expose the number of live streams.
+	ShowStreams bool `json:"showStreams"`
+	// The custom message, for example, a scheduled maintenance notice.
+	Message string `json:"message"`
+}
+
+func (v *PublicStatusConfig) String() string {
+	return fmt.Sprintf("enabled=%v, showStreams=%v, message=%vB", v.Enabled, v.ShowStreams, len(v.Message))
+}
+
+// PublicStatus is the status for unauthenticated users. Never add version or internal address to it.
+type PublicStatus struct {
+	// The overall health, operational, degraded or maintenance.
+	Status string `json:"status"`
+	// The number of live streams, if exposed.
+	Streams *int `json:"streams,omitempty"`
+	// The custom message, if set.
+	Message string `json:"message,omitempty"`
+	// The time of status.
+	Update string `json:"update"`
+}
+
+// queryPublicStatusConfig returns the config of public status from SRS_PUBLIC_STATUS.
+func queryPublicStatusConfig(ctx context.Context) (*PublicStatusConfig, error) {
+	values, err := rdb.HGetAll(ctx, SRS_PUBLIC_STATUS).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_PUBLIC_STATUS)
+	}
+
+	return &PublicStatusConfig{
+		Enabled: values["enabled"] == "true", ShowStreams: values["streams"] == "true", Message: values["message"],
+	}, nil
+}
+
+// buildPublicStatus builds the status by config. The health is degraded if the self-check is not done, and in
+// maintenance if upgrading or draining for upgrade.
+func buildPublicStatus(ctx context.Context, config *PublicStatusConfig) (*PublicStatus, error) {
+	status := &PublicStatus{
+		Status: PublicStatusOperational, Message: config.Message, Update: time.Now().Format(time.RFC3339),
+	}
+
+	upgrading, err := rdb.HGet(ctx, SRS_UPGRADING, "upgrading").Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v upgrading", SRS_UPGRADING)
+	}
+	drain, err := queryUpgradeDrain(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query drain")
+	}
+
+	if upgrading == "1" || drain != nil {
+		status.Status = PublicStatusMaintenance
+	} else if selfCheckResult == nil {
+		status.Status = PublicStatusDegraded
+	}
+
+	if config.ShowStreams {
+		streams, err := queryLiveStreams(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "query streams")
+		}
+		nn := len(streams)
+		status.Streams = &nn
+	}
+
+	return status, nil
+}
+
+func handleMgmtPublicStatus(ctx context.Context, handler *http.ServeMux) {
+	limiter := NewClientRateLimiter(publicStatusRateWindow, publicStatusRateLimit)
+
+	// The status in cache, to avoid querying redis for each request.
+	var cache *PublicStatus
+	var cacheExpire time.Time
+	var cacheLock sync.Mutex
+
+	// Without authentication, for the public status page.
+	ep := "/terraform/v1/mgmt/public/status"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			if !limiter.Allow(clientIP(r), time.Now()) {
+				w.Header().Set("Retry-After", fmt.Sprintf("%v", int(publicStatusRateWindow.Seconds())))
+				return newHttpCodeError(http.StatusTooManyRequests, SrsStackErrorTooManyRequests,
+					errors.Errorf("too many requests from %v", clientIP(r)),
+				)
+			}
+
+			cacheLock.Lock()
+			defer cacheLock.Unlock()
+
+			if cache == nil || time.Now().After(cacheExpire) {
+				config, err := queryPublicStatusConfig(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "query config")
+				}
+				if !config.Enabled {
+					return newHttpStatusError(http.StatusNotFound, errors.New("public status disabled"))
+				}
+
+				status, err := buildPublicStatus(ctx, config)
+				if err != nil {
+					return errors.Wrapf(err, "build status")
+				}
+				cache, cacheExpire = status, time.Now().Add(publicStatusMaxAge)
+			}
+
+			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%v", int(publicStatusMaxAge.Seconds())))
+			httpWriteData(ctx, w, r, cache)
+			logger.Tf(ctx, "public status ok, status=%v, client=%v", cache.Status, clientIP(r))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/public/status/settings"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			// Only the specified fields are updated, or query the config if no field.
+			var token string
+			var enabled, showStreams *bool
+			var message *string
+			if err := ParseBody(ctx, r, &struct {
+				Token       *string  `json:"token"`
+				Enabled     **bool   `json:"enabled"`
+				ShowStreams **bool   `json:"showStreams"`
+				Message     **string `json:"message"`
+			}{
+				Token: &token, Enabled: &enabled, ShowStreams: &showStreams, Message: &message,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if message != nil && len(*message) > publicStatusMaxMessage {
+				return errors.Errorf("message %vB exceeds %vB", len(*message), publicStatusMaxMessage)
+			}
+
+			var values []interface{}
+			if enabled != nil {
+				values = append(values, "enabled", fmt.Sprintf("%v", *enabled))
+			}
+			if showStreams != nil {
+				values = append(values, "streams", fmt.Sprintf("%v", *showStreams))
+			}
+			if message != nil {
+				values = append(values, "message", *message)
+			}
+			if len(values) > 0 {
+				if err := rdb.HSet(ctx, SRS_PUBLIC_STATUS, values...).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v %v", SRS_PUBLIC_STATUS, values)
+				}
+
+				// Expire the cache, so the change takes effect ASAP.
+				cacheLock.Lock()
+				cache = nil
+				cacheLock.Unlock()
+			}
+
+			config, err := queryPublicStatusConfig(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query config")
+			}
+
+			httpWriteData(ctx, w, r, config)
+			logger.Tf(ctx, "public status settings ok, update=%v, %v, token=%vB", len(values) > 0, config.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max number of publish attempts in audit log.
+const publishAuditMaxEntries = 1000
+
+// PublishAudit is an attempt to publish stream, allowed or rejected.
+type PublishAudit struct {
+	// The time of attempt.
+	Time string `json:"time"`
+	// The protocol of publisher, for example, srt.
+	Protocol string `json:"protocol"`
+	// The stream URL, such as live/livestream.
+	Stream string `json:"stream"`
+	// The client id of SRS.
+	Client string `json:"client,omitempty"`
+	// Whether the publish is allowed.
+	Allowed bool `json:"allowed"`
+	// The reason if rejected.
+	Reason string `json:"reason,omitempty"`
+}
+
+func (v *PublishAudit) String() string {
+	return fmt.Sprintf("time=%v, protocol=%v, stream=%v, client=%v, allowed=%v, reason=%v",
+		v.Time, v.Protocol, v.Stream, v.Client, v.Allowed, v.Reason,
+	)
+}
+
+// recordPublishAudit saves the attempt to audit log. It never fails, because it should not block the publisher. The
+// param of stream is removed from the reason, because it might contain the secret.
+func recordPublishAudit(ctx context.Context, protocol string, streamObj *SrsStream, err error) {
+	audit := &PublishAudit{
+		Time: time.Now().Format(time.RFC3339), Protocol: protocol, Stream: streamObj.StreamURL(),
+		Client: streamObj.Client, Allowed: err == nil,
+	}
+	if err != nil {
+		audit.Reason = errors.Cause(err).Error()
+		if streamObj.Param != "" {
+			audit.Reason = strings.ReplaceAll(audit.Reason, streamObj.Param, "xxxxxx")
+		}
+	}
+
+	if err := func() error {
+		b, err := json.Marshal(audit)
+		if err != nil {
+			return errors.Wrapf(err, "marshal %v", audit.String())
+		}
+
+		return bufferedRedisWrite(ctx, "publish audit", func(ctx context.Context, pipe redis.Pipeliner) {
+			pipe.LPush(ctx, SRS_PUBLISH_AUDIT, string(b))
+			pipe.LTrim(ctx, SRS_PUBLISH_AUDIT, 0, publishAuditMaxEntries-1)
+		})
+	}(); err != nil {
+		logger.Wf(ctx, "publish audit ignore %v err %+v", audit.String(), err)
+		return
+	}
+
+	logger.Tf(ctx, "publish audit ok, %v", audit.String())
+}
+
+// rangePublishAudits callback for each attempt in audit log, the latest first, without loading all of them.
+func rangePublishAudits(ctx context.Context, handler func(audit *PublishAudit) error) error {
+	return rangeRedisList(ctx, SRS_PUBLISH_AUDIT, publishAuditMaxEntries, func(value string) error {
+		var audit PublishAudit
+		if err := json.Unmarshal([]byte(value), &audit); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", value)
+		}
+		return handler(&audit)
+	})
+}
+
+// queryPublishAudits returns the attempts in audit log, the latest first.
+func queryPublishAudits(ctx context.Context) ([]*PublishAudit, error) {
+	var audits []*PublishAudit
+	if err := rangePublishAudits(ctx, func(audit *PublishAudit) error {
+		audits = append(audits, audit)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "range audits")
+	}
+	return audits, nil
+}
+
+func handleMgmtPublishAudit(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/streams/audit"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Stream the audits, in the same envelope of httpWriteData, see JSONArrayWriter.
+			aw := NewJSONArrayWriter(w, "audits")
+			if err := rangePublishAudits(ctx, func(audit *PublishAudit) error {
+				return aw.Write(audit)
+			}); err != nil {
+				return errors.Wrapf(err, "range audits")
+			}
+			if err := aw.Close(); err != nil {
+				return errors.Wrapf(err, "close")
+			}
+			logger.Tf(ctx, "publish audit query ok, audits=%v, token=%vB", aw.Elements(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
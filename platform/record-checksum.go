@@ -0,0 +1,405 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The default and max IO rate in MB/s to re-hash files in verification, to avoid starving the live streams, which
+// also read and write the same disk.
+const recordVerifyDefaultRate = 32
+const recordVerifyMaxRate = 1024
+
+// FileChecksum is the size and SHA-256 of a file, to verify the integrity.
+type FileChecksum struct {
+	// The object key, for example, record/3ECF0239-708C-42E4-96E1-5AE935C6E6A9/index.mp4
+	Key string `json:"key"`
+	// The size in bytes.
+	Size int64 `json:"size"`
+	// The SHA-256 in hex.
+	SHA256 string `json:"sha256"`
+}
+
+func (v *FileChecksum) String() string {
+	return fmt.Sprintf("key=%v, size=%v, sha256=%v", v.Key, v.Size, v.SHA256)
+}
+
+// rateLimitedReader limits the read rate in bytes per second, by sleeping when reads ahead of the rate.
+type rateLimitedReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	nn    int64
+}
+
+func newRateLimitedReader(ctx context.Context, r io.Reader, rate int64) *rateLimitedReader {
+	return &rateLimitedReader{ctx: ctx, r: r, rate: rate, start: time.Now()}
+}
+
+func (v *rateLimitedReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if n <= 0 || v.rate <= 0 {
+		return n, err
+	}
+
+	v.nn += int64(n)
+	expect := time.Duration(float64(v.nn) / float64(v.rate) * float64(time.Second))
+	if elapsed := time.Since(v.start); elapsed < expect {
+		select {
+		case <-v.ctx.Done():
+			return n, v.ctx.Err()
+		case <-time.After(expect - elapsed):
+		}
+	}
+	return n, err
+}
+
+// checksumReader reads r to the end, and returns the size and SHA-256 in hex. The rate is the max read rate in bytes
+// per second, or no limit if not positive.
+func checksumReader(ctx context.Context, r io.Reader, rate int64) (int64, string, error) {
+	h := sha256.New()
+	nn, err := io.Copy(h, newRateLimitedReader(ctx, r, rate))
+	if err != nil {
+		return nn, "", errors.Wrapf(err, "copy")
+	}
+	return nn, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checksumFile returns the checksum of a local file, see checksumReader.
+func checksumFile(ctx context.Context, filename string, rate int64) (*FileChecksum, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %v", filename)
+	}
+	defer f.Close()
+
+	size, sum, err := checksumReader(ctx, f, rate)
+	if err != nil {
+		return nil, errors.Wrapf(err, "checksum %v", filename)
+	}
+	return &FileChecksum{Key: filename, Size: size, SHA256: sum}, nil
+}
+
+// checksumRecordFiles returns the checksums of all files of record in local disk, without rate limit, because it's
+// only run once when record is finalized.
+func checksumRecordFiles(ctx context.Context, recordUUID string) ([]*FileChecksum, error) {
+	objects, err := localStorage.List(ctx, fmt.Sprintf("record/%v/", recordUUID))
+	if err != nil {
+		return nil, errors.Wrapf(err, "list record %v", recordUUID)
+	}
+
+	checksums := make([]*FileChecksum, 0, len(objects))
+	for _, object := range objects {
+		if err := func() error {
+			f, err := localStorage.Get(ctx, object.Key)
+			if err != nil {
+				return errors.Wrapf(err, "get %v", object.Key)
+			}
+			defer f.Close()
+
+			size, sum, err := checksumReader(ctx, f, 0)
+			if err != nil {
+				return errors.Wrapf(err, "checksum %v", object.Key)
+			}
+			checksums = append(checksums, &FileChecksum{Key: object.Key, Size: size, SHA256: sum})
+			return nil
+		}(); err != nil {
+			return nil, err
+		}
+	}
+	return checksums, nil
+}
+
+// findFileChecksum returns the checksum of key, or nil if not found.
+func findFileChecksum(checksums []*FileChecksum, key string) *FileChecksum {
+	for _, checksum := range checksums {
+		if checksum.Key == key {
+			return checksum
+		}
+	}
+	return nil
+}
+
+// The status of verify job.
+type RecordVerifyStatus string
+
+const RecordVerifyStatusRunning RecordVerifyStatus = "running"
+const RecordVerifyStatusDone RecordVerifyStatus = "done"
+const RecordVerifyStatusFailed RecordVerifyStatus = "failed"
+
+// RecordVerifyMismatch is a file which is missing or changed since finalized.
+type RecordVerifyMismatch struct {
+	// The type of file, record or vlive.
+	Type string `json:"type"`
+	// The UUID of recording, or the platform of vLive.
+	Owner string `json:"owner"`
+	// The file key or path.
+	Key string `json:"key"`
+	// The expected size and SHA-256.
+	Expect *FileChecksum `json:"expect"`
+	// The actual size and SHA-256, nil if failed to read.
+	Actual *FileChecksum `json:"actual,omitempty"`
+	// The error message if failed to read, for example, the file is missing.
+	Error string `json:"error,omitempty"`
+}
+
+func (v *RecordVerifyMismatch) String() string {
+	return fmt.Sprintf("type=%v, owner=%v, key=%v, expect=(%v), actual=(%v), error=%v",
+		v.Type, v.Owner, v.Key, v.Expect, v.Actual, v.Error,
+	)
+}
+
+// RecordVerifyJob re-hashes the files of recordings and vLive, to find the corrupted files.
+type RecordVerifyJob struct {
+	// The job UUID.
+	UUID string `json:"uuid"`
+	// The max IO rate in MB/s.
+	Rate int `json:"rate"`
+	// The status of job.
+	Status RecordVerifyStatus `json:"status"`
+	// The number of files and bytes verified.
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// The files which are missing or changed.
+	Mismatches []*RecordVerifyMismatch `json:"mismatches"`
+	// The error message if failed.
+	Error string `json:"error,omitempty"`
+	// The start and update time.
+	Start  string `json:"start"`
+	Update string `json:"update"`
+}
+
+func (v *RecordVerifyJob) String() string {
+	return fmt.Sprintf("uuid=%v, rate=%v, status=%v, files=%v, bytes=%v, mismatches=%v, error=%v, start=%v",
+		v.UUID, v.Rate, v.Status, v.Files, v.Bytes, len(v.Mismatches), v.Error, v.Start,
+	)
+}
+
+func (v *RecordVerifyJob) save(ctx context.Context) error {
+	v.Update = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(v); err != nil {
+		return errors.Wrapf(err, "marshal %v", v.String())
+	} else if err = rdb.Set(ctx, SRS_RECORD_VERIFY, string(b), 0).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "set %v %v", SRS_RECORD_VERIFY, string(b))
+	}
+	return nil
+}
+
+// verify re-hashes the file, by the open function, and appends a mismatch if missing or changed.
+func (v *RecordVerifyJob) verify(ctx context.Context, fileType, owner string, expect *FileChecksum, open func() (io.ReadCloser, error)) {
+	mismatch := &RecordVerifyMismatch{Type: fileType, Owner: owner, Key: expect.Key, Expect: expect}
+
+	if err := func() error {
+		f, err := open()
+		if err != nil {
+			return errors.Wrapf(err, "open")
+		}
+		defer f.Close()
+
+		size, sum, err := checksumReader(ctx, f, int64(v.Rate)*1024*1024)
+		v.Files, v.Bytes = v.Files+1, v.Bytes+size
+		if err != nil {
+			return errors.Wrapf(err, "checksum")
+		}
+
+		if size != expect.Size || sum != expect.SHA256 {
+			mismatch.Actual = &FileChecksum{Key: expect.Key, Size: size, SHA256: sum}
+			v.Mismatches = append(v.Mismatches, mismatch)
+		}
+		return nil
+	}(); err != nil {
+		mismatch.Error = err.Error()
+		v.Mismatches = append(v.Mismatches, mismatch)
+	}
+
+	if mismatch.Actual != nil || mismatch.Error != "" {
+		logger.Wf(ctx, "record verify mismatch, %v", mismatch.String())
+	}
+}
+
+// Run verifies the files of all finished recordings, and the uploaded files of vLive, which have checksums.
+func (v *RecordVerifyJob) Run(ctx context.Context) error {
+	artifacts, err := rdb.HGetAll(ctx, SRS_RECORD_M3U8_ARTIFACT).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_RECORD_M3U8_ARTIFACT)
+	}
+
+	for _, value := range artifacts {
+		var artifact M3u8VoDArtifact
+		if err := json.Unmarshal([]byte(value), &artifact); err != nil {
+			return errors.Wrapf(err, "json parse %v", value)
+		}
+
+		// Read the local file, or the archived one if removed from local disk.
+		var driver StorageDriver = localStorage
+		if artifact.Storage != "" && artifact.Storage != StorageDriverLocal {
+			if driver, err = queryStorageDriverByName(ctx, artifact.Storage); err != nil {
+				return errors.Wrapf(err, "query driver %v", artifact.Storage)
+			}
+		}
+
+		for _, checksum := range artifact.Checksums {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			v.verify(ctx, "record", artifact.UUID, checksum, func() (io.ReadCloser, error) {
+				if f, err := localStorage.Get(ctx, checksum.Key); err == nil || driver == localStorage {
+					return f, err
+				}
+				return driver.Get(ctx, checksum.Key)
+			})
+		}
+		if err := v.save(ctx); err != nil {
+			return errors.Wrapf(err, "save %v", v.String())
+		}
+	}
+
+	configs, err := rdb.HGetAll(ctx, SRS_VLIVE_CONFIG).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_VLIVE_CONFIG)
+	}
+
+	for platform, value := range configs {
+		var conf VLiveConfigure
+		if err := json.Unmarshal([]byte(value), &conf); err != nil {
+			return errors.Wrapf(err, "json parse %v", value)
+		}
+
+		for _, file := range conf.Files {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if file.Type == FFprobeSourceTypeStream || file.SHA256 == "" {
+				continue
+			}
+
+			target := file.Target
+			v.verify(ctx, "vlive", platform, &FileChecksum{Key: target, Size: int64(file.Size), SHA256: file.SHA256},
+				func() (io.ReadCloser, error) {
+					return os.Open(target)
+				},
+			)
+		}
+	}
+
+	return nil
+}
+
+func (v *RecordWorker) handleVerify(ctx context.Context, handler *http.ServeMux) {
+	// Only one verify job at the same time, because it's IO intensive.
+	var running bool
+	var lock sync.Mutex
+
+	ep := "/terraform/v1/mgmt/recordings/verify"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		if err := func() error {
+			var token, action string
+			rate := recordVerifyDefaultRate
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Action *string `json:"action"`
+				Rate   *int    `json:"rate"`
+			}{
+				Token: &token, Action: &action, Rate: &rate,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if action != "" && action != "start" {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+			}
+			if rate <= 0 || rate > recordVerifyMaxRate {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf(
+					"invalid rate %v, should in (0, %v]", rate, recordVerifyMaxRate,
+				))
+			}
+
+			// Query the last job.
+			if action == "" {
+				var job *RecordVerifyJob
+				if value, err := rdb.Get(ctx, SRS_RECORD_VERIFY).Result(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "get %v", SRS_RECORD_VERIFY)
+				} else if value != "" {
+					job = &RecordVerifyJob{}
+					if err := json.Unmarshal([]byte(value), job); err != nil {
+						return errors.Wrapf(err, "unmarshal %v", value)
+					}
+				}
+
+				httpWriteData(ctx, w, r, job)
+				logger.Tf(ctx, "record verify query ok, job=(%v), token=%vB", job, len(token))
+				return nil
+			}
+
+			lock.Lock()
+			defer lock.Unlock()
+			if running {
+				return newHttpStatusError(http.StatusConflict, errors.New("verify job is running"))
+			}
+
+			job := &RecordVerifyJob{
+				UUID: uuid.NewString(), Rate: rate, Status: RecordVerifyStatusRunning,
+				Mismatches: []*RecordVerifyMismatch{}, Start: time.Now().Format(time.RFC3339),
+			}
+			if err := job.save(ctx); err != nil {
+				return errors.Wrapf(err, "save %v", job.String())
+			}
+
+			running = true
+			v.wg.Add(1)
+			go safe(ctx, func() {
+				defer v.wg.Done()
+				defer func() {
+					lock.Lock()
+					defer lock.Unlock()
+					running = false
+				}()
+
+				if err := job.Run(ctx); err != nil {
+					job.Status, job.Error = RecordVerifyStatusFailed, err.Error()
+					logger.Wf(ctx, "record verify %v err %+v", job.String(), err)
+				} else {
+					job.Status = RecordVerifyStatusDone
+					logger.Tf(ctx, "record verify ok, %v", job.String())
+				}
+
+				if err := job.save(ctx); err != nil {
+					logger.Wf(ctx, "record verify ignore save err %+v", err)
+				}
+			})
+
+			httpWriteData(ctx, w, r, job)
+			logger.Tf(ctx, "record verify start, %v, token=%vB", job.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
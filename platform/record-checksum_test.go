@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestRecordChecksum_VerifyMismatch(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	dir, err := ioutil.TempDir("", "record-checksum")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldStorage := localStorage
+	localStorage = NewLocalStorage(dir)
+	defer func() {
+		localStorage = oldStorage
+	}()
+
+	for key, body := range map[string]string{
+		"record/a/index.m3u8": "#EXTM3U", "record/a/index.mp4": "mp4", "record/b/index.mp4": "other",
+	} {
+		if err := localStorage.Put(ctx, key, strings.NewReader(body), int64(len(body))); err != nil {
+			t.Fatalf("Fail for put %v err %+v", key, err)
+		}
+	}
+
+	// The checksums of final files, only for the record.
+	checksums, err := checksumRecordFiles(ctx, "a")
+	if err != nil || len(checksums) != 2 {
+		t.Fatalf("Fail for %v, err %+v", checksums, err)
+	}
+	if c := findFileChecksum(checksums, "record/a/index.mp4"); c == nil || c.Size != 3 ||
+		c.SHA256 != fmt.Sprintf("%x", sha256.Sum256([]byte("mp4"))) {
+		t.Errorf("Fail for %v", c)
+	}
+
+	artifact := &M3u8VoDArtifact{UUID: "a", Checksums: checksums}
+	if b, err := json.Marshal(artifact); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	} else {
+		server.HSet(SRS_RECORD_M3U8_ARTIFACT, "a", string(b))
+	}
+
+	// The vLive file with checksum, which is removed later.
+	vliveFile := path.Join(dir, "vlive.mp4")
+	ioutil.WriteFile(vliveFile, []byte("vlive"), 0644)
+	vliveChecksum, err := checksumFile(ctx, vliveFile, 0)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	conf := &VLiveConfigure{Platform: "wx", Files: []*FFprobeSource{
+		{Target: vliveFile, Type: FFprobeSourceTypeFile, Size: uint64(vliveChecksum.Size), SHA256: vliveChecksum.SHA256},
+		{Target: "rtsp://127.0.0.1/live", Type: FFprobeSourceTypeStream},
+	}}
+	if b, err := json.Marshal(conf); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	} else {
+		server.HSet(SRS_VLIVE_CONFIG, "wx", string(b))
+	}
+
+	// Nothing changed.
+	job := &RecordVerifyJob{Rate: recordVerifyDefaultRate}
+	if err := job.Run(ctx); err != nil || job.Files != 3 || len(job.Mismatches) != 0 {
+		t.Fatalf("Fail for %v, err %+v", job.String(), err)
+	}
+
+	// Corrupt the mp4 of record, and remove the vLive file.
+	ioutil.WriteFile(path.Join(dir, "record/a/index.mp4"), []byte("mp5"), 0644)
+	os.Remove(vliveFile)
+
+	job = &RecordVerifyJob{Rate: recordVerifyDefaultRate}
+	if err := job.Run(ctx); err != nil || len(job.Mismatches) != 2 {
+		t.Fatalf("Fail for %v, err %+v", job.String(), err)
+	}
+	for _, m := range job.Mismatches {
+		if m.Type == "record" && (m.Key != "record/a/index.mp4" || m.Actual == nil || m.Actual.SHA256 == m.Expect.SHA256) {
+			t.Errorf("Fail for %v", m.String())
+		} else if m.Type == "vlive" && (m.Key != vliveFile || m.Error == "") {
+			t.Errorf("Fail for %v", m.String())
+		}
+	}
+}
+
+func TestRecordChecksum_RateLimit(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	// Read 20KB at 100KB/s, should take about 200ms.
+	starttime := time.Now()
+	if size, _, err := checksumReader(ctx, strings.NewReader(strings.Repeat("x", 20*1024)), 100*1024); err != nil || size != 20*1024 {
+		t.Errorf("Fail for size=%v, err %+v", size, err)
+	}
+	if elapsed := time.Since(starttime); elapsed < 150*time.Millisecond {
+		t.Errorf("Fail for elapsed %v", elapsed)
+	}
+
+	// Cancel the slow read.
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, _, err := checksumReader(ctx, strings.NewReader(strings.Repeat("x", 1024*1024)), 100*1024); err == nil {
+		t.Errorf("Fail for no error")
+	}
+}
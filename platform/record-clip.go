@@ -0,0 +1,365 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The max number of clip jobs running at the same time.
+const recordClipMaxJobs = 2
+
+// The status of record clip job.
+type RecordClipStatus string
+
+const RecordClipStatusRunning RecordClipStatus = "running"
+const RecordClipStatusDone RecordClipStatus = "done"
+const RecordClipStatusFailed RecordClipStatus = "failed"
+
+// RecordClipJob is a job to cut a clip from a finished recording, as a new recording.
+type RecordClipJob struct {
+	// The job UUID.
+	UUID string `json:"uuid"`
+	// The source recording UUID.
+	Source string `json:"source"`
+	// The start and end offset in seconds.
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+	// The output name of clip.
+	Name string `json:"name"`
+	// Whether cut at the exact offset, re-encode if not at keyframe.
+	Precise bool `json:"precise"`
+	// Whether re-encode the clip.
+	Reencode bool `json:"reencode"`
+
+	// The status of job.
+	Status RecordClipStatus `json:"status"`
+	// The progress in percent, 0 to 100.
+	Progress int `json:"progress"`
+	// The new recording UUID, available when done.
+	Record string `json:"record,omitempty"`
+	// The error message if failed.
+	Error string `json:"error,omitempty"`
+	// The update time.
+	Update string `json:"update"`
+}
+
+func (v *RecordClipJob) String() string {
+	return fmt.Sprintf("uuid=%v, source=%v, start=%v, end=%v, name=%v, precise=%v, reencode=%v, "+
+		"status=%v, progress=%v, record=%v, error=%v",
+		v.UUID, v.Source, v.Start, v.End, v.Name, v.Precise, v.Reencode, v.Status, v.Progress,
+		v.Record, v.Error,
+	)
+}
+
+func (v *RecordClipJob) save(ctx context.Context) error {
+	v.Update = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(v); err != nil {
+		return errors.Wrapf(err, "marshal %v", v.String())
+	} else if err = rdb.HSet(ctx, SRS_RECORD_CLIP, v.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_CLIP, v.UUID, string(b))
+	}
+	return nil
+}
+
+// isKeyframeAt returns whether there is a video keyframe at the offset of file.
+func isKeyframeAt(ctx context.Context, file string, offset float64) (bool, error) {
+	args := []string{
+		"-v", "quiet", "-select_streams", "v:0", "-skip_frame", "nokey",
+		"-read_intervals", fmt.Sprintf("%.3f%%+1", math.Max(0, offset-1)),
+		"-show_entries", "frame=pts_time", "-of", "csv=p=0", file,
+	}
+	stdout, err := exec.CommandContext(ctx, "ffprobe", args...).Output()
+	if err != nil {
+		return false, errors.Wrapf(err, "ffprobe %v", file)
+	}
+
+	for _, line := range strings.Split(string(stdout), "\n") {
+		if pts, err := strconv.ParseFloat(strings.TrimSpace(line), 64); err == nil && math.Abs(pts-offset) < 0.05 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Run cuts the clip to a new recording, with a mp4 file and a ts file for HLS.
+func (v *RecordClipJob) Run(ctx context.Context, source *M3u8VoDArtifact) error {
+	recordUUID := uuid.NewString()
+	recordDir := path.Join("record", recordUUID)
+	if err := os.MkdirAll(recordDir, 0755); err != nil {
+		return errors.Wrapf(err, "mkdir %v", recordDir)
+	}
+
+	// Cleanup the directory if failed.
+	var done bool
+	defer func() {
+		if !done {
+			os.RemoveAll(recordDir)
+		}
+	}()
+
+	sourceMp4 := path.Join("record", v.Source, "index.mp4")
+	mp4File := path.Join(recordDir, "index.mp4")
+	duration := v.End - v.Start
+
+	// Seek before input is fast, but it only cuts at keyframe if stream copy.
+	args := []string{"-ss", fmt.Sprintf("%.3f", v.Start), "-i", sourceMp4, "-t", fmt.Sprintf("%.3f", duration)}
+	if v.Reencode {
+		args = append(args, "-c:v", "libx264", "-preset", "veryfast", "-c:a", "aac")
+	} else {
+		args = append(args, "-c", "copy", "-avoid_negative_ts", "make_zero")
+	}
+	args = append(args, "-progress", "pipe:1", "-nostats", "-y", mp4File)
+
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return errors.Wrapf(err, "pipe process")
+	}
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "start ffmpeg %v", args)
+	}
+
+	// Parse the progress of FFmpeg, for example, out_time_us=1234567
+	scanner := bufio.NewScanner(stdout)
+	for scanner.Scan() {
+		k, value, _ := strings.Cut(scanner.Text(), "=")
+		if k != "out_time_us" {
+			continue
+		}
+		if us, err := strconv.ParseInt(value, 10, 64); err == nil && duration > 0 {
+			if progress := int(float64(us) / 1000000 / duration * 100); progress > v.Progress && progress < 100 {
+				v.Progress = progress
+				if err := v.save(ctx); err != nil {
+					logger.Wf(ctx, "record clip ignore save err %+v", err)
+				}
+			}
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return errors.Wrapf(err, "ffmpeg %v", args)
+	}
+
+	// Remux to a ts file, so the clip is also able to be played as HLS.
+	tsID := uuid.NewString()
+	tsFile := path.Join(recordDir, fmt.Sprintf("%v.ts", tsID))
+	if b, err := exec.CommandContext(ctx, "ffmpeg", "-i", mp4File, "-c", "copy", "-f", "mpegts", "-y", tsFile).CombinedOutput(); err != nil {
+		return errors.Wrapf(err, "remux %v to %v, %v", mp4File, tsFile, lastLineOf(string(b)))
+	}
+
+	info, err := os.Stat(tsFile)
+	if err != nil {
+		return errors.Wrapf(err, "stat %v", tsFile)
+	}
+
+	format, _, _, err := FFprobeFileFormat(ctx, mp4File)
+	if err != nil {
+		return errors.Wrapf(err, "probe %v", mp4File)
+	}
+
+	// Register the clip as a new recording.
+	now := time.Now().Format(time.RFC3339)
+	artifact := &M3u8VoDArtifact{
+		NN: 1, Update: now, UUID: recordUUID, M3u8URL: source.M3u8URL,
+		Vhost: source.Vhost, App: source.App, Stream: source.Stream,
+		Processing: false, Done: now, Name: v.Name, Source: v.Source,
+		PlaybackURL: recordPlaybackURL(recordUUID),
+		Files: []*TsFile{{
+			Key: tsFile, TsID: tsID, File: tsFile, Duration: format.Duration, Size: uint64(info.Size()),
+		}},
+	}
+	if b, err := json.Marshal(artifact); err != nil {
+		return errors.Wrapf(err, "marshal %v", artifact.String())
+	} else if err = rdb.HSet(ctx, SRS_RECORD_M3U8_ARTIFACT, recordUUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_M3U8_ARTIFACT, recordUUID, string(b))
+	}
+
+	done, v.Record = true, recordUUID
+	return nil
+}
+
+func (v *RecordWorker) handleClip(ctx context.Context, handler *http.ServeMux) {
+	// Limit the concurrent clip jobs.
+	jobs := make(chan bool, recordClipMaxJobs)
+
+	ep := "/terraform/v1/mgmt/recordings/clip"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		// The clip job outlives the request, so it runs in the context of worker.
+		parentCtx := ctx
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			job := &RecordClipJob{}
+			if err := ParseBody(ctx, r, &struct {
+				Token   *string  `json:"token"`
+				UUID    *string  `json:"uuid"`
+				Start   *float64 `json:"start"`
+				End     *float64 `json:"end"`
+				Name    *string  `json:"name"`
+				Precise *bool    `json:"precise"`
+			}{
+				Token: &token, UUID: &job.Source, Start: &job.Start, End: &job.End, Name: &job.Name,
+				Precise: &job.Precise,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if job.Source == "" {
+				return errors.New("no uuid")
+			}
+			if job.Start < 0 {
+				return errors.Errorf("invalid start %v", job.Start)
+			}
+			if job.End <= job.Start {
+				return errors.Errorf("invalid end %v, should after start %v", job.End, job.Start)
+			}
+
+			var source M3u8VoDArtifact
+			if metadata, err := rdb.HGet(ctx, SRS_RECORD_M3U8_ARTIFACT, job.Source).Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hget %v %v", SRS_RECORD_M3U8_ARTIFACT, job.Source)
+			} else if metadata == "" {
+				return errors.Errorf("no record for uuid=%v", job.Source)
+			} else if err = json.Unmarshal([]byte(metadata), &source); err != nil {
+				return errors.Wrapf(err, "parse %v", metadata)
+			}
+
+			sourceMp4 := path.Join("record", job.Source, "index.mp4")
+			if source.Processing {
+				return errors.Errorf("record %v is processing", job.Source)
+			} else if _, err := os.Stat(sourceMp4); err != nil {
+				return errors.Wrapf(err, "no mp4 file %v", sourceMp4)
+			}
+
+			format, _, _, err := FFprobeFileFormat(ctx, sourceMp4)
+			if err != nil {
+				return errors.Wrapf(err, "probe %v", sourceMp4)
+			}
+			if job.End > format.Duration {
+				return errors.Errorf("invalid end %v, exceed duration %v", job.End, format.Duration)
+			}
+
+			// Only re-encode if precise is required and the start is not at keyframe.
+			if job.Precise {
+				if keyframe, err := isKeyframeAt(ctx, sourceMp4, job.Start); err != nil {
+					return errors.Wrapf(err, "check keyframe at %v of %v", job.Start, sourceMp4)
+				} else {
+					job.Reencode = !keyframe
+				}
+			}
+
+			select {
+			case jobs <- true:
+			default:
+				return errors.Errorf("too many clip jobs, max %v", recordClipMaxJobs)
+			}
+
+			job.UUID, job.Status = uuid.NewString(), RecordClipStatusRunning
+			if job.Name == "" {
+				job.Name = fmt.Sprintf("%v-%v-%v", source.Stream, int(job.Start), int(job.End))
+			}
+			if err := job.save(ctx); err != nil {
+				<-jobs
+				return errors.Wrapf(err, "save %v", job.String())
+			}
+
+			v.wg.Add(1)
+			jobCtx := logger.AliasContext(parentCtx, ctx)
+			go safe(jobCtx, func() {
+				ctx := jobCtx
+				defer v.wg.Done()
+				defer func() {
+					<-jobs
+				}()
+
+				if err := job.Run(ctx, &source); err != nil {
+					job.Status, job.Error = RecordClipStatusFailed, err.Error()
+					logger.Wf(ctx, "record clip %v err %+v", job.String(), err)
+				} else {
+					job.Status, job.Progress = RecordClipStatusDone, 100
+					logger.Tf(ctx, "record clip ok, %v", job.String())
+				}
+
+				if err := job.save(ctx); err != nil {
+					logger.Wf(ctx, "record clip ignore save err %+v", err)
+				}
+			})
+
+			httpWriteData(ctx, w, r, job)
+			logger.Tf(ctx, "record clip start, %v, token=%vB", job.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/recordings/clip/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, jobUUID string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+			}{
+				Token: &token, UUID: &jobUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if jobUUID == "" {
+				return errors.New("no uuid")
+			}
+
+			var job RecordClipJob
+			if obj, err := rdb.HGet(ctx, SRS_RECORD_CLIP, jobUUID).Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hget %v %v", SRS_RECORD_CLIP, jobUUID)
+			} else if obj == "" {
+				return errors.Errorf("clip %v not found", jobUUID)
+			} else if err := json.Unmarshal([]byte(obj), &job); err != nil {
+				return errors.Wrapf(err, "unmarshal %v", obj)
+			}
+
+			httpWriteData(ctx, w, r, &job)
+			logger.Tf(ctx, "record clip query ok, %v, token=%vB", job.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,382 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The interval to export the finished records, and retry the failed ones.
+const recordExportInterval = 30 * time.Second
+
+// The max attempts to export a record, and the base backoff, which is doubled for each attempt.
+const (
+	recordExportMaxAttempts = 5
+	recordExportBackoff     = time.Minute
+)
+
+type RecordExportStatus string
+
+const (
+	// The export is waiting to upload, or to retry.
+	RecordExportStatusPending RecordExportStatus = "pending"
+	// The file is uploaded, and the file id is in the artifact.
+	RecordExportStatusDone RecordExportStatus = "done"
+	// The export fails after max attempts, retry by API.
+	RecordExportStatusFailed RecordExportStatus = "failed"
+)
+
+// RecordExport is the state of exporting a record to cloud VOD, the file id is also stored in the artifact.
+type RecordExport struct {
+	// The UUID of record.
+	UUID string `json:"uuid"`
+	// The exporter, for example, tencent-vod.
+	Exporter StorageDriverName `json:"exporter"`
+	// The status of export.
+	Status RecordExportStatus `json:"status"`
+	// The file id in cloud VOD.
+	FileID string `json:"fileId,omitempty"`
+	// The status of the task flow in cloud VOD, for example, PROCESSING or FINISH, updated by callback.
+	Procedure string `json:"procedure,omitempty"`
+	// The attempts to export, and the error of last attempt.
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+	// The time to retry, in RFC3339.
+	Next string `json:"next,omitempty"`
+	// The last update time, in RFC3339.
+	Update string `json:"update"`
+}
+
+func (v *RecordExport) String() string {
+	return fmt.Sprintf("uuid=%v, exporter=%v, status=%v, fileId=%v, procedure=%v, attempts=%v, error=%v, next=%v",
+		v.UUID, v.Exporter, v.Status, v.FileID, v.Procedure, v.Attempts, v.Error, v.Next,
+	)
+}
+
+func (v *RecordExport) save(ctx context.Context) error {
+	v.Update = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(v); err != nil {
+		return errors.Wrapf(err, "marshal %v", v.String())
+	} else if err := rdb.HSet(ctx, SRS_RECORD_EXPORT, v.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_EXPORT, v.UUID, string(b))
+	}
+	return nil
+}
+
+// queryRecordExports returns the exports of records, sorted by update time, the latest first.
+func queryRecordExports(ctx context.Context) ([]*RecordExport, error) {
+	values, err := rdb.HGetAll(ctx, SRS_RECORD_EXPORT).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_RECORD_EXPORT)
+	}
+
+	exports := make([]*RecordExport, 0, len(values))
+	for _, value := range values {
+		var export RecordExport
+		if err := json.Unmarshal([]byte(value), &export); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+		exports = append(exports, &export)
+	}
+
+	sort.Slice(exports, func(i, j int) bool {
+		if exports[i].Update != exports[j].Update {
+			return exports[i].Update > exports[j].Update
+		}
+		return exports[i].UUID < exports[j].UUID
+	})
+	return exports, nil
+}
+
+func queryRecordExport(ctx context.Context, uuid string) (*RecordExport, error) {
+	value, err := rdb.HGet(ctx, SRS_RECORD_EXPORT, uuid).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_RECORD_EXPORT, uuid)
+	} else if value == "" {
+		return nil, nil
+	}
+
+	var export RecordExport
+	if err := json.Unmarshal([]byte(value), &export); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", value)
+	}
+	return &export, nil
+}
+
+// enqueueRecordExport creates a pending export for the finished record, if any exporter is enabled.
+func enqueueRecordExport(ctx context.Context, uuid string) error {
+	exporter, err := queryStorageExporter(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query exporter")
+	} else if exporter == nil {
+		return nil
+	}
+
+	export := &RecordExport{UUID: uuid, Exporter: exporter.Name(), Status: RecordExportStatusPending}
+	if err := export.save(ctx); err != nil {
+		return errors.Wrapf(err, "save %v", export.String())
+	}
+	logger.Tf(ctx, "record export enqueue ok, %v", export.String())
+	return nil
+}
+
+// exportRecords exports the pending records which are due, the failed attempt is retried with backoff.
+func exportRecords(ctx context.Context, queryExporter func(ctx context.Context) (StorageExporter, error)) error {
+	exporter, err := queryExporter(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query exporter")
+	} else if exporter == nil {
+		return nil
+	}
+
+	exports, err := queryRecordExports(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query exports")
+	}
+
+	now := time.Now()
+	for _, export := range exports {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if export.Status != RecordExportStatusPending {
+			continue
+		}
+		if next, err := time.Parse(time.RFC3339, export.Next); err == nil && now.Before(next) {
+			continue
+		}
+
+		fileID, err := exportRecord(ctx, exporter, export.UUID)
+		export.Exporter, export.Attempts = exporter.Name(), export.Attempts+1
+		if err != nil {
+			export.Error = err.Error()
+			if export.Attempts >= recordExportMaxAttempts {
+				export.Status, export.Next = RecordExportStatusFailed, ""
+			} else {
+				backoff := recordExportBackoff * time.Duration(1<<uint(export.Attempts-1))
+				export.Next = now.Add(backoff).Format(time.RFC3339)
+			}
+			logger.Wf(ctx, "record export failed, %v, err %+v", export.String(), err)
+		} else {
+			export.Status, export.FileID, export.Error, export.Next = RecordExportStatusDone, fileID, "", ""
+			if err := rdb.HSet(ctx, SRS_RECORD_EXPORT_FILE, fileID, export.UUID).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_EXPORT_FILE, fileID, export.UUID)
+			}
+			logger.Tf(ctx, "record export ok, %v", export.String())
+		}
+
+		if err := export.save(ctx); err != nil {
+			return errors.Wrapf(err, "save %v", export.String())
+		}
+	}
+	return nil
+}
+
+// exportRecord exports the MP4 of record, from local disk or the storage driver it's archived to, and stores the file
+// id in the artifact.
+func exportRecord(ctx context.Context, exporter StorageExporter, uuid string) (string, error) {
+	value, err := rdb.HGet(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid).Result()
+	if err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "hget %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid)
+	} else if value == "" {
+		return "", errors.Errorf("no record for uuid=%v", uuid)
+	}
+
+	var artifact M3u8VoDArtifact
+	if err := json.Unmarshal([]byte(value), &artifact); err != nil {
+		return "", errors.Wrapf(err, "unmarshal %v", value)
+	}
+
+	key := path.Join("record", uuid, "index.mp4")
+	var driver StorageDriver = localStorage
+	if objects, err := localStorage.List(ctx, key); err != nil || len(objects) == 0 {
+		if artifact.Storage == "" || artifact.Storage == StorageDriverLocal {
+			return "", errors.Errorf("no %v, MP4 is required to export", key)
+		}
+		if driver, err = queryStorageDriverByName(ctx, artifact.Storage); err != nil {
+			return "", errors.Wrapf(err, "query driver %v", artifact.Storage)
+		}
+	}
+
+	objects, err := driver.List(ctx, key)
+	if err != nil {
+		return "", errors.Wrapf(err, "list %v of %v", key, driver.Name())
+	} else if len(objects) == 0 || objects[0].Key != key {
+		return "", errors.Errorf("no %v in %v", key, driver.Name())
+	}
+
+	f, err := driver.Get(ctx, key)
+	if err != nil {
+		return "", errors.Wrapf(err, "get %v of %v", key, driver.Name())
+	}
+	defer f.Close()
+
+	fileID, err := exporter.Export(ctx, key, f, objects[0].Size)
+	if err != nil {
+		return "", errors.Wrapf(err, "export %v to %v", key, exporter.Name())
+	}
+
+	artifact.FileID = fileID
+	if b, err := json.Marshal(&artifact); err != nil {
+		return "", errors.Wrapf(err, "marshal %v", artifact.String())
+	} else if err := rdb.HSet(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid, string(b)).Err(); err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid, string(b))
+	}
+	return fileID, nil
+}
+
+func (v *RecordWorker) handleExport(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/recordings/export"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action, uuid string
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Action *string `json:"action"`
+				UUID   *string `json:"uuid"`
+			}{
+				Token: &token, Action: &action, UUID: &uuid,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if action != "" && action != "retry" {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+			}
+			if action == "retry" && uuid == "" {
+				return newHttpStatusError(http.StatusBadRequest, errors.New("no uuid"))
+			}
+
+			// Retry the export, or export a record which is finished before exporter is enabled.
+			if action == "retry" {
+				if ok, err := rdb.HExists(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid).Result(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hexists %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid)
+				} else if !ok {
+					return newHttpStatusError(http.StatusNotFound, errors.Errorf("no record for uuid=%v", uuid))
+				}
+
+				export, err := queryRecordExport(ctx, uuid)
+				if err != nil {
+					return errors.Wrapf(err, "query export %v", uuid)
+				} else if export == nil {
+					export = &RecordExport{UUID: uuid}
+				}
+
+				export.Status, export.Attempts, export.Error, export.Next = RecordExportStatusPending, 0, "", ""
+				if err := export.save(ctx); err != nil {
+					return errors.Wrapf(err, "save %v", export.String())
+				}
+				logger.Tf(ctx, "record export retry, %v", export.String())
+			}
+
+			exports, err := queryRecordExports(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query exports")
+			}
+
+			if uuid != "" {
+				var matched []*RecordExport
+				for _, export := range exports {
+					if export.UUID == uuid {
+						matched = append(matched, export)
+					}
+				}
+				exports = matched
+			}
+
+			httpWriteData(ctx, w, r, exports)
+			logger.Tf(ctx, "record export ok, action=%v, uuid=%v, exports=%v, token=%vB", action, uuid, len(exports), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
+
+// For the event notifications of VOD, the callback URL is configured with the key, for example,
+// https://your-domain/terraform/v1/hooks/record/vod/callback?key=xxx
+// See https://cloud.tencent.com/document/product/266/7829
+func (v *RecordWorker) handleVodCallback(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/hooks/record/vod/callback"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			vodStorage, err := queryTencentVodStorage(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query vod")
+			}
+
+			key := r.URL.Query().Get("key")
+			if vodStorage == nil || vodStorage.CallbackKey == "" ||
+				subtle.ConstantTimeCompare([]byte(key), []byte(vodStorage.CallbackKey)) != 1 {
+				return newHttpCodeError(http.StatusUnauthorized, SrsStackErrorAuth, errors.New("invalid callback key"))
+			}
+
+			var event struct {
+				EventType                 string `json:"EventType"`
+				ProcedureStateChangeEvent *struct {
+					FileId  string `json:"FileId"`
+					Status  string `json:"Status"`
+					ErrCode int    `json:"ErrCode"`
+					Message string `json:"Message"`
+				} `json:"ProcedureStateChangeEvent"`
+			}
+			if err := ParseBody(ctx, r, &event); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			// Ignore the other events, VOD requires 200 to confirm the event.
+			if e := event.ProcedureStateChangeEvent; event.EventType == "ProcedureStateChanged" && e != nil {
+				uuid, err := rdb.HGet(ctx, SRS_RECORD_EXPORT_FILE, e.FileId).Result()
+				if err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hget %v %v", SRS_RECORD_EXPORT_FILE, e.FileId)
+				}
+
+				if export, err := queryRecordExport(ctx, uuid); err != nil {
+					return errors.Wrapf(err, "query export %v", uuid)
+				} else if export != nil {
+					export.Procedure = e.Status
+					if e.ErrCode != 0 {
+						export.Procedure = fmt.Sprintf("%v, code=%v, %v", e.Status, e.ErrCode, e.Message)
+					}
+					if err := export.save(ctx); err != nil {
+						return errors.Wrapf(err, "save %v", export.String())
+					}
+				}
+				logger.Tf(ctx, "record vod callback ok, fileId=%v, uuid=%v, status=%v", e.FileId, uuid, e.Status)
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,320 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max number of labels of a recording, and the max length of label.
+const (
+	recordMaxLabels      = 16
+	recordMaxLabelLength = 64
+)
+
+// The max number of recordings in a page.
+const recordMaxPageLimit = 1000
+
+// RecordMetadata is the user-editable metadata of recording. It's stored in SRS_RECORD_METADATA apart from the
+// artifact, because the artifact is rewritten by the worker while recording.
+type RecordMetadata struct {
+	// The title of recording, specified by user.
+	Title string `json:"title,omitempty"`
+	// The labels of recording, normalized to lower case and sorted.
+	Labels []string `json:"labels,omitempty"`
+	// The notes of recording, specified by user.
+	Notes string `json:"notes,omitempty"`
+}
+
+func (v *RecordMetadata) String() string {
+	return fmt.Sprintf("title=%v, labels=%v, notes=%vB", v.Title, v.Labels, len(v.Notes))
+}
+
+// RecordFilter is the conditions to search the recordings, all conditions must match. Empty condition matches all.
+type RecordFilter struct {
+	// The stream name contains it, case-insensitive.
+	Stream string `json:"stream"`
+	// The update time of recording is in [From, To], in RFC3339.
+	From string `json:"from"`
+	To   string `json:"to"`
+	// The duration of recording in seconds is in [MinDuration, MaxDuration], zero for no limit.
+	MinDuration float64 `json:"minDuration"`
+	MaxDuration float64 `json:"maxDuration"`
+	// The recording has the label.
+	Label string `json:"label"`
+
+	// The page of recordings, starts from offset and zero limit for all.
+	Offset int `json:"offset"`
+	Limit  int `json:"limit"`
+}
+
+func (v *RecordFilter) String() string {
+	return fmt.Sprintf("stream=%v, from=%v, to=%v, duration=[%v,%v], label=%v, offset=%v, limit=%v",
+		v.Stream, v.From, v.To, v.MinDuration, v.MaxDuration, v.Label, v.Offset, v.Limit,
+	)
+}
+
+func recordLabelKey(label string) string {
+	return fmt.Sprintf("%v:%v", SRS_RECORD_LABEL, label)
+}
+
+// normalizeRecordLabels trims, lowers and removes the duplicated labels, then sort them.
+func normalizeRecordLabels(labels []string) ([]string, error) {
+	unique := make(map[string]bool)
+	for _, label := range labels {
+		label = strings.ToLower(strings.TrimSpace(label))
+		if label == "" {
+			continue
+		}
+		if len(label) > recordMaxLabelLength {
+			return nil, errors.Errorf("label %v exceeds %v", label, recordMaxLabelLength)
+		}
+		unique[label] = true
+	}
+
+	if len(unique) > recordMaxLabels {
+		return nil, errors.Errorf("labels %v exceeds %v", len(unique), recordMaxLabels)
+	}
+
+	r := make([]string, 0, len(unique))
+	for label := range unique {
+		r = append(r, label)
+	}
+	sort.Strings(r)
+	return r, nil
+}
+
+// queryRecordMetadata returns the user metadata of recording, empty if not set.
+func queryRecordMetadata(ctx context.Context, uuid string) (*RecordMetadata, error) {
+	var metadata RecordMetadata
+	if value, err := rdb.HGet(ctx, SRS_RECORD_METADATA, uuid).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_RECORD_METADATA, uuid)
+	} else if value != "" {
+		if err = json.Unmarshal([]byte(value), &metadata); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+	}
+	return &metadata, nil
+}
+
+// updateRecordMetadata updates the fields which are not nil, and maintains the index of labels.
+func updateRecordMetadata(
+	ctx context.Context, uuid string, title *string, labels *[]string, notes *string,
+) (*RecordMetadata, error) {
+	if ok, err := rdb.HExists(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hexists %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid)
+	} else if !ok {
+		return nil, errors.Errorf("no record for uuid=%v", uuid)
+	}
+
+	metadata, err := queryRecordMetadata(ctx, uuid)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query metadata of %v", uuid)
+	}
+
+	if title != nil {
+		metadata.Title = strings.TrimSpace(*title)
+	}
+	if notes != nil {
+		metadata.Notes = *notes
+	}
+	if labels != nil {
+		newLabels, err := normalizeRecordLabels(*labels)
+		if err != nil {
+			return nil, errors.Wrapf(err, "normalize labels")
+		}
+
+		for _, label := range metadata.Labels {
+			if !slicesContains(newLabels, label) {
+				if err := rdb.SRem(ctx, recordLabelKey(label), uuid).Err(); err != nil && err != redis.Nil {
+					return nil, errors.Wrapf(err, "srem %v %v", recordLabelKey(label), uuid)
+				}
+			}
+		}
+		for _, label := range newLabels {
+			if err := rdb.SAdd(ctx, recordLabelKey(label), uuid).Err(); err != nil && err != redis.Nil {
+				return nil, errors.Wrapf(err, "sadd %v %v", recordLabelKey(label), uuid)
+			}
+		}
+		metadata.Labels = newLabels
+	}
+
+	if b, err := json.Marshal(metadata); err != nil {
+		return nil, errors.Wrapf(err, "marshal %v", metadata.String())
+	} else if err = rdb.HSet(ctx, SRS_RECORD_METADATA, uuid, string(b)).Err(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_METADATA, uuid, string(b))
+	}
+
+	return metadata, nil
+}
+
+// removeRecordMetadata removes the user metadata of recording, and its index of labels.
+func removeRecordMetadata(ctx context.Context, uuid string) error {
+	metadata, err := queryRecordMetadata(ctx, uuid)
+	if err != nil {
+		return errors.Wrapf(err, "query metadata of %v", uuid)
+	}
+
+	for _, label := range metadata.Labels {
+		if err := rdb.SRem(ctx, recordLabelKey(label), uuid).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "srem %v %v", recordLabelKey(label), uuid)
+		}
+	}
+
+	if err := rdb.HDel(ctx, SRS_RECORD_METADATA, uuid).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SRS_RECORD_METADATA, uuid)
+	}
+	return nil
+}
+
+// queryRecordFiles returns the recordings which match the filter, in the page, and the total number of matched
+// recordings. The recordings are sorted by update time, the latest first, so the page is stable.
+func queryRecordFiles(ctx context.Context, filter *RecordFilter) ([]map[string]interface{}, int, error) {
+	var from, to time.Time
+	if filter.From != "" {
+		if t, err := time.Parse(time.RFC3339, filter.From); err != nil {
+			return nil, 0, errors.Wrapf(err, "parse from %v", filter.From)
+		} else {
+			from = t
+		}
+	}
+	if filter.To != "" {
+		if t, err := time.Parse(time.RFC3339, filter.To); err != nil {
+			return nil, 0, errors.Wrapf(err, "parse to %v", filter.To)
+		} else {
+			to = t
+		}
+	}
+	if filter.Offset < 0 || filter.Limit < 0 {
+		return nil, 0, errors.Errorf("invalid offset=%v, limit=%v", filter.Offset, filter.Limit)
+	}
+
+	// Load the recordings of label by the index, or all recordings.
+	var artifacts []string
+	if label := strings.ToLower(strings.TrimSpace(filter.Label)); label != "" {
+		uuids, err := rdb.SMembers(ctx, recordLabelKey(label)).Result()
+		if err != nil && err != redis.Nil {
+			return nil, 0, errors.Wrapf(err, "smembers %v", recordLabelKey(label))
+		}
+
+		if len(uuids) > 0 {
+			values, err := rdb.HMGet(ctx, SRS_RECORD_M3U8_ARTIFACT, uuids...).Result()
+			if err != nil && err != redis.Nil {
+				return nil, 0, errors.Wrapf(err, "hmget %v %v", SRS_RECORD_M3U8_ARTIFACT, uuids)
+			}
+			for _, value := range values {
+				if value, ok := value.(string); ok && value != "" {
+					artifacts = append(artifacts, value)
+				}
+			}
+		}
+	} else {
+		values, err := rdb.HGetAll(ctx, SRS_RECORD_M3U8_ARTIFACT).Result()
+		if err != nil && err != redis.Nil {
+			return nil, 0, errors.Wrapf(err, "hgetall %v", SRS_RECORD_M3U8_ARTIFACT)
+		}
+		for _, value := range values {
+			artifacts = append(artifacts, value)
+		}
+	}
+
+	metadatas, err := rdb.HGetAll(ctx, SRS_RECORD_METADATA).Result()
+	if err != nil && err != redis.Nil {
+		return nil, 0, errors.Wrapf(err, "hgetall %v", SRS_RECORD_METADATA)
+	}
+
+	type recordFile struct {
+		update time.Time
+		file   map[string]interface{}
+	}
+	var matched []*recordFile
+	for _, value := range artifacts {
+		var artifact M3u8VoDArtifact
+		if err := json.Unmarshal([]byte(value), &artifact); err != nil {
+			return nil, 0, errors.Wrapf(err, "json parse %v", value)
+		}
+
+		var duration float64
+		var size uint64
+		for _, file := range artifact.Files {
+			duration += file.Duration
+			size += file.Size
+		}
+
+		update, _ := time.Parse(time.RFC3339, artifact.Update)
+		if filter.Stream != "" && !strings.Contains(strings.ToLower(artifact.Stream), strings.ToLower(filter.Stream)) {
+			continue
+		}
+		if (!from.IsZero() && update.Before(from)) || (!to.IsZero() && update.After(to)) {
+			continue
+		}
+		if (filter.MinDuration > 0 && duration < filter.MinDuration) ||
+			(filter.MaxDuration > 0 && duration > filter.MaxDuration) {
+			continue
+		}
+
+		var metadata RecordMetadata
+		if value := metadatas[artifact.UUID]; value != "" {
+			if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+				return nil, 0, errors.Wrapf(err, "json parse %v", value)
+			}
+		}
+
+		matched = append(matched, &recordFile{update: update, file: map[string]interface{}{
+			"uuid":      artifact.UUID,
+			"vhost":     artifact.Vhost,
+			"app":       artifact.App,
+			"stream":    artifact.Stream,
+			"progress":  artifact.Processing,
+			"update":    artifact.Update,
+			"nn":        len(artifact.Files),
+			"duration":  duration,
+			"size":      size,
+			"playback":  artifact.PlaybackURL,
+			"name":      artifact.Name,
+			"source":    artifact.Source,
+			"title":     metadata.Title,
+			"labels":    metadata.Labels,
+			"notes":     metadata.Notes,
+			"checksums": artifact.Checksums,
+		}})
+	}
+
+	sort.Slice(matched, func(i, j int) bool {
+		if !matched[i].update.Equal(matched[j].update) {
+			return matched[i].update.After(matched[j].update)
+		}
+		return matched[i].file["uuid"].(string) < matched[j].file["uuid"].(string)
+	})
+
+	start, end := filter.Offset, len(matched)
+	if start > end {
+		start = end
+	}
+	if limit := filter.Limit; limit > 0 {
+		if limit > recordMaxPageLimit {
+			limit = recordMaxPageLimit
+		}
+		if start+limit < end {
+			end = start + limit
+		}
+	}
+
+	files := []map[string]interface{}{}
+	for _, r := range matched[start:end] {
+		files = append(files, r.file)
+	}
+	return files, len(matched), nil
+}
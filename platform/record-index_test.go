@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestRecordIndex_CombinedFilters(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	for i, r := range []struct {
+		uuid, stream, update string
+		duration             float64
+	}{
+		{"r0", "livestream", "2024-01-01T10:00:00Z", 30},
+		{"r1", "livestream", "2024-01-02T10:00:00Z", 300},
+		{"r2", "LiveStream2", "2024-01-03T10:00:00Z", 600},
+		{"r3", "other", "2024-01-04T10:00:00Z", 600},
+	} {
+		server.HSet(SRS_RECORD_M3U8_ARTIFACT, r.uuid, fmt.Sprintf(
+			`{"uuid":"%v","stream":"%v","update":"%v","files":[{"duration":%v,"size":%v}]}`,
+			r.uuid, r.stream, r.update, r.duration, i,
+		))
+	}
+
+	labels := []string{" Sports ", "sports", "Final"}
+	if _, err := updateRecordMetadata(ctx, "r1", nil, &labels, nil); err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	title, labels2 := "Match", []string{"sports"}
+	if _, err := updateRecordMetadata(ctx, "r2", &title, &labels2, nil); err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	labels3 := []string{"sports"}
+	if _, err := updateRecordMetadata(ctx, "r3", nil, &labels3, nil); err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	if _, err := updateRecordMetadata(ctx, "not-exists", &title, nil, nil); err == nil {
+		t.Errorf("Fail for should reject recording not exists")
+	}
+
+	// Only update the notes, the title and labels are kept.
+	notes := "Good game"
+	if metadata, err := updateRecordMetadata(ctx, "r2", nil, nil, &notes); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	} else if metadata.Title != "Match" || len(metadata.Labels) != 1 || metadata.Notes != notes {
+		t.Errorf("Fail for metadata %v", metadata.String())
+	}
+
+	uuidsOf := func(filter *RecordFilter) ([]string, int) {
+		files, total, err := queryRecordFiles(ctx, filter)
+		if err != nil {
+			t.Errorf("Fail for err %+v", err)
+			return nil, 0
+		}
+		var uuids []string
+		for _, file := range files {
+			uuids = append(uuids, file["uuid"].(string))
+		}
+		return uuids, total
+	}
+
+	for _, c := range []struct {
+		filter *RecordFilter
+		expect string
+		total  int
+	}{
+		{&RecordFilter{}, "[r3 r2 r1 r0]", 4},
+		{&RecordFilter{Stream: "livestream"}, "[r2 r1 r0]", 3},
+		{&RecordFilter{Label: "SPORTS"}, "[r3 r2 r1]", 3},
+		{&RecordFilter{Label: "sports", Stream: "live", MinDuration: 400}, "[r2]", 1},
+		{&RecordFilter{Label: "sports", From: "2024-01-02T00:00:00Z", To: "2024-01-03T23:59:59Z", MaxDuration: 300}, "[r1]", 1},
+		{&RecordFilter{Label: "final", Stream: "other"}, "[]", 0},
+		{&RecordFilter{Label: "none"}, "[]", 0},
+		{&RecordFilter{Stream: "live", Offset: 1, Limit: 1}, "[r1]", 3},
+		{&RecordFilter{Stream: "live", Offset: 5, Limit: 1}, "[]", 3},
+	} {
+		if uuids, total := uuidsOf(c.filter); fmt.Sprint(uuids) != c.expect || total != c.total {
+			t.Errorf("Fail for %v, uuids=%v, total=%v, expect %v %v", c.filter.String(), uuids, total, c.expect, c.total)
+		}
+	}
+
+	if _, _, err := queryRecordFiles(ctx, &RecordFilter{From: "yesterday"}); err == nil {
+		t.Errorf("Fail for should reject invalid from")
+	}
+
+	// Removing the recording should clean the index of labels.
+	if err := removeRecordArtifact(ctx, &M3u8VoDArtifact{UUID: "r2"}); err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	if uuids, total := uuidsOf(&RecordFilter{Label: "sports"}); fmt.Sprint(uuids) != "[r3 r1]" || total != 2 {
+		t.Errorf("Fail for uuids=%v, total=%v", uuids, total)
+	}
+	if _, ok := server.HGet(SRS_RECORD_METADATA, "r2"); ok {
+		t.Errorf("Fail for metadata of r2 not removed")
+	}
+
+	// Removing the label should clean the index.
+	var empty []string
+	if _, err := updateRecordMetadata(ctx, "r1", nil, &empty, nil); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if uuids, _ := uuidsOf(&RecordFilter{Label: "final"}); len(uuids) != 0 {
+		t.Errorf("Fail for uuids=%v", uuids)
+	}
+}
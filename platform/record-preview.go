@@ -0,0 +1,408 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The interval to generate the previews of the finished records.
+const recordPreviewSweepInterval = 10 * time.Second
+
+// The default interval between thumbnails, and the default max number of ffmpeg to generate previews.
+const (
+	recordPreviewDefaultInterval    = 10 * time.Second
+	recordPreviewDefaultConcurrency = 2
+)
+
+// The size of each thumbnail, and the grid of thumbnails in each sprite sheet.
+const (
+	recordPreviewWidth   = 160
+	recordPreviewHeight  = 90
+	recordPreviewColumns = 10
+	recordPreviewRows    = 10
+)
+
+// The name of WebVTT file, and the sprite sheets such as sprite-1.jpg, in the preview directory of record.
+const recordPreviewThumbnails = "thumbnails.vtt"
+
+var recordPreviewFilePattern = regexp.MustCompile(`^(sprite-\d+\.jpg|thumbnails\.vtt)$`)
+
+// errRecordPreviewAudioOnly is the error when there is no video to generate the preview, which is not a failure.
+var errRecordPreviewAudioOnly = errors.New("audio only")
+
+// RecordPreview is the thumbnail sprite sheets of a record, and the WebVTT file mapping the times to the thumbnails,
+// for the player to preview when seeking.
+type RecordPreview struct {
+	// The interval in seconds between thumbnails.
+	Interval int `json:"interval"`
+	// The size of each thumbnail.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	// The URL of WebVTT file.
+	Thumbnails string `json:"thumbnails"`
+	// The URLs of sprite sheets.
+	Sprites []string `json:"sprites"`
+	// The time generated, in RFC3339.
+	Update string `json:"update"`
+}
+
+func (v *RecordPreview) String() string {
+	return fmt.Sprintf("interval=%v, size=%vx%v, thumbnails=%v, sprites=%v",
+		v.Interval, v.Width, v.Height, v.Thumbnails, len(v.Sprites),
+	)
+}
+
+// recordPreviewURL returns the URL of preview file of record, served by the record hls handler.
+func recordPreviewURL(uuid, filename string) string {
+	return fmt.Sprintf("/terraform/v1/hooks/record/hls/%v/preview/%v", uuid, filename)
+}
+
+// parseRecordPreviewInterval parse the interval between thumbnails, such as 10s, at least 1s.
+func parseRecordPreviewInterval(v string) (time.Duration, error) {
+	if v == "" {
+		return recordPreviewDefaultInterval, nil
+	}
+
+	interval, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse %v", v)
+	}
+	if interval < time.Second {
+		return 0, errors.Errorf("interval %v should not less than 1s", interval)
+	}
+	return interval, nil
+}
+
+// parseRecordPreviewConcurrency parse the max number of ffmpeg to generate previews, at least 1.
+func parseRecordPreviewConcurrency(v string) (int, error) {
+	if v == "" {
+		return recordPreviewDefaultConcurrency, nil
+	}
+
+	concurrency, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse %v", v)
+	}
+	if concurrency < 1 {
+		return 0, errors.Errorf("concurrency %v should not less than 1", concurrency)
+	}
+	return concurrency, nil
+}
+
+// enqueueRecordPreview queues the finished record, to generate the preview by the worker.
+func enqueueRecordPreview(ctx context.Context, uuid string) error {
+	update := time.Now().Format(time.RFC3339)
+	if err := rdb.HSet(ctx, SRS_RECORD_PREVIEW, uuid, update).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_PREVIEW, uuid, update)
+	}
+	logger.Tf(ctx, "record preview enqueue ok, uuid=%v", uuid)
+	return nil
+}
+
+// previewRecords generates the previews of the queued records, at most concurrency at the same time. The failed one
+// is marked by the previewError of artifact and never retried, so it never blocks the others.
+func previewRecords(ctx context.Context, concurrency int,
+	generate func(ctx context.Context, artifact *M3u8VoDArtifact) (*RecordPreview, error),
+) error {
+	queue, err := rdb.HGetAll(ctx, SRS_RECORD_PREVIEW).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_RECORD_PREVIEW)
+	}
+
+	uuids := make([]string, 0, len(queue))
+	for uuid := range queue {
+		uuids = append(uuids, uuid)
+	}
+	sort.Slice(uuids, func(i, j int) bool {
+		if queue[uuids[i]] != queue[uuids[j]] {
+			return queue[uuids[i]] < queue[uuids[j]]
+		}
+		return uuids[i] < uuids[j]
+	})
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	semaphore := make(chan bool, concurrency)
+	for _, uuid := range uuids {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case semaphore <- true:
+		}
+
+		wg.Add(1)
+		go func(uuid string) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			if err := previewRecord(ctx, uuid, generate); err != nil {
+				logger.Wf(ctx, "record preview ignore uuid=%v, err %+v", uuid, err)
+			}
+		}(uuid)
+	}
+	return nil
+}
+
+func previewRecord(ctx context.Context, uuid string,
+	generate func(ctx context.Context, artifact *M3u8VoDArtifact) (*RecordPreview, error),
+) error {
+	artifact, err := queryRecordPreviewArtifact(ctx, uuid)
+	if err != nil {
+		return errors.Wrapf(err, "query artifact")
+	}
+
+	// Generate the preview, unless the record is removed.
+	var preview *RecordPreview
+	var r0 error
+	if artifact != nil {
+		preview, r0 = generate(ctx, artifact)
+	}
+
+	// Retry later if interrupted, for example, the server is shutting down.
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Update the artifact, which might be changed by others while generating, for example, exported to VOD.
+	if artifact, err := queryRecordPreviewArtifact(ctx, uuid); err != nil {
+		return errors.Wrapf(err, "query artifact")
+	} else if artifact != nil && r0 != errRecordPreviewAudioOnly {
+		artifact.Preview, artifact.PreviewError = preview, ""
+		if r0 != nil {
+			artifact.PreviewError = r0.Error()
+		}
+
+		if b, err := json.Marshal(artifact); err != nil {
+			return errors.Wrapf(err, "marshal %v", artifact.String())
+		} else if err := rdb.HSet(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid, string(b)).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid, string(b))
+		}
+	}
+
+	if err := rdb.HDel(ctx, SRS_RECORD_PREVIEW, uuid).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v %v", SRS_RECORD_PREVIEW, uuid)
+	}
+
+	if r0 == errRecordPreviewAudioOnly {
+		logger.Tf(ctx, "record preview ignore audio only, uuid=%v", uuid)
+	} else if r0 != nil {
+		logger.Wf(ctx, "record preview failed, uuid=%v, err %+v", uuid, r0)
+	} else if preview != nil {
+		logger.Tf(ctx, "record preview ok, uuid=%v, %v", uuid, preview.String())
+	}
+	return nil
+}
+
+// queryRecordPreviewArtifact returns the artifact of record, or nil if removed.
+func queryRecordPreviewArtifact(ctx context.Context, uuid string) (*M3u8VoDArtifact, error) {
+	value, err := rdb.HGet(ctx, SRS_RECORD_M3U8_ARTIFACT, uuid).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_RECORD_M3U8_ARTIFACT, uuid)
+	} else if value == "" {
+		return nil, nil
+	}
+
+	var artifact M3u8VoDArtifact
+	if err := json.Unmarshal([]byte(value), &artifact); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", value)
+	}
+	return &artifact, nil
+}
+
+// generateRecordPreview uses ffmpeg to tile a thumbnail every interval into sprite sheets, writes the WebVTT file,
+// then puts them to the storage driver which the record is archived to.
+func generateRecordPreview(ctx context.Context, artifact *M3u8VoDArtifact, interval time.Duration) (*RecordPreview, error) {
+	// Use the MP4 if there is, or the HLS VoD for example, only archive the HLS.
+	input := path.Join(localStorage.Root, "record", artifact.UUID, "index.mp4")
+	if _, err := os.Stat(input); err != nil {
+		input = path.Join(localStorage.Root, "record", artifact.UUID, "index.m3u8")
+	}
+	if _, err := os.Stat(input); err != nil {
+		return nil, errors.Wrapf(err, "no mp4 or m3u8 of %v", artifact.UUID)
+	}
+
+	format, video, _, err := FFprobeFileFormat(ctx, input)
+	if err != nil {
+		return nil, errors.Wrapf(err, "probe %v", input)
+	} else if video == nil {
+		return nil, errRecordPreviewAudioOnly
+	}
+
+	dir := path.Join(localStorage.Root, "record", artifact.UUID, "preview")
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, errors.Wrapf(err, "remove %v", dir)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrapf(err, "mkdir %v", dir)
+	}
+
+	filter := fmt.Sprintf("fps=1/%v,scale=%v:%v:force_original_aspect_ratio=decrease,pad=%v:%v:(ow-iw)/2:(oh-ih)/2,tile=%vx%v",
+		int(interval/time.Second), recordPreviewWidth, recordPreviewHeight, recordPreviewWidth, recordPreviewHeight,
+		recordPreviewColumns, recordPreviewRows,
+	)
+	args := []string{
+		"-i", input, "-an", "-vf", filter, "-q:v", "5", "-y", path.Join(dir, "sprite-%d.jpg"),
+	}
+	if b, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+		return nil, errors.Wrapf(err, "ffmpeg %v, %v", strings.Join(args, " "), string(b))
+	}
+
+	var sprites int
+	for sprites = 0; ; sprites++ {
+		if _, err := os.Stat(path.Join(dir, fmt.Sprintf("sprite-%v.jpg", sprites+1))); err != nil {
+			break
+		}
+	}
+	if sprites == 0 {
+		return nil, errors.Errorf("no sprite by ffmpeg %v", strings.Join(args, " "))
+	}
+
+	// Clamp the thumbnails to the sprites, in case the duration is not accurate.
+	thumbnails := buildRecordPreviewThumbnails(format.Duration, interval, sprites)
+	if err := os.WriteFile(path.Join(dir, recordPreviewThumbnails), []byte(thumbnails), 0644); err != nil {
+		return nil, errors.Wrapf(err, "write %v", recordPreviewThumbnails)
+	}
+
+	preview := &RecordPreview{
+		Interval: int(interval / time.Second), Width: recordPreviewWidth, Height: recordPreviewHeight,
+		Thumbnails: recordPreviewURL(artifact.UUID, recordPreviewThumbnails),
+		Update:     time.Now().Format(time.RFC3339),
+	}
+	for i := 1; i <= sprites; i++ {
+		preview.Sprites = append(preview.Sprites, recordPreviewURL(artifact.UUID, fmt.Sprintf("sprite-%v.jpg", i)))
+	}
+
+	if err := archiveRecordPreview(ctx, artifact); err != nil {
+		return nil, errors.Wrapf(err, "archive")
+	}
+	return preview, nil
+}
+
+// buildRecordPreviewThumbnails returns the WebVTT which maps each interval of duration to the thumbnail in sprites,
+// the URL is relative to the WebVTT file, such as sprite-1.jpg#xywh=160,0,160,90
+func buildRecordPreviewThumbnails(duration float64, interval time.Duration, sprites int) string {
+	formatTime := func(t float64) string {
+		ms := int64(t * 1000)
+		return fmt.Sprintf("%02d:%02d:%02d.%03d", ms/3600000, ms/60000%60, ms/1000%60, ms%1000)
+	}
+
+	var b bytes.Buffer
+	b.WriteString("WEBVTT\n")
+
+	step, perSprite := interval.Seconds(), recordPreviewColumns*recordPreviewRows
+	for i := 0; i < sprites*perSprite && float64(i)*step < duration; i++ {
+		start, end := float64(i)*step, float64(i+1)*step
+		if end > duration {
+			end = duration
+		}
+
+		x := (i % recordPreviewColumns) * recordPreviewWidth
+		y := (i % perSprite / recordPreviewColumns) * recordPreviewHeight
+		b.WriteString(fmt.Sprintf("\n%v --> %v\nsprite-%v.jpg#xywh=%v,%v,%v,%v\n",
+			formatTime(start), formatTime(end), i/perSprite+1, x, y, recordPreviewWidth, recordPreviewHeight,
+		))
+	}
+	return b.String()
+}
+
+// archiveRecordPreview puts the preview files to the storage driver which the record is archived to, because the
+// record is archived before the preview is generated.
+func archiveRecordPreview(ctx context.Context, artifact *M3u8VoDArtifact) error {
+	if artifact.Storage == "" || artifact.Storage == StorageDriverLocal {
+		return nil
+	}
+
+	driver, err := queryStorageDriverByName(ctx, artifact.Storage)
+	if err != nil {
+		return errors.Wrapf(err, "query driver %v", artifact.Storage)
+	}
+
+	objects, err := localStorage.List(ctx, fmt.Sprintf("record/%v/preview/", artifact.UUID))
+	if err != nil {
+		return errors.Wrapf(err, "list preview %v", artifact.UUID)
+	}
+
+	for _, object := range objects {
+		if err := func() error {
+			f, err := localStorage.Get(ctx, object.Key)
+			if err != nil {
+				return errors.Wrapf(err, "get %v", object.Key)
+			}
+			defer f.Close()
+
+			if err := driver.Put(ctx, object.Key, f, object.Size); err != nil {
+				return errors.Wrapf(err, "put %v to %v", object.Key, driver.Name())
+			}
+			return nil
+		}(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveRecordPreview serves the preview file of record, from local disk or the storage driver it's archived to. The
+// format of filename is :uuid/preview/:file, for example, :uuid/preview/thumbnails.vtt
+func serveRecordPreview(ctx context.Context, w http.ResponseWriter, filename string) error {
+	uuid, base := path.Dir(path.Dir(filename)), path.Base(filename)
+	if uuid == "" || uuid == "." || uuid == ".." || strings.Contains(uuid, "/") || path.Base(path.Dir(filename)) != "preview" {
+		return errors.Errorf("invalid preview %v", filename)
+	}
+	if !recordPreviewFilePattern.MatchString(base) {
+		return errors.Errorf("invalid preview file %v of %v", base, filename)
+	}
+
+	key := path.Join("record", uuid, "preview", base)
+	f, err := localStorage.Get(ctx, key)
+	if err != nil {
+		artifact, r0 := queryRecordPreviewArtifact(ctx, uuid)
+		if r0 != nil {
+			return errors.Wrapf(r0, "query artifact of %v", uuid)
+		} else if artifact == nil || artifact.Storage == "" || artifact.Storage == StorageDriverLocal {
+			return errors.Wrapf(err, "no preview %v", key)
+		}
+
+		driver, err := queryStorageDriverByName(ctx, artifact.Storage)
+		if err != nil {
+			return errors.Wrapf(err, "query driver %v", artifact.Storage)
+		}
+		if f, err = driver.Get(ctx, key); err != nil {
+			return errors.Wrapf(err, "get %v of %v", key, driver.Name())
+		}
+	}
+	defer f.Close()
+
+	if path.Ext(base) == ".vtt" {
+		w.Header().Set("Content-Type", "text/vtt")
+	} else {
+		w.Header().Set("Content-Type", "image/jpeg")
+	}
+	io.Copy(w, f)
+
+	logger.Tf(ctx, "record serve preview ok, uuid=%v, file=%v", uuid, base)
+	return nil
+}
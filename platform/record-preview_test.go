@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestRecordPreview_Thumbnails(t *testing.T) {
+	vtt := buildRecordPreviewThumbnails(25, 10*time.Second, 1)
+	if !strings.HasPrefix(vtt, "WEBVTT\n") || strings.Count(vtt, " --> ") != 3 ||
+		!strings.Contains(vtt, "00:00:10.000 --> 00:00:20.000\nsprite-1.jpg#xywh=160,0,160,90\n") ||
+		!strings.Contains(vtt, "00:00:20.000 --> 00:00:25.000\n") {
+		t.Errorf("Fail for vtt %v", vtt)
+	}
+
+	// The 11th thumbnail is in the second row, and the 101st is in the next sprite.
+	vtt = buildRecordPreviewThumbnails(1010, 10*time.Second, 2)
+	if strings.Count(vtt, " --> ") != 101 || !strings.Contains(vtt, "sprite-1.jpg#xywh=0,90,160,90\n") ||
+		!strings.Contains(vtt, "00:16:40.000 --> 00:16:50.000\nsprite-2.jpg#xywh=0,0,160,90\n") {
+		t.Errorf("Fail for vtt %v", vtt)
+	}
+
+	// Never refer to the sprites not generated.
+	if vtt = buildRecordPreviewThumbnails(3600, 10*time.Second, 1); strings.Count(vtt, " --> ") != 100 ||
+		strings.Contains(vtt, "sprite-2.jpg") {
+		t.Errorf("Fail for vtt %v", vtt)
+	}
+
+	for v, expect := range map[string]time.Duration{"": 10 * time.Second, "5s": 5 * time.Second, "1m": time.Minute} {
+		if interval, err := parseRecordPreviewInterval(v); err != nil || interval != expect {
+			t.Errorf("Fail for %v, interval=%v, err %+v", v, interval, err)
+		}
+	}
+	for _, v := range []string{"500ms", "-1s", "abc"} {
+		if _, err := parseRecordPreviewInterval(v); err == nil {
+			t.Errorf("Fail for %v", v)
+		}
+	}
+	if _, err := parseRecordPreviewConcurrency("0"); err == nil {
+		t.Errorf("Fail for concurrency 0")
+	}
+}
+
+func TestRecordPreview_Worker(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	dir, err := ioutil.TempDir("", "record-preview")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldStorage := localStorage
+	localStorage = NewLocalStorage(dir)
+	defer func() {
+		localStorage = oldStorage
+	}()
+
+	for _, uuid := range []string{"a", "b", "c", "d", "e"} {
+		if uuid != "e" {
+			b, _ := json.Marshal(&M3u8VoDArtifact{UUID: uuid})
+			server.HSet(SRS_RECORD_M3U8_ARTIFACT, uuid, string(b))
+		}
+		if err := enqueueRecordPreview(ctx, uuid); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+	}
+
+	// The failed or audio only record never blocks others, and the removed one is ignored.
+	var lock sync.Mutex
+	var running, maxRunning, calls int
+	generate := func(ctx context.Context, artifact *M3u8VoDArtifact) (*RecordPreview, error) {
+		lock.Lock()
+		running, calls = running+1, calls+1
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+
+		time.Sleep(30 * time.Millisecond)
+
+		lock.Lock()
+		running--
+		lock.Unlock()
+
+		switch artifact.UUID {
+		case "b":
+			return nil, errors.New("mock ffmpeg failed")
+		case "c":
+			return nil, errRecordPreviewAudioOnly
+		}
+		return &RecordPreview{Thumbnails: recordPreviewURL(artifact.UUID, recordPreviewThumbnails)}, nil
+	}
+	if err := previewRecords(ctx, 2, generate); err != nil || calls != 4 || maxRunning != 2 {
+		t.Errorf("Fail for calls=%v, max=%v, err %+v", calls, maxRunning, err)
+	}
+
+	for uuid, expect := range map[string][2]bool{"a": {true, false}, "b": {false, true}, "c": {false, false}, "d": {true, false}} {
+		artifact, err := queryRecordPreviewArtifact(ctx, uuid)
+		if err != nil || artifact == nil || (artifact.Preview != nil) != expect[0] || (artifact.PreviewError != "") != expect[1] {
+			t.Errorf("Fail for %v, artifact=%v, err %+v", uuid, artifact, err)
+		}
+	}
+	if artifact, err := queryRecordPreviewArtifact(ctx, "e"); err != nil || artifact != nil {
+		t.Errorf("Fail for artifact=%v, err %+v", artifact, err)
+	}
+	if queue, err := rdb.HGetAll(ctx, SRS_RECORD_PREVIEW).Result(); err != nil || len(queue) != 0 {
+		t.Errorf("Fail for queue=%v, err %+v", queue, err)
+	}
+
+	// Serve the preview files of record, only the sprites and WebVTT.
+	vtt := buildRecordPreviewThumbnails(25, 10*time.Second, 1)
+	if err := localStorage.Put(ctx, "record/a/preview/thumbnails.vtt", strings.NewReader(vtt), int64(len(vtt))); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	w := httptest.NewRecorder()
+	if err := serveRecordPreview(ctx, w, "a/preview/thumbnails.vtt"); err != nil ||
+		w.Header().Get("Content-Type") != "text/vtt" || w.Body.String() != vtt {
+		t.Errorf("Fail for body=%v, err %+v", w.Body.String(), err)
+	}
+	for _, filename := range []string{
+		"a/preview/sprite-1.jpg", "a/preview/index.mp4", "a/thumbnails.vtt", "a/b/preview/thumbnails.vtt",
+		"../preview/thumbnails.vtt",
+	} {
+		if err := serveRecordPreview(ctx, httptest.NewRecorder(), filename); err == nil {
+			t.Errorf("Fail for %v", filename)
+		}
+	}
+}
@@ -0,0 +1,554 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max number of deletions in retention audit log.
+const recordRetentionMaxAudits = 1000
+
+// The key of global retention, which applies to the recordings without any policy.
+const recordRetentionGlobal = "global"
+
+type RecordRetentionMode string
+
+const (
+	// Keep the recordings forever.
+	RecordRetentionForever RecordRetentionMode = "forever"
+	// Keep the recordings for N days.
+	RecordRetentionDays RecordRetentionMode = "days"
+	// Keep the last N recordings.
+	RecordRetentionLast RecordRetentionMode = "last"
+)
+
+// RecordRetentionPolicy is the retention of recordings of a stream or a label, which overwrites the global retention.
+// It's stored in SRS_RECORD_RETENTION, the field is the key of policy.
+type RecordRetentionPolicy struct {
+	// The stream URL such as live/livestream, or the label of recordings, only one of them is set.
+	Stream string `json:"stream,omitempty"`
+	Label  string `json:"label,omitempty"`
+	// The mode of policy.
+	Mode RecordRetentionMode `json:"mode"`
+	// The days to keep for days mode, or the number of recordings to keep for last mode.
+	Value int `json:"value,omitempty"`
+	// The update time of policy.
+	Update string `json:"update,omitempty"`
+}
+
+func (v *RecordRetentionPolicy) String() string {
+	return fmt.Sprintf("key=%v, mode=%v, value=%v, update=%v", v.Key(), v.Mode, v.Value, v.Update)
+}
+
+// Key returns the identity of policy, such as stream:live/livestream or label:show.
+func (v *RecordRetentionPolicy) Key() string {
+	if v.Stream != "" {
+		return fmt.Sprintf("stream:%v", v.Stream)
+	} else if v.Label != "" {
+		return fmt.Sprintf("label:%v", v.Label)
+	}
+	return recordRetentionGlobal
+}
+
+// Validate checks the policy and normalizes the label.
+func (v *RecordRetentionPolicy) Validate() error {
+	v.Stream = strings.Trim(strings.TrimSpace(v.Stream), "/")
+	if v.Label != "" {
+		if labels, err := normalizeRecordLabels([]string{v.Label}); err != nil {
+			return errors.Wrapf(err, "normalize label %v", v.Label)
+		} else if len(labels) == 1 {
+			v.Label = labels[0]
+		} else {
+			v.Label = ""
+		}
+	}
+
+	if v.Stream == "" && v.Label == "" {
+		return errors.New("no stream or label")
+	}
+	if v.Stream != "" && v.Label != "" {
+		return errors.Errorf("both stream %v and label %v", v.Stream, v.Label)
+	}
+
+	switch v.Mode {
+	case RecordRetentionForever:
+		v.Value = 0
+	case RecordRetentionDays, RecordRetentionLast:
+		if v.Value <= 0 {
+			return errors.Errorf("invalid value %v for mode %v", v.Value, v.Mode)
+		}
+	default:
+		return errors.Errorf("invalid mode %v", v.Mode)
+	}
+	return nil
+}
+
+// RecordRetentionAction is a recording to be removed by retention, or has been removed by the janitor.
+type RecordRetentionAction struct {
+	// The time of deletion, or the time of dry-run.
+	Time string `json:"time"`
+	// The UUID of recording.
+	UUID string `json:"uuid"`
+	// The stream URL of recording, such as live/livestream.
+	Stream string `json:"stream"`
+	// The done time of recording.
+	Done string `json:"done"`
+	// The key of policy which triggers the deletion, such as stream:live/livestream or global.
+	Policy string `json:"policy"`
+	// The reason of deletion, such as older than 7d.
+	Reason string `json:"reason"`
+}
+
+func (v *RecordRetentionAction) String() string {
+	return fmt.Sprintf("uuid=%v, stream=%v, done=%v, policy=%v, reason=%v",
+		v.UUID, v.Stream, v.Done, v.Policy, v.Reason,
+	)
+}
+
+// queryRecordRetentionPolicies returns the policies of streams and labels, sorted by key.
+func queryRecordRetentionPolicies(ctx context.Context) ([]*RecordRetentionPolicy, error) {
+	values, err := rdb.HGetAll(ctx, SRS_RECORD_RETENTION).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_RECORD_RETENTION)
+	}
+
+	policies := make([]*RecordRetentionPolicy, 0, len(values))
+	for key, value := range values {
+		var policy RecordRetentionPolicy
+		if err := json.Unmarshal([]byte(value), &policy); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", key, value)
+		}
+		policies = append(policies, &policy)
+	}
+
+	sort.Slice(policies, func(i, j int) bool {
+		return policies[i].Key() < policies[j].Key()
+	})
+	return policies, nil
+}
+
+// planRecordRetention returns the recordings to remove at now. The policy of stream is evaluated first, then the
+// policies of labels, in which keep-forever wins, otherwise the first label in order. The global retention only
+// applies to the recordings without any policy.
+func planRecordRetention(ctx context.Context, now time.Time) ([]*RecordRetentionAction, error) {
+	policies, err := queryRecordRetentionPolicies(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query policies")
+	}
+
+	policyByKey := make(map[string]*RecordRetentionPolicy)
+	for _, policy := range policies {
+		policyByKey[policy.Key()] = policy
+	}
+
+	retention, err := rdb.HGet(ctx, SRS_RECORD_PATTERNS, "retention").Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v retention", SRS_RECORD_PATTERNS)
+	}
+	if days, _ := strconv.Atoi(retention); days > 0 {
+		policyByKey[recordRetentionGlobal] = &RecordRetentionPolicy{Mode: RecordRetentionDays, Value: days}
+	}
+
+	objs, err := rdb.HGetAll(ctx, SRS_RECORD_M3U8_ARTIFACT).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_RECORD_M3U8_ARTIFACT)
+	}
+
+	metadatas, err := rdb.HGetAll(ctx, SRS_RECORD_METADATA).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_RECORD_METADATA)
+	}
+
+	// Match the policy of each finished recording.
+	type recordItem struct {
+		artifact *M3u8VoDArtifact
+		done     string
+		t        time.Time
+	}
+	groups := make(map[string][]*recordItem)
+	for uuid, obj := range objs {
+		var artifact M3u8VoDArtifact
+		if err := json.Unmarshal([]byte(obj), &artifact); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", uuid, obj)
+		}
+
+		if artifact.Processing {
+			continue
+		}
+
+		var labels []string
+		if value := metadatas[uuid]; value != "" {
+			var metadata RecordMetadata
+			if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+				return nil, errors.Wrapf(err, "unmarshal %v %v", uuid, value)
+			}
+			labels = metadata.Labels
+		}
+
+		key := matchRecordRetentionPolicy(policyByKey, recordStreamURL(&artifact), labels)
+		if key == "" {
+			continue
+		}
+
+		item := &recordItem{artifact: &artifact, done: artifact.Done}
+		if item.done == "" {
+			item.done = artifact.Update
+		}
+		item.t, _ = time.Parse(time.RFC3339, item.done)
+		groups[key] = append(groups[key], item)
+	}
+
+	var actions []*RecordRetentionAction
+	for key, items := range groups {
+		policy := policyByKey[key]
+
+		// Sort by the newest first, so we keep the first N recordings.
+		sort.Slice(items, func(i, j int) bool {
+			if !items[i].t.Equal(items[j].t) {
+				return items[i].t.After(items[j].t)
+			}
+			return items[i].artifact.UUID < items[j].artifact.UUID
+		})
+
+		deadline := now.Add(-time.Duration(policy.Value) * 24 * time.Hour)
+		for index, item := range items {
+			var reason string
+			switch policy.Mode {
+			case RecordRetentionDays:
+				// Ignore the recording without valid time, like the previous janitor.
+				if !item.t.IsZero() && item.t.Before(deadline) {
+					reason = fmt.Sprintf("older than %vd", policy.Value)
+				}
+			case RecordRetentionLast:
+				if index >= policy.Value {
+					reason = fmt.Sprintf("exceeds last %v", policy.Value)
+				}
+			}
+			if reason == "" {
+				continue
+			}
+
+			actions = append(actions, &RecordRetentionAction{
+				Time: now.Format(time.RFC3339), UUID: item.artifact.UUID,
+				Stream: recordStreamURL(item.artifact), Done: item.done, Policy: key, Reason: reason,
+			})
+		}
+	}
+
+	// The oldest recordings are removed first.
+	sort.Slice(actions, func(i, j int) bool {
+		if actions[i].Done != actions[j].Done {
+			return actions[i].Done < actions[j].Done
+		}
+		return actions[i].UUID < actions[j].UUID
+	})
+	return actions, nil
+}
+
+// matchRecordRetentionPolicy returns the key of policy for the recording, or empty if no policy.
+func matchRecordRetentionPolicy(policies map[string]*RecordRetentionPolicy, stream string, labels []string) string {
+	if key := (&RecordRetentionPolicy{Stream: stream}).Key(); policies[key] != nil {
+		return key
+	}
+
+	var matched string
+	for _, label := range labels {
+		key := (&RecordRetentionPolicy{Label: label}).Key()
+		if policy := policies[key]; policy == nil {
+			continue
+		} else if policy.Mode == RecordRetentionForever {
+			return key
+		} else if matched == "" {
+			matched = key
+		}
+	}
+	if matched != "" {
+		return matched
+	}
+
+	if policies[recordRetentionGlobal] != nil {
+		return recordRetentionGlobal
+	}
+	return ""
+}
+
+func recordStreamURL(artifact *M3u8VoDArtifact) string {
+	return fmt.Sprintf("%v/%v", artifact.App, artifact.Stream)
+}
+
+// removeExpiredRecords removes the finished records by the retention policies, both MP4 and HLS VoD. Each deletion is
+// recorded in the retention audit log.
+func removeExpiredRecords(ctx context.Context) error {
+	actions, err := planRecordRetention(ctx, time.Now())
+	if err != nil {
+		return errors.Wrapf(err, "plan retention")
+	}
+
+	for _, action := range actions {
+		var artifact M3u8VoDArtifact
+		if obj, err := rdb.HGet(ctx, SRS_RECORD_M3U8_ARTIFACT, action.UUID).Result(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hget %v %v", SRS_RECORD_M3U8_ARTIFACT, action.UUID)
+		} else if obj == "" {
+			continue
+		} else if err = json.Unmarshal([]byte(obj), &artifact); err != nil {
+			return errors.Wrapf(err, "unmarshal %v %v", action.UUID, obj)
+		}
+
+		if err := removeRecordArtifact(ctx, &artifact); err != nil {
+			return errors.Wrapf(err, "remove %v", action.UUID)
+		}
+
+		action.Time = time.Now().Format(time.RFC3339)
+		if b, err := json.Marshal(action); err != nil {
+			return errors.Wrapf(err, "marshal %v", action.String())
+		} else if err := bufferedRedisWrite(ctx, "retention audit", func(ctx context.Context, pipe redis.Pipeliner) {
+			pipe.LPush(ctx, SRS_RECORD_RETENTION_AUDIT, string(b))
+			pipe.LTrim(ctx, SRS_RECORD_RETENTION_AUDIT, 0, recordRetentionMaxAudits-1)
+		}); err != nil {
+			logger.Wf(ctx, "record janitor ignore audit %v err %+v", action.String(), err)
+		}
+		logger.Tf(ctx, "record janitor remove %v", action.String())
+	}
+
+	return nil
+}
+
+// queryRecordRetentionAudits returns the deletions of janitor, the latest first.
+func queryRecordRetentionAudits(ctx context.Context) ([]*RecordRetentionAction, error) {
+	values, err := rdb.LRange(ctx, SRS_RECORD_RETENTION_AUDIT, 0, recordRetentionMaxAudits-1).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "lrange %v", SRS_RECORD_RETENTION_AUDIT)
+	}
+
+	audits := make([]*RecordRetentionAction, 0, len(values))
+	for _, value := range values {
+		var audit RecordRetentionAction
+		if err := json.Unmarshal([]byte(value), &audit); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+		audits = append(audits, &audit)
+	}
+	return audits, nil
+}
+
+func (v *RecordWorker) handleRetention(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/hooks/record/retention/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			policies, err := queryRecordRetentionPolicies(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query policies")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Policies []*RecordRetentionPolicy `json:"policies"`
+			}{
+				Policies: policies,
+			})
+			logger.Tf(ctx, "record retention query ok, policies=%v, token=%vB", len(policies), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/retention/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			policy := &RecordRetentionPolicy{}
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string              `json:"token"`
+				Stream *string              `json:"stream"`
+				Label  *string              `json:"label"`
+				Mode   *RecordRetentionMode `json:"mode"`
+				Value  *int                 `json:"value"`
+			}{
+				Token: &token, Stream: &policy.Stream, Label: &policy.Label, Mode: &policy.Mode, Value: &policy.Value,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if err := policy.Validate(); err != nil {
+				return errors.Wrapf(err, "validate %v", policy.String())
+			}
+			if policy.Stream != "" {
+				if err := verifyStreamName(ctx, streamNameOf(policy.Stream)); err != nil {
+					return errors.Wrapf(err, "verify stream name")
+				}
+			}
+			policy.Update = time.Now().Format(time.RFC3339)
+
+			if b, err := json.Marshal(policy); err != nil {
+				return errors.Wrapf(err, "marshal %v", policy.String())
+			} else if err = rdb.HSet(ctx, SRS_RECORD_RETENTION, policy.Key(), string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v %v %v", SRS_RECORD_RETENTION, policy.Key(), string(b))
+			}
+
+			httpWriteData(ctx, w, r, policy)
+			logger.Tf(ctx, "record retention update ok, %v, token=%vB", policy.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/retention/remove"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			policy := &RecordRetentionPolicy{Mode: RecordRetentionForever}
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Stream *string `json:"stream"`
+				Label  *string `json:"label"`
+			}{
+				Token: &token, Stream: &policy.Stream, Label: &policy.Label,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if err := policy.Validate(); err != nil {
+				return errors.Wrapf(err, "validate %v", policy.String())
+			}
+
+			if err := rdb.HDel(ctx, SRS_RECORD_RETENTION, policy.Key()).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_RECORD_RETENTION, policy.Key())
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "record retention remove ok, key=%v, token=%vB", policy.Key(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/retention/dryrun"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			actions, err := planRecordRetention(ctx, time.Now())
+			if err != nil {
+				return errors.Wrapf(err, "plan retention")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Actions []*RecordRetentionAction `json:"actions"`
+			}{
+				Actions: actions,
+			})
+			logger.Tf(ctx, "record retention dryrun ok, actions=%v, token=%vB", len(actions), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/hooks/record/retention/audit"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			audits, err := queryRecordRetentionAudits(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query audits")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Audits []*RecordRetentionAction `json:"audits"`
+			}{
+				Audits: audits,
+			})
+			logger.Tf(ctx, "record retention audit ok, audits=%v, token=%vB", len(audits), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestRecordRetention_PlanAndRemove(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	now := time.Now()
+	addRecord := func(uuid, app, stream string, days int, labels ...string) {
+		b, _ := json.Marshal(&M3u8VoDArtifact{
+			UUID: uuid, App: app, Stream: stream, Done: now.Add(-time.Duration(days) * 24 * time.Hour).Format(time.RFC3339),
+		})
+		server.HSet(SRS_RECORD_M3U8_ARTIFACT, uuid, string(b))
+		if len(labels) > 0 {
+			b, _ := json.Marshal(&RecordMetadata{Labels: labels})
+			server.HSet(SRS_RECORD_METADATA, uuid, string(b))
+		}
+	}
+	addPolicy := func(policy *RecordRetentionPolicy) {
+		if err := policy.Validate(); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+		b, _ := json.Marshal(policy)
+		server.HSet(SRS_RECORD_RETENTION, policy.Key(), string(b))
+	}
+
+	// The flagship show is kept forever, even older than the global retention.
+	addRecord("show-1", "live", "show", 30)
+	addPolicy(&RecordRetentionPolicy{Stream: "live/show", Mode: RecordRetentionForever})
+	// Keep the last 2 recordings of news.
+	addRecord("news-1", "live", "news", 3)
+	addRecord("news-2", "live", "news", 2)
+	addRecord("news-3", "live", "news", 1)
+	addPolicy(&RecordRetentionPolicy{Stream: "live/news", Mode: RecordRetentionLast, Value: 2})
+	// The label keep-forever wins other labels.
+	addRecord("test-1", "live", "test", 5, "demo", "keep")
+	addRecord("test-2", "live", "test", 5, "demo")
+	addPolicy(&RecordRetentionPolicy{Label: " Keep ", Mode: RecordRetentionForever})
+	addPolicy(&RecordRetentionPolicy{Label: "demo", Mode: RecordRetentionDays, Value: 3})
+	// The global retention for others.
+	addRecord("other-1", "live", "other", 10)
+	addRecord("other-2", "live", "other", 1)
+	server.HSet(SRS_RECORD_PATTERNS, "retention", "7")
+
+	for _, policy := range []*RecordRetentionPolicy{
+		{Mode: RecordRetentionForever},
+		{Stream: "live/a", Label: "b", Mode: RecordRetentionForever},
+		{Stream: "live/a", Mode: RecordRetentionDays},
+		{Stream: "live/a", Mode: "unknown", Value: 1},
+	} {
+		if err := policy.Validate(); err == nil {
+			t.Errorf("Fail for %v should fail", policy.String())
+		}
+	}
+
+	actions, err := planRecordRetention(ctx, now)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	expects := []struct {
+		uuid, policy string
+	}{
+		{"other-1", recordRetentionGlobal},
+		{"test-2", "label:demo"},
+		{"news-1", "stream:live/news"},
+	}
+	if len(actions) != len(expects) {
+		t.Fatalf("Fail for actions %v", len(actions))
+	}
+	for i, expect := range expects {
+		if a := actions[i]; a.UUID != expect.uuid || a.Policy != expect.policy {
+			t.Errorf("Fail for action %v, expect %v", a.String(), expect)
+		}
+	}
+
+	// The janitor removes the planned recordings, and records the audit logs.
+	if err := removeExpiredRecords(ctx); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if objs, err := rdb.HGetAll(ctx, SRS_RECORD_M3U8_ARTIFACT).Result(); err != nil || len(objs) != 5 {
+		t.Errorf("Fail for records %v, err %+v", len(objs), err)
+	}
+	if audits, err := queryRecordRetentionAudits(ctx); err != nil || len(audits) != 3 {
+		t.Errorf("Fail for audits %v, err %+v", len(audits), err)
+	} else if a := audits[0]; a.UUID != "news-1" || a.Policy != "stream:live/news" || a.Reason != "exceeds last 2" {
+		t.Errorf("Fail for audit %v", a.String())
+	}
+
+	if actions, err := planRecordRetention(ctx, now); err != nil || len(actions) != 0 {
+		t.Errorf("Fail for actions %v, err %+v", len(actions), err)
+	}
+}
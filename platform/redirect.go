@@ -0,0 +1,284 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The prefixes served by platform, which are never overridden by the redirects.
+var redirectReservedPrefixes = []string{
+	"/terraform/", "/mgmt/", "/.well-known/", "/api/", "/rtc/", "/console/", "/players/", "/tools/",
+}
+
+// The max hops to follow the redirects, to detect the loop.
+const redirectMaxHops = 10
+
+// Redirect is a short link defined by operator, for example, /show to the current player URL.
+type Redirect struct {
+	// The path to match, for example, /show.
+	Path string `json:"path"`
+	// The target, an absolute URL, or a path of this server.
+	Target string `json:"target"`
+	// The create time in RFC3339.
+	CreateAt string `json:"createAt"`
+	// The expire time in RFC3339, empty if never expire.
+	ExpireAt string `json:"expireAt,omitempty"`
+	// The number of hits, only for query.
+	Hits int64 `json:"hits"`
+}
+
+func (v *Redirect) String() string {
+	return fmt.Sprintf("path=%v, target=%v, create=%v, expire=%v, hits=%v",
+		v.Path, v.Target, v.CreateAt, v.ExpireAt, v.Hits,
+	)
+}
+
+// Expired returns whether the redirect is expired at now.
+func (v *Redirect) Expired(now time.Time) bool {
+	if v.ExpireAt == "" {
+		return false
+	}
+	expireAt, err := time.Parse(time.RFC3339, v.ExpireAt)
+	return err == nil && !now.Before(expireAt)
+}
+
+// redirectPath returns the cleaned path, or error if not able to redirect, for example, the reserved prefixes.
+func redirectPath(p string) (string, error) {
+	if !strings.HasPrefix(p, "/") || strings.ContainsAny(p, "?#") {
+		return "", errors.Errorf("path %v should start with / and without query", p)
+	}
+
+	p = path.Clean(p)
+	if p == "/" {
+		return "", errors.Errorf("path %v is reserved", p)
+	}
+	for _, prefix := range redirectReservedPrefixes {
+		if strings.HasPrefix(p+"/", prefix) {
+			return "", errors.Errorf("path %v is reserved by %v", p, prefix)
+		}
+	}
+	return p, nil
+}
+
+// redirectTargetPath returns the path if target is on this server, or empty for the external URL.
+func redirectTargetPath(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		return ""
+	}
+	if u, err := url.Parse(target); err == nil {
+		return path.Clean(u.Path)
+	}
+	return ""
+}
+
+// validateRedirect validates the target of redirect, and detects the loop by following the redirects on this server.
+func validateRedirect(redirect *Redirect, redirects map[string]*Redirect) error {
+	if redirect.Target == "" {
+		return errors.New("no target")
+	}
+
+	if redirectTargetPath(redirect.Target) == "" {
+		u, err := url.Parse(redirect.Target)
+		if err != nil {
+			return errors.Wrapf(err, "parse target %v", redirect.Target)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+			return errors.Errorf("target %v should be http(s) URL or path", redirect.Target)
+		}
+		return nil
+	}
+
+	chain := []string{redirect.Path}
+	for target := redirect.Target; ; {
+		p := redirectTargetPath(target)
+		if p == "" {
+			return nil
+		}
+
+		chain = append(chain, p)
+		if p == redirect.Path {
+			return errors.Errorf("redirect loop %v", strings.Join(chain, " -> "))
+		}
+		if len(chain) > redirectMaxHops {
+			return errors.Errorf("redirect too many hops %v", strings.Join(chain, " -> "))
+		}
+
+		next, ok := redirects[p]
+		if !ok {
+			return nil
+		}
+		target = next.Target
+	}
+}
+
+// queryRedirects returns all redirects with hits, sorted by path.
+func queryRedirects(ctx context.Context) ([]*Redirect, error) {
+	items, err := rdb.HGetAll(ctx, SRS_REDIRECTS).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_REDIRECTS)
+	}
+
+	hits, err := rdb.HGetAll(ctx, SRS_REDIRECT_HITS).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_REDIRECT_HITS)
+	}
+
+	redirects := make([]*Redirect, 0, len(items))
+	for p, item := range items {
+		var redirect Redirect
+		if err := json.Unmarshal([]byte(item), &redirect); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", p, item)
+		}
+		redirect.Path = p
+		redirect.Hits, _ = strconv.ParseInt(hits[p], 10, 64)
+		redirects = append(redirects, &redirect)
+	}
+
+	sort.Slice(redirects, func(i, j int) bool {
+		return redirects[i].Path < redirects[j].Path
+	})
+	return redirects, nil
+}
+
+// serveRedirect redirects the request if matches a redirect which is not expired, returns false if not match.
+func serveRedirect(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	p, err := redirectPath(r.URL.Path)
+	if err != nil {
+		return false
+	}
+
+	item, err := rdb.HGet(ctx, SRS_REDIRECTS, p).Result()
+	if err != nil {
+		if err != redis.Nil {
+			logThrottle.Wf(ctx, "redirect query", "ignore redirect %v err %+v", p, err)
+		}
+		return false
+	}
+
+	var redirect Redirect
+	if err := json.Unmarshal([]byte(item), &redirect); err != nil {
+		logThrottle.Wf(ctx, "redirect query", "ignore redirect %v err %+v", p, err)
+		return false
+	}
+	if redirect.Expired(time.Now()) {
+		return false
+	}
+
+	if err := rdb.HIncrBy(ctx, SRS_REDIRECT_HITS, p, 1).Err(); err != nil {
+		logThrottle.Wf(ctx, "redirect hits", "ignore redirect %v hits err %+v", p, err)
+	}
+
+	// The target of path is under the base path, for example, /mgmt/routers-streaming.
+	http.Redirect(w, r, withBasePath(redirect.Target), http.StatusFound)
+	return true
+}
+
+func handleMgmtRedirects(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/redirects"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action, p, target string
+			var expire int64
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Action *string `json:"action"`
+				Path   *string `json:"path"`
+				Target *string `json:"target"`
+				// The expire in seconds, 0 if never expire.
+				Expire *int64 `json:"expire"`
+			}{
+				Token: &token, Action: &action, Path: &p, Target: &target, Expire: &expire,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if action != "" && action != "update" && action != "remove" {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+			}
+			if action != "" {
+				if cleaned, err := redirectPath(p); err != nil {
+					return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "path"))
+				} else {
+					p = cleaned
+				}
+			}
+
+			if action == "update" {
+				if expire < 0 {
+					return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid expire %v", expire))
+				}
+
+				redirects, err := queryRedirects(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "query redirects")
+				}
+				others := make(map[string]*Redirect)
+				for _, redirect := range redirects {
+					others[redirect.Path] = redirect
+				}
+
+				now := time.Now()
+				redirect := &Redirect{Path: p, Target: target, CreateAt: now.Format(time.RFC3339)}
+				if expire > 0 {
+					redirect.ExpireAt = now.Add(time.Duration(expire) * time.Second).Format(time.RFC3339)
+				}
+				if err := validateRedirect(redirect, others); err != nil {
+					return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "validate"))
+				}
+
+				if b, err := json.Marshal(redirect); err != nil {
+					return errors.Wrapf(err, "marshal %v", redirect.String())
+				} else if err := rdb.HSet(ctx, SRS_REDIRECTS, p, string(b)).Err(); err != nil {
+					return errors.Wrapf(err, "hset %v %v %v", SRS_REDIRECTS, p, string(b))
+				}
+				logger.Tf(ctx, "redirect update ok, %v", redirect.String())
+			} else if action == "remove" {
+				if err := rdb.HDel(ctx, SRS_REDIRECTS, p).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", SRS_REDIRECTS, p)
+				}
+				if err := rdb.HDel(ctx, SRS_REDIRECT_HITS, p).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", SRS_REDIRECT_HITS, p)
+				}
+				logger.Tf(ctx, "redirect remove ok, path=%v", p)
+			}
+
+			redirects, err := queryRedirects(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query redirects")
+			}
+
+			httpWriteData(ctx, w, r, redirects)
+			logger.Tf(ctx, "redirects ok, action=%v, redirects=%v, token=%vB", action, len(redirects), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
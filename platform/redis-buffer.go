@@ -0,0 +1,258 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max number of writes in buffer, the oldest write is dropped if exceeded, for example, redis is down for a long
+// time, to avoid the memory grows unboundedly.
+const redisWriteBufferMaxWrites = 10000
+
+// The max number of writes to flush in a pipeline.
+const redisWriteBufferBatch = 100
+
+// The interval to flush the buffer, or retry after failure.
+const redisWriteBufferInterval = time.Second
+
+// The max number of retries of a write, then it's dropped.
+const redisWriteBufferMaxRetries = 10
+
+// The timeout to flush a batch, and to drain the buffer when shutdown.
+const (
+	redisWriteBufferFlushTimeout = 3 * time.Second
+	redisWriteBufferDrainTimeout = 5 * time.Second
+)
+
+// RedisWriteOp queues the commands of a write to pipeline, it should not read the result.
+type RedisWriteOp func(ctx context.Context, pipe redis.Pipeliner)
+
+type redisWrite struct {
+	// The name of write, for log.
+	name string
+	// The commands of write.
+	op RedisWriteOp
+	// The number of failed flushes.
+	retries int
+}
+
+// RedisWriteBufferMetrics is the metrics of the write buffer.
+type RedisWriteBufferMetrics struct {
+	// The number of writes in buffer.
+	Depth int `json:"depth"`
+	// The number of writes flushed.
+	Written int64 `json:"written"`
+	// The number of failed flushes of writes.
+	Retried int64 `json:"retried"`
+	// The number of writes dropped, because buffer is full or too many retries.
+	Dropped int64 `json:"dropped"`
+}
+
+var redisWriteBuffer *RedisWriteBuffer
+
+// RedisWriteBuffer buffers the non-critical writes, such as stat counters, audit log and task history, and flushes
+// them in batches by pipeline, so the handlers are not blocked by redis. Note that a retried write might be applied
+// more than once, if the pipeline partially succeeds, so never use it for critical writes like auth and config.
+type RedisWriteBuffer struct {
+	// The writes to flush, the oldest first.
+	writes []*redisWrite
+	// Whether closed, the writes are executed directly after closed.
+	closed bool
+	lock   sync.Mutex
+
+	// Notify the worker to flush, when there are enough writes.
+	notify chan bool
+
+	written, retried, dropped int64
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewRedisWriteBuffer() *RedisWriteBuffer {
+	return &RedisWriteBuffer{notify: make(chan bool, 1)}
+}
+
+// Close stops the worker, and drains the buffer before return, so the writes are not lost when shutdown.
+func (v *RedisWriteBuffer) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+
+	v.lock.Lock()
+	v.closed = true
+	v.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), redisWriteBufferDrainTimeout)
+	defer cancel()
+
+	for v.depth() > 0 {
+		if err := v.flush(ctx); err != nil {
+			logger.Wf(ctx, "redis buffer drain err %+v", err)
+			break
+		}
+	}
+	logger.Tf(ctx, "redis buffer closed, %v", v.Metrics().String())
+	return nil
+}
+
+func (v *RedisWriteBuffer) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "redis buffer start, max=%v, batch=%v", redisWriteBufferMaxWrites, redisWriteBufferBatch)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		safeRestart(ctx, func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-v.notify:
+				case <-time.After(redisWriteBufferInterval):
+				}
+
+				for v.depth() > 0 && ctx.Err() == nil {
+					if err := v.flush(ctx); err != nil {
+						logger.Wf(ctx, "redis buffer flush err %+v", err)
+						break
+					}
+				}
+			}
+		})
+	}()
+
+	return nil
+}
+
+// Write buffers the write, or executes it directly if the buffer is closed.
+func (v *RedisWriteBuffer) Write(ctx context.Context, name string, op RedisWriteOp) error {
+	v.lock.Lock()
+	if v.closed {
+		v.lock.Unlock()
+		return execRedisWrite(ctx, name, op)
+	}
+
+	v.writes = append(v.writes, &redisWrite{name: name, op: op})
+	if len(v.writes) > redisWriteBufferMaxWrites {
+		logger.Wf(ctx, "redis buffer full, drop %v", v.writes[0].name)
+		v.writes = v.writes[1:]
+		atomic.AddInt64(&v.dropped, 1)
+	}
+	nn := len(v.writes)
+	v.lock.Unlock()
+
+	if nn >= redisWriteBufferBatch {
+		select {
+		case v.notify <- true:
+		default:
+		}
+	}
+	return nil
+}
+
+func (v *RedisWriteBuffer) Metrics() *RedisWriteBufferMetrics {
+	return &RedisWriteBufferMetrics{
+		Depth: v.depth(), Written: atomic.LoadInt64(&v.written), Retried: atomic.LoadInt64(&v.retried),
+		Dropped: atomic.LoadInt64(&v.dropped),
+	}
+}
+
+func (v *RedisWriteBufferMetrics) String() string {
+	return fmt.Sprintf("depth=%v, written=%v, retried=%v, dropped=%v", v.Depth, v.Written, v.Retried, v.Dropped)
+}
+
+func (v *RedisWriteBuffer) depth() int {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return len(v.writes)
+}
+
+// flush writes a batch of the oldest writes by pipeline. If failed, the writes are put back to retry, except the ones
+// exceed the max retries.
+func (v *RedisWriteBuffer) flush(ctx context.Context) error {
+	v.lock.Lock()
+	batch := v.writes
+	if len(batch) > redisWriteBufferBatch {
+		batch = batch[:redisWriteBufferBatch]
+	}
+	v.writes = v.writes[len(batch):]
+	v.lock.Unlock()
+
+	if len(batch) == 0 {
+		return nil
+	}
+
+	ctx2, cancel := context.WithTimeout(ctx, redisWriteBufferFlushTimeout)
+	defer cancel()
+
+	_, err := rdb.Pipelined(ctx2, func(pipe redis.Pipeliner) error {
+		for _, w := range batch {
+			w.op(ctx2, pipe)
+		}
+		return nil
+	})
+	if err == nil || err == redis.Nil {
+		atomic.AddInt64(&v.written, int64(len(batch)))
+		return nil
+	}
+
+	var retries []*redisWrite
+	for _, w := range batch {
+		if w.retries++; w.retries > redisWriteBufferMaxRetries {
+			logger.Wf(ctx, "redis buffer drop %v after %v retries", w.name, redisWriteBufferMaxRetries)
+			atomic.AddInt64(&v.dropped, 1)
+			continue
+		}
+		retries = append(retries, w)
+	}
+	atomic.AddInt64(&v.retried, int64(len(retries)))
+
+	// Put back to the head to keep the order, and drop the oldest if exceed the max.
+	v.lock.Lock()
+	v.writes = append(retries, v.writes...)
+	if overflow := len(v.writes) - redisWriteBufferMaxWrites; overflow > 0 {
+		v.writes = v.writes[overflow:]
+		atomic.AddInt64(&v.dropped, int64(overflow))
+	}
+	v.lock.Unlock()
+
+	return errors.Wrapf(err, "pipeline %v writes", len(batch))
+}
+
+// execRedisWrite executes the write directly by pipeline.
+func execRedisWrite(ctx context.Context, name string, op RedisWriteOp) error {
+	if _, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		op(ctx, pipe)
+		return nil
+	}); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "write %v", name)
+	}
+	return nil
+}
+
+// bufferedRedisWrite writes by the buffer if started, or executes it directly, for example, in tests or tools.
+func bufferedRedisWrite(ctx context.Context, name string, op RedisWriteOp) error {
+	if redisWriteBuffer == nil {
+		return execRedisWrite(ctx, name, op)
+	}
+	return redisWriteBuffer.Write(ctx, name, op)
+}
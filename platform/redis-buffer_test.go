@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestRedisWriteBuffer_DrainWhenClose(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	// Never started, so the writes are only flushed when close.
+	buffer := NewRedisWriteBuffer()
+	for i := 0; i < 250; i++ {
+		i := i
+		buffer.Write(ctx, "test", func(ctx context.Context, pipe redis.Pipeliner) {
+			pipe.HSet(ctx, "test", fmt.Sprintf("f%v", i), "v")
+			pipe.HIncrBy(ctx, SRS_STAT_COUNTER, "publish", 1)
+		})
+	}
+	if m := buffer.Metrics(); m.Depth != 250 || m.Written != 0 {
+		t.Errorf("Fail for metrics %v", m.String())
+	}
+
+	buffer.Close()
+	if m := buffer.Metrics(); m.Depth != 0 || m.Written != 250 || m.Dropped != 0 {
+		t.Errorf("Fail for metrics %v", m.String())
+	}
+	if v, _ := server.HGet(SRS_STAT_COUNTER, "publish"); v != "250" {
+		t.Errorf("Fail for counter %v", v)
+	}
+	if v, ok := server.HGet("test", "f249"); !ok || v != "v" {
+		t.Errorf("Fail for value %v", v)
+	}
+
+	// Execute directly after closed.
+	buffer.Write(ctx, "test", func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.HSet(ctx, "test", "closed", "v")
+	})
+	if _, ok := server.HGet("test", "closed"); !ok {
+		t.Errorf("Fail for not written")
+	}
+}
+
+func TestRedisWriteBuffer_RetryAndCap(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := newFakeRedis(t)
+	addr := server.Addr()
+	server.Close()
+
+	oldRdb := rdb
+	rdb = redis.NewClient(&redis.Options{Addr: addr, MaxRetries: -1})
+	defer func() {
+		rdb.Close()
+		rdb = oldRdb
+	}()
+
+	buffer := NewRedisWriteBuffer()
+	for i := 0; i < redisWriteBufferMaxWrites+5; i++ {
+		buffer.Write(ctx, "test", func(ctx context.Context, pipe redis.Pipeliner) {
+			pipe.HIncrBy(ctx, SRS_STAT_COUNTER, "play", 1)
+		})
+	}
+	if m := buffer.Metrics(); m.Depth != redisWriteBufferMaxWrites || m.Dropped != 5 {
+		t.Errorf("Fail for metrics %v", m.String())
+	}
+
+	// The writes are kept to retry if redis is down.
+	if err := buffer.flush(ctx); err == nil {
+		t.Errorf("Fail for should fail")
+	}
+	if m := buffer.Metrics(); m.Depth != redisWriteBufferMaxWrites || m.Retried != redisWriteBufferBatch {
+		t.Errorf("Fail for metrics %v", m.String())
+	}
+
+	// Dropped after too many retries.
+	for i := 0; i < redisWriteBufferMaxRetries; i++ {
+		buffer.flush(ctx)
+	}
+	if m := buffer.Metrics(); m.Depth != redisWriteBufferMaxWrites-redisWriteBufferBatch || m.Dropped != 5+redisWriteBufferBatch {
+		t.Errorf("Fail for metrics %v", m.String())
+	}
+}
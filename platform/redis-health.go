@@ -0,0 +1,195 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The round-trip latency of redis in milliseconds, which is too slow for the hooks of SRS.
+const redisHealthSlowLatency = 100
+
+// The RDB snapshot is stale if not saved for a while, with changes not saved.
+const redisHealthStaleSave = 1 * time.Hour
+
+// The maxmemory in bytes which is too small to evict keys safely, because the keys of platform might be evicted.
+const redisHealthSmallMaxMemory = 1024 * 1024 * 1024
+
+// The ratio of memory used to maxmemory, to warn before redis is full.
+const redisHealthMemoryRatio = 0.9
+
+// RedisHealthWarning is a risky setting or state of redis, with the remediation hint.
+type RedisHealthWarning struct {
+	// The code of warning, for example, no-persistence.
+	Code string `json:"code"`
+	// The detail of warning.
+	Message string `json:"message"`
+	// The remediation hint.
+	Hint string `json:"hint"`
+}
+
+// RedisHealth is the health of redis, the latency, persistence and memory.
+type RedisHealth struct {
+	// The round-trip latency of PING in milliseconds.
+	Latency float64 `json:"latency"`
+	// Whether RDB snapshot or AOF is enabled.
+	RDB bool `json:"rdb"`
+	AOF bool `json:"aof"`
+	// The seconds since the last RDB save, -1 if never saved.
+	LastSave int64 `json:"lastSave"`
+	// The memory used and the maxmemory in bytes, the maxmemory is 0 if no limit.
+	UsedMemory int64 `json:"usedMemory"`
+	MaxMemory  int64 `json:"maxMemory"`
+	// The eviction policy, for example, noeviction.
+	EvictionPolicy string `json:"evictionPolicy"`
+	// The risky settings or state, empty if healthy.
+	Warnings []*RedisHealthWarning `json:"warnings"`
+}
+
+func (v *RedisHealth) String() string {
+	var codes []string
+	for _, w := range v.Warnings {
+		codes = append(codes, w.Code)
+	}
+	return fmt.Sprintf("latency=%.1fms, rdb=%v, aof=%v, lastSave=%v, memory=%v/%v, policy=%v, warnings=%v",
+		v.Latency, v.RDB, v.AOF, v.LastSave, v.UsedMemory, v.MaxMemory, v.EvictionPolicy, strings.Join(codes, ","),
+	)
+}
+
+// WarningsOf returns the warnings of codes, empty if healthy.
+func (v *RedisHealth) WarningsOf(codes ...string) []*RedisHealthWarning {
+	var warnings []*RedisHealthWarning
+	for _, w := range v.Warnings {
+		for _, code := range codes {
+			if w.Code == code {
+				warnings = append(warnings, w)
+			}
+		}
+	}
+	return warnings
+}
+
+// queryRedisHealth measures the latency, and queries the persistence and memory of redis by CONFIG and INFO. The
+// CONFIG might be disabled by managed redis, so the persistence is detected by INFO if failed.
+func queryRedisHealth(ctx context.Context) (*RedisHealth, error) {
+	starttime := time.Now()
+	if err := rdb.Ping(ctx).Err(); err != nil {
+		return nil, errors.Wrapf(err, "ping")
+	}
+	latency := float64(time.Since(starttime)) / float64(time.Millisecond)
+
+	info := make(map[string]string)
+	for _, section := range []string{"persistence", "memory"} {
+		value, err := rdb.Info(ctx, section).Result()
+		if err != nil && err != redis.Nil {
+			return nil, errors.Wrapf(err, "info %v", section)
+		}
+		for _, line := range strings.Split(value, "\n") {
+			if kv := strings.SplitN(strings.TrimSpace(line), ":", 2); len(kv) == 2 {
+				info[kv[0]] = kv[1]
+			}
+		}
+	}
+
+	var save *string
+	if values, err := rdb.ConfigGet(ctx, "save").Result(); err == nil && len(values) == 2 {
+		v := fmt.Sprintf("%v", values[1])
+		save = &v
+	}
+
+	return parseRedisHealth(latency, save, info, time.Now()), nil
+}
+
+// redisHealthError returns the error of warnings with the remediation hints, nil if no warning.
+func redisHealthError(warnings []*RedisHealthWarning) error {
+	if len(warnings) == 0 {
+		return nil
+	}
+
+	var msgs []string
+	for _, w := range warnings {
+		msgs = append(msgs, fmt.Sprintf("%v: %v. %v", w.Code, w.Message, w.Hint))
+	}
+	return errors.New(strings.Join(msgs, "; "))
+}
+
+// parseRedisHealth builds the health by the INFO of redis, and the save of CONFIG which is nil if not available.
+func parseRedisHealth(latency float64, save *string, info map[string]string, now time.Time) *RedisHealth {
+	atoi := func(key string) int64 {
+		v, _ := strconv.ParseInt(info[key], 10, 64)
+		return v
+	}
+
+	v := &RedisHealth{
+		Latency: latency, AOF: info["aof_enabled"] == "1", LastSave: -1,
+		UsedMemory: atoi("used_memory"), MaxMemory: atoi("maxmemory"), EvictionPolicy: info["maxmemory_policy"],
+		Warnings: []*RedisHealthWarning{},
+	}
+
+	// Without CONFIG, the RDB is enabled if ever saved, which is a guess.
+	if save != nil {
+		v.RDB = *save != ""
+	} else {
+		v.RDB = info["rdb_last_bgsave_status"] == "ok" && atoi("rdb_last_save_time") > 0
+	}
+	if t := atoi("rdb_last_save_time"); t > 0 {
+		v.LastSave = int64(now.Sub(time.Unix(t, 0)) / time.Second)
+	}
+
+	if latency > redisHealthSlowLatency {
+		v.Warnings = append(v.Warnings, &RedisHealthWarning{
+			Code: "slow", Message: fmt.Sprintf("latency %.1fms exceeds %vms", latency, redisHealthSlowLatency),
+			Hint: "Run redis on the same host or network of platform, and check the CPU and slowlog of redis.",
+		})
+	}
+
+	if !v.RDB && !v.AOF {
+		v.Warnings = append(v.Warnings, &RedisHealthWarning{
+			Code: "no-persistence", Message: "neither RDB nor AOF is enabled, all settings are lost after restart",
+			Hint: "Enable AOF by CONFIG SET appendonly yes, or RDB by CONFIG SET save \"3600 1 300 100 60 10000\", then CONFIG REWRITE.",
+		})
+	} else if v.RDB && info["rdb_last_bgsave_status"] != "" && info["rdb_last_bgsave_status"] != "ok" {
+		v.Warnings = append(v.Warnings, &RedisHealthWarning{
+			Code: "save-failed", Message: fmt.Sprintf("last RDB save status is %v", info["rdb_last_bgsave_status"]),
+			Hint: "Check the disk space and permission of the redis data directory.",
+		})
+	} else if v.RDB && !v.AOF && atoi("rdb_changes_since_last_save") > 0 &&
+		v.LastSave > int64(redisHealthStaleSave/time.Second) {
+		v.Warnings = append(v.Warnings, &RedisHealthWarning{
+			Code: "stale-save", Message: fmt.Sprintf("%v changes not saved for %vs",
+				atoi("rdb_changes_since_last_save"), v.LastSave,
+			),
+			Hint: "Check the save rules of redis, or run BGSAVE to save now.",
+		})
+	}
+
+	if v.MaxMemory > 0 && v.EvictionPolicy != "" && v.EvictionPolicy != "noeviction" &&
+		v.MaxMemory < redisHealthSmallMaxMemory {
+		v.Warnings = append(v.Warnings, &RedisHealthWarning{
+			Code: "eviction", Message: fmt.Sprintf("policy %v with small maxmemory %vMB",
+				v.EvictionPolicy, v.MaxMemory/1024/1024,
+			),
+			Hint: "Set maxmemory-policy to noeviction, or increase maxmemory, or the settings of platform might be evicted.",
+		})
+	}
+	if v.MaxMemory > 0 && float64(v.UsedMemory) > float64(v.MaxMemory)*redisHealthMemoryRatio {
+		v.Warnings = append(v.Warnings, &RedisHealthWarning{
+			Code: "memory", Message: fmt.Sprintf("memory used %vMB of maxmemory %vMB",
+				v.UsedMemory/1024/1024, v.MaxMemory/1024/1024,
+			),
+			Hint: "Increase maxmemory of redis, or clean up the unused data.",
+		})
+	}
+	return v
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRedisHealth_Parse(t *testing.T) {
+	now := time.Now()
+	lastSave := fmt.Sprintf("%v", now.Add(-10*time.Minute).Unix())
+	staleSave := fmt.Sprintf("%v", now.Add(-2*redisHealthStaleSave).Unix())
+	str := func(v string) *string {
+		return &v
+	}
+
+	for _, tc := range []struct {
+		name     string
+		latency  float64
+		save     *string
+		info     map[string]string
+		warnings string
+	}{
+		{name: "healthy", latency: 1, save: str("3600 1"), info: map[string]string{
+			"rdb_last_bgsave_status": "ok", "rdb_last_save_time": lastSave, "rdb_changes_since_last_save": "10",
+			"used_memory": "1048576", "maxmemory": "0", "maxmemory_policy": "noeviction",
+		}},
+		{name: "aof", latency: 1, save: str(""), info: map[string]string{"aof_enabled": "1"}},
+		{name: "slow", latency: 200, save: str("3600 1"), info: map[string]string{}, warnings: "slow"},
+		{name: "no-persistence", latency: 1, save: str(""), info: map[string]string{
+			"aof_enabled": "0", "rdb_last_bgsave_status": "ok", "rdb_last_save_time": lastSave,
+		}, warnings: "no-persistence"},
+		{name: "save-failed", latency: 1, save: str("3600 1"), info: map[string]string{
+			"rdb_last_bgsave_status": "err", "rdb_last_save_time": lastSave,
+		}, warnings: "save-failed"},
+		{name: "stale-save", latency: 1, save: str("3600 1"), info: map[string]string{
+			"rdb_last_bgsave_status": "ok", "rdb_last_save_time": staleSave, "rdb_changes_since_last_save": "10",
+		}, warnings: "stale-save"},
+		{name: "eviction", latency: 1, save: str("3600 1"), info: map[string]string{
+			"used_memory": "1048576", "maxmemory": "268435456", "maxmemory_policy": "allkeys-lru",
+		}, warnings: "eviction"},
+		{name: "memory", latency: 1, save: str("3600 1"), info: map[string]string{
+			"used_memory": "2040109466", "maxmemory": "2147483648", "maxmemory_policy": "noeviction",
+		}, warnings: "memory"},
+		// Without CONFIG, detect the RDB by INFO.
+		{name: "no-config", latency: 1, info: map[string]string{
+			"rdb_last_bgsave_status": "ok", "rdb_last_save_time": lastSave,
+		}},
+		{name: "no-config-never-saved", latency: 1, info: map[string]string{
+			"rdb_last_bgsave_status": "ok", "rdb_last_save_time": "0",
+		}, warnings: "no-persistence"},
+	} {
+		health := parseRedisHealth(tc.latency, tc.save, tc.info, now)
+
+		var codes []string
+		for _, w := range health.Warnings {
+			if w.Hint == "" {
+				t.Errorf("Fail for %v, no hint of %v", tc.name, w.Code)
+			}
+			codes = append(codes, w.Code)
+		}
+		if strings.Join(codes, ",") != tc.warnings {
+			t.Errorf("Fail for %v, %v", tc.name, health.String())
+		}
+	}
+}
+
+func TestRedisHealth_Error(t *testing.T) {
+	health := parseRedisHealth(1, nil, map[string]string{
+		"used_memory": "1048576", "maxmemory": "1048576", "maxmemory_policy": "volatile-lru",
+	}, time.Now())
+
+	if err := redisHealthError(health.WarningsOf("slow")); err != nil {
+		t.Errorf("Fail for err %v", err)
+	}
+	if err := redisHealthError(health.WarningsOf("eviction", "memory")); err == nil ||
+		!strings.Contains(err.Error(), "eviction") || !strings.Contains(err.Error(), "memory") {
+		t.Errorf("Fail for err %v", err)
+	}
+}
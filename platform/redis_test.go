@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/alicebob/miniredis/v2/server"
+	"github.com/go-redis/redis/v8"
+)
+
+// fakeRedis is a in-memory redis server by miniredis, which runs the Lua scripts like redis, for example, the scripts
+// of lock. The keys expire by the wall clock like redis, while miniredis only expires keys by FastForward.
+type fakeRedis struct {
+	*miniredis.Miniredis
+	done chan bool
+}
+
+func newFakeRedis(t testing.TB) *fakeRedis {
+	s, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	// The subcommand of MEMORY is case-sensitive in miniredis, while go-redis sends lowercase, so we dispatch it again
+	// in uppercase.
+	s.Server().SetPreHook(func(c *server.Peer, cmd string, args ...string) bool {
+		if cmd != "MEMORY" || len(args) == 0 || args[0] == strings.ToUpper(args[0]) {
+			return false
+		}
+		s.Server().Dispatch(c, append([]string{cmd, strings.ToUpper(args[0])}, args[1:]...))
+		return true
+	})
+
+	v := &fakeRedis{Miniredis: s, done: make(chan bool)}
+	go func() {
+		last := time.Now()
+		for {
+			select {
+			case <-v.done:
+				return
+			case now := <-time.After(10 * time.Millisecond):
+				s.FastForward(now.Sub(last))
+				last = now
+			}
+		}
+	}()
+	return v
+}
+
+// setupFakeRedis starts a fake redis as rdb, and set the api secret to test-platform-secret, which are restored when
+// the test is done.
+func setupFakeRedis(t testing.TB) *fakeRedis {
+	server := newFakeRedis(t)
+
+	oldRdb, oldSecret := rdb, os.Getenv("SRS_PLATFORM_SECRET")
+	rdb = redis.NewClient(&redis.Options{Addr: server.Addr()})
+	os.Setenv("SRS_PLATFORM_SECRET", "test-platform-secret")
+	t.Cleanup(func() {
+		rdb.Close()
+		rdb = oldRdb
+		os.Setenv("SRS_PLATFORM_SECRET", oldSecret)
+		server.Close()
+	})
+	return server
+}
+
+func (v *fakeRedis) Close() error {
+	select {
+	case <-v.done:
+	default:
+		close(v.done)
+	}
+	v.Miniredis.Close()
+	return nil
+}
+
+// HGet returns the value of field, and whether the field exists.
+func (v *fakeRedis) HGet(key, field string) (string, bool) {
+	fields, _ := v.Miniredis.HKeys(key)
+	for _, f := range fields {
+		if f == field {
+			return v.Miniredis.HGet(key, field), true
+		}
+	}
+	return "", false
+}
+
+// execute runs the redis command directly, for example, to set the key with TTL.
+func (v *fakeRedis) execute(args []string) error {
+	client := redis.NewClient(&redis.Options{Addr: v.Addr()})
+	defer client.Close()
+
+	values := make([]interface{}, 0, len(args))
+	for _, arg := range args {
+		values = append(values, arg)
+	}
+	return client.Do(context.Background(), values...).Err()
+}
@@ -0,0 +1,690 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The default idle timeout to stop the relay, when there is no viewer.
+const relayDefaultIdleTimeout = 30 * time.Second
+
+// The interval to reconcile the relay tasks with the viewers.
+const relayInterval = 3 * time.Second
+
+// The interval to restart the relay after failure, to avoid too fast restart.
+const relayRestartInterval = 3 * time.Second
+
+var relayWorker *RelayWorker
+
+// RelayConfig is the configuration of a relay, which pulls the source stream from other origin, and republishes it as
+// the local stream on demand.
+type RelayConfig struct {
+	// The relay UUID, also used as the task UUID in task history.
+	UUID string `json:"uuid"`
+	// The local app and stream name, for example, live and livestream.
+	App    string `json:"app"`
+	Stream string `json:"stream"`
+	// The source URL of other origin, such as RTMP, HLS or SRT, encrypted by api secret because it might contain
+	// credentials, see encryptByApiSecret.
+	Source string `json:"source"`
+	// The idle timeout in seconds to stop the relay when no viewer, default to relayDefaultIdleTimeout.
+	IdleTimeout int `json:"idleTimeout"`
+	// Whether relay is enabled.
+	Enabled bool `json:"enabled"`
+	// The label for this relay.
+	Label string `json:"label"`
+	// The update time.
+	Update string `json:"update"`
+}
+
+func (v *RelayConfig) String() string {
+	return fmt.Sprintf("uuid=%v, app=%v, stream=%v, source=%vB, idleTimeout=%v, enabled=%v, label=%v",
+		v.UUID, v.App, v.Stream, len(v.Source), v.IdleTimeout, v.Enabled, v.Label,
+	)
+}
+
+// StreamURL returns the local stream URL, for example, live/livestream, which is the key of relay.
+func (v *RelayConfig) StreamURL() string {
+	return fmt.Sprintf("%v/%v", v.App, v.Stream)
+}
+
+func (v *RelayConfig) idleTimeout() time.Duration {
+	if v.IdleTimeout > 0 {
+		return time.Duration(v.IdleTimeout) * time.Second
+	}
+	return relayDefaultIdleTimeout
+}
+
+// RelayState is the runtime state of relay, which is persisted in redis for query.
+type RelayState struct {
+	// The status of relay, idle, running, error or waiting-for-srs.
+	Status string `json:"status"`
+	// The number of viewers.
+	Viewers int64 `json:"viewers"`
+	// The FFmpeg pid, if running.
+	PID int32 `json:"pid,omitempty"`
+	// The start time of FFmpeg, if running.
+	Start string `json:"start,omitempty"`
+	// The time when the last viewer leaves, if running.
+	IdleSince string `json:"idleSince,omitempty"`
+	// The last start or stop decision, with reason.
+	Decision string `json:"decision,omitempty"`
+	// The last error of FFmpeg.
+	Error string `json:"error,omitempty"`
+	// The update time.
+	Update string `json:"update"`
+}
+
+func (v *RelayState) String() string {
+	return fmt.Sprintf("status=%v, viewers=%v, pid=%v, start=%v, idleSince=%v, decision=%v, error=%v",
+		v.Status, v.Viewers, v.PID, v.Start, v.IdleSince, v.Decision, v.Error,
+	)
+}
+
+// RelayAction is the decision of relay.
+type RelayAction string
+
+const (
+	RelayActionNone  RelayAction = ""
+	RelayActionStart RelayAction = "start"
+	RelayActionStop  RelayAction = "stop"
+)
+
+// relayDecide returns whether to start or stop the relay, with the reason.
+func relayDecide(config *RelayConfig, viewers int64, running bool, idleSince, now time.Time) (RelayAction, string) {
+	if !config.Enabled {
+		if running {
+			return RelayActionStop, "disabled"
+		}
+		return RelayActionNone, ""
+	}
+
+	if viewers > 0 && !running {
+		return RelayActionStart, fmt.Sprintf("viewers=%v", viewers)
+	}
+	if viewers <= 0 && running && !idleSince.IsZero() && now.Sub(idleSince) >= config.idleTimeout() {
+		return RelayActionStop, fmt.Sprintf("idle for %v", now.Sub(idleSince).Round(time.Second))
+	}
+	return RelayActionNone, ""
+}
+
+// validateRelaySource verifies the source URL, only RTMP, HLS over HTTP and SRT are supported.
+func validateRelaySource(source string) error {
+	u, err := RebuildStreamURL(source)
+	if err != nil {
+		return errors.Wrapf(err, "parse source")
+	}
+
+	if !slicesContains([]string{"rtmp", "rtmps", "http", "https", "srt"}, u.Scheme) {
+		return errors.Errorf("invalid schema %v", u.Scheme)
+	}
+	return nil
+}
+
+// queryRelayConfigs returns all relays, the key is the local stream URL.
+func queryRelayConfigs(ctx context.Context) (map[string]*RelayConfig, error) {
+	values, err := rdb.HGetAll(ctx, SRS_RELAY_CONFIG).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_RELAY_CONFIG)
+	}
+
+	configs := make(map[string]*RelayConfig)
+	for streamURL, value := range values {
+		var config RelayConfig
+		if err := json.Unmarshal([]byte(value), &config); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", streamURL, value)
+		}
+		configs[streamURL] = &config
+	}
+	return configs, nil
+}
+
+// queryPublishSecret returns the secret to publish the local stream, the secret of local publishers if the stream has
+// a publish key, because the key is hashed, or the global publish secret, see the on_publish hook.
+func queryPublishSecret(ctx context.Context, stream string) (string, error) {
+	if secret, err := rdb.HGet(ctx, SRS_AUTH_SECRET, GenerateRoomPublishKey(stream)).Result(); err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "hget %v %v", SRS_AUTH_SECRET, GenerateRoomPublishKey(stream))
+	} else if secret != "" {
+		if local := localPublishSecret(envApiSecret(), stream); local != "" {
+			return local, nil
+		}
+		return "", errors.Errorf("no api secret to publish %v", stream)
+	}
+
+	secret, err := rdb.HGet(ctx, SRS_AUTH_SECRET, "pubSecret").Result()
+	if err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "hget %v pubSecret", SRS_AUTH_SECRET)
+	}
+	return secret, nil
+}
+
+// RelayTask is the runtime of a relay.
+type RelayTask struct {
+	// The configuration of relay.
+	config *RelayConfig
+	// The runtime state.
+	state RelayState
+	// The time when the last viewer leaves, zero if there are viewers.
+	idleSince time.Time
+	// The time when FFmpeg exits, to avoid too fast restart.
+	exitTime time.Time
+	// To stop the FFmpeg, nil if not running.
+	cancel context.CancelFunc
+}
+
+// RelayWorker starts the relay when there are viewers, and stops it when idle.
+type RelayWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The relay tasks, key is the local stream URL.
+	tasks map[string]*RelayTask
+	// The lock for tasks.
+	lock sync.Mutex
+	// To reconcile the tasks immediately, for example, when a viewer plays.
+	signal chan bool
+}
+
+func NewRelayWorker() *RelayWorker {
+	return &RelayWorker{tasks: make(map[string]*RelayTask), signal: make(chan bool, 1)}
+}
+
+func (v *RelayWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *RelayWorker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "relay: start a worker")
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			if err := v.reconcile(ctx, time.Now()); err != nil {
+				logger.Wf(ctx, "relay: ignore err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-v.signal:
+			case <-time.After(relayInterval):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// OnViewer updates the number of viewers of stream by the on_play and on_stop hooks, ignore if not a relay.
+func (v *RelayWorker) OnViewer(ctx context.Context, stream *SrsStream, delta int64) error {
+	// The relay always publishes to the default vhost.
+	streamURL := fmt.Sprintf("%v/%v", stream.App, stream.Stream)
+	if exists, err := rdb.HExists(ctx, SRS_RELAY_CONFIG, streamURL).Result(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hexists %v %v", SRS_RELAY_CONFIG, streamURL)
+	} else if !exists {
+		return nil
+	}
+
+	viewers, err := rdb.HIncrBy(ctx, SRS_RELAY_VIEWERS, streamURL, delta).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hincrby %v %v %v", SRS_RELAY_VIEWERS, streamURL, delta)
+	}
+
+	// The on_stop might be more than on_play, for example, the platform restarts.
+	if viewers < 0 {
+		if err := rdb.HSet(ctx, SRS_RELAY_VIEWERS, streamURL, 0).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v %v 0", SRS_RELAY_VIEWERS, streamURL)
+		}
+	}
+
+	select {
+	case v.signal <- true:
+	default:
+	}
+
+	logger.Tf(ctx, "relay: stream %v viewers=%v, delta=%v", streamURL, viewers, delta)
+	return nil
+}
+
+// reconcile starts or stops the relay tasks, by the configurations and viewers.
+func (v *RelayWorker) reconcile(ctx context.Context, now time.Time) error {
+	configs, err := queryRelayConfigs(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query configs")
+	}
+
+	viewers, err := rdb.HGetAll(ctx, SRS_RELAY_VIEWERS).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_RELAY_VIEWERS)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// Stop the relays which are removed.
+	for streamURL, task := range v.tasks {
+		if _, ok := configs[streamURL]; ok {
+			continue
+		}
+		if task.cancel != nil {
+			task.cancel()
+		}
+		delete(v.tasks, streamURL)
+		logger.Tf(ctx, "relay: remove %v", streamURL)
+	}
+
+	for streamURL, config := range configs {
+		task, ok := v.tasks[streamURL]
+		if !ok {
+			task = &RelayTask{state: RelayState{Status: "idle"}}
+			v.tasks[streamURL] = task
+		}
+		task.config = config
+
+		var n int64
+		fmt.Sscanf(viewers[streamURL], "%d", &n)
+		task.state.Viewers = n
+
+		running := task.cancel != nil
+		if n > 0 || !running {
+			task.idleSince = time.Time{}
+		} else if task.idleSince.IsZero() {
+			task.idleSince = now
+		}
+
+		// Restart immediately if FFmpeg exits before SRS is ready again, and hold it until SRS is ready.
+		action, reason := relayDecide(config, n, running, task.idleSince, now)
+		if action == RelayActionStart && now.Sub(task.exitTime) < relayRestartInterval &&
+			!task.exitTime.Before(srsReadiness.Since()) {
+			action = RelayActionNone
+		}
+		if !running && !srsReadiness.Ready() {
+			action, task.state.Status = RelayActionNone, string(TaskStatusWaitingSrs)
+		} else if !running && task.state.Status == string(TaskStatusWaitingSrs) {
+			task.state.Status = "idle"
+		}
+
+		if action == RelayActionStart {
+			task.state.Decision = fmt.Sprintf("start at %v, %v", now.Format(time.RFC3339), reason)
+			v.startTask(ctx, streamURL, task)
+		} else if action == RelayActionStop {
+			task.state.Decision = fmt.Sprintf("stop at %v, %v", now.Format(time.RFC3339), reason)
+			task.cancel()
+		}
+		logger.Tf(ctx, "relay: reconcile %v, action=%v, %v", streamURL, action, task.state.String())
+
+		task.state.IdleSince = ""
+		if !task.idleSince.IsZero() {
+			task.state.IdleSince = task.idleSince.Format(time.RFC3339)
+		}
+		if err := v.saveState(ctx, streamURL, &task.state); err != nil {
+			return errors.Wrapf(err, "save %v", streamURL)
+		}
+	}
+
+	return nil
+}
+
+func (v *RelayWorker) saveState(ctx context.Context, streamURL string, state *RelayState) error {
+	state.Update = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(state); err != nil {
+		return errors.Wrapf(err, "marshal %v", state.String())
+	} else if err := rdb.HSet(ctx, SRS_RELAY_TASK, streamURL, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_RELAY_TASK, streamURL, string(b))
+	}
+	return nil
+}
+
+// startTask starts the FFmpeg to relay, note that the lock must be held.
+func (v *RelayWorker) startTask(ctx context.Context, streamURL string, task *RelayTask) {
+	taskCtx, cancel := context.WithCancel(ctx)
+	task.cancel = cancel
+	task.state.Status, task.state.Error = "running", ""
+	config := task.config
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		defer cancel()
+
+		err := v.doRelay(taskCtx, ctx, streamURL, config, task)
+
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		task.cancel, task.exitTime, task.idleSince = nil, time.Now(), time.Time{}
+		task.state.PID, task.state.Start, task.state.IdleSince = 0, "", ""
+		if err != nil && taskCtx.Err() == nil {
+			task.state.Status, task.state.Error = "error", err.Error()
+			logger.Wf(ctx, "relay: %v failed, err %+v", streamURL, err)
+		} else {
+			task.state.Status = "idle"
+		}
+
+		if err := v.saveState(ctx, streamURL, &task.state); err != nil {
+			logger.Wf(ctx, "relay: ignore save %v err %+v", streamURL, err)
+		}
+	}()
+}
+
+// doRelay runs the FFmpeg to pull the source and publish to local stream, until canceled or FFmpeg quit. The
+// parentCtx is for the task history, because ctx might be canceled.
+func (v *RelayWorker) doRelay(
+	ctx, parentCtx context.Context, streamURL string, config *RelayConfig, task *RelayTask,
+) error {
+	source, err := decryptByApiSecret(config.Source)
+	if err != nil {
+		return errors.Wrapf(err, "decrypt source")
+	}
+
+	input, err := RebuildStreamURL(source)
+	if err != nil {
+		return errors.Wrapf(err, "rebuild %v", RedactStreamURL(source))
+	}
+
+	secret, err := queryPublishSecret(ctx, config.Stream)
+	if err != nil {
+		return errors.Wrapf(err, "query secret")
+	}
+	output := fmt.Sprintf("rtmp://localhost/%v/%v", config.App, config.Stream)
+	if secret != "" {
+		output = fmt.Sprintf("%v?secret=%v", output, url.QueryEscape(secret))
+	}
+
+	taskCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	heartbeat := NewFFmpegHeartbeat(cancel)
+	heartbeat.Parse(input)
+
+	args := []string{"-i", input.String(), "-c", "copy", "-f", "flv", output}
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errors.Wrapf(err, "pipe process")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "execute ffmpeg")
+	}
+
+	pid := int32(cmd.Process.Pid)
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		task.state.PID, task.state.Start = pid, time.Now().Format(time.RFC3339)
+	}()
+	logger.Tf(ctx, "relay: start %v, source=%v, pid=%v", streamURL, RedactStreamURL(source), pid)
+	recordTaskEvent(ctx, &TaskEvent{
+		Worker: "relay", Task: config.UUID, Platform: streamURL, Event: TaskEventStarted, PID: pid,
+	})
+
+	// Drain the frame logs, because the heartbeat blocks on it.
+	heartbeat.Polling(ctx, stderr)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-heartbeat.FrameLogs:
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-heartbeat.PollingCtx.Done():
+	}
+
+	err = cmd.Wait()
+	logger.Tf(ctx, "relay: done %v, pid=%v, err=%v", streamURL, pid, err)
+
+	stopped := parentCtx.Err() != nil || taskCtx.Err() != nil
+	recordTaskExit(parentCtx, "relay", config.UUID, streamURL, pid, stopped, heartbeat, err)
+	return err
+}
+
+func (v *RelayWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/ffmpeg/relay/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var userConf RelayConfig
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				*RelayConfig
+			}{
+				Token: &token, RelayConfig: &userConf,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if userConf.App == "" {
+				userConf.App = "live"
+			}
+			if userConf.Stream == "" || strings.ContainsAny(userConf.App+userConf.Stream, "/ \t\r\n") {
+				return errors.Errorf("invalid app=%v, stream=%v", userConf.App, userConf.Stream)
+			}
+			if err := verifyStreamName(ctx, userConf.Stream); err != nil {
+				return errors.Wrapf(err, "verify stream name")
+			}
+			if userConf.IdleTimeout < 0 {
+				return errors.Errorf("invalid idle timeout %v", userConf.IdleTimeout)
+			}
+
+			streamURL := userConf.StreamURL()
+			configs, err := queryRelayConfigs(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query configs")
+			}
+
+			// Encrypt the source, or use the previous one if not changed.
+			if userConf.Source != "" {
+				if err := validateRelaySource(userConf.Source); err != nil {
+					return errors.Wrapf(err, "validate source")
+				}
+				if userConf.Source, err = encryptByApiSecret(userConf.Source); err != nil {
+					return errors.Wrapf(err, "encrypt source")
+				}
+			} else if previous, ok := configs[streamURL]; ok {
+				userConf.Source = previous.Source
+			} else {
+				return errors.New("no source")
+			}
+
+			if previous, ok := configs[streamURL]; ok {
+				userConf.UUID = previous.UUID
+			} else {
+				userConf.UUID = uuid.NewString()
+			}
+			userConf.Update = time.Now().Format(time.RFC3339)
+
+			if b, err := json.Marshal(&userConf); err != nil {
+				return errors.Wrapf(err, "marshal %v", userConf.String())
+			} else if err := rdb.HSet(ctx, SRS_RELAY_CONFIG, streamURL, string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v %v", SRS_RELAY_CONFIG, streamURL)
+			}
+
+			// Restart the relay to apply the new configuration.
+			func() {
+				v.lock.Lock()
+				defer v.lock.Unlock()
+				if task, ok := v.tasks[streamURL]; ok && task.cancel != nil {
+					task.state.Decision = fmt.Sprintf("stop at %v, config changed", time.Now().Format(time.RFC3339))
+					task.cancel()
+				}
+			}()
+			select {
+			case v.signal <- true:
+			default:
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "relay update ok, %v, token=%vB", userConf.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/relay/remove"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, app, stream string
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				App    *string `json:"app"`
+				Stream *string `json:"stream"`
+			}{
+				Token: &token, App: &app, Stream: &stream,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if app == "" {
+				app = "live"
+			}
+			streamURL := fmt.Sprintf("%v/%v", app, stream)
+			for _, key := range []string{SRS_RELAY_CONFIG, SRS_RELAY_TASK, SRS_RELAY_VIEWERS} {
+				if err := rdb.HDel(ctx, key, streamURL).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", key, streamURL)
+				}
+			}
+
+			select {
+			case v.signal <- true:
+			default:
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "relay remove ok, stream=%v, token=%vB", streamURL, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/relay/streams"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			configs, err := queryRelayConfigs(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query configs")
+			}
+
+			states, err := rdb.HGetAll(ctx, SRS_RELAY_TASK).Result()
+			if err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hgetall %v", SRS_RELAY_TASK)
+			}
+
+			res := make([]map[string]interface{}, 0)
+			for streamURL, config := range configs {
+				// Never response the credentials in source.
+				source := "xxxxxx"
+				if plaintext, err := decryptByApiSecret(config.Source); err != nil {
+					logger.Wf(ctx, "relay ignore decrypt %v err %+v", streamURL, err)
+				} else {
+					source = RedactStreamURL(plaintext)
+				}
+
+				elem := map[string]interface{}{
+					"uuid":        config.UUID,
+					"app":         config.App,
+					"stream":      config.Stream,
+					"source":      source,
+					"idleTimeout": int(config.idleTimeout().Seconds()),
+					"enabled":     config.Enabled,
+					"label":       config.Label,
+				}
+
+				if value, ok := states[streamURL]; ok {
+					var state RelayState
+					if err := json.Unmarshal([]byte(value), &state); err != nil {
+						return errors.Wrapf(err, "unmarshal %v", value)
+					}
+					elem["state"] = &state
+				}
+
+				res = append(res, elem)
+			}
+
+			sort.Slice(res, func(i, j int) bool {
+				return res[i]["app"].(string)+res[i]["stream"].(string) < res[j]["app"].(string)+res[j]["stream"].(string)
+			})
+
+			httpWriteData(ctx, w, r, res)
+			logger.Tf(ctx, "relay query streams ok, relays=%v, token=%vB", len(res), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
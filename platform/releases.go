@@ -0,0 +1,288 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The cache duration of release notes, which rarely changes after published.
+const releaseNoteCacheDuration = 24 * time.Hour
+
+// The max length of summary of release notes.
+const releaseNoteSummaryMaxLength = 200
+
+// ReleaseSummary is the brief of a release, for the UI to show with the upgrade prompt.
+type ReleaseSummary struct {
+	// The version of release, for example, v5.14.0
+	Version string `json:"version"`
+	// The title of release.
+	Name string `json:"name,omitempty"`
+	// The URL of release page.
+	URL string `json:"url,omitempty"`
+	// The first paragraph of release notes.
+	Summary string `json:"summary,omitempty"`
+	// The publish time of release.
+	PublishedAt string `json:"publishedAt,omitempty"`
+	// The digest of image, which is an extension to the GitHub releases API, empty if not in the feed.
+	Digest string `json:"digest,omitempty"`
+}
+
+// ReleaseNote is the release notes of a version, cached in redis.
+type ReleaseNote struct {
+	ReleaseSummary
+	// The release notes in markdown, passed through as is for the UI to render.
+	Notes string `json:"notes"`
+	// The update time of cache.
+	Update string `json:"update"`
+}
+
+func (v *ReleaseNote) String() string {
+	return fmt.Sprintf("version=%v, name=%v, url=%v, notes=%vB, update=%v",
+		v.Version, v.Name, v.URL, len(v.Notes), v.Update,
+	)
+}
+
+// queryReleaseNote query the release notes of version from the cache, or the releases feed if not cached or expired.
+// The feed is compatible with the GitHub releases API, see https://docs.github.com/en/rest/releases/releases
+func queryReleaseNote(ctx context.Context, version string) (*ReleaseNote, error) {
+	var cached *ReleaseNote
+	if value, err := rdb.HGet(ctx, SRS_RELEASE_NOTES, version).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_RELEASE_NOTES, version)
+	} else if value != "" {
+		var obj ReleaseNote
+		if err := json.Unmarshal([]byte(value), &obj); err != nil {
+			return nil, errors.Wrapf(err, "json unmarshal %v", value)
+		}
+		cached = &obj
+	}
+
+	if cached != nil {
+		if updateAt, err := time.Parse(time.RFC3339, cached.Update); err == nil {
+			if updateAt.Add(releaseNoteCacheDuration).After(time.Now()) {
+				return cached, nil
+			}
+		}
+	}
+
+	note, err := fetchReleaseNote(ctx, version)
+	if err != nil {
+		// Use the stale cache if failed, because the notes rarely changes after published.
+		if cached != nil {
+			logger.Wf(ctx, "releases: use stale %v, err %+v", cached.String(), err)
+			return cached, nil
+		}
+		return nil, errors.Wrapf(err, "fetch %v", version)
+	}
+
+	if b, err := json.Marshal(note); err != nil {
+		return nil, errors.Wrapf(err, "json marshal %v", note.String())
+	} else if err := rdb.HSet(ctx, SRS_RELEASE_NOTES, version, string(b)).Err(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hset %v %v %v", SRS_RELEASE_NOTES, version, string(b))
+	}
+
+	logger.Tf(ctx, "releases: fetch ok, %v", note.String())
+	return note, nil
+}
+
+// fetchReleaseNote fetch the release notes of version from the releases feed, see env RELEASES_FEED.
+func fetchReleaseNote(ctx context.Context, version string) (*ReleaseNote, error) {
+	feed := fmt.Sprintf("%v/%v", strings.TrimSuffix(envReleasesFeed(), "/"), version)
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feed, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "new request %v", feed)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %v", feed)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", feed)
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("get %v, code=%v, body=%v", feed, res.StatusCode, string(b))
+	}
+
+	var obj struct {
+		TagName     string `json:"tag_name"`
+		Name        string `json:"name"`
+		HtmlURL     string `json:"html_url"`
+		Body        string `json:"body"`
+		PublishedAt string `json:"published_at"`
+		Digest      string `json:"digest"`
+	}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return nil, errors.Wrapf(err, "json unmarshal %v", string(b))
+	}
+
+	return &ReleaseNote{
+		ReleaseSummary: ReleaseSummary{
+			Version: version, Name: obj.Name, URL: obj.HtmlURL, Summary: summarizeReleaseNotes(obj.Body),
+			PublishedAt: obj.PublishedAt, Digest: obj.Digest,
+		},
+		Notes: obj.Body, Update: time.Now().Format(time.RFC3339),
+	}, nil
+}
+
+// summarizeReleaseNotes returns the first paragraph of the markdown, ignore the headings.
+func summarizeReleaseNotes(notes string) string {
+	var lines []string
+	for _, line := range strings.Split(strings.ReplaceAll(notes, "\r\n", "\n"), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			if len(lines) > 0 {
+				break
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	summary := strings.Join(lines, " ")
+	if r := []rune(summary); len(r) > releaseNoteSummaryMaxLength {
+		summary = string(r[:releaseNoteSummaryMaxLength]) + "..."
+	}
+	return summary
+}
+
+// queryReleaseSummaries update the summary, publish time and notes URL of latest and stable release, ignore any error
+// because the release notes is optional.
+func queryReleaseSummaries(ctx context.Context, versions *Versions) {
+	for _, component := range []*ComponentVersion{&versions.Latest, &versions.Stable} {
+		if component.Version == "" {
+			continue
+		}
+		if note, err := queryReleaseNote(ctx, component.Version); err != nil {
+			logger.Wf(ctx, "releases: ignore %v err %+v", component.Version, err)
+		} else {
+			summary := note.ReleaseSummary
+			component.Release, component.PublishedAt, component.NotesURL = &summary, summary.PublishedAt, summary.URL
+			// The digest in feed overwrites the offline default, because it's updated when image is published.
+			if summary.Digest != "" {
+				component.Digest = summary.Digest
+			}
+		}
+	}
+}
+
+func handleMgmtReleases(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/releases"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			versions := conf.Versions()
+			releases := []*ReleaseNote{}
+			for _, version := range []string{versions.Latest.Version, versions.Stable.Version} {
+				if version == "" {
+					continue
+				}
+				if note, err := queryReleaseNote(ctx, version); err != nil {
+					logger.Wf(ctx, "releases: ignore %v err %+v", version, err)
+				} else {
+					releases = append(releases, note)
+				}
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Version  string         `json:"version"`
+				Latest   string         `json:"latest"`
+				Stable   string         `json:"stable"`
+				Releases []*ReleaseNote `json:"releases"`
+			}{
+				Version: versions.Platform.Version, Latest: versions.Latest.Version, Stable: versions.Stable.Version,
+				Releases: releases,
+			})
+			logger.Tf(ctx, "releases query ok, %v, releases=%v, token=%vB",
+				versions.String(), len(releases), len(token),
+			)
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/releases/versions"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			var versionsRefreshed string
+			if t := conf.VersionsRefreshed(); !t.IsZero() {
+				versionsRefreshed = t.Format(time.RFC3339)
+			}
+
+			versions := conf.Versions()
+			httpWriteData(ctx, w, r, &struct {
+				Versions Versions `json:"versions"`
+				// The last time the versions is refreshed, empty if never.
+				VersionsRefreshed string `json:"versionsRefreshed"`
+			}{
+				Versions: versions, VersionsRefreshed: versionsRefreshed,
+			})
+			logger.Tf(ctx, "releases versions ok, %v, token=%vB", versions.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestReleases_SummarizeNotes(t *testing.T) {
+	for _, e := range []struct {
+		notes   string
+		summary string
+	}{
+		{notes: "", summary: ""},
+		{notes: "## What's Changed\r\n\r\nFix HLS.\r\nImprove UI.\r\n\r\n* Other", summary: "Fix HLS. Improve UI."},
+		{notes: "# Title\n* Item 1\n* Item 2", summary: "* Item 1 * Item 2"},
+	} {
+		if summary := summarizeReleaseNotes(e.notes); summary != e.summary {
+			t.Errorf("Fail for %v, summary=%v, expect %v", e.notes, summary, e.summary)
+		}
+	}
+}
+
+func TestReleases_Versions(t *testing.T) {
+	versions := Versions{
+		Platform: ComponentVersion{Version: "v5.15.20"},
+		Stable: ComponentVersion{Version: "v5.14.0", PublishedAt: "2024-03-01T10:00:00Z",
+			Release: &ReleaseSummary{Version: "v5.14.0"}},
+		Latest: ComponentVersion{Version: "v5.15.0"},
+	}
+	if v := versions.String(); v != "platform v5.15.20, stable v5.14.0 (2024-03-01), latest v5.15.0, api unknown" {
+		t.Errorf("Fail for %v", v)
+	}
+
+	// The existing endpoints keep the shape of previous releases.
+	b, _ := json.Marshal(versions.Compatible())
+	var compatible map[string]interface{}
+	if err := json.Unmarshal(b, &compatible); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if compatible["version"] != "v5.15.20" || compatible["stable"] != "v5.14.0" || compatible["latest"] != "v5.15.0" ||
+		compatible["stableRelease"] == nil || compatible["latestRelease"] != nil {
+		t.Errorf("Fail for %v", string(b))
+	}
+
+	b, _ = json.Marshal(versions)
+	var rich map[string]map[string]interface{}
+	if err := json.Unmarshal(b, &rich); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if rich["stable"]["version"] != "v5.14.0" || rich["stable"]["publishedAt"] != "2024-03-01T10:00:00Z" ||
+		rich["platform"]["version"] != "v5.15.20" || rich["api"]["version"] != "" {
+		t.Errorf("Fail for %v", string(b))
+	}
+}
+
+func TestReleases_QueryNoteWithCache(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	var requests int
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/releases/v5.14.0" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{
+			"name": "Oryx v5.14.0", "html_url": "https://example.com/v5.14.0", "body": "Support **HEVC**.",
+		})
+	}))
+	defer feed.Close()
+
+	oldFeed := os.Getenv("RELEASES_FEED")
+	os.Setenv("RELEASES_FEED", feed.URL+"/releases/")
+	defer os.Setenv("RELEASES_FEED", oldFeed)
+
+	for i := 0; i < 2; i++ {
+		if note, err := queryReleaseNote(ctx, "v5.14.0"); err != nil {
+			t.Errorf("Fail for err %+v", err)
+		} else if note.Notes != "Support **HEVC**." || note.Summary != note.Notes || note.URL != "https://example.com/v5.14.0" {
+			t.Errorf("Fail for note %v", note.String())
+		}
+	}
+	if requests != 1 {
+		t.Errorf("Fail for requests=%v, expect cached", requests)
+	}
+
+	// Use the stale cache if the feed fails.
+	stale, _ := json.Marshal(&ReleaseNote{
+		ReleaseSummary: ReleaseSummary{Version: "v5.13.0"}, Notes: "Stale.",
+		Update: time.Now().Add(-2 * releaseNoteCacheDuration).Format(time.RFC3339),
+	})
+	server.HSet(SRS_RELEASE_NOTES, "v5.13.0", string(stale))
+	if note, err := queryReleaseNote(ctx, "v5.13.0"); err != nil || note.Notes != "Stale." {
+		t.Errorf("Fail for stale note %v, err %+v", note, err)
+	}
+
+	// Never fail the versions for release notes.
+	versions := &Versions{Latest: ComponentVersion{Version: "v5.14.0"}, Stable: ComponentVersion{Version: "v5.12.0"}}
+	queryReleaseSummaries(ctx, versions)
+	if r := versions.Latest; r.Release == nil || r.Release.Summary != "Support **HEVC**." ||
+		r.NotesURL != "https://example.com/v5.14.0" {
+		t.Errorf("Fail for latest %v", r)
+	}
+	if versions.Stable.Release != nil {
+		t.Errorf("Fail for stable %v", versions.Stable)
+	}
+}
@@ -7,11 +7,32 @@ import (
 	"context"
 )
 
+// The versions of release channels and the API service, which should be the same to releases/version.go, because we
+// don't query the version from API anymore.
+const (
+	releasesStable = "v1.0.193"
+	releasesLatest = "v1.0.307"
+	releasesAPI    = "v1.0.374"
+)
+
+// The expected digest of image for the release channels, the offline default when the releases feed has no digest,
+// which should also be the same to releases/version.go. Empty if not pinned.
+const (
+	releasesStableDigest = ""
+	releasesLatestDigest = ""
+)
+
 // queryLatestVersion is to query the latest and stable version from Oryx API.
 func queryLatestVersion(ctx context.Context) (*Versions, error) {
-	return &Versions{
-		Version: version,
-		Stable:  "v1.0.193",
-		Latest:  "v1.0.307",
-	}, nil
+	versions := &Versions{
+		Platform: ComponentVersion{Version: version},
+		Stable:   ComponentVersion{Version: releasesStable, Digest: releasesStableDigest},
+		Latest:   ComponentVersion{Version: releasesLatest, Digest: releasesLatestDigest},
+		API:      ComponentVersion{Version: releasesAPI},
+	}
+
+	// Never fail for release notes, which is optional for the upgrade prompt.
+	queryReleaseSummaries(ctx, versions)
+
+	return versions, nil
 }
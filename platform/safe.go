@@ -0,0 +1,142 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	"github.com/google/uuid"
+)
+
+// The interval to restart the periodic task after panic, to avoid busy loop if it always panics.
+const safeRestartInterval = 3 * time.Second
+
+// PanicMetrics is the number of recovered panics.
+type PanicMetrics struct {
+	// The panics in HTTP handlers.
+	HTTP int64 `json:"http"`
+	// The panics in background goroutines.
+	Goroutine int64 `json:"goroutine"`
+}
+
+var panicMetrics PanicMetrics
+
+// queryPanicMetrics returns the snapshot of panic metrics.
+func queryPanicMetrics() *PanicMetrics {
+	return &PanicMetrics{
+		HTTP: atomic.LoadInt64(&panicMetrics.HTTP), Goroutine: atomic.LoadInt64(&panicMetrics.Goroutine),
+	}
+}
+
+// safe runs fn and recovers the panic, which is logged with stack, for background goroutines, for example:
+//
+//	go safe(ctx, func() { ... })
+func safe(ctx context.Context, fn func()) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddInt64(&panicMetrics.Goroutine, 1)
+			logger.Ef(ctx, "recover from panic %v, stack is %v", r, string(debug.Stack()))
+		}
+	}()
+	fn()
+}
+
+// safeRestart runs fn like safe, and restarts it after a while if panics, until ctx is done. It's for the periodic
+// task which should never quit, and it returns when fn returns normally.
+func safeRestart(ctx context.Context, fn func()) {
+	for {
+		panicked := true
+		safe(ctx, func() {
+			fn()
+			panicked = false
+		})
+		if !panicked {
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(safeRestartInterval):
+		}
+		logger.Wf(ctx, "restart periodic task after panic")
+	}
+}
+
+// httpRecover serves the request by handler, and responses 500 with the request ID if the handler panics. The
+// request ID is from header X-Request-Id, or generated, and always responded in header X-Request-Id.
+func httpRecover(w http.ResponseWriter, r *http.Request, handler http.Handler) {
+	requestID := r.Header.Get("X-Request-Id")
+	if requestID == "" || len(requestID) > 64 {
+		requestID = uuid.NewString()
+	}
+	w.Header().Set("X-Request-Id", requestID)
+
+	defer func() {
+		r0 := recover()
+		if r0 == nil {
+			return
+		}
+		// The ErrAbortHandler is used to abort the response, which should be handled by HTTP server.
+		if r0 == http.ErrAbortHandler {
+			panic(r0)
+		}
+
+		atomic.AddInt64(&panicMetrics.HTTP, 1)
+		ctx := logger.WithContext(r.Context())
+		logger.Ef(ctx, "recover from panic %v, request=%v, path=%v, stack is %v",
+			r0, requestID, r.URL.Path, string(debug.Stack()),
+		)
+
+		// Never respond the panic, which might contain sensitive information.
+		httpWriteError(ctx, w, r, newHttpCodeError(http.StatusInternalServerError, SrsStackErrorInternal,
+			errors.Errorf("internal error, request %v", requestID),
+		))
+	}()
+
+	handler.ServeHTTP(w, r)
+}
+
+// BoundedPool runs functions concurrently in goroutines, but at most size at the same time, for the fan-out work which
+// should not overwhelm the redis or system. The panic of function is recovered like safe.
+type BoundedPool struct {
+	ctx   context.Context
+	slots chan bool
+	wg    sync.WaitGroup
+}
+
+func NewBoundedPool(ctx context.Context, size int) *BoundedPool {
+	if size <= 0 {
+		size = 1
+	}
+	return &BoundedPool{ctx: ctx, slots: make(chan bool, size)}
+}
+
+// Go runs fn in a goroutine, it blocks if there are already size functions running.
+func (v *BoundedPool) Go(fn func()) {
+	v.wg.Add(1)
+	v.slots <- true
+
+	go safe(v.ctx, func() {
+		defer func() {
+			<-v.slots
+			v.wg.Done()
+		}()
+		fn()
+	})
+}
+
+// Wait for all functions to finish.
+func (v *BoundedPool) Wait() {
+	v.wg.Wait()
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestSafe_RecoverHandlerPanic(t *testing.T) {
+	panics := queryPanicMetrics().HTTP
+
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("secret detail")
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/terraform/v1/mgmt/test", nil)
+	r.Header.Set("X-Request-Id", "req-1")
+	w := httptest.NewRecorder()
+	httpRecover(newHttpResponseGuard(w), r, handler)
+
+	if w.Code != http.StatusInternalServerError || w.Header().Get("X-Request-Id") != "req-1" {
+		t.Errorf("Fail for code=%v, header=%v", w.Code, w.Header())
+	}
+	if body := w.Body.String(); !strings.Contains(body, `"code":2009`) || !strings.Contains(body, "req-1") ||
+		strings.Contains(body, "secret detail") {
+		t.Errorf("Fail for body %v", body)
+	}
+	if n := queryPanicMetrics().HTTP; n != panics+1 {
+		t.Errorf("Fail for panics %v, expect %v", n, panics+1)
+	}
+
+	// Generate the request ID if not specified.
+	w = httptest.NewRecorder()
+	httpRecover(w, httptest.NewRequest(http.MethodPost, "/", nil), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	if w.Code != http.StatusOK || w.Header().Get("X-Request-Id") == "" {
+		t.Errorf("Fail for code=%v, header=%v", w.Code, w.Header())
+	}
+}
+
+func TestSafe_RecoverGoroutinePanic(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+	panics := queryPanicMetrics().Goroutine
+
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		safe(ctx, func() {
+			panic("oops")
+		})
+	}()
+	<-done
+
+	// The periodic task is not restarted if ctx is done, and returns when task returns normally.
+	var runs int
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	safeRestart(canceled, func() {
+		runs++
+		panic("oops")
+	})
+	safeRestart(ctx, func() {
+		runs++
+	})
+
+	if runs != 2 {
+		t.Errorf("Fail for runs %v", runs)
+	}
+	if n := queryPanicMetrics().Goroutine; n != panics+2 {
+		t.Errorf("Fail for panics %v, expect %v", n, panics+2)
+	}
+}
+
+func TestSafe_BoundedPool(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	var running, maxRunning, finished int64
+	pool := NewBoundedPool(ctx, 3)
+	for i := 0; i < 10; i++ {
+		i := i
+		pool.Go(func() {
+			defer atomic.AddInt64(&finished, 1)
+
+			n := atomic.AddInt64(&running, 1)
+			defer atomic.AddInt64(&running, -1)
+			for {
+				if m := atomic.LoadInt64(&maxRunning); n <= m || atomic.CompareAndSwapInt64(&maxRunning, m, n) {
+					break
+				}
+			}
+
+			time.Sleep(10 * time.Millisecond)
+			if i == 5 {
+				panic("oops")
+			}
+		})
+	}
+	pool.Wait()
+
+	if finished != 10 || maxRunning > 3 || maxRunning < 2 {
+		t.Errorf("Fail for finished=%v, maxRunning=%v", finished, maxRunning)
+	}
+}
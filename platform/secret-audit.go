@@ -0,0 +1,184 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max number of api secret queries in audit log.
+const secretAuditMaxEntries = 1000
+
+// The duration to wait for invalid password, same to login, to slow down guessing the password by a leaked token.
+var secretQueryInvalidPasswordWait = 10 * time.Second
+
+// The methods to authenticate for the api secret.
+const (
+	secretQueryMethodBearer   = "bearer"
+	secretQueryMethodPassword = "password"
+	secretQueryMethodAdmin    = "admin-token"
+)
+
+// SecretAudit is an attempt to query the api secret, allowed or rejected.
+type SecretAudit struct {
+	// The time of attempt.
+	Time string `json:"time"`
+	// The client IP of caller.
+	IP string `json:"ip"`
+	// How the caller is authenticated, bearer, password or admin-token, empty if rejected.
+	Method string `json:"method,omitempty"`
+	// Whether the query is allowed.
+	Allowed bool `json:"allowed"`
+	// The error code if rejected. Note that we never log the error message, which might contain the token.
+	Code SrsStackError `json:"code,omitempty"`
+}
+
+func (v *SecretAudit) String() string {
+	return fmt.Sprintf("time=%v, ip=%v, method=%v, allowed=%v, code=%v",
+		v.Time, v.IP, v.Method, v.Allowed, v.Code,
+	)
+}
+
+// authenticateAdmin authenticates the caller, and requires the admin scope of token which is only created by login,
+// or the admin password, or the bearer api secret itself. It returns the method to authenticate.
+func authenticateAdmin(ctx context.Context, apiSecret, token, password string, header http.Header) (string, error) {
+	if envMgmtSecretQuery() == "off" {
+		return "", newHttpCodeError(http.StatusForbidden, SrsStackErrorFeatureDisabled,
+			errors.New("secret query is disabled by MGMT_SECRET_QUERY"),
+		)
+	}
+
+	if err := Authenticate(ctx, apiSecret, token, header); err != nil {
+		return "", errors.Wrapf(err, "authenticate")
+	}
+
+	// The bearer is the api secret itself, see authenticate.
+	if header.Get("Authorization") != "" {
+		return secretQueryMethodBearer, nil
+	}
+
+	if password != "" {
+		mgmtPassword := envMgmtPassword()
+		if mgmtPassword == "" || subtle.ConstantTimeCompare([]byte(password), []byte(mgmtPassword)) != 1 {
+			select {
+			case <-time.After(secretQueryInvalidPasswordWait):
+			case <-ctx.Done():
+			}
+			return "", newHttpCodeError(http.StatusForbidden, SrsStackErrorAdminRequired, errors.Errorf(
+				"invalid password, wait %v", secretQueryInvalidPasswordWait,
+			))
+		}
+		return secretQueryMethodPassword, nil
+	}
+
+	if introspectToken(apiSecret, token).Scope == tokenScopeAdmin {
+		return secretQueryMethodAdmin, nil
+	}
+
+	return "", newHttpCodeError(http.StatusForbidden, SrsStackErrorAdminRequired,
+		errors.New("token without admin scope, please login or present the password"),
+	)
+}
+
+// recordSecretAudit saves the attempt to audit log. It never fails, because the audit should not change the result.
+func recordSecretAudit(ctx context.Context, r *http.Request, method string, err error) {
+	audit := &SecretAudit{
+		Time: time.Now().Format(time.RFC3339), IP: clientIP(r), Method: method, Allowed: err == nil,
+	}
+	if cause, ok := errors.Cause(err).(*httpStatusError); ok {
+		audit.Code = cause.code
+	}
+
+	if err := func() error {
+		b, err := json.Marshal(audit)
+		if err != nil {
+			return errors.Wrapf(err, "marshal %v", audit.String())
+		}
+
+		return bufferedRedisWrite(ctx, "secret audit", func(ctx context.Context, pipe redis.Pipeliner) {
+			pipe.LPush(ctx, SRS_SECRET_AUDIT, string(b))
+			pipe.LTrim(ctx, SRS_SECRET_AUDIT, 0, secretAuditMaxEntries-1)
+		})
+	}(); err != nil {
+		logger.Wf(ctx, "secret audit ignore %v err %+v", audit.String(), err)
+		return
+	}
+
+	logger.Tf(ctx, "secret audit ok, %v", audit.String())
+}
+
+// rangeSecretAudits callback for each attempt in audit log, the latest first, without loading all of them.
+func rangeSecretAudits(ctx context.Context, handler func(audit *SecretAudit) error) error {
+	return rangeRedisList(ctx, SRS_SECRET_AUDIT, secretAuditMaxEntries, func(value string) error {
+		var audit SecretAudit
+		if err := json.Unmarshal([]byte(value), &audit); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", value)
+		}
+		return handler(&audit)
+	})
+}
+
+// querySecretAudits returns the attempts in audit log, the latest first.
+func querySecretAudits(ctx context.Context) ([]*SecretAudit, error) {
+	var audits []*SecretAudit
+	if err := rangeSecretAudits(ctx, func(audit *SecretAudit) error {
+		audits = append(audits, audit)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "range audits")
+	}
+	return audits, nil
+}
+
+func handleMgmtSecretAudit(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/secret/audit"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Stream the audits, in the same envelope of httpWriteData, see JSONArrayWriter.
+			aw := NewJSONArrayWriter(w, "audits")
+			if err := rangeSecretAudits(ctx, func(audit *SecretAudit) error {
+				return aw.Write(audit)
+			}); err != nil {
+				return errors.Wrapf(err, "range audits")
+			}
+			if err := aw.Close(); err != nil {
+				return errors.Wrapf(err, "close")
+			}
+			logger.Tf(ctx, "secret audit query ok, audits=%v, token=%vB", aw.Elements(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestSecretQuery_RequireAdminScope(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	setupFakeRedis(t)
+
+	secret := "srs-v2-0123456789abcdef"
+	oldPassword, oldWait := os.Getenv("MGMT_PASSWORD"), secretQueryInvalidPasswordWait
+	os.Setenv("SRS_PLATFORM_SECRET", secret)
+	os.Setenv("MGMT_PASSWORD", "admin-password")
+	secretQueryInvalidPasswordWait = time.Millisecond
+	defer func() {
+		secretQueryInvalidPasswordWait = oldWait
+		os.Setenv("MGMT_PASSWORD", oldPassword)
+		os.Unsetenv("MGMT_SECRET_QUERY")
+	}()
+
+	handler := http.NewServeMux()
+	handleMgmtSecretQuery(ctx, handler)
+	handleMgmtSecretAudit(ctx, handler)
+
+	request := func(api, authorization, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, api, strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	_, _, refreshed, err := createToken(ctx, secret)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	_, _, admin, err := createTokenWithScope(ctx, secret, tokenScopeAdmin)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	for _, c := range []struct {
+		authorization, body string
+		code                int
+	}{
+		{"", `{"token":"` + refreshed + `"}`, http.StatusForbidden},
+		{"", `{"token":"` + refreshed + `","password":"guess"}`, http.StatusForbidden},
+		{"", `{"token":"` + refreshed + `","password":"admin-password"}`, http.StatusOK},
+		{"", `{"token":"` + admin + `"}`, http.StatusOK},
+		{"Bearer " + secret, `{}`, http.StatusOK},
+		{"", `{"token":"invalid"}`, http.StatusUnauthorized},
+	} {
+		w := request("/terraform/v1/mgmt/secret/query", c.authorization, c.body)
+		if w.Code != c.code {
+			t.Errorf("Fail for %v, code=%v, body=%v", c.body, w.Code, w.Body.String())
+		} else if c.code == http.StatusOK && !strings.Contains(w.Body.String(), secret) {
+			t.Errorf("Fail for %v, body=%v", c.body, w.Body.String())
+		}
+	}
+
+	// Disabled for all callers, even the bearer.
+	os.Setenv("MGMT_SECRET_QUERY", "off")
+	if w := request("/terraform/v1/mgmt/secret/query", "Bearer "+secret, `{}`); w.Code != http.StatusForbidden ||
+		strings.Contains(w.Body.String(), secret) {
+		t.Errorf("Fail for code=%v, body=%v", w.Code, w.Body.String())
+	}
+
+	// Every attempt is in audit log, with the caller IP, but without the token.
+	var res struct {
+		Data struct {
+			Audits []*SecretAudit `json:"audits"`
+		} `json:"data"`
+	}
+	w := request("/terraform/v1/mgmt/secret/audit", "Bearer "+secret, `{}`)
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || len(res.Data.Audits) != 7 {
+		t.Fatalf("Fail for body %v, err %+v", w.Body.String(), err)
+	}
+	if strings.Contains(w.Body.String(), refreshed) || strings.Contains(w.Body.String(), "invalid") {
+		t.Errorf("Fail for token in audit %v", w.Body.String())
+	}
+	for i, method := range []string{"", "", secretQueryMethodBearer, secretQueryMethodAdmin, secretQueryMethodPassword, "", ""} {
+		if a := res.Data.Audits[i]; a.Method != method || a.Allowed != (method != "") || a.IP == "" {
+			t.Errorf("Fail for %v, %v", i, a.String())
+		}
+	}
+	if a := res.Data.Audits[0]; a.Code != SrsStackErrorFeatureDisabled {
+		t.Errorf("Fail for %v", a.String())
+	}
+	if a := res.Data.Audits[5]; a.Code != SrsStackErrorAdminRequired {
+		t.Errorf("Fail for %v", a.String())
+	}
+}
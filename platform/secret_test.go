@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/joho/godotenv"
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestApiSecret_Reconcile(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	oldRdb, oldConf, oldSecret := rdb, conf, os.Getenv("SRS_PLATFORM_SECRET")
+	defer func() {
+		rdb, conf = oldRdb, oldConf
+		os.Setenv("SRS_PLATFORM_SECRET", oldSecret)
+	}()
+
+	for _, e := range []struct {
+		name   string
+		env    string
+		redis  string
+		source ApiSecretSource
+	}{
+		{name: "env only", env: "srs-v2-env-0123456789", source: ApiSecretSourceEnv},
+		{name: "redis only", redis: "srs-v2-redis-0123456789", source: ApiSecretSourceRedis},
+		{name: "env differs from redis", env: "srs-v2-env-0123456789", redis: "srs-v2-redis-0123456789", source: ApiSecretSourceRedis},
+		{name: "neither", source: ApiSecretSourceGenerated},
+		{name: "weak env", env: "weak", source: ApiSecretSourceGenerated},
+	} {
+		func() {
+			server := newFakeRedis(t)
+			defer server.Close()
+
+			rdb = redis.NewClient(&redis.Options{Addr: server.Addr()})
+			defer rdb.Close()
+
+			pwd, err := ioutil.TempDir("", "oryx-secret-")
+			if err != nil {
+				t.Fatalf("Fail for err %+v", err)
+			}
+			defer os.RemoveAll(pwd)
+			conf = &Config{Pwd: pwd}
+
+			os.Setenv("SRS_PLATFORM_SECRET", e.env)
+			if e.redis != "" {
+				server.HSet(SRS_PLATFORM_SECRET, "token", e.redis)
+			}
+
+			if err := initApiSecret(ctx); err != nil {
+				t.Errorf("Fail for %v err %+v", e.name, err)
+				return
+			}
+
+			token, _ := server.HGet(SRS_PLATFORM_SECRET, "token")
+			if conf.SecretSource != e.source || token == "" || envApiSecret() != token {
+				t.Errorf("Fail for %v, source=%v, redis=%v, env=%v", e.name, conf.SecretSource, token, envApiSecret())
+			}
+			if e.redis != "" && token != e.redis {
+				t.Errorf("Fail for %v, redis changed to %v", e.name, token)
+			}
+
+			// The .env is reconciled if env is empty or differs from redis.
+			envs, _ := godotenv.Read(path.Join(pwd, "containers/data/config/.env"))
+			if expect := e.env != token; (envs["SRS_PLATFORM_SECRET"] == token) != expect {
+				t.Errorf("Fail for %v, .env=%v, expect reconcile=%v", e.name, envs, expect)
+			}
+		}()
+	}
+}
+
+func TestApiSecret_FailClosedIfWeak(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	// The token signed by empty secret, which is valid if verified by an empty HMAC key.
+	claims := jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(""))
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	for _, secret := range []string{"", "short"} {
+		err := Authenticate(ctx, secret, token, http.Header{})
+		if cause, ok := errors.Cause(err).(*httpStatusError); !ok || cause.code != SrsStackErrorNotConfigured ||
+			cause.status != http.StatusServiceUnavailable {
+			t.Errorf("Fail for secret %vB, err %+v", len(secret), err)
+		}
+		if _, _, _, err := createToken(ctx, secret); err == nil {
+			t.Errorf("Fail for secret %vB should not sign", len(secret))
+		}
+	}
+
+	// The token signed by other secret, or by none algorithm, is rejected.
+	secret := "srs-v2-0123456789abcdef"
+	if err := Authenticate(ctx, secret, token, http.Header{}); err == nil {
+		t.Errorf("Fail for empty-secret token accepted")
+	}
+	if none, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	} else if err := Authenticate(ctx, secret, none, http.Header{}); err == nil {
+		t.Errorf("Fail for none token accepted")
+	}
+
+	if _, _, token, err := createToken(ctx, secret); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	} else if err := Authenticate(ctx, secret, token, http.Header{}); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+}
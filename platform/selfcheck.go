@@ -0,0 +1,213 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The result of last self-check, which is done when startup.
+var selfCheckResult *SelfCheckResult
+
+// SelfCheckResult is the result of startup self-check and repair.
+type SelfCheckResult struct {
+	// Whether the last shutdown is unclean, for example, power loss.
+	Unclean bool `json:"unclean"`
+	// The repairs we have done.
+	Repairs []string `json:"repairs"`
+	// The time we start the self-check.
+	Starttime string `json:"starttime"`
+	// The elapsed time in milliseconds.
+	Elapsed int64 `json:"elapsed"`
+}
+
+func (v *SelfCheckResult) String() string {
+	return fmt.Sprintf("unclean=%v, repairs=%v, starttime=%v, elapsed=%vms",
+		v.Unclean, len(v.Repairs), v.Starttime, v.Elapsed,
+	)
+}
+
+func (v *SelfCheckResult) repair(ctx context.Context, format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	v.Repairs = append(v.Repairs, msg)
+	logger.Wf(ctx, "selfcheck: repair %v", msg)
+}
+
+// runSelfCheck reconciles the state in redis and files, which might be stale after an unclean shutdown.
+// Note that it must run after redis is ready, and before the workers start.
+func runSelfCheck(ctx context.Context) (*SelfCheckResult, error) {
+	starttime := time.Now()
+	r := &SelfCheckResult{Starttime: starttime.Format(time.RFC3339), Repairs: []string{}}
+
+	// If the running flag is not cleared, the last shutdown is unclean.
+	if running, err := rdb.HGet(ctx, SRS_SELF_CHECK, "running").Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v running", SRS_SELF_CHECK)
+	} else if running == "1" {
+		r.Unclean = true
+	}
+	if err := rdb.HSet(ctx, SRS_SELF_CHECK, "running", "1").Err(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hset %v running 1", SRS_SELF_CHECK)
+	}
+
+	// Cancel upgrading, because the platform is restarted, the upgrading flag is always stale.
+	if upgrading, err := rdb.HGet(ctx, SRS_UPGRADING, "upgrading").Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v upgrading", SRS_UPGRADING)
+	} else if upgrading == "1" {
+		if err = rdb.HSet(ctx, SRS_UPGRADING, "upgrading", "0").Err(); err != nil && err != redis.Nil {
+			return nil, errors.Wrapf(err, "hset %v upgrading 0", SRS_UPGRADING)
+		}
+		r.repair(ctx, "clear stale upgrading flag")
+	}
+
+	// Verify the generated NGINX config, which might be half-written.
+	if err := selfCheckNginxConfig(ctx, r); err != nil {
+		return nil, errors.Wrapf(err, "check nginx config")
+	}
+
+	// Reconcile the task records against the running FFmpeg processes.
+	for _, key := range []string{SRS_FORWARD_TASK, SRS_VLIVE_TASK, SRS_CAMERA_TASK, SRS_TRANSCODE_TASK} {
+		if err := selfCheckTasks(ctx, r, key); err != nil {
+			return nil, errors.Wrapf(err, "check tasks %v", key)
+		}
+	}
+
+	r.Elapsed = int64(time.Since(starttime) / time.Millisecond)
+	logger.Tf(ctx, "selfcheck: done, %v, repairs=[%v]", r.String(), strings.Join(r.Repairs, "; "))
+	return r, nil
+}
+
+// stopSelfCheck clears the running flag when shutdown gracefully.
+func stopSelfCheck(ctx context.Context) {
+	if err := rdb.HSet(ctx, SRS_SELF_CHECK, "running", "0").Err(); err != nil && err != redis.Nil {
+		logger.Wf(ctx, "selfcheck: ignore hset %v running 0 err %+v", SRS_SELF_CHECK, err)
+	}
+}
+
+// isNginxConfigComplete whether the config file is completely written. The file is always started by the comment,
+// and ended by two empty lines, see nginxGenerateConfig.
+func isNginxConfigComplete(content string) bool {
+	return strings.HasPrefix(content, "# !!! Important:") && strings.HasSuffix(content, "\n\n")
+}
+
+// selfCheckNginxConfig regenerates the NGINX config if any file is missing or incomplete.
+func selfCheckNginxConfig(ctx context.Context, r *SelfCheckResult) error {
+	var corrupted []string
+	for _, name := range []string{"nginx.http.conf", "nginx.server.conf"} {
+		fileName := path.Join(conf.Pwd, "containers/data/config", name)
+		b, err := os.ReadFile(fileName)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "read %v", fileName)
+		}
+
+		// Ignore if not exists, which will be generated when first boot.
+		if os.IsNotExist(err) {
+			continue
+		}
+
+		if !isNginxConfigComplete(string(b)) {
+			corrupted = append(corrupted, name)
+		}
+	}
+
+	if len(corrupted) == 0 {
+		return nil
+	}
+
+	if err := nginxGenerateConfig(ctx, NginxTriggerSelfCheck); err != nil {
+		return errors.Wrapf(err, "nginx config and reload")
+	}
+	r.repair(ctx, "regenerate incomplete nginx config %v", strings.Join(corrupted, ","))
+	return nil
+}
+
+// selfCheckTasks clears the pid of task records, if the process is not FFmpeg any more. Because the pid
+// might be reused by other process after restart, we should never kill it when worker starts.
+func selfCheckTasks(ctx context.Context, r *SelfCheckResult, key string) error {
+	objs, err := rdb.HGetAll(ctx, key).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", key)
+	}
+
+	for id, obj := range objs {
+		var task map[string]interface{}
+		if err := json.Unmarshal([]byte(obj), &task); err != nil {
+			return errors.Wrapf(err, "unmarshal %v %v", id, obj)
+		}
+
+		pid, ok := task["pid"].(float64)
+		if !ok || pid <= 0 {
+			continue
+		}
+
+		// If the process is still FFmpeg, it's an orphan process which will be killed by worker.
+		cmdline, err := os.ReadFile(fmt.Sprintf("/proc/%v/cmdline", int(pid)))
+		if err == nil && strings.Contains(string(cmdline), "ffmpeg") {
+			continue
+		}
+
+		task["pid"] = 0
+		if b, err := json.Marshal(task); err != nil {
+			return errors.Wrapf(err, "marshal %v", task)
+		} else if err = rdb.HSet(ctx, key, id, string(b)).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v %v %v", key, id, string(b))
+		}
+		r.repair(ctx, "clear stale pid %v of task %v in %v", int(pid), id, key)
+	}
+	return nil
+}
+
+func handleMgmtSelfCheck(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/selfcheck"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if selfCheckResult == nil {
+				return errors.New("no selfcheck result")
+			}
+
+			// The clock is checked periodically, so it's the latest state rather than the one when startup.
+			httpWriteData(ctx, w, r, &struct {
+				*SelfCheckResult
+				Clock *ClockState `json:"clock"`
+			}{
+				SelfCheckResult: selfCheckResult, Clock: clockChecker.State(),
+			})
+			logger.Tf(ctx, "selfcheck query ok, %v, token=%vB", selfCheckResult.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -8,10 +8,10 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
-	"github.com/joho/godotenv"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"os"
 	"path"
 	"runtime"
 	"strconv"
@@ -29,15 +29,27 @@ import (
 // HttpService is a HTTP server for platform.
 type HttpService interface {
 	Close() error
+	// Start listens and serves the startup status by the gate, before the service is ready.
+	Start(ctx context.Context) error
+	// Run serves all the endpoints, and waits for the servers to quit.
 	Run(ctx context.Context) error
 }
 
-func NewHTTPService() HttpService {
-	return &httpService{}
+func NewHTTPService(gate *startupGate) HttpService {
+	return &httpService{gate: gate}
 }
 
 type httpService struct {
 	servers []*http.Server
+	// The gate to serve the startup status, until switches to the full handler by Run.
+	gate *startupGate
+	// The context of servers, cancelled when any server quit.
+	ctx    context.Context
+	cancel context.CancelFunc
+	// The servers are done, and the errors of servers.
+	wg   sync.WaitGroup
+	errs []error
+	lock sync.Mutex
 }
 
 func (v *httpService) Close() error {
@@ -64,9 +76,10 @@ func (v *httpService) Close() error {
 	return nil
 }
 
-func (v *httpService) Run(ctx context.Context) error {
-	var wg sync.WaitGroup
-	defer wg.Wait()
+func (v *httpService) Start(ctx context.Context) error {
+	if v.ctx != nil {
+		return nil
+	}
 
 	// For debugging server, listen at 127.0.0.1:22022
 	go func() {
@@ -76,34 +89,13 @@ func (v *httpService) Run(ctx context.Context) error {
 		server.ListenAndServe()
 	}()
 
-	ctx, cancel := context.WithCancel(ctx)
+	v.ctx, v.cancel = context.WithCancel(ctx)
+	ctx, cancel := v.ctx, v.cancel
 
-	handler := http.NewServeMux()
-	if true {
-		serviceHandler := http.NewServeMux()
-		if err := handleHTTPService(ctx, serviceHandler); err != nil {
-			return errors.Wrapf(err, "handle service")
-		}
+	// Serve by the gate, which only responds /healthz and starting up, until Run switches to the full handler. Strip
+	// the base path before the gate, so that all handlers serve the path from root.
+	handler := newBasePathHandler(v.gate)
 
-		handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-			// Set common header.
-			ohttp.SetHeader(w)
-
-			// Always allow CORS.
-			httpAllowCORS(w, r)
-
-			// Allow OPTIONS for CORS.
-			if r.Method == http.MethodOptions {
-				w.Write(nil)
-				return
-			}
-
-			// Handle by service handler.
-			serviceHandler.ServeHTTP(w, r)
-		})
-	}
-
-	var r0 error
 	if true {
 		addr := envPlatformListen()
 		if !strings.HasPrefix(addr, ":") {
@@ -111,29 +103,28 @@ func (v *httpService) Run(ctx context.Context) error {
 		}
 		logger.Tf(ctx, "HTTP listen at %v", addr)
 
-		server := &http.Server{Addr: addr, Handler: handler}
+		server := &http.Server{Addr: addr, Handler: handler, ConnContext: httpConnContext}
 		v.servers = append(v.servers, server)
 
-		wg.Add(1)
+		v.wg.Add(1)
 		go func() {
-			defer wg.Done()
+			defer v.wg.Done()
 			<-ctx.Done()
 			logger.Tf(ctx, "shutting down HTTP server, addr=%v", addr)
 			v.Close()
 		}()
 
-		wg.Add(1)
+		v.wg.Add(1)
 		go func() {
-			defer wg.Done()
+			defer v.wg.Done()
 			defer cancel()
 			if err := server.ListenAndServe(); err != nil && ctx.Err() != context.Canceled {
-				r0 = errors.Wrapf(err, "listen %v", addr)
+				v.onError(errors.Wrapf(err, "listen %v", addr))
 			}
 			logger.Tf(ctx, "HTTP server is done, addr=%v", addr)
 		}()
 	}
 
-	var r1 error
 	if true {
 		addr := envMgmtListen()
 		if !strings.HasPrefix(addr, ":") {
@@ -141,29 +132,28 @@ func (v *httpService) Run(ctx context.Context) error {
 		}
 		logger.Tf(ctx, "HTTP listen at %v", addr)
 
-		server := &http.Server{Addr: addr, Handler: handler}
+		server := &http.Server{Addr: addr, Handler: handler, ConnContext: httpConnContext}
 		v.servers = append(v.servers, server)
 
-		wg.Add(1)
+		v.wg.Add(1)
 		go func() {
-			defer wg.Done()
+			defer v.wg.Done()
 			<-ctx.Done()
 			logger.Tf(ctx, "shutting down HTTP server, addr=%v", addr)
 			v.Close()
 		}()
 
-		wg.Add(1)
+		v.wg.Add(1)
 		go func() {
-			defer wg.Done()
+			defer v.wg.Done()
 			defer cancel()
 			if err := server.ListenAndServe(); err != nil && ctx.Err() != context.Canceled {
-				r1 = errors.Wrapf(err, "listen %v", addr)
+				v.onError(errors.Wrapf(err, "listen %v", addr))
 			}
 			logger.Tf(ctx, "HTTP server is done, addr=%v", addr)
 		}()
 	}
 
-	var r2 error
 	if true {
 		addr := envHttpListen()
 		if !strings.HasPrefix(addr, ":") {
@@ -172,8 +162,9 @@ func (v *httpService) Run(ctx context.Context) error {
 		logger.Tf(ctx, "HTTPS listen at %v", addr)
 
 		server := &http.Server{
-			Addr:    addr,
-			Handler: handler,
+			Addr:        addr,
+			Handler:     handler,
+			ConnContext: httpConnContext,
 			TLSConfig: &tls.Config{
 				GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 					return certManager.httpsCertificate, nil
@@ -182,30 +173,91 @@ func (v *httpService) Run(ctx context.Context) error {
 		}
 		v.servers = append(v.servers, server)
 
-		wg.Add(1)
+		v.wg.Add(1)
 		go func() {
-			defer wg.Done()
+			defer v.wg.Done()
 			<-ctx.Done()
 			logger.Tf(ctx, "shutting down HTTPS server, addr=%v", addr)
 			v.Close()
 		}()
 
-		wg.Add(1)
+		v.wg.Add(1)
 		go func() {
-			defer wg.Done()
+			defer v.wg.Done()
 			defer cancel()
 			if err := server.ListenAndServeTLS("", ""); err != nil && ctx.Err() != context.Canceled {
-				r2 = errors.Wrapf(err, "listen %v", addr)
+				v.onError(errors.Wrapf(err, "listen %v", addr))
 			}
 			logger.Tf(ctx, "HTTPS server is done, addr=%v", addr)
 		}()
 	}
 
-	wg.Wait()
-	for _, r := range []error{r0, r1, r2} {
-		if r != nil {
-			return r
+	return nil
+}
+
+func (v *httpService) onError(err error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.errs = append(v.errs, err)
+}
+
+func (v *httpService) Run(ctx context.Context) error {
+	// Listen now, if not started for the startup gate is disabled.
+	if err := v.Start(ctx); err != nil {
+		return errors.Wrapf(err, "start")
+	}
+	ctx = v.ctx
+
+	handler := http.NewServeMux()
+	if true {
+		serviceHandler := http.NewServeMux()
+		if err := handleHTTPService(ctx, serviceHandler); err != nil {
+			v.cancel()
+			v.wg.Wait()
+			return errors.Wrapf(err, "handle service")
 		}
+
+		handler.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+			// Set common header.
+			ohttp.SetHeader(w)
+
+			// Always allow CORS.
+			httpAllowCORS(w, r)
+
+			// Allow OPTIONS for CORS, while the UI answers OPTIONS with the allowed methods.
+			if r.Method == http.MethodOptions && r.URL.Path != "/mgmt" && !strings.HasPrefix(r.URL.Path, "/mgmt/") {
+				w.Write(nil)
+				return
+			}
+
+			// Apply the cache policy of the route, see httpRouteCachePolicies.
+			_, pattern := serviceHandler.Handler(r)
+
+			// Warn the deprecated shape of route, see httpDeprecations.
+			httpDeprecationsDetector.ServeHTTP(ctx, w, r, pattern)
+
+			// Handle by service handler, limit the concurrency of expensive endpoints, and capture the
+			// requests for diagnostics if enabled. Guard the response, to never write error after data, and
+			// recover the panic of handler.
+			serveHttpCache(ctx, w, r, pattern, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				diagnostics.ServeHTTP(w, r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+					httpLimiter.ServeHTTP(newHttpResponseGuard(w), r, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+						httpRecover(w, r, serviceHandler)
+					}))
+				}))
+			}))
+		})
+	}
+
+	// Switch to the full handler, the service is ready.
+	v.gate.Ready(handler)
+	logger.Tf(ctx, "HTTP service is ready, cost=%v", time.Since(v.gate.starttime))
+
+	v.wg.Wait()
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if len(v.errs) > 0 {
+		return v.errs[0]
 	}
 	return nil
 }
@@ -225,15 +277,15 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 		return errors.Wrapf(err, "handle ocr")
 	}
 
-	if err := transcodeWorker.Handle(ctx, handler); err != nil {
+	if err := handleFeatureWorker(ctx, handler, FeatureTranscode, "/terraform/v1/ffmpeg/transcode/", transcodeWorker.Handle); err != nil {
 		return errors.Wrapf(err, "handle transcode")
 	}
 
-	if err := forwardWorker.Handle(ctx, handler); err != nil {
+	if err := handleFeatureWorker(ctx, handler, FeatureForward, "/terraform/v1/ffmpeg/forward/", forwardWorker.Handle); err != nil {
 		return errors.Wrapf(err, "handle forward")
 	}
 
-	if err := vLiveWorker.Handle(ctx, handler); err != nil {
+	if err := handleFeatureWorker(ctx, handler, FeatureVLive, "/terraform/v1/ffmpeg/vlive/", vLiveWorker.Handle); err != nil {
 		return errors.Wrapf(err, "handle vLive")
 	}
 
@@ -241,6 +293,16 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 		return errors.Wrapf(err, "handle IP camera")
 	}
 
+	if err := clusterWorker.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle cluster")
+	}
+	if err := relayWorker.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle relay")
+	}
+	if err := aliasWorker.Handle(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle alias")
+	}
+
 	if err := handleHooksService(ctx, handler); err != nil {
 		return errors.Wrapf(err, "handle hooks")
 	}
@@ -257,6 +319,10 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 		return errors.Wrapf(err, "handle AI talk")
 	}
 
+	if err := handleSrsApiProxy(ctx, handler); err != nil {
+		return errors.Wrapf(err, "handle SRS API proxy")
+	}
+
 	var ep string
 
 	handleHostVersions(ctx, handler)
@@ -265,9 +331,16 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 	handleMgmtInit(ctx, handler)
 	handleMgmtCheck(ctx, handler)
 	handleMgmtEnvs(ctx, handler)
+	handleMgmtEnvsRestore(ctx, handler)
 	handleMgmtToken(ctx, handler)
+	handleMgmtTokenIntrospect(ctx, handler)
 	handleMgmtLogin(ctx, handler)
+	handleMgmtPassword(ctx, handler)
+	handleMgmtRecover(ctx, handler)
+	handleMgmtDeprecations(ctx, handler)
 	handleMgmtStatus(ctx, handler)
+	handleMgmtFeatures(ctx, handler)
+	handleMgmtPublicStatus(ctx, handler)
 	handleMgmtBilibili(ctx, handler)
 	handleMgmtLimitsQuery(ctx, handler)
 	handleMgmtLimitsUpdate(ctx, handler)
@@ -275,17 +348,58 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 	handleMgmtOpenAIUpdate(ctx, handler)
 	handleMgmtBeianQuery(ctx, handler)
 	handleMgmtSecretQuery(ctx, handler)
+	handleMgmtSecretAudit(ctx, handler)
+	handleMgmtConfigReset(ctx, handler)
 	handleMgmtBeianUpdate(ctx, handler)
+	handleMgmtMotd(ctx, handler)
+	handleMgmtPlayback(ctx, handler)
+	handleMgmtRedirects(ctx, handler)
+	handleMgmtEmbed(ctx, handler)
+	handleMgmtSpeedtest(ctx, handler)
 	handleMgmtNginxHlsUpdate(ctx, handler)
 	handleMgmtNginxHlsQuery(ctx, handler)
 	handleMgmtHlsLowLatencyUpdate(ctx, handler)
 	handleMgmtHlsLowLatencyQuery(ctx, handler)
+	handleMgmtHlsProfile(ctx, handler)
+	handleMgmtHlsTimeShift(ctx, handler)
 	handleMgmtAutoSelfSignedCertificate(ctx, handler)
 	handleMgmtSsl(ctx, handler)
 	handleMgmtLetsEncrypt(ctx, handler)
 	handleMgmtCertQuery(ctx, handler)
+	handleMgmtCertbot(ctx, handler)
+	handleMgmtNginxStatus(ctx, handler)
+	handleMgmtNginxPreview(ctx, handler)
+	handleMgmtViewerStats(ctx, handler)
 	handleMgmtStreamsQuery(ctx, handler)
 	handleMgmtStreamsKickoff(ctx, handler)
+	handleMgmtStreamsPreview(ctx, handler)
+	handleMgmtDownload(ctx, handler)
+	handleMgmtSelfCheck(ctx, handler)
+	handleMgmtStreamSchedules(ctx, handler)
+	handleMgmtStreamKeys(ctx, handler)
+	handleMgmtStreamQuota(ctx, handler)
+	handleMgmtStreamGuest(ctx, handler)
+	handleMgmtStreamMetadata(ctx, handler)
+	handleMgmtStreamNaming(ctx, handler)
+	handleMgmtHooksSecret(ctx, handler)
+	handleMgmtPublishAudit(ctx, handler)
+	handleMgmtHooksEvents(ctx, handler)
+	handleMgmtEventBus(ctx, handler)
+	handleMgmtStorage(ctx, handler)
+	handleMgmtStorageRedis(ctx, handler)
+	handleMgmtMetrics(ctx, handler)
+	handleMgmtPrometheus(ctx, handler)
+	handleMgmtAlerts(ctx, handler)
+	handleMgmtLogThrottle(ctx, handler)
+	handleMgmtTimeouts(ctx, handler)
+	handleMgmtNetworkCandidates(ctx, handler)
+	handleMgmtDiagnostics(ctx, handler)
+	handleMgmtReleases(ctx, handler)
+	handleMgmtDiagnose(ctx, handler)
+	handleMgmtCloud(ctx, handler)
+	handleMgmtUpgrade(ctx, handler)
+	handleMgmtEventStream(ctx, handler)
+	handleMgmtContainers(ctx, handler)
 	handleMgmtUI(ctx, handler)
 
 	proxy2023, err := httpCreateProxy("http://127.0.0.1:2023")
@@ -329,6 +443,11 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 			return
 		}
 
+		// The player page to embed by iframe, rather than the static files of players.
+		if serveEmbedPlayer(ctx, w, r) {
+			return
+		}
+
 		// We directly serve the static files, because we overwrite the www for DVR.
 		if strings.HasPrefix(r.URL.Path, "/console/") || strings.HasPrefix(r.URL.Path, "/players/") ||
 			strings.HasPrefix(r.URL.Path, "/tools/") {
@@ -357,7 +476,7 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 				if ip, err := candidateWorker.Resolve(host); err != nil {
 					logger.Ef(ctx, "Proxy %v to backend 1985, resolve %v/%v failed, cost=%v, err is %v",
 						r.URL.Path, r.Host, host, time.Now().Sub(starttime), err)
-					ohttp.WriteError(ctx, w, r, err)
+					httpWriteError(ctx, w, r, err)
 					return
 				} else if ip != nil {
 					eip = ip.String()
@@ -384,7 +503,7 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 			apiSecret := envApiSecret()
 			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
 				w.WriteHeader(http.StatusUnauthorized)
-				ohttp.WriteError(ctx, w, r, err)
+				httpWriteError(ctx, w, r, err)
 				return
 			}
 
@@ -393,11 +512,18 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 			return
 		}
 
+		// Track the HLS viewers by the playlist requests.
+		if strings.HasSuffix(r.URL.Path, ".m3u8") && viewerTracker != nil {
+			viewerTracker.OnHLSPlaylist(ctx, r)
+		}
+
 		// Always directly serve the HLS ts files.
 		if fastCache.HLSHighPerformance && strings.HasSuffix(r.URL.Path, ".m3u8") {
-			var m3u8ExpireInSeconds int = 10
+			// Note that we use smaller expire time that fragment duration.
+			streamURL := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".m3u8")
+			m3u8ExpireInSeconds := fastCache.HLSProfile(streamURL).PlaylistMaxAge()
 			if fastCache.HLSLowLatency {
-				m3u8ExpireInSeconds = 1 // Note that we use smaller expire time that fragment duration.
+				m3u8ExpireInSeconds = HLSProfileLow.PlaylistMaxAge()
 			}
 
 			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%v", m3u8ExpireInSeconds))
@@ -419,7 +545,12 @@ func handleHTTPService(ctx context.Context, handler *http.ServeMux) error {
 
 		}
 
-		http.Redirect(w, r, "/mgmt", http.StatusFound)
+		// The short links defined by operator, before redirecting to UI.
+		if serveRedirect(ctx, w, r) {
+			return
+		}
+
+		http.Redirect(w, r, withBasePath("/mgmt"), http.StatusFound)
 	})
 
 	return nil
@@ -475,29 +606,35 @@ func handleMgmtInit(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/init"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
-		if err := func() error {
-			b, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				return errors.Wrapf(err, "read body")
-			}
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
 
-			var password string
-			if len(b) > 0 {
-				if err := json.Unmarshal(b, &struct {
-					Password *string `json:"password"`
-				}{
-					Password: &password,
-				}); err != nil {
-					return errors.Wrapf(err, "json unmarshal %v", string(b))
-				}
+		if err := func() error {
+			var password, email string
+			if err := ParseLimitedBody(ctx, w, r, mgmtPasswordMaxBody, &struct {
+				Password *string `json:"password"`
+				// The optional admin email, to recover the password.
+				Email *string `json:"email"`
+			}{
+				Password: &password, Email: &email,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
 			}
 
 			// If no password, query the system init status.
 			if password == "" {
-				ohttp.WriteData(ctx, w, r, &struct {
+				motd, err := queryMotd(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "query motd")
+				}
+
+				// Never expose the source of api secret, which is only in the authenticated envs.
+				httpWriteData(ctx, w, r, &struct {
 					Init bool `json:"init"`
+					// The message of the day for login page, nil if not set.
+					Motd *Motd `json:"motd"`
 				}{
-					Init: envMgmtPassword() != "",
+					Init: envMgmtPassword() != "", Motd: motd,
 				})
 				return nil
 			}
@@ -507,30 +644,36 @@ func handleMgmtInit(ctx context.Context, handler *http.ServeMux) {
 				return errors.New("already initialized")
 			}
 
-			// Initialize the system password, save to env.
-			envFile := path.Join(conf.Pwd, "containers/data/config/.env")
-			if envs, err := godotenv.Read(envFile); err != nil {
-				return errors.Wrapf(err, "load envs from %v", envFile)
-			} else {
-				envs["MGMT_PASSWORD"] = password
-				if err := godotenv.Write(envs, envFile); err != nil {
-					return errors.Wrapf(err, "write %v", envFile)
+			// The same rules as changing password, see validateMgmtPassword.
+			if err := validateMgmtPassword(password); err != nil {
+				return errors.Wrapf(err, "validate password")
+			}
+			if email != "" {
+				if err := validateAdminEmail(email); err != nil {
+					return errors.Wrapf(err, "validate email")
 				}
 			}
-			logger.Tf(ctx, "init mgmt password %vB ok, file=%v", len(password), envFile)
 
-			// Refresh the local token.
-			if err := godotenv.Overload(envFile); err != nil {
-				return errors.Wrapf(err, "load %v", envFile)
+			// Initialize the system password, save to env and refresh the local token.
+			if err := saveMgmtPassword(ctx, password); err != nil {
+				return errors.Wrapf(err, "save password")
+			}
+			logger.Tf(ctx, "init mgmt password %vB ok", len(password))
+
+			if email != "" {
+				if err := saveAdminEmail(ctx, email); err != nil {
+					return errors.Wrapf(err, "save email")
+				}
+				logger.Tf(ctx, "init admin email %v ok", maskAdminEmail(email))
 			}
 
 			apiSecret := envApiSecret()
-			expireAt, createAt, token, err := createToken(ctx, envApiSecret())
+			expireAt, createAt, token, err := createTokenWithScope(ctx, apiSecret, tokenScopeAdmin)
 			if err != nil {
 				return errors.Wrapf(err, "build token")
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Token    string `json:"token"`
 				CreateAt string `json:"createAt"`
 				ExpireAt string `json:"expireAt"`
@@ -543,7 +686,7 @@ func handleMgmtInit(ctx context.Context, handler *http.ServeMux) {
 			logger.Tf(ctx, "init password ok, create=%v, expire=%v, password=%vB", createAt, expireAt, len(password))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -552,6 +695,9 @@ func handleMgmtCheck(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/check"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			// Check whether redis is ok.
 			if r0, err := rdb.HGet(ctx, SRS_AUTH_SECRET, "pubSecret").Result(); err != nil && err != redis.Nil {
@@ -560,20 +706,28 @@ func handleMgmtCheck(ctx context.Context, handler *http.ServeMux) {
 				return errors.Wrapf(err, "get %v", SRS_FIRST_BOOT)
 			} else if r2, err := rdb.HLen(ctx, SRS_TENCENT_LH).Result(); err != nil && err != redis.Nil {
 				return errors.Wrapf(err, "get %v", SRS_TENCENT_LH)
-			} else if r0 == "" || r1 <= 0 || r2 <= 0 {
+			} else if r0 == "" || r1 <= 0 || (r2 <= 0 && conf.Cloud == "TENCENT") {
+				// Note that the SRS_TENCENT_LH is only required for TENCENT, might be empty for other clouds.
 				return errors.New("Redis is not  ready")
 			} else {
 				logger.Tf(ctx, "system check ok, r0=%v, r1=%v, r2=%v", r0, r1, r2)
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
-				Upgrading bool `json:"upgrading"`
+			// The health of redis is only for diagnosis, never fails the check.
+			health, err := queryRedisHealth(ctx)
+			if err != nil {
+				logger.Wf(ctx, "system check ignore redis health err %+v", err)
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Upgrading bool         `json:"upgrading"`
+				Redis     *RedisHealth `json:"redis,omitempty"`
 			}{
-				Upgrading: false,
+				Upgrading: false, Redis: health,
 			})
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -582,12 +736,16 @@ func handleMgmtEnvs(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/envs"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
-			var locale string
-			if err := ParseBody(ctx, r.Body, &struct {
+			var token, locale string
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
 				Locale *string `json:"locale"`
 			}{
-				Locale: &locale,
+				Token: &token, Locale: &locale,
 			}); err != nil {
 				return errors.Wrapf(err, "parse body")
 			}
@@ -628,15 +786,17 @@ func handleMgmtEnvs(ctx context.Context, handler *http.ServeMux) {
 				}
 			}
 
-			platformDocker := envPlatformDocker() != "off"
-			candidate := envCandidate() != ""
-			ohttp.WriteData(ctx, w, r, &struct {
+			// The setup state for login page, uninitialized if no password, or initialized.
+			setupState := "initialized"
+			if envMgmtPassword() == "" {
+				setupState = "uninitialized"
+			}
+
+			// The envs for any caller, to render the login page and stream URLs, without any information to
+			// fingerprint the install.
+			type coarseEnvs struct {
 				// Whether mgmt run in docker.
 				MgmtDocker bool `json:"mgmtDocker"`
-				// Whether platform run in docker.
-				PlatformDocker bool `json:"platformDocker"`
-				// Whether set the env CANDIDATE for WebRTC.
-				Candidate bool `json:"candidate"`
 				// The exposed RTMP port.
 				RTMPPort string `json:"rtmpPort"`
 				// The exposed HTTP port.
@@ -651,36 +811,79 @@ func handleMgmtEnvs(ctx context.Context, handler *http.ServeMux) {
 				VLiveLimit int `json:"vLiveLimit"`
 				// The limit of the number of IP camera streams.
 				CameraLimit int `json:"cameraLimit"`
+				// Whether system is initialized, same to /terraform/v1/mgmt/init
+				Init bool `json:"init"`
+				// The setup state, uninitialized or initialized.
+				SetupState string `json:"setupState"`
+				// The version of platform.
+				Version string `json:"version"`
+				// The message of the day, nil if not set.
+				Motd *Motd `json:"motd"`
+				// The base path of platform, for UI to build the router and asset URLs, empty if at root.
+				BasePath string `json:"basePath,omitempty"`
+			}
+			motd, err := queryMotd(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query motd")
+			}
+			envs := &coarseEnvs{
+				MgmtDocker: conf.DeployMode != DeployModeHost, RTMPPort: envRtmpPort(), HTTPPort: envHttpPort(), SRTPort: envSrtListen(),
+				RTCPort: envRtcListen(), ForwardLimit: forwardLimit, VLiveLimit: vLiveLimit, CameraLimit: cameraLimit,
+				Init: envMgmtPassword() != "", SetupState: setupState, Version: conf.Versions().Platform.Version, Motd: motd,
+				BasePath: platformBasePath(),
+			}
+
+			// Response the coarse envs, if not authenticated. Note that we never fail for invalid token, because the
+			// login page also requests it with the expired token.
+			if token == "" && r.Header.Get("Authorization") == "" {
+				httpWriteData(ctx, w, r, envs)
+				logger.Tf(ctx, "mgmt envs ok, locale=%v, setup=%v", locale, setupState)
+				return nil
+			} else if err := Authenticate(ctx, envApiSecret(), token, r.Header); err != nil {
+				httpWriteData(ctx, w, r, envs)
+				logger.Wf(ctx, "mgmt envs ok, locale=%v, setup=%v, ignore auth err %v", locale, setupState, err)
+				return nil
+			}
+
+			https, err := rdb.Get(ctx, SRS_HTTPS).Result()
+			if err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "get %v", SRS_HTTPS)
+			}
+
+			platformDocker := envPlatformDocker() != "off"
+			candidate := envCandidate() != ""
+			httpWriteData(ctx, w, r, &struct {
+				*coarseEnvs
+				// Whether platform run in docker.
+				PlatformDocker bool `json:"platformDocker"`
+				// Whether set the env CANDIDATE for WebRTC.
+				Candidate bool `json:"candidate"`
+				// Whether the api secret exists.
+				Secret bool `json:"secret"`
+				// Where the api secret came from, redis, env or generated.
+				SecretSource ApiSecretSource `json:"secretSource"`
+				// The HTTPS mode, for example, ssl or lets, empty if not set.
+				HTTPS string `json:"https"`
+				// The listen address of platform.
+				Listen string `json:"listen"`
+				// The locale of UI.
+				Locale string `json:"locale"`
+				// The effective directory of UI, which falls back to default locale, empty if not built.
+				UIRoot string `json:"uiRoot"`
+				// The deploy mode, docker or host.
+				DeployMode DeployMode `json:"deployMode"`
 			}{
-				// Whether in docker.
-				MgmtDocker: true,
-				// Whether platform in docker.
-				PlatformDocker: platformDocker,
-				// The candidate IP for WebRTC.
-				Candidate: candidate,
-				// The export port for RTMP.
-				RTMPPort: envRtmpPort(),
-				// The export port for HTTP.
-				HTTPPort: envHttpPort(),
-				// The export port for SRT.
-				SRTPort: envSrtListen(),
-				// The export port for WebRTC.
-				RTCPort: envRtcListen(),
-				// The limit of the number of forwarding streams.
-				ForwardLimit: forwardLimit,
-				// The limit of the number of vLive streams.
-				VLiveLimit: vLiveLimit,
-				// The limit of the number of IP camera streams.
-				CameraLimit: cameraLimit,
+				envs, platformDocker, candidate, envApiSecret() != "", conf.SecretSource, https,
+				envPlatformListen(), locale, conf.UIRoot, conf.DeployMode,
 			})
 
-			logger.Tf(ctx, "mgmt envs ok, locale=%v, platformDocker=%v, candidate=%v, rtmpPort=%v, httpPort=%v, srtPort=%v, rtcPort=%v, forwardLimit=%v, vLiveLimit=%v, cameraLimit=%v",
+			logger.Tf(ctx, "mgmt envs ok, locale=%v, platformDocker=%v, candidate=%v, rtmpPort=%v, httpPort=%v, srtPort=%v, rtcPort=%v, forwardLimit=%v, vLiveLimit=%v, cameraLimit=%v, https=%v, token=%vB",
 				locale, platformDocker, candidate, envRtmpPort(), envHttpPort(),
-				envSrtListen(), envRtcListen(), forwardLimit, vLiveLimit, cameraLimit,
+				envSrtListen(), envRtcListen(), forwardLimit, vLiveLimit, cameraLimit, https, len(token),
 			)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -689,9 +892,12 @@ func handleMgmtToken(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/token"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -709,7 +915,7 @@ func handleMgmtToken(ctx context.Context, handler *http.ServeMux) {
 				return errors.Wrapf(err, "build token")
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Token    string `json:"token"`
 				CreateAt string `json:"createAt"`
 				ExpireAt string `json:"expireAt"`
@@ -719,7 +925,7 @@ func handleMgmtToken(ctx context.Context, handler *http.ServeMux) {
 			logger.Tf(ctx, "login by token ok, create=%v, expire=%v, token=%vB", createAt, expireAt, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -729,6 +935,8 @@ func handleMgmtLogin(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/login"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		// Note that we use the service context, not the request context, because we must always wait for
+		// invalid password, even the client is gone.
 		if err := func() error {
 			if !loginLock.TryLock() {
 				return errors.New("login is running, try later")
@@ -739,18 +947,13 @@ func handleMgmtLogin(ctx context.Context, handler *http.ServeMux) {
 				return errors.New("not init")
 			}
 
-			b, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				return errors.Wrapf(err, "read body")
-			}
-
 			var password string
-			if err := json.Unmarshal(b, &struct {
+			if err := ParseLimitedBody(ctx, w, r, mgmtPasswordMaxBody, &struct {
 				Password *string `json:"password"`
 			}{
 				Password: &password,
 			}); err != nil {
-				return errors.Wrapf(err, "json unmarshal %v", string(b))
+				return errors.Wrapf(err, "parse body")
 			}
 
 			if password == "" {
@@ -759,7 +962,7 @@ func handleMgmtLogin(ctx context.Context, handler *http.ServeMux) {
 
 			if password != envMgmtPassword() {
 				wait := time.Duration(10) * time.Second
-				logger.Wf(ctx, "Invalid password, wait for %v", wait)
+				logger.Wf(ctx, "Invalid password from %v, wait for %v", clientIP(r), wait)
 
 				select {
 				case <-time.After(wait):
@@ -770,7 +973,7 @@ func handleMgmtLogin(ctx context.Context, handler *http.ServeMux) {
 			}
 
 			apiSecret := envApiSecret()
-			expireAt, createAt, token, err := createToken(ctx, apiSecret)
+			expireAt, createAt, token, err := createTokenWithScope(ctx, apiSecret, tokenScopeAdmin)
 			if err != nil {
 				return errors.Wrapf(err, "build token")
 			}
@@ -785,10 +988,11 @@ func handleMgmtLogin(ctx context.Context, handler *http.ServeMux) {
 				Token: token, CreateAt: createAt.Format(time.RFC3339), ExpireAt: expireAt.Format(time.RFC3339),
 				Bearer: apiSecret,
 			})
-			logger.Tf(ctx, "login by password ok, create=%v, expire=%v, token=%vB", createAt, expireAt, len(token))
+			logger.Tf(ctx, "login by password ok, ip=%v, create=%v, expire=%v, token=%vB",
+				clientIP(r), createAt, expireAt, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -797,9 +1001,12 @@ func handleMgmtStatus(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/status"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -817,21 +1024,58 @@ func handleMgmtStatus(ctx context.Context, handler *http.ServeMux) {
 				return errors.Wrapf(err, "hget %v upgrading", SRS_UPGRADING)
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
-				Version   string   `json:"version"`
-				Releases  Versions `json:"releases"`
-				Upgrading bool     `json:"upgrading"`
-				Strategy  string   `json:"strategy"`
+			drain, err := queryUpgradeDrain(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query drain")
+			}
+
+			locks, err := queryRedisLocks(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query locks")
+			}
+
+			motd, err := queryMotd(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query motd")
+			}
+
+			var versionsRefreshed string
+			if t := conf.VersionsRefreshed(); !t.IsZero() {
+				versionsRefreshed = t.Format(time.RFC3339)
+			}
+
+			versions := conf.Versions()
+			httpWriteData(ctx, w, r, &struct {
+				Version string `json:"version"`
+				// The versions in the shape of previous releases, see /terraform/v1/mgmt/releases/versions for all.
+				Releases *VersionsCompatible `json:"releases"`
+				// The last time the releases is refreshed, empty if never.
+				VersionsRefreshed string `json:"versionsRefreshed"`
+				Upgrading         bool   `json:"upgrading"`
+				Strategy          string `json:"strategy"`
+				// The diagnostics capture mode, show it to avoid forgetting it's on.
+				Diagnostics *DiagnosticsState `json:"diagnostics"`
+				// The drain state before upgrade, nil if not draining.
+				Drain *UpgradeDrain `json:"drain"`
+				// The distributed locks between platform replicas, nil if not held.
+				Locks map[string]*RedisLockState `json:"locks"`
+				// The message of the day, nil if not set.
+				Motd *Motd `json:"motd"`
 			}{
-				Version:   conf.Versions.Version,
-				Releases:  conf.Versions,
-				Upgrading: upgrading == "1",
-				Strategy:  "manual",
+				Version:           versions.Platform.Version,
+				Releases:          versions.Compatible(),
+				VersionsRefreshed: versionsRefreshed,
+				Upgrading:         upgrading == "1",
+				Strategy:          "manual",
+				Diagnostics:       diagnostics.State(),
+				Drain:             drain,
+				Locks:             locks,
+				Motd:              motd,
 			})
-			logger.Tf(ctx, "status ok, versions=%v, upgrading=%v, token=%vB", conf.Versions.String(), upgrading, len(token))
+			logger.Tf(ctx, "status ok, versions=%v, upgrading=%v, token=%vB", versions.String(), upgrading, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -840,9 +1084,12 @@ func handleMgmtBilibili(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/bilibili"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, bvid string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				BVID  *string `json:"bvid"`
 			}{
@@ -860,36 +1107,13 @@ func handleMgmtBilibili(ctx context.Context, handler *http.ServeMux) {
 				return errors.New("no bvid")
 			}
 
-			bilibiliObj := struct {
-				Update string                 `json:"update"`
-				Res    map[string]interface{} `json:"res"`
-			}{}
-			if bilibili, err := rdb.HGet(ctx, SRS_CACHE_BILIBILI, bvid).Result(); err != nil && err != redis.Nil {
-				return errors.Wrapf(err, "hget %v %v", SRS_CACHE_BILIBILI, bvid)
-			} else if bilibili != "" {
-				if err := json.Unmarshal([]byte(bilibili), &bilibiliObj); err != nil {
-					return errors.Wrapf(err, "json unmarshal %v", bilibili)
-				}
-			}
-
-			var cacheExpired bool
-			if bilibiliObj.Update != "" {
-				duration := time.Duration(24*3600) * time.Second
-				if envNodeEnv() == "development" {
-					duration = time.Duration(300) * time.Second
-				}
-
-				updateAt, err := time.Parse(time.RFC3339, bilibiliObj.Update)
-				if err != nil {
-					cacheExpired = true
-				}
-				if updateAt.Add(duration).Before(time.Now()) {
-					cacheExpired = true
-				}
+			bilibiliObj, err := bilibiliCache.Get(ctx, bvid)
+			if err != nil {
+				return errors.Wrapf(err, "get cache %v", bvid)
 			}
 
-			if bilibiliObj.Res == nil || cacheExpired {
-				bilibiliObj.Update = time.Now().Format(time.RFC3339)
+			if bilibiliObj == nil {
+				bilibiliObj = &BilibiliCacheObject{Update: time.Now().Format(time.RFC3339)}
 
 				bilibiliURL := fmt.Sprintf("https://api.bilibili.com/x/web-interface/view?bvid=%v", bvid)
 				res, err := http.Get(bilibiliURL)
@@ -913,18 +1137,17 @@ func handleMgmtBilibili(ctx context.Context, handler *http.ServeMux) {
 				}); err != nil {
 					return errors.Wrapf(err, "json unmarshal %v", string(b))
 				}
-			}
-			if b, err := json.Marshal(bilibiliObj); err != nil {
-				return errors.Wrapf(err, "json marshal %v", bilibiliObj)
-			} else if err = rdb.HSet(ctx, SRS_CACHE_BILIBILI, bvid, string(b)).Err(); err != nil {
-				return errors.Wrapf(err, "update redis for %v", string(b))
+
+				if err := bilibiliCache.Set(ctx, bvid, bilibiliObj); err != nil {
+					return errors.Wrapf(err, "set cache %v", bvid)
+				}
 			}
 
-			ohttp.WriteData(ctx, w, r, bilibiliObj.Res)
+			httpWriteData(ctx, w, r, bilibiliObj.Res)
 			logger.Tf(ctx, "bilibili cache bvid=%v, update=%v, token=%vB", bvid, bilibiliObj.Update, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -933,9 +1156,12 @@ func handleMgmtOpenAIQuery(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/openai/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -963,7 +1189,7 @@ func handleMgmtOpenAIQuery(ctx context.Context, handler *http.ServeMux) {
 				return errors.Wrapf(err, "hget %v org", SRS_SYS_OPENAI)
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				// The AI secret key.
 				AISecretKey string `json:"aiSecretKey"`
 				// The AI base url.
@@ -977,7 +1203,7 @@ func handleMgmtOpenAIQuery(ctx context.Context, handler *http.ServeMux) {
 			logger.Tf(ctx, "settings: query openai ok")
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -986,10 +1212,13 @@ func handleMgmtOpenAIUpdate(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/openai/update"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var aiSecretKey, aiBaseURL, aiOrganization string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token          *string `json:"token"`
 				AISecretKey    *string `json:"aiSecretKey"`
 				AIBaseURL      *string `json:"aiBaseURL"`
@@ -1023,11 +1252,11 @@ func handleMgmtOpenAIUpdate(ctx context.Context, handler *http.ServeMux) {
 				return errors.Wrapf(err, "hset %v org %v", SRS_SYS_OPENAI, aiOrganization)
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "limits: Update ok, key=%vB, url=%v, org=%v", len(aiSecretKey), aiBaseURL, aiOrganization)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1036,9 +1265,12 @@ func handleMgmtLimitsQuery(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/limits/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -1065,7 +1297,7 @@ func handleMgmtLimitsQuery(ctx context.Context, handler *http.ServeMux) {
 				ipCameraLimits = SrsSysLimitsCamera
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				// The limits for virtual live streaming.
 				VLive int64 `json:"vlive"`
 				// The limits for IP camera streaming.
@@ -1077,7 +1309,7 @@ func handleMgmtLimitsQuery(ctx context.Context, handler *http.ServeMux) {
 			logger.Tf(ctx, "limits: query ok")
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1086,10 +1318,13 @@ func handleMgmtLimitsUpdate(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/limits/update"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var vlive, camera int64
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token    *string `json:"token"`
 				VLive    *int64  `json:"vlive"`
 				IPCamera *int64  `json:"camera"`
@@ -1118,11 +1353,11 @@ func handleMgmtLimitsUpdate(ctx context.Context, handler *http.ServeMux) {
 				return errors.Wrapf(err, "hset %v camera %v", SRS_SYS_LIMITS, camera)
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "limits: Update ok, vlive=%v, camera=%v", vlive, camera)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1132,17 +1367,20 @@ func handleMgmtBeianQuery(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/beian/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			r0, err := rdb.HGetAll(ctx, SRS_BEIAN).Result()
 			if err != nil && err != redis.Nil {
 				return errors.Wrapf(err, "hgetall %v", SRS_BEIAN)
 			}
 
-			ohttp.WriteData(ctx, w, r, r0)
+			httpWriteData(ctx, w, r, r0)
 			logger.Tf(ctx, "beian: query ok")
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1151,26 +1389,34 @@ func handleMgmtSecretQuery(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/secret/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
-			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
-				Token *string `json:"token"`
+			var token, password string
+			if err := ParseBody(ctx, r, &struct {
+				Token    *string `json:"token"`
+				Password *string `json:"password"`
 			}{
-				Token: &token,
+				Token: &token, Password: &password,
 			}); err != nil {
 				return errors.Wrapf(err, "parse body")
 			}
 
+			// The api secret is permanent, so it requires the admin scope or password, see authenticateAdmin.
 			apiSecret := envApiSecret()
-			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
-				return errors.Wrapf(err, "authenticate")
+			method, err := authenticateAdmin(ctx, apiSecret, token, password, r.Header)
+			recordSecretAudit(ctx, r, method, err)
+			if err != nil {
+				return errors.Wrapf(err, "authenticate admin")
 			}
 
-			ohttp.WriteData(ctx, w, r, apiSecret)
-			logger.Tf(ctx, "query apiSecret ok, versions=%v, token=%vB", conf.Versions.String(), len(token))
+			httpWriteData(ctx, w, r, apiSecret)
+			logger.Tf(ctx, "query apiSecret ok, ip=%v, method=%v, versions=%v, token=%vB",
+				clientIP(r), method, conf.Versions().String(), len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1179,9 +1425,12 @@ func handleMgmtBeianUpdate(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/beian/update"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, beian, text string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				Beian *string `json:"beian"`
 				Text  *string `json:"text"`
@@ -1207,11 +1456,11 @@ func handleMgmtBeianUpdate(ctx context.Context, handler *http.ServeMux) {
 				return errors.Wrapf(err, "hset %v %v %v", SRS_BEIAN, beian, text)
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "beian: update ok, beian=%v, text=%v, token=%vB", beian, text, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1220,10 +1469,13 @@ func handleMgmtNginxHlsUpdate(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/hphls/update"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var noHlsCtx bool
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token    *string `json:"token"`
 				NoHlsCtx *bool   `json:"noHlsCtx"`
 			}{
@@ -1246,11 +1498,15 @@ func handleMgmtNginxHlsUpdate(ctx context.Context, handler *http.ServeMux) {
 				return errors.Wrapf(err, "generate SRS config")
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, &struct {
+				Hash string `json:"hash"`
+			}{
+				Hash: renderedConfigHash(),
+			})
 			logger.Tf(ctx, "nginx hls update ok, enabled=%v, token=%vB", noHlsCtx, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1259,9 +1515,12 @@ func handleMgmtNginxHlsQuery(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/hphls/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -1281,7 +1540,7 @@ func handleMgmtNginxHlsQuery(ctx context.Context, handler *http.ServeMux) {
 				enabled = v == "true"
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				NoHlsCtx bool `json:"noHlsCtx"`
 			}{
 				NoHlsCtx: enabled,
@@ -1289,7 +1548,7 @@ func handleMgmtNginxHlsQuery(ctx context.Context, handler *http.ServeMux) {
 			logger.Tf(ctx, "nginx hls query ok, enabled=%v, token=%vB", enabled, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1298,10 +1557,13 @@ func handleMgmtHlsLowLatencyUpdate(ctx context.Context, handler *http.ServeMux)
 	ep := "/terraform/v1/mgmt/hlsll/update"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var hlsLowLatency bool
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token         *string `json:"token"`
 				HlsLowLatency *bool   `json:"hlsLowLatency"`
 			}{
@@ -1324,11 +1586,15 @@ func handleMgmtHlsLowLatencyUpdate(ctx context.Context, handler *http.ServeMux)
 				return errors.Wrapf(err, "generate SRS config")
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, &struct {
+				Hash string `json:"hash"`
+			}{
+				Hash: renderedConfigHash(),
+			})
 			logger.Tf(ctx, "hls low latency update ok, enabled=%v, token=%vB", hlsLowLatency, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1337,9 +1603,12 @@ func handleMgmtHlsLowLatencyQuery(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/hlsll/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -1359,7 +1628,7 @@ func handleMgmtHlsLowLatencyQuery(ctx context.Context, handler *http.ServeMux) {
 				enabled = v == "true"
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				HlsLowLatency bool `json:"hlsLowLatency"`
 			}{
 				HlsLowLatency: enabled,
@@ -1367,7 +1636,7 @@ func handleMgmtHlsLowLatencyQuery(ctx context.Context, handler *http.ServeMux) {
 			logger.Tf(ctx, "hls low latency query ok, enabled=%v, token=%vB", enabled, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1376,9 +1645,12 @@ func handleMgmtAutoSelfSignedCertificate(ctx context.Context, handler *http.Serv
 	ep := "/terraform/v1/mgmt/auto-self-signed-certificate"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -1395,11 +1667,11 @@ func handleMgmtAutoSelfSignedCertificate(ctx context.Context, handler *http.Serv
 				return errors.Wrapf(err, "create self sign certificate")
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "create self-signed cert ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1408,15 +1680,20 @@ func handleMgmtSsl(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/ssl"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			var key, crt string
-			if err := ParseBody(ctx, r.Body, &struct {
+			var key, crt, hash string
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				Key   *string `json:"key"`
 				Crt   *string `json:"crt"`
+				// The hash of previewed NGINX config, optional.
+				Hash *string `json:"hash"`
 			}{
-				Token: &token, Key: &key, Crt: &crt,
+				Token: &token, Key: &key, Crt: &crt, Hash: &hash,
 			}); err != nil {
 				return errors.Wrapf(err, "parse body")
 			}
@@ -1432,6 +1709,9 @@ func handleMgmtSsl(ctx context.Context, handler *http.ServeMux) {
 			if crt = strings.TrimSpace(crt); crt == "" {
 				return errors.New("empty crt")
 			}
+			if err := verifyNginxPreview(ctx, "ssl", hash); err != nil {
+				return errors.Wrapf(err, "verify preview")
+			}
 
 			if err := certManager.updateSslFiles(ctx, key+"\n", crt+"\n"); err != nil {
 				return errors.Wrapf(err, "updateSslFiles key=%vB, crt=%vB", len(key), len(crt))
@@ -1441,15 +1721,19 @@ func handleMgmtSsl(ctx context.Context, handler *http.ServeMux) {
 				return errors.Wrapf(err, "set %v %v", SRS_HTTPS, "ssl")
 			}
 
-			if err := nginxGenerateConfig(ctx); err != nil {
+			if err := nginxApplyConfig(ctx, NginxTriggerSsl, hash); err != nil {
 				return errors.Wrapf(err, "nginx config and reload")
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, &struct {
+				Hash string `json:"hash"`
+			}{
+				Hash: renderedConfigHash(),
+			})
 			logger.Tf(ctx, "nginx ssl file ok, key=%vB, crt=%vB, token=%vB", len(key), len(crt), len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1458,14 +1742,18 @@ func handleMgmtLetsEncrypt(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/letsencrypt"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		// Note that we use the service context, not the request context, because the ACME challenge might
+		// take longer than the request timeout, and should not be interrupted.
 		if err := func() error {
 			var token string
-			var domain string
-			if err := ParseBody(ctx, r.Body, &struct {
+			var domain, hash string
+			if err := ParseBody(ctx, r, &struct {
 				Token  *string `json:"token"`
 				Domain *string `json:"domain"`
+				// The hash of previewed NGINX config, optional.
+				Hash *string `json:"hash"`
 			}{
-				Token: &token, Domain: &domain,
+				Token: &token, Domain: &domain, Hash: &hash,
 			}); err != nil {
 				return errors.Wrapf(err, "parse body")
 			}
@@ -1478,6 +1766,9 @@ func handleMgmtLetsEncrypt(ctx context.Context, handler *http.ServeMux) {
 			if domain = strings.TrimSpace(domain); domain == "" {
 				return errors.New("empty domain")
 			}
+			if err := verifyNginxPreview(ctx, "lets", hash); err != nil {
+				return errors.Wrapf(err, "verify preview")
+			}
 
 			if err := certManager.updateLetsEncrypt(ctx, domain); err != nil {
 				return errors.Wrapf(err, "updateSslFiles domain=%v", domain)
@@ -1490,15 +1781,19 @@ func handleMgmtLetsEncrypt(ctx context.Context, handler *http.ServeMux) {
 				return errors.Wrapf(err, "set %v %v", SRS_HTTPS_DOMAIN, domain)
 			}
 
-			if err := nginxGenerateConfig(ctx); err != nil {
+			if err := nginxApplyConfig(ctx, NginxTriggerLetsEncrypt, hash); err != nil {
 				return errors.Wrapf(err, "nginx config and reload")
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, &struct {
+				Hash string `json:"hash"`
+			}{
+				Hash: renderedConfigHash(),
+			})
 			logger.Tf(ctx, "nginx letsencrypt ok, domain=%v, token=%vB", domain, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1507,9 +1802,12 @@ func handleMgmtCertQuery(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/cert/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -1540,7 +1838,7 @@ func handleMgmtCertQuery(ctx context.Context, handler *http.ServeMux) {
 				}
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Provider string `json:"provider"`
 				Domain   string `json:"domain"`
 				Key      string `json:"key"`
@@ -1553,7 +1851,7 @@ func handleMgmtCertQuery(ctx context.Context, handler *http.ServeMux) {
 			)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1562,9 +1860,12 @@ func handleMgmtStreamsQuery(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/streams/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -1583,24 +1884,63 @@ func handleMgmtStreamsQuery(ctx context.Context, handler *http.ServeMux) {
 			}
 
 			var streamObjects []*SrsStream
-			for _, value := range streams {
+			var streamURLs []string
+			for streamURL, value := range streams {
 				var stream SrsStream
 				if err := json.Unmarshal([]byte(value), &stream); err != nil {
 					return errors.Wrapf(err, "unmarshal %v", value)
 				}
 
 				streamObjects = append(streamObjects, &stream)
+				streamURLs = append(streamURLs, streamURL)
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			profiles, err := queryHLSProfileStates(ctx, streamURLs)
+			if err != nil {
+				return errors.Wrapf(err, "query hls profiles")
+			}
+
+			windows, err := queryScheduleWindows(ctx, time.Now())
+			if err != nil {
+				return errors.Wrapf(err, "query schedule windows")
+			}
+
+			healths, err := queryStreamHealths(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query healths")
+			}
+			for streamURL := range healths {
+				if _, ok := streams[streamURL]; !ok {
+					delete(healths, streamURL)
+				}
+			}
+
+			endpoints, err := queryPlaybackEndpoints(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query playback")
+			}
+			playbacks := make(map[string]*PlaybackURLs)
+			for _, stream := range streamObjects {
+				playbacks[stream.StreamURL()] = endpoints.URLs(stream.App, stream.Stream)
+			}
+
+			httpWriteData(ctx, w, r, &struct {
 				Streams []*SrsStream `json:"streams"`
+				// The current or upcoming schedule windows.
+				Schedules []*StreamScheduleWindow `json:"schedules"`
+				// The effective HLS profile of streams, key is stream URL.
+				HLSProfiles map[string]*HLSProfileState `json:"hlsProfiles"`
+				// The playback URLs of streams by the playback setting, key is stream URL.
+				Playbacks map[string]*PlaybackURLs `json:"playbacks"`
+				// The health score and factors of streams, key is stream URL.
+				Health map[string]*StreamHealth `json:"health"`
 			}{
-				streamObjects,
+				streamObjects, windows, profiles, playbacks, healths,
 			})
 			logger.Tf(ctx, "query streams ok, streams=%v, token=%vB", len(streamObjects), len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 }
@@ -1612,10 +1952,13 @@ func handleMgmtStreamsKickoff(ctx context.Context, handler *http.ServeMux) {
 	ep := "/terraform/v1/mgmt/streams/kickoff"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var vhost, app, stream string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token  *string `json:"token"`
 				Vhost  *string `json:"vhost"`
 				App    *string `json:"app"`
@@ -1655,86 +1998,163 @@ func handleMgmtStreamsKickoff(ctx context.Context, handler *http.ServeMux) {
 				return errors.Errorf("no client_id for %v", streamURL)
 			}
 
-			// Start request and parse the code.
-			requestClient := func(ctx context.Context, clientURL, method string) (int, string, error) {
-				req, err := http.NewRequest(method, clientURL, nil)
-				if err != nil {
-					return 0, "", errors.Wrapf(err, "new request")
-				}
+			code, err := kickoffStream(ctx, streamObject)
+			if err != nil {
+				return errors.Wrapf(err, "kickoff %v", streamURL)
+			}
 
-				res, err := http.DefaultClient.Do(req.WithContext(ctx))
-				if err != nil {
-					return 0, "", errors.Wrapf(err, "do request")
-				}
-				defer res.Body.Close()
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "kickoff stream ok, code=%v, token=%vB", code, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
 
-				b, err := io.ReadAll(res.Body)
-				if err != nil {
-					return 0, "", errors.Wrapf(err, "http read body")
-				}
+// kickoffStream kicks the publisher of stream by SRS API, and removes it from the active streams.
+func kickoffStream(ctx context.Context, streamObject *SrsStream) (int, error) {
+	// Start request and parse the code.
+	requestClient := func(ctx context.Context, clientURL, method string) (int, string, error) {
+		req, err := http.NewRequest(method, clientURL, nil)
+		if err != nil {
+			return 0, "", errors.Wrapf(err, "new request")
+		}
 
-				if res.StatusCode != http.StatusOK {
-					return 0, "", errors.Errorf("status %v", res.StatusCode)
-				}
+		res, err := http.DefaultClient.Do(req.WithContext(ctx))
+		if err != nil {
+			return 0, "", errors.Wrapf(err, "do request")
+		}
+		defer res.Body.Close()
 
-				var code int
-				if err := json.Unmarshal(b, &struct {
-					Code *int `json:"code"`
-				}{
-					Code: &code,
-				}); err != nil {
-					return 0, "", errors.Wrapf(err, "unmarshal %v", string(b))
-				}
-				return code, string(b), nil
-			}
+		b, err := io.ReadAll(res.Body)
+		if err != nil {
+			return 0, "", errors.Wrapf(err, "http read body")
+		}
 
-			// Whether client exists in SRS server.
-			var code int
-			clientURL := fmt.Sprintf("http://127.0.0.1:1985/api/v1/clients/%v", streamObject.Client)
-			if r0, body, err := requestClient(ctx, clientURL, http.MethodGet); err != nil {
-				return errors.Wrapf(err, "http query client %v", clientURL)
-			} else if r0 != 0 && r0 != ErrorRtmpClientNotFound {
-				return errors.Errorf("invalid code=%v, body=%v", r0, body)
-			} else {
-				code = r0
-			}
+		if res.StatusCode != http.StatusOK {
+			return 0, "", errors.Errorf("status %v", res.StatusCode)
+		}
 
-			// Kickoff if exists, ignore if not.
-			if code == 0 {
-				if r0, body, err := requestClient(ctx, clientURL, http.MethodDelete); err != nil {
-					return errors.Wrapf(err, "kickoff %v, body %v", clientURL, body)
-				} else if r0 != 0 && r0 != ErrorRtmpClientNotFound {
-					return errors.Errorf("invalid code=%v, body=%v", r0, body)
-				}
-			}
+		var code int
+		if err := json.Unmarshal(b, &struct {
+			Code *int `json:"code"`
+		}{
+			Code: &code,
+		}); err != nil {
+			return 0, "", errors.Wrapf(err, "unmarshal %v", string(b))
+		}
+		return code, string(b), nil
+	}
 
-			if err := rdb.HDel(ctx, SRS_STREAM_ACTIVE, streamURL).Err(); err != nil && err != redis.Nil {
-				return errors.Wrapf(err, "hdel %v %v", SRS_STREAM_ACTIVE, streamURL)
-			}
+	// Whether client exists in SRS server.
+	var code int
+	clientURL := fmt.Sprintf("http://127.0.0.1:1985/api/v1/clients/%v", streamObject.Client)
+	if r0, body, err := requestClient(ctx, clientURL, http.MethodGet); err != nil {
+		return 0, errors.Wrapf(err, "http query client %v", clientURL)
+	} else if r0 != 0 && r0 != ErrorRtmpClientNotFound {
+		return 0, errors.Errorf("invalid code=%v, body=%v", r0, body)
+	} else {
+		code = r0
+	}
 
-			ohttp.WriteData(ctx, w, r, nil)
-			logger.Tf(ctx, "kickoff stream ok, code=%v, token=%vB", code, len(token))
-			return nil
-		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+	// Kickoff if exists, ignore if not.
+	if code == 0 {
+		if r0, body, err := requestClient(ctx, clientURL, http.MethodDelete); err != nil {
+			return 0, errors.Wrapf(err, "kickoff %v, body %v", clientURL, body)
+		} else if r0 != 0 && r0 != ErrorRtmpClientNotFound {
+			return 0, errors.Errorf("invalid code=%v, body=%v", r0, body)
 		}
-	})
+	}
+
+	streamURL := streamObject.StreamURL()
+	if err := rdb.HDel(ctx, SRS_STREAM_ACTIVE, streamURL).Err(); err != nil && err != redis.Nil {
+		return 0, errors.Wrapf(err, "hdel %v %v", SRS_STREAM_ACTIVE, streamURL)
+	}
+
+	return code, nil
+}
+
+// The default locale of UI, which is always built, see ui/Makefile.
+const defaultUILocale = "en"
+
+// The page to serve if UI is not built, for example, a fresh source checkout.
+const uiPlaceholderPage = `<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Oryx</title></head>
+<body>
+<h1>Oryx UI is not built</h1>
+<p>The platform is running, but there is no UI in ui/build. Please build the UI, then restart the platform:</p>
+<pre>make -C ui</pre>
+<p>See DEVELOPER.md for details.</p>
+</body>
+</html>
+`
+
+// resolveUIRoot returns the directory of UI for locale in buildDir, or the default locale if the locale is not built.
+// Return empty if the UI is not built at all.
+func resolveUIRoot(ctx context.Context, buildDir, locale string) string {
+	built := func(dir string) bool {
+		info, err := os.Stat(path.Join(dir, "index.html"))
+		return err == nil && !info.IsDir()
+	}
+
+	if fileRoot := path.Join(buildDir, locale); built(fileRoot) {
+		return fileRoot
+	}
+
+	if fileRoot := path.Join(buildDir, defaultUILocale); built(fileRoot) {
+		logger.Wf(ctx, "UI for locale %v not found in %v, fallback to %v", locale, buildDir, fileRoot)
+		return fileRoot
+	}
+
+	logger.Wf(ctx, "UI not found in %v, serve placeholder page, please build UI by make -C ui", buildDir)
+	return ""
+}
+
+// The allowed methods of the static file server of UI.
+const uiAllowMethods = "GET, HEAD, OPTIONS"
+
+// The extensions of static assets of UI, which are never served as the main page.
+var uiStaticExtensions = map[string]bool{
+	".js": true, ".mjs": true, ".css": true, ".map": true, ".json": true, ".txt": true, ".wasm": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".ico": true, ".webp": true,
+	".woff": true, ".woff2": true, ".ttf": true, ".eot": true,
+}
+
+func isUIStaticAsset(p string) bool {
+	return uiStaticExtensions[strings.ToLower(path.Ext(p))]
 }
 
 func handleMgmtUI(ctx context.Context, handler *http.ServeMux) {
 	// Serve UI at platform.
-	fileRoot := path.Join(conf.Pwd, "../ui/build", envReactAppLocale())
+	fileRoot := resolveUIRoot(ctx, path.Join(conf.Pwd, "../ui/build"), envReactAppLocale())
+	conf.UIRoot = fileRoot
 
 	fileServer := http.FileServer(http.Dir(fileRoot))
-	logger.Tf(ctx, "File server at %v", fileRoot)
+	logger.Tf(ctx, "File server at %v, locale=%v", fileRoot, envReactAppLocale())
 
 	mgmtHandler := func(w http.ResponseWriter, r *http.Request) {
+		// Only serve the static files, answer OPTIONS for CDN probes with the allowed methods.
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+		case http.MethodOptions:
+			w.Header().Set("Allow", uiAllowMethods)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		default:
+			w.Header().Set("Allow", uiAllowMethods)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
 		// Trim the start prefix.
 		r.URL.Path = r.URL.Path[len("/mgmt"):]
 
-		// If home or route page, always use virtual main page to serve it.
+		// If home or route page, always use virtual main page to serve it. The asset under route is not main page,
+		// so a broken reference is 404 rather than HTML.
 		serveAsMainPage := r.URL.Path == "/index.html" || r.URL.Path == "/" || r.URL.Path == ""
-		if strings.Contains(r.URL.Path, "/routers-") {
+		if strings.Contains(r.URL.Path, "/routers-") && !isUIStaticAsset(r.URL.Path) {
 			serveAsMainPage = true
 		}
 		// Should never use /index.html, which will be redirect to /.
@@ -1742,8 +2162,31 @@ func handleMgmtUI(ctx context.Context, handler *http.ServeMux) {
 			r.URL.Path = "/"
 		}
 
-		// We should never cache the main page for react.
-		if !serveAsMainPage {
+		// Serve the placeholder page if UI is not built, rather than 404 for all.
+		if fileRoot == "" {
+			if !serveAsMainPage {
+				http.NotFound(w, r)
+				return
+			}
+			ohttp.SetHeader(w)
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Header().Set("Content-Length", fmt.Sprintf("%v", len(uiPlaceholderPage)))
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			if r.Method != http.MethodHead {
+				w.Write([]byte(uiPlaceholderPage))
+			}
+			return
+		}
+
+		// We should never cache the main page for react. Never cache the 404 of assets either, which might be
+		// available after UI is rebuilt.
+		if serveAsMainPage {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else if _, err := os.Stat(path.Join(fileRoot, path.Clean("/"+r.URL.Path))); err != nil {
+			http.NotFound(w, r)
+			return
+		} else {
 			w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%v", 365*24*3600))
 		}
 
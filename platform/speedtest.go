@@ -0,0 +1,318 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	"github.com/golang-jwt/jwt/v4"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The audience of speedtest token, which is only for the ingest bandwidth test.
+const speedtestTokenAudience = "speedtest"
+
+const (
+	// The default and max expire of speedtest token.
+	speedtestTokenDefaultExpire = 10 * time.Minute
+	speedtestTokenMaxExpire     = 24 * time.Hour
+	// The max duration and bytes of a test, the rest of data is not read.
+	speedtestMaxDuration = 10 * time.Second
+	speedtestMaxBytes    = 256 * 1024 * 1024
+	// The interval to sample the throughput.
+	speedtestInterval = 500 * time.Millisecond
+	// The max number of concurrent tests.
+	speedtestMaxConcurrency = 2
+	// The ratio of the sustained throughput, which is safe for the bitrate of publisher.
+	speedtestSafeRatio = 0.75
+)
+
+// The slots of concurrent tests.
+var speedtestSlots = make(chan bool, speedtestMaxConcurrency)
+
+// speedtestTokenKey derives the key from api secret, so that the speedtest token, which is given to publishers, is
+// never accepted as the token of API or playback.
+func speedtestTokenKey(apiSecret string) []byte {
+	h := hmac.New(sha256.New, []byte(apiSecret))
+	h.Write([]byte("oryx-speedtest-token"))
+	return h.Sum(nil)
+}
+
+// createSpeedtestToken creates the signed token to run the ingest bandwidth test, before expireAt.
+func createSpeedtestToken(apiSecret string, expireAt time.Time) (string, error) {
+	if err := checkApiSecret(apiSecret); err != nil {
+		return "", errors.Wrapf(err, "check api secret")
+	}
+
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    tokenIssuer,
+		Audience:  jwt.ClaimStrings{speedtestTokenAudience},
+		ExpiresAt: jwt.NewNumericDate(expireAt),
+		IssuedAt:  jwt.NewNumericDate(time.Now()),
+	}).SignedString(speedtestTokenKey(apiSecret))
+	if err != nil {
+		return "", errors.Wrapf(err, "jwt sign")
+	}
+	return token, nil
+}
+
+// verifySpeedtestToken verifies the token is signed for speedtest, and not expired.
+func verifySpeedtestToken(apiSecret, token string) error {
+	if err := checkApiSecret(apiSecret); err != nil {
+		return errors.Wrapf(err, "check api secret")
+	}
+
+	var claims jwt.RegisteredClaims
+	if _, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.Errorf("invalid signing method %v", token.Header["alg"])
+		}
+		return speedtestTokenKey(apiSecret), nil
+	}); err != nil {
+		return errors.Wrapf(withClockHint(err), "verify token")
+	}
+
+	if !claims.VerifyAudience(speedtestTokenAudience, true) {
+		return errors.Errorf("invalid audience %v", claims.Audience)
+	}
+	return nil
+}
+
+// verifySpeedtestKey verifies the publish key of stream, the secret of live room if the stream has a publish key,
+// otherwise the global publish secret. Note that it's rejected if there is no secret, because the test is not for
+// anonymous.
+func verifySpeedtestKey(ctx context.Context, stream, secret string) error {
+	// The publish key is hashed, see hashStreamSecret.
+	if hashed, err := rdb.HGet(ctx, SRS_AUTH_SECRET, GenerateRoomPublishKey(stream)).Result(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hget %v %v", SRS_AUTH_SECRET, GenerateRoomPublishKey(stream))
+	} else if hashed != "" {
+		if !matchStreamSecret(hashed, secret) {
+			return errors.Errorf("invalid key of stream %v", stream)
+		}
+		return nil
+	}
+
+	publish, err := rdb.HGet(ctx, SRS_AUTH_SECRET, "pubSecret").Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hget %v pubSecret", SRS_AUTH_SECRET)
+	}
+	if publish == "" || subtle.ConstantTimeCompare([]byte(publish), []byte(secret)) != 1 {
+		return errors.Errorf("invalid key of stream %v", stream)
+	}
+	return nil
+}
+
+// SpeedtestResult is the result of ingest bandwidth test.
+type SpeedtestResult struct {
+	// The bytes received.
+	Bytes int64 `json:"bytes"`
+	// The duration of test in milliseconds.
+	Duration int64 `json:"duration"`
+	// The throughput of each sample in kbps.
+	Samples []int `json:"samples"`
+	// The sustained throughput in kbps, ignoring the first sample of TCP slow start.
+	Kbps int `json:"kbps"`
+	// The jitter of throughput in kbps, the standard deviation of samples.
+	Jitter int `json:"jitter"`
+	// The recommended max bitrate of publisher in kbps.
+	Recommended int `json:"recommended"`
+	// Whether the test is stopped by the max duration or bytes, before the client finishes.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+func (v *SpeedtestResult) String() string {
+	return fmt.Sprintf("bytes=%v, duration=%vms, samples=%v, kbps=%v, jitter=%v, recommended=%v, truncated=%v",
+		v.Bytes, v.Duration, len(v.Samples), v.Kbps, v.Jitter, v.Recommended, v.Truncated,
+	)
+}
+
+// analyze calculates the sustained throughput, jitter and the recommended bitrate by samples.
+func (v *SpeedtestResult) analyze() {
+	samples := v.Samples
+	if len(samples) > 2 {
+		samples = samples[1:]
+	}
+	if len(samples) == 0 {
+		return
+	}
+
+	var sum float64
+	for _, kbps := range samples {
+		sum += float64(kbps)
+	}
+	mean := sum / float64(len(samples))
+
+	var variance float64
+	for _, kbps := range samples {
+		variance += (float64(kbps) - mean) * (float64(kbps) - mean)
+	}
+	jitter := math.Sqrt(variance / float64(len(samples)))
+
+	v.Kbps, v.Jitter = int(mean), int(jitter)
+	v.Recommended = int(math.Max(0, (mean-jitter)*speedtestSafeRatio))
+}
+
+// measureIngest reads and discards the data, and samples the throughput for each interval, until EOF, canceled, or
+// exceeds the max duration or bytes.
+func measureIngest(
+	ctx context.Context, r io.Reader, interval, maxDuration time.Duration, maxBytes int64,
+) (*SpeedtestResult, error) {
+	res := &SpeedtestResult{Samples: []int{}}
+	buf := make([]byte, 32*1024)
+
+	start := time.Now()
+	sampleStart, sampleBytes := start, int64(0)
+	addSample := func(now time.Time) {
+		if elapsed := now.Sub(sampleStart); elapsed > 0 {
+			res.Samples = append(res.Samples, int(float64(sampleBytes*8)/elapsed.Seconds()/1000))
+		}
+		sampleStart, sampleBytes = now, 0
+	}
+
+	for ctx.Err() == nil {
+		n, err := r.Read(buf)
+		res.Bytes, sampleBytes = res.Bytes+int64(n), sampleBytes+int64(n)
+
+		now := time.Now()
+		if now.Sub(sampleStart) >= interval {
+			addSample(now)
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrapf(err, "read")
+		}
+
+		if now.Sub(start) >= maxDuration || res.Bytes >= maxBytes {
+			res.Truncated = true
+			break
+		}
+	}
+
+	// Ignore the last sample if too short, which is not accurate.
+	if now := time.Now(); now.Sub(sampleStart) >= interval/2 || len(res.Samples) == 0 {
+		addSample(now)
+	}
+
+	res.Duration = int64(time.Since(start) / time.Millisecond)
+	res.analyze()
+	return res, nil
+}
+
+func handleMgmtSpeedtest(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/speedtest/token"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var expire int
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Expire *int    `json:"expire"`
+			}{
+				Token: &token, Expire: &expire,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if expire < 0 || time.Duration(expire)*time.Second > speedtestTokenMaxExpire {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid expire %v, should in [0, %v]",
+					expire, int(speedtestTokenMaxExpire/time.Second)))
+			}
+
+			expireAt := time.Now().Add(speedtestTokenDefaultExpire)
+			if expire > 0 {
+				expireAt = time.Now().Add(time.Duration(expire) * time.Second)
+			}
+
+			testToken, err := createSpeedtestToken(apiSecret, expireAt)
+			if err != nil {
+				return errors.Wrapf(err, "create token")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Token    string `json:"token"`
+				ExpireAt string `json:"expireAt"`
+			}{
+				Token: testToken, ExpireAt: expireAt.Format(time.RFC3339),
+			})
+			logger.Tf(ctx, "speedtest token ok, expire=%v, token=%vB", expireAt.Format(time.RFC3339), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	// The client POST the generated data as body, authenticated by the speedtest token, or the stream and its
+	// publish key, in query, for example, ?stream=livestream&secret=xxx.
+	ep = "/terraform/v1/mgmt/speedtest/ingest"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			if r.Method != http.MethodPost {
+				return newHttpStatusError(http.StatusMethodNotAllowed, errors.Errorf("invalid method %v", r.Method))
+			}
+
+			q := r.URL.Query()
+			if token := q.Get("token"); token != "" {
+				if err := verifySpeedtestToken(envApiSecret(), token); err != nil {
+					return newHttpStatusError(http.StatusUnauthorized, errors.Wrapf(err, "verify token"))
+				}
+			} else if stream := q.Get("stream"); stream != "" {
+				if err := verifySpeedtestKey(ctx, stream, q.Get("secret")); err != nil {
+					return newHttpStatusError(http.StatusUnauthorized, errors.Wrapf(err, "verify key"))
+				}
+			} else {
+				return newHttpStatusError(http.StatusUnauthorized, errors.New("no token or stream"))
+			}
+
+			select {
+			case speedtestSlots <- true:
+				defer func() { <-speedtestSlots }()
+			default:
+				w.Header().Set("Retry-After", fmt.Sprintf("%v", int(speedtestMaxDuration.Seconds())))
+				return newHttpCodeError(http.StatusTooManyRequests, SrsStackErrorTooManyRequests,
+					errors.Errorf("too many tests, max %v", speedtestMaxConcurrency),
+				)
+			}
+
+			res, err := measureIngest(ctx, r.Body, speedtestInterval, speedtestMaxDuration, speedtestMaxBytes)
+			if err != nil {
+				return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "measure"))
+			}
+
+			httpWriteData(ctx, w, r, res)
+			logger.Tf(ctx, "speedtest ingest ok, client=%v, %v", clientIP(r), res.String())
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -13,3 +13,53 @@ const (
 	// Error for callback module, about the record events.
 	SrsStackErrorCallbackRecord SrsStackError = 100
 )
+
+// Error code for HTTP API, compatible with the UI, see Errors of ui/src/utils.js
+const (
+	// Failed to verify the token or bearer secret.
+	SrsStackErrorAuth SrsStackError = 2001
+	// The body is malformed JSON, or the field is invalid.
+	SrsStackErrorInvalidBody SrsStackError = 2002
+	// The Content-Type of body is not JSON.
+	SrsStackErrorContentType SrsStackError = 2003
+	// Too many requests in flight, please retry later.
+	SrsStackErrorTooManyRequests SrsStackError = 2004
+	// There are live streams, which will be interrupted by upgrade.
+	SrsStackErrorStreamsLive SrsStackError = 2005
+	// The operation is in progress by another platform replica.
+	SrsStackErrorLockBusy SrsStackError = 2006
+	// The feature is disabled for this install.
+	SrsStackErrorFeatureDisabled SrsStackError = 2007
+	// The SRT streamid is malformed.
+	SrsStackErrorSrtStreamID SrsStackError = 2008
+	// The handler panics, please report with the request ID.
+	SrsStackErrorInternal SrsStackError = 2009
+	// Failed to generate NGINX config or reload NGINX, see the nginx status for the error.
+	SrsStackErrorNginx SrsStackError = 2010
+	// The api secret SRS_PLATFORM_SECRET is empty or too weak, so the authenticated API is refused.
+	SrsStackErrorNotConfigured SrsStackError = 2011
+	// The configuration is invalid, see the details for the issue of each field.
+	SrsStackErrorConfigInvalid SrsStackError = 2012
+	// The feature requires docker, which is not supported when running as host processes.
+	SrsStackErrorHostModeNotSupported SrsStackError = 2013
+	// The token without admin scope, should login or present the password.
+	SrsStackErrorAdminRequired SrsStackError = 2014
+	// The request exceeds the timeout of route.
+	SrsStackErrorRequestTimeout SrsStackError = 2015
+	// The platform is starting up, waiting for the dependencies such as redis.
+	SrsStackErrorStartingUp SrsStackError = 2016
+	// The stream name violates the naming policy, for example, with space or reserved.
+	SrsStackErrorStreamName SrsStackError = 2017
+	// The media file is used by an active vLive source, should stop it or force to remove.
+	SrsStackErrorMediaInUse SrsStackError = 2018
+	// The one-time code to recover password is invalid or expired, should start again.
+	SrsStackErrorRecoverCode SrsStackError = 2019
+	// The NGINX config differs from the previewed one, for example, the settings changed, should preview again.
+	SrsStackErrorNginxPreview SrsStackError = 2020
+	// The confirmation of reset mismatch the subsystem, or the code of factory reset is invalid or expired.
+	SrsStackErrorResetConfirm SrsStackError = 2021
+	// The image to upgrade mismatch the expected digest, or the signature is invalid, the upgrade is aborted.
+	SrsStackErrorImageVerify SrsStackError = 2022
+	// The upgrade script PLATFORM_UPGRADE_SCRIPT is not configured, so there is no executor to upgrade.
+	SrsStackErrorUpgradeNotConfigured SrsStackError = 2023
+)
@@ -0,0 +1,228 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The duration to cache the SRS statistics, to protect SRS from frequent scrapes.
+const srsExporterCacheTTL = 2 * time.Second
+
+// The timeout to query the SRS API.
+const srsExporterTimeout = 3 * time.Second
+
+// The max number of streams with labels, sorted by clients, the others are aggregated as _others, to bound the
+// label cardinality.
+const srsExporterMaxStreams = 50
+
+// The label of streams aggregated, which exceed srsExporterMaxStreams.
+const srsExporterOtherStreams = "_others"
+
+var srsExporter = NewSrsExporter()
+
+// SrsExporterStream is the statistic of a stream in SRS.
+type SrsExporterStream struct {
+	// The stream URL, for example, live/livestream.
+	Stream string
+	// The number of clients, including the publisher.
+	Clients int
+	// Whether the publisher is active.
+	Active bool
+	// The bitrate in kbps, in the last 30s.
+	RecvKbps int
+	SendKbps int
+}
+
+// SrsExporterStats is the statistics of SRS, from the API of summaries and streams.
+type SrsExporterStats struct {
+	// The CPU and memory of SRS process.
+	CPUPercent float64
+	MemKbyte   int64
+	// The uptime of SRS in seconds.
+	Uptime int64
+	// The number of connections of SRS.
+	Connections int64
+	// The streams, sorted by clients.
+	Streams []*SrsExporterStream
+}
+
+// SrsExporter bridges the SRS statistics into the Prometheus metrics of platform, instead of running the separate
+// srs-exporter. It pulls SRS on scrape, and caches the statistics for srsExporterCacheTTL.
+type SrsExporter struct {
+	// The cached statistics, and the last error if SRS is down.
+	stats  *SrsExporterStats
+	err    error
+	update time.Time
+	// The lock for cache, also serialize the queries to SRS.
+	lock sync.Mutex
+	// For test to overwrite the SRS API server.
+	apiServer func() string
+}
+
+func NewSrsExporter() *SrsExporter {
+	return &SrsExporter{apiServer: envSrsApiServer}
+}
+
+// Query returns the statistics of SRS, which is cached for a while, including the error.
+func (v *SrsExporter) Query(ctx context.Context) (*SrsExporterStats, error) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if !v.update.IsZero() && time.Since(v.update) < srsExporterCacheTTL {
+		return v.stats, v.err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, srsExporterTimeout)
+	defer cancel()
+
+	v.stats, v.err = v.query(ctx)
+	v.update = time.Now()
+	return v.stats, v.err
+}
+
+func (v *SrsExporter) get(ctx context.Context, api string, data interface{}) error {
+	url := fmt.Sprintf("%v%v", v.apiServer(), api)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return errors.Wrapf(err, "new request %v", url)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "get %v", url)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return errors.Wrapf(err, "read %v", url)
+	}
+	if res.StatusCode != http.StatusOK {
+		return errors.Errorf("get %v, status=%v, body=%v", url, res.StatusCode, string(b))
+	}
+
+	if err := json.Unmarshal(b, data); err != nil {
+		return errors.Wrapf(err, "unmarshal %v", string(b))
+	}
+	return nil
+}
+
+func (v *SrsExporter) query(ctx context.Context) (*SrsExporterStats, error) {
+	var summaries struct {
+		Code int `json:"code"`
+		Data struct {
+			Self struct {
+				MemKbyte   int64   `json:"mem_kbyte"`
+				CPUPercent float64 `json:"cpu_percent"`
+				Uptime     int64   `json:"srs_uptime"`
+			} `json:"self"`
+			System struct {
+				ConnSrs int64 `json:"conn_srs"`
+			} `json:"system"`
+		} `json:"data"`
+	}
+	if err := v.get(ctx, "/api/v1/summaries", &summaries); err != nil {
+		return nil, errors.Wrapf(err, "query summaries")
+	} else if summaries.Code != 0 {
+		return nil, errors.Errorf("query summaries, code=%v", summaries.Code)
+	}
+
+	var streams struct {
+		Code    int `json:"code"`
+		Streams []struct {
+			App     string `json:"app"`
+			Name    string `json:"name"`
+			Clients int    `json:"clients"`
+			Kbps    struct {
+				Recv int `json:"recv_30s"`
+				Send int `json:"send_30s"`
+			} `json:"kbps"`
+			Publish struct {
+				Active bool `json:"active"`
+			} `json:"publish"`
+		} `json:"streams"`
+	}
+	if err := v.get(ctx, "/api/v1/streams?count=1000", &streams); err != nil {
+		return nil, errors.Wrapf(err, "query streams")
+	} else if streams.Code != 0 {
+		return nil, errors.Errorf("query streams, code=%v", streams.Code)
+	}
+
+	stats := &SrsExporterStats{
+		CPUPercent: summaries.Data.Self.CPUPercent, MemKbyte: summaries.Data.Self.MemKbyte,
+		Uptime: summaries.Data.Self.Uptime, Connections: summaries.Data.System.ConnSrs,
+	}
+	for _, s := range streams.Streams {
+		stats.Streams = append(stats.Streams, &SrsExporterStream{
+			Stream: fmt.Sprintf("%v/%v", s.App, s.Name), Clients: s.Clients, Active: s.Publish.Active,
+			RecvKbps: s.Kbps.Recv, SendKbps: s.Kbps.Send,
+		})
+	}
+	sort.SliceStable(stats.Streams, func(i, j int) bool {
+		if stats.Streams[i].Clients != stats.Streams[j].Clients {
+			return stats.Streams[i].Clients > stats.Streams[j].Clients
+		}
+		return stats.Streams[i].Stream < stats.Streams[j].Stream
+	})
+	return stats, nil
+}
+
+// Collect writes the SRS metrics. It never fails the scrape, the up{component="srs"} is 0 if SRS is down.
+func (v *SrsExporter) Collect(ctx context.Context, w *PrometheusWriter) {
+	stats, err := v.Query(ctx)
+	if err != nil {
+		logThrottle.Wf(ctx, "srs exporter query", "srs exporter ignore err %+v", err)
+		w.Gauge("up", "Whether the component is up.", 0, "component", "srs")
+		return
+	}
+	w.Gauge("up", "Whether the component is up.", 1, "component", "srs")
+
+	w.Gauge("oryx_srs_cpu_percent", "The CPU usage of SRS process.", stats.CPUPercent)
+	w.Gauge("oryx_srs_memory_kbyte", "The memory of SRS process in KB.", float64(stats.MemKbyte))
+	w.Gauge("oryx_srs_uptime_seconds", "The uptime of SRS in seconds.", float64(stats.Uptime))
+	w.Gauge("oryx_srs_connections", "The number of connections of SRS.", float64(stats.Connections))
+
+	var live, clients int
+	for _, s := range stats.Streams {
+		if s.Active {
+			live++
+		}
+		clients += s.Clients
+	}
+	w.Gauge("oryx_srs_streams_live", "The number of streams with active publisher.", float64(live))
+	w.Gauge("oryx_srs_clients", "The number of clients of all streams, including publishers.", float64(clients))
+
+	// Bound the label cardinality, the streams with most clients are labeled, and the others are aggregated.
+	streams := stats.Streams
+	if len(streams) > srsExporterMaxStreams {
+		others := &SrsExporterStream{Stream: srsExporterOtherStreams}
+		for _, s := range streams[srsExporterMaxStreams:] {
+			others.Clients += s.Clients
+			others.RecvKbps += s.RecvKbps
+			others.SendKbps += s.SendKbps
+		}
+		streams = append(streams[:srsExporterMaxStreams:srsExporterMaxStreams], others)
+	}
+
+	for _, s := range streams {
+		w.Gauge("oryx_srs_stream_clients", "The number of clients of stream.", float64(s.Clients), "stream", s.Stream)
+	}
+	for _, s := range streams {
+		w.Gauge("oryx_srs_stream_recv_kbps", "The receive bitrate of stream in kbps.", float64(s.RecvKbps), "stream", s.Stream)
+	}
+	for _, s := range streams {
+		w.Gauge("oryx_srs_stream_send_kbps", "The send bitrate of stream in kbps.", float64(s.SendKbps), "stream", s.Stream)
+	}
+}
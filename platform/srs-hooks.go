@@ -9,7 +9,6 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"net/url"
@@ -19,7 +18,6 @@ import (
 	"time"
 
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
 	"github.com/go-redis/redis/v8"
@@ -49,11 +47,23 @@ const (
 
 	// The on_ocr action.
 	SrsActionOnOcr = "on_ocr"
+
+	// The on_task action, for lifecycle transitions of FFmpeg tasks.
+	SrsActionOnTask = "on_task"
+
+	// The on_quota action, for violations of stream quota.
+	SrsActionOnQuota = "on_quota"
+
+	// The on_event action, for the events on bus, see EventBus.
+	SrsActionOnEvent = "on_event"
 )
 
 func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 	versionHandler := func(w http.ResponseWriter, r *http.Request) {
-		ohttp.WriteData(ctx, w, r, &struct {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		httpWriteData(ctx, w, r, &struct {
 			Version string `json:"version"`
 		}{
 			Version: strings.TrimPrefix(version, "v"),
@@ -72,60 +82,48 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 	ep = "/terraform/v1/hooks/srs/verify"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
+			// Verify the callback is from SRS, even if the publish authentication is disabled.
+			if err := verifyHooksSecret(ctx, r); err != nil {
+				return errors.Wrapf(err, "verify hooks secret")
+			}
+
 			if noAuth, err := rdb.HGet(ctx, SRS_AUTH_SECRET, "pubNoAuth").Result(); err != nil && err != redis.Nil {
 				return errors.Wrapf(err, "hget %v pubNoAuth", SRS_AUTH_SECRET)
 			} else if noAuth == "true" {
-				ohttp.WriteData(ctx, w, r, nil)
+				httpWriteData(ctx, w, r, nil)
 				logger.Tf(ctx, "srs hooks disabled")
 				return nil
 			}
 
-			b, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				return errors.Wrapf(err, "read body")
-			}
-			requestBody := string(b)
-
 			var action SrsAction
 			var streamObj SrsStream
-			if err := json.Unmarshal(b, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Action *SrsAction `json:"action"`
 				*SrsStream
 			}{
 				Action: &action, SrsStream: &streamObj,
 			}); err != nil {
-				return errors.Wrapf(err, "json unmarshal %v", string(b))
+				return errors.Wrapf(err, "parse body")
+			}
+			if action == "" {
+				return newHttpCodeError(http.StatusBadRequest, SrsStackErrorInvalidBody, errors.New("no action"))
 			}
 
 			verifiedBy := "noVerify"
 			if action == SrsActionOnPublish {
-				// Note that we allow pass secret by params or in stream name, for example, some encoder does not support params
-				// with ?secret=xxx, so it will fail when url is:
-				//      rtmp://ip/live/livestream?secret=xxx
-				// so user could change the url to bellow to get around of it:
-				//      rtmp://ip/live/livestreamxxx
-				// or simply use secret as stream:
-				//      rtmp://ip/live/xxx
-				// in this situation, the secret is part of stream name.
-				isSecretOK := func(publish, stream, param string) bool {
-					return publish == "" || strings.Contains(param, publish) || strings.Contains(stream, publish)
-				}
+				var err error
+				verifiedBy, err = verifyPublish(ctx, &streamObj)
 
-				// Use live room secret to verify if stream name matches.
-				roomPublishAuthKey := GenerateRoomPublishKey(streamObj.Stream)
-				publish, err := rdb.HGet(ctx, SRS_AUTH_SECRET, roomPublishAuthKey).Result()
-				verifiedBy = "room"
-				if publish == "" {
-					// Use global publish secret to verify
-					publish, err = rdb.HGet(ctx, SRS_AUTH_SECRET, "pubSecret").Result()
-					verifiedBy = "global"
-				}
-				if err != nil && err != redis.Nil {
-					return errors.Wrapf(err, "hget %v pubSecret", SRS_AUTH_SECRET)
+				// Record the attempt of SRT publisher, which is authenticated by streamid.
+				if streamObj.IsSRT() {
+					recordPublishAudit(ctx, "srt", &streamObj, err)
 				}
-				if !isSecretOK(publish, streamObj.Stream, streamObj.Param) {
-					return errors.Errorf("invalid normal stream=%v, param=%v, action=%v", streamObj.Stream, streamObj.Param, action)
+				if err != nil {
+					return errors.Wrapf(err, "verify publish")
 				}
 			}
 
@@ -141,6 +139,7 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 			streamURL := streamObj.StreamURL()
 			if action == SrsActionOnPublish {
 				streamObj.Update = time.Now().Format(time.RFC3339)
+				streamObj.Guest = verifiedBy == "guest"
 
 				b, err := json.Marshal(&streamObj)
 				if err != nil {
@@ -149,7 +148,9 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 					return errors.Wrapf(err, "hset %v %v %v", SRS_STREAM_ACTIVE, streamURL, string(b))
 				}
 
-				if err := rdb.HIncrBy(ctx, SRS_STAT_COUNTER, "publish", 1).Err(); err != nil && err != redis.Nil {
+				if err := bufferedRedisWrite(ctx, "stat publish", func(ctx context.Context, pipe redis.Pipeliner) {
+					pipe.HIncrBy(ctx, SRS_STAT_COUNTER, "publish", 1)
+				}); err != nil {
 					return errors.Wrapf(err, "hincrby %v publish 1", SRS_STAT_COUNTER)
 				}
 				if streamObj.IsSRT() {
@@ -162,6 +163,18 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 						return errors.Wrapf(err, "hset %v %v %v", SRS_STREAM_RTC_ACTIVE, streamURL, string(b))
 					}
 				}
+
+				publishEvent(ctx, &StreamPublishEvent{
+					Vhost: streamObj.Vhost, App: streamObj.App, Stream: streamObj.Stream, Client: streamObj.Client,
+				})
+
+				// Start forwarding by rules, never reject the stream if failed.
+				if forwardWorker != nil {
+					forwardWorker.OnStreamPublish(ctx, &streamObj)
+				}
+				if aliasWorker != nil {
+					aliasWorker.OnStreamChanged(ctx, &streamObj)
+				}
 			} else if action == SrsActionOnUnpublish {
 				if err := rdb.HDel(ctx, SRS_STREAM_ACTIVE, streamURL).Err(); err != nil && err != redis.Nil {
 					return errors.Wrapf(err, "hset %v %v", SRS_STREAM_ACTIVE, streamURL)
@@ -176,10 +189,39 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 						return errors.Wrapf(err, "hset %v %v", SRS_STREAM_RTC_ACTIVE, streamURL)
 					}
 				}
+
+				// Consume the guest key, or release it for next session.
+				if err := releaseGuestSession(ctx, &streamObj); err != nil {
+					return errors.Wrapf(err, "release guest")
+				}
+
+				publishEvent(ctx, &StreamUnpublishEvent{
+					Vhost: streamObj.Vhost, App: streamObj.App, Stream: streamObj.Stream, Client: streamObj.Client,
+				})
+
+				// Stop forwarding by rules.
+				if forwardWorker != nil {
+					forwardWorker.OnStreamUnpublish(ctx, &streamObj)
+				}
+				if aliasWorker != nil {
+					aliasWorker.OnStreamChanged(ctx, &streamObj)
+				}
 			} else if action == "on_play" {
-				if err := rdb.HIncrBy(ctx, SRS_STAT_COUNTER, "play", 1).Err(); err != nil && err != redis.Nil {
+				if err := verifyPlay(ctx, &streamObj); err != nil {
+					return errors.Wrapf(err, "verify play")
+				}
+				if err := bufferedRedisWrite(ctx, "stat play", func(ctx context.Context, pipe redis.Pipeliner) {
+					pipe.HIncrBy(ctx, SRS_STAT_COUNTER, "play", 1)
+				}); err != nil {
 					return errors.Wrapf(err, "hincrby %v play 1", SRS_STAT_COUNTER)
 				}
+				if err := relayWorker.OnViewer(ctx, &streamObj, 1); err != nil {
+					return errors.Wrapf(err, "relay play")
+				}
+			} else if action == "on_stop" {
+				if err := relayWorker.OnViewer(ctx, &streamObj, -1); err != nil {
+					return errors.Wrapf(err, "relay stop")
+				}
 			}
 
 			// For some events, hook after all other hooks are done.
@@ -189,19 +231,22 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 				}
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
-			logger.Tf(ctx, "srs hooks ok, action=%v, verifiedBy=%v, %v, %v",
-				action, verifiedBy, streamObj.String(), requestBody)
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "srs hooks ok, action=%v, verifiedBy=%v, %v",
+				action, verifiedBy, streamObj.String())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	secretQueryHandler := func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -222,7 +267,7 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.New("system not boot yet")
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Publish string `json:"publish"`
 			}{
 				Publish: publish,
@@ -230,7 +275,7 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 			logger.Tf(ctx, "srs secret ok ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	}
 
@@ -245,9 +290,12 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 	ep = "/terraform/v1/hooks/srs/secret/update"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, secret string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token  *string `json:"token"`
 				Secret *string `json:"secret"`
 			}{
@@ -272,21 +320,24 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Wrapf(err, "set %v %v", SRS_SECRET_PUBLISH, secret)
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "hooks update secret, secret=%vB, token=%vB", len(secret), len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/hooks/srs/secret/disable"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var pubNoAuth bool
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token     *string `json:"token"`
 				PubNoAuth *bool   `json:"pubNoAuth"`
 			}{
@@ -304,11 +355,11 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 				return errors.Wrapf(err, "hset %v pubSecret %v", SRS_AUTH_SECRET, pubNoAuth)
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "hooks disable secret, pubNoAuth=%v, token=%vB", pubNoAuth, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
@@ -316,9 +367,12 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 	ep = "/terraform/v1/tencent/cam/secret"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, secretId, secretKey string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token     *string `json:"token"`
 				SecretID  *string `json:"secretId"`
 				SecretKey *string `json:"secretKey"`
@@ -390,7 +444,7 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 			}
 
 			var cosClient *cos.Client
-			location := fmt.Sprintf("%v.cos.%v.myqcloud.com", bucketName, conf.Region)
+			location := fmt.Sprintf("%v.cos.%v.myqcloud.com", bucketName, conf.Region())
 			if true {
 				u, err := url.Parse(fmt.Sprintf("https://%v", location))
 				if err != nil {
@@ -446,7 +500,7 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 								"name/cos:OptionsObject",
 							},
 							Resource: []string{
-								fmt.Sprintf("qcs::cos:%v:uid/%v:%v/*", conf.Region, appID, bucketName),
+								fmt.Sprintf("qcs::cos:%v:uid/%v:%v/*", conf.Region(), appID, bucketName),
 							},
 						},
 					},
@@ -553,11 +607,11 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 				if true {
 					request := vod.NewCreateStorageRegionRequest()
 
-					request.StorageRegion = common.StringPtr(conf.Region)
+					request.StorageRegion = common.StringPtr(conf.Region())
 					request.SubAppId = common.Uint64Ptr(uint64(vodAppIDParsed))
 
 					if _, err := vodClient.CreateStorageRegionWithContext(ctx, request); err != nil {
-						return errors.Wrapf(err, "create storage region=%v, app=%v", conf.Region, vodAppIDParsed)
+						return errors.Wrapf(err, "create storage region=%v, app=%v", conf.Region(), vodAppIDParsed)
 					}
 				}
 
@@ -565,20 +619,20 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 				if true {
 					request := vod.NewModifyDefaultStorageRegionRequest()
 
-					request.StorageRegion = common.StringPtr(conf.Region)
+					request.StorageRegion = common.StringPtr(conf.Region())
 					request.SubAppId = common.Uint64Ptr(uint64(vodAppIDParsed))
 
 					if _, err := vodClient.ModifyDefaultStorageRegionWithContext(ctx, request); err != nil {
-						return errors.Wrapf(err, "set default storage region=%v, app=%v", conf.Region, vodAppIDParsed)
+						return errors.Wrapf(err, "set default storage region=%v, app=%v", conf.Region(), vodAppIDParsed)
 					}
 				}
 
 				// Save information to redis.
-				if err := rdb.HSet(ctx, SRS_TENCENT_VOD, "storage", conf.Region).Err(); err != nil && err != redis.Nil {
-					return errors.Wrapf(err, "hset %v storage %v", SRS_TENCENT_VOD, conf.Region)
+				if err := rdb.HSet(ctx, SRS_TENCENT_VOD, "storage", conf.Region()).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v storage %v", SRS_TENCENT_VOD, conf.Region())
 				}
-				logger.Tf(ctx, "VOD create storage ok, appID=%v, region=%v", vodAppID, conf.Region)
-				sb.WriteString(fmt.Sprintf(", createVodStorage=true, vodRegion=%v", conf.Region))
+				logger.Tf(ctx, "VOD create storage ok, appID=%v, region=%v", vodAppID, conf.Region())
+				sb.WriteString(fmt.Sprintf(", createVodStorage=true, vodRegion=%v", conf.Region()))
 			}
 
 			// Query templates.
@@ -597,7 +651,7 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 
 				var templates []*vod.TranscodeTemplate
 				if response, err := vodClient.DescribeTranscodeTemplatesWithContext(ctx, request); err != nil {
-					return errors.Wrapf(err, "set query transcode templates region=%v, app=%v", conf.Region, vodAppIDParsed)
+					return errors.Wrapf(err, "set query transcode templates region=%v, app=%v", conf.Region(), vodAppIDParsed)
 				} else if *response.Response.TotalCount == 0 {
 					return errors.Errorf("invalid transcode template %v", response.ToJsonString())
 				} else {
@@ -675,7 +729,7 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 
 				var target *vod.DomainDetailInfo
 				if response, err := vodClient.DescribeVodDomainsWithContext(ctx, request); err != nil {
-					return errors.Wrapf(err, "set query vod domains region=%v, app=%v", conf.Region, vodAppIDParsed)
+					return errors.Wrapf(err, "set query vod domains region=%v, app=%v", conf.Region(), vodAppIDParsed)
 				} else if *response.Response.TotalCount == 0 {
 					return errors.Errorf("invalid vod domains %v", response.ToJsonString())
 				} else {
@@ -694,11 +748,11 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 				sb.WriteString(fmt.Sprintf(", createVodDomain=true, vodDomain=%v", *target.Domain))
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "CAM: Update ok, %v, token=%vB", sb.String(), len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
@@ -709,21 +763,129 @@ func handleHooksService(ctx context.Context, handler *http.ServeMux) error {
 	return nil
 }
 
+// verifyPublish verifies the publisher by the secret of stream or global secret, and returns how it's verified. For SRT
+// publisher, the stream and key might be in streamid, for example, #!::r=livestream,key=secret, see resolveSrtPublish.
+func verifyPublish(ctx context.Context, streamObj *SrsStream) (string, error) {
+	// The publish key of SRT streamid, which must equal to the secret if specified.
+	var srtKey string
+	if streamObj.IsSRT() {
+		if key, err := resolveSrtPublish(streamObj); err != nil {
+			return "", errors.Wrapf(err, "resolve srt")
+		} else {
+			srtKey = key
+		}
+	}
+
+	// Note that we allow pass secret by params or in stream name, for example, some encoder does not support params
+	// with ?secret=xxx, so it will fail when url is:
+	//      rtmp://ip/live/livestream?secret=xxx
+	// so user could change the url to bellow to get around of it:
+	//      rtmp://ip/live/livestreamxxx
+	// or simply use secret as stream:
+	//      rtmp://ip/live/xxx
+	// in this situation, the secret is part of stream name.
+	isSecretOK := func(publish, stream, param string) bool {
+		return publish == "" || strings.Contains(param, publish) || strings.Contains(stream, publish)
+	}
+
+	// The temporary key of guest is bound to the stream, instead of the secret of stream, see GuestKey.
+	guest, err := verifyGuestPublish(ctx, streamObj)
+	if err != nil {
+		return "", errors.Wrapf(err, "verify guest")
+	}
+
+	verifiedBy := "guest"
+	if guest == nil {
+		// Use live room secret to verify if stream name matches. The secret is hashed, so only the secret in params or
+		// the key of SRT streamid matches it, see hashStreamSecret.
+		roomPublishAuthKey := GenerateRoomPublishKey(streamObj.Stream)
+		publish, err := rdb.HGet(ctx, SRS_AUTH_SECRET, roomPublishAuthKey).Result()
+		if err != nil && err != redis.Nil {
+			return "", errors.Wrapf(err, "hget %v %v", SRS_AUTH_SECRET, roomPublishAuthKey)
+		}
+
+		verifiedBy = "room"
+		if publish != "" {
+			if !verifyRoomPublishSecret(publish, streamObj) {
+				return "", errors.Errorf("invalid room stream=%v, param=%v, action=%v", streamObj.Stream, streamObj.Param, SrsActionOnPublish)
+			}
+		} else {
+			// Use global publish secret to verify
+			publish, err = rdb.HGet(ctx, SRS_AUTH_SECRET, "pubSecret").Result()
+			verifiedBy = "global"
+			if err != nil && err != redis.Nil {
+				return "", errors.Wrapf(err, "hget %v pubSecret", SRS_AUTH_SECRET)
+			}
+			if srtKey != "" && publish != "" && srtKey != publish {
+				return "", errors.Errorf("invalid srt key of stream=%v", streamObj.Stream)
+			}
+			if !isSecretOK(publish, streamObj.Stream, streamObj.Param) {
+				return "", errors.Errorf("invalid normal stream=%v, param=%v, action=%v", streamObj.Stream, streamObj.Param, SrsActionOnPublish)
+			}
+		}
+	}
+
+	// Reject the stream name violating the naming policy, unless grandfathered.
+	if err := verifyStreamName(ctx, streamObj.Stream); err != nil {
+		return "", errors.Wrapf(err, "verify stream name")
+	}
+
+	// The publish key only works in the schedule window, if stream is scheduled.
+	if err := verifyStreamSchedule(ctx, streamObj, time.Now()); err != nil {
+		return "", errors.Wrapf(err, "verify schedule")
+	}
+
+	// The publish key might limit the number of concurrent publishes, see StreamQuota.
+	if verifiedBy == "room" {
+		if err := verifyStreamQuota(ctx, streamObj); err != nil {
+			return "", errors.Wrapf(err, "verify quota")
+		}
+	}
+
+	// Reject new publish when draining for upgrade.
+	if err := verifyUpgradeDrain(ctx); err != nil {
+		return "", errors.Wrapf(err, "verify drain")
+	}
+
+	// Reject the SRT or WebRTC publish if the feature is disabled for this install.
+	if streamObj.IsSRT() {
+		if err := verifyFeature(ctx, FeatureSRT); err != nil {
+			return "", errors.Wrapf(err, "verify feature")
+		}
+	}
+	if streamObj.IsRTC() {
+		if err := verifyFeature(ctx, FeatureRTC); err != nil {
+			return "", errors.Wrapf(err, "verify feature")
+		}
+	}
+
+	// Bind the guest to publisher at last, so the key is accepted only once for each session.
+	if guest != nil {
+		if err := acquireGuestSession(ctx, guest, streamObj); err != nil {
+			return "", errors.Wrapf(err, "acquire guest")
+		}
+	}
+
+	return verifiedBy, nil
+}
+
 func handleOnHls(ctx context.Context, handler *http.ServeMux) error {
 	// TODO: FIXME: Fixed token.
 	// See https://github.com/ossrs/srs/wiki/v4_EN_HTTPCallback
 	ep := "/terraform/v1/hooks/srs/hls"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
-			b, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				return errors.Wrapf(err, "read body")
+			if err := verifyHooksSecret(ctx, r); err != nil {
+				return errors.Wrapf(err, "verify hooks secret")
 			}
 
 			var msg SrsOnHlsMessage
-			if err := json.Unmarshal(b, &msg); err != nil {
-				return errors.Wrapf(err, "json unmarshal %v", string(b))
+			if err := ParseBody(ctx, r, &msg); err != nil {
+				return errors.Wrapf(err, "parse body")
 			}
 			if msg.Action != SrsActionOnHls {
 				return errors.Errorf("invalid action=%v", msg.Action)
@@ -731,12 +893,14 @@ func handleOnHls(ctx context.Context, handler *http.ServeMux) error {
 			if _, err := os.Stat(msg.File); err != nil {
 				return errors.Wrapf(err, "invalid ts file %v", msg.File)
 			}
-			logger.Tf(ctx, "on_hls ok, %v", string(b))
+			logger.Tf(ctx, "on_hls ok, %v", msg.String())
 
-			// Handle TS file by Record task if enabled.
+			// Handle TS file by Record task if enabled, and the feature is not disabled for this install.
 			if recordAll, err := rdb.HGet(ctx, SRS_RECORD_PATTERNS, "all").Result(); err != nil && err != redis.Nil {
 				return errors.Wrapf(err, "hget %v all", SRS_RECORD_PATTERNS)
-			} else if recordAll == "true" {
+			} else if enabled, err := isFeatureEnabled(ctx, FeatureRecord); err != nil {
+				return errors.Wrapf(err, "query feature")
+			} else if recordAll == "true" && enabled {
 				if err = recordWorker.OnHlsTsMessage(ctx, &msg); err != nil {
 					return errors.Wrapf(err, "feed %v", msg.String())
 				}
@@ -757,15 +921,27 @@ func handleOnHls(ctx context.Context, handler *http.ServeMux) error {
 			if vodAll, err := rdb.HGet(ctx, SRS_VOD_PATTERNS, "all").Result(); err != nil && err != redis.Nil {
 				return errors.Wrapf(err, "hget %v all", SRS_VOD_PATTERNS)
 			} else if vodAll == "true" {
-				if err = vodWorker.OnHlsTsMessage(ctx, &msg); err != nil {
+				if err := vodWorker.OnHlsTsMessage(ctx, &msg); err != nil {
 					return errors.Wrapf(err, "feed %v", msg.String())
 				}
 				logger.Tf(ctx, "vod %v", msg.String())
 			}
 
+			// Retain the TS file for time-shift, if enabled for this stream.
+			if hlsTimeShiftWorker != nil {
+				if err := hlsTimeShiftWorker.OnHlsTsMessage(ctx, &msg); err != nil {
+					return errors.Wrapf(err, "feed %v", msg.String())
+				}
+			}
+
+			// Score the health of stream, by the duration of segments.
+			if streamHealthWorker != nil {
+				streamHealthWorker.OnHlsTsMessage(ctx, &msg)
+			}
+
 			// Handle TS file by Transcript task if enabled.
 			if transcriptWorker.Enabled() {
-				if err = transcriptWorker.OnHlsTsMessage(ctx, &msg); err != nil {
+				if err := transcriptWorker.OnHlsTsMessage(ctx, &msg); err != nil {
 					return errors.Wrapf(err, "feed %v", msg.String())
 				}
 				logger.Tf(ctx, "transcript %v", msg.String())
@@ -773,22 +949,26 @@ func handleOnHls(ctx context.Context, handler *http.ServeMux) error {
 
 			// Handle TS file by OCR task if enabled.
 			if ocrWorker.Enabled() {
-				if err = ocrWorker.OnHlsTsMessage(ctx, &msg); err != nil {
+				if err := ocrWorker.OnHlsTsMessage(ctx, &msg); err != nil {
 					return errors.Wrapf(err, "feed %v", msg.String())
 				}
 				logger.Tf(ctx, "ocr %v", msg.String())
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
-	if err := recordWorker.Handle(ctx, handler); err != nil {
+	if err := handleFeatureWorker(ctx, handler, FeatureRecord, "/terraform/v1/hooks/record/", recordWorker.Handle); err != nil {
 		return errors.Wrapf(err, "handle record")
 	}
+	// The feature guard only routes the paths under its prefix, so the recordings have their own prefix.
+	if err := handleFeatureWorker(ctx, handler, FeatureRecord, "/terraform/v1/mgmt/recordings/", recordWorker.HandleRecordings); err != nil {
+		return errors.Wrapf(err, "handle recordings")
+	}
 
 	if err := dvrWorker.Handle(ctx, handler); err != nil {
 		return errors.Wrapf(err, "handle dvr")
@@ -0,0 +1,180 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The prefix of SRS API proxy, for example, /terraform/v1/srs/proxy/api/v1/summaries
+const srsProxyPrefix = "/terraform/v1/srs/proxy"
+
+// The read-only SRS API allowed to proxy by default.
+var srsProxyReadonlyAPIs = []string{
+	"/api/v1/versions", "/api/v1/summaries", "/api/v1/rusages", "/api/v1/self_proc_stats",
+	"/api/v1/system_proc_stats", "/api/v1/meminfos", "/api/v1/authors", "/api/v1/features",
+	"/api/v1/requests", "/api/v1/vhosts", "/api/v1/streams", "/api/v1/clients",
+}
+
+// CircuitBreaker rejects the requests for a while, if backend fails too many times continuously, so
+// that a hung backend won't tie up our connections.
+type CircuitBreaker struct {
+	// The max continuous failures to open the breaker.
+	maxFailures int
+	// The duration to keep the breaker open.
+	openDuration time.Duration
+
+	// The continuous failures.
+	failures int
+	// The time to close the breaker, zero if not open.
+	openUntil time.Time
+	lock      sync.Mutex
+}
+
+func NewCircuitBreaker(maxFailures int, openDuration time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{maxFailures: maxFailures, openDuration: openDuration}
+}
+
+// Allow returns whether the request is allowed. Note that we allow requests after the open duration,
+// and it will be open again if the request fails.
+func (v *CircuitBreaker) Allow() bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.openUntil.IsZero() || time.Now().After(v.openUntil)
+}
+
+func (v *CircuitBreaker) Success() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.failures, v.openUntil = 0, time.Time{}
+}
+
+func (v *CircuitBreaker) Failure() {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if v.failures++; v.failures >= v.maxFailures {
+		v.openUntil = time.Now().Add(v.openDuration)
+	}
+}
+
+// srsProxyAllowed returns whether the method and path of SRS API is allowed to proxy.
+func srsProxyAllowed(method, apiPath string) bool {
+	if envSrsApiProxyWrite() == "on" {
+		return strings.HasPrefix(apiPath, "/api/")
+	}
+
+	if method != http.MethodGet {
+		return false
+	}
+	for _, api := range srsProxyReadonlyAPIs {
+		if apiPath == api || strings.HasPrefix(apiPath, api+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func handleSrsApiProxy(ctx context.Context, handler *http.ServeMux) error {
+	target, err := url.Parse(envSrsApiServer())
+	if err != nil {
+		return errors.Wrapf(err, "parse %v", envSrsApiServer())
+	}
+
+	breaker := NewCircuitBreaker(5, 30*time.Second)
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	proxy.Transport = &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: 3 * time.Second}).DialContext,
+		ResponseHeaderTimeout: 10 * time.Second,
+		IdleConnTimeout:       30 * time.Second,
+		MaxIdleConnsPerHost:   8,
+	}
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		if resp.StatusCode >= http.StatusInternalServerError {
+			breaker.Failure()
+		} else {
+			breaker.Success()
+		}
+
+		// We will set the server and CORS headers.
+		resp.Header.Del("Server")
+		resp.Header.Del("Access-Control-Allow-Origin")
+		resp.Header.Del("Access-Control-Allow-Headers")
+		resp.Header.Del("Access-Control-Allow-Methods")
+		resp.Header.Del("Access-Control-Expose-Headers")
+		resp.Header.Del("Access-Control-Allow-Credentials")
+
+		// Rewrite the links of SRS API to the proxy.
+		if !strings.Contains(resp.Header.Get("Content-Type"), "json") {
+			return nil
+		}
+
+		b, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return errors.Wrapf(err, "read body")
+		}
+		resp.Body.Close()
+
+		b = bytes.ReplaceAll(b, []byte(`"/api/`), []byte(fmt.Sprintf(`"%v/api/`, srsProxyPrefix)))
+		resp.Body = io.NopCloser(bytes.NewReader(b))
+		resp.ContentLength = int64(len(b))
+		resp.Header.Set("Content-Length", strconv.Itoa(len(b)))
+		return nil
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		breaker.Failure()
+		logger.Wf(ctx, "srs proxy %v err %+v", r.URL.Path, err)
+		w.WriteHeader(http.StatusBadGateway)
+	}
+
+	ep := srsProxyPrefix + "/"
+	logger.Tf(ctx, "Handle %v to %v", ep, target)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		token := r.URL.Query().Get("token")
+		apiSecret := envApiSecret()
+		if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+			logger.Wf(ctx, "srs proxy %v auth err %+v", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+
+		apiPath := strings.TrimPrefix(r.URL.Path, srsProxyPrefix)
+		if !srsProxyAllowed(r.Method, apiPath) {
+			http.Error(w, fmt.Sprintf("%v %v not allowed", r.Method, apiPath), http.StatusForbidden)
+			return
+		}
+
+		if !breaker.Allow() {
+			http.Error(w, fmt.Sprintf("srs api %v is unavailable, try later", target), http.StatusServiceUnavailable)
+			return
+		}
+
+		// Remove the token, never pass it to SRS.
+		q := r.URL.Query()
+		q.Del("token")
+		r.URL.RawQuery = q.Encode()
+		r.URL.Path, r.URL.RawPath = apiPath, ""
+		r.Header.Del("Authorization")
+
+		logger.Tf(ctx, "Proxy %v %v to %v", r.Method, apiPath, target)
+		proxy.ServeHTTP(w, r)
+	})
+
+	return nil
+}
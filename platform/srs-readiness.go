@@ -0,0 +1,203 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The interval to probe SRS while waiting for it, and while it's ready to detect the restart.
+const srsReadinessWaitInterval = 500 * time.Millisecond
+const srsReadinessCheckInterval = 3 * time.Second
+
+// The timeout of each probe.
+const srsReadinessProbeTimeout = 2 * time.Second
+
+// The readiness gate of SRS, shared by the workers which spawn FFmpeg.
+var srsReadiness *SrsReadiness
+
+// SrsReadiness is the gate to hold the FFmpeg tasks until SRS is accepting connections, for example, the platform
+// starts before SRS after reboot, to avoid the FFmpeg fails and the task is delayed by the backoff.
+//
+// Note that the gate is open if not created, for example, in tests.
+type SrsReadiness struct {
+	// Whether SRS is accepting connections.
+	ready bool
+	// The time when SRS becomes ready, or restarted.
+	since time.Time
+	// The uptime of SRS in seconds, to detect the restart.
+	uptime int64
+	// The channel closed when SRS becomes ready again, to reset the backoff of tasks.
+	regained chan struct{}
+	// The lock for readiness.
+	lock sync.Mutex
+
+	// Probe SRS and return the uptime in seconds, replaced by tests.
+	probe func(ctx context.Context) (int64, error)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewSrsReadiness() *SrsReadiness {
+	return &SrsReadiness{regained: make(chan struct{}), probe: probeSrsReadiness}
+}
+
+func (v *SrsReadiness) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *SrsReadiness) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "srs readiness start a worker, wait=%v, check=%v", srsReadinessWaitInterval, srsReadinessCheckInterval)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			v.update(ctx)
+
+			interval := srsReadinessCheckInterval
+			if !v.Ready() {
+				interval = srsReadinessWaitInterval
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(interval):
+			}
+		}
+	}()
+	return nil
+}
+
+// Ready returns whether SRS is accepting connections.
+func (v *SrsReadiness) Ready() bool {
+	if v == nil {
+		return true
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.ready
+}
+
+// Since returns the time when SRS becomes ready or restarted, the FFmpeg exits before it should restart immediately.
+func (v *SrsReadiness) Since() time.Time {
+	if v == nil {
+		return time.Time{}
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.since
+}
+
+// Regained returns a channel which is closed when SRS becomes ready again, to interrupt the backoff of task.
+func (v *SrsReadiness) Regained() <-chan struct{} {
+	if v == nil {
+		return nil
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.regained
+}
+
+// update probes SRS, and opens the gate if ready, or closes it if not. The restart of SRS is detected by the uptime,
+// and the backoff of tasks is reset as SRS becomes ready again.
+func (v *SrsReadiness) update(ctx context.Context) {
+	probeCtx, cancel := context.WithTimeout(ctx, srsReadinessProbeTimeout)
+	defer cancel()
+
+	uptime, err := v.probe(probeCtx)
+	if ctx.Err() != nil {
+		return
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if err != nil {
+		if v.ready {
+			logger.Wf(ctx, "srs readiness lost, hold the FFmpeg tasks, err %+v", err)
+		}
+		v.ready = false
+		return
+	}
+
+	restarted := v.ready && uptime < v.uptime
+	if !v.ready || restarted {
+		logger.Tf(ctx, "srs readiness ok, uptime=%v, last=%v, restarted=%v", uptime, v.uptime, restarted)
+		v.ready, v.since = true, time.Now()
+		close(v.regained)
+		v.regained = make(chan struct{})
+	}
+	v.uptime = uptime
+}
+
+// probeSrsReadiness checks the RTMP port is accepting, and returns the uptime of SRS by API.
+func probeSrsReadiness(ctx context.Context) (int64, error) {
+	addr := net.JoinHostPort("127.0.0.1", envRtmpPort())
+	var d net.Dialer
+	if conn, err := d.DialContext(ctx, "tcp", addr); err != nil {
+		return 0, errors.Wrapf(err, "dial %v", addr)
+	} else {
+		conn.Close()
+	}
+
+	api := fmt.Sprintf("%v/api/v1/summaries", envSrsApiServer())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
+	if err != nil {
+		return 0, errors.Wrapf(err, "new request %v", api)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, errors.Wrapf(err, "get %v", api)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, errors.Wrapf(err, "read %v", api)
+	}
+	if res.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("get %v, status=%v, body=%v", api, res.StatusCode, string(b))
+	}
+
+	var summaries struct {
+		Code int `json:"code"`
+		Data struct {
+			Self struct {
+				Uptime int64 `json:"srs_uptime"`
+			} `json:"self"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(b, &summaries); err != nil {
+		return 0, errors.Wrapf(err, "unmarshal %v", string(b))
+	} else if summaries.Code != 0 {
+		return 0, errors.Errorf("get %v, code=%v", api, summaries.Code)
+	}
+	return summaries.Data.Self.Uptime, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestSrsReadiness_Gate(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	// The gate is open if not created.
+	var gate *SrsReadiness
+	if !gate.Ready() || gate.Regained() != nil {
+		t.Errorf("Fail for nil gate")
+	}
+
+	var uptime int64
+	var probeErr error
+	gate = NewSrsReadiness()
+	gate.probe = func(ctx context.Context) (int64, error) {
+		return uptime, probeErr
+	}
+
+	isClosed := func(ch <-chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	// Hold the tasks until SRS is ready.
+	probeErr = errors.New("connection refused")
+	regained := gate.Regained()
+	if gate.update(ctx); gate.Ready() || isClosed(regained) {
+		t.Errorf("Fail for ready before SRS")
+	}
+
+	probeErr, uptime = nil, 10
+	if gate.update(ctx); !gate.Ready() || !isClosed(regained) || gate.Since().IsZero() {
+		t.Errorf("Fail for not ready")
+	}
+
+	// Never reset the backoff if SRS keeps running.
+	regained, since := gate.Regained(), gate.Since()
+	uptime = 13
+	if gate.update(ctx); isClosed(regained) || gate.Since() != since {
+		t.Errorf("Fail for regained without restart")
+	}
+
+	// Reset the backoff if SRS restarts, even if the restart is between probes.
+	uptime = 1
+	if gate.update(ctx); !gate.Ready() || !isClosed(regained) || !gate.Since().After(since) {
+		t.Errorf("Fail for restart not detected")
+	}
+}
+
+func TestSrsReadiness_Probe(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/summaries" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"code":0,"data":{"self":{"srs_uptime":30}}}`))
+	}))
+	defer api.Close()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	_, port, _ := net.SplitHostPort(listener.Addr().String())
+
+	oldApi, oldPort := os.Getenv("SRS_API_SERVER"), os.Getenv("RTMP_PORT")
+	os.Setenv("SRS_API_SERVER", api.URL)
+	os.Setenv("RTMP_PORT", port)
+	defer func() {
+		os.Setenv("SRS_API_SERVER", oldApi)
+		os.Setenv("RTMP_PORT", oldPort)
+	}()
+
+	if uptime, err := probeSrsReadiness(ctx); err != nil || uptime != 30 {
+		t.Errorf("Fail for uptime=%v, err %+v", uptime, err)
+	}
+
+	// Not ready if RTMP is not accepting, even if the API is ok.
+	listener.Close()
+	if _, err := probeSrsReadiness(ctx); err == nil {
+		t.Errorf("Fail for RTMP closed")
+	}
+}
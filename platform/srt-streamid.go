@@ -0,0 +1,146 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// The prefix of SRT streamid in the access control format, see
+// https://github.com/Haivision/srt/blob/master/docs/features/access-control.md
+const srtStreamIDPrefix = "#!::"
+
+// SrtStreamID is the SRT streamid in the access control format, for example, #!::r=livestream,key=secret,m=publish
+type SrtStreamID struct {
+	// The resource name, such as livestream or live/livestream, the r= of streamid.
+	Resource string
+	// The publish key, the key= of streamid.
+	Key string
+	// The mode, publish or request, the m= of streamid.
+	Mode string
+	// The other params, such as secret=xxx in r=live/livestream?secret=xxx.
+	Params url.Values
+}
+
+func (v *SrtStreamID) String() string {
+	return fmt.Sprintf("r=%v, key=%vB, m=%v, params=%v", v.Resource, len(v.Key), v.Mode, len(v.Params))
+}
+
+// AppStream returns the app and stream of resource, app is empty if not specified.
+func (v *SrtStreamID) AppStream() (app, stream string) {
+	if index := strings.LastIndex(v.Resource, "/"); index >= 0 {
+		return v.Resource[:index], v.Resource[index+1:]
+	}
+	return "", v.Resource
+}
+
+// parseSrtStreamID parses the streamid such as #!::r=livestream,key=secret,m=publish, and the r= is required.
+func parseSrtStreamID(streamid string) (*SrtStreamID, error) {
+	if !strings.HasPrefix(streamid, srtStreamIDPrefix) {
+		return nil, errors.Errorf("no prefix %v", srtStreamIDPrefix)
+	}
+
+	v := &SrtStreamID{Params: url.Values{}}
+	parsed := make(map[string]bool)
+	for _, pair := range strings.Split(strings.TrimPrefix(streamid, srtStreamIDPrefix), ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.Errorf("invalid pair %v", pair)
+		}
+		if parsed[kv[0]] {
+			return nil, errors.Errorf("duplicated %v", kv[0])
+		}
+		parsed[kv[0]] = true
+
+		switch key, value := kv[0], kv[1]; key {
+		case "r":
+			// The old style is r=live/livestream?secret=xxx, for encoders which do not support custom keys.
+			if index := strings.Index(value, "?"); index >= 0 {
+				params, err := url.ParseQuery(value[index+1:])
+				if err != nil {
+					return nil, errors.Wrapf(err, "parse params of r")
+				}
+				for k, values := range params {
+					v.Params[k] = append(v.Params[k], values...)
+				}
+				value = value[:index]
+			}
+			v.Resource = value
+		case "key":
+			v.Key = value
+		case "m":
+			v.Mode = value
+		default:
+			v.Params.Add(key, value)
+		}
+	}
+
+	if _, stream := v.AppStream(); stream == "" || strings.ContainsAny(v.Resource, " \t\r\n") {
+		return nil, errors.Errorf("invalid r=%v", v.Resource)
+	}
+	if v.Mode != "" && v.Mode != "publish" && v.Mode != "request" {
+		return nil, errors.Errorf("invalid m=%v", v.Mode)
+	}
+	return v, nil
+}
+
+// buildSrtStreamID returns the streamid for encoder to publish the stream with key.
+func buildSrtStreamID(stream, key string) string {
+	return fmt.Sprintf("%vr=%v,key=%v,m=publish", srtStreamIDPrefix, stream, key)
+}
+
+// resolveSrtPublish parses the streamid of SRT publisher from the param of hook, and returns the publish key. SRS
+// passes the custom keys of streamid in param, such as ?key=secret&upstream=srt, or the whole streamid by
+// ?streamid=xxx, and the r= is mapped to the stream name. Return a bad request error if streamid is malformed, so SRS
+// refuses the connection. Note that the error never contains the param, because it's saved in the audit log.
+func resolveSrtPublish(streamObj *SrsStream) (string, error) {
+	params, err := url.ParseQuery(strings.TrimPrefix(streamObj.Param, "?"))
+	if err != nil {
+		return "", newHttpCodeError(http.StatusBadRequest, SrsStackErrorSrtStreamID,
+			errors.Wrapf(err, "parse param"),
+		)
+	}
+
+	key := params.Get("key")
+	if streamid := params.Get("streamid"); streamid != "" {
+		sid, err := parseSrtStreamID(streamid)
+		if err != nil {
+			return "", newHttpCodeError(http.StatusBadRequest, SrsStackErrorSrtStreamID,
+				errors.Wrapf(err, "parse streamid"),
+			)
+		}
+		if sid.Mode != "" && sid.Mode != "publish" {
+			return "", newHttpCodeError(http.StatusBadRequest, SrsStackErrorSrtStreamID,
+				errors.Errorf("invalid mode %v to publish", sid.Mode),
+			)
+		}
+
+		app, stream := sid.AppStream()
+		if streamObj.Stream != "" && streamObj.Stream != stream {
+			return "", newHttpCodeError(http.StatusBadRequest, SrsStackErrorSrtStreamID,
+				errors.Errorf("r=%v mismatch stream %v", sid.Resource, streamObj.Stream),
+			)
+		}
+		if streamObj.Stream == "" {
+			streamObj.Stream = stream
+		}
+		if streamObj.App == "" && app != "" {
+			streamObj.App = app
+		}
+
+		if sid.Key != "" {
+			key = sid.Key
+		} else if secret := sid.Params.Get("secret"); secret != "" && key == "" {
+			key = secret
+		}
+	}
+
+	return key, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestSrtStreamID_Parse(t *testing.T) {
+	for _, c := range []struct {
+		streamid, app, stream, key, mode string
+	}{
+		{"#!::r=livestream,key=secret", "", "livestream", "secret", ""},
+		{"#!::r=live/livestream,key=secret,m=publish", "live", "livestream", "secret", "publish"},
+		{"#!::r=live/livestream?secret=xxx,m=publish", "live", "livestream", "", "publish"},
+		{"#!::key=a=b,r=livestream,latency=20", "", "livestream", "a=b", ""},
+	} {
+		sid, err := parseSrtStreamID(c.streamid)
+		if err != nil {
+			t.Errorf("Fail for %v err %+v", c.streamid, err)
+			continue
+		}
+		if app, stream := sid.AppStream(); app != c.app || stream != c.stream || sid.Key != c.key || sid.Mode != c.mode {
+			t.Errorf("Fail for %v parsed %v", c.streamid, sid.String())
+		}
+	}
+
+	for _, streamid := range []string{
+		"", "r=livestream", "#!::", "#!::key=secret", "#!::r=", "#!::r=live/", "#!::r=livestream,,key=secret",
+		"#!::r=livestream,key", "#!::r=a,r=b", "#!::r=livestream,m=play", "#!::r=live stream",
+	} {
+		if sid, err := parseSrtStreamID(streamid); err == nil {
+			t.Errorf("Fail for %v should be malformed, parsed %v", streamid, sid.String())
+		}
+	}
+
+	if sid, err := parseSrtStreamID(buildSrtStreamID("livestream", "secret")); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	} else if sid.Resource != "livestream" || sid.Key != "secret" || sid.Mode != "publish" {
+		t.Errorf("Fail for parsed %v", sid.String())
+	}
+}
+
+func TestSrtStreamID_VerifyPublish(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	server.HSet(SRS_AUTH_SECRET, "pubSecret", "global")
+	server.HSet(SRS_AUTH_SECRET, GenerateRoomPublishKey("room1"), hashStreamSecret("room-key"))
+
+	streamidParam := func(streamid string) string {
+		return "?" + url.Values{"streamid": {streamid}, "upstream": {"srt"}}.Encode()
+	}
+
+	for _, c := range []struct {
+		name   string
+		stream *SrsStream
+		ok     bool
+	}{
+		{"key in param", &SrsStream{App: "live", Stream: "room1", Param: "?key=room-key&upstream=srt"}, true},
+		{"wrong key in param", &SrsStream{App: "live", Stream: "room1", Param: "?key=global&upstream=srt"}, false},
+		{"streamid maps r to stream", &SrsStream{Param: streamidParam("#!::r=room1,key=room-key")}, true},
+		{"streamid with global key", &SrsStream{Param: streamidParam("#!::r=live/other,key=global,m=publish")}, true},
+		{"streamid with wrong key", &SrsStream{Param: streamidParam("#!::r=room1,key=global")}, false},
+		{"streamid mismatch stream", &SrsStream{Stream: "room2", Param: streamidParam("#!::r=room1,key=room-key")}, false},
+		{"streamid to play", &SrsStream{Param: streamidParam("#!::r=room1,key=room-key,m=request")}, false},
+		{"malformed streamid", &SrsStream{Param: streamidParam("#!::r=room1,key")}, false},
+		{"rtmp with secret", &SrsStream{App: "live", Stream: "room1", Param: "?secret=room-key"}, true},
+	} {
+		if _, err := verifyPublish(ctx, c.stream); (err == nil) != c.ok {
+			t.Errorf("Fail for %v, err %+v", c.name, err)
+		}
+	}
+
+	stream := &SrsStream{Param: streamidParam("#!::r=live/room1,key=room-key")}
+	if _, err := verifyPublish(ctx, stream); err != nil || stream.App != "live" || stream.Stream != "room1" {
+		t.Errorf("Fail for stream %v, err %+v", stream.String(), err)
+	}
+}
+
+func TestSrtStreamID_AuditWithoutSecret(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	server.HSet(SRS_AUTH_SECRET, "pubSecret", "global")
+
+	stream := &SrsStream{Vhost: "__defaultVhost__", App: "live", Stream: "room1", Client: "c1", Param: "?secret=wrong-secret&upstream=srt"}
+	_, err := verifyPublish(ctx, stream)
+	recordPublishAudit(ctx, "srt", stream, err)
+	recordPublishAudit(ctx, "srt", &SrsStream{Vhost: "__defaultVhost__", App: "live", Stream: "room2"}, nil)
+
+	audits, err := queryPublishAudits(ctx)
+	if err != nil || len(audits) != 2 {
+		t.Errorf("Fail for audits %v, err %+v", audits, err)
+		return
+	}
+	if audits[0].Stream != "live/room2" || !audits[0].Allowed {
+		t.Errorf("Fail for audit %v", audits[0].String())
+	}
+	if r0 := audits[1]; r0.Allowed || r0.Client != "c1" || r0.Reason == "" || strings.Contains(r0.Reason, "wrong-secret") {
+		t.Errorf("Fail for audit %v", r0.String())
+	}
+}
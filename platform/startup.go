@@ -0,0 +1,226 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// The exit code when the dependencies never come up at startup, to distinguish from crash for the init system.
+const startupExitCode = 3
+
+// The backoff to retry the dependency at startup, doubled for each attempt up to the max.
+const startupBackoffMin = 200 * time.Millisecond
+const startupBackoffMax = 5 * time.Second
+
+// The timeout of each attempt to check the dependency.
+const startupAttemptTimeout = 3 * time.Second
+
+// The path to check the health, which is served even when starting up.
+const startupHealthzPath = "/healthz"
+
+// startupError is the error when the dependency never comes up in PLATFORM_STARTUP_TIMEOUT.
+type startupError struct {
+	// The name of dependency, for example, redis.
+	dependency string
+	err        error
+}
+
+func (v *startupError) Error() string {
+	return fmt.Sprintf("dependency %v is not ready, %v", v.dependency, v.err)
+}
+
+// StartupStatus is the status of startup, responded by /healthz.
+type StartupStatus struct {
+	// Whether the service is ready, serving all the endpoints.
+	Ready bool `json:"ready"`
+	// The dependency waiting for, empty if ready or initializing after all dependencies are ready.
+	Waiting string `json:"waiting,omitempty"`
+	// The uptime in seconds.
+	Uptime int64 `json:"uptime"`
+}
+
+// startupGate serves the /healthz and responds starting up for other endpoints, until the service is ready, then
+// switches to the full handler.
+type startupGate struct {
+	// The full handler, nil if starting up.
+	handler http.Handler
+	// The dependency waiting for.
+	waiting string
+	// The time of startup.
+	starttime time.Time
+	// The lock to swap the handler.
+	lock sync.RWMutex
+}
+
+func newStartupGate() *startupGate {
+	return &startupGate{starttime: time.Now()}
+}
+
+// Ready switches to the full handler.
+func (v *startupGate) Ready(handler http.Handler) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.handler, v.waiting = handler, ""
+}
+
+// Wait sets the dependency waiting for.
+func (v *startupGate) Wait(dependency string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.waiting = dependency
+}
+
+func (v *startupGate) Status() *StartupStatus {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return &StartupStatus{
+		Ready: v.handler != nil, Waiting: v.waiting, Uptime: int64(time.Since(v.starttime).Seconds()),
+	}
+}
+
+func (v *startupGate) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == startupHealthzPath {
+		v.serveHealthz(w, r)
+		return
+	}
+
+	v.lock.RLock()
+	handler := v.handler
+	v.lock.RUnlock()
+
+	if handler != nil {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	ctx := logger.WithContext(r.Context())
+	ohttp.SetHeader(w)
+	httpAllowCORS(w, r)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", "1")
+	httpWriteError(ctx, w, r, newHttpCodeError(http.StatusServiceUnavailable, SrsStackErrorStartingUp,
+		errors.Errorf("starting up, %v", r.URL.Path)))
+}
+
+// serveHealthz responds 200 if ready, or 503 if starting up, for the probe of init system or load balancer.
+func (v *startupGate) serveHealthz(w http.ResponseWriter, r *http.Request) {
+	status := v.Status()
+
+	ohttp.SetHeader(w)
+	httpAllowCORS(w, r)
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Content-Type", "application/json")
+
+	code := SrsStackError(0)
+	if !status.Ready {
+		code = SrsStackErrorStartingUp
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	if r.Method == http.MethodHead {
+		return
+	}
+	json.NewEncoder(w).Encode(&struct {
+		Code SrsStackError `json:"code"`
+		Data interface{}   `json:"data"`
+	}{code, status})
+}
+
+// parseStartupTimeout parse the timeout to wait for dependencies, such as 60s, returns zero if disabled by off or 0,
+// for example, to develop without redis.
+func parseStartupTimeout(v string) (time.Duration, error) {
+	if v == "" || v == "0" || strings.ToLower(v) == "off" {
+		return 0, nil
+	}
+
+	timeout, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, errors.Wrapf(err, "parse %v", v)
+	}
+	if timeout < time.Second {
+		return 0, errors.Errorf("timeout %v should not less than 1s", timeout)
+	}
+	return timeout, nil
+}
+
+// startupDependency is a dependency to wait for at startup, with a cheap check.
+type startupDependency struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// queryStartupDependencies returns the dependencies, the redis, and the docker to manage containers in docker mode.
+func queryStartupDependencies() []*startupDependency {
+	dependencies := []*startupDependency{
+		{name: "redis", check: func(ctx context.Context) error {
+			return rdb.Ping(ctx).Err()
+		}},
+	}
+	if conf.DeployMode == DeployModeDocker {
+		dependencies = append(dependencies, &startupDependency{name: "docker", check: func(ctx context.Context) error {
+			return execApi(ctx, "version")
+		}})
+	}
+	return dependencies
+}
+
+// waitStartupDependencies waits for all the dependencies in timeout, returns the startupError naming the dependency
+// if it never comes up.
+func waitStartupDependencies(ctx context.Context, gate *startupGate, dependencies []*startupDependency, timeout time.Duration) error {
+	toCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	for _, dependency := range dependencies {
+		gate.Wait(dependency.name)
+
+		starttime := time.Now()
+		if err := waitStartupDependency(toCtx, dependency); err != nil {
+			// Quit if interrupted, for example, by signal.
+			if ctx.Err() != nil {
+				return errors.Wrapf(ctx.Err(), "wait for %v", dependency.name)
+			}
+			logger.Ef(ctx, "startup: dependency %v is not ready in %v, err %v", dependency.name, timeout, err)
+			return &startupError{dependency: dependency.name, err: err}
+		}
+		logger.Tf(ctx, "startup: dependency %v is ready, cost=%v", dependency.name, time.Since(starttime))
+	}
+
+	gate.Wait("")
+	return nil
+}
+
+func waitStartupDependency(ctx context.Context, dependency *startupDependency) error {
+	backoff := startupBackoffMin
+	for attempt := 1; ; attempt++ {
+		attemptCtx, attemptCancel := context.WithTimeout(ctx, startupAttemptTimeout)
+		err := dependency.check(attemptCtx)
+		attemptCancel()
+		if err == nil {
+			return nil
+		}
+
+		logger.Wf(ctx, "startup: wait for %v, attempt=%v, backoff=%v, err %v", dependency.name, attempt, backoff, err)
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(err, "%v attempts", attempt)
+		case <-time.After(backoff):
+		}
+
+		if backoff *= 2; backoff > startupBackoffMax {
+			backoff = startupBackoffMax
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestStartup_Gate(t *testing.T) {
+	gate := newStartupGate()
+	gate.Wait("redis")
+
+	serve := func(p string) (int, SrsStackError, *StartupStatus) {
+		w := httptest.NewRecorder()
+		gate.ServeHTTP(w, httptest.NewRequest(http.MethodGet, p, nil))
+
+		var res struct {
+			Code SrsStackError  `json:"code"`
+			Data *StartupStatus `json:"data"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		return w.Code, res.Code, res.Data
+	}
+
+	// Only serve the healthz and starting up, when waiting for dependencies.
+	if status, code, data := serve("/healthz"); status != http.StatusServiceUnavailable ||
+		code != SrsStackErrorStartingUp || data == nil || data.Ready || data.Waiting != "redis" {
+		t.Errorf("Fail for status=%v, code=%v, data=%v", status, code, data)
+	}
+	if status, code, _ := serve("/terraform/v1/mgmt/versions"); status != http.StatusServiceUnavailable ||
+		code != SrsStackErrorStartingUp {
+		t.Errorf("Fail for status=%v, code=%v", status, code)
+	}
+
+	// Switch to the full handler when ready.
+	gate.Ready(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	if status, code, data := serve("/healthz"); status != http.StatusOK || code != 0 || data == nil ||
+		!data.Ready || data.Waiting != "" {
+		t.Errorf("Fail for status=%v, code=%v, data=%v", status, code, data)
+	}
+	if status, _, _ := serve("/terraform/v1/mgmt/versions"); status != http.StatusTeapot {
+		t.Errorf("Fail for status=%v", status)
+	}
+}
+
+func TestStartup_WaitDependencies(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	for v, expect := range map[string]time.Duration{
+		"": 0, "0": 0, "off": 0, "OFF": 0, "60s": 60 * time.Second, "2m": 2 * time.Minute,
+	} {
+		if timeout, err := parseStartupTimeout(v); err != nil || timeout != expect {
+			t.Errorf("Fail for %v, timeout=%v, err %+v", v, timeout, err)
+		}
+	}
+	for _, v := range []string{"100ms", "-1s", "abc"} {
+		if _, err := parseStartupTimeout(v); err == nil {
+			t.Errorf("Fail for %v", v)
+		}
+	}
+
+	// The redis comes up after some attempts.
+	var attempts int
+	redis := &startupDependency{name: "redis", check: func(ctx context.Context) error {
+		if attempts++; attempts < 3 {
+			return errors.New("connection refused")
+		}
+		return nil
+	}}
+	docker := &startupDependency{name: "docker", check: func(ctx context.Context) error {
+		return errors.New("cannot connect to the docker daemon")
+	}}
+
+	gate := newStartupGate()
+	if err := waitStartupDependencies(ctx, gate, []*startupDependency{redis}, 10*time.Second); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if status := gate.Status(); attempts != 3 || status.Ready || status.Waiting != "" {
+		t.Errorf("Fail for attempts=%v, status=%v", attempts, status)
+	}
+
+	// The docker never comes up, should name it in error.
+	err := waitStartupDependencies(ctx, gate, []*startupDependency{redis, docker}, time.Second)
+	if r0, ok := errors.Cause(errors.Wrapf(err, "wait")).(*startupError); !ok || r0.dependency != "docker" {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if status := gate.Status(); status.Waiting != "docker" {
+		t.Errorf("Fail for status=%v", status)
+	}
+
+	// Never exit as startup error, if interrupted.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = waitStartupDependencies(cancelCtx, gate, []*startupDependency{docker}, time.Second)
+	if _, ok := errors.Cause(err).(*startupError); ok || err == nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+}
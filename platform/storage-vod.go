@@ -0,0 +1,160 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
+	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
+	vod "github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/vod/v20180717"
+	"github.com/tencentyun/cos-go-sdk-v5"
+)
+
+// TencentVodStorage exports the finished recordings to Tencent Cloud VOD, for transcoding and CDN delivery. See
+// https://cloud.tencent.com/document/product/266/9759
+type TencentVodStorage struct {
+	// Whether export the finished recordings.
+	Enabled bool `json:"enabled"`
+	// The region of API, for example, ap-guangzhou.
+	Region string `json:"region"`
+	// The credential of Tencent Cloud, the secret key is never responded.
+	SecretID  string `json:"secretId"`
+	SecretKey string `json:"secretKey,omitempty"`
+	// The sub application of VOD, 0 for the default one.
+	SubAppID uint64 `json:"subAppId,omitempty"`
+	// The task flow to run after uploaded, for example, the transcoding, empty for none.
+	Procedure string `json:"procedure,omitempty"`
+	// The key in query of callback URL, to verify the event notifications of VOD, never responded.
+	CallbackKey string `json:"callbackKey,omitempty"`
+}
+
+func (v *TencentVodStorage) String() string {
+	return fmt.Sprintf("enabled=%v, region=%v, secretId=%v, secretKey=%vB, subAppId=%v, procedure=%v, callbackKey=%vB",
+		v.Enabled, v.Region, v.SecretID, len(v.SecretKey), v.SubAppID, v.Procedure, len(v.CallbackKey),
+	)
+}
+
+func (v *TencentVodStorage) Name() StorageDriverName {
+	return StorageDriverTencentVod
+}
+
+func (v *TencentVodStorage) Validate() error {
+	if v.Region == "" {
+		return errors.New("no region")
+	}
+	if v.SecretID == "" || v.SecretKey == "" {
+		return errors.New("no secretId or secretKey")
+	}
+	return nil
+}
+
+// Export uploads the object by the VOD upload flow, that is, apply upload, put to the COS bucket of VOD, then commit
+// upload, returns the FileId of VOD. See https://cloud.tencent.com/document/product/266/9759
+func (v *TencentVodStorage) Export(ctx context.Context, key string, r io.Reader, size int64) (string, error) {
+	cpf := profile.NewClientProfile()
+	cpf.HttpProfile.Endpoint = TENCENT_CLOUD_VOD_ENDPOINT
+
+	client, err := vod.NewClient(common.NewCredential(v.SecretID, v.SecretKey), v.Region, cpf)
+	if err != nil {
+		return "", errors.Wrapf(err, "create vod client, region=%v", v.Region)
+	}
+
+	// See https://cloud.tencent.com/document/product/266/31767
+	apply := vod.NewApplyUploadRequest()
+	apply.MediaType = common.StringPtr(strings.TrimPrefix(path.Ext(key), "."))
+	apply.MediaName = common.StringPtr(key)
+	if v.SubAppID > 0 {
+		apply.SubAppId = common.Uint64Ptr(v.SubAppID)
+	}
+	if v.Procedure != "" {
+		apply.Procedure = common.StringPtr(v.Procedure)
+	}
+
+	applied, err := client.ApplyUploadWithContext(ctx, apply)
+	if err != nil {
+		return "", errors.Wrapf(err, "apply upload %v", key)
+	}
+	res := applied.Response
+	if res == nil || res.TempCertificate == nil || res.StorageBucket == nil || res.StorageRegion == nil ||
+		res.MediaStoragePath == nil || res.VodSessionKey == nil {
+		return "", errors.Errorf("invalid apply upload response %v", applied.ToJsonString())
+	}
+
+	// Put to the COS bucket of VOD, by the temporary certificate.
+	bucketURL := fmt.Sprintf("https://%v.cos.%v.myqcloud.com", *res.StorageBucket, *res.StorageRegion)
+	u, err := url.Parse(bucketURL)
+	if err != nil {
+		return "", errors.Wrapf(err, "parse %v", bucketURL)
+	}
+
+	cert := res.TempCertificate
+	cosClient := cos.NewClient(&cos.BaseURL{BucketURL: u}, &http.Client{
+		Transport: &cos.AuthorizationTransport{
+			SecretID: *cert.SecretId, SecretKey: *cert.SecretKey, SessionToken: *cert.Token,
+			Expire: time.Duration(*cert.ExpiredTime-uint64(time.Now().Unix())) * time.Second,
+		},
+	})
+	if _, err := cosClient.Object.Put(ctx, *res.MediaStoragePath, r, &cos.ObjectPutOptions{
+		ObjectPutHeaderOptions: &cos.ObjectPutHeaderOptions{ContentLength: size},
+	}); err != nil {
+		return "", errors.Wrapf(err, "cos put %v", *res.MediaStoragePath)
+	}
+
+	// See https://cloud.tencent.com/document/product/266/31766
+	commit := vod.NewCommitUploadRequest()
+	commit.VodSessionKey = res.VodSessionKey
+	if v.SubAppID > 0 {
+		commit.SubAppId = common.Uint64Ptr(v.SubAppID)
+	}
+
+	committed, err := client.CommitUploadWithContext(ctx, commit)
+	if err != nil {
+		return "", errors.Wrapf(err, "commit upload %v", key)
+	}
+	if committed.Response == nil || committed.Response.FileId == nil {
+		return "", errors.Errorf("invalid commit upload response %v", committed.ToJsonString())
+	}
+	return *committed.Response.FileId, nil
+}
+
+func queryTencentVodStorage(ctx context.Context) (*TencentVodStorage, error) {
+	value, err := rdb.HGet(ctx, SRS_STORAGE, string(StorageDriverTencentVod)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_STORAGE, StorageDriverTencentVod)
+	} else if value == "" {
+		return nil, nil
+	}
+
+	var vodStorage TencentVodStorage
+	if err := json.Unmarshal([]byte(value), &vodStorage); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", value)
+	}
+	return &vodStorage, nil
+}
+
+// queryStorageExporter returns the exporter which is enabled, or nil if none.
+func queryStorageExporter(ctx context.Context) (StorageExporter, error) {
+	vodStorage, err := queryTencentVodStorage(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query vod")
+	}
+	if vodStorage == nil || !vodStorage.Enabled {
+		return nil, nil
+	}
+	return vodStorage, nil
+}
@@ -0,0 +1,721 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The name of storage driver.
+type StorageDriverName string
+
+const (
+	StorageDriverLocal StorageDriverName = "local"
+	StorageDriverS3    StorageDriverName = "s3"
+	// The cloud VOD service, which is only for exporting, see StorageExporter.
+	StorageDriverTencentVod StorageDriverName = "tencent-vod"
+)
+
+// StorageObject is an object in storage.
+type StorageObject struct {
+	// The object key, for example, record/3ECF0239-708C-42E4-96E1-5AE935C6E6A9/index.mp4
+	Key string `json:"key"`
+	// The size in bytes.
+	Size int64 `json:"size"`
+	// The last modified time.
+	Update string `json:"update"`
+}
+
+// StorageDriver is the storage to put files to, such as local disk or S3-compatible object storage.
+type StorageDriver interface {
+	Name() StorageDriverName
+	// Put the object from r, the size should be the exact size of r.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get the object, user should close the reader.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete the object, it's ok if not exists.
+	Delete(ctx context.Context, key string) error
+	// List the objects which key starts with prefix.
+	List(ctx context.Context, prefix string) ([]*StorageObject, error)
+	// SignedURL returns a URL to download the object, which expires in duration.
+	SignedURL(ctx context.Context, key string, expire time.Duration) (string, error)
+}
+
+// StorageExporter exports the object to a cloud VOD service, for transcoding and CDN delivery. Unlike StorageDriver,
+// the object is identified by the file id generated by cloud, rather than the key.
+type StorageExporter interface {
+	Name() StorageDriverName
+	// Export the object from r, the size should be the exact size of r, returns the file id in cloud.
+	Export(ctx context.Context, key string, r io.Reader, size int64) (string, error)
+}
+
+// checkStorageKey returns error if key is not a relative path, or try to access the parent directory.
+func checkStorageKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, "..") {
+		return errors.Errorf("invalid key %v", key)
+	}
+	return nil
+}
+
+// LocalStorage stores objects in local disk, the key is the relative path to root.
+type LocalStorage struct {
+	// The root directory.
+	Root string
+}
+
+func NewLocalStorage(root string) *LocalStorage {
+	return &LocalStorage{Root: root}
+}
+
+func (v *LocalStorage) Name() StorageDriverName {
+	return StorageDriverLocal
+}
+
+func (v *LocalStorage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := checkStorageKey(key); err != nil {
+		return err
+	}
+
+	filename := path.Join(v.Root, key)
+	if err := os.MkdirAll(path.Dir(filename), 0755); err != nil {
+		return errors.Wrapf(err, "mkdir %v", path.Dir(filename))
+	}
+
+	// Write to a temporary file then rename, so the object is never partial.
+	f, err := ioutil.TempFile(path.Dir(filename), fmt.Sprintf(".%v.*", path.Base(filename)))
+	if err != nil {
+		return errors.Wrapf(err, "create temp for %v", filename)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if nn, err := io.Copy(f, r); err != nil {
+		return errors.Wrapf(err, "copy to %v", f.Name())
+	} else if size >= 0 && nn != size {
+		return errors.Errorf("copy %v bytes to %v, expect %v", nn, f.Name(), size)
+	}
+
+	if err := f.Close(); err != nil {
+		return errors.Wrapf(err, "close %v", f.Name())
+	}
+	if err := os.Rename(f.Name(), filename); err != nil {
+		return errors.Wrapf(err, "rename %v to %v", f.Name(), filename)
+	}
+	return nil
+}
+
+func (v *LocalStorage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := checkStorageKey(key); err != nil {
+		return nil, err
+	}
+
+	filename := path.Join(v.Root, key)
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, errors.Wrapf(err, "open %v", filename)
+	}
+	return f, nil
+}
+
+func (v *LocalStorage) Delete(ctx context.Context, key string) error {
+	if err := checkStorageKey(key); err != nil {
+		return err
+	}
+
+	filename := path.Join(v.Root, key)
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "remove %v", filename)
+	}
+	return nil
+}
+
+func (v *LocalStorage) List(ctx context.Context, prefix string) ([]*StorageObject, error) {
+	// Only walk the directory of prefix, for example, record for record/3ECF.
+	dir := path.Join(v.Root, path.Dir(prefix))
+	if strings.HasSuffix(prefix, "/") {
+		dir = path.Join(v.Root, prefix)
+	}
+	if _, err := os.Stat(dir); err != nil && os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	var objects []*StorageObject
+	if err := filepath.Walk(dir, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+
+		key, err := filepath.Rel(v.Root, filename)
+		if err != nil {
+			return errors.Wrapf(err, "rel %v", filename)
+		}
+		if key = filepath.ToSlash(key); !strings.HasPrefix(key, prefix) {
+			return nil
+		}
+
+		objects = append(objects, &StorageObject{
+			Key: key, Size: info.Size(), Update: info.ModTime().Format(time.RFC3339),
+		})
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "walk %v", dir)
+	}
+
+	return objects, nil
+}
+
+// SignedURL returns a download URL by token, only for files in the downloadAllowedDirs.
+func (v *LocalStorage) SignedURL(ctx context.Context, key string, expire time.Duration) (string, error) {
+	if err := checkStorageKey(key); err != nil {
+		return "", err
+	}
+
+	cleaned, err := cleanDownloadFile(path.Join(v.Root, key))
+	if err != nil {
+		return "", errors.Wrapf(err, "check file %v", key)
+	}
+
+	downloadURL, _, err := createDownloadToken(ctx, cleaned, "", expire)
+	if err != nil {
+		return "", errors.Wrapf(err, "create token for %v", cleaned)
+	}
+	return downloadURL, nil
+}
+
+// S3Storage stores objects in S3-compatible object storage, such as AWS S3, MinIO, Tencent COS and Alibaba OSS,
+// by the AWS Signature Version 4 protocol.
+type S3Storage struct {
+	// The endpoint, for example, https://s3.amazonaws.com or http://127.0.0.1:9000
+	Endpoint string `json:"endpoint"`
+	// The region, for example, us-east-1
+	Region string `json:"region"`
+	// The bucket name.
+	Bucket string `json:"bucket"`
+	// The access key and secret key.
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+	// Whether use path style URL like endpoint/bucket/key, or virtual hosted style like bucket.endpoint/key.
+	PathStyle bool `json:"pathStyle"`
+}
+
+func (v *S3Storage) String() string {
+	return fmt.Sprintf("endpoint=%v, region=%v, bucket=%v, accessKey=%v, secretKey=%vB, pathStyle=%v",
+		v.Endpoint, v.Region, v.Bucket, v.AccessKey, len(v.SecretKey), v.PathStyle,
+	)
+}
+
+func (v *S3Storage) Name() StorageDriverName {
+	return StorageDriverS3
+}
+
+func (v *S3Storage) Validate() error {
+	if v.Endpoint == "" {
+		return errors.New("no endpoint")
+	}
+	if u, err := url.Parse(v.Endpoint); err != nil {
+		return errors.Wrapf(err, "parse endpoint %v", v.Endpoint)
+	} else if u.Scheme != "http" && u.Scheme != "https" {
+		return errors.Errorf("invalid endpoint %v, should be http or https", v.Endpoint)
+	}
+	if v.Region == "" {
+		return errors.New("no region")
+	}
+	if v.Bucket == "" {
+		return errors.New("no bucket")
+	}
+	if v.AccessKey == "" || v.SecretKey == "" {
+		return errors.New("no access key or secret key")
+	}
+	return nil
+}
+
+func (v *S3Storage) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if err := checkStorageKey(key); err != nil {
+		return err
+	}
+
+	// Hash the body while uploading, to compare with the ETag, which is the MD5 of object for single PUT.
+	h := md5.New()
+	req, err := v.newRequest(ctx, http.MethodPut, key, nil, io.TeeReader(r, h))
+	if err != nil {
+		return errors.Wrapf(err, "new request")
+	}
+	req.ContentLength = size
+
+	res, err := v.do(req, http.StatusOK)
+	if err != nil {
+		return errors.Wrapf(err, "put %v", key)
+	}
+	res.Body.Close()
+
+	// Ignore if no ETag, or not MD5, for example, encrypted by SSE-KMS by some S3-compatible storage.
+	etag := strings.Trim(res.Header.Get("ETag"), `"`)
+	if sum := hex.EncodeToString(h.Sum(nil)); len(etag) == len(sum) && !strings.EqualFold(etag, sum) {
+		return errors.Errorf("put %v etag mismatch, expect %v, actual %v", key, sum, etag)
+	}
+	return nil
+}
+
+func (v *S3Storage) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := checkStorageKey(key); err != nil {
+		return nil, err
+	}
+
+	req, err := v.newRequest(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "new request")
+	}
+
+	res, err := v.do(req, http.StatusOK)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %v", key)
+	}
+	return res.Body, nil
+}
+
+func (v *S3Storage) Delete(ctx context.Context, key string) error {
+	if err := checkStorageKey(key); err != nil {
+		return err
+	}
+
+	req, err := v.newRequest(ctx, http.MethodDelete, key, nil, nil)
+	if err != nil {
+		return errors.Wrapf(err, "new request")
+	}
+
+	if _, err := v.do(req, http.StatusNoContent, http.StatusOK, http.StatusNotFound); err != nil {
+		return errors.Wrapf(err, "delete %v", key)
+	}
+	return nil
+}
+
+func (v *S3Storage) List(ctx context.Context, prefix string) ([]*StorageObject, error) {
+	var objects []*StorageObject
+	var continuationToken string
+	for {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", prefix)
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+
+		req, err := v.newRequest(ctx, http.MethodGet, "", query, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "new request")
+		}
+
+		res, err := v.do(req, http.StatusOK)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list %v", prefix)
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string `xml:"Key"`
+				Size         int64  `xml:"Size"`
+				LastModified string `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(res.Body).Decode(&result)
+		res.Body.Close()
+		if err != nil {
+			return nil, errors.Wrapf(err, "decode list %v", prefix)
+		}
+
+		for _, content := range result.Contents {
+			objects = append(objects, &StorageObject{
+				Key: content.Key, Size: content.Size, Update: content.LastModified,
+			})
+		}
+
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			break
+		}
+		continuationToken = result.NextContinuationToken
+	}
+
+	return objects, nil
+}
+
+// SignedURL returns a presigned URL of S3, see https://docs.aws.amazon.com/AmazonS3/latest/API/sigv4-query-string-auth.html
+func (v *S3Storage) SignedURL(ctx context.Context, key string, expire time.Duration) (string, error) {
+	if err := checkStorageKey(key); err != nil {
+		return "", err
+	}
+
+	u, err := v.objectURL(key)
+	if err != nil {
+		return "", errors.Wrapf(err, "build url")
+	}
+
+	now := time.Now().UTC()
+	query := url.Values{}
+	query.Set("X-Amz-Algorithm", "AWS4-HMAC-SHA256")
+	query.Set("X-Amz-Credential", fmt.Sprintf("%v/%v", v.AccessKey, v.scope(now)))
+	query.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	query.Set("X-Amz-Expires", fmt.Sprintf("%v", int(expire.Seconds())))
+	query.Set("X-Amz-SignedHeaders", "host")
+
+	canonicalRequest := strings.Join([]string{
+		http.MethodGet, s3Escape(u.Path, false), s3CanonicalQuery(query),
+		fmt.Sprintf("host:%v\n", u.Host), "host", "UNSIGNED-PAYLOAD",
+	}, "\n")
+	query.Set("X-Amz-Signature", v.sign(now, canonicalRequest))
+
+	u.RawQuery = s3CanonicalQuery(query)
+	return u.String(), nil
+}
+
+// objectURL builds the URL of object, the key is empty for bucket.
+func (v *S3Storage) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(v.Endpoint)
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse endpoint %v", v.Endpoint)
+	}
+
+	if v.PathStyle {
+		u.Path = fmt.Sprintf("/%v/%v", v.Bucket, key)
+	} else {
+		u.Host = fmt.Sprintf("%v.%v", v.Bucket, u.Host)
+		u.Path = fmt.Sprintf("/%v", key)
+	}
+	return u, nil
+}
+
+// newRequest creates a request signed by header, see https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (v *S3Storage) newRequest(ctx context.Context, method, key string, query url.Values, body io.Reader) (*http.Request, error) {
+	u, err := v.objectURL(key)
+	if err != nil {
+		return nil, errors.Wrapf(err, "build url")
+	}
+	u.RawQuery = s3CanonicalQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "new request %v %v", method, u.String())
+	}
+
+	// We use unsigned payload, to upload large file in streaming.
+	now := time.Now().UTC()
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		method, s3Escape(u.Path, false), s3CanonicalQuery(query),
+		fmt.Sprintf("host:%v\nx-amz-content-sha256:%v\nx-amz-date:%v\n",
+			u.Host, req.Header.Get("X-Amz-Content-Sha256"), req.Header.Get("X-Amz-Date"),
+		),
+		signedHeaders, "UNSIGNED-PAYLOAD",
+	}, "\n")
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%v/%v, SignedHeaders=%v, Signature=%v",
+		v.AccessKey, v.scope(now), signedHeaders, v.sign(now, canonicalRequest),
+	))
+	return req, nil
+}
+
+// do sends the request, and returns error if the status is not expected.
+func (v *S3Storage) do(req *http.Request, expects ...int) (*http.Response, error) {
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "do %v %v", req.Method, req.URL.Path)
+	}
+
+	for _, expect := range expects {
+		if res.StatusCode == expect {
+			return res, nil
+		}
+	}
+
+	defer res.Body.Close()
+	b, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+	return nil, errors.Errorf("%v %v status %v, body %v", req.Method, req.URL.Path, res.StatusCode, string(b))
+}
+
+func (v *S3Storage) scope(now time.Time) string {
+	return fmt.Sprintf("%v/%v/s3/aws4_request", now.Format("20060102"), v.Region)
+}
+
+func (v *S3Storage) sign(now time.Time, canonicalRequest string) string {
+	hmacSHA256 := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+
+	hashed := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256", now.Format("20060102T150405Z"), v.scope(now), hex.EncodeToString(hashed[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+v.SecretKey), now.Format("20060102"))
+	key = hmacSHA256(key, v.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// s3Escape encodes the string by RFC 3986, except the unreserved characters, and the slash if not encodeSlash.
+func s3Escape(s string, encodeSlash bool) string {
+	var sb strings.Builder
+	for _, c := range []byte(s) {
+		if ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || ('0' <= c && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			sb.WriteByte(c)
+		} else {
+			sb.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return sb.String()
+}
+
+// s3CanonicalQuery encodes the query, sorted by key.
+func s3CanonicalQuery(query url.Values) string {
+	var keys []string
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		for _, value := range query[k] {
+			pairs = append(pairs, fmt.Sprintf("%v=%v", s3Escape(k, true), s3Escape(value, true)))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// The local storage, the key is the relative path to working directory, such as record/xxx/index.mp4
+var localStorage = NewLocalStorage(".")
+
+// queryStorageDriver returns the active storage driver, default to local disk.
+func queryStorageDriver(ctx context.Context) (StorageDriver, error) {
+	name, err := rdb.HGet(ctx, SRS_STORAGE, "driver").Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v driver", SRS_STORAGE)
+	}
+
+	return queryStorageDriverByName(ctx, StorageDriverName(name))
+}
+
+// queryStorageDriverByName returns the storage driver by name, which is stored in the object index, so the
+// objects are still accessible after switching to other driver.
+func queryStorageDriverByName(ctx context.Context, name StorageDriverName) (StorageDriver, error) {
+	switch name {
+	case "", StorageDriverLocal:
+		return localStorage, nil
+	case StorageDriverS3:
+		s3, err := queryS3Storage(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "query s3")
+		} else if s3 == nil {
+			return nil, errors.New("no s3 config")
+		}
+		return s3, nil
+	}
+	return nil, errors.Errorf("invalid storage driver %v", name)
+}
+
+func queryS3Storage(ctx context.Context) (*S3Storage, error) {
+	value, err := rdb.HGet(ctx, SRS_STORAGE, string(StorageDriverS3)).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_STORAGE, StorageDriverS3)
+	} else if value == "" {
+		return nil, nil
+	}
+
+	var s3 S3Storage
+	if err := json.Unmarshal([]byte(value), &s3); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", value)
+	}
+	return &s3, nil
+}
+
+func handleMgmtStorage(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/storage/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			driver, err := queryStorageDriver(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query driver")
+			}
+
+			s3, err := queryS3Storage(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query s3")
+			}
+			// Never response the secret key.
+			if s3 != nil {
+				s3.SecretKey = ""
+			}
+
+			vodStorage, err := queryTencentVodStorage(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query vod")
+			}
+			if vodStorage != nil {
+				vodStorage.SecretKey, vodStorage.CallbackKey = "", ""
+			}
+
+			// The usage of vLive media library, which is always in local disk.
+			_, library, err := listVLiveLibrary(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "list library")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Driver  StorageDriverName  `json:"driver"`
+				S3      *S3Storage         `json:"s3,omitempty"`
+				Vod     *TencentVodStorage `json:"vod,omitempty"`
+				Library *VLiveLibraryUsage `json:"library"`
+			}{
+				Driver: driver.Name(), S3: s3, Vod: vodStorage, Library: library,
+			})
+			logger.Tf(ctx, "storage query ok, driver=%v, token=%vB", driver.Name(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/storage/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var driver StorageDriverName
+			var s3 *S3Storage
+			var vodStorage *TencentVodStorage
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string             `json:"token"`
+				Driver *StorageDriverName  `json:"driver"`
+				S3     **S3Storage         `json:"s3"`
+				Vod    **TencentVodStorage `json:"vod"`
+			}{
+				Token: &token, Driver: &driver, S3: &s3, Vod: &vodStorage,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if driver != StorageDriverLocal && driver != StorageDriverS3 {
+				return errors.Errorf("invalid driver %v", driver)
+			}
+
+			if s3 != nil {
+				// Keep the secret key if not changed, because we never response it.
+				if s3.SecretKey == "" {
+					if previous, err := queryS3Storage(ctx); err != nil {
+						return errors.Wrapf(err, "query s3")
+					} else if previous != nil {
+						s3.SecretKey = previous.SecretKey
+					}
+				}
+				if err := s3.Validate(); err != nil {
+					return errors.Wrapf(err, "validate %v", s3.String())
+				}
+
+				if b, err := json.Marshal(s3); err != nil {
+					return errors.Wrapf(err, "marshal %v", s3.String())
+				} else if err := rdb.HSet(ctx, SRS_STORAGE, string(StorageDriverS3), string(b)).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v %v %v", SRS_STORAGE, StorageDriverS3, s3.String())
+				}
+			}
+
+			if vodStorage != nil {
+				// Keep the secret key and callback key if not changed, because we never response them.
+				if previous, err := queryTencentVodStorage(ctx); err != nil {
+					return errors.Wrapf(err, "query vod")
+				} else if previous != nil {
+					if vodStorage.SecretKey == "" {
+						vodStorage.SecretKey = previous.SecretKey
+					}
+					if vodStorage.CallbackKey == "" {
+						vodStorage.CallbackKey = previous.CallbackKey
+					}
+				}
+				if err := vodStorage.Validate(); err != nil {
+					return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "validate %v", vodStorage.String()))
+				}
+
+				if b, err := json.Marshal(vodStorage); err != nil {
+					return errors.Wrapf(err, "marshal %v", vodStorage.String())
+				} else if err := rdb.HSet(ctx, SRS_STORAGE, string(StorageDriverTencentVod), string(b)).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v %v %v", SRS_STORAGE, StorageDriverTencentVod, vodStorage.String())
+				}
+			}
+
+			// Make sure the driver is available, before switching to it.
+			if _, err := queryStorageDriverByName(ctx, driver); err != nil {
+				return errors.Wrapf(err, "query driver %v", driver)
+			}
+			if err := rdb.HSet(ctx, SRS_STORAGE, "driver", string(driver)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v driver %v", SRS_STORAGE, driver)
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "storage update ok, driver=%v, token=%vB", driver, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
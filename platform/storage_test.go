@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+// fakeS3 is an in-memory S3 server in path style, which only supports the object APIs used by S3Storage.
+type fakeS3 struct {
+	bucket  string
+	objects map[string][]byte
+	lock    sync.Mutex
+}
+
+func (v *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// Only check whether request is signed, the signature is not verified.
+	if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=") &&
+		r.URL.Query().Get("X-Amz-Signature") == "" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	key := strings.TrimPrefix(r.URL.Path, "/"+v.bucket)
+	key = strings.TrimPrefix(key, "/")
+
+	switch {
+	case r.Method == http.MethodPut:
+		b, _ := ioutil.ReadAll(r.Body)
+		v.objects[key] = b
+		w.Header().Set("ETag", fmt.Sprintf(`"%x"`, md5.Sum(b)))
+	case r.Method == http.MethodGet && key == "" && r.URL.Query().Get("list-type") == "2":
+		type Content struct {
+			Key  string `xml:"Key"`
+			Size int64  `xml:"Size"`
+		}
+		var result struct {
+			XMLName  xml.Name  `xml:"ListBucketResult"`
+			Contents []Content `xml:"Contents"`
+		}
+		for k, b := range v.objects {
+			if strings.HasPrefix(k, r.URL.Query().Get("prefix")) {
+				result.Contents = append(result.Contents, Content{Key: k, Size: int64(len(b))})
+			}
+		}
+		xml.NewEncoder(w).Encode(&result)
+	case r.Method == http.MethodGet:
+		if b, ok := v.objects[key]; ok {
+			w.Write(b)
+		} else {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodDelete:
+		delete(v.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func testStorageDriver(ctx context.Context, t *testing.T, driver StorageDriver) {
+	for key, body := range map[string]string{
+		"record/a/index.m3u8": "#EXTM3U", "record/a/0.ts": "ts0", "record/b/index.mp4": "mp4",
+	} {
+		if err := driver.Put(ctx, key, strings.NewReader(body), int64(len(body))); err != nil {
+			t.Errorf("Fail for put %v err %+v", key, err)
+			return
+		}
+	}
+
+	if err := driver.Put(ctx, "../passwd", strings.NewReader("x"), 1); err == nil {
+		t.Errorf("Fail for invalid key should be rejected")
+	}
+
+	if r, err := driver.Get(ctx, "record/a/0.ts"); err != nil {
+		t.Errorf("Fail for get err %+v", err)
+	} else {
+		b, _ := ioutil.ReadAll(r)
+		r.Close()
+		if string(b) != "ts0" {
+			t.Errorf("Fail for get %v, expect ts0", string(b))
+		}
+	}
+
+	objects, err := driver.List(ctx, "record/a/")
+	if err != nil {
+		t.Errorf("Fail for list err %+v", err)
+		return
+	}
+	var keys []string
+	for _, object := range objects {
+		keys = append(keys, object.Key)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "record/a/0.ts,record/a/index.m3u8" {
+		t.Errorf("Fail for list %v", keys)
+	}
+
+	if err := driver.Delete(ctx, "record/a/0.ts"); err != nil {
+		t.Errorf("Fail for delete err %+v", err)
+	}
+	if err := driver.Delete(ctx, "record/a/0.ts"); err != nil {
+		t.Errorf("Fail for delete not exists err %+v", err)
+	}
+	if objects, err := driver.List(ctx, "record/"); err != nil {
+		t.Errorf("Fail for list err %+v", err)
+	} else if len(objects) != 2 {
+		t.Errorf("Fail for list %v objects, expect 2", len(objects))
+	}
+}
+
+func TestStorage_LocalDriver(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+	testStorageDriver(ctx, t, NewLocalStorage(t.TempDir()))
+}
+
+func TestStorage_S3Driver(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	s3 := &fakeS3{bucket: "oryx", objects: make(map[string][]byte)}
+	server := httptest.NewServer(s3)
+	defer server.Close()
+
+	driver := &S3Storage{
+		Endpoint: server.URL, Region: "us-east-1", Bucket: "oryx",
+		AccessKey: "AKID", SecretKey: "secret", PathStyle: true,
+	}
+	if err := driver.Validate(); err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	testStorageDriver(ctx, t, driver)
+
+	// The presigned URL should be able to download without credentials.
+	signedURL, err := driver.SignedURL(ctx, "record/b/index.mp4", 5*time.Minute)
+	if err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	if !strings.Contains(signedURL, "X-Amz-Credential=AKID%2F") || !strings.Contains(signedURL, "X-Amz-Expires=300") {
+		t.Errorf("Fail for signed url %v", signedURL)
+	}
+
+	res, err := http.Get(signedURL)
+	if err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	defer res.Body.Close()
+	if b, _ := ioutil.ReadAll(res.Body); !bytes.Equal(b, []byte("mp4")) {
+		t.Errorf("Fail for signed url got %v, expect mp4", string(b))
+	}
+}
+
+func TestStorage_S3Sign(t *testing.T) {
+	// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+	driver := &S3Storage{Region: "us-east-1", SecretKey: "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY"}
+	now, _ := time.Parse(time.RFC3339, "2013-05-24T00:00:00Z")
+	canonicalRequest := strings.Join([]string{
+		"GET", "/test.txt", "",
+		"host:examplebucket.s3.amazonaws.com\nrange:bytes=0-9\n" +
+			"x-amz-content-sha256:e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855\n" +
+			"x-amz-date:20130524T000000Z\n",
+		"host;range;x-amz-content-sha256;x-amz-date",
+		"e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855",
+	}, "\n")
+	if r0 := driver.sign(now, canonicalRequest); r0 != "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41" {
+		t.Errorf("Fail for signature %v", r0)
+	}
+}
@@ -0,0 +1,704 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The interval to reconcile the alias tasks with the active streams.
+const aliasInterval = 3 * time.Second
+
+// The duration a higher priority source must be live, before it preempts the active source. It avoids flapping when
+// the higher priority source reconnects frequently.
+const aliasStableDuration = 5 * time.Second
+
+// The max number of sources of an alias.
+const aliasMaxSources = 16
+
+// The max number of failover history of all aliases.
+const aliasMaxHistory = 1000
+
+var aliasWorker *AliasWorker
+
+// StreamAlias maps some publish names, the sources, to a logical stream. The live source with the highest priority
+// feeds the logical stream, and fails over to the next one when it drops.
+type StreamAlias struct {
+	// The alias UUID, also used as the task UUID in task history.
+	UUID string `json:"uuid"`
+	// The logical app and stream name, for example, live and channel.
+	App    string `json:"app"`
+	Stream string `json:"stream"`
+	// The stream names of sources in the same app, in priority order, the first one is the highest.
+	Sources []string `json:"sources"`
+	// Whether alias is enabled.
+	Enabled bool `json:"enabled"`
+	// The label for this alias.
+	Label string `json:"label"`
+	// The update time.
+	Update string `json:"update"`
+}
+
+func (v *StreamAlias) String() string {
+	return fmt.Sprintf("uuid=%v, app=%v, stream=%v, sources=%v, enabled=%v, label=%v",
+		v.UUID, v.App, v.Stream, strings.Join(v.Sources, ","), v.Enabled, v.Label,
+	)
+}
+
+// StreamURL returns the logical stream URL, for example, live/channel, which is the key of alias.
+func (v *StreamAlias) StreamURL() string {
+	return fmt.Sprintf("%v/%v", v.App, v.Stream)
+}
+
+// Validate verifies the logical stream and sources, note that the logical stream must not be a source of itself.
+func (v *StreamAlias) Validate() error {
+	if v.Stream == "" || strings.ContainsAny(v.App+v.Stream, "/ \t\r\n") {
+		return errors.Errorf("invalid app=%v, stream=%v", v.App, v.Stream)
+	}
+	if len(v.Sources) == 0 || len(v.Sources) > aliasMaxSources {
+		return errors.Errorf("invalid sources %v, should be 1 to %v", len(v.Sources), aliasMaxSources)
+	}
+
+	for i, source := range v.Sources {
+		if source == "" || strings.ContainsAny(source, "/ \t\r\n") {
+			return errors.Errorf("invalid source %v", source)
+		}
+		if source == v.Stream {
+			return errors.Errorf("source %v is the logical stream", source)
+		}
+		if slicesContains(v.Sources[:i], source) {
+			return errors.Errorf("duplicated source %v", source)
+		}
+	}
+	return nil
+}
+
+// AliasState is the runtime state of alias, which is persisted in redis for query.
+type AliasState struct {
+	// The status of alias, idle, running, error or waiting-for-srs.
+	Status string `json:"status"`
+	// The active source which feeds the logical stream, empty if no live source.
+	Active string `json:"active,omitempty"`
+	// The FFmpeg pid, if running.
+	PID int32 `json:"pid,omitempty"`
+	// The start time of FFmpeg, if running.
+	Start string `json:"start,omitempty"`
+	// The last switch decision, with reason.
+	Decision string `json:"decision,omitempty"`
+	// The last error of FFmpeg.
+	Error string `json:"error,omitempty"`
+	// The update time.
+	Update string `json:"update"`
+}
+
+func (v *AliasState) String() string {
+	return fmt.Sprintf("status=%v, active=%v, pid=%v, start=%v, decision=%v, error=%v",
+		v.Status, v.Active, v.PID, v.Start, v.Decision, v.Error,
+	)
+}
+
+// AliasFailover is a switch of the active source of alias.
+type AliasFailover struct {
+	// The time of switch.
+	Time string `json:"time"`
+	// The logical stream URL of alias.
+	Alias string `json:"alias"`
+	// The previous and current active source, empty if none.
+	From string `json:"from"`
+	To   string `json:"to"`
+	// The reason of switch.
+	Reason string `json:"reason"`
+}
+
+func (v *AliasFailover) String() string {
+	return fmt.Sprintf("time=%v, alias=%v, from=%v, to=%v, reason=%v", v.Time, v.Alias, v.From, v.To, v.Reason)
+}
+
+// aliasSelect returns the source to feed the logical stream, with the reason if changed. The live is the publish time
+// of live sources. The highest priority live source is selected, so it's deterministic when sources publish
+// simultaneously, however, a source preempts the active one only when it's live for aliasStableDuration.
+func aliasSelect(alias *StreamAlias, live map[string]time.Time, active string, now time.Time) (string, string) {
+	if !alias.Enabled {
+		return "", "disabled"
+	}
+
+	_, activeLive := live[active]
+	for _, source := range alias.Sources {
+		since, ok := live[source]
+		if !ok {
+			continue
+		}
+		if source == active {
+			return active, ""
+		}
+		if activeLive && now.Sub(since) < aliasStableDuration {
+			continue
+		}
+
+		if active == "" {
+			return source, fmt.Sprintf("source %v is live", source)
+		} else if !activeLive {
+			return source, fmt.Sprintf("source %v dropped", active)
+		}
+		return source, fmt.Sprintf("source %v has higher priority", source)
+	}
+
+	if active != "" && !activeLive {
+		return "", fmt.Sprintf("source %v dropped", active)
+	}
+	return "", ""
+}
+
+// queryStreamAliases returns all aliases, the key is the logical stream URL.
+func queryStreamAliases(ctx context.Context) (map[string]*StreamAlias, error) {
+	values, err := rdb.HGetAll(ctx, SRS_STREAM_ALIAS).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_ALIAS)
+	}
+
+	aliases := make(map[string]*StreamAlias)
+	for streamURL, value := range values {
+		var alias StreamAlias
+		if err := json.Unmarshal([]byte(value), &alias); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", streamURL, value)
+		}
+		aliases[streamURL] = &alias
+	}
+	return aliases, nil
+}
+
+// recordAliasFailover saves the switch of source. It never fails, because the history is only for troubleshooting.
+func recordAliasFailover(ctx context.Context, failover *AliasFailover) {
+	if failover.Time == "" {
+		failover.Time = time.Now().Format(time.RFC3339)
+	}
+
+	if b, err := json.Marshal(failover); err != nil {
+		logger.Wf(ctx, "alias: ignore marshal %v err %+v", failover.String(), err)
+	} else if err := bufferedRedisWrite(ctx, "stream alias", func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.LPush(ctx, SRS_STREAM_ALIAS_HISTORY, string(b))
+		pipe.LTrim(ctx, SRS_STREAM_ALIAS_HISTORY, 0, aliasMaxHistory-1)
+	}); err != nil {
+		logger.Wf(ctx, "alias: ignore save %v err %+v", failover.String(), err)
+	}
+}
+
+// queryAliasFailovers returns the failover history, the latest first, the key is the logical stream URL.
+func queryAliasFailovers(ctx context.Context) (map[string][]*AliasFailover, error) {
+	history := make(map[string][]*AliasFailover)
+	if err := rangeRedisList(ctx, SRS_STREAM_ALIAS_HISTORY, aliasMaxHistory, func(value string) error {
+		var failover AliasFailover
+		if err := json.Unmarshal([]byte(value), &failover); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", value)
+		}
+		history[failover.Alias] = append(history[failover.Alias], &failover)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "range %v", SRS_STREAM_ALIAS_HISTORY)
+	}
+	return history, nil
+}
+
+// AliasTask is the runtime of an alias.
+type AliasTask struct {
+	// The configuration of alias.
+	config *StreamAlias
+	// The runtime state.
+	state AliasState
+	// The source relayed by FFmpeg, empty if not running.
+	source string
+	// The source and time when FFmpeg exits, to avoid too fast restart.
+	exitSource string
+	exitTime   time.Time
+	// To stop the FFmpeg, nil if not running.
+	cancel context.CancelFunc
+}
+
+// AliasWorker relays the active source of alias to the logical stream, and switches the source by priority.
+type AliasWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The alias tasks, key is the logical stream URL.
+	tasks map[string]*AliasTask
+	// The lock for tasks.
+	lock sync.Mutex
+	// To reconcile the tasks immediately, for example, when a stream publishes.
+	signal chan bool
+	// For test to overwrite the relay.
+	relay func(ctx, parentCtx context.Context, task *AliasTask, source string) error
+}
+
+func NewAliasWorker() *AliasWorker {
+	v := &AliasWorker{tasks: make(map[string]*AliasTask), signal: make(chan bool, 1)}
+	v.relay = v.doRelay
+	return v
+}
+
+func (v *AliasWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *AliasWorker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "alias: start a worker")
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			if err := v.reconcile(ctx, time.Now()); err != nil {
+				logger.Wf(ctx, "alias: ignore err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-v.signal:
+			case <-time.After(aliasInterval):
+			}
+		}
+	}()
+
+	return nil
+}
+
+// OnStreamChanged reconciles the aliases immediately, when a stream publishes or unpublishes.
+func (v *AliasWorker) OnStreamChanged(ctx context.Context, stream *SrsStream) {
+	select {
+	case v.signal <- true:
+	default:
+	}
+}
+
+// reconcile selects the source of aliases by the active streams, and starts or switches the relay tasks.
+func (v *AliasWorker) reconcile(ctx context.Context, now time.Time) error {
+	aliases, err := queryStreamAliases(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query aliases")
+	}
+
+	actives, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
+	}
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// Stop the aliases which are removed.
+	for streamURL, task := range v.tasks {
+		if _, ok := aliases[streamURL]; ok {
+			continue
+		}
+		if task.cancel != nil {
+			task.cancel()
+		}
+		delete(v.tasks, streamURL)
+		logger.Tf(ctx, "alias: remove %v", streamURL)
+	}
+
+	for streamURL, alias := range aliases {
+		task, ok := v.tasks[streamURL]
+		if !ok {
+			task = &AliasTask{state: AliasState{Status: "idle"}}
+			v.tasks[streamURL] = task
+		}
+		task.config = alias
+
+		// The sources always publish to the default vhost, see SrsStream.StreamURL.
+		live := make(map[string]time.Time)
+		for _, source := range alias.Sources {
+			value, ok := actives[fmt.Sprintf("%v/%v", alias.App, source)]
+			if !ok {
+				continue
+			}
+
+			var stream SrsStream
+			if err := json.Unmarshal([]byte(value), &stream); err != nil {
+				return errors.Wrapf(err, "unmarshal %v", value)
+			}
+			live[source], _ = time.Parse(time.RFC3339, stream.Update)
+		}
+
+		selected, reason := aliasSelect(alias, live, task.state.Active, now)
+		if selected != task.state.Active {
+			failover := &AliasFailover{
+				Time: now.Format(time.RFC3339), Alias: streamURL, From: task.state.Active, To: selected, Reason: reason,
+			}
+			recordAliasFailover(ctx, failover)
+			logger.Tf(ctx, "alias: switch %v", failover.String())
+
+			task.state.Active = selected
+			task.state.Decision = fmt.Sprintf("switch at %v, %v", now.Format(time.RFC3339), reason)
+		}
+
+		// Stop the relay of previous source, and start the selected one when it quits.
+		if task.cancel != nil && task.source != selected {
+			task.cancel()
+		}
+		// Hold the relay until SRS is ready, and never delay it if FFmpeg exits before SRS is ready again.
+		if task.cancel == nil && !srsReadiness.Ready() {
+			task.state.Status = string(TaskStatusWaitingSrs)
+		} else if task.cancel == nil && selected != "" && (selected != task.exitSource ||
+			now.Sub(task.exitTime) >= relayRestartInterval || task.exitTime.Before(srsReadiness.Since())) {
+			v.startTask(ctx, streamURL, task, selected)
+		} else if task.cancel == nil && task.state.Status == string(TaskStatusWaitingSrs) {
+			task.state.Status = "idle"
+		}
+		logger.Tf(ctx, "alias: reconcile %v, live=%v, %v", streamURL, len(live), task.state.String())
+
+		if err := v.saveState(ctx, streamURL, &task.state); err != nil {
+			return errors.Wrapf(err, "save %v", streamURL)
+		}
+	}
+
+	return nil
+}
+
+func (v *AliasWorker) saveState(ctx context.Context, streamURL string, state *AliasState) error {
+	state.Update = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(state); err != nil {
+		return errors.Wrapf(err, "marshal %v", state.String())
+	} else if err := rdb.HSet(ctx, SRS_STREAM_ALIAS_TASK, streamURL, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_STREAM_ALIAS_TASK, streamURL, string(b))
+	}
+	return nil
+}
+
+// startTask starts the FFmpeg to relay the source, note that the lock must be held.
+func (v *AliasWorker) startTask(ctx context.Context, streamURL string, task *AliasTask, source string) {
+	taskCtx, cancel := context.WithCancel(ctx)
+	task.cancel, task.source = cancel, source
+	task.state.Status, task.state.Error = "running", ""
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+		defer cancel()
+
+		err := v.relay(taskCtx, ctx, task, source)
+
+		func() {
+			v.lock.Lock()
+			defer v.lock.Unlock()
+
+			task.cancel, task.source, task.exitSource, task.exitTime = nil, "", source, time.Now()
+			task.state.PID, task.state.Start = 0, ""
+			if err != nil && taskCtx.Err() == nil {
+				task.state.Status, task.state.Error = "error", err.Error()
+				logger.Wf(ctx, "alias: %v from %v failed, err %+v", streamURL, source, err)
+			} else {
+				task.state.Status = "idle"
+			}
+
+			if err := v.saveState(ctx, streamURL, &task.state); err != nil {
+				logger.Wf(ctx, "alias: ignore save %v err %+v", streamURL, err)
+			}
+		}()
+
+		// Switch to the next source immediately.
+		select {
+		case v.signal <- true:
+		default:
+		}
+	}()
+}
+
+// doRelay runs the FFmpeg to play the source and publish to the logical stream, until canceled or the source drops.
+// The parentCtx is for the task history, because ctx might be canceled.
+func (v *AliasWorker) doRelay(ctx, parentCtx context.Context, task *AliasTask, source string) error {
+	config := task.config
+	streamURL := config.StreamURL()
+
+	secret, err := queryPublishSecret(ctx, config.Stream)
+	if err != nil {
+		return errors.Wrapf(err, "query secret")
+	}
+
+	input, err := url.Parse(fmt.Sprintf("rtmp://localhost/%v/%v", config.App, source))
+	if err != nil {
+		return errors.Wrapf(err, "parse source %v", source)
+	}
+	output := fmt.Sprintf("rtmp://localhost/%v/%v", config.App, config.Stream)
+	if secret != "" {
+		output = fmt.Sprintf("%v?secret=%v", output, url.QueryEscape(secret))
+	}
+
+	taskCtx := ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	heartbeat := NewFFmpegHeartbeat(cancel)
+	heartbeat.Parse(input)
+
+	args := []string{"-i", input.String(), "-c", "copy", "-f", "flv", output}
+	cmd := exec.CommandContext(ctx, "ffmpeg", args...)
+
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return errors.Wrapf(err, "pipe process")
+	}
+
+	if err := cmd.Start(); err != nil {
+		return errors.Wrapf(err, "execute ffmpeg")
+	}
+
+	pid := int32(cmd.Process.Pid)
+	func() {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+		task.state.PID, task.state.Start = pid, time.Now().Format(time.RFC3339)
+	}()
+	logger.Tf(ctx, "alias: start %v, source=%v, pid=%v", streamURL, source, pid)
+	recordTaskEvent(ctx, &TaskEvent{
+		Worker: "alias", Task: config.UUID, Platform: streamURL, Event: TaskEventStarted, PID: pid,
+		Message: fmt.Sprintf("source %v", source),
+	})
+
+	// Drain the frame logs, because the heartbeat blocks on it.
+	heartbeat.Polling(ctx, stderr)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-heartbeat.FrameLogs:
+			}
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-heartbeat.PollingCtx.Done():
+	}
+
+	err = cmd.Wait()
+	logger.Tf(ctx, "alias: done %v, source=%v, pid=%v, err=%v", streamURL, source, pid, err)
+
+	stopped := parentCtx.Err() != nil || taskCtx.Err() != nil
+	recordTaskExit(parentCtx, "alias", config.UUID, streamURL, pid, stopped, heartbeat, err)
+	return err
+}
+
+func (v *AliasWorker) Handle(ctx context.Context, handler *http.ServeMux) error {
+	ep := "/terraform/v1/ffmpeg/alias/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var userConf StreamAlias
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				*StreamAlias
+			}{
+				Token: &token, StreamAlias: &userConf,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if userConf.App == "" {
+				userConf.App = "live"
+			}
+			if err := userConf.Validate(); err != nil {
+				return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "validate"))
+			}
+			if err := verifyStreamName(ctx, userConf.Stream); err != nil {
+				return errors.Wrapf(err, "verify stream name")
+			}
+
+			streamURL := userConf.StreamURL()
+			aliases, err := queryStreamAliases(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query aliases")
+			}
+
+			// The logical stream of other alias must not be a source, to avoid relay loop.
+			for _, alias := range aliases {
+				if alias.App != userConf.App || alias.StreamURL() == streamURL {
+					continue
+				}
+				if slicesContains(userConf.Sources, alias.Stream) || slicesContains(alias.Sources, userConf.Stream) {
+					return newHttpStatusError(http.StatusBadRequest, errors.Errorf("loop with alias %v", alias.StreamURL()))
+				}
+			}
+
+			if previous, ok := aliases[streamURL]; ok {
+				userConf.UUID = previous.UUID
+			} else {
+				userConf.UUID = uuid.NewString()
+			}
+			userConf.Update = time.Now().Format(time.RFC3339)
+
+			if b, err := json.Marshal(&userConf); err != nil {
+				return errors.Wrapf(err, "marshal %v", userConf.String())
+			} else if err := rdb.HSet(ctx, SRS_STREAM_ALIAS, streamURL, string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v %v", SRS_STREAM_ALIAS, streamURL)
+			}
+
+			// Select the source by the new priority.
+			select {
+			case v.signal <- true:
+			default:
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "alias update ok, %v, token=%vB", userConf.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/alias/remove"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, app, stream string
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				App    *string `json:"app"`
+				Stream *string `json:"stream"`
+			}{
+				Token: &token, App: &app, Stream: &stream,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if app == "" {
+				app = "live"
+			}
+			streamURL := fmt.Sprintf("%v/%v", app, stream)
+			for _, key := range []string{SRS_STREAM_ALIAS, SRS_STREAM_ALIAS_TASK} {
+				if err := rdb.HDel(ctx, key, streamURL).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", key, streamURL)
+				}
+			}
+
+			select {
+			case v.signal <- true:
+			default:
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "alias remove ok, stream=%v, token=%vB", streamURL, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/alias/streams"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			aliases, err := queryStreamAliases(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query aliases")
+			}
+
+			states, err := rdb.HGetAll(ctx, SRS_STREAM_ALIAS_TASK).Result()
+			if err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hgetall %v", SRS_STREAM_ALIAS_TASK)
+			}
+
+			history, err := queryAliasFailovers(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query history")
+			}
+
+			res := make([]map[string]interface{}, 0)
+			for streamURL, alias := range aliases {
+				elem := map[string]interface{}{
+					"uuid":    alias.UUID,
+					"app":     alias.App,
+					"stream":  alias.Stream,
+					"sources": alias.Sources,
+					"enabled": alias.Enabled,
+					"label":   alias.Label,
+					"history": history[streamURL],
+				}
+
+				if value, ok := states[streamURL]; ok {
+					var state AliasState
+					if err := json.Unmarshal([]byte(value), &state); err != nil {
+						return errors.Wrapf(err, "unmarshal %v", value)
+					}
+					elem["state"] = &state
+				}
+
+				res = append(res, elem)
+			}
+
+			sort.Slice(res, func(i, j int) bool {
+				return res[i]["app"].(string)+res[i]["stream"].(string) < res[j]["app"].(string)+res[j]["stream"].(string)
+			})
+
+			httpWriteData(ctx, w, r, res)
+			logger.Tf(ctx, "alias query streams ok, aliases=%v, token=%vB", len(res), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	return nil
+}
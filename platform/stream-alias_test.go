@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestStreamAlias_Validate(t *testing.T) {
+	for _, c := range []struct {
+		alias StreamAlias
+		ok    bool
+	}{
+		{StreamAlias{App: "live", Stream: "channel", Sources: []string{"main", "backup"}}, true},
+		{StreamAlias{App: "live", Stream: "channel"}, false},
+		{StreamAlias{App: "live", Stream: "ch/1", Sources: []string{"main"}}, false},
+		{StreamAlias{App: "live", Stream: "channel", Sources: []string{"main", "main"}}, false},
+		{StreamAlias{App: "live", Stream: "channel", Sources: []string{"main", "channel"}}, false},
+	} {
+		if err := c.alias.Validate(); (err == nil) != c.ok {
+			t.Errorf("Fail for %v, err %+v", c.alias.String(), err)
+		}
+	}
+}
+
+func TestStreamAlias_Select(t *testing.T) {
+	now := time.Now()
+	alias := &StreamAlias{Stream: "channel", Sources: []string{"a", "b", "c"}, Enabled: true}
+	stable, unstable := now.Add(-time.Minute), now.Add(-time.Second)
+
+	for _, c := range []struct {
+		live   map[string]time.Time
+		active string
+		expect string
+	}{
+		// Select the highest priority, even publish simultaneously.
+		{map[string]time.Time{"b": unstable, "a": unstable}, "", "a"},
+		{map[string]time.Time{"c": stable, "b": stable}, "", "b"},
+		// Never preempt by the unstable source.
+		{map[string]time.Time{"a": unstable, "b": stable}, "b", "b"},
+		{map[string]time.Time{"a": stable, "b": stable}, "b", "a"},
+		// Never switch to lower priority source, if active is alive.
+		{map[string]time.Time{"a": stable, "b": stable}, "a", "a"},
+		// Failover to the next one, when active drops.
+		{map[string]time.Time{"b": unstable, "c": stable}, "a", "b"},
+		{map[string]time.Time{}, "a", ""},
+	} {
+		if selected, _ := aliasSelect(alias, c.live, c.active, now); selected != c.expect {
+			t.Errorf("Fail for live %v, active %v, selected %v", c.live, c.active, selected)
+		}
+	}
+
+	disabled := &StreamAlias{Stream: "channel", Sources: []string{"a"}}
+	if selected, reason := aliasSelect(disabled, map[string]time.Time{"a": stable}, "", now); selected != "" || reason != "disabled" {
+		t.Errorf("Fail for selected %v, reason %v", selected, reason)
+	}
+}
+
+func TestStreamAlias_Failover(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	started := make(chan string, 10)
+	worker := NewAliasWorker()
+	worker.relay = func(ctx, parentCtx context.Context, task *AliasTask, source string) error {
+		started <- source
+		<-ctx.Done()
+		return nil
+	}
+	defer worker.Close()
+
+	// Wait for the relay to quit, then reconcile to start the next source.
+	reconcile := func(now time.Time, expect string) {
+		for i := 0; i < 100; i++ {
+			worker.lock.Lock()
+			task := worker.tasks["live/channel"]
+			quit := task == nil || task.source == "" || task.source == task.state.Active
+			worker.lock.Unlock()
+			if quit {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		if err := worker.reconcile(ctx, now); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+		if expect == "" {
+			return
+		}
+
+		select {
+		case source := <-started:
+			if source != expect {
+				t.Errorf("Fail for source %v, expect %v", source, expect)
+			}
+		case <-time.After(3 * time.Second):
+			t.Errorf("Fail for no relay of %v", expect)
+		}
+	}
+
+	now := time.Now()
+	server.HSet(SRS_STREAM_ALIAS, "live/channel", `{"uuid":"u1","app":"live","stream":"channel","sources":["a","b"],"enabled":true}`)
+	server.HSet(SRS_STREAM_ACTIVE, "live/b", `{"vhost":"__defaultVhost__","app":"live","stream":"b","update":"`+now.Add(-time.Minute).Format(time.RFC3339)+`"}`)
+	reconcile(now, "b")
+
+	// The higher priority source preempts only when stable.
+	server.HSet(SRS_STREAM_ACTIVE, "live/a", `{"vhost":"__defaultVhost__","app":"live","stream":"a","update":"`+now.Format(time.RFC3339)+`"}`)
+	reconcile(now, "")
+	reconcile(now.Add(aliasStableDuration), "")
+	reconcile(now.Add(aliasStableDuration), "a")
+
+	// Failover to the next source, when active drops.
+	if err := rdb.HDel(ctx, SRS_STREAM_ACTIVE, "live/a").Err(); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	reconcile(now.Add(2*aliasStableDuration), "")
+	reconcile(now.Add(2*aliasStableDuration), "b")
+
+	history, err := queryAliasFailovers(ctx)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if h := history["live/channel"]; len(h) != 3 || h[0].From != "a" || h[0].To != "b" ||
+		h[1].From != "b" || h[1].To != "a" || h[2].From != "" || h[2].To != "b" {
+		t.Errorf("Fail for history %v", h)
+	}
+
+	// Stop the relay when alias is removed.
+	if err := rdb.HDel(ctx, SRS_STREAM_ALIAS, "live/channel").Err(); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	reconcile(now.Add(3*aliasStableDuration), "")
+	if len(worker.tasks) != 0 {
+		t.Errorf("Fail for tasks %v", worker.tasks)
+	}
+}
@@ -0,0 +1,198 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+)
+
+// StreamCheckResult is the result of a single check, so the UI is able to show exactly which one failed.
+type StreamCheckResult struct {
+	// The name of check, for example, url, dns, connect, push or source.
+	Name string `json:"name"`
+	// Whether the check is passed.
+	OK bool `json:"ok"`
+	// The error message if failed, or some information if passed.
+	Message string `json:"message,omitempty"`
+	// The elapsed time in milliseconds.
+	Elapsed int64 `json:"elapsed"`
+}
+
+// StreamChecker validates the configuration of forward or vLive as a dry run, which never persists
+// anything, and collects the result of each check.
+type StreamChecker struct {
+	// Whether all checks are passed.
+	OK bool `json:"ok"`
+	// The result of each check, in order.
+	Checks []*StreamCheckResult `json:"checks"`
+}
+
+func NewStreamChecker() *StreamChecker {
+	return &StreamChecker{OK: true}
+}
+
+func (v *StreamChecker) String() string {
+	var checks []string
+	for _, check := range v.Checks {
+		checks = append(checks, fmt.Sprintf("%v:%v", check.Name, check.OK))
+	}
+	return fmt.Sprintf("ok=%v, checks=[%v]", v.OK, strings.Join(checks, ","))
+}
+
+// check runs the fn as a named check, and returns whether it's passed.
+func (v *StreamChecker) check(name string, fn func() (string, error)) bool {
+	starttime := time.Now()
+	msg, err := fn()
+
+	r := &StreamCheckResult{Name: name, OK: err == nil, Message: msg}
+	r.Elapsed = int64(time.Since(starttime) / time.Millisecond)
+	if err != nil {
+		r.Message, v.OK = err.Error(), false
+	}
+
+	v.Checks = append(v.Checks, r)
+	return r.OK
+}
+
+// CheckTarget validates the output server and secret, by checking the URL syntax and scheme, resolving
+// the DNS and connecting to the server. If push is true, start a FFmpeg to push a test stream of 2s to
+// the target, note that the stream may appear briefly on the remote platform.
+func (v *StreamChecker) CheckTarget(ctx context.Context, server, secret string, push bool) {
+	outputServer := server
+	if !strings.HasSuffix(outputServer, "/") && !strings.HasPrefix(secret, "/") && secret != "" {
+		outputServer += "/"
+	}
+	outputURL := fmt.Sprintf("%v%v", outputServer, secret)
+
+	var hostname, port string
+	if ok := v.check("url", func() (string, error) {
+		u, err := RebuildStreamURL(outputURL)
+		if err != nil {
+			return "", errors.Wrapf(err, "parse %v", outputURL)
+		}
+
+		allowedSchemes := []string{"rtmp", "rtmps", "srt"}
+		if !slicesContains(allowedSchemes, u.Scheme) {
+			return "", errors.Errorf("invalid scheme %v, should be %v", u.Scheme, strings.Join(allowedSchemes, ","))
+		}
+		if u.Hostname() == "" {
+			return "", errors.Errorf("no host of %v", server)
+		}
+
+		hostname, port = u.Hostname(), u.Port()
+		if port == "" && u.Scheme == "rtmp" {
+			port = "1935"
+		} else if port == "" && u.Scheme == "rtmps" {
+			port = "443"
+		}
+		return fmt.Sprintf("scheme=%v, host=%v, port=%v", u.Scheme, hostname, port), nil
+	}); !ok {
+		return
+	}
+
+	if ok := v.check("dns", func() (string, error) {
+		if ip := net.ParseIP(hostname); ip != nil {
+			return fmt.Sprintf("ip %v", ip), nil
+		}
+
+		toCtx, cancel := context.WithTimeout(ctx, 3*time.Second)
+		defer cancel()
+
+		addrs, err := net.DefaultResolver.LookupHost(toCtx, hostname)
+		if err != nil {
+			return "", errors.Wrapf(err, "lookup %v", hostname)
+		}
+		return strings.Join(addrs, ","), nil
+	}); !ok {
+		return
+	}
+
+	// SRT is over UDP, so we're not able to connect to it without a handshake.
+	if port != "" && !strings.HasPrefix(outputURL, "srt://") {
+		if ok := v.check("connect", func() (string, error) {
+			endpoint := net.JoinHostPort(hostname, port)
+			conn, err := net.DialTimeout("tcp", endpoint, 3*time.Second)
+			if err != nil {
+				return "", errors.Wrapf(err, "connect %v", endpoint)
+			}
+			defer conn.Close()
+			return fmt.Sprintf("connected to %v", conn.RemoteAddr()), nil
+		}); !ok {
+			return
+		}
+	}
+
+	if push {
+		v.check("push", func() (string, error) {
+			toCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+			defer cancel()
+
+			args := []string{
+				"-re", "-f", "lavfi", "-i", "testsrc=size=320x240:rate=25",
+				"-f", "lavfi", "-i", "sine=frequency=440:sample_rate=44100",
+				"-t", "2", "-c:v", "libx264", "-preset", "ultrafast", "-c:a", "aac",
+			}
+			if strings.HasPrefix(outputURL, "srt://") {
+				args = append(args, "-pes_payload_size", "0", "-f", "mpegts")
+			} else {
+				args = append(args, "-f", "flv")
+			}
+			args = append(args, outputURL)
+
+			if b, err := exec.CommandContext(toCtx, "ffmpeg", args...).CombinedOutput(); err != nil {
+				lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+				return "", errors.Wrapf(err, "push %v, %v", server, lines[len(lines)-1])
+			}
+			return "pushed 2s test stream", nil
+		})
+	}
+}
+
+// CheckSource validates the vLive source file or stream, by probing it with FFprobe.
+func (v *StreamChecker) CheckSource(ctx context.Context, source *FFprobeSource) {
+	v.check("source", func() (string, error) {
+		if source.Target == "" {
+			return "", errors.Errorf("no target of %v", source.Name)
+		}
+
+		if source.Type != FFprobeSourceTypeStream {
+			if _, err := os.Stat(source.Target); err != nil {
+				return "", errors.Wrapf(err, "no file %v", source.Target)
+			}
+		}
+
+		toCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
+		defer cancel()
+
+		target := source.Target
+		if strings.Contains(target, "://") {
+			if u, err := RebuildStreamURL(target); err != nil {
+				return "", errors.Wrapf(err, "rebuild %v", target)
+			} else {
+				target = u.String()
+			}
+		}
+
+		format, video, audio, err := FFprobeFileFormat(toCtx, target)
+		if err != nil {
+			return "", errors.Wrapf(err, "probe %v", source.Name)
+		}
+		if video == nil && audio == nil {
+			return "", errors.Errorf("no video or audio stream in %v", source.Name)
+		}
+
+		return fmt.Sprintf("name=%v, duration=%v, video=%v, audio=%v",
+			source.Name, format.Duration, video != nil, audio != nil,
+		), nil
+	})
+}
@@ -0,0 +1,449 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The default and max validity of guest key, in seconds.
+const streamGuestDefaultValidity = 4 * 3600
+const streamGuestMaxValidity = 24 * 3600
+
+// The interval to purge the expired or consumed guest keys.
+const streamGuestPurgeInterval = 1 * time.Minute
+
+// The app to publish by guest key, the same as the stream keys.
+const streamGuestApp = "live"
+
+var streamGuestWorker *StreamGuestWorker
+
+// kickoffGuestStream kicks the publisher of guest when revoked, replaced by tests.
+var kickoffGuestStream = kickoffStream
+
+// GuestKey is a temporary publish key for a stream, stored in SRS_STREAM_GUEST, the field is the key. The publisher
+// of key is stored in SRS_STREAM_GUEST_SESSION while publishing, so only one session for each key.
+type GuestKey struct {
+	// The publish key, for example, guest3F2A9C0B41D7E6A5.
+	Key string `json:"key"`
+	// The stream name the key is bound to, for example, livestream.
+	Stream string `json:"stream"`
+	// Whether the key is only for one session, which is consumed when unpublished.
+	Single bool `json:"single"`
+	// Whether the single session key is consumed.
+	Consumed bool `json:"consumed,omitempty"`
+	// The time the key is created, and expires.
+	Create string `json:"create"`
+	Expire string `json:"expire"`
+
+	// The client id of publisher if publishing, only in response.
+	Client string `json:"client,omitempty"`
+	// The URLs for encoder to publish the stream, only in response.
+	RTMP        string `json:"rtmp,omitempty"`
+	SRT         string `json:"srt,omitempty"`
+	SrtStreamID string `json:"srtStreamId,omitempty"`
+}
+
+func (v *GuestKey) String() string {
+	return fmt.Sprintf("key=%vB, stream=%v, single=%v, consumed=%v, expire=%v, client=%v",
+		len(v.Key), v.Stream, v.Single, v.Consumed, v.Expire, v.Client,
+	)
+}
+
+// Expired returns whether the key is expired at now, so it's not able to publish.
+func (v *GuestKey) Expired(now time.Time) bool {
+	expire, err := time.Parse(time.RFC3339, v.Expire)
+	return err != nil || !now.Before(expire)
+}
+
+// buildIngest fills the URLs to publish by RTMP and SRT, for the host of platform.
+func (v *GuestKey) buildIngest(host string) {
+	v.RTMP = fmt.Sprintf("rtmp://%v/%v/%v?secret=%v",
+		net.JoinHostPort(host, envRtmpPort()), streamGuestApp, v.Stream, v.Key,
+	)
+	v.SrtStreamID = buildSrtStreamID(fmt.Sprintf("%v/%v", streamGuestApp, v.Stream), v.Key)
+	v.SRT = fmt.Sprintf("srt://%v?streamid=%v", net.JoinHostPort(host, envSrtListen()), v.SrtStreamID)
+}
+
+// streamGuestHost returns the host for encoder to publish, by PUBLIC_URL, or the host of request.
+func streamGuestHost(r *http.Request) string {
+	host := r.Host
+	if publicURL := envPublicUrl(); publicURL != "" {
+		if u, err := url.Parse(publicURL); err == nil && u.Host != "" {
+			host = u.Host
+		}
+	}
+
+	if hostname, _, err := net.SplitHostPort(host); err == nil {
+		return hostname
+	}
+	return host
+}
+
+// queryGuestKeys returns the guest keys with the publisher, sorted by the time of creation.
+func queryGuestKeys(ctx context.Context) ([]*GuestKey, error) {
+	values, err := rdb.HGetAll(ctx, SRS_STREAM_GUEST).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_GUEST)
+	}
+
+	sessions, err := rdb.HGetAll(ctx, SRS_STREAM_GUEST_SESSION).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_GUEST_SESSION)
+	}
+
+	guests := []*GuestKey{}
+	for key, value := range values {
+		var guest GuestKey
+		if err := json.Unmarshal([]byte(value), &guest); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+		guest.Client = sessions[key]
+		guests = append(guests, &guest)
+	}
+
+	sort.Slice(guests, func(i, j int) bool {
+		if guests[i].Create != guests[j].Create {
+			return guests[i].Create < guests[j].Create
+		}
+		return guests[i].Key < guests[j].Key
+	})
+	return guests, nil
+}
+
+// guestKeyOf returns the key of publisher, the key of SRT streamid, or the secret of param.
+func guestKeyOf(streamObj *SrsStream) string {
+	if streamObj.IsSRT() {
+		if key, err := resolveSrtPublish(streamObj); err == nil {
+			return key
+		}
+		return ""
+	}
+
+	params, err := url.ParseQuery(strings.TrimPrefix(streamObj.Param, "?"))
+	if err != nil {
+		return ""
+	}
+	return params.Get("secret")
+}
+
+// verifyGuestPublish returns the guest key of publisher, nil if not a guest key, or error if the key is not allowed.
+func verifyGuestPublish(ctx context.Context, streamObj *SrsStream) (*GuestKey, error) {
+	key := guestKeyOf(streamObj)
+	if key == "" {
+		return nil, nil
+	}
+
+	value, err := rdb.HGet(ctx, SRS_STREAM_GUEST, key).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v", SRS_STREAM_GUEST)
+	} else if value == "" {
+		return nil, nil
+	}
+
+	var guest GuestKey
+	if err := json.Unmarshal([]byte(value), &guest); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", value)
+	}
+
+	if guest.Stream != streamObj.Stream {
+		return nil, errors.Errorf("guest key of %v, not %v", guest.Stream, streamObj.Stream)
+	}
+	if guest.Consumed {
+		return nil, errors.Errorf("guest key of %v is consumed", guest.Stream)
+	}
+	if guest.Expired(time.Now()) {
+		return nil, errors.Errorf("guest key of %v expired at %v", guest.Stream, guest.Expire)
+	}
+	return &guest, nil
+}
+
+// acquireGuestSession binds the publisher to guest key, which fails if the key is publishing by another one.
+func acquireGuestSession(ctx context.Context, guest *GuestKey, streamObj *SrsStream) error {
+	if ok, err := rdb.HSetNX(ctx, SRS_STREAM_GUEST_SESSION, guest.Key, streamObj.Client).Result(); err != nil {
+		return errors.Wrapf(err, "hsetnx %v %v", SRS_STREAM_GUEST_SESSION, streamObj.Client)
+	} else if !ok {
+		return errors.Errorf("guest key of %v is publishing", guest.Stream)
+	}
+	return nil
+}
+
+// releaseGuestSession unbinds the publisher when unpublished, and the single session key is consumed.
+func releaseGuestSession(ctx context.Context, streamObj *SrsStream) error {
+	key := guestKeyOf(streamObj)
+	if key == "" {
+		return nil
+	}
+
+	if client, err := rdb.HGet(ctx, SRS_STREAM_GUEST_SESSION, key).Result(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hget %v", SRS_STREAM_GUEST_SESSION)
+	} else if client == "" || client != streamObj.Client {
+		return nil
+	}
+
+	value, err := rdb.HGet(ctx, SRS_STREAM_GUEST, key).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hget %v", SRS_STREAM_GUEST)
+	}
+
+	// Consume the key before releasing the session, so it never publishes again.
+	if value != "" {
+		var guest GuestKey
+		if err := json.Unmarshal([]byte(value), &guest); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", value)
+		}
+
+		if guest.Single {
+			guest.Consumed = true
+			if b, err := json.Marshal(&guest); err != nil {
+				return errors.Wrapf(err, "marshal %v", guest.String())
+			} else if err := rdb.HSet(ctx, SRS_STREAM_GUEST, key, string(b)).Err(); err != nil {
+				return errors.Wrapf(err, "hset %v %v", SRS_STREAM_GUEST, guest.String())
+			}
+		}
+		logger.Tf(ctx, "guest release session ok, %v", guest.String())
+	}
+
+	if err := rdb.HDel(ctx, SRS_STREAM_GUEST_SESSION, key).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v", SRS_STREAM_GUEST_SESSION)
+	}
+	return nil
+}
+
+// queryActiveStreamByClient returns the active stream published by client, nil if not found.
+func queryActiveStreamByClient(ctx context.Context, client string) (*SrsStream, error) {
+	streams, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
+	}
+
+	for _, value := range streams {
+		var stream SrsStream
+		if err := json.Unmarshal([]byte(value), &stream); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+		if stream.Client == client {
+			return &stream, nil
+		}
+	}
+	return nil, nil
+}
+
+// revokeGuestKey removes the key, and kicks the publisher if publishing.
+func revokeGuestKey(ctx context.Context, key string) error {
+	if err := rdb.HDel(ctx, SRS_STREAM_GUEST, key).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v", SRS_STREAM_GUEST)
+	}
+
+	client, err := rdb.HGet(ctx, SRS_STREAM_GUEST_SESSION, key).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hget %v", SRS_STREAM_GUEST_SESSION)
+	} else if client == "" {
+		return nil
+	}
+
+	if err := rdb.HDel(ctx, SRS_STREAM_GUEST_SESSION, key).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v", SRS_STREAM_GUEST_SESSION)
+	}
+
+	stream, err := queryActiveStreamByClient(ctx, client)
+	if err != nil {
+		return errors.Wrapf(err, "query client %v", client)
+	} else if stream == nil {
+		return nil
+	}
+
+	if code, err := kickoffGuestStream(ctx, stream); err != nil {
+		return errors.Wrapf(err, "kickoff %v", stream.StreamURL())
+	} else {
+		logger.Tf(ctx, "guest kickoff %v ok, code=%v, client=%v", stream.StreamURL(), code, client)
+	}
+	return nil
+}
+
+// purgeGuestKeys removes the expired or consumed keys, unless the guest is still publishing.
+func purgeGuestKeys(ctx context.Context, now time.Time) error {
+	guests, err := queryGuestKeys(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query guests")
+	}
+
+	for _, guest := range guests {
+		if !guest.Consumed && !guest.Expired(now) {
+			continue
+		}
+
+		// The session is stale if publisher is gone without unpublish, for example, SRS restarts.
+		if guest.Client != "" {
+			if stream, err := queryActiveStreamByClient(ctx, guest.Client); err != nil {
+				return errors.Wrapf(err, "query client %v", guest.Client)
+			} else if stream != nil {
+				continue
+			}
+		}
+
+		if err := rdb.HDel(ctx, SRS_STREAM_GUEST, guest.Key).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hdel %v", SRS_STREAM_GUEST)
+		}
+		if err := rdb.HDel(ctx, SRS_STREAM_GUEST_SESSION, guest.Key).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hdel %v", SRS_STREAM_GUEST_SESSION)
+		}
+		logger.Tf(ctx, "guest purge ok, %v", guest.String())
+	}
+	return nil
+}
+
+// StreamGuestWorker purges the guest keys periodically.
+type StreamGuestWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewStreamGuestWorker() *StreamGuestWorker {
+	return &StreamGuestWorker{}
+}
+
+func (v *StreamGuestWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *StreamGuestWorker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "guest start a worker, interval=%v", streamGuestPurgeInterval)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			select {
+			case <-ctx.Done():
+			case <-time.After(streamGuestPurgeInterval):
+			}
+
+			if err := purgeGuestKeys(ctx, time.Now()); err != nil {
+				logger.Wf(ctx, "guest ignore purge err %+v", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func handleMgmtStreamGuest(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/streams/guest"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action, stream, key string
+			var validity int
+			single := true
+			if err := ParseBody(ctx, r, &struct {
+				Token    *string `json:"token"`
+				Action   *string `json:"action"`
+				Stream   *string `json:"stream"`
+				Key      *string `json:"key"`
+				Validity *int    `json:"validity"`
+				Single   *bool   `json:"single"`
+			}{
+				Token: &token, Action: &action, Stream: &stream, Key: &key, Validity: &validity, Single: &single,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			host := streamGuestHost(r)
+			switch action {
+			case "":
+			case "create":
+				if stream == "" || strings.ContainsAny(stream, "/?&= \t\r\n") {
+					return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid stream %v", stream))
+				}
+				if validity == 0 {
+					validity = streamGuestDefaultValidity
+				}
+				if validity < 0 || validity > streamGuestMaxValidity {
+					return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid validity %v", validity))
+				}
+				if err := verifyStreamName(ctx, stream); err != nil {
+					return errors.Wrapf(err, "verify stream name")
+				}
+
+				now := time.Now()
+				guest := &GuestKey{
+					Key:    fmt.Sprintf("guest%v", strings.ToUpper(strings.ReplaceAll(uuid.NewString(), "-", ""))[:16]),
+					Stream: stream, Single: single, Create: now.Format(time.RFC3339),
+					Expire: now.Add(time.Duration(validity) * time.Second).Format(time.RFC3339),
+				}
+				if b, err := json.Marshal(guest); err != nil {
+					return errors.Wrapf(err, "marshal %v", guest.String())
+				} else if err := rdb.HSet(ctx, SRS_STREAM_GUEST, guest.Key, string(b)).Err(); err != nil {
+					return errors.Wrapf(err, "hset %v %v", SRS_STREAM_GUEST, guest.String())
+				}
+
+				guest.buildIngest(host)
+				httpWriteData(ctx, w, r, guest)
+				logger.Tf(ctx, "guest create ok, %v, token=%vB", guest.String(), len(token))
+				return nil
+			case "remove":
+				if key == "" {
+					return newHttpStatusError(http.StatusBadRequest, errors.New("no key"))
+				}
+				if err := revokeGuestKey(ctx, key); err != nil {
+					return errors.Wrapf(err, "revoke %vB", len(key))
+				}
+			default:
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+			}
+
+			guests, err := queryGuestKeys(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query guests")
+			}
+			for _, guest := range guests {
+				guest.buildIngest(host)
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Guests []*GuestKey `json:"guests"`
+			}{
+				Guests: guests,
+			})
+			logger.Tf(ctx, "guest %v ok, guests=%v, token=%vB", action, len(guests), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,558 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The interval to refresh the health of streams, by the bitrate samples of SRS.
+const streamHealthInterval = 10 * time.Second
+
+// The factors are evaluated by the samples in the window, so the score recovers or decays as the condition changes.
+const streamHealthWindow = 5 * time.Minute
+
+// The interval to spot check each stream by ffprobe, which is the only probe of stream, and the probe result expires
+// if the stream is not probed again in streamHealthProbeExpire.
+const streamHealthProbeInterval = 1 * time.Minute
+const streamHealthProbeExpire = 3 * streamHealthProbeInterval
+
+// The duration of packets to read for each probe, and the timeout of probe.
+const streamHealthProbeDuration = 6
+const streamHealthProbeTimeout = 15 * time.Second
+
+// The name of factors of stream health.
+const (
+	StreamHealthBitrate  = "bitrate"
+	StreamHealthKeyframe = "keyframe"
+	StreamHealthDrift    = "drift"
+	StreamHealthDropped  = "dropped"
+)
+
+var streamHealthWorker *StreamHealthWorker
+
+// StreamHealthFactor is a factor which contributes to the score, zero penalty means good.
+type StreamHealthFactor struct {
+	// The name of factor, such as bitrate.
+	Name string `json:"name"`
+	// The penalty of score, 0 if good.
+	Penalty int `json:"penalty"`
+	// The description of factor, for example, the variation of bitrate.
+	Message string `json:"message"`
+}
+
+// StreamHealth is the health of a publishing stream, stored in SRS_STREAM_HEALTH, the field is the stream URL.
+type StreamHealth struct {
+	// The stream URL, for example, live/livestream.
+	Stream string `json:"stream"`
+	// The score in [0, 100], higher is better, 100 minus the penalty of factors.
+	Score int `json:"score"`
+	// The best score in streamHealthWindow, which is below the threshold if the stream is persistently unhealthy.
+	Best int `json:"best"`
+	// The factors evaluated, the factor is absent if no data, for example, not probed yet.
+	Factors []*StreamHealthFactor `json:"factors"`
+	// The time when we start to evaluate the stream, and the time of the latest evaluation.
+	Since  string `json:"since"`
+	Update string `json:"update"`
+}
+
+func (v *StreamHealth) String() string {
+	var factors []string
+	for _, f := range v.Factors {
+		factors = append(factors, fmt.Sprintf("%v-%v", f.Name, f.Penalty))
+	}
+	return fmt.Sprintf("stream=%v, score=%v, best=%v, factors=%v, since=%v",
+		v.Stream, v.Score, v.Best, strings.Join(factors, ","), v.Since,
+	)
+}
+
+// queryStreamHealths returns the health of streams, key is stream URL.
+func queryStreamHealths(ctx context.Context) (map[string]*StreamHealth, error) {
+	values, err := rdb.HGetAll(ctx, SRS_STREAM_HEALTH).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_HEALTH)
+	}
+
+	healths := make(map[string]*StreamHealth)
+	for streamURL, value := range values {
+		var health StreamHealth
+		if err := json.Unmarshal([]byte(value), &health); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", streamURL, value)
+		}
+		healths[streamURL] = &health
+	}
+	return healths, nil
+}
+
+// StreamHealthProbe is the result of ffprobe spot check of a stream.
+type StreamHealthProbe struct {
+	// The time of keyframes in seconds.
+	Keyframes []float64
+	// The timestamp of the last audio and video packet in seconds, negative if no audio or video.
+	LastAudio float64
+	LastVideo float64
+}
+
+type streamHealthSegment struct {
+	at       time.Time
+	duration float64
+	seqNo    uint64
+}
+
+type streamHealthSample struct {
+	at    time.Time
+	value int
+}
+
+// streamHealthState is the samples of a stream, in the window.
+type streamHealthState struct {
+	// The time when we start to evaluate the stream.
+	since time.Time
+	// The receive bitrate of SRS.
+	bitrates []streamHealthSample
+	// The HLS segments notified by the on_hls hook.
+	segments []streamHealthSegment
+	// The latest probe, the time to start it, and whether it's running.
+	probe   *StreamHealthProbe
+	probed  time.Time
+	probing bool
+	// The scores, to find the best one in window.
+	scores []streamHealthSample
+}
+
+// StreamHealthWorker scores the health of publishing streams, from the data we already have, and at most one spot
+// check by ffprobe for each stream in streamHealthProbeInterval.
+type StreamHealthWorker struct {
+	// The samples of streams, key is stream URL.
+	streams map[string]*streamHealthState
+	// The lock for streams.
+	lock sync.Mutex
+
+	// Probe the stream by ffprobe, replaced by tests.
+	probe func(ctx context.Context, streamURL string) (*StreamHealthProbe, error)
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewStreamHealthWorker() *StreamHealthWorker {
+	return &StreamHealthWorker{streams: make(map[string]*streamHealthState), probe: probeStreamHealth}
+}
+
+func (v *StreamHealthWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *StreamHealthWorker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "stream health start a worker, interval=%v, window=%v, probe=%v",
+		streamHealthInterval, streamHealthWindow, streamHealthProbeInterval,
+	)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		for ctx.Err() == nil {
+			if stats, err := srsExporter.Query(ctx); err != nil {
+				logger.Wf(ctx, "stream health ignore query srs err %+v", err)
+			} else if err := v.refresh(ctx, stats.Streams); err != nil {
+				logger.Wf(ctx, "stream health ignore err %+v", err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(streamHealthInterval):
+			}
+		}
+	}()
+	return nil
+}
+
+// OnHlsTsMessage records the HLS segment, to detect the dropped frames by the duration of media and wall clock.
+func (v *StreamHealthWorker) OnHlsTsMessage(ctx context.Context, msg *SrsOnHlsMessage) {
+	streamURL := fmt.Sprintf("%v/%v", msg.App, msg.Stream)
+
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	// Ignore the segment if not publishing, the stream is added by refresh.
+	if state, ok := v.streams[streamURL]; ok {
+		state.segments = append(state.segments, streamHealthSegment{
+			at: time.Now(), duration: msg.Duration, seqNo: msg.SeqNo,
+		})
+	}
+}
+
+// refresh samples the bitrate of publishing streams, evaluates and saves the health, and pushes them to clients.
+func (v *StreamHealthWorker) refresh(ctx context.Context, streams []*SrsExporterStream) error {
+	healths := v.sample(ctx, streams, time.Now())
+
+	// Save the health, and remove the streams not publishing.
+	actives := make(map[string]bool)
+	for _, health := range healths {
+		actives[health.Stream] = true
+
+		b, err := json.Marshal(health)
+		if err != nil {
+			return errors.Wrapf(err, "marshal %v", health.String())
+		}
+		if err := rdb.HSet(ctx, SRS_STREAM_HEALTH, health.Stream, string(b)).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hset %v %v %v", SRS_STREAM_HEALTH, health.Stream, string(b))
+		}
+	}
+
+	streamURLs, err := rdb.HKeys(ctx, SRS_STREAM_HEALTH).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hkeys %v", SRS_STREAM_HEALTH)
+	}
+	for _, streamURL := range streamURLs {
+		if actives[streamURL] {
+			continue
+		}
+		if err := rdb.HDel(ctx, SRS_STREAM_HEALTH, streamURL).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hdel %v %v", SRS_STREAM_HEALTH, streamURL)
+		}
+	}
+
+	sort.Slice(healths, func(i, j int) bool {
+		return healths[i].Stream < healths[j].Stream
+	})
+	streamHealthStream.Publish(ctx, "health", healths, false)
+	return nil
+}
+
+// sample appends the bitrate of publishing streams, and evaluates the health, the stream not publishing is removed.
+func (v *StreamHealthWorker) sample(ctx context.Context, streams []*SrsExporterStream, now time.Time) []*StreamHealth {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var healths []*StreamHealth
+	actives := make(map[string]bool)
+	for _, s := range streams {
+		if !s.Active {
+			continue
+		}
+		actives[s.Stream] = true
+
+		state, ok := v.streams[s.Stream]
+		if !ok {
+			state = &streamHealthState{since: now}
+			v.streams[s.Stream] = state
+		}
+		state.bitrates = append(state.bitrates, streamHealthSample{at: now, value: s.RecvKbps})
+		state.trim(now)
+
+		if !state.probing && now.Sub(state.probed) >= streamHealthProbeInterval {
+			state.probing, state.probed = true, now
+			v.spotCheck(ctx, s.Stream)
+		}
+
+		healths = append(healths, state.evaluate(s.Stream, now))
+	}
+
+	for streamURL := range v.streams {
+		if !actives[streamURL] {
+			delete(v.streams, streamURL)
+		}
+	}
+	return healths
+}
+
+// spotCheck probes the stream in a goroutine, never blocks the refresh. Note that it's called with lock.
+func (v *StreamHealthWorker) spotCheck(ctx context.Context, streamURL string) {
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		probe, err := v.probe(ctx, streamURL)
+		if err != nil {
+			logger.Wf(ctx, "stream health ignore probe %v err %+v", streamURL, err)
+		}
+
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		// Ignore the result if the stream is gone, or republished.
+		if state, ok := v.streams[streamURL]; ok {
+			state.probing = false
+			if probe != nil {
+				state.probe = probe
+			}
+		}
+	}()
+}
+
+// trim removes the samples out of window, and the expired probe.
+func (v *streamHealthState) trim(now time.Time) {
+	for len(v.bitrates) > 0 && now.Sub(v.bitrates[0].at) > streamHealthWindow {
+		v.bitrates = v.bitrates[1:]
+	}
+	for len(v.segments) > 0 && now.Sub(v.segments[0].at) > streamHealthWindow {
+		v.segments = v.segments[1:]
+	}
+	for len(v.scores) > 0 && now.Sub(v.scores[0].at) > streamHealthWindow {
+		v.scores = v.scores[1:]
+	}
+	if v.probe != nil && now.Sub(v.probed) > streamHealthProbeExpire {
+		v.probe = nil
+	}
+}
+
+// evaluate scores the stream by the factors.
+func (v *streamHealthState) evaluate(streamURL string, now time.Time) *StreamHealth {
+	var factors []*StreamHealthFactor
+	if f := v.evaluateBitrate(); f != nil {
+		factors = append(factors, f)
+	}
+	if v.probe != nil {
+		factors = append(factors, v.probe.evaluateKeyframe(), v.probe.evaluateDrift())
+	}
+	if f := v.evaluateDropped(); f != nil {
+		factors = append(factors, f)
+	}
+
+	score := 100
+	for _, f := range factors {
+		if f != nil {
+			score -= f.Penalty
+		}
+	}
+	if score < 0 {
+		score = 0
+	}
+
+	v.scores = append(v.scores, streamHealthSample{at: now, value: score})
+	best := score
+	for _, s := range v.scores {
+		if s.value > best {
+			best = s.value
+		}
+	}
+
+	health := &StreamHealth{
+		Stream: streamURL, Score: score, Best: best, Factors: []*StreamHealthFactor{},
+		Since: v.since.Format(time.RFC3339), Update: now.Format(time.RFC3339),
+	}
+	for _, f := range factors {
+		if f != nil {
+			health.Factors = append(health.Factors, f)
+		}
+	}
+	return health
+}
+
+// evaluateBitrate evaluates the stability of ingest bitrate, by the variation of samples.
+func (v *streamHealthState) evaluateBitrate() *StreamHealthFactor {
+	if len(v.bitrates) < 3 {
+		return nil
+	}
+
+	var sum float64
+	for _, s := range v.bitrates {
+		sum += float64(s.value)
+	}
+	mean := sum / float64(len(v.bitrates))
+	if mean == 0 {
+		return &StreamHealthFactor{Name: StreamHealthBitrate, Penalty: 40, Message: "no data received"}
+	}
+
+	var variance float64
+	for _, s := range v.bitrates {
+		variance += (float64(s.value) - mean) * (float64(s.value) - mean)
+	}
+	cv := math.Sqrt(variance/float64(len(v.bitrates))) / mean
+
+	f := &StreamHealthFactor{Name: StreamHealthBitrate, Message: fmt.Sprintf(
+		"bitrate %vkbps, variation %.0f%%", int(mean), cv*100,
+	)}
+	if cv >= 0.5 {
+		f.Penalty = 30
+	} else if cv >= 0.25 {
+		f.Penalty = 15
+	}
+	return f
+}
+
+// evaluateDropped evaluates the dropped frames, by the media duration of HLS segments against the wall clock, and the
+// missing segments.
+func (v *streamHealthState) evaluateDropped() *StreamHealthFactor {
+	if len(v.segments) < 3 {
+		return nil
+	}
+
+	var media float64
+	var missing uint64
+	for i := 1; i < len(v.segments); i++ {
+		prev, s := v.segments[i-1], v.segments[i]
+		media += s.duration
+		// The sequence number is reset if republished, which is not a gap.
+		if s.seqNo > prev.seqNo+1 {
+			missing += s.seqNo - prev.seqNo - 1
+		}
+	}
+
+	elapsed := v.segments[len(v.segments)-1].at.Sub(v.segments[0].at).Seconds()
+	if elapsed <= 0 {
+		return nil
+	}
+	realtime := media / elapsed
+
+	f := &StreamHealthFactor{Name: StreamHealthDropped, Message: fmt.Sprintf(
+		"media %.0f%% of realtime, missing %v segments", realtime*100, missing,
+	)}
+	if realtime < 0.8 {
+		f.Penalty = 25
+	} else if realtime < 0.95 {
+		f.Penalty = 10
+	}
+	if missing > 0 {
+		f.Penalty += 10
+	}
+	return f
+}
+
+// evaluateKeyframe evaluates the regularity of keyframe interval, by the jitter of intervals.
+func (v *StreamHealthProbe) evaluateKeyframe() *StreamHealthFactor {
+	if v.LastVideo < 0 {
+		return nil
+	}
+	if len(v.Keyframes) < 2 {
+		return &StreamHealthFactor{Name: StreamHealthKeyframe, Penalty: 20, Message: fmt.Sprintf(
+			"keyframe interval over %vs", streamHealthProbeDuration,
+		)}
+	}
+
+	var intervals []float64
+	for i := 1; i < len(v.Keyframes); i++ {
+		intervals = append(intervals, v.Keyframes[i]-v.Keyframes[i-1])
+	}
+	min, max, sum := intervals[0], intervals[0], float64(0)
+	for _, interval := range intervals {
+		min, max, sum = math.Min(min, interval), math.Max(max, interval), sum+interval
+	}
+	mean := sum / float64(len(intervals))
+
+	f := &StreamHealthFactor{Name: StreamHealthKeyframe, Message: fmt.Sprintf(
+		"keyframe interval %.1fs, jitter %.1fs", mean, max-min,
+	)}
+	if mean > 0 && (max-min)/mean >= 0.5 {
+		f.Penalty = 20
+	} else if mean > 0 && (max-min)/mean >= 0.2 {
+		f.Penalty = 10
+	}
+	return f
+}
+
+// evaluateDrift evaluates the audio/video drift, by the timestamp of the last packets.
+func (v *StreamHealthProbe) evaluateDrift() *StreamHealthFactor {
+	if v.LastAudio < 0 || v.LastVideo < 0 {
+		return nil
+	}
+
+	drift := math.Abs(v.LastAudio - v.LastVideo)
+	f := &StreamHealthFactor{Name: StreamHealthDrift, Message: fmt.Sprintf("audio/video drift %vms", int(drift*1000))}
+	if drift >= 1 {
+		f.Penalty = 25
+	} else if drift >= 0.3 {
+		f.Penalty = 10
+	}
+	return f
+}
+
+// probeStreamHealth reads the packets of stream for a few seconds, without decoding.
+func probeStreamHealth(ctx context.Context, streamURL string) (*StreamHealthProbe, error) {
+	ctx, cancel := context.WithTimeout(ctx, streamHealthProbeTimeout)
+	defer cancel()
+
+	inputURL := fmt.Sprintf("rtmp://localhost/%v", streamURL)
+	args := []string{
+		"-v", "quiet", "-print_format", "json", "-read_intervals", fmt.Sprintf("%%+%v", streamHealthProbeDuration),
+		"-show_entries", "packet=codec_type,pts_time,flags", "-i", inputURL,
+	}
+	stdout, err := exec.CommandContext(ctx, "ffprobe", args...).Output()
+	if err != nil {
+		return nil, errors.Wrapf(err, "ffprobe %v", inputURL)
+	}
+
+	res := struct {
+		Packets []struct {
+			CodecType string `json:"codec_type"`
+			PTS       string `json:"pts_time"`
+			Flags     string `json:"flags"`
+		} `json:"packets"`
+	}{}
+	if err := json.Unmarshal(stdout, &res); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", string(stdout))
+	}
+
+	probe := &StreamHealthProbe{LastAudio: -1, LastVideo: -1}
+	for _, p := range res.Packets {
+		pts, err := strconv.ParseFloat(p.PTS, 64)
+		if err != nil {
+			continue
+		}
+
+		if p.CodecType == "audio" {
+			probe.LastAudio = pts
+		} else if p.CodecType == "video" {
+			probe.LastVideo = pts
+			if strings.Contains(p.Flags, "K") {
+				probe.Keyframes = append(probe.Keyframes, pts)
+			}
+		}
+	}
+	return probe, nil
+}
+
+// alertStreamUnhealthy fires for each stream whose best score in the window is below the threshold, that is, the
+// stream is persistently unhealthy, not a spike.
+func alertStreamUnhealthy(ctx context.Context, threshold float64) (map[string]string, error) {
+	healths, err := queryStreamHealths(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query healths")
+	}
+
+	firing := make(map[string]string)
+	for streamURL, health := range healths {
+		since, err := time.Parse(time.RFC3339, health.Since)
+		if err != nil || time.Since(since) < streamHealthWindow || float64(health.Best) >= threshold {
+			continue
+		}
+
+		var reasons []string
+		for _, f := range health.Factors {
+			if f.Penalty > 0 {
+				reasons = append(reasons, f.Message)
+			}
+		}
+		firing[streamURL] = fmt.Sprintf("score %v, best %v in %v, %v",
+			health.Score, health.Best, streamHealthWindow, strings.Join(reasons, ", "),
+		)
+	}
+	return firing, nil
+}
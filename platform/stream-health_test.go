@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestStreamHealth_Factors(t *testing.T) {
+	now := time.Now()
+
+	// Stable bitrate, regular keyframes, in sync and realtime.
+	state := &streamHealthState{since: now, probe: &StreamHealthProbe{
+		Keyframes: []float64{10, 12, 14, 16}, LastAudio: 16.02, LastVideo: 16.04,
+	}}
+	for i, kbps := range []int{1000, 1010, 990} {
+		state.bitrates = append(state.bitrates, streamHealthSample{at: now, value: kbps})
+		state.segments = append(state.segments, streamHealthSegment{
+			at: now.Add(time.Duration(i*10) * time.Second), duration: 10, seqNo: uint64(i),
+		})
+	}
+	if health := state.evaluate("live/livestream", now); health.Score != 100 || len(health.Factors) != 4 {
+		t.Errorf("Fail for %v", health.String())
+	}
+
+	// Unstable bitrate, irregular keyframes, drift and dropped frames.
+	state = &streamHealthState{since: now, probe: &StreamHealthProbe{
+		Keyframes: []float64{10, 11, 15}, LastAudio: 15, LastVideo: 16.5,
+	}}
+	for i, kbps := range []int{200, 1800, 1000} {
+		state.bitrates = append(state.bitrates, streamHealthSample{at: now, value: kbps})
+		state.segments = append(state.segments, streamHealthSegment{
+			at: now.Add(time.Duration(i*20) * time.Second), duration: 10, seqNo: uint64(i * 2),
+		})
+	}
+	if health := state.evaluate("live/livestream", now); health.Score != 0 || health.Best != 0 {
+		t.Errorf("Fail for %v", health.String())
+	}
+
+	// No data received, without probe.
+	state = &streamHealthState{since: now}
+	for i := 0; i < 3; i++ {
+		state.bitrates = append(state.bitrates, streamHealthSample{at: now})
+	}
+	if health := state.evaluate("live/livestream", now); health.Score != 60 || health.Factors[0].Name != StreamHealthBitrate {
+		t.Errorf("Fail for %v", health.String())
+	}
+}
+
+func TestStreamHealth_Refresh(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	setupFakeRedis(t)
+
+	var probes int
+	worker := NewStreamHealthWorker()
+	worker.probe = func(ctx context.Context, streamURL string) (*StreamHealthProbe, error) {
+		probes++
+		return &StreamHealthProbe{Keyframes: []float64{0, 2, 4}, LastAudio: 4, LastVideo: 4}, nil
+	}
+	defer worker.Close()
+
+	// Only one probe for each stream in the interval.
+	streams := []*SrsExporterStream{{Stream: "live/livestream", Active: true, RecvKbps: 1000}, {Stream: "live/idle"}}
+	for i := 0; i < 3; i++ {
+		if err := worker.refresh(ctx, streams); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+		worker.wg.Wait()
+	}
+	if probes != 1 {
+		t.Errorf("Fail for probes %v", probes)
+	}
+
+	healths, err := queryStreamHealths(ctx)
+	if err != nil || len(healths) != 1 || healths["live/livestream"] == nil || healths["live/livestream"].Score != 100 {
+		t.Fatalf("Fail for healths %v, err %+v", healths, err)
+	}
+
+	// Fire the alert if persistently unhealthy.
+	health := healths["live/livestream"]
+	health.Since, health.Best = time.Now().Add(-2*streamHealthWindow).Format(time.RFC3339), 40
+	b, _ := json.Marshal(health)
+	rdb.HSet(ctx, SRS_STREAM_HEALTH, health.Stream, string(b))
+	if firing, err := alertStreamUnhealthy(ctx, 60); err != nil || len(firing) != 1 {
+		t.Errorf("Fail for firing %v, err %+v", firing, err)
+	}
+
+	// Remove the health when unpublished.
+	if err := worker.refresh(ctx, nil); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if healths, err := queryStreamHealths(ctx); err != nil || len(healths) != 0 || len(worker.streams) != 0 {
+		t.Errorf("Fail for healths %v, err %+v", healths, err)
+	}
+}
@@ -0,0 +1,411 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The header of CSV document for stream keys.
+var streamKeysCSVHeader = []string{"stream", "secret"}
+
+// The prefix of the hashed publish secret in SRS_AUTH_SECRET, see hashStreamSecret.
+const streamSecretHashPrefix = "sha256:"
+
+// hashStreamSecret returns the salted hash of secret to store, in the format sha256:{salt}:{hash}, so the publish keys
+// in SRS_AUTH_SECRET, of live room or imported, are never stored in plaintext. The secret which is already hashed, for
+// example, exported from another install, is kept.
+func hashStreamSecret(secret string) string {
+	if isStreamSecretHashed(secret) {
+		return secret
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		panic(errors.Wrapf(err, "generate salt"))
+	}
+	return hashStreamSecretWithSalt(hex.EncodeToString(salt), secret)
+}
+
+func hashStreamSecretWithSalt(salt, secret string) string {
+	b := sha256.Sum256([]byte(salt + secret))
+	return fmt.Sprintf("%v%v:%v", streamSecretHashPrefix, salt, hex.EncodeToString(b[:]))
+}
+
+func isStreamSecretHashed(secret string) bool {
+	parts := strings.Split(strings.TrimPrefix(secret, streamSecretHashPrefix), ":")
+	return strings.HasPrefix(secret, streamSecretHashPrefix) && len(parts) == 2 && parts[0] != "" &&
+		len(parts[1]) == sha256.Size*2
+}
+
+// matchStreamSecret returns whether the secret of publisher matches the hashed secret, in constant time.
+func matchStreamSecret(hashed, secret string) bool {
+	if secret == "" || isStreamSecretHashed(secret) || !isStreamSecretHashed(hashed) {
+		return false
+	}
+
+	salt := strings.Split(strings.TrimPrefix(hashed, streamSecretHashPrefix), ":")[0]
+	return subtle.ConstantTimeCompare([]byte(hashStreamSecretWithSalt(salt, secret)), []byte(hashed)) == 1
+}
+
+// localPublishSecret returns the secret for the local publishers such as relay, to publish the stream with a publish
+// key, because the plaintext of key is unknown. It's derived from api secret and bound to the stream, see
+// queryPublishSecret. Return empty string if no api secret.
+func localPublishSecret(apiSecret, stream string) string {
+	if err := checkApiSecret(apiSecret); err != nil {
+		return ""
+	}
+
+	h := hmac.New(sha256.New, []byte(apiSecret))
+	h.Write([]byte("oryx-local-publish:" + stream))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verifyRoomPublishSecret verifies the secret of publisher, by the secret in params or the key of SRT streamid, against
+// the hashed publish key of stream, or the secret of local publishers.
+func verifyRoomPublishSecret(hashed string, streamObj *SrsStream) bool {
+	secret := guestKeyOf(streamObj)
+	if matchStreamSecret(hashed, secret) {
+		return true
+	}
+
+	local := localPublishSecret(envApiSecret(), streamObj.Stream)
+	return local != "" && subtle.ConstantTimeCompare([]byte(local), []byte(secret)) == 1
+}
+
+// migrateStreamSecrets hashes the publish keys in plaintext, which are saved before the keys are hashed.
+func migrateStreamSecrets(ctx context.Context) error {
+	values, err := rdb.HGetAll(ctx, SRS_AUTH_SECRET).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_AUTH_SECRET)
+	}
+
+	prefix := GenerateRoomPublishKey("")
+	var hashes []interface{}
+	for field, secret := range values {
+		if strings.HasPrefix(field, prefix) && secret != "" && !isStreamSecretHashed(secret) {
+			hashes = append(hashes, field, hashStreamSecret(secret))
+		}
+	}
+	if len(hashes) == 0 {
+		return nil
+	}
+
+	if err := rdb.HSet(ctx, SRS_AUTH_SECRET, hashes...).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v keys", SRS_AUTH_SECRET, len(hashes)/2)
+	}
+	logger.Tf(ctx, "migration: hash %v stream keys", len(hashes)/2)
+	return nil
+}
+
+// StreamKey is the publish key of a stream, which is stored in SRS_AUTH_SECRET as the live room does, see
+// GenerateRoomPublishKey for detail. The key is hashed, see hashStreamSecret.
+type StreamKey struct {
+	// The stream name, for example, livestream.
+	Stream string `json:"stream"`
+	// The hash of publish secret with prefix sha256:, while the plaintext is also accepted to import.
+	Secret string `json:"secret"`
+	// The SRT streamid for encoder to publish the stream, only in response, see buildSrtStreamID.
+	SrtStreamID string `json:"srtStreamId,omitempty"`
+	// The URLs to play the stream of live app, only in response, see PlaybackEndpoints.
+	Playback *PlaybackURLs `json:"playback,omitempty"`
+	// The quota of key, nil if no limit, see StreamQuota.
+	Quota *StreamQuota `json:"quota,omitempty"`
+}
+
+func (v *StreamKey) String() string {
+	return fmt.Sprintf("stream=%v, secret=%vB", v.Stream, len(v.Secret))
+}
+
+// StreamKeyConflict is a key which is not able to import.
+type StreamKeyConflict struct {
+	// The stream name.
+	Stream string `json:"stream"`
+	// The reason, for example, exists, duplicated, invalid, quota if the quota is invalid, or naming if violates the
+	// naming policy.
+	Reason string `json:"reason"`
+}
+
+// queryStreamKeys returns all publish keys of streams, sorted by stream name.
+func queryStreamKeys(ctx context.Context) ([]*StreamKey, error) {
+	values, err := rdb.HGetAll(ctx, SRS_AUTH_SECRET).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_AUTH_SECRET)
+	}
+
+	quotas, err := queryStreamQuotas(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query quotas")
+	}
+
+	prefix := GenerateRoomPublishKey("")
+	keys := []*StreamKey{}
+	for field, secret := range values {
+		if strings.HasPrefix(field, prefix) {
+			stream := strings.TrimPrefix(field, prefix)
+			keys = append(keys, &StreamKey{Stream: stream, Secret: secret, Quota: quotas[stream]})
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Stream < keys[j].Stream
+	})
+	return keys, nil
+}
+
+// checkStreamKeys returns the conflicts of keys to import, against the existing keys and the keys themselves.
+func checkStreamKeys(keys, existing []*StreamKey) []*StreamKeyConflict {
+	exists := make(map[string]bool)
+	for _, key := range existing {
+		exists[key.Stream] = true
+	}
+
+	conflicts := []*StreamKeyConflict{}
+	imported := make(map[string]bool)
+	for _, key := range keys {
+		if key.Stream == "" || key.Secret == "" || strings.ContainsAny(key.Stream, "/ \t\r\n") {
+			conflicts = append(conflicts, &StreamKeyConflict{Stream: key.Stream, Reason: "invalid"})
+		} else if key.Quota != nil && key.Quota.Validate() != nil {
+			conflicts = append(conflicts, &StreamKeyConflict{Stream: key.Stream, Reason: "quota"})
+		} else if imported[key.Stream] {
+			conflicts = append(conflicts, &StreamKeyConflict{Stream: key.Stream, Reason: "duplicated"})
+		} else if exists[key.Stream] {
+			conflicts = append(conflicts, &StreamKeyConflict{Stream: key.Stream, Reason: "exists"})
+		}
+		imported[key.Stream] = true
+	}
+	return conflicts
+}
+
+// importStreamKeys save all keys by one HSET command, so either all keys or none of them are active. The quotas are
+// saved before keys, so a key is never active without its quota. The secrets are hashed, like the passwords.
+func importStreamKeys(ctx context.Context, keys []*StreamKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	for _, key := range keys {
+		if key.Quota != nil {
+			if err := saveStreamQuota(ctx, key.Stream, key.Quota); err != nil {
+				return errors.Wrapf(err, "save quota of %v", key.Stream)
+			}
+		}
+	}
+
+	values := make([]interface{}, 0, len(keys)*2)
+	for _, key := range keys {
+		values = append(values, GenerateRoomPublishKey(key.Stream), hashStreamSecret(key.Secret))
+	}
+
+	if err := rdb.HSet(ctx, SRS_AUTH_SECRET, values...).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v keys", SRS_AUTH_SECRET, len(keys))
+	}
+	return nil
+}
+
+// parseStreamKeysCSV parse the CSV document with header stream,secret.
+func parseStreamKeysCSV(data string) ([]*StreamKey, error) {
+	records, err := csv.NewReader(strings.NewReader(data)).ReadAll()
+	if err != nil {
+		return nil, errors.Wrapf(err, "read csv")
+	}
+
+	keys := []*StreamKey{}
+	for i, record := range records {
+		if len(record) != len(streamKeysCSVHeader) {
+			return nil, errors.Errorf("invalid line %v, %v", i+1, record)
+		}
+		if i == 0 && record[0] == streamKeysCSVHeader[0] && record[1] == streamKeysCSVHeader[1] {
+			continue
+		}
+		keys = append(keys, &StreamKey{Stream: strings.TrimSpace(record[0]), Secret: strings.TrimSpace(record[1])})
+	}
+	return keys, nil
+}
+
+// writeStreamKeysCSV write the keys as CSV document with header stream,secret.
+func writeStreamKeysCSV(w io.Writer, keys []*StreamKey) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(streamKeysCSVHeader); err != nil {
+		return errors.Wrapf(err, "write header")
+	}
+	for _, key := range keys {
+		if err := cw.Write([]string{key.Stream, key.Secret}); err != nil {
+			return errors.Wrapf(err, "write %v", key.String())
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func handleMgmtStreamKeys(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/streams/keys/export"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, format string
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Format *string `json:"format"`
+			}{
+				Token: &token, Format: &format,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			keys, err := queryStreamKeys(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query keys")
+			}
+
+			if format == "csv" {
+				var b bytes.Buffer
+				if err := writeStreamKeysCSV(&b, keys); err != nil {
+					return errors.Wrapf(err, "write csv")
+				}
+
+				w.Header().Set("Content-Type", "text/csv")
+				w.Header().Set("Content-Disposition", "attachment; filename=stream-keys.csv")
+				w.Write(b.Bytes())
+			} else if format == "" || format == "json" {
+				endpoints, err := queryPlaybackEndpoints(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "query playback")
+				}
+
+				for _, key := range keys {
+					// The streamid is not able to build by the hashed secret.
+					if !isStreamSecretHashed(key.Secret) {
+						key.SrtStreamID = buildSrtStreamID(key.Stream, key.Secret)
+					}
+					key.Playback = endpoints.URLs("live", key.Stream)
+				}
+				httpWriteData(ctx, w, r, &struct {
+					Keys []*StreamKey `json:"keys"`
+				}{
+					Keys: keys,
+				})
+			} else {
+				return errors.Errorf("invalid format %v", format)
+			}
+
+			logger.Tf(ctx, "stream keys export ok, format=%v, keys=%v, token=%vB", format, len(keys), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/streams/keys/import"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, format, data string
+			var dryRun bool
+			var keys []*StreamKey
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string       `json:"token"`
+				Format *string       `json:"format"`
+				Keys   *[]*StreamKey `json:"keys"`
+				Data   *string       `json:"data"`
+				DryRun *bool         `json:"dryRun"`
+			}{
+				Token: &token, Format: &format, Keys: &keys, Data: &data, DryRun: &dryRun,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if format == "csv" {
+				if parsed, err := parseStreamKeysCSV(data); err != nil {
+					return errors.Wrapf(err, "parse csv")
+				} else {
+					keys = parsed
+				}
+			} else if format != "" && format != "json" {
+				return errors.Errorf("invalid format %v", format)
+			}
+			if len(keys) == 0 {
+				return errors.New("no keys")
+			}
+
+			existing, err := queryStreamKeys(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query keys")
+			}
+
+			// Never import any key if conflicts, to avoid leaving part of keys active.
+			conflicts := checkStreamKeys(keys, existing)
+			for _, key := range keys {
+				if key.Stream == "" {
+					continue
+				}
+				if err := verifyStreamName(ctx, key.Stream); err != nil {
+					if _, ok := errors.Cause(err).(*httpStatusError); !ok {
+						return errors.Wrapf(err, "verify stream name")
+					}
+					conflicts = append(conflicts, &StreamKeyConflict{Stream: key.Stream, Reason: "naming"})
+				}
+			}
+			if !dryRun && len(conflicts) > 0 {
+				return errors.Errorf("conflicts %v of %v keys, first is %v %v",
+					len(conflicts), len(keys), conflicts[0].Stream, conflicts[0].Reason,
+				)
+			}
+
+			if !dryRun {
+				if err := importStreamKeys(ctx, keys); err != nil {
+					return errors.Wrapf(err, "import %v keys", len(keys))
+				}
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				DryRun    bool                 `json:"dryRun"`
+				Keys      int                  `json:"keys"`
+				Conflicts []*StreamKeyConflict `json:"conflicts"`
+			}{
+				DryRun: dryRun, Keys: len(keys), Conflicts: conflicts,
+			})
+			logger.Tf(ctx, "stream keys import ok, format=%v, dryRun=%v, keys=%v, conflicts=%v, token=%vB",
+				format, dryRun, len(keys), len(conflicts), len(token),
+			)
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestStreamKeys_CSVRoundTrip(t *testing.T) {
+	keys := []*StreamKey{{Stream: "room1", Secret: "abc"}, {Stream: "room2", Secret: "x,y"}}
+
+	var b bytes.Buffer
+	if err := writeStreamKeysCSV(&b, keys); err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+
+	parsed, err := parseStreamKeysCSV(b.String())
+	if err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	if len(parsed) != 2 || parsed[0].Stream != "room1" || parsed[1].Secret != "x,y" {
+		t.Errorf("Fail for parsed %v", parsed)
+	}
+
+	if _, err := parseStreamKeysCSV("room1,abc,extra"); err == nil {
+		t.Errorf("Fail for no error")
+	}
+}
+
+func TestStreamKeys_ImportWithConflicts(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	server.HSet(SRS_AUTH_SECRET, "pubSecret", "global")
+	server.HSet(SRS_AUTH_SECRET, GenerateRoomPublishKey("room1"), "old")
+
+	existing, err := queryStreamKeys(ctx)
+	if err != nil || len(existing) != 1 || existing[0].Stream != "room1" {
+		t.Errorf("Fail for existing %v, err %+v", existing, err)
+		return
+	}
+
+	keys := []*StreamKey{
+		{Stream: "room1", Secret: "new"}, {Stream: "room2", Secret: "a"}, {Stream: "room2", Secret: "b"},
+		{Stream: "live/room3", Secret: "c"}, {Stream: "room4", Secret: ""},
+	}
+	conflicts := checkStreamKeys(keys, existing)
+	if len(conflicts) != 4 {
+		t.Errorf("Fail for conflicts %v", len(conflicts))
+		return
+	}
+	for i, reason := range []string{"exists", "duplicated", "invalid", "invalid"} {
+		if conflicts[i].Reason != reason {
+			t.Errorf("Fail for conflict %v, reason=%v, expect %v", i, conflicts[i].Reason, reason)
+		}
+	}
+
+	if err := importStreamKeys(ctx, []*StreamKey{{Stream: "room2", Secret: "a"}, {Stream: "room3", Secret: "c"}}); err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	if keys, err := queryStreamKeys(ctx); err != nil || len(keys) != 3 || keys[2].Stream != "room3" {
+		t.Errorf("Fail for keys %v, err %+v", keys, err)
+	}
+	if secret, _ := server.HGet(SRS_AUTH_SECRET, GenerateRoomPublishKey("room3")); !matchStreamSecret(secret, "c") {
+		t.Errorf("Fail for secret %v", secret)
+	}
+	if secret, _ := server.HGet(SRS_AUTH_SECRET, "pubSecret"); secret != "global" {
+		t.Errorf("Fail for global secret %v", secret)
+	}
+}
+
+func TestStreamKeys_HashedSecret(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	// The hashed secret is kept, for example, exported from another install.
+	hashed := hashStreamSecret("room-key")
+	if !isStreamSecretHashed(hashed) || hashStreamSecret(hashed) != hashed {
+		t.Errorf("Fail for hashed %v", hashed)
+	}
+	if !matchStreamSecret(hashed, "room-key") || matchStreamSecret(hashed, "room-key2") ||
+		matchStreamSecret(hashed, "") || matchStreamSecret(hashed, hashed) || matchStreamSecret("room-key", "room-key") {
+		t.Errorf("Fail for match %v", hashed)
+	}
+
+	// The same secret is hashed with different salt.
+	if hashed == hashStreamSecret("room-key") || !matchStreamSecret(hashStreamSecret("room-key"), "room-key") {
+		t.Errorf("Fail for salt of %v", hashed)
+	}
+
+	server.HSet(SRS_AUTH_SECRET, "pubSecret", "global")
+	if err := importStreamKeys(ctx, []*StreamKey{{Stream: "room1", Secret: "room-key"}, {Stream: "room2", Secret: hashed}}); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if secret, _ := server.HGet(SRS_AUTH_SECRET, GenerateRoomPublishKey("room2")); secret != hashed {
+		t.Errorf("Fail for secret %v", secret)
+	}
+
+	// Publish by the secret in params, but never the global secret or the hash itself, like the live room.
+	for _, c := range []struct {
+		param string
+		ok    bool
+	}{
+		{"?secret=room-key", true}, {"?secret=global", false}, {"?secret=wrong", false}, {"", false},
+		{"?secret=" + hashed, false},
+	} {
+		if verifiedBy, err := verifyPublish(ctx, &SrsStream{App: "live", Stream: "room1", Param: c.param}); (err == nil) != c.ok ||
+			(c.ok && verifiedBy != "room") {
+			t.Errorf("Fail for %v, verifiedBy=%v, err %+v", c, verifiedBy, err)
+		}
+	}
+	if verifiedBy, err := verifyPublish(ctx, &SrsStream{App: "live", Stream: "room3", Param: "?secret=global"}); err != nil || verifiedBy != "global" {
+		t.Errorf("Fail for verifiedBy=%v, err %+v", verifiedBy, err)
+	}
+
+	// The local publishers use the secret bound to the stream, because the plaintext is unknown.
+	secret, err := queryPublishSecret(ctx, "room1")
+	if err != nil || secret == "" || secret == "global" {
+		t.Errorf("Fail for secret %v, err %+v", secret, err)
+	}
+	if _, err := verifyPublish(ctx, &SrsStream{App: "live", Stream: "room1", Param: "?secret=" + secret}); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if _, err := verifyPublish(ctx, &SrsStream{App: "live", Stream: "room2", Param: "?secret=" + secret}); err == nil {
+		t.Errorf("Fail for secret of other stream")
+	}
+	if secret, err := queryPublishSecret(ctx, "room3"); err != nil || secret != "global" {
+		t.Errorf("Fail for secret %v, err %+v", secret, err)
+	}
+
+	if err := verifySpeedtestKey(ctx, "room1", "room-key"); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	for _, secret := range []string{"wrong", "global"} {
+		if err := verifySpeedtestKey(ctx, "room1", secret); err == nil {
+			t.Errorf("Fail for key %v", secret)
+		}
+	}
+}
+
+func TestStreamKeys_MigrateToHash(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	hashed := hashStreamSecret("room2-key")
+	server.HSet(SRS_AUTH_SECRET, "pubSecret", "global")
+	server.HSet(SRS_AUTH_SECRET, GenerateRoomPublishKey("room1"), "room1-key")
+	server.HSet(SRS_AUTH_SECRET, GenerateRoomPublishKey("room2"), hashed)
+
+	// Run twice, because the migration must be idempotent.
+	for i := 0; i < 2; i++ {
+		if err := migrateStreamSecrets(ctx); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+	}
+
+	if secret, _ := server.HGet(SRS_AUTH_SECRET, GenerateRoomPublishKey("room1")); !matchStreamSecret(secret, "room1-key") {
+		t.Errorf("Fail for secret %v", secret)
+	}
+	if secret, _ := server.HGet(SRS_AUTH_SECRET, GenerateRoomPublishKey("room2")); secret != hashed {
+		t.Errorf("Fail for secret %v", secret)
+	}
+	if secret, _ := server.HGet(SRS_AUTH_SECRET, "pubSecret"); secret != "global" {
+		t.Errorf("Fail for global secret %v", secret)
+	}
+}
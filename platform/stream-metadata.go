@@ -0,0 +1,165 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max length of metadata in characters, which is the limit of YouTube, the strictest destination.
+const (
+	streamMetadataMaxTitle       = 100
+	streamMetadataMaxDescription = 5000
+	streamMetadataMaxCategory    = 100
+)
+
+// StreamMetadata is the metadata of a stream, to update the remote broadcast of forward destinations, see
+// ForwardIntegration.
+type StreamMetadata struct {
+	// The title of broadcast.
+	Title string `json:"title,omitempty"`
+	// The description of broadcast, ignored by the destination without description, for example, Twitch.
+	Description string `json:"description,omitempty"`
+	// The category of broadcast, the category ID of YouTube, for example, 20 for gaming, or the category name of
+	// Twitch, for example, Just Chatting.
+	Category string `json:"category,omitempty"`
+}
+
+func (v *StreamMetadata) String() string {
+	return fmt.Sprintf("title=%v, description=%vB, category=%v", v.Title, len(v.Description), v.Category)
+}
+
+func (v *StreamMetadata) Validate() error {
+	if v.Title == "" && v.Description == "" && v.Category == "" {
+		return errors.New("no title, description or category")
+	}
+	if n := utf8.RuneCountInString(v.Title); n > streamMetadataMaxTitle {
+		return errors.Errorf("title %v exceeds %v characters", n, streamMetadataMaxTitle)
+	}
+	if n := utf8.RuneCountInString(v.Description); n > streamMetadataMaxDescription {
+		return errors.Errorf("description %v exceeds %v characters", n, streamMetadataMaxDescription)
+	}
+	if n := utf8.RuneCountInString(v.Category); n > streamMetadataMaxCategory {
+		return errors.Errorf("category %v exceeds %v characters", n, streamMetadataMaxCategory)
+	}
+	return nil
+}
+
+// queryStreamMetadatas returns the metadata of all streams, key is the stream name.
+func queryStreamMetadatas(ctx context.Context) (map[string]*StreamMetadata, error) {
+	values, err := rdb.HGetAll(ctx, SRS_STREAM_METADATA).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_METADATA)
+	}
+
+	metadatas := make(map[string]*StreamMetadata)
+	for stream, value := range values {
+		var metadata StreamMetadata
+		if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", stream, value)
+		}
+		metadatas[stream] = &metadata
+	}
+	return metadatas, nil
+}
+
+// queryStreamMetadata returns the metadata of stream, nil if not set.
+func queryStreamMetadata(ctx context.Context, stream string) (*StreamMetadata, error) {
+	value, err := rdb.HGet(ctx, SRS_STREAM_METADATA, stream).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v %v", SRS_STREAM_METADATA, stream)
+	}
+	if value == "" {
+		return nil, nil
+	}
+
+	var metadata StreamMetadata
+	if err := json.Unmarshal([]byte(value), &metadata); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", value)
+	}
+	return &metadata, nil
+}
+
+func handleMgmtStreamMetadata(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/streams/metadata"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action, stream string
+			var metadata StreamMetadata
+			if err := ParseBody(ctx, r, &struct {
+				Token    *string         `json:"token"`
+				Action   *string         `json:"action"`
+				Stream   *string         `json:"stream"`
+				Metadata *StreamMetadata `json:"metadata"`
+			}{
+				Token: &token, Action: &action, Stream: &stream, Metadata: &metadata,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if action == "" {
+				metadatas, err := queryStreamMetadatas(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "query metadatas")
+				}
+
+				httpWriteData(ctx, w, r, metadatas)
+				logger.Tf(ctx, "stream metadata query ok, metadatas=%v, token=%vB", len(metadatas), len(token))
+				return nil
+			}
+
+			if action != "update" && action != "remove" {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+			}
+			if stream == "" {
+				return newHttpStatusError(http.StatusBadRequest, errors.New("no stream"))
+			}
+
+			if action == "remove" {
+				if err := rdb.HDel(ctx, SRS_STREAM_METADATA, stream).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hdel %v %v", SRS_STREAM_METADATA, stream)
+				}
+			} else {
+				if err := metadata.Validate(); err != nil {
+					return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "validate"))
+				}
+				if err := verifyStreamName(ctx, stream); err != nil {
+					return errors.Wrapf(err, "verify stream name")
+				}
+
+				if b, err := json.Marshal(&metadata); err != nil {
+					return errors.Wrapf(err, "marshal %v", metadata.String())
+				} else if err := rdb.HSet(ctx, SRS_STREAM_METADATA, stream, string(b)).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v %v %v", SRS_STREAM_METADATA, stream, string(b))
+				}
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "stream metadata %v ok, stream=%v, %v, token=%vB", action, stream, metadata.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,415 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The default rules of stream name, which is safe for HLS path, recording filename and Nginx location.
+const streamNamingPattern = `^[A-Za-z0-9_-]+$`
+const streamNamingMaxLength = 64
+
+// The max length of the max length, to limit the filename of recordings.
+const streamNamingMaxLengthLimit = 255
+
+// The default reserved names, which conflict with the paths of HTTP API or pages.
+var streamNamingReserved = []string{"api", "mgmt", "terraform", "players", "tools", "console", "healthz"}
+
+// StreamNamingPolicy is the rules of stream name, because the name with spaces, slashes or emoji breaks the HLS path,
+// recording filename and Nginx location. It's stored in SRS_STREAM_NAMING, and the names already in use when the
+// policy changes are grandfathered as exceptions in SRS_STREAM_NAMING_EXCEPTIONS.
+type StreamNamingPolicy struct {
+	// The regular expression the stream name must match.
+	Pattern string `json:"pattern"`
+	// The max length of stream name in characters.
+	MaxLength int `json:"maxLength"`
+	// The reserved names which are not allowed, case-insensitive.
+	Reserved []string `json:"reserved"`
+	// The update time of policy.
+	Update string `json:"update,omitempty"`
+
+	// The compiled pattern.
+	pattern *regexp.Regexp
+}
+
+func (v *StreamNamingPolicy) String() string {
+	return fmt.Sprintf("pattern=%v, maxLength=%v, reserved=%v, update=%v",
+		v.Pattern, v.MaxLength, strings.Join(v.Reserved, ","), v.Update,
+	)
+}
+
+func newStreamNamingPolicy() *StreamNamingPolicy {
+	v := &StreamNamingPolicy{
+		Pattern: streamNamingPattern, MaxLength: streamNamingMaxLength,
+		Reserved: append([]string{}, streamNamingReserved...),
+	}
+	v.pattern = regexp.MustCompile(v.Pattern)
+	return v
+}
+
+// Validate checks the policy, compiles the pattern and normalizes the reserved names.
+func (v *StreamNamingPolicy) Validate() error {
+	if v.Pattern == "" {
+		return errors.New("no pattern")
+	}
+	if pattern, err := regexp.Compile(v.Pattern); err != nil {
+		return errors.Wrapf(err, "compile %v", v.Pattern)
+	} else {
+		v.pattern = pattern
+	}
+
+	if v.MaxLength <= 0 || v.MaxLength > streamNamingMaxLengthLimit {
+		return errors.Errorf("invalid max length %v, should in (0, %v]", v.MaxLength, streamNamingMaxLengthLimit)
+	}
+
+	reserved := make(map[string]bool)
+	for _, name := range v.Reserved {
+		if name = strings.ToLower(strings.TrimSpace(name)); name != "" {
+			reserved[name] = true
+		}
+	}
+	v.Reserved = make([]string, 0, len(reserved))
+	for name := range reserved {
+		v.Reserved = append(v.Reserved, name)
+	}
+	sort.Strings(v.Reserved)
+	return nil
+}
+
+// Check returns the error if the stream name violates the policy, without the exceptions.
+func (v *StreamNamingPolicy) Check(stream string) error {
+	if stream == "" {
+		return errors.New("empty stream name")
+	}
+	if n := utf8.RuneCountInString(stream); n > v.MaxLength {
+		return errors.Errorf("stream name %v is %v characters, exceeds %v", stream, n, v.MaxLength)
+	}
+	if !v.pattern.MatchString(stream) {
+		return errors.Errorf("stream name %v does not match %v", stream, v.Pattern)
+	}
+	if slicesContains(v.Reserved, strings.ToLower(stream)) {
+		return errors.Errorf("stream name %v is reserved", stream)
+	}
+	return nil
+}
+
+// StreamNameException is a stream name violating the policy, but grandfathered because it's already in use.
+type StreamNameException struct {
+	// The stream name.
+	Stream string `json:"stream"`
+	// Where the name is found, for example, stream-key or forward.
+	Source string `json:"source"`
+	// The time when grandfathered.
+	Update string `json:"update"`
+}
+
+// queryStreamNamingPolicy returns the policy, or the default one if not configured.
+func queryStreamNamingPolicy(ctx context.Context) (*StreamNamingPolicy, error) {
+	value, err := rdb.HGet(ctx, SRS_STREAM_NAMING, "policy").Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v policy", SRS_STREAM_NAMING)
+	}
+	if value == "" {
+		return newStreamNamingPolicy(), nil
+	}
+
+	policy := &StreamNamingPolicy{}
+	if err := json.Unmarshal([]byte(value), policy); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", value)
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "validate %v", policy.String())
+	}
+	return policy, nil
+}
+
+// queryStreamNameExceptions returns the grandfathered names, sorted by stream name.
+func queryStreamNameExceptions(ctx context.Context) ([]*StreamNameException, error) {
+	values, err := rdb.HGetAll(ctx, SRS_STREAM_NAMING_EXCEPTIONS).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_NAMING_EXCEPTIONS)
+	}
+
+	exceptions := []*StreamNameException{}
+	for stream, value := range values {
+		exception := &StreamNameException{}
+		if err := json.Unmarshal([]byte(value), exception); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", stream, value)
+		}
+		exceptions = append(exceptions, exception)
+	}
+	sort.Slice(exceptions, func(i, j int) bool {
+		return exceptions[i].Stream < exceptions[j].Stream
+	})
+	return exceptions, nil
+}
+
+// verifyStreamName verifies the stream name by the policy, unless it's grandfathered. It's used by the publish hook,
+// and all APIs which accept a stream name.
+func verifyStreamName(ctx context.Context, stream string) error {
+	policy, err := queryStreamNamingPolicy(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query policy")
+	}
+
+	r0 := policy.Check(stream)
+	if r0 == nil {
+		return nil
+	}
+
+	if exists, err := rdb.HExists(ctx, SRS_STREAM_NAMING_EXCEPTIONS, stream).Result(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hexists %v %v", SRS_STREAM_NAMING_EXCEPTIONS, stream)
+	} else if exists {
+		return nil
+	}
+	return newHttpCodeError(http.StatusBadRequest, SrsStackErrorStreamName, r0)
+}
+
+// streamNameOf returns the stream name of stream URL, for example, livestream of live/livestream.
+func streamNameOf(streamURL string) string {
+	return streamURL[strings.LastIndex(streamURL, "/")+1:]
+}
+
+// localStreamName returns the stream name if the target of server and secret is this Oryx, for example, the vLive
+// publishes to rtmp://localhost/live and livestream, or empty for other targets, whose names are not ours.
+func localStreamName(server, secret string) string {
+	outputServer := server
+	if !strings.HasSuffix(outputServer, "/") && !strings.HasPrefix(secret, "/") && secret != "" {
+		outputServer += "/"
+	}
+
+	u, err := RebuildStreamURL(fmt.Sprintf("%v%v", outputServer, secret))
+	if err != nil {
+		return ""
+	}
+	if host := u.Hostname(); host != "localhost" && host != "127.0.0.1" && host != "::1" {
+		return ""
+	}
+	return streamNameOf(strings.TrimSuffix(u.Path, "/"))
+}
+
+// collectStreamNames returns the stream names in use, the value is where the name is found.
+func collectStreamNames(ctx context.Context) (map[string]string, error) {
+	names := make(map[string]string)
+	collect := func(stream, source string) {
+		if _, ok := names[stream]; !ok && stream != "" {
+			names[stream] = source
+		}
+	}
+
+	// The publish keys of streams.
+	keys, err := queryStreamKeys(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query keys")
+	}
+	for _, key := range keys {
+		collect(key.Stream, "stream-key")
+	}
+
+	// The active streams.
+	if values, err := rdb.HKeys(ctx, SRS_STREAM_ACTIVE).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hkeys %v", SRS_STREAM_ACTIVE)
+	} else {
+		for _, streamURL := range values {
+			collect(streamNameOf(streamURL), "active")
+		}
+	}
+
+	// The HLS profiles and relays, the field is the stream URL.
+	for key, source := range map[string]string{SRS_HLS_PROFILE: "hls-profile", SRS_RELAY_CONFIG: "relay"} {
+		if values, err := rdb.HKeys(ctx, key).Result(); err != nil && err != redis.Nil {
+			return nil, errors.Wrapf(err, "hkeys %v", key)
+		} else {
+			for _, streamURL := range values {
+				collect(streamNameOf(streamURL), source)
+			}
+		}
+	}
+
+	// The retention policies of streams, the field is stream:app/stream.
+	if values, err := rdb.HKeys(ctx, SRS_RECORD_RETENTION).Result(); err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hkeys %v", SRS_RECORD_RETENTION)
+	} else {
+		for _, key := range values {
+			if strings.HasPrefix(key, "stream:") {
+				collect(streamNameOf(key), "record-retention")
+			}
+		}
+	}
+
+	// The forward source streams, and the schedules.
+	for key, source := range map[string]string{SRS_FORWARD_CONFIG: "forward", SRS_STREAM_SCHEDULE: "schedule"} {
+		values, err := rdb.HGetAll(ctx, key).Result()
+		if err != nil && err != redis.Nil {
+			return nil, errors.Wrapf(err, "hgetall %v", key)
+		}
+		for field, value := range values {
+			var obj struct {
+				Stream string `json:"stream"`
+			}
+			if err := json.Unmarshal([]byte(value), &obj); err != nil {
+				return nil, errors.Wrapf(err, "unmarshal %v %v %v", key, field, value)
+			}
+			collect(obj.Stream, source)
+		}
+	}
+
+	return names, nil
+}
+
+// grandfatherStreamNames records the names in use violating the policy as exceptions, so they still work after the
+// policy is introduced or changed. Returns the number of new exceptions.
+func grandfatherStreamNames(ctx context.Context, policy *StreamNamingPolicy) (int, error) {
+	names, err := collectStreamNames(ctx)
+	if err != nil {
+		return 0, errors.Wrapf(err, "collect names")
+	}
+
+	var values []interface{}
+	for stream, source := range names {
+		if err := policy.Check(stream); err == nil {
+			continue
+		}
+
+		if exists, err := rdb.HExists(ctx, SRS_STREAM_NAMING_EXCEPTIONS, stream).Result(); err != nil && err != redis.Nil {
+			return 0, errors.Wrapf(err, "hexists %v %v", SRS_STREAM_NAMING_EXCEPTIONS, stream)
+		} else if exists {
+			continue
+		}
+
+		exception := &StreamNameException{Stream: stream, Source: source, Update: time.Now().Format(time.RFC3339)}
+		if b, err := json.Marshal(exception); err != nil {
+			return 0, errors.Wrapf(err, "marshal %v", stream)
+		} else {
+			values = append(values, stream, string(b))
+		}
+		logger.Tf(ctx, "stream naming: grandfather stream=%v, source=%v", stream, source)
+	}
+
+	if len(values) > 0 {
+		if err := rdb.HSet(ctx, SRS_STREAM_NAMING_EXCEPTIONS, values...).Err(); err != nil && err != redis.Nil {
+			return 0, errors.Wrapf(err, "hset %v %v exceptions", SRS_STREAM_NAMING_EXCEPTIONS, len(values)/2)
+		}
+	}
+	return len(values) / 2, nil
+}
+
+func handleMgmtStreamNaming(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/streams/naming/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			policy, err := queryStreamNamingPolicy(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query policy")
+			}
+
+			exceptions, err := queryStreamNameExceptions(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query exceptions")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Policy     *StreamNamingPolicy    `json:"policy"`
+				Exceptions []*StreamNameException `json:"exceptions"`
+			}{
+				Policy: policy, Exceptions: exceptions,
+			})
+			logger.Tf(ctx, "stream naming query ok, %v, exceptions=%v, token=%vB",
+				policy.String(), len(exceptions), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/streams/naming/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			policy := newStreamNamingPolicy()
+			if err := ParseBody(ctx, r, &struct {
+				Token     *string   `json:"token"`
+				Pattern   *string   `json:"pattern"`
+				MaxLength *int      `json:"maxLength"`
+				Reserved  *[]string `json:"reserved"`
+			}{
+				Token: &token, Pattern: &policy.Pattern, MaxLength: &policy.MaxLength, Reserved: &policy.Reserved,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if err := policy.Validate(); err != nil {
+				return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "validate %v", policy.String()))
+			}
+			policy.Update = time.Now().Format(time.RFC3339)
+
+			// Grandfather the names in use before the policy is applied, so they never break.
+			grandfathered, err := grandfatherStreamNames(ctx, policy)
+			if err != nil {
+				return errors.Wrapf(err, "grandfather names")
+			}
+
+			if b, err := json.Marshal(policy); err != nil {
+				return errors.Wrapf(err, "marshal %v", policy.String())
+			} else if err = rdb.HSet(ctx, SRS_STREAM_NAMING, "policy", string(b)).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hset %v policy %v", SRS_STREAM_NAMING, string(b))
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Policy        *StreamNamingPolicy `json:"policy"`
+				Grandfathered int                 `json:"grandfathered"`
+			}{
+				Policy: policy, Grandfathered: grandfathered,
+			})
+			logger.Tf(ctx, "stream naming update ok, %v, grandfathered=%v, token=%vB",
+				policy.String(), grandfathered, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,403 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The directory to store the snapshot of live streams.
+var dirSnapshotPath = "containers/data/snapshot"
+
+// The interval to probe each stream, no matter how many clients ask for the preview.
+const streamPreviewInterval = 5 * time.Second
+
+// The timeout for each probe of stream, including snapshot and ffprobe.
+const streamPreviewTimeout = 10 * time.Second
+
+var streamPreviewer *StreamPreviewer
+
+// StreamPreviewer probes the live streams for operators, with the result cached for each stream.
+type StreamPreviewer struct {
+	// The previews of streams, key is stream URL, value is *StreamPreview.
+	previews sync.Map
+}
+
+func NewStreamPreviewer() *StreamPreviewer {
+	return &StreamPreviewer{}
+}
+
+// StreamPreview is the probe result of a live stream.
+type StreamPreview struct {
+	// The stream URL, for example, /live/livestream.
+	Stream string `json:"stream"`
+	// The URL of latest snapshot image.
+	Snapshot string `json:"snapshot,omitempty"`
+
+	// The video information.
+	VideoCodec string `json:"vcodec,omitempty"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	// The audio information.
+	AudioCodec string `json:"acodec,omitempty"`
+	// The estimated bitrate in kbps, by the packets we probed.
+	Kbps int `json:"kbps"`
+	// The max keyframe interval in seconds, by the packets we probed.
+	GOP float64 `json:"gop"`
+
+	// The estimated HLS latency in seconds, by the timestamp of newest segment and now.
+	HLSLatency float64 `json:"hlsLatency"`
+
+	// Whether the stream looks good, and the reasons if not.
+	Healthy bool     `json:"healthy"`
+	Reasons []string `json:"reasons,omitempty"`
+
+	// The time we probe the stream.
+	Update string `json:"update"`
+
+	// The uuid of snapshot file, which is unguessable so we're able to serve the image without token.
+	snapshotID string
+	// The time we probe the stream, to limit the probe interval.
+	updated time.Time
+	// To make sure only one probe for each stream.
+	lock sync.Mutex
+}
+
+func (v *StreamPreview) String() string {
+	return fmt.Sprintf("stream=%v, video=%v %vx%v, audio=%v, kbps=%v, gop=%v, hls=%v, healthy=%v, reasons=%v",
+		v.Stream, v.VideoCodec, v.Width, v.Height, v.AudioCodec, v.Kbps, v.GOP, v.HLSLatency,
+		v.Healthy, strings.Join(v.Reasons, ","),
+	)
+}
+
+// Query returns the preview of stream, probe it if expired. Note that concurrent clients for the same
+// stream will wait for the same probe.
+func (v *StreamPreviewer) Query(ctx context.Context, stream *SrsStream) (*StreamPreview, error) {
+	streamURL := stream.StreamURL()
+	obj, _ := v.previews.LoadOrStore(streamURL, &StreamPreview{
+		Stream: streamURL, snapshotID: uuid.NewString(),
+	})
+	preview := obj.(*StreamPreview)
+
+	preview.lock.Lock()
+	defer preview.lock.Unlock()
+
+	if time.Since(preview.updated) < streamPreviewInterval {
+		return preview.copy(), nil
+	}
+
+	if err := preview.probe(ctx, stream); err != nil {
+		return nil, errors.Wrapf(err, "probe %v", streamURL)
+	}
+	return preview.copy(), nil
+}
+
+// Cached returns the latest preview of stream without probing, nil if never probed.
+func (v *StreamPreviewer) Cached(streamURL string) *StreamPreview {
+	obj, ok := v.previews.Load(streamURL)
+	if !ok {
+		return nil
+	}
+
+	preview := obj.(*StreamPreview)
+	preview.lock.Lock()
+	defer preview.lock.Unlock()
+
+	if preview.updated.IsZero() {
+		return nil
+	}
+	return preview.copy()
+}
+
+// Snapshot returns the snapshot file of preview by uuid.
+func (v *StreamPreviewer) Snapshot(snapshotID string) string {
+	var filename string
+	v.previews.Range(func(key, value interface{}) bool {
+		if preview := value.(*StreamPreview); preview.snapshotID == snapshotID {
+			filename = preview.snapshotFile()
+			return false
+		}
+		return true
+	})
+	return filename
+}
+
+func (v *StreamPreview) snapshotFile() string {
+	return path.Join(dirSnapshotPath, fmt.Sprintf("%v.jpg", v.snapshotID))
+}
+
+func (v *StreamPreview) copy() *StreamPreview {
+	return &StreamPreview{
+		Stream: v.Stream, Snapshot: v.Snapshot, VideoCodec: v.VideoCodec, Width: v.Width, Height: v.Height,
+		AudioCodec: v.AudioCodec, Kbps: v.Kbps, GOP: v.GOP, HLSLatency: v.HLSLatency,
+		Healthy: v.Healthy, Reasons: append([]string{}, v.Reasons...), Update: v.Update,
+	}
+}
+
+func (v *StreamPreview) probe(ctx context.Context, stream *SrsStream) error {
+	ctx, cancel := context.WithTimeout(ctx, streamPreviewTimeout)
+	defer cancel()
+
+	if err := os.MkdirAll(dirSnapshotPath, 0755); err != nil {
+		return errors.Wrapf(err, "mkdir %v", dirSnapshotPath)
+	}
+
+	inputURL := fmt.Sprintf("rtmp://localhost/%v/%v", stream.App, stream.Stream)
+
+	// Take the snapshot and probe the packets in parallel, to make it faster.
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	var snapshotErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		tmpFile := path.Join(dirSnapshotPath, fmt.Sprintf("%v.tmp.jpg", v.snapshotID))
+		args := []string{"-y", "-i", inputURL, "-frames:v", "1", "-q:v", "5", tmpFile}
+		if b, err := exec.CommandContext(ctx, "ffmpeg", args...).CombinedOutput(); err != nil {
+			snapshotErr = errors.Wrapf(err, "snapshot %v, %v", inputURL, lastLineOf(string(b)))
+		} else if err := os.Rename(tmpFile, v.snapshotFile()); err != nil {
+			snapshotErr = errors.Wrapf(err, "rename %v to %v", tmpFile, v.snapshotFile())
+		}
+	}()
+
+	// Probe the streams and packets for some seconds, to calculate the bitrate and keyframe interval.
+	args := []string{
+		"-v", "quiet", "-print_format", "json", "-read_intervals", "%+5",
+		"-show_streams", "-show_entries", "packet=codec_type,pts_time,size,flags", "-i", inputURL,
+	}
+	stdout, err := exec.CommandContext(ctx, "ffprobe", args...).Output()
+	if err != nil {
+		return errors.Wrapf(err, "ffprobe %v", inputURL)
+	}
+
+	res := struct {
+		Streams []struct {
+			CodecType string `json:"codec_type"`
+			CodecName string `json:"codec_name"`
+			Width     int    `json:"width"`
+			Height    int    `json:"height"`
+		} `json:"streams"`
+		Packets []struct {
+			CodecType string `json:"codec_type"`
+			PTS       string `json:"pts_time"`
+			Size      string `json:"size"`
+			Flags     string `json:"flags"`
+		} `json:"packets"`
+	}{}
+	if err := json.Unmarshal(stdout, &res); err != nil {
+		return errors.Wrapf(err, "unmarshal %v", string(stdout))
+	}
+
+	v.VideoCodec, v.Width, v.Height, v.AudioCodec = "", 0, 0, ""
+	for _, s := range res.Streams {
+		if s.CodecType == "video" && v.VideoCodec == "" {
+			v.VideoCodec, v.Width, v.Height = s.CodecName, s.Width, s.Height
+		} else if s.CodecType == "audio" && v.AudioCodec == "" {
+			v.AudioCodec = s.CodecName
+		}
+	}
+
+	var totalBytes int
+	var firstPTS, lastPTS, lastKeyframe float64 = -1, 0, -1
+	v.GOP = 0
+	for _, p := range res.Packets {
+		pts, err := strconv.ParseFloat(p.PTS, 64)
+		if err != nil {
+			continue
+		}
+		if size, err := strconv.Atoi(p.Size); err == nil {
+			totalBytes += size
+		}
+		if firstPTS < 0 {
+			firstPTS = pts
+		}
+		lastPTS = pts
+
+		if p.CodecType == "video" && strings.Contains(p.Flags, "K") {
+			if lastKeyframe >= 0 && pts-lastKeyframe > v.GOP {
+				v.GOP = pts - lastKeyframe
+			}
+			lastKeyframe = pts
+		}
+	}
+	if duration := lastPTS - firstPTS; duration > 0 {
+		v.Kbps = int(float64(totalBytes*8) / duration / 1000)
+	}
+
+	// Estimate the HLS latency by the newest segment of m3u8.
+	v.HLSLatency = 0
+	m3u8File := path.Join(conf.Pwd, "containers/objs/nginx/html", stream.App, fmt.Sprintf("%v.m3u8", stream.Stream))
+	if segment, err := newestHLSSegment(m3u8File); err != nil {
+		logger.Wf(ctx, "preview ignore hls of %v, err %v", m3u8File, err)
+	} else if info, err := os.Stat(path.Join(path.Dir(m3u8File), segment)); err == nil {
+		v.HLSLatency = float64(time.Since(info.ModTime())/time.Millisecond) / 1000
+	}
+
+	// Wait for snapshot, so the image is ready.
+	wg.Wait()
+	v.Snapshot = ""
+	if snapshotErr != nil {
+		logger.Wf(ctx, "preview ignore snapshot of %v, err %v", inputURL, snapshotErr)
+	} else {
+		v.Snapshot = fmt.Sprintf("/terraform/v1/mgmt/streams/snapshot/%v.jpg", v.snapshotID)
+	}
+
+	v.Healthy, v.Reasons = true, nil
+	if v.VideoCodec == "" {
+		v.Reasons = append(v.Reasons, "no video")
+	}
+	if v.AudioCodec == "" {
+		v.Reasons = append(v.Reasons, "no audio")
+	}
+	if v.VideoCodec != "" && lastKeyframe < 0 {
+		v.Reasons = append(v.Reasons, "no keyframe")
+	} else if v.GOP > 10 {
+		v.Reasons = append(v.Reasons, fmt.Sprintf("keyframe interval %.1fs too large", v.GOP))
+	}
+	v.Healthy = len(v.Reasons) == 0
+
+	v.updated = time.Now()
+	v.Update = v.updated.Format(time.RFC3339)
+	logger.Tf(ctx, "preview probe ok, %v", v.String())
+	return nil
+}
+
+// newestHLSSegment returns the last segment in the m3u8 file.
+func newestHLSSegment(m3u8File string) (string, error) {
+	f, err := os.Open(m3u8File)
+	if err != nil {
+		return "", errors.Wrapf(err, "open %v", m3u8File)
+	}
+	defer f.Close()
+
+	var segment string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			segment = line
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", errors.Wrapf(err, "scan %v", m3u8File)
+	}
+
+	if segment == "" {
+		return "", errors.Errorf("no segment in %v", m3u8File)
+	}
+	// Remove the query string, for example, the hls_ctx.
+	if index := strings.Index(segment, "?"); index >= 0 {
+		segment = segment[:index]
+	}
+	return segment, nil
+}
+
+// lastLineOf returns the last line of output, which is generally the error of FFmpeg.
+func lastLineOf(s string) string {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	return lines[len(lines)-1]
+}
+
+func handleMgmtStreamsPreview(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/streams/preview"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var vhost, app, stream string
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Vhost  *string `json:"vhost"`
+				App    *string `json:"app"`
+				Stream *string `json:"stream"`
+			}{
+				Token: &token, Vhost: &vhost, App: &app, Stream: &stream,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if app == "" {
+				return errors.New("no app")
+			}
+			if stream == "" {
+				return errors.New("no stream")
+			}
+
+			streamObject := &SrsStream{Vhost: vhost, App: app, Stream: stream}
+			streamURL := streamObject.StreamURL()
+			if target, err := rdb.HGet(ctx, SRS_STREAM_ACTIVE, streamURL).Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hget %v %v", SRS_STREAM_ACTIVE, streamURL)
+			} else if target == "" {
+				return errors.Errorf("stream not found %v", streamURL)
+			} else if err := json.Unmarshal([]byte(target), &streamObject); err != nil {
+				return errors.Wrapf(err, "unmarshal %v", target)
+			}
+
+			preview, err := streamPreviewer.Query(ctx, streamObject)
+			if err != nil {
+				return errors.Wrapf(err, "preview %v", streamURL)
+			}
+
+			httpWriteData(ctx, w, r, preview)
+			logger.Tf(ctx, "preview stream ok, %v, token=%vB", preview.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	// The snapshot is identified by an unguessable uuid, so it's served without token, for img tag.
+	ep = "/terraform/v1/mgmt/streams/snapshot/"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			filename := path.Base(r.URL.Path)
+			if !strings.HasSuffix(filename, ".jpg") {
+				return errors.Errorf("invalid snapshot %v", r.URL.Path)
+			}
+
+			snapshotFile := streamPreviewer.Snapshot(strings.TrimSuffix(filename, ".jpg"))
+			if snapshotFile == "" {
+				return errors.Errorf("snapshot not found %v", r.URL.Path)
+			}
+
+			w.Header().Set("Cache-Control", "no-cache")
+			http.ServeFile(w, r, snapshotFile)
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
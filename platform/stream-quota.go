@@ -0,0 +1,473 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The interval to check the publishing streams against the quotas.
+const streamQuotaInterval = 5 * time.Second
+
+// The default duration the bitrate is allowed to exceed the limit, before kicking off the publisher.
+const streamQuotaDefaultGrace = 30 * time.Second
+
+// The max grace in seconds, to avoid a quota never enforced.
+const streamQuotaMaxGrace = 3600
+
+// The max number of events of violations.
+const streamQuotaMaxEvents = 1000
+
+var streamQuotaWorker *StreamQuotaWorker
+
+// StreamQuota is the limits of a publish key, see StreamKey. Zero means no limit.
+type StreamQuota struct {
+	// The max ingest bitrate in kbps, the average of 30s by SRS.
+	MaxKbps int `json:"maxKbps,omitempty"`
+	// The max duration of a publish session, in seconds.
+	MaxDuration int `json:"maxDuration,omitempty"`
+	// The max number of simultaneous publishes, for the key shared by devices, for example, publish to different
+	// apps by the same stream name.
+	MaxPublishes int `json:"maxPublishes,omitempty"`
+	// The seconds the bitrate is allowed to exceed the limit, default to streamQuotaDefaultGrace.
+	Grace int `json:"grace,omitempty"`
+	// Whether to notify the violation by callback, see SrsActionOnQuota.
+	Notify bool `json:"notify,omitempty"`
+}
+
+func (v *StreamQuota) String() string {
+	return fmt.Sprintf("maxKbps=%v, maxDuration=%v, maxPublishes=%v, grace=%v, notify=%v",
+		v.MaxKbps, v.MaxDuration, v.MaxPublishes, v.Grace, v.Notify,
+	)
+}
+
+// Empty returns whether no limit at all.
+func (v *StreamQuota) Empty() bool {
+	return v.MaxKbps <= 0 && v.MaxDuration <= 0 && v.MaxPublishes <= 0
+}
+
+func (v *StreamQuota) Validate() error {
+	if v.MaxKbps < 0 || v.MaxDuration < 0 || v.MaxPublishes < 0 || v.Grace < 0 {
+		return errors.Errorf("negative quota %v", v.String())
+	}
+	if v.Grace > streamQuotaMaxGrace {
+		return errors.Errorf("grace %v exceeds %v", v.Grace, streamQuotaMaxGrace)
+	}
+	return nil
+}
+
+// grace returns the duration the bitrate is allowed to exceed the limit.
+func (v *StreamQuota) grace() time.Duration {
+	if v.Grace <= 0 {
+		return streamQuotaDefaultGrace
+	}
+	return time.Duration(v.Grace) * time.Second
+}
+
+// StreamQuotaViolation is the limit violated by publisher.
+type StreamQuotaViolation string
+
+const (
+	StreamQuotaViolationBitrate   StreamQuotaViolation = "bitrate"
+	StreamQuotaViolationDuration  StreamQuotaViolation = "duration"
+	StreamQuotaViolationPublishes StreamQuotaViolation = "publishes"
+)
+
+// StreamQuotaEvent is a violation of quota, the publisher is kicked off, or rejected for too many publishes.
+type StreamQuotaEvent struct {
+	// The time in RFC3339.
+	Time string `json:"time"`
+	// The stream name of key, and the stream URL, for example, livestream and live/livestream.
+	Key    string `json:"key"`
+	Stream string `json:"stream"`
+	// The SRS client ID of publisher.
+	Client string `json:"client,omitempty"`
+	// The limit violated, and the value of limit and publisher.
+	Violation StreamQuotaViolation `json:"violation"`
+	Limit     int                  `json:"limit"`
+	Value     int                  `json:"value"`
+}
+
+func (v *StreamQuotaEvent) String() string {
+	return fmt.Sprintf("key=%v, stream=%v, client=%v, violation=%v, limit=%v, value=%v",
+		v.Key, v.Stream, v.Client, v.Violation, v.Limit, v.Value,
+	)
+}
+
+// queryStreamQuotas returns all quotas, key is the stream name.
+func queryStreamQuotas(ctx context.Context) (map[string]*StreamQuota, error) {
+	values, err := rdb.HGetAll(ctx, SRS_STREAM_QUOTA).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_QUOTA)
+	}
+
+	quotas := make(map[string]*StreamQuota)
+	for stream, value := range values {
+		var quota StreamQuota
+		if err := json.Unmarshal([]byte(value), &quota); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", stream, value)
+		}
+		quotas[stream] = &quota
+	}
+	return quotas, nil
+}
+
+// saveStreamQuota saves the quota of stream, or removes it if nil or empty.
+func saveStreamQuota(ctx context.Context, stream string, quota *StreamQuota) error {
+	if quota == nil || quota.Empty() {
+		if err := rdb.HDel(ctx, SRS_STREAM_QUOTA, stream).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "hdel %v %v", SRS_STREAM_QUOTA, stream)
+		}
+		return nil
+	}
+
+	if err := quota.Validate(); err != nil {
+		return errors.Wrapf(err, "validate")
+	}
+
+	if b, err := json.Marshal(quota); err != nil {
+		return errors.Wrapf(err, "marshal %v", quota.String())
+	} else if err := rdb.HSet(ctx, SRS_STREAM_QUOTA, stream, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_STREAM_QUOTA, stream, string(b))
+	}
+	return nil
+}
+
+// recordStreamQuotaEvent saves the event, and notify by callback if required. It never fails, because the event is
+// only for troubleshooting.
+func recordStreamQuotaEvent(ctx context.Context, quota *StreamQuota, event *StreamQuotaEvent) {
+	if event.Time == "" {
+		event.Time = time.Now().Format(time.RFC3339)
+	}
+
+	if b, err := json.Marshal(event); err != nil {
+		logger.Wf(ctx, "quota: ignore marshal %v err %+v", event.String(), err)
+	} else if err := bufferedRedisWrite(ctx, "stream quota", func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.LPush(ctx, SRS_STREAM_QUOTA_EVENTS, string(b))
+		pipe.LTrim(ctx, SRS_STREAM_QUOTA_EVENTS, 0, streamQuotaMaxEvents-1)
+	}); err != nil {
+		logger.Wf(ctx, "quota: ignore save %v err %+v", event.String(), err)
+	}
+
+	// Notify by callback in background, never block the hooks or worker.
+	if quota.Notify && callbackWorker != nil {
+		go safe(ctx, func() {
+			ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 30*time.Second)
+			defer cancel()
+
+			if err := callbackWorker.OnQuotaMessage(ctx, SrsActionOnQuota, event); err != nil {
+				logger.Wf(ctx, "quota: ignore callback %v err %+v", event.String(), err)
+			}
+		})
+	}
+
+	logger.Tf(ctx, "quota: violation %v", event.String())
+}
+
+// queryStreamQuotaEvents returns the events of violations, the latest first.
+func queryStreamQuotaEvents(ctx context.Context, max int) ([]*StreamQuotaEvent, error) {
+	events := []*StreamQuotaEvent{}
+	if err := rangeRedisList(ctx, SRS_STREAM_QUOTA_EVENTS, max, func(value string) error {
+		var event StreamQuotaEvent
+		if err := json.Unmarshal([]byte(value), &event); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", value)
+		}
+		events = append(events, &event)
+		return nil
+	}); err != nil {
+		return nil, errors.Wrapf(err, "range %v", SRS_STREAM_QUOTA_EVENTS)
+	}
+	return events, nil
+}
+
+// verifyStreamQuota returns error if the key of stream exceeds the max number of simultaneous publishes.
+func verifyStreamQuota(ctx context.Context, stream *SrsStream) error {
+	value, err := rdb.HGet(ctx, SRS_STREAM_QUOTA, stream.Stream).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hget %v %v", SRS_STREAM_QUOTA, stream.Stream)
+	} else if value == "" {
+		return nil
+	}
+
+	var quota StreamQuota
+	if err := json.Unmarshal([]byte(value), &quota); err != nil {
+		return errors.Wrapf(err, "unmarshal %v", value)
+	}
+	if quota.MaxPublishes <= 0 {
+		return nil
+	}
+
+	streams, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
+	}
+
+	// Count the other publishes using the same key, ignore the stream itself, for example, SRS retries the hook.
+	var publishes int
+	streamURL := stream.StreamURL()
+	for activeURL, value := range streams {
+		var active SrsStream
+		if err := json.Unmarshal([]byte(value), &active); err != nil {
+			return errors.Wrapf(err, "unmarshal %v %v", activeURL, value)
+		}
+		if active.Stream == stream.Stream && activeURL != streamURL {
+			publishes++
+		}
+	}
+
+	if publishes < quota.MaxPublishes {
+		return nil
+	}
+
+	recordStreamQuotaEvent(ctx, &quota, &StreamQuotaEvent{
+		Key: stream.Stream, Stream: streamURL, Client: stream.Client,
+		Violation: StreamQuotaViolationPublishes, Limit: quota.MaxPublishes, Value: publishes + 1,
+	})
+	return errors.Errorf("stream %v exceeds %v publishes", stream.Stream, quota.MaxPublishes)
+}
+
+// streamQuotaExceeded is the state of publisher whose bitrate exceeds the limit.
+type streamQuotaExceeded struct {
+	// The time of first sample exceeded.
+	since time.Time
+	// The number of samples exceeded.
+	samples int
+}
+
+// StreamQuotaWorker kicks off the publishers, which exceed the bitrate or duration of quota.
+type StreamQuotaWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// The publishers whose bitrate exceeds the limit, key is the stream URL and client.
+	exceeded map[string]*streamQuotaExceeded
+	// For test to overwrite the kickoff.
+	kickoff func(ctx context.Context, stream *SrsStream) (int, error)
+}
+
+func NewStreamQuotaWorker() *StreamQuotaWorker {
+	return &StreamQuotaWorker{
+		exceeded: make(map[string]*streamQuotaExceeded), kickoff: kickoffStream,
+	}
+}
+
+func (v *StreamQuotaWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *StreamQuotaWorker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "quota: start a worker")
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		safeRestart(ctx, func() {
+			for ctx.Err() == nil {
+				// Never kick off by bitrate if SRS stats is not available, but the duration is still enforced.
+				stats, err := srsExporter.Query(ctx)
+				if err != nil {
+					logThrottle.Wf(ctx, "quota query stats", "quota: ignore stats err %+v", err)
+					stats = nil
+				}
+
+				if err := v.enforce(ctx, stats, time.Now()); err != nil {
+					logger.Wf(ctx, "quota: ignore err %+v", err)
+				}
+
+				select {
+				case <-ctx.Done():
+				case <-time.After(streamQuotaInterval):
+				}
+			}
+		})
+	}()
+
+	return nil
+}
+
+// enforce kicks off the publishing streams which exceed the quota. The stats is nil if SRS is not available, then
+// the bitrate state is kept, so a missing sample never kicks off or resets the publisher.
+func (v *StreamQuotaWorker) enforce(ctx context.Context, stats *SrsExporterStats, now time.Time) error {
+	quotas, err := queryStreamQuotas(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query quotas")
+	}
+
+	streams, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
+	}
+
+	bitrates := make(map[string]int)
+	if stats != nil {
+		for _, s := range stats.Streams {
+			if s.Active {
+				bitrates[s.Stream] = s.RecvKbps
+			}
+		}
+	}
+
+	publishers := make(map[string]bool)
+	for streamURL, value := range streams {
+		var stream SrsStream
+		if err := json.Unmarshal([]byte(value), &stream); err != nil {
+			return errors.Wrapf(err, "unmarshal %v %v", streamURL, value)
+		}
+
+		quota := quotas[stream.Stream]
+		if quota == nil {
+			continue
+		}
+
+		publisher := fmt.Sprintf("%v %v", streamURL, stream.Client)
+		publishers[publisher] = true
+
+		var event *StreamQuotaEvent
+		if quota.MaxDuration > 0 {
+			if start, err := time.Parse(time.RFC3339, stream.Update); err == nil {
+				if duration := now.Sub(start); duration > time.Duration(quota.MaxDuration)*time.Second {
+					event = &StreamQuotaEvent{
+						Violation: StreamQuotaViolationDuration, Limit: quota.MaxDuration, Value: int(duration.Seconds()),
+					}
+				}
+			}
+		}
+
+		if kbps, ok := bitrates[fmt.Sprintf("%v/%v", stream.App, stream.Stream)]; event == nil && quota.MaxKbps > 0 && ok {
+			if kbps <= quota.MaxKbps {
+				delete(v.exceeded, publisher)
+			} else if exceeded := v.exceeded[publisher]; exceeded == nil {
+				v.exceeded[publisher] = &streamQuotaExceeded{since: now, samples: 1}
+			} else if exceeded.samples++; exceeded.samples > 1 && now.Sub(exceeded.since) >= quota.grace() {
+				event = &StreamQuotaEvent{
+					Violation: StreamQuotaViolationBitrate, Limit: quota.MaxKbps, Value: kbps,
+				}
+			}
+		}
+
+		if event == nil {
+			continue
+		}
+
+		event.Key, event.Stream, event.Client = stream.Stream, streamURL, stream.Client
+		recordStreamQuotaEvent(ctx, quota, event)
+		delete(v.exceeded, publisher)
+
+		if code, err := v.kickoff(ctx, &stream); err != nil {
+			logger.Wf(ctx, "quota: ignore kickoff %v err %+v", streamURL, err)
+		} else {
+			logger.Tf(ctx, "quota: kickoff %v ok, code=%v, %v", streamURL, code, event.String())
+		}
+	}
+
+	// Remove the state of unpublished publishers.
+	for publisher := range v.exceeded {
+		if !publishers[publisher] {
+			delete(v.exceeded, publisher)
+		}
+	}
+
+	return nil
+}
+
+func handleMgmtStreamQuota(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/streams/keys/quota"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, action, stream string
+			var quota StreamQuota
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string      `json:"token"`
+				Action *string      `json:"action"`
+				Stream *string      `json:"stream"`
+				Quota  *StreamQuota `json:"quota"`
+			}{
+				Token: &token, Action: &action, Stream: &stream, Quota: &quota,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if action == "" {
+				quotas, err := queryStreamQuotas(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "query quotas")
+				}
+
+				events, err := queryStreamQuotaEvents(ctx, 100)
+				if err != nil {
+					return errors.Wrapf(err, "query events")
+				}
+
+				httpWriteData(ctx, w, r, &struct {
+					Quotas map[string]*StreamQuota `json:"quotas"`
+					Events []*StreamQuotaEvent     `json:"events"`
+				}{
+					Quotas: quotas, Events: events,
+				})
+				logger.Tf(ctx, "stream quota query ok, quotas=%v, events=%v, token=%vB", len(quotas), len(events), len(token))
+				return nil
+			}
+
+			if action != "update" && action != "remove" {
+				return newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid action %v", action))
+			}
+			if stream == "" {
+				return newHttpStatusError(http.StatusBadRequest, errors.New("no stream"))
+			}
+
+			// The quota lives with the key, so the key must exist.
+			if secret, err := rdb.HGet(ctx, SRS_AUTH_SECRET, GenerateRoomPublishKey(stream)).Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hget %v %v", SRS_AUTH_SECRET, GenerateRoomPublishKey(stream))
+			} else if secret == "" && action == "update" {
+				return newHttpStatusError(http.StatusNotFound, errors.Errorf("no key of stream %v", stream))
+			}
+
+			if action == "remove" {
+				quota = StreamQuota{}
+			} else if err := quota.Validate(); err != nil {
+				return newHttpStatusError(http.StatusBadRequest, errors.Wrapf(err, "validate"))
+			}
+
+			if err := saveStreamQuota(ctx, stream, &quota); err != nil {
+				return errors.Wrapf(err, "save quota of %v", stream)
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "stream quota %v ok, stream=%v, %v, token=%vB", action, stream, quota.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestStreamQuota_Validate(t *testing.T) {
+	for _, c := range []struct {
+		quota StreamQuota
+		ok    bool
+	}{
+		{StreamQuota{MaxKbps: 3000, MaxDuration: 3600, MaxPublishes: 2, Grace: 60}, true},
+		{StreamQuota{MaxKbps: -1}, false},
+		{StreamQuota{MaxKbps: 3000, Grace: streamQuotaMaxGrace + 1}, false},
+	} {
+		if err := c.quota.Validate(); (err == nil) != c.ok {
+			t.Errorf("Fail for %v, err %+v", c.quota.String(), err)
+		}
+	}
+
+	if q := (&StreamQuota{Notify: true}); !q.Empty() || q.grace() != streamQuotaDefaultGrace {
+		t.Errorf("Fail for %v", q.String())
+	}
+}
+
+func TestStreamQuota_Publishes(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	stream := &SrsStream{Vhost: "__defaultVhost__", App: "live2", Stream: "livestream", Client: "c2"}
+	server.HSet(SRS_STREAM_ACTIVE, "live/livestream", `{"vhost":"__defaultVhost__","app":"live","stream":"livestream","client_id":"c1"}`)
+	if err := verifyStreamQuota(ctx, stream); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+
+	if err := saveStreamQuota(ctx, "livestream", &StreamQuota{MaxPublishes: 1}); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if err := verifyStreamQuota(ctx, stream); err == nil {
+		t.Errorf("Fail for publishes exceeded")
+	}
+	if events, err := queryStreamQuotaEvents(ctx, 10); err != nil || len(events) != 1 ||
+		events[0].Violation != StreamQuotaViolationPublishes || events[0].Stream != "live2/livestream" || events[0].Value != 2 {
+		t.Errorf("Fail for events %v, err %+v", events, err)
+	}
+
+	// The stream itself is not counted, for example, SRS retries the hook.
+	if err := verifyStreamQuota(ctx, &SrsStream{Vhost: "__defaultVhost__", App: "live", Stream: "livestream"}); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+
+	// Remove the quota if empty.
+	if err := saveStreamQuota(ctx, "livestream", &StreamQuota{}); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	} else if _, ok := server.HGet(SRS_STREAM_QUOTA, "livestream"); ok {
+		t.Errorf("Fail for quota not removed")
+	}
+}
+
+func TestStreamQuota_Enforce(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	var kicked []string
+	worker := NewStreamQuotaWorker()
+	worker.kickoff = func(ctx context.Context, stream *SrsStream) (int, error) {
+		kicked = append(kicked, stream.StreamURL())
+		return 0, rdb.HDel(ctx, SRS_STREAM_ACTIVE, stream.StreamURL()).Err()
+	}
+
+	now := time.Now()
+	server.HSet(SRS_STREAM_QUOTA, "bitrate", `{"maxKbps":1000,"grace":10}`)
+	server.HSet(SRS_STREAM_QUOTA, "duration", `{"maxDuration":60}`)
+	server.HSet(SRS_STREAM_ACTIVE, "live/bitrate", `{"vhost":"__defaultVhost__","app":"live","stream":"bitrate","client_id":"c1","update":"`+now.Format(time.RFC3339)+`"}`)
+	server.HSet(SRS_STREAM_ACTIVE, "live/duration", `{"vhost":"__defaultVhost__","app":"live","stream":"duration","client_id":"c2","update":"`+now.Add(-61*time.Second).Format(time.RFC3339)+`"}`)
+	server.HSet(SRS_STREAM_ACTIVE, "live/other", `{"vhost":"__defaultVhost__","app":"live","stream":"other","client_id":"c3","update":"`+now.Add(-time.Hour).Format(time.RFC3339)+`"}`)
+
+	sample := func(kbps int) *SrsExporterStats {
+		return &SrsExporterStats{Streams: []*SrsExporterStream{
+			{Stream: "live/bitrate", Active: true, RecvKbps: kbps},
+			{Stream: "live/other", Active: true, RecvKbps: kbps},
+		}}
+	}
+
+	// Kick off by duration, but not by bitrate in grace.
+	if err := worker.enforce(ctx, sample(2000), now); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	} else if len(kicked) != 1 || kicked[0] != "live/duration" {
+		t.Errorf("Fail for kicked %v", kicked)
+	}
+
+	// Never kick off or reset by missing samples, or the stats is not available.
+	if err := worker.enforce(ctx, nil, now.Add(20*time.Second)); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	} else if err := worker.enforce(ctx, &SrsExporterStats{}, now.Add(25*time.Second)); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	} else if len(kicked) != 1 || worker.exceeded["live/bitrate c1"] == nil {
+		t.Errorf("Fail for kicked %v, exceeded %v", kicked, worker.exceeded)
+	}
+
+	// Reset if the bitrate is below the limit.
+	if err := worker.enforce(ctx, sample(500), now.Add(30*time.Second)); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	} else if len(kicked) != 1 || worker.exceeded["live/bitrate c1"] != nil {
+		t.Errorf("Fail for kicked %v, exceeded %v", kicked, worker.exceeded)
+	}
+
+	// Kick off if exceeded longer than the grace.
+	for i, offset := range []int{35, 40, 45} {
+		if err := worker.enforce(ctx, sample(2000), now.Add(time.Duration(offset)*time.Second)); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		} else if i < 2 && len(kicked) != 1 {
+			t.Errorf("Fail for kicked %v at %vs", kicked, offset)
+		}
+	}
+	if len(kicked) != 2 || kicked[1] != "live/bitrate" || len(worker.exceeded) != 0 {
+		t.Errorf("Fail for kicked %v, exceeded %v", kicked, worker.exceeded)
+	}
+
+	if events, err := queryStreamQuotaEvents(ctx, 10); err != nil || len(events) != 2 ||
+		events[0].Violation != StreamQuotaViolationBitrate || events[0].Value != 2000 || events[0].Client != "c1" ||
+		events[1].Violation != StreamQuotaViolationDuration || events[1].Limit != 60 {
+		t.Errorf("Fail for events %v, err %+v", events, err)
+	}
+}
@@ -0,0 +1,554 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The layout of schedule time, which is the local time in the timezone of schedule.
+const streamScheduleTimeLayout = "2006-01-02T15:04:05"
+
+// The interval to check the publishing streams against the schedules.
+const streamScheduleInterval = 3 * time.Second
+
+var streamScheduler *StreamScheduler
+
+// The recurring rule of schedule.
+type StreamScheduleRecurring string
+
+const (
+	StreamScheduleOnce   StreamScheduleRecurring = ""
+	StreamScheduleDaily  StreamScheduleRecurring = "daily"
+	StreamScheduleWeekly StreamScheduleRecurring = "weekly"
+)
+
+// StreamSchedule is a publish window of stream. If a stream has any schedule, the publish key only works
+// during the window, and the publisher is kicked off when window ends.
+type StreamSchedule struct {
+	// The schedule UUID.
+	UUID string `json:"uuid"`
+	// The app and stream name, for example, live and livestream.
+	App    string `json:"app"`
+	Stream string `json:"stream"`
+	// The start and end time, in layout streamScheduleTimeLayout, for example, 2024-01-01T20:00:00
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// The IANA timezone, for example, Asia/Shanghai, default to UTC.
+	Timezone string `json:"timezone"`
+	// The recurring rule, empty for once, or daily, or weekly.
+	Recurring StreamScheduleRecurring `json:"recurring"`
+	// The label for this schedule.
+	Label string `json:"label"`
+	// The update time.
+	Update string `json:"update"`
+}
+
+func (v *StreamSchedule) String() string {
+	return fmt.Sprintf("uuid=%v, app=%v, stream=%v, start=%v, end=%v, timezone=%v, recurring=%v, label=%v",
+		v.UUID, v.App, v.Stream, v.Start, v.End, v.Timezone, v.Recurring, v.Label,
+	)
+}
+
+// StreamScheduleWindow is an occurrence of schedule.
+type StreamScheduleWindow struct {
+	// The schedule UUID.
+	UUID string `json:"uuid"`
+	// The app and stream name.
+	App    string `json:"app"`
+	Stream string `json:"stream"`
+	// The start and end time in RFC3339.
+	Start string `json:"start"`
+	End   string `json:"end"`
+	// The label of schedule.
+	Label string `json:"label"`
+}
+
+// period returns the days of recurring, 0 if once.
+func (v *StreamSchedule) period() int {
+	switch v.Recurring {
+	case StreamScheduleDaily:
+		return 1
+	case StreamScheduleWeekly:
+		return 7
+	}
+	return 0
+}
+
+// parse returns the first window of schedule.
+func (v *StreamSchedule) parse() (time.Time, time.Time, error) {
+	timezone := v.Timezone
+	if timezone == "" {
+		timezone = "UTC"
+	}
+
+	loc, err := time.LoadLocation(timezone)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrapf(err, "load timezone %v", timezone)
+	}
+
+	start, err := time.ParseInLocation(streamScheduleTimeLayout, v.Start, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrapf(err, "parse start %v", v.Start)
+	}
+
+	end, err := time.ParseInLocation(streamScheduleTimeLayout, v.End, loc)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.Wrapf(err, "parse end %v", v.End)
+	}
+
+	return start, end, nil
+}
+
+func (v *StreamSchedule) Validate() error {
+	if v.App == "" {
+		return errors.New("no app")
+	}
+	if v.Stream == "" {
+		return errors.New("no stream")
+	}
+	if v.Recurring != StreamScheduleOnce && v.Recurring != StreamScheduleDaily && v.Recurring != StreamScheduleWeekly {
+		return errors.Errorf("invalid recurring %v", v.Recurring)
+	}
+
+	start, end, err := v.parse()
+	if err != nil {
+		return errors.Wrapf(err, "parse")
+	}
+	if !end.After(start) {
+		return errors.Errorf("end %v should after start %v", v.End, v.Start)
+	}
+
+	// The window should be shorter than the period, or it overlaps itself.
+	if days := v.period(); days > 0 && !end.Before(start.AddDate(0, 0, days)) {
+		return errors.Errorf("window %v to %v exceeds %v period", v.Start, v.End, v.Recurring)
+	}
+
+	return nil
+}
+
+// nextWindow returns the first window which is not ended at t, or false if no more window.
+func (v *StreamSchedule) nextWindow(t time.Time) (time.Time, time.Time, bool) {
+	start, end, err := v.parse()
+	if err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+
+	if end.After(t) {
+		return start, end, true
+	}
+
+	days := v.period()
+	if days == 0 {
+		return time.Time{}, time.Time{}, false
+	}
+
+	// Estimate the occurrence, then walk forward, because the day might not be 24h for DST.
+	n := int(t.Sub(end)/(time.Duration(days)*24*time.Hour)) - 1
+	if n < 0 {
+		n = 0
+	}
+	for ; ; n++ {
+		if e := end.AddDate(0, 0, n*days); e.After(t) {
+			return start.AddDate(0, 0, n*days), e, true
+		}
+	}
+}
+
+// Active returns whether t is in a window of schedule.
+func (v *StreamSchedule) Active(t time.Time) bool {
+	start, _, ok := v.nextWindow(t)
+	return ok && !start.After(t)
+}
+
+// windows returns all windows which are not ended at from, and start before to.
+func (v *StreamSchedule) windows(from, to time.Time) [][2]time.Time {
+	var windows [][2]time.Time
+	for t := from; ; {
+		start, end, ok := v.nextWindow(t)
+		if !ok || !start.Before(to) {
+			break
+		}
+		windows = append(windows, [2]time.Time{start, end})
+		t = end
+	}
+	return windows
+}
+
+// Overlaps returns whether any window of the schedules overlaps, for the same stream.
+func (v *StreamSchedule) Overlaps(o *StreamSchedule) bool {
+	if v.App != o.App || v.Stream != o.Stream {
+		return false
+	}
+
+	s0, e0, err := v.parse()
+	if err != nil {
+		return false
+	}
+	s1, e1, err := o.parse()
+	if err != nil {
+		return false
+	}
+
+	// The recurring windows repeat in a week, so two weeks after both started is enough.
+	from, to := s0, e0
+	if s1.Before(from) {
+		from = s1
+	}
+	if e1.After(to) {
+		to = e1
+	}
+	to = to.AddDate(0, 0, 14)
+
+	w0, w1 := v.windows(from, to), o.windows(from, to)
+	for _, a := range w0 {
+		for _, b := range w1 {
+			if a[0].Before(b[1]) && b[0].Before(a[1]) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// queryStreamSchedules loads all schedules from redis.
+func queryStreamSchedules(ctx context.Context) ([]*StreamSchedule, error) {
+	objs, err := rdb.HGetAll(ctx, SRS_STREAM_SCHEDULE).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_SCHEDULE)
+	}
+
+	schedules := []*StreamSchedule{}
+	for id, obj := range objs {
+		var schedule StreamSchedule
+		if err := json.Unmarshal([]byte(obj), &schedule); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", id, obj)
+		}
+		schedules = append(schedules, &schedule)
+	}
+
+	sort.Slice(schedules, func(i, j int) bool {
+		return schedules[i].Start < schedules[j].Start
+	})
+	return schedules, nil
+}
+
+// verifyStreamSchedule returns error if the stream has schedules, but not in any window.
+func verifyStreamSchedule(ctx context.Context, stream *SrsStream, t time.Time) error {
+	schedules, err := queryStreamSchedules(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query schedules")
+	}
+
+	var scheduled bool
+	for _, schedule := range schedules {
+		if schedule.App != stream.App || schedule.Stream != stream.Stream {
+			continue
+		}
+
+		if schedule.Active(t) {
+			return nil
+		}
+		scheduled = true
+	}
+
+	if scheduled {
+		return errors.Errorf("stream %v/%v not in schedule window", stream.App, stream.Stream)
+	}
+	return nil
+}
+
+// queryScheduleWindows returns the current or upcoming window of each schedule, sorted by start time.
+func queryScheduleWindows(ctx context.Context, t time.Time) ([]*StreamScheduleWindow, error) {
+	schedules, err := queryStreamSchedules(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query schedules")
+	}
+
+	windows := []*StreamScheduleWindow{}
+	for _, schedule := range schedules {
+		if start, end, ok := schedule.nextWindow(t); ok {
+			windows = append(windows, &StreamScheduleWindow{
+				UUID: schedule.UUID, App: schedule.App, Stream: schedule.Stream, Label: schedule.Label,
+				Start: start.Format(time.RFC3339), End: end.Format(time.RFC3339),
+			})
+		}
+	}
+
+	sort.Slice(windows, func(i, j int) bool {
+		return windows[i].Start < windows[j].Start
+	})
+	return windows, nil
+}
+
+// saveStreamSchedule validates and saves the schedule, rejects if overlaps with others of the same stream.
+func saveStreamSchedule(ctx context.Context, schedule *StreamSchedule) error {
+	if err := schedule.Validate(); err != nil {
+		return errors.Wrapf(err, "validate")
+	}
+	if err := verifyStreamName(ctx, schedule.Stream); err != nil {
+		return errors.Wrapf(err, "verify stream name")
+	}
+
+	schedules, err := queryStreamSchedules(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query schedules")
+	}
+
+	for _, other := range schedules {
+		if other.UUID != schedule.UUID && schedule.Overlaps(other) {
+			return errors.Errorf("overlaps with schedule %v", other.String())
+		}
+	}
+
+	schedule.Update = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(schedule); err != nil {
+		return errors.Wrapf(err, "marshal %v", schedule.String())
+	} else if err := rdb.HSet(ctx, SRS_STREAM_SCHEDULE, schedule.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_STREAM_SCHEDULE, schedule.UUID, string(b))
+	}
+	return nil
+}
+
+// StreamScheduler kicks off the publishers, when the schedule window of stream ends.
+type StreamScheduler struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewStreamScheduler() *StreamScheduler {
+	return &StreamScheduler{}
+}
+
+func (v *StreamScheduler) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *StreamScheduler) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "schedule: start a worker")
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		safeRestart(ctx, func() {
+			for ctx.Err() == nil {
+				if err := v.kickoffUnscheduled(ctx); err != nil {
+					logger.Wf(ctx, "schedule: ignore err %+v", err)
+				}
+
+				select {
+				case <-ctx.Done():
+				case <-time.After(streamScheduleInterval):
+				}
+			}
+		})
+	}()
+
+	return nil
+}
+
+// kickoffUnscheduled kicks off the publishing streams which are out of schedule windows.
+func (v *StreamScheduler) kickoffUnscheduled(ctx context.Context) error {
+	streams, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
+	}
+
+	for streamURL, value := range streams {
+		var stream SrsStream
+		if err := json.Unmarshal([]byte(value), &stream); err != nil {
+			return errors.Wrapf(err, "unmarshal %v %v", streamURL, value)
+		}
+
+		if err := verifyStreamSchedule(ctx, &stream, time.Now()); err == nil {
+			continue
+		} else {
+			logger.Tf(ctx, "schedule: kickoff %v, %v", streamURL, err.Error())
+		}
+
+		if code, err := kickoffStream(ctx, &stream); err != nil {
+			logger.Wf(ctx, "schedule: ignore kickoff %v err %+v", streamURL, err)
+		} else {
+			logger.Tf(ctx, "schedule: kickoff %v ok, code=%v", streamURL, code)
+		}
+	}
+
+	return nil
+}
+
+func handleMgmtStreamSchedules(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/schedules/create"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var schedule StreamSchedule
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				*StreamSchedule
+			}{
+				Token: &token, StreamSchedule: &schedule,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			schedule.UUID = uuid.NewString()
+			if err := saveStreamSchedule(ctx, &schedule); err != nil {
+				return errors.Wrapf(err, "save %v", schedule.String())
+			}
+
+			httpWriteData(ctx, w, r, &schedule)
+			logger.Tf(ctx, "schedule create ok, %v, token=%vB", schedule.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/schedules/update"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var schedule StreamSchedule
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				*StreamSchedule
+			}{
+				Token: &token, StreamSchedule: &schedule,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if schedule.UUID == "" {
+				return errors.New("no uuid")
+			}
+			if exists, err := rdb.HExists(ctx, SRS_STREAM_SCHEDULE, schedule.UUID).Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hexists %v %v", SRS_STREAM_SCHEDULE, schedule.UUID)
+			} else if !exists {
+				return errors.Errorf("schedule %v not exists", schedule.UUID)
+			}
+
+			if err := saveStreamSchedule(ctx, &schedule); err != nil {
+				return errors.Wrapf(err, "save %v", schedule.String())
+			}
+
+			httpWriteData(ctx, w, r, &schedule)
+			logger.Tf(ctx, "schedule update ok, %v, token=%vB", schedule.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/schedules/remove"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, scheduleUUID string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+			}{
+				Token: &token, UUID: &scheduleUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if scheduleUUID == "" {
+				return errors.New("no uuid")
+			}
+			if err := rdb.HDel(ctx, SRS_STREAM_SCHEDULE, scheduleUUID).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hdel %v %v", SRS_STREAM_SCHEDULE, scheduleUUID)
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "schedule remove ok, uuid=%v, token=%vB", scheduleUUID, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/schedules/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			schedules, err := queryStreamSchedules(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query schedules")
+			}
+
+			httpWriteData(ctx, w, r, schedules)
+			logger.Tf(ctx, "schedule query ok, schedules=%v, token=%vB", len(schedules), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
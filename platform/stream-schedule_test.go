@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreamSchedule_Overlaps(t *testing.T) {
+	newSchedule := func(start, end string, recurring StreamScheduleRecurring) *StreamSchedule {
+		return &StreamSchedule{
+			App: "live", Stream: "livestream", Start: start, End: end, Recurring: recurring,
+			Timezone: "Asia/Shanghai",
+		}
+	}
+
+	for _, e := range []struct {
+		a, b     *StreamSchedule
+		overlaps bool
+	}{
+		{
+			a:        newSchedule("2024-01-01T20:00:00", "2024-01-01T22:00:00", StreamScheduleOnce),
+			b:        newSchedule("2024-01-01T21:00:00", "2024-01-01T23:00:00", StreamScheduleOnce),
+			overlaps: true,
+		},
+		{
+			a:        newSchedule("2024-01-01T20:00:00", "2024-01-01T22:00:00", StreamScheduleOnce),
+			b:        newSchedule("2024-01-01T22:00:00", "2024-01-01T23:00:00", StreamScheduleOnce),
+			overlaps: false,
+		},
+		{
+			a:        newSchedule("2024-01-01T20:00:00", "2024-01-01T22:00:00", StreamScheduleDaily),
+			b:        newSchedule("2024-03-05T21:00:00", "2024-03-05T21:30:00", StreamScheduleOnce),
+			overlaps: true,
+		},
+		{
+			a:        newSchedule("2024-01-01T20:00:00", "2024-01-01T22:00:00", StreamScheduleWeekly),
+			b:        newSchedule("2024-01-02T20:00:00", "2024-01-02T22:00:00", StreamScheduleWeekly),
+			overlaps: false,
+		},
+		{
+			a:        newSchedule("2024-01-01T20:00:00", "2024-01-01T22:00:00", StreamScheduleWeekly),
+			b:        newSchedule("2024-01-03T21:00:00", "2024-01-03T23:00:00", StreamScheduleDaily),
+			overlaps: true,
+		},
+	} {
+		if r0 := e.a.Overlaps(e.b); r0 != e.overlaps {
+			t.Errorf("Fail for %v and %v overlaps=%v, expect %v", e.a.String(), e.b.String(), r0, e.overlaps)
+		}
+		if r0 := e.b.Overlaps(e.a); r0 != e.overlaps {
+			t.Errorf("Fail for %v and %v overlaps=%v, expect %v", e.b.String(), e.a.String(), r0, e.overlaps)
+		}
+	}
+}
+
+func TestStreamSchedule_Active(t *testing.T) {
+	schedule := &StreamSchedule{
+		App: "live", Stream: "livestream", Start: "2024-01-01T20:00:00", End: "2024-01-01T22:00:00",
+		Recurring: StreamScheduleDaily, Timezone: "UTC",
+	}
+	if err := schedule.Validate(); err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+
+	for _, e := range []struct {
+		t      string
+		active bool
+	}{
+		{t: "2023-12-31T21:00:00Z", active: false},
+		{t: "2024-01-01T20:00:00Z", active: true},
+		{t: "2024-01-01T22:00:00Z", active: false},
+		{t: "2024-02-10T21:59:59Z", active: true},
+		{t: "2024-02-10T19:59:59Z", active: false},
+	} {
+		at, _ := time.Parse(time.RFC3339, e.t)
+		if r0 := schedule.Active(at); r0 != e.active {
+			t.Errorf("Fail for %v active=%v, expect %v", e.t, r0, e.active)
+		}
+	}
+
+	// The window should be shorter than the recurring period.
+	schedule.End = "2024-01-02T20:00:00"
+	if err := schedule.Validate(); err == nil {
+		t.Errorf("Fail for window exceeds period should be rejected")
+	}
+}
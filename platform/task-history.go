@@ -0,0 +1,243 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The max number of events for each task.
+const taskHistoryMaxEventsPerTask = 50
+
+// The max number of events for all tasks.
+const taskHistoryMaxEvents = 1000
+
+// The history of a task expires if no event for a while, for example, the task is removed.
+const taskHistoryExpire = 7 * 24 * time.Hour
+
+// The max number of lines of FFmpeg stderr for failed task.
+const taskHistoryStderrLines = 20
+
+// The window to count the recent failures of task, for alerts like failed 3 times in 10 minutes.
+const taskHistoryFailureWindow = 10 * time.Minute
+
+// TaskEventType is the lifecycle transition of task.
+type TaskEventType string
+
+const (
+	TaskEventCreated   TaskEventType = "created"
+	TaskEventStarted   TaskEventType = "started"
+	TaskEventRestarted TaskEventType = "restarted"
+	TaskEventStopped   TaskEventType = "stopped"
+	TaskEventFailed    TaskEventType = "failed"
+)
+
+// TaskEvent is a lifecycle transition of a worker task, for example, the forward task.
+type TaskEvent struct {
+	// The event time.
+	Time string `json:"time"`
+	// The worker of task, for example, forward, vlive or camera.
+	Worker string `json:"worker"`
+	// The task UUID and platform.
+	Task     string `json:"task"`
+	Platform string `json:"platform"`
+	// The event type.
+	Event TaskEventType `json:"event"`
+	// The FFmpeg pid, if started.
+	PID int32 `json:"pid,omitempty"`
+	// The reason or error message.
+	Message string `json:"message,omitempty"`
+	// The tail of FFmpeg stderr, for failed task.
+	Stderr []string `json:"stderr,omitempty"`
+	// The number of failures in recent window, including this one, for failed task.
+	Failures int `json:"failures,omitempty"`
+}
+
+func (v *TaskEvent) String() string {
+	return fmt.Sprintf("worker=%v, task=%v, platform=%v, event=%v, pid=%v, message=%v, stderr=%v, failures=%v",
+		v.Worker, v.Task, v.Platform, v.Event, v.PID, v.Message, len(v.Stderr), v.Failures,
+	)
+}
+
+func taskHistoryKey(task string) string {
+	return fmt.Sprintf("%v:%v", SRS_TASK_HISTORY, task)
+}
+
+// recordTaskEvent saves the event to the history of task and all tasks, and notify by callback. It never fails,
+// because the history is only for troubleshooting.
+func recordTaskEvent(ctx context.Context, event *TaskEvent) {
+	if event.Time == "" {
+		event.Time = time.Now().Format(time.RFC3339)
+	}
+
+	if event.Event == TaskEventFailed {
+		if failures, err := queryTaskFailures(ctx, event.Task, taskHistoryFailureWindow); err != nil {
+			logger.Wf(ctx, "task history ignore query failures err %+v", err)
+		} else {
+			event.Failures = failures + 1
+		}
+	}
+
+	if err := saveTaskEvent(ctx, event); err != nil {
+		logger.Wf(ctx, "task history ignore save %v err %+v", event.String(), err)
+	}
+
+	// Notify by callback in background, never block the task. Note that we use a new context, because the ctx might
+	// be cancelled when task stopped or request done.
+	if callbackWorker != nil {
+		go safe(ctx, func() {
+			ctx, cancel := context.WithTimeout(logger.WithContext(context.Background()), 30*time.Second)
+			defer cancel()
+
+			if err := callbackWorker.OnTaskMessage(ctx, SrsActionOnTask, event); err != nil {
+				logger.Wf(ctx, "task history ignore callback %v err %+v", event.String(), err)
+			}
+		})
+	}
+}
+
+func saveTaskEvent(ctx context.Context, event *TaskEvent) error {
+	b, err := json.Marshal(event)
+	if err != nil {
+		return errors.Wrapf(err, "marshal %v", event.String())
+	}
+
+	// The history is only for troubleshooting, so write by buffer, never block the task.
+	key := taskHistoryKey(event.Task)
+	if err := bufferedRedisWrite(ctx, "task history", func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.LPush(ctx, key, string(b))
+		pipe.LTrim(ctx, key, 0, taskHistoryMaxEventsPerTask-1)
+		pipe.Expire(ctx, key, taskHistoryExpire)
+		pipe.LPush(ctx, SRS_TASK_HISTORY, string(b))
+		pipe.LTrim(ctx, SRS_TASK_HISTORY, 0, taskHistoryMaxEvents-1)
+	}); err != nil {
+		return errors.Wrapf(err, "write %v", key)
+	}
+
+	logger.Tf(ctx, "task history save ok, %v", event.String())
+	return nil
+}
+
+// queryTaskHistory returns the events of task, the latest first.
+func queryTaskHistory(ctx context.Context, task string) ([]*TaskEvent, error) {
+	key := taskHistoryKey(task)
+	values, err := rdb.LRange(ctx, key, 0, taskHistoryMaxEventsPerTask-1).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "lrange %v", key)
+	}
+
+	events := make([]*TaskEvent, 0, len(values))
+	for _, value := range values {
+		var event TaskEvent
+		if err := json.Unmarshal([]byte(value), &event); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v", value)
+		}
+		events = append(events, &event)
+	}
+	return events, nil
+}
+
+// rangeTaskEvents callback for each event of all tasks, the latest first, without loading all of them.
+func rangeTaskEvents(ctx context.Context, handler func(event *TaskEvent) error) error {
+	return rangeRedisList(ctx, SRS_TASK_HISTORY, taskHistoryMaxEvents, func(value string) error {
+		var event TaskEvent
+		if err := json.Unmarshal([]byte(value), &event); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", value)
+		}
+		return handler(&event)
+	})
+}
+
+// handleMgmtHooksEvents queries the events of all tasks, which are also notified by the on_task hook.
+func handleMgmtHooksEvents(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/hooks/events"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, worker string
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Worker *string `json:"worker"`
+			}{
+				Token: &token, Worker: &worker,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Stream the events, in the same envelope of httpWriteData, see JSONArrayWriter.
+			aw := NewJSONArrayWriter(w, "events")
+			if err := rangeTaskEvents(ctx, func(event *TaskEvent) error {
+				if worker != "" && event.Worker != worker {
+					return nil
+				}
+				return aw.Write(event)
+			}); err != nil {
+				return errors.Wrapf(err, "range events")
+			}
+			if err := aw.Close(); err != nil {
+				return errors.Wrapf(err, "close")
+			}
+			logger.Tf(ctx, "hooks events query ok, worker=%v, events=%v, token=%vB", worker, aw.Elements(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
+
+// queryTaskFailures returns the number of failed events of task in the recent window.
+func queryTaskFailures(ctx context.Context, task string, window time.Duration) (int, error) {
+	events, err := queryTaskHistory(ctx, task)
+	if err != nil {
+		return 0, errors.Wrapf(err, "query history")
+	}
+
+	var failures int
+	for _, event := range events {
+		if t, err := time.Parse(time.RFC3339, event.Time); err != nil || time.Since(t) > window {
+			break
+		}
+		if event.Event == TaskEventFailed {
+			failures++
+		}
+	}
+	return failures, nil
+}
+
+// recordTaskExit records the FFmpeg exit as stopped or failed. The task is stopped if canceled by worker, or FFmpeg
+// exits normally, otherwise it's failed with the tail of stderr.
+func recordTaskExit(
+	ctx context.Context, worker, task, platform string, pid int32, canceled bool, heartbeat *FFmpegHeartbeat, err error,
+) {
+	event := &TaskEvent{Worker: worker, Task: task, Platform: platform, PID: pid, Event: TaskEventStopped}
+	if canceled {
+		event.Message = "canceled"
+	} else if err != nil {
+		event.Event, event.Message = TaskEventFailed, err.Error()
+		event.Stderr = heartbeat.StderrTail(taskHistoryStderrLines)
+		publishEvent(ctx, &TaskFailedEvent{Worker: worker, Task: task, Platform: platform, Message: event.Message})
+	} else {
+		event.Message = "exit normally"
+	}
+	recordTaskEvent(ctx, event)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestTaskHistory_StderrTail(t *testing.T) {
+	heartbeat := NewFFmpegHeartbeat(func() {})
+	for i := 0; i < 30; i++ {
+		heartbeat.appendExtraLog(fmt.Sprintf("line %v", i))
+	}
+
+	if tail := heartbeat.StderrTail(taskHistoryStderrLines); len(tail) != 20 || tail[0] != "line 10" || tail[19] != "line 29" {
+		t.Errorf("Fail for tail %v", tail)
+	}
+	if all := heartbeat.StderrTail(0); len(all) != 30 {
+		t.Errorf("Fail for all %v", len(all))
+	}
+}
+
+func TestTaskHistory_RecordAndQuery(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	heartbeat := NewFFmpegHeartbeat(func() {})
+	heartbeat.appendExtraLog("Connection refused")
+
+	recordTaskEvent(ctx, &TaskEvent{Worker: "forward", Task: "task-wx", Platform: "wx", Event: TaskEventCreated})
+	recordTaskEvent(ctx, &TaskEvent{Worker: "forward", Task: "task-wx", Platform: "wx", Event: TaskEventStarted, PID: 100})
+	recordTaskExit(ctx, "forward", "task-wx", "wx", 100, false, heartbeat, errors.New("exit status 1"))
+	recordTaskExit(ctx, "forward", "task-wx", "wx", 101, false, heartbeat, errors.New("exit status 1"))
+	recordTaskExit(ctx, "forward", "task-wx", "wx", 102, true, heartbeat, errors.New("signal: killed"))
+
+	events, err := queryTaskHistory(ctx, "task-wx")
+	if err != nil {
+		t.Errorf("Fail for err %+v", err)
+		return
+	}
+	if len(events) != 5 {
+		t.Errorf("Fail for events %v", len(events))
+		return
+	}
+
+	// The latest event first, and a stopped task is not failure.
+	if e := events[0]; e.Event != TaskEventStopped || e.PID != 102 || len(e.Stderr) != 0 {
+		t.Errorf("Fail for event %v", e.String())
+	}
+	if e := events[1]; e.Event != TaskEventFailed || e.Failures != 2 || len(e.Stderr) != 1 || e.Message != "exit status 1" {
+		t.Errorf("Fail for event %v", e.String())
+	}
+	if e := events[2]; e.Event != TaskEventFailed || e.Failures != 1 || e.Stderr[0] != "Connection refused" {
+		t.Errorf("Fail for event %v", e.String())
+	}
+	if e := events[4]; e.Event != TaskEventCreated {
+		t.Errorf("Fail for event %v", e.String())
+	}
+
+	// The history is bounded for each task.
+	for i := 0; i < taskHistoryMaxEventsPerTask; i++ {
+		recordTaskEvent(ctx, &TaskEvent{Worker: "forward", Task: "task-wx", Platform: "wx", Event: TaskEventStarted})
+	}
+	if events, err := queryTaskHistory(ctx, "task-wx"); err != nil || len(events) != taskHistoryMaxEventsPerTask {
+		t.Errorf("Fail for events %v, err %+v", len(events), err)
+	}
+	if events, err := server.List(SRS_TASK_HISTORY); err != nil || len(events) != taskHistoryMaxEventsPerTask+5 {
+		t.Errorf("Fail for global events %v, err %+v", len(events), err)
+	}
+}
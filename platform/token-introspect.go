@@ -0,0 +1,299 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/google/uuid"
+)
+
+// The max number of introspection requests from a client in a window. It's generous, because a reverse proxy might
+// introspect each request of HLS segments.
+const (
+	tokenIntrospectRateWindow = time.Minute
+	tokenIntrospectRateLimit  = 6000
+)
+
+// TokenIntrospection is the state of token, in the shape of RFC 7662. The claims are only set if active.
+type TokenIntrospection struct {
+	// Whether the token is valid and not expired.
+	Active bool `json:"active"`
+	// The scope of token, if any.
+	Scope string `json:"scope,omitempty"`
+	// The issuer of token, if any.
+	Issuer string `json:"iss,omitempty"`
+	// The expire and issue time of token, in seconds since epoch.
+	ExpireAt int64 `json:"exp,omitempty"`
+	IssuedAt int64 `json:"iat,omitempty"`
+}
+
+func (v *TokenIntrospection) String() string {
+	return fmt.Sprintf("active=%v, scope=%v, iss=%v, exp=%v, iat=%v",
+		v.Active, v.Scope, v.Issuer, v.ExpireAt, v.IssuedAt,
+	)
+}
+
+// introspectToken verifies the token by api secret, and returns the claims if active. A bad token is never an error,
+// but an inactive introspection.
+func introspectToken(apiSecret, token string) *TokenIntrospection {
+	claims := struct {
+		Scope string `json:"scope"`
+		jwt.RegisteredClaims
+	}{}
+	if token == "" || checkApiSecret(apiSecret) != nil {
+		return &TokenIntrospection{}
+	}
+
+	if _, err := jwt.ParseWithClaims(token, &claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.Errorf("invalid signing method %v", token.Header["alg"])
+		}
+		return []byte(apiSecret), nil
+	}); err != nil {
+		return &TokenIntrospection{}
+	}
+
+	r := &TokenIntrospection{Active: true, Scope: claims.Scope, Issuer: claims.Issuer}
+	if claims.ExpiresAt != nil {
+		r.ExpireAt = claims.ExpiresAt.Unix()
+	}
+	if claims.IssuedAt != nil {
+		r.IssuedAt = claims.IssuedAt.Unix()
+	}
+	return r
+}
+
+// queryIntrospectKey returns the dedicated key for introspection, create one if not exists or reset.
+func queryIntrospectKey(ctx context.Context, reset bool) (string, error) {
+	if !reset {
+		if ciphertext, err := rdb.HGet(ctx, SRS_TOKEN_INTROSPECT, "key").Result(); err != nil && err != redis.Nil {
+			return "", errors.Wrapf(err, "hget %v key", SRS_TOKEN_INTROSPECT)
+		} else if ciphertext != "" {
+			key, err := decryptByApiSecret(ciphertext)
+			if err != nil {
+				return "", errors.Wrapf(err, "decrypt key")
+			}
+			return key, nil
+		}
+	}
+
+	key := fmt.Sprintf("srs-ik-%v", strings.ReplaceAll(uuid.NewString(), "-", ""))
+	ciphertext, err := encryptByApiSecret(key)
+	if err != nil {
+		return "", errors.Wrapf(err, "encrypt key")
+	}
+
+	if err := rdb.HSet(ctx, SRS_TOKEN_INTROSPECT, "key", ciphertext).Err(); err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "hset %v key", SRS_TOKEN_INTROSPECT)
+	}
+	if err := rdb.HSet(ctx, SRS_TOKEN_INTROSPECT, "update", time.Now().Format(time.RFC3339)).Err(); err != nil && err != redis.Nil {
+		return "", errors.Wrapf(err, "hset %v update", SRS_TOKEN_INTROSPECT)
+	}
+	return key, nil
+}
+
+// authenticateIntrospect verifies the caller of introspection, by the bearer of api secret or introspection key. Note
+// that the platform token is not allowed, because the caller is a service rather than a user.
+func authenticateIntrospect(ctx context.Context, apiSecret string, header http.Header) error {
+	if err := checkApiSecret(apiSecret); err != nil {
+		return newHttpCodeError(http.StatusServiceUnavailable, SrsStackErrorNotConfigured, err)
+	}
+
+	authorization := header.Get("Authorization")
+	authParts := strings.Split(authorization, " ")
+	if len(authParts) != 2 || strings.ToLower(authParts[0]) != "bearer" {
+		return newHttpCodeError(http.StatusUnauthorized, SrsStackErrorAuth, errors.New("no bearer secret or key"))
+	}
+
+	bearer := []byte(authParts[1])
+	if subtle.ConstantTimeCompare(bearer, []byte(apiSecret)) == 1 {
+		return nil
+	}
+
+	key, err := queryIntrospectKey(ctx, false)
+	if err != nil {
+		return errors.Wrapf(err, "query key")
+	}
+	if subtle.ConstantTimeCompare(bearer, []byte(key)) == 1 {
+		return nil
+	}
+
+	return newHttpCodeError(http.StatusUnauthorized, SrsStackErrorAuth, errors.New("invalid bearer secret or key"))
+}
+
+// parseIntrospectToken returns the token to introspect, from the JSON body, the form or query, or the query of
+// X-Original-URI for the subrequest of NGINX auth_request.
+func parseIntrospectToken(ctx context.Context, r *http.Request) (string, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var token string
+		if err := ParseBody(ctx, r, &struct {
+			Token *string `json:"token"`
+		}{
+			Token: &token,
+		}); err != nil {
+			return "", errors.Wrapf(err, "parse body")
+		}
+		return token, nil
+	}
+
+	if token := r.FormValue("token"); token != "" {
+		return token, nil
+	}
+
+	if original := r.Header.Get("X-Original-URI"); original != "" {
+		if u, err := url.Parse(original); err == nil {
+			return u.Query().Get("token"), nil
+		}
+	}
+	return "", nil
+}
+
+// handleMgmtTokenIntrospect handles the introspection for reverse proxies. For NGINX, protect the HLS by:
+//
+//	location ~ /.+\.(m3u8|ts)$ {
+//	  auth_request /terraform/v1/mgmt/token/introspect/auth-request;
+//	}
+//	location = /terraform/v1/mgmt/token/introspect/auth-request {
+//	  internal;
+//	  proxy_pass http://127.0.0.1:2024;
+//	  proxy_pass_request_body off;
+//	  proxy_set_header Content-Length "";
+//	  proxy_set_header X-Original-URI $request_uri;
+//	  proxy_set_header Authorization "Bearer $introspect_key";
+//	}
+func handleMgmtTokenIntrospect(ctx context.Context, handler *http.ServeMux) {
+	limiter := NewClientRateLimiter(tokenIntrospectRateWindow, tokenIntrospectRateLimit)
+
+	introspect := func(ctx context.Context, w http.ResponseWriter, r *http.Request) (*TokenIntrospection, error) {
+		if !limiter.Allow(clientIP(r), time.Now()) {
+			w.Header().Set("Retry-After", fmt.Sprintf("%v", int(tokenIntrospectRateWindow.Seconds())))
+			return nil, newHttpCodeError(http.StatusTooManyRequests, SrsStackErrorTooManyRequests,
+				errors.Errorf("too many requests from %v", clientIP(r)),
+			)
+		}
+
+		apiSecret := envApiSecret()
+		if err := authenticateIntrospect(ctx, apiSecret, r.Header); err != nil {
+			return nil, errors.Wrapf(err, "authenticate")
+		}
+
+		token, err := parseIntrospectToken(ctx, r)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse token")
+		}
+
+		return introspectToken(apiSecret, token), nil
+	}
+
+	// The inactive token is 200 with active=false, so the proxy is able to distinguish it from service down.
+	ep := "/terraform/v1/mgmt/token/introspect"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			res, err := introspect(ctx, w, r)
+			if err != nil {
+				return errors.Wrapf(err, "introspect")
+			}
+
+			b, err := json.Marshal(res)
+			if err != nil {
+				return errors.Wrapf(err, "marshal %v", res.String())
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			w.Write(b)
+			logger.Tf(ctx, "token introspect ok, %v, client=%v", res.String(), clientIP(r))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	// For NGINX auth_request, which only checks the status, 204 for active token, and 401 for inactive.
+	ep = "/terraform/v1/mgmt/token/introspect/auth-request"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			res, err := introspect(ctx, w, r)
+			if err != nil {
+				return errors.Wrapf(err, "introspect")
+			}
+
+			w.Header().Set("Cache-Control", "no-store")
+			if !res.Active {
+				w.WriteHeader(http.StatusUnauthorized)
+			} else {
+				w.WriteHeader(http.StatusNoContent)
+			}
+			logger.Tf(ctx, "token auth request ok, %v, client=%v", res.String(), clientIP(r))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/token/introspect/key"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, password string
+			var reset bool
+			if err := ParseBody(ctx, r, &struct {
+				Token    *string `json:"token"`
+				Password *string `json:"password"`
+				Reset    *bool   `json:"reset"`
+			}{
+				Token: &token, Password: &password, Reset: &reset,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			// The key is able to introspect all tokens, so it requires the admin scope or password, see authenticateAdmin.
+			apiSecret := envApiSecret()
+			if _, err := authenticateAdmin(ctx, apiSecret, token, password, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate admin")
+			}
+
+			key, err := queryIntrospectKey(ctx, reset)
+			if err != nil {
+				return errors.Wrapf(err, "query key")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Key string `json:"key"`
+			}{
+				Key: key,
+			})
+			logger.Tf(ctx, "token introspect key ok, reset=%v, key=%vB, token=%vB", reset, len(key), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestTokenIntrospect_ActiveAndInactive(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	handler := http.NewServeMux()
+	handleMgmtTokenIntrospect(ctx, handler)
+
+	request := func(api, authorization, contentType, body string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, api, strings.NewReader(body))
+		for k, v := range header {
+			r.Header[k] = v
+		}
+		r.Header.Set("Content-Type", contentType)
+		r.Header.Set("Authorization", authorization)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	_, _, token, err := createToken(ctx, envApiSecret())
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	// The dedicated key, which is stable until reset.
+	w := request("/terraform/v1/mgmt/token/introspect/key", "Bearer test-platform-secret", "application/json", "{}", nil)
+	var res struct {
+		Data struct {
+			Key string `json:"key"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Data.Key == "" {
+		t.Fatalf("Fail for body %v, err %+v", w.Body.String(), err)
+	}
+	key := res.Data.Key
+
+	// The token without admin scope is not able to query the key.
+	if w := request("/terraform/v1/mgmt/token/introspect/key", "", "application/json", `{"token":"`+token+`"}`, nil); w.Code != http.StatusForbidden ||
+		!strings.Contains(w.Body.String(), `"code":2014`) || strings.Contains(w.Body.String(), key) {
+		t.Errorf("Fail for code=%v, body=%v", w.Code, w.Body.String())
+	}
+	_, _, adminToken, err := createTokenWithScope(ctx, envApiSecret(), tokenScopeAdmin)
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if w := request("/terraform/v1/mgmt/token/introspect/key", "", "application/json", `{"token":"`+adminToken+`"}`, nil); w.Code != http.StatusOK ||
+		!strings.Contains(w.Body.String(), key) {
+		t.Errorf("Fail for code=%v, body=%v", w.Code, w.Body.String())
+	}
+	if ciphertext, _ := server.HGet(SRS_TOKEN_INTROSPECT, "key"); strings.Contains(ciphertext, key) {
+		t.Errorf("Fail for key in plaintext")
+	}
+
+	for _, c := range []struct {
+		authorization, contentType, body string
+		active                           bool
+	}{
+		{"Bearer " + key, "application/json", `{"token":"` + token + `"}`, true},
+		{"Bearer test-platform-secret", "application/x-www-form-urlencoded", "token=" + token, true},
+		{"Bearer " + key, "application/json", `{"token":"invalid"}`, false},
+		{"Bearer " + key, "application/json", `{}`, false},
+	} {
+		w := request("/terraform/v1/mgmt/token/introspect", c.authorization, c.contentType, c.body, nil)
+		var r TokenIntrospection
+		if err := json.Unmarshal(w.Body.Bytes(), &r); err != nil || w.Code != http.StatusOK || r.Active != c.active {
+			t.Errorf("Fail for %v, code=%v, body=%v, err %+v", c.body, w.Code, w.Body.String(), err)
+		} else if c.active && (r.Issuer != tokenIssuer || r.ExpireAt == 0) {
+			t.Errorf("Fail for %v", r.String())
+		} else if !c.active && (r.Issuer != "" || r.ExpireAt != 0) {
+			t.Errorf("Fail for %v", r.String())
+		}
+	}
+
+	// The caller must use the secret or key, the platform token is not allowed.
+	for _, authorization := range []string{"", "Bearer invalid", "Bearer " + token} {
+		if w := request("/terraform/v1/mgmt/token/introspect", authorization, "application/json", `{"token":"`+token+`"}`, nil); w.Code != http.StatusUnauthorized {
+			t.Errorf("Fail for code=%v, body=%v", w.Code, w.Body.String())
+		}
+	}
+
+	// For NGINX auth_request, the token is in the original URI.
+	for uri, code := range map[string]int{
+		"/live/livestream.m3u8?token=" + token: http.StatusNoContent,
+		"/live/livestream.m3u8?token=invalid":  http.StatusUnauthorized,
+		"/live/livestream.m3u8":                http.StatusUnauthorized,
+	} {
+		header := http.Header{"X-Original-Uri": []string{uri}}
+		if w := request("/terraform/v1/mgmt/token/introspect/auth-request", "Bearer "+key, "", "", header); w.Code != code {
+			t.Errorf("Fail for %v code=%v, body=%v", uri, w.Code, w.Body.String())
+		}
+	}
+
+	// Reset the key, the previous one is invalid.
+	request("/terraform/v1/mgmt/token/introspect/key", "Bearer test-platform-secret", "application/json", `{"reset":true}`, nil)
+	if w := request("/terraform/v1/mgmt/token/introspect", "Bearer "+key, "application/json", `{}`, nil); w.Code != http.StatusUnauthorized {
+		t.Errorf("Fail for code=%v, body=%v", w.Code, w.Body.String())
+	}
+}
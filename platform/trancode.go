@@ -18,7 +18,6 @@ import (
 
 	// From ossrs.
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
 	"github.com/go-redis/redis/v8"
@@ -46,9 +45,12 @@ func (v *TranscodeWorker) Handle(ctx context.Context, handler *http.ServeMux) er
 	ep := "/terraform/v1/ffmpeg/transcode/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -70,21 +72,24 @@ func (v *TranscodeWorker) Handle(ctx context.Context, handler *http.ServeMux) er
 				}
 			}
 
-			ohttp.WriteData(ctx, w, r, &config)
+			httpWriteData(ctx, w, r, &config)
 			logger.Tf(ctx, "transcode query ok, %v, token=%vB", config, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ffmpeg/transcode/apply"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var config TranscodeConfig
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				*TranscodeConfig
 			}{
@@ -109,20 +114,23 @@ func (v *TranscodeWorker) Handle(ctx context.Context, handler *http.ServeMux) er
 				return errors.Wrapf(err, "restart task %v", config.String())
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "transcode apply ok, %v, token=%vB", config, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ffmpeg/transcode/task"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -172,12 +180,12 @@ func (v *TranscodeWorker) Handle(ctx context.Context, handler *http.ServeMux) er
 				res.Frame.Update = update
 			}
 
-			ohttp.WriteData(ctx, w, r, &res)
+			httpWriteData(ctx, w, r, &res)
 			logger.Tf(ctx, "transcode task ok, %v, pid=%v, input=%v, output=%v, frame=%v, update=%v, token=%vB",
 				config, pid, input, output, frame, update, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
@@ -329,6 +337,21 @@ func (v *TranscodeTask) Restart(ctx context.Context) error {
 	return nil
 }
 
+// Stop the FFmpeg if running, for example, the feature is disabled, and record the reason.
+func (v *TranscodeTask) Stop(ctx context.Context, reason string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.cancel == nil || v.PID <= 0 {
+		return
+	}
+	v.cancel()
+
+	recordTaskEvent(ctx, &TaskEvent{
+		Worker: "transcode", Task: v.UUID, Platform: "global", Event: TaskEventStopped, PID: v.PID, Message: reason,
+	})
+}
+
 func (v *TranscodeTask) Run(ctx context.Context) error {
 	ctx = logger.WithContext(ctx)
 	logger.Tf(ctx, "transcode run task %v", v.String())
@@ -414,10 +437,22 @@ func (v *TranscodeTask) Run(ctx context.Context) error {
 			return nil
 		}
 
+		// Ignore if the feature is disabled for this install.
+		if enabled, err := isFeatureEnabled(ctx, FeatureTranscode); err != nil {
+			return errors.Wrapf(err, "query feature")
+		} else if !enabled {
+			return nil
+		}
+
 		if err := v.saveTask(ctx); err != nil {
 			return errors.Wrapf(err, "save task")
 		}
 
+		// Never start FFmpeg before SRS is ready, see srsReadiness.
+		if !srsReadiness.Ready() {
+			return nil
+		}
+
 		// Use a active stream as input.
 		input, err := selectActiveStream()
 		if err != nil {
@@ -438,10 +473,12 @@ func (v *TranscodeTask) Run(ctx context.Context) error {
 
 	for ctx.Err() == nil {
 		if err := pfn(ctx); err != nil {
-			logger.Wf(ctx, "ignore %v err %+v", v.String(), err)
+			logThrottle.Wf(ctx, fmt.Sprintf("%v %v", v.UUID, err.Error()), "ignore %v err %+v", v.String(), err)
 
+			// Retry immediately once SRS is ready again.
 			select {
 			case <-ctx.Done():
+			case <-srsReadiness.Regained():
 			case <-time.After(3500 * time.Millisecond):
 			}
 			continue
@@ -19,7 +19,6 @@ import (
 
 	// From ossrs.
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
 	"github.com/go-redis/redis/v8"
@@ -62,9 +61,12 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 	ep := "/terraform/v1/ai/transcript/query"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -94,23 +96,26 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 			}
 			resp.Task.UUID = v.task.UUID
 
-			ohttp.WriteData(ctx, w, r, resp)
+			httpWriteData(ctx, w, r, resp)
 			logger.Tf(ctx, "transcript query ok, config=<%v>, uuid=%v, token=%vB",
 				config, v.task.UUID, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/transcript/apply"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var uuid string
 			var config TranscriptConfig
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				UUID  *string `json:"uuid"`
 				*TranscriptConfig
@@ -142,24 +147,27 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 			type ApplyResponse struct {
 				UUID string `json:"uuid"`
 			}
-			ohttp.WriteData(ctx, w, r, &ApplyResponse{
+			httpWriteData(ctx, w, r, &ApplyResponse{
 				UUID: v.task.UUID,
 			})
 			logger.Tf(ctx, "transcript apply ok, config=<%v>, uuid=%v, token=%vB",
 				config, v.task.UUID, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/transcript/check"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var transcriptConfig TranscriptConfig
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				*TranscriptConfig
 			}{
@@ -205,22 +213,25 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 				return errors.Wrapf(err, "create chat")
 			}
 
-			ohttp.WriteData(ctx, w, r, nil)
+			httpWriteData(ctx, w, r, nil)
 			logger.Tf(ctx, "transcript check ok, config=<%v>, model=<%v>, msg=<%v>, token=%vB",
 				transcriptConfig, model.ID, resp.Choices[0].Message.Content, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/transcript/clear-subtitle"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var uuid, tsid string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				UUID  *string `json:"uuid"`
 				TSID  *string `json:"tsid"`
@@ -248,21 +259,24 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 				UUID string `json:"uuid"`
 			}
 
-			ohttp.WriteData(ctx, w, r, &ClearSubtitleResponse{uuid})
+			httpWriteData(ctx, w, r, &ClearSubtitleResponse{uuid})
 			logger.Tf(ctx, "transcript clear subtitle ok, uuid=%v, token=%vB", uuid, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/transcript/reset"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var uuid string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 				UUID  *string `json:"uuid"`
 			}{
@@ -288,22 +302,25 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 			type ResetResponse struct {
 				UUID string `json:"uuid"`
 			}
-			ohttp.WriteData(ctx, w, r, &ResetResponse{
+			httpWriteData(ctx, w, r, &ResetResponse{
 				UUID: v.task.UUID,
 			})
 			logger.Tf(ctx, "transcript reset ok, uuid=%v, new=%v, token=%vB", uuid, v.task.UUID, len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/transcript/live-queue"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -342,20 +359,23 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 
 			res.Count = len(res.Segments)
 
-			ohttp.WriteData(ctx, w, r, res)
+			httpWriteData(ctx, w, r, res)
 			logger.Tf(ctx, "transcript query live ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/transcript/asr-queue"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -402,20 +422,23 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 
 			res.Count = len(res.Segments)
 
-			ohttp.WriteData(ctx, w, r, res)
+			httpWriteData(ctx, w, r, res)
 			logger.Tf(ctx, "transcript query asr ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/transcript/fix-queue"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -493,20 +516,23 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 
 			res.Count = len(res.Segments)
 
-			ohttp.WriteData(ctx, w, r, res)
+			httpWriteData(ctx, w, r, res)
 			logger.Tf(ctx, "transcript query fix ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/transcript/overlay-queue"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token *string `json:"token"`
 			}{
 				Token: &token,
@@ -592,17 +618,20 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 
 			res.Count = len(res.Segments)
 
-			ohttp.WriteData(ctx, w, r, res)
+			httpWriteData(ctx, w, r, res)
 			logger.Tf(ctx, "transcript query overlay ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/transcript/hls/webvtt/"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		hlsM3u8VariantHandler := func(w http.ResponseWriter, r *http.Request) error {
 			// Format is webvtt/:uuid/index.m3u8
 			webvttPrefix := "/terraform/v1/ai/transcript/hls/webvtt/"
@@ -791,13 +820,16 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 
 			return errors.Errorf("invalid handler for %v", r.URL.Path)
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/transcript/hls/overlay/"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		overlayM3u8Handler := func(w http.ResponseWriter, r *http.Request) error {
 			// Format is /overlay/:uuid.m3u8
 			filename := r.URL.Path[len("/terraform/v1/ai/transcript/hls/overlay/"):]
@@ -861,13 +893,16 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 
 			return errors.Errorf("invalid handler for %v", r.URL.Path)
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ai/transcript/hls/original/"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		originalM3u8Handler := func(w http.ResponseWriter, r *http.Request) error {
 			// Format is /original/:uuid.m3u8
 			filename := r.URL.Path[len("/terraform/v1/ai/transcript/hls/original/"):]
@@ -931,7 +966,7 @@ func (v *TranscriptWorker) Handle(ctx context.Context, handler *http.ServeMux) e
 
 			return errors.Errorf("invalid handler for %v", r.URL.Path)
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
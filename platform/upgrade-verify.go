@@ -0,0 +1,369 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The repository of the Oryx image, in the registry of conf.Registry.
+const upgradeImageRepository = "ossrs/oryx"
+
+// The max number of verifications in audit log.
+const upgradeAuditMaxEntries = 1000
+
+// The timeout to resolve the manifest, and to verify the signature by cosign.
+const upgradeVerifyTimeout = 30 * time.Second
+
+// The result of verification of the image to upgrade, see UpgradeTarget.
+const (
+	// The digest matches the pinned one, and the signature is valid if the public key is configured.
+	UpgradeVerifyOK = "verified"
+	// Neither the digest is pinned, nor the public key is configured, so nothing is verified.
+	UpgradeVerifyUnpinned = "unpinned"
+	// The verification is skipped by API, which is never recommended.
+	UpgradeVerifySkipped = "skipped"
+	// The digest or signature mismatch, the upgrade is aborted.
+	UpgradeVerifyFailed = "failed"
+)
+
+// UpgradeTarget is the image to upgrade to, and the result of verification.
+type UpgradeTarget struct {
+	// The release channel, stable or latest.
+	Channel string `json:"channel"`
+	// The version of channel, which is also the tag of image.
+	Version string `json:"version"`
+	// The image without tag, for example, docker.io/ossrs/oryx
+	Image string `json:"image"`
+	// The expected digest of image, empty if not pinned.
+	Expected string `json:"expected,omitempty"`
+	// The digest resolved from the registry manifest, empty if skipped.
+	Digest string `json:"digest,omitempty"`
+	// Whether the signature is verified by cosign.
+	Signed bool `json:"signed,omitempty"`
+	// The result of verification, see UpgradeVerifyOK.
+	Result string `json:"result"`
+}
+
+func (v *UpgradeTarget) String() string {
+	return fmt.Sprintf("channel=%v, version=%v, image=%v, expected=%v, digest=%v, signed=%v, result=%v",
+		v.Channel, v.Version, v.Image, v.Expected, v.Digest, v.Signed, v.Result,
+	)
+}
+
+// Reference returns the image reference to pull, pinned by digest if resolved.
+func (v *UpgradeTarget) Reference() string {
+	if v.Digest != "" {
+		return fmt.Sprintf("%v@%v", v.Image, v.Digest)
+	}
+	return fmt.Sprintf("%v:%v", v.Image, v.Version)
+}
+
+// UpgradeAudit is a verification of the image before upgrade, passed, failed or skipped.
+type UpgradeAudit struct {
+	// The time of verification.
+	Time string `json:"time"`
+	// The client IP of caller.
+	IP string `json:"ip"`
+	UpgradeTarget
+	// The error if failed.
+	Error string `json:"error,omitempty"`
+}
+
+func (v *UpgradeAudit) String() string {
+	return fmt.Sprintf("time=%v, ip=%v, %v, error=%v", v.Time, v.IP, v.UpgradeTarget.String(), v.Error)
+}
+
+// resolveImageDigest resolves the digest of image tag from the registry, it's a variable for testing.
+var resolveImageDigest = fetchImageDigest
+
+// verifyImageSignature verifies the signature of image reference by cosign, it's a variable for testing.
+var verifyImageSignature = func(ctx context.Context, pubkey, reference string) error {
+	ctx, cancel := context.WithTimeout(ctx, upgradeVerifyTimeout)
+	defer cancel()
+
+	b, err := exec.CommandContext(ctx, "cosign", "verify", "--key", pubkey, reference).CombinedOutput()
+	if err != nil {
+		return errors.Wrapf(err, "cosign verify %v, output %v", reference, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// resolveUpgradeTarget returns the image of release channel, the latest if empty. The offline default is used if the
+// versions is not refreshed yet.
+func resolveUpgradeTarget(channel string) (*UpgradeTarget, error) {
+	versions := conf.Versions()
+
+	var component ComponentVersion
+	switch channel {
+	case "", "latest":
+		channel, component = "latest", versions.Latest
+		if component.Version == "" {
+			component = ComponentVersion{Version: releasesLatest, Digest: releasesLatestDigest}
+		}
+	case "stable":
+		component = versions.Stable
+		if component.Version == "" {
+			component = ComponentVersion{Version: releasesStable, Digest: releasesStableDigest}
+		}
+	default:
+		return nil, newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid channel %v", channel))
+	}
+
+	registry := conf.Registry()
+	if registry == "" {
+		registry = "docker.io"
+	}
+
+	return &UpgradeTarget{
+		Channel: channel, Version: component.Version, Expected: component.Digest,
+		Image: fmt.Sprintf("%v/%v", registry, upgradeImageRepository),
+	}, nil
+}
+
+// preflightUpgrade resolves the image to upgrade, and verifies the digest and signature. Each verification is saved to
+// audit log, and the failure is an error of SrsStackErrorImageVerify to abort the upgrade.
+func preflightUpgrade(ctx context.Context, r *http.Request, channel string, skip bool) (*UpgradeTarget, error) {
+	target, err := resolveUpgradeTarget(channel)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve %v", channel)
+	}
+
+	if skip {
+		target.Result = UpgradeVerifySkipped
+		logger.Wf(ctx, "upgrade: !!! SKIP VERIFICATION !!! the image %v is NOT verified, expected=%v, pubkey=%v",
+			target.Reference(), target.Expected, envPlatformUpgradePubkey())
+		recordUpgradeAudit(ctx, r, target, nil)
+		return target, nil
+	}
+
+	pubkey := envPlatformUpgradePubkey()
+	if target.Expected == "" && pubkey == "" {
+		target.Result = UpgradeVerifyUnpinned
+		logger.Tf(ctx, "upgrade: image %v is not pinned, no digest or PLATFORM_UPGRADE_PUBKEY", target.Reference())
+		recordUpgradeAudit(ctx, r, target, nil)
+		return target, nil
+	}
+
+	if err := verifyUpgradeTarget(ctx, target, pubkey); err != nil {
+		target.Result = UpgradeVerifyFailed
+		recordUpgradeAudit(ctx, r, target, err)
+		return nil, newHttpCodeError(http.StatusConflict, SrsStackErrorImageVerify, errors.Wrapf(err, "verify %v", target.String()))
+	}
+
+	target.Result = UpgradeVerifyOK
+	recordUpgradeAudit(ctx, r, target, nil)
+	logger.Tf(ctx, "upgrade: verify image ok, %v", target.String())
+	return target, nil
+}
+
+// verifyUpgradeTarget resolves the digest from the registry manifest, which must match the expected digest if pinned,
+// then verifies the signature of the digest if pubkey is not empty.
+func verifyUpgradeTarget(ctx context.Context, target *UpgradeTarget, pubkey string) error {
+	digest, err := resolveImageDigest(ctx, target.Image, target.Version)
+	if err != nil {
+		return errors.Wrapf(err, "resolve digest of %v:%v", target.Image, target.Version)
+	}
+	target.Digest = digest
+
+	if target.Expected != "" && target.Expected != digest {
+		return errors.Errorf("digest mismatch, expected %v, registry %v", target.Expected, digest)
+	}
+
+	if pubkey != "" {
+		if err := verifyImageSignature(ctx, pubkey, target.Reference()); err != nil {
+			return errors.Wrapf(err, "verify signature by %v", pubkey)
+		}
+		target.Signed = true
+	}
+	return nil
+}
+
+// fetchImageDigest resolves the digest of image tag by the manifest of Docker Registry HTTP API V2, with the anonymous
+// token if the registry requires, see https://distribution.github.io/distribution/spec/api/
+func fetchImageDigest(ctx context.Context, image, tag string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, upgradeVerifyTimeout)
+	defer cancel()
+
+	host, repository := image, ""
+	if index := strings.Index(image, "/"); index > 0 {
+		host, repository = image[:index], image[index+1:]
+	}
+	// The API server of Docker Hub is not the same to the name of registry.
+	if host == "docker.io" {
+		host = "registry-1.docker.io"
+	}
+	manifest := fmt.Sprintf("https://%v/v2/%v/manifests/%v", host, repository, tag)
+
+	head := func(token string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, manifest, nil)
+		if err != nil {
+			return nil, errors.Wrapf(err, "new request %v", manifest)
+		}
+		// The digest of the multi-arch image is the index, which is signed and pulled by the tag.
+		req.Header.Set("Accept", strings.Join([]string{
+			"application/vnd.oci.image.index.v1+json",
+			"application/vnd.docker.distribution.manifest.list.v2+json",
+			"application/vnd.oci.image.manifest.v1+json",
+			"application/vnd.docker.distribution.manifest.v2+json",
+		}, ", "))
+		if token != "" {
+			req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", token))
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, errors.Wrapf(err, "head %v", manifest)
+		}
+		res.Body.Close()
+		return res, nil
+	}
+
+	res, err := head("")
+	if err != nil {
+		return "", err
+	}
+	if res.StatusCode == http.StatusUnauthorized {
+		token, err := fetchRegistryToken(ctx, res.Header.Get("Www-Authenticate"))
+		if err != nil {
+			return "", errors.Wrapf(err, "token of %v", manifest)
+		}
+		if res, err = head(token); err != nil {
+			return "", err
+		}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("head %v, code=%v", manifest, res.StatusCode)
+	}
+	if digest := res.Header.Get("Docker-Content-Digest"); digest != "" {
+		return digest, nil
+	}
+	return "", errors.Errorf("head %v, no digest", manifest)
+}
+
+// fetchRegistryToken requests the anonymous token by the challenge of registry, for example,
+//
+//	Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:ossrs/oryx:pull"
+func fetchRegistryToken(ctx context.Context, challenge string) (string, error) {
+	if !strings.HasPrefix(challenge, "Bearer ") {
+		return "", errors.Errorf("invalid challenge %v", challenge)
+	}
+
+	params := make(map[string]string)
+	for _, m := range regexp.MustCompile(`(\w+)="([^"]*)"`).FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	if params["realm"] == "" {
+		return "", errors.Errorf("no realm in %v", challenge)
+	}
+
+	q := url.Values{}
+	for _, key := range []string{"service", "scope"} {
+		if params[key] != "" {
+			q.Set(key, params[key])
+		}
+	}
+	realm := fmt.Sprintf("%v?%v", params["realm"], q.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm, nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "new request %v", realm)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", errors.Wrapf(err, "get %v", realm)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", errors.Wrapf(err, "read %v", realm)
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", errors.Errorf("get %v, code=%v, body=%v", realm, res.StatusCode, string(b))
+	}
+
+	var obj struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.Unmarshal(b, &obj); err != nil {
+		return "", errors.Wrapf(err, "json unmarshal %v", string(b))
+	}
+	if obj.Token != "" {
+		return obj.Token, nil
+	}
+	return obj.AccessToken, nil
+}
+
+// recordUpgradeAudit saves the verification to audit log. It never fails, because the audit should not change the
+// result of verification.
+func recordUpgradeAudit(ctx context.Context, r *http.Request, target *UpgradeTarget, err error) {
+	audit := &UpgradeAudit{Time: time.Now().Format(time.RFC3339), IP: clientIP(r), UpgradeTarget: *target}
+	if err != nil {
+		audit.Error = err.Error()
+	}
+
+	if err := func() error {
+		b, err := json.Marshal(audit)
+		if err != nil {
+			return errors.Wrapf(err, "marshal %v", audit.String())
+		}
+
+		return bufferedRedisWrite(ctx, "upgrade audit", func(ctx context.Context, pipe redis.Pipeliner) {
+			pipe.LPush(ctx, SRS_UPGRADE_AUDIT, string(b))
+			pipe.LTrim(ctx, SRS_UPGRADE_AUDIT, 0, upgradeAuditMaxEntries-1)
+		})
+	}(); err != nil {
+		logger.Wf(ctx, "upgrade audit ignore %v err %+v", audit.String(), err)
+		return
+	}
+
+	logger.Tf(ctx, "upgrade audit ok, %v", audit.String())
+}
+
+// rangeUpgradeAudits callback for each verification in audit log, the latest first.
+func rangeUpgradeAudits(ctx context.Context, handler func(audit *UpgradeAudit) error) error {
+	return rangeRedisList(ctx, SRS_UPGRADE_AUDIT, upgradeAuditMaxEntries, func(value string) error {
+		var audit UpgradeAudit
+		if err := json.Unmarshal([]byte(value), &audit); err != nil {
+			return errors.Wrapf(err, "unmarshal %v", value)
+		}
+		return handler(&audit)
+	})
+}
+
+// queryUpgradeTarget returns the verified image to upgrade, or nil if not set.
+func queryUpgradeTarget(ctx context.Context) (*UpgradeTarget, error) {
+	value, err := rdb.HGet(ctx, SRS_UPGRADING, "target").Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v target", SRS_UPGRADING)
+	} else if value == "" {
+		return nil, nil
+	}
+
+	var target UpgradeTarget
+	if err := json.Unmarshal([]byte(value), &target); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", value)
+	}
+	return &target, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestUpgradeVerify_Preflight(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	setupFakeRedis(t)
+
+	oldPubkey := os.Getenv("PLATFORM_UPGRADE_PUBKEY")
+	oldResolve, oldVerify, oldVersions := resolveImageDigest, verifyImageSignature, conf.Versions()
+	defer func() {
+		resolveImageDigest, verifyImageSignature = oldResolve, oldVerify
+		os.Setenv("PLATFORM_UPGRADE_PUBKEY", oldPubkey)
+		conf.SetVersions(&oldVersions)
+	}()
+
+	conf.SetVersions(&Versions{
+		Stable: ComponentVersion{Version: "v5.14.0", Digest: "sha256:stable"},
+		Latest: ComponentVersion{Version: "v5.15.0"},
+	})
+	resolveImageDigest = func(ctx context.Context, image, tag string) (string, error) {
+		return map[string]string{"v5.14.0": "sha256:stable", "v5.15.0": "sha256:latest"}[tag], nil
+	}
+	var signed []string
+	verifyImageSignature = func(ctx context.Context, pubkey, reference string) error {
+		signed = append(signed, reference)
+		if strings.HasSuffix(reference, "sha256:latest") {
+			return errors.New("no signature")
+		}
+		return nil
+	}
+	r := httptest.NewRequest(http.MethodPost, "/terraform/v1/mgmt/upgrade", nil)
+
+	if _, err := preflightUpgrade(ctx, r, "beta", false); err == nil {
+		t.Errorf("Fail for invalid channel")
+	}
+
+	// Neither pinned nor signed, nothing to verify.
+	os.Setenv("PLATFORM_UPGRADE_PUBKEY", "")
+	if target, err := preflightUpgrade(ctx, r, "", false); err != nil || target.Result != UpgradeVerifyUnpinned || target.Version != "v5.15.0" {
+		t.Errorf("Fail for target %v, err %+v", target, err)
+	}
+
+	// The digest is pinned for stable.
+	if target, err := preflightUpgrade(ctx, r, "stable", false); err != nil || target.Result != UpgradeVerifyOK ||
+		target.Reference() != "docker.io/ossrs/oryx@sha256:stable" {
+		t.Errorf("Fail for target %v, err %+v", target, err)
+	}
+
+	// Mismatch the digest, or the signature is invalid.
+	conf.SetVersions(&Versions{
+		Stable: ComponentVersion{Version: "v5.14.0", Digest: "sha256:tampered"},
+		Latest: ComponentVersion{Version: "v5.15.0"},
+	})
+	os.Setenv("PLATFORM_UPGRADE_PUBKEY", "/data/cosign.pub")
+	for _, channel := range []string{"stable", "latest"} {
+		_, err := preflightUpgrade(ctx, r, channel, false)
+		if cause, ok := errors.Cause(err).(*httpStatusError); !ok || cause.code != SrsStackErrorImageVerify {
+			t.Errorf("Fail for %v, err %+v", channel, err)
+		}
+	}
+	// The signature is not verified if digest mismatch.
+	if len(signed) != 1 || signed[0] != "docker.io/ossrs/oryx@sha256:latest" {
+		t.Errorf("Fail for signed %v", signed)
+	}
+
+	// Skip the verification by force.
+	if target, err := preflightUpgrade(ctx, r, "stable", true); err != nil || target.Result != UpgradeVerifySkipped {
+		t.Errorf("Fail for target %v, err %+v", target, err)
+	}
+
+	var results []string
+	if err := rangeUpgradeAudits(ctx, func(audit *UpgradeAudit) error {
+		results = append(results, audit.Result)
+		return nil
+	}); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if strings.Join(results, ",") != "skipped,failed,failed,verified,unpinned" {
+		t.Errorf("Fail for results %v", results)
+	}
+}
+
+func TestUpgradeVerify_FetchDigest(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/token":
+			if r.URL.Query().Get("scope") != "repository:ossrs/oryx:pull" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write([]byte(`{"token":"anonymous"}`))
+		case "/v2/ossrs/oryx/manifests/v5.15.0":
+			if r.Header.Get("Authorization") != "Bearer anonymous" {
+				w.Header().Set("Www-Authenticate", fmt.Sprintf(
+					`Bearer realm="%v/token",service="registry",scope="repository:ossrs/oryx:pull"`, server.URL,
+				))
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Docker-Content-Digest", "sha256:latest")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	oldClient := http.DefaultClient
+	http.DefaultClient = server.Client()
+	defer func() {
+		http.DefaultClient = oldClient
+	}()
+
+	image := fmt.Sprintf("%v/ossrs/oryx", strings.TrimPrefix(server.URL, "https://"))
+	if digest, err := fetchImageDigest(ctx, image, "v5.15.0"); err != nil || digest != "sha256:latest" {
+		t.Errorf("Fail for digest %v, err %+v", digest, err)
+	}
+	if _, err := fetchImageDigest(ctx, image, "v0.0.0"); err == nil {
+		t.Errorf("Fail for no manifest")
+	}
+}
@@ -0,0 +1,587 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"sort"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The default and max duration to wait for the live streams to end in drain state.
+const upgradeDrainDefaultWait = 1 * time.Hour
+const upgradeDrainMaxWait = 24 * time.Hour
+
+// The interval to check the live streams in drain state.
+const upgradeDrainInterval = 3 * time.Second
+
+var upgradeDrainWorker *UpgradeDrainWorker
+
+// UpgradeDrain is the drain state before upgrade, new publishes are rejected, and the upgrade proceeds when the last
+// stream ends, or the drain is cancelled when timeout.
+type UpgradeDrain struct {
+	// The start time of drain, in RFC3339.
+	Start string `json:"start"`
+	// The deadline of drain, in RFC3339.
+	Deadline string `json:"deadline"`
+	// The live streams when drain starts.
+	Streams []string `json:"streams"`
+}
+
+func (v *UpgradeDrain) String() string {
+	return fmt.Sprintf("start=%v, deadline=%v, streams=%v", v.Start, v.Deadline, v.Streams)
+}
+
+// The stages of upgrade progress, see UpgradeProgress.
+const (
+	// Waiting for the live streams to end.
+	UpgradeStageDraining = "draining"
+	// The drain is cancelled by API or timeout, terminal.
+	UpgradeStageCancelled = "cancelled"
+	// The upgrade script is started.
+	UpgradeStageUpgrading = "upgrading"
+	// The output of upgrade script.
+	UpgradeStageScript = "script"
+	// The upgrade script is done or failed, terminal.
+	UpgradeStageDone   = "done"
+	UpgradeStageFailed = "failed"
+)
+
+// UpgradeProgress is the progress of upgrade, streamed to UI by /terraform/v1/mgmt/upgrade/progress.
+type UpgradeProgress struct {
+	Stage string `json:"stage"`
+	// The message, for example, the line of script output or the error.
+	Message string `json:"message,omitempty"`
+	// The live streams when draining.
+	Streams []string `json:"streams,omitempty"`
+}
+
+// publishUpgradeProgress notifies the progress of upgrade, which never blocks on the slow clients.
+func publishUpgradeProgress(ctx context.Context, progress *UpgradeProgress, terminal bool) {
+	upgradeProgress.Publish(ctx, progress.Stage, progress, terminal)
+}
+
+// queryUpgradeSafe returns whether the safe upgrade mode is on, which is on by default.
+func queryUpgradeSafe(ctx context.Context) (bool, error) {
+	safe, err := rdb.HGet(ctx, SRS_UPGRADING, "safe").Result()
+	if err != nil && err != redis.Nil {
+		return false, errors.Wrapf(err, "hget %v safe", SRS_UPGRADING)
+	}
+	return safe != "off", nil
+}
+
+// queryUpgradeDrain returns the drain state, or nil if not draining.
+func queryUpgradeDrain(ctx context.Context) (*UpgradeDrain, error) {
+	value, err := rdb.HGet(ctx, SRS_UPGRADING, "drain").Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hget %v drain", SRS_UPGRADING)
+	} else if value == "" {
+		return nil, nil
+	}
+
+	var drain UpgradeDrain
+	if err := json.Unmarshal([]byte(value), &drain); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", value)
+	}
+	return &drain, nil
+}
+
+func cancelUpgradeDrain(ctx context.Context) error {
+	if err := rdb.HDel(ctx, SRS_UPGRADING, "drain").Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hdel %v drain", SRS_UPGRADING)
+	}
+	return nil
+}
+
+// The script to set the upgrading flag only if the fencing token is not newer than ours, which returns the newer
+// fencing token, or 0 if set.
+var upgradeStartScript = redis.NewScript(`local fencing = tonumber(redis.call("hget", KEYS[1], "fencing") or "0")
+if fencing > tonumber(ARGV[1]) then return fencing end
+redis.call("hset", KEYS[1], "upgrading", "1", "fencing", ARGV[1], "start", ARGV[2])
+return 0`)
+
+// errUpgradeNotConfigured returns the error when there is no upgrade script, rather than setting the upgrading flag
+// while nothing upgrades.
+func errUpgradeNotConfigured() error {
+	return newHttpCodeError(http.StatusNotImplemented, SrsStackErrorUpgradeNotConfigured,
+		errors.Errorf("upgrade without PLATFORM_UPGRADE_SCRIPT"),
+	)
+}
+
+// startUpgrade set the upgrading flag, which is cleared when platform restarts, see SelfCheck, and starts the upgrade
+// script. The fencing token of the lock is recorded, to reject a stale holder whose lock is expired and acquired by
+// another replica. The flag is reset if the script fails, because nothing is upgraded.
+func startUpgrade(ctx context.Context, lock *RedisLock) error {
+	if envPlatformUpgradeScript() == "" {
+		return errUpgradeNotConfigured()
+	}
+
+	// Check the fencing token and set the flag in one script, so a stale holder never overwrites the flag after the
+	// newer holder checked. The start time is to detect the upgrade which is stuck, see alertUpgradeStuck.
+	start := time.Now().Format(time.RFC3339)
+	if fencing, err := upgradeStartScript.Run(ctx, rdb, []string{SRS_UPGRADING}, lock.State.Token, start).Int64(); err != nil {
+		return errors.Wrapf(err, "start %v fencing %v start %v", SRS_UPGRADING, lock.State.Token, start)
+	} else if fencing > 0 {
+		return errors.Errorf("stale lock %v, fencing %v", lock.State.String(), fencing)
+	}
+
+	// The containers are replaced by upgrade.
+	if conf.DeployMode != DeployModeHost {
+		invalidateContainerStates(ctx)
+	}
+
+	publishUpgradeProgress(ctx, &UpgradeProgress{Stage: UpgradeStageUpgrading}, false)
+	if err := runUpgradeScript(ctx); err != nil {
+		failUpgrade(ctx, err)
+		return errors.Wrapf(err, "run upgrade script")
+	}
+	return nil
+}
+
+// failUpgrade resets the upgrading flag and notifies the failure of upgrade.
+func failUpgrade(ctx context.Context, err error) {
+	if r0 := rdb.HSet(ctx, SRS_UPGRADING, "upgrading", "0").Err(); r0 != nil && r0 != redis.Nil {
+		logger.Wf(ctx, "upgrade: ignore reset upgrading err %+v", r0)
+	}
+	publishEvent(ctx, &UpgradeFailedEvent{Version: version, Error: err.Error()})
+	publishUpgradeProgress(ctx, &UpgradeProgress{Stage: UpgradeStageFailed, Message: err.Error()}, true)
+}
+
+// runUpgradeScript starts the upgrade script, which should pull the image or package, then upgrade and restart the
+// services, so we never wait for it. Note that the platform might be restarted by script, so the done of script is not
+// always reported, and the upgrading flag is cleared by SelfCheck.
+func runUpgradeScript(ctx context.Context) error {
+	script := envPlatformUpgradeScript()
+
+	// Stream the output of script as the progress of upgrade.
+	pr, pw := io.Pipe()
+	cmd := exec.Command(script)
+	cmd.Dir = conf.Pwd
+
+	// Pass the verified image to script, which should pull it by digest if set.
+	cmd.Env = append(os.Environ(), fmt.Sprintf("ORYX_DEPLOY_MODE=%v", conf.DeployMode))
+	if target, err := queryUpgradeTarget(ctx); err != nil {
+		return errors.Wrapf(err, "query target")
+	} else if target != nil {
+		cmd.Env = append(cmd.Env,
+			fmt.Sprintf("ORYX_UPGRADE_VERSION=%v", target.Version),
+			fmt.Sprintf("ORYX_UPGRADE_IMAGE=%v", target.Reference()),
+		)
+	}
+	cmd.Stdout, cmd.Stderr = pw, pw
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return errors.Wrapf(err, "start %v", script)
+	}
+
+	// The script outlives the request, so it reports the progress in a context never cancelled.
+	ctx = logger.AliasContext(context.Background(), ctx)
+
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			publishUpgradeProgress(ctx, &UpgradeProgress{Stage: UpgradeStageScript, Message: scanner.Text()}, false)
+		}
+		// Drain the rest if the line is too long, to never block the script.
+		io.Copy(ioutil.Discard, pr)
+	}()
+
+	go func() {
+		err := cmd.Wait()
+		pw.Close()
+		logger.Tf(ctx, "upgrade script %v done, pid=%v, err=%v", script, cmd.Process.Pid, err)
+
+		if err != nil {
+			failUpgrade(ctx, errors.Wrapf(err, "run %v", script))
+		} else {
+			publishUpgradeProgress(ctx, &UpgradeProgress{Stage: UpgradeStageDone}, true)
+		}
+	}()
+	logger.Tf(ctx, "upgrade script %v started, pid=%v", script, cmd.Process.Pid)
+	return nil
+}
+
+// queryLiveStreams returns the URL of publishing streams, sorted.
+func queryLiveStreams(ctx context.Context) ([]string, error) {
+	streams, err := rdb.HGetAll(ctx, SRS_STREAM_ACTIVE).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STREAM_ACTIVE)
+	}
+
+	urls := make([]string, 0, len(streams))
+	for streamURL := range streams {
+		urls = append(urls, streamURL)
+	}
+	sort.Strings(urls)
+	return urls, nil
+}
+
+// verifyUpgradeDrain rejects the new publish when draining for upgrade.
+func verifyUpgradeDrain(ctx context.Context) error {
+	if drain, err := queryUpgradeDrain(ctx); err != nil {
+		return errors.Wrapf(err, "query drain")
+	} else if drain != nil {
+		return errors.Errorf("draining for upgrade, %v", drain.String())
+	}
+	return nil
+}
+
+// UpgradeDrainWorker starts the upgrade when all streams end in drain state, or cancel the drain when timeout. Note
+// that the drain state is in redis, so it resumes after platform restarts.
+type UpgradeDrainWorker struct {
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewUpgradeDrainWorker() *UpgradeDrainWorker {
+	return &UpgradeDrainWorker{}
+}
+
+func (v *UpgradeDrainWorker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *UpgradeDrainWorker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "upgrade: start a drain worker")
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		safeRestart(ctx, func() {
+			for ctx.Err() == nil {
+				if err := v.checkDrain(ctx, time.Now()); err != nil {
+					logger.Wf(ctx, "upgrade: ignore err %+v", err)
+				}
+
+				select {
+				case <-ctx.Done():
+				case <-time.After(upgradeDrainInterval):
+				}
+			}
+		})
+	}()
+
+	return nil
+}
+
+func (v *UpgradeDrainWorker) checkDrain(ctx context.Context, t time.Time) error {
+	drain, err := queryUpgradeDrain(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query drain")
+	} else if drain == nil {
+		return nil
+	}
+
+	streams, err := queryLiveStreams(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query streams")
+	}
+
+	if len(streams) == 0 {
+		// The drain worker runs on each platform replica, so only the lock holder starts the upgrade.
+		return withRedisLock(ctx, SRS_LOCK_UPGRADE, func(ctx context.Context, lock *RedisLock) error {
+			if err := cancelUpgradeDrain(ctx); err != nil {
+				return errors.Wrapf(err, "cancel drain")
+			}
+			if err := startUpgrade(ctx, lock); err != nil {
+				return errors.Wrapf(err, "start upgrade")
+			}
+			logger.Tf(ctx, "upgrade: all streams end, start upgrade, %v", drain.String())
+			return nil
+		})
+	}
+
+	if deadline, err := time.Parse(time.RFC3339, drain.Deadline); err != nil || t.After(deadline) {
+		if err := cancelUpgradeDrain(ctx); err != nil {
+			return errors.Wrapf(err, "cancel drain")
+		}
+		publishUpgradeProgress(ctx, &UpgradeProgress{
+			Stage: UpgradeStageCancelled, Message: "timeout", Streams: streams,
+		}, true)
+		logger.Wf(ctx, "upgrade: cancel drain for timeout, %v, live streams %v", drain.String(), streams)
+		return nil
+	}
+
+	publishUpgradeProgress(ctx, &UpgradeProgress{Stage: UpgradeStageDraining, Streams: streams}, false)
+	return nil
+}
+
+func handleMgmtUpgrade(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/upgrade"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, channel string
+			var force, drain, skipVerification bool
+			var maxWait int
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				// Whether upgrade even there are live streams.
+				Force *bool `json:"force"`
+				// Whether to wait for the live streams to end, and reject new publishes.
+				Drain *bool `json:"drain"`
+				// The max duration in seconds to wait in drain state.
+				MaxWait *int `json:"maxWait"`
+				// The release channel to upgrade to, stable or latest, default to latest.
+				Channel *string `json:"channel"`
+				// Whether to skip the verification of image digest and signature, never recommended.
+				SkipVerification *bool `json:"skipVerification"`
+			}{
+				Token: &token, Force: &force, Drain: &drain, MaxWait: &maxWait,
+				Channel: &channel, SkipVerification: &skipVerification,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// Fail early without the upgrade script, rather than after drain.
+			if envPlatformUpgradeScript() == "" {
+				return errUpgradeNotConfigured()
+			}
+
+			// Verify the image before drain, so the live streams are never interrupted for a bad image.
+			target, err := preflightUpgrade(ctx, r, channel, skipVerification)
+			if err != nil {
+				return errors.Wrapf(err, "preflight")
+			}
+
+			// Only one platform replica is allowed to upgrade, the others get the holder of lock.
+			return withRedisLock(ctx, SRS_LOCK_UPGRADE, func(ctx context.Context, lock *RedisLock) error {
+				safe, err := queryUpgradeSafe(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "query safe")
+				}
+
+				// The upgrade pulls the image by the verified target, also when started by the drain worker.
+				if b, err := json.Marshal(target); err != nil {
+					return errors.Wrapf(err, "marshal %v", target.String())
+				} else if err := rdb.HSet(ctx, SRS_UPGRADING, "target", string(b)).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v target %v", SRS_UPGRADING, string(b))
+				}
+
+				streams, err := queryLiveStreams(ctx)
+				if err != nil {
+					return errors.Wrapf(err, "query streams")
+				}
+
+				if !safe || force || len(streams) == 0 {
+					if err := cancelUpgradeDrain(ctx); err != nil {
+						return errors.Wrapf(err, "cancel drain")
+					}
+					if err := startUpgrade(ctx, lock); err != nil {
+						return errors.Wrapf(err, "start upgrade")
+					}
+
+					httpWriteData(ctx, w, r, &struct {
+						Upgrading bool           `json:"upgrading"`
+						Target    *UpgradeTarget `json:"target"`
+					}{
+						Upgrading: true, Target: target,
+					})
+					logger.Tf(ctx, "upgrade start ok, safe=%v, force=%v, streams=%v, %v, token=%vB",
+						safe, force, streams, target.String(), len(token))
+					return nil
+				}
+
+				if !drain {
+					return newHttpCodeError(http.StatusConflict, SrsStackErrorStreamsLive,
+						errors.Errorf("%v live streams %v", len(streams), streams),
+					)
+				}
+
+				wait := upgradeDrainDefaultWait
+				if maxWait > 0 {
+					wait = time.Duration(maxWait) * time.Second
+				}
+				if wait > upgradeDrainMaxWait {
+					return errors.Errorf("max wait %v exceeds %v", wait, upgradeDrainMaxWait)
+				}
+
+				now := time.Now()
+				state := &UpgradeDrain{
+					Start: now.Format(time.RFC3339), Deadline: now.Add(wait).Format(time.RFC3339), Streams: streams,
+				}
+				if b, err := json.Marshal(state); err != nil {
+					return errors.Wrapf(err, "marshal %v", state.String())
+				} else if err := rdb.HSet(ctx, SRS_UPGRADING, "drain", string(b)).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v drain %v", SRS_UPGRADING, string(b))
+				}
+				publishUpgradeProgress(ctx, &UpgradeProgress{Stage: UpgradeStageDraining, Streams: streams}, false)
+
+				httpWriteData(ctx, w, r, &struct {
+					Upgrading bool           `json:"upgrading"`
+					Drain     *UpgradeDrain  `json:"drain"`
+					Target    *UpgradeTarget `json:"target"`
+				}{
+					Upgrading: false, Drain: state, Target: target,
+				})
+				logger.Tf(ctx, "upgrade drain ok, %v, token=%vB", state.String(), len(token))
+				return nil
+			})
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/upgrade/cancel"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			drain, err := queryUpgradeDrain(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query drain")
+			}
+
+			if err := cancelUpgradeDrain(ctx); err != nil {
+				return errors.Wrapf(err, "cancel drain")
+			}
+			if drain != nil {
+				publishUpgradeProgress(ctx, &UpgradeProgress{Stage: UpgradeStageCancelled, Message: "cancelled by API"}, true)
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "upgrade cancel drain ok, draining=%v, token=%vB", drain != nil, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/upgrade/safe"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			var enabled *bool
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				// Update the safe mode if set, or query it.
+				Enabled **bool `json:"enabled"`
+			}{
+				Token: &token, Enabled: &enabled,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if enabled != nil {
+				safe := "off"
+				if *enabled {
+					safe = "on"
+				}
+				if err := rdb.HSet(ctx, SRS_UPGRADING, "safe", safe).Err(); err != nil && err != redis.Nil {
+					return errors.Wrapf(err, "hset %v safe %v", SRS_UPGRADING, safe)
+				}
+			}
+
+			safe, err := queryUpgradeSafe(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query safe")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Enabled bool `json:"enabled"`
+			}{
+				Enabled: safe,
+			})
+			logger.Tf(ctx, "upgrade safe mode ok, update=%v, enabled=%v, token=%vB", enabled != nil, safe, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/mgmt/upgrade/audit"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			aw := NewJSONArrayWriter(w, "audits")
+			if err := rangeUpgradeAudits(ctx, func(audit *UpgradeAudit) error {
+				return aw.Write(audit)
+			}); err != nil {
+				return errors.Wrapf(err, "range audits")
+			}
+			if err := aw.Close(); err != nil {
+				return errors.Wrapf(err, "close")
+			}
+			logger.Tf(ctx, "upgrade audit query ok, audits=%v, token=%vB", aw.Elements(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
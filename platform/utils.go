@@ -6,12 +6,18 @@ package main
 import (
 	"bufio"
 	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
 	"math/rand"
+	"mime"
 	"net"
 	"net/http"
 	"net/http/httputil"
@@ -21,12 +27,14 @@ import (
 	"path"
 	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/ossrs/go-oryx-lib/errors"
+	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
@@ -34,17 +42,79 @@ import (
 	"github.com/golang-jwt/jwt/v4"
 )
 
-// Versions is latest and stable version from Oryx API.
+// ComponentVersion is the version of a component or a release channel.
+type ComponentVersion struct {
+	// The version, for example, v5.14.0
+	Version string `json:"version"`
+	// The publish time in RFC3339, empty if unknown.
+	PublishedAt string `json:"publishedAt,omitempty"`
+	// The URL of release notes, empty if unknown.
+	NotesURL string `json:"notesUrl,omitempty"`
+	// The summary of release, nil if failed to fetch the release notes.
+	Release *ReleaseSummary `json:"release,omitempty"`
+	// The expected digest of image, for example, sha256:xxx, empty if not pinned.
+	Digest string `json:"digest,omitempty"`
+}
+
+func (v ComponentVersion) String() string {
+	if v.Version == "" {
+		return "unknown"
+	}
+	if v.PublishedAt == "" {
+		return v.Version
+	}
+	// Only the date of publish time, for human to read.
+	if t, err := time.Parse(time.RFC3339, v.PublishedAt); err == nil {
+		return fmt.Sprintf("%v (%v)", v.Version, t.Format("2006-01-02"))
+	}
+	return fmt.Sprintf("%v (%v)", v.Version, v.PublishedAt)
+}
+
+// Versions is the version of each component, and the latest and stable release channel of Oryx.
 type Versions struct {
+	// The stable and latest release channel of Oryx, to prompt for upgrade.
+	Stable ComponentVersion `json:"stable"`
+	Latest ComponentVersion `json:"latest"`
+	// The version of the releases API service.
+	API ComponentVersion `json:"api"`
+	// The version of the running platform.
+	Platform ComponentVersion `json:"platform"`
+}
+
+func (v Versions) String() string {
+	return fmt.Sprintf("platform %v, stable %v, latest %v, api %v", v.Platform, v.Stable, v.Latest, v.API)
+}
+
+// VersionsCompatible is the versions in the shape of previous releases, for the existing endpoints and UI.
+type VersionsCompatible struct {
 	Version string `json:"version"`
 	Stable  string `json:"stable"`
 	Latest  string `json:"latest"`
+	// The summary of latest and stable release, nil if failed to fetch the release notes.
+	LatestRelease *ReleaseSummary `json:"latestRelease,omitempty"`
+	StableRelease *ReleaseSummary `json:"stableRelease,omitempty"`
 }
 
-func (v Versions) String() string {
-	return fmt.Sprintf("version=%v, latest=%v, stable=%v", v.Version, v.Latest, v.Stable)
+// Compatible returns the versions in the shape of previous releases.
+func (v Versions) Compatible() *VersionsCompatible {
+	return &VersionsCompatible{
+		Version: v.Platform.Version, Stable: v.Stable.Version, Latest: v.Latest.Version,
+		LatestRelease: v.Latest.Release, StableRelease: v.Stable.Release,
+	}
 }
 
+// ApiSecretSource is where the api secret SRS_PLATFORM_SECRET came from.
+type ApiSecretSource string
+
+const (
+	// The secret is loaded from redis, which is the source of truth.
+	ApiSecretSourceRedis ApiSecretSource = "redis"
+	// The secret is loaded from env, and saved to redis, because redis has no secret.
+	ApiSecretSourceEnv ApiSecretSource = "env"
+	// The secret is generated, because neither redis nor env has the secret.
+	ApiSecretSourceGenerated ApiSecretSource = "generated"
+)
+
 // Config is for configuration.
 // TODO: FIXME: Should be merged to mgmt.
 type Config struct {
@@ -52,40 +122,124 @@ type Config struct {
 	// Current working directory, at xxx/oryx/platform.
 	Pwd string
 
-	Cloud    string
-	Region   string
-	Source   string
-	Registry string
+	Cloud  string
+	Source string
+
+	// The region and registry, which might be updated at runtime, for example, when the instance is migrated to
+	// another region, so we must use the lock, see Region and SetRegion.
+	region   string
+	registry string
 
-	// Discover by iface.
+	// Discover by iface, which is refreshed in background, see SetIPv4.
 	ipv4  net.IP
-	Iface string
+	iface string
 
-	// The latest and stable version from Oryx API.
-	Versions Versions
+	// The latest and stable version from Oryx API, which is refreshed in background, see Versions and SetVersions.
+	versions Versions
+	// The last time the versions is refreshed successfully.
+	versionsRefreshed time.Time
+
+	// The lock for the fields updated at runtime, while read by handlers in other goroutines.
+	lock sync.RWMutex
+
+	// Where the api secret came from, see initApiSecret.
+	SecretSource ApiSecretSource
+	// The effective directory of UI, empty if UI is not built, see resolveUIRoot.
+	UIRoot string
+	// The deploy mode, docker or host, see detectDeployMode.
+	DeployMode DeployMode
 }
 
 func NewConfig() *Config {
 	return &Config{
 		ipv4:     net.IPv4zero,
 		IsDarwin: runtime.GOOS == "darwin",
-		Versions: Versions{
-			Version: "v0.0.0",
-			Latest:  "v0.0.0",
-			Stable:  "v0.0.0",
+		versions: Versions{
+			Platform: ComponentVersion{Version: "v0.0.0"},
+			Latest:   ComponentVersion{Version: "v0.0.0"},
+			Stable:   ComponentVersion{Version: "v0.0.0"},
 		},
 	}
 }
 
+// Versions returns a copy of the latest and stable version.
+func (v *Config) Versions() Versions {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.versions
+}
+
+// VersionsRefreshed returns the last time the versions is refreshed, zero if never.
+func (v *Config) VersionsRefreshed() time.Time {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.versionsRefreshed
+}
+
+// SetVersions updates the versions, and the refreshed time.
+func (v *Config) SetVersions(versions *Versions) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.versions, v.versionsRefreshed = *versions, time.Now()
+}
+
+func (v *Config) Region() string {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.region
+}
+
+func (v *Config) SetRegion(region string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.region = region
+}
+
+func (v *Config) Registry() string {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.registry
+}
+
+func (v *Config) SetRegistry(registry string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.registry = registry
+}
+
+// IPv4Addr returns a copy of the private ipv4, never nil.
+func (v *Config) IPv4Addr() net.IP {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	if v.ipv4 == nil {
+		return net.IPv4zero
+	}
+	return append(net.IP{}, v.ipv4...)
+}
+
 func (v *Config) IPv4() string {
-	return v.ipv4.String()
+	return v.IPv4Addr().String()
+}
+
+func (v *Config) Iface() string {
+	v.lock.RLock()
+	defer v.lock.RUnlock()
+	return v.iface
+}
+
+// SetIPv4 updates the private ipv4 and the iface it's discovered by.
+func (v *Config) SetIPv4(iface string, ipv4 net.IP) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	v.iface, v.ipv4 = iface, ipv4
 }
 
 func (v *Config) String() string {
+	versions := v.Versions()
 	return fmt.Sprintf("darwin=%v, cloud=%v, region=%v, source=%v, registry=%v, iface=%v, ipv4=%v, pwd=%v, "+
 		"mgmtPwd=%v, version=%v, latest=%v, stable=%v",
-		v.IsDarwin, v.Cloud, v.Region, v.Source, v.Registry, v.Iface, v.IPv4(), v.Pwd, v.Pwd, v.Versions.Version,
-		v.Versions.Latest, v.Versions.Stable,
+		v.IsDarwin, v.Cloud, v.Region(), v.Source, v.Registry(), v.Iface(), v.IPv4(), v.Pwd, v.Pwd, versions.Platform.Version,
+		versions.Latest.Version, versions.Stable.Version,
 	)
 }
 
@@ -120,13 +274,13 @@ func discoverRegion(ctx context.Context) (cloud, region string, err error) {
 	defer wg.Wait()
 
 	discoverCtx, discoverCancel := context.WithCancel(ctx)
-	result := make(chan Config, 2)
+	result := make(chan *Config, 2)
 
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
 
-		res, err := http.Get("http://metadata.tencentyun.com/latest/meta-data/placement/region")
+		res, err := cloudMetadataClient.Get(tencentMetadataURL + "/placement/region")
 		if err != nil {
 			logger.Tf(ctx, "Ignore tencent region err %v", err)
 			return
@@ -141,7 +295,7 @@ func discoverRegion(ctx context.Context) (cloud, region string, err error) {
 
 		select {
 		case <-discoverCtx.Done():
-		case result <- Config{Cloud: "TENCENT", Region: string(b)}:
+		case result <- &Config{Cloud: "TENCENT", region: string(b)}:
 			discoverCancel()
 		}
 	}()
@@ -151,7 +305,7 @@ func discoverRegion(ctx context.Context) (cloud, region string, err error) {
 		defer wg.Done()
 
 		// See https://docs.digitalocean.com/reference/api/metadata-api/#operation/getRegion
-		res, err := http.Get("http://169.254.169.254/metadata/v1/region")
+		res, err := cloudMetadataClient.Get(doMetadataURL + "/region")
 		if err != nil {
 			logger.Tf(ctx, "Ignore do region err %v", err)
 			return
@@ -166,15 +320,29 @@ func discoverRegion(ctx context.Context) (cloud, region string, err error) {
 
 		select {
 		case <-discoverCtx.Done():
-		case result <- Config{Cloud: "DO", Region: string(b)}:
+		case result <- &Config{Cloud: "DO", region: string(b)}:
 			discoverCancel()
 		}
 	}()
 
+	// Quit when all probes failed, for example, the bare metal without metadata service.
+	probed := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(probed)
+	}()
+
 	select {
 	case <-ctx.Done():
 	case r := <-result:
-		return r.Cloud, r.Region, nil
+		return r.Cloud, r.Region(), nil
+	case <-probed:
+		select {
+		case r := <-result:
+			return r.Cloud, r.Region(), nil
+		default:
+			logger.Tf(ctx, "Initialize no cloud metadata, might be bare metal")
+		}
 	}
 	return
 }
@@ -221,7 +389,7 @@ func discoverPlatform(ctx context.Context, cloud string) (platform string, err e
 	}
 
 	// Discover CVM or lighthouse.
-	res, err := http.Get("http://metadata.tencentyun.com/latest/meta-data/instance-name")
+	res, err := cloudMetadataClient.Get(tencentMetadataURL + "/instance-name")
 	if err != nil {
 		logger.Tf(ctx, "Ignore tencent platform err %v", err)
 		return "dev", nil
@@ -252,9 +420,15 @@ const srsDevDockerName = "srs-dev"
 const (
 	// For LightHouse information, like region or source.
 	SRS_TENCENT_LH = "SRS_TENCENT_LH"
+	// For the normalized cloud metadata, like provider or instance id.
+	SRS_CLOUD_METADATA = "SRS_CLOUD_METADATA"
 	// For SRS stream status.
 	SRS_HP_HLS = "SRS_HP_HLS"
 	SRS_LL_HLS = "SRS_LL_HLS"
+	// For the HLS latency profile of each stream.
+	SRS_HLS_PROFILE = "SRS_HLS_PROFILE"
+	// For the HLS time-shift of each stream, the max duration to rewind.
+	SRS_HLS_TIMESHIFT = "SRS_HLS_TIMESHIFT"
 	// For tencent cloud products.
 	SRS_TENCENT_CAM = "SRS_TENCENT_CAM"
 	SRS_TENCENT_COS = "SRS_TENCENT_COS"
@@ -263,6 +437,22 @@ const (
 	SRS_RECORD_PATTERNS      = "SRS_RECORD_PATTERNS"
 	SRS_RECORD_M3U8_WORKING  = "SRS_RECORD_M3U8_WORKING"
 	SRS_RECORD_M3U8_ARTIFACT = "SRS_RECORD_M3U8_ARTIFACT"
+	SRS_RECORD_CLIP          = "SRS_RECORD_CLIP"
+	// The user metadata of recordings, and the index of label, which is a set of UUID, the key is SRS_RECORD_LABEL:label
+	SRS_RECORD_METADATA = "SRS_RECORD_METADATA"
+	SRS_RECORD_LABEL    = "SRS_RECORD_LABEL"
+	// The retention policies of streams and labels, and the audit log of deletions by retention.
+	SRS_RECORD_RETENTION       = "SRS_RECORD_RETENTION"
+	SRS_RECORD_RETENTION_AUDIT = "SRS_RECORD_RETENTION_AUDIT"
+	// The last job to verify the checksums of recordings and vLive files.
+	SRS_RECORD_VERIFY = "SRS_RECORD_VERIFY"
+	// The exports of recordings to cloud VOD, and the index from file id of VOD to UUID.
+	SRS_RECORD_EXPORT      = "SRS_RECORD_EXPORT"
+	SRS_RECORD_EXPORT_FILE = "SRS_RECORD_EXPORT_FILE"
+	// The queue of recordings to generate the thumbnail sprites and WebVTT.
+	SRS_RECORD_PREVIEW = "SRS_RECORD_PREVIEW"
+	// For storage driver of recordings and uploads.
+	SRS_STORAGE = "SRS_STORAGE"
 	// For cloud storage.
 	SRS_DVR_PATTERNS      = "SRS_DVR_PATTERNS"
 	SRS_DVR_M3U8_WORKING  = "SRS_DVR_M3U8_WORKING"
@@ -276,12 +466,23 @@ const (
 	// For stream forwarding by FFmpeg.
 	SRS_FORWARD_CONFIG = "SRS_FORWARD_CONFIG"
 	SRS_FORWARD_TASK   = "SRS_FORWARD_TASK"
+	// The templates of forward destinations, override or extend the builtin ones.
+	SRS_FORWARD_TEMPLATES = "SRS_FORWARD_TEMPLATES"
+	// The rules to forward the published streams matched by pattern, key is the name of rule.
+	SRS_FORWARD_RULES = "SRS_FORWARD_RULES"
+	// The API integrations of forward destinations, key is the platform, to update the metadata of broadcast.
+	SRS_FORWARD_INTEGRATIONS = "SRS_FORWARD_INTEGRATIONS"
 	// For virtual live channel/stream.
 	SRS_VLIVE_CONFIG = "SRS_VLIVE_CONFIG"
 	SRS_VLIVE_TASK   = "SRS_VLIVE_TASK"
+	SRS_VLIVE_IMPORT = "SRS_VLIVE_IMPORT"
 	// For IP camera live channel/stream.
 	SRS_CAMERA_CONFIG = "SRS_CAMERA_CONFIG"
 	SRS_CAMERA_TASK   = "SRS_CAMERA_TASK"
+	// For relay, pull stream from other origin on demand.
+	SRS_RELAY_CONFIG  = "SRS_RELAY_CONFIG"
+	SRS_RELAY_TASK    = "SRS_RELAY_TASK"
+	SRS_RELAY_VIEWERS = "SRS_RELAY_VIEWERS"
 	// For transcoding.
 	SRS_TRANSCODE_CONFIG = "SRS_TRANSCODE_CONFIG"
 	SRS_TRANSCODE_TASK   = "SRS_TRANSCODE_TASK"
@@ -295,10 +496,33 @@ const (
 	SRS_STREAM_ACTIVE     = "SRS_STREAM_ACTIVE"
 	SRS_STREAM_SRT_ACTIVE = "SRS_STREAM_SRT_ACTIVE"
 	SRS_STREAM_RTC_ACTIVE = "SRS_STREAM_RTC_ACTIVE"
+	SRS_STREAM_SCHEDULE   = "SRS_STREAM_SCHEDULE"
+	// The quotas of stream keys, key is the stream name, and the events of violations.
+	SRS_STREAM_QUOTA        = "SRS_STREAM_QUOTA"
+	SRS_STREAM_QUOTA_EVENTS = "SRS_STREAM_QUOTA_EVENTS"
+	// The metadata of streams, key is the stream name, for example, the title of broadcast of forward destinations.
+	SRS_STREAM_METADATA = "SRS_STREAM_METADATA"
+	SRS_STREAM_HEALTH   = "SRS_STREAM_HEALTH"
+
+	SRS_STREAM_GUEST         = "SRS_STREAM_GUEST"
+	SRS_STREAM_GUEST_SESSION = "SRS_STREAM_GUEST_SESSION"
+	// The aliases of streams, key is the logical stream URL, the runtime state and the failover history.
+	SRS_STREAM_ALIAS         = "SRS_STREAM_ALIAS"
+	SRS_STREAM_ALIAS_TASK    = "SRS_STREAM_ALIAS_TASK"
+	SRS_STREAM_ALIAS_HISTORY = "SRS_STREAM_ALIAS_HISTORY"
+	// The event bus, a redis stream consumed by the sinks in consumer groups.
+	SRS_EVENT_BUS = "SRS_EVENT_BUS"
+	// The naming policy of streams, and the grandfathered names violating the policy.
+	SRS_STREAM_NAMING            = "SRS_STREAM_NAMING"
+	SRS_STREAM_NAMING_EXCEPTIONS = "SRS_STREAM_NAMING_EXCEPTIONS"
 	// For feature statistics.
 	SRS_STAT_COUNTER = "SRS_STAT_COUNTER"
+	// For diagnostics capture mode.
+	SRS_DIAGNOSTICS          = "SRS_DIAGNOSTICS"
+	SRS_DIAGNOSTICS_CAPTURES = "SRS_DIAGNOSTICS_CAPTURES"
 	// For container and images.
 	SRS_CONTAINER_DISABLED = "SRS_CONTAINER_DISABLED"
+	SRS_CONTAINER_STATES   = "SRS_CONTAINER_STATES"
 	// For live stream and rooms.
 	SRS_LIVE_ROOM = "SRS_LIVE_ROOM"
 	// For dubbing service.
@@ -307,19 +531,71 @@ const (
 	// About authentication.
 	SRS_AUTH_SECRET    = "SRS_AUTH_SECRET"
 	SRS_SECRET_PUBLISH = "SRS_SECRET_PUBLISH"
+	SRS_DOWNLOAD_TOKEN = "SRS_DOWNLOAD_TOKEN"
+	SRS_PUBLISH_AUDIT  = "SRS_PUBLISH_AUDIT"
+	// The shared secret for SRS to callback, and the callbacks seen by fingerprint of secret.
+	SRS_HOOKS_SECRET      = "SRS_HOOKS_SECRET"
+	SRS_HOOKS_SECRET_SEEN = "SRS_HOOKS_SECRET_SEEN"
+	// The audit log of querying the api secret.
+	SRS_SECRET_AUDIT = "SRS_SECRET_AUDIT"
+	// The one-time code to confirm factory reset, and the audit log of resets of subsystems.
+	SRS_RESET_CODE  = "SRS_RESET_CODE"
+	SRS_RESET_AUDIT = "SRS_RESET_AUDIT"
+	// The admin email and one-time code to recover the password, and the audit log of recovery.
+	SRS_ADMIN_EMAIL   = "SRS_ADMIN_EMAIL"
+	SRS_RECOVER_CODE  = "SRS_RECOVER_CODE"
+	SRS_RECOVER_AUDIT = "SRS_RECOVER_AUDIT"
+	// For custom HTTP redirects and short links.
+	SRS_REDIRECTS     = "SRS_REDIRECTS"
+	SRS_REDIRECT_HITS = "SRS_REDIRECT_HITS"
 	// For system settings.
 	SRS_LOCALE          = "SRS_LOCALE"
 	SRS_FIRST_BOOT      = "SRS_FIRST_BOOT"
 	SRS_UPGRADING       = "SRS_UPGRADING"
 	SRS_UPGRADE_WINDOW  = "SRS_UPGRADE_WINDOW"
+	SRS_UPGRADE_AUDIT   = "SRS_UPGRADE_AUDIT"
+	SRS_RELEASE_NOTES   = "SRS_RELEASE_NOTES"
+	SRS_TASK_HISTORY    = "SRS_TASK_HISTORY"
+	SRS_ALERTS          = "SRS_ALERTS"
+	SRS_ALERT_SETTINGS  = "SRS_ALERT_SETTINGS"
+	SRS_SELF_CHECK      = "SRS_SELF_CHECK"
 	SRS_PLATFORM_SECRET = "SRS_PLATFORM_SECRET"
 	SRS_CACHE_BILIBILI  = "SRS_CACHE_BILIBILI"
-	SRS_BEIAN           = "SRS_BEIAN"
-	SRS_HTTPS           = "SRS_HTTPS"
-	SRS_HTTPS_DOMAIN    = "SRS_HTTPS_DOMAIN"
-	SRS_HOOKS           = "SRS_HOOKS"
-	SRS_SYS_LIMITS      = "SRS_SYS_LIMITS"
-	SRS_SYS_OPENAI      = "SRS_SYS_OPENAI"
+	// The access time of bilibili cache, for LRU eviction.
+	SRS_CACHE_BILIBILI_LRU = "SRS_CACHE_BILIBILI_LRU"
+	SRS_BEIAN              = "SRS_BEIAN"
+	SRS_MOTD               = "SRS_MOTD"
+	SRS_PLAYBACK           = "SRS_PLAYBACK"
+	SRS_HTTPS              = "SRS_HTTPS"
+	SRS_HTTPS_DOMAIN       = "SRS_HTTPS_DOMAIN"
+	SRS_HTTPS_CERTBOT      = "SRS_HTTPS_CERTBOT"
+	SRS_RTC_CANDIDATE      = "SRS_RTC_CANDIDATE"
+	SRS_HOOKS              = "SRS_HOOKS"
+	SRS_SYS_LIMITS         = "SRS_SYS_LIMITS"
+	SRS_SYS_OPENAI         = "SRS_SYS_OPENAI"
+	SRS_FEATURES           = "SRS_FEATURES"
+	SRS_PUBLIC_STATUS      = "SRS_PUBLIC_STATUS"
+	SRS_NGINX_STATUS       = "SRS_NGINX_STATUS"
+	SRS_NGINX_RELOADS      = "SRS_NGINX_RELOADS"
+	// For viewers of streams.
+	SRS_STAT_VIEWERS         = "SRS_STAT_VIEWERS"
+	SRS_STAT_VIEWERS_STREAMS = "SRS_STAT_VIEWERS_STREAMS"
+	SRS_STAT_VIEWERS_CURRENT = "SRS_STAT_VIEWERS_CURRENT"
+	SRS_STAT_VIEWERS_HLS     = "SRS_STAT_VIEWERS_HLS"
+	SRS_STAT_VIEWERS_UNIQUE  = "SRS_STAT_VIEWERS_UNIQUE"
+	SRS_STAT_VIEWERS_SAMPLE  = "SRS_STAT_VIEWERS_SAMPLE"
+	// For remote nodes of cluster.
+	SRS_CLUSTER_NODES  = "SRS_CLUSTER_NODES"
+	SRS_CLUSTER_HEALTH = "SRS_CLUSTER_HEALTH"
+	// For the dedicated key of token introspection.
+	SRS_TOKEN_INTROSPECT = "SRS_TOKEN_INTROSPECT"
+	// For distributed locks between platform replicas.
+	SRS_LOCK_UPGRADE = "SRS_LOCK_UPGRADE"
+	SRS_LOCK_NGINX   = "SRS_LOCK_NGINX"
+	SRS_LOCK_FENCING = "SRS_LOCK_FENCING"
+	// For data migrations.
+	SRS_LOCK_MIGRATION    = "SRS_LOCK_MIGRATION"
+	SRS_SCHEMA_MIGRATIONS = "SRS_SCHEMA_MIGRATIONS"
 )
 
 // GenerateRoomPublishKey to build the redis hashset key from room stream name.
@@ -347,11 +623,13 @@ const FFprobeSourceTypeUpload FFprobeSourceType = "upload"
 const FFprobeSourceTypeFile FFprobeSourceType = "file"
 const FFprobeSourceTypeYTDL FFprobeSourceType = "ytdl"
 const FFprobeSourceTypeStream FFprobeSourceType = "stream"
+const FFprobeSourceTypePlatformURL FFprobeSourceType = "platform-url"
 
 // For vLive upload directory.
 var dirUploadPath = path.Join(".", "upload")
 var dirVLivePath = path.Join(".", "vlive")
 var dirDubbingPath = path.Join(".", "dub")
+var dirTimeShiftPath = path.Join(".", "containers/objs/nginx/html/timeshift")
 
 // For Oryx to use the files.
 const serverDataDirectory = "/data"
@@ -362,6 +640,21 @@ var serverAllowVideoFiles []string = []string{".mp4", ".flv", ".ts", ".mkv", ".m
 // The audio files allowed to use by Oryx.
 var serverAllowAudioFiles []string = []string{".mp3", ".aac", ".m4a"}
 
+// The min length of api secret, the generated secret is about 39 bytes.
+const apiSecretMinLength = 16
+
+// checkApiSecret returns error if the api secret is empty or shorter than apiSecretMinLength, because the tokens signed
+// by a weak secret are easy to forge. It should be checked before signing or verifying tokens.
+func checkApiSecret(apiSecret string) error {
+	if apiSecret == "" {
+		return errors.New("no api secret")
+	}
+	if len(apiSecret) < apiSecretMinLength {
+		return errors.Errorf("api secret %vB is shorter than %vB", len(apiSecret), apiSecretMinLength)
+	}
+	return nil
+}
+
 // Get the API secret from env.
 func envApiSecret() string {
 	return os.Getenv("SRS_PLATFORM_SECRET")
@@ -375,6 +668,10 @@ func envMgmtPassword() string {
 	return os.Getenv("MGMT_PASSWORD")
 }
 
+func envMgmtPasswordComplexity() string {
+	return os.Getenv("MGMT_PASSWORD_COMPLEXITY")
+}
+
 func envSelfSignedCertificate() string {
 	return os.Getenv("AUTO_SELF_SIGNED_CERTIFICATE")
 }
@@ -395,10 +692,38 @@ func envPlatformDocker() string {
 	return os.Getenv("PLATFORM_DOCKER")
 }
 
+func envMgmtSecretQuery() string {
+	return os.Getenv("MGMT_SECRET_QUERY")
+}
+
+func envPlatformDeployMode() string {
+	return os.Getenv("PLATFORM_DEPLOY_MODE")
+}
+
+func envPlatformUpgradeScript() string {
+	return os.Getenv("PLATFORM_UPGRADE_SCRIPT")
+}
+
+func envPlatformUpgradePubkey() string {
+	return os.Getenv("PLATFORM_UPGRADE_PUBKEY")
+}
+
+func envPlatformHostServices() string {
+	return os.Getenv("PLATFORM_HOST_SERVICES")
+}
+
+func envPlatformDockerSocket() string {
+	return os.Getenv("PLATFORM_DOCKER_SOCKET")
+}
+
 func envCandidate() string {
 	return os.Getenv("CANDIDATE")
 }
 
+func envCandidateEchoServer() string {
+	return os.Getenv("CANDIDATE_ECHO_SERVER")
+}
+
 func envMgmtListen() string {
 	return os.Getenv("MGMT_LISTEN")
 }
@@ -479,6 +804,26 @@ func envForwardLimit() string {
 	return os.Getenv("SRS_FORWARD_LIMIT")
 }
 
+func envExecConcurrency() string {
+	return os.Getenv("SRS_EXEC_CONCURRENCY")
+}
+
+func envFFmpegConcurrency() string {
+	return os.Getenv("SRS_FFMPEG_CONCURRENCY")
+}
+
+func envRecordPreviewInterval() string {
+	return os.Getenv("RECORD_PREVIEW_INTERVAL")
+}
+
+func envHlsTimeShiftBudget() string {
+	return os.Getenv("HLS_TIMESHIFT_BUDGET")
+}
+
+func envRecordPreviewConcurrency() string {
+	return os.Getenv("RECORD_PREVIEW_CONCURRENCY")
+}
+
 func envVLiveLimit() string {
 	return os.Getenv("SRS_VLIVE_LIMIT")
 }
@@ -495,6 +840,74 @@ func envYtdlProxy() string {
 	return os.Getenv("YTDL_PROXY")
 }
 
+func envSrsApiServer() string {
+	return os.Getenv("SRS_API_SERVER")
+}
+
+func envSrsHooksServer() string {
+	return os.Getenv("SRS_HOOKS_SERVER")
+}
+
+func envSmtpServer() string {
+	return os.Getenv("SMTP_SERVER")
+}
+
+func envSmtpUsername() string {
+	return os.Getenv("SMTP_USERNAME")
+}
+
+func envSmtpPassword() string {
+	return os.Getenv("SMTP_PASSWORD")
+}
+
+func envSmtpFrom() string {
+	return os.Getenv("SMTP_FROM")
+}
+
+func envSrsApiProxyWrite() string {
+	return os.Getenv("SRS_API_PROXY_WRITE")
+}
+
+func envReleasesFeed() string {
+	return os.Getenv("RELEASES_FEED")
+}
+
+func envMgmtTrustProxy() string {
+	return os.Getenv("MGMT_TRUST_PROXY")
+}
+
+func envMgmtTrustedProxies() string {
+	return os.Getenv("MGMT_TRUSTED_PROXIES")
+}
+
+func envVersionsRefreshInterval() string {
+	return os.Getenv("VERSIONS_REFRESH_INTERVAL")
+}
+
+func envClockCheckInterval() string {
+	return os.Getenv("CLOCK_CHECK_INTERVAL")
+}
+
+func envClockCheckServer() string {
+	return os.Getenv("CLOCK_CHECK_SERVER")
+}
+
+func envPlayerFrameAncestors() string {
+	return os.Getenv("PLAYER_FRAME_ANCESTORS")
+}
+
+func envMigrationsDryRun() string {
+	return os.Getenv("MIGRATIONS_DRY_RUN")
+}
+
+func envPlatformStartupTimeout() string {
+	return os.Getenv("PLATFORM_STARTUP_TIMEOUT")
+}
+
+func envPlatformBasePath() string {
+	return os.Getenv("PLATFORM_BASE_PATH")
+}
+
 // rdb is a global redis client object.
 var rdb *redis.Client
 
@@ -514,17 +927,35 @@ func InitRdb() error {
 }
 
 // For platform to build token by jwt.
+// The issuer of token created by platform.
+const tokenIssuer = "oryx"
+
+// The scope of token created by login with password, which is required to query the api secret.
+const tokenScopeAdmin = "admin"
+
 func createToken(ctx context.Context, apiSecret string) (expireAt, createAt time.Time, token string, err error) {
+	return createTokenWithScope(ctx, apiSecret, "")
+}
+
+// createTokenWithScope creates the token with scope, which should only be minted by password, never by refresh.
+func createTokenWithScope(ctx context.Context, apiSecret, scope string) (expireAt, createAt time.Time, token string, err error) {
+	if err = checkApiSecret(apiSecret); err != nil {
+		return expireAt, createAt, "", errors.Wrapf(err, "check api secret")
+	}
+
 	createAt, expireAt = time.Now(), time.Now().Add(365*24*time.Hour)
 
 	claims := struct {
 		Version string `json:"v"`
 		Nonce   string `json:"nonce"`
+		Scope   string `json:"scope,omitempty"`
 		jwt.RegisteredClaims
 	}{
 		Version: "1.0",
 		Nonce:   fmt.Sprintf("%x", rand.Uint64()),
+		Scope:   scope,
 		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    tokenIssuer,
 			ExpiresAt: jwt.NewNumericDate(expireAt),
 			IssuedAt:  jwt.NewNumericDate(createAt),
 		},
@@ -597,8 +1028,7 @@ func refreshIPv4(ctx context.Context) error {
 			if name, ipv4, err := discoverPrivateIPv4(ctx); err != nil {
 				logger.Wf(ctx, "ignore ipv4 discover err %v", err)
 			} else if name != "" && ipv4 != nil {
-				conf.ipv4 = ipv4
-				conf.Iface = name
+				conf.SetIPv4(name, ipv4)
 				ipv4Cancel()
 			}
 
@@ -622,8 +1052,37 @@ func setEnvDefault(key, value string) {
 	}
 }
 
+// configLock serializes the generation of SRS and NGINX config, because the settings might be changed and the config
+// regenerated by concurrent requests, for example, the HLS toggle and HTTPS apply. Note that the generators always
+// read the settings from redis after the lock is acquired, so the last generation contains all the changes.
+var configLock sync.Mutex
+
+// configHashes is the hash of each rendered config file, protected by configLock.
+var configHashes = make(map[string]string)
+
+// renderedConfigHash returns the hash of all rendered config files, for callers to detect their change landed.
+func renderedConfigHash() string {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	fileNames := make([]string, 0, len(configHashes))
+	for fileName := range configHashes {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+
+	h := sha256.New()
+	for _, fileName := range fileNames {
+		h.Write([]byte(fmt.Sprintf("%v=%v\n", path.Base(fileName), configHashes[fileName])))
+	}
+	return fmt.Sprintf("%x", h.Sum(nil))
+}
+
 // srsGenerateConfig is to build SRS configuration and reload SRS.
 func srsGenerateConfig(ctx context.Context) error {
+	configLock.Lock()
+	defer configLock.Unlock()
+
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	// Build the High Performance HLS config.
 	hlsConf := []string{
@@ -633,18 +1092,26 @@ func srsGenerateConfig(ctx context.Context) error {
 	}
 	if hlsLowLatency, err := rdb.HGet(ctx, SRS_LL_HLS, "hlsLowLatency").Result(); err != nil && err != redis.Nil {
 		return errors.Wrapf(err, "hget %v hls", SRS_LL_HLS)
+	} else if profiles, err := queryHLSProfiles(ctx); err != nil {
+		return errors.Wrapf(err, "query hls profiles")
 	} else {
-		if hlsLowLatency != "true" {
-			hlsConf = append(hlsConf, []string{
-				"    hls_fragment 10;",
-				"    hls_window 60;",
-			}...)
+		// Because SRS only supports HLS config of vhost, we use the smaller fragment if any stream is in low latency
+		// profile, and keep the larger window for normal streams. SRS only cuts the fragment at keyframe, so the normal
+		// streams with large keyframe interval are not affected.
+		fragment, window := HLSProfileNormal.Fragment(), HLSProfileNormal.Window()
+		if hlsLowLatency == "true" {
+			fragment, window = HLSProfileLow.Fragment(), HLSProfileLow.Window()
 		} else {
-			hlsConf = append(hlsConf, []string{
-				"    hls_fragment 2;",
-				"    hls_window 16;",
-			}...)
+			for _, profile := range profiles {
+				if profile == HLSProfileLow {
+					fragment = HLSProfileLow.Fragment()
+				}
+			}
 		}
+		hlsConf = append(hlsConf, []string{
+			fmt.Sprintf("    hls_fragment %v;", fragment),
+			fmt.Sprintf("    hls_window %v;", window),
+		}...)
 	}
 	hlsConf = append(hlsConf, []string{
 		"    hls_aof_ratio 2.1;",
@@ -664,6 +1131,15 @@ func srsGenerateConfig(ctx context.Context) error {
 	}
 	hlsConf = append(hlsConf, "}")
 
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Build the http_hooks with secret, which overrides the default one, because SRS uses the first one.
+	var hooksConf []string
+	if secret, err := queryHooksSecret(ctx); err != nil {
+		return errors.Wrapf(err, "query hooks secret")
+	} else {
+		hooksConf = buildSrsHooksConf(envSrsHooksServer(), secret.Active())
+	}
+
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
 	// Build the config for SRS.
 	if true {
@@ -682,12 +1158,14 @@ func srsGenerateConfig(ctx context.Context) error {
 				return errors.Wrapf(err, "write file %v with %v", fileName, confData)
 			}
 		}
+		configHashes[fileName] = fmt.Sprintf("%x", sha256.Sum256([]byte(confData)))
 	}
 	if true {
 		confLines := []string{
 			"# !!! Important: This file is produced and maintained by the Oryx, please never modify it.",
 		}
 		confLines = append(confLines, hlsConf...)
+		confLines = append(confLines, hooksConf...)
 		confLines = append(confLines, "", "")
 
 		confData := strings.Join(confLines, "\n")
@@ -700,6 +1178,7 @@ func srsGenerateConfig(ctx context.Context) error {
 				return errors.Wrapf(err, "write file %v with %v", fileName, confData)
 			}
 		}
+		configHashes[fileName] = fmt.Sprintf("%x", sha256.Sum256([]byte(confData)))
 	}
 
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -794,70 +1273,60 @@ func srsGenerateConfig(ctx context.Context) error {
 	return errors.New("reload srs timeout")
 }
 
-// nginxGenerateConfig is to build NGINX configuration and reload NGINX.
-func nginxGenerateConfig(ctx context.Context) error {
-	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Build the SSL/TLS config.
-	sslConf := []string{}
-	if ssl, err := rdb.Get(ctx, SRS_HTTPS).Result(); err != nil && err != redis.Nil {
-		return errors.Wrapf(err, "get %v", SRS_HTTPS)
-	} else if ssl == "ssl" || ssl == "lets" {
-		sslConf = []string{
-			"",
-			"# For SSL/TLS config.",
-			"listen       443 ssl;",
-			"listen       [::]:443 ssl;",
-			"ssl_certificate /data/config/nginx.crt;",
-			"ssl_certificate_key /data/config/nginx.key;",
-			"ssl_protocols TLSv1.1 TLSv1.2 TLSv1.3;",
-			`add_header Strict-Transport-Security "max-age=0";`,
-			"ssl_session_cache shared:SSL:10m;",
-			"ssl_session_timeout 10m;",
-			"",
+// nginxGenerateConfig is to build NGINX configuration and reload NGINX. Only one platform replica is allowed to do it
+// at the same time, because the config files are shared, while the callers in this replica are serialized by configLock.
+// The outcome is recorded with trigger, see /terraform/v1/mgmt/nginx/status.
+func nginxGenerateConfig(ctx context.Context, trigger string) error {
+	return nginxApplyConfig(ctx, trigger, "")
+}
+
+// nginxApplyConfig is the same as nginxGenerateConfig, but rejects if the hash is not empty and the config differs
+// from the previewed one, so the config applied is exactly what was reviewed, see /terraform/v1/mgmt/nginx/preview.
+func nginxApplyConfig(ctx context.Context, trigger, hash string) error {
+	configLock.Lock()
+	defer configLock.Unlock()
+
+	return withRedisLock(ctx, SRS_LOCK_NGINX, func(ctx context.Context, lock *RedisLock) error {
+		err := nginxGenerateConfigLocked(ctx, hash)
+		if r0, ok := errors.Cause(err).(*httpStatusError); ok && r0.status == http.StatusConflict {
+			return err
 		}
-	}
 
-	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Build the default root.
-	// Note that it's been removed, see SRS_HTTP_PROXY.
+		recordNginxReload(ctx, trigger, nginxConfigHash(), err)
+		if err != nil {
+			return newHttpCodeError(http.StatusInternalServerError, SrsStackErrorNginx, err)
+		}
+		return nil
+	})
+}
 
-	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Build the upload limit for uploader(vLive).
-	uploadLimit := []string{
-		"",
-		"# Limit for upload file size",
-		"client_max_body_size 100g;",
+func nginxGenerateConfigLocked(ctx context.Context, hash string) error {
+	settings, err := queryNginxSettings(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query settings")
 	}
 
-	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-	// Build the config for NGINX.
-	if true {
-		confLines := []string{
-			"# !!! Important: This file is produced and maintained by the Oryx, please never modify it.",
-		}
-		confLines = append(confLines, "", "")
+	// Reject if the config differs from the previewed one, see NginxPreview.
+	files := renderNginxConfig(settings)
+	if hash != "" && nginxFilesHash(files) != hash {
+		return newHttpCodeError(http.StatusConflict, SrsStackErrorNginxPreview,
+			errors.Errorf("config changed since preview, hash=%v, settings is %v", hash, settings.String()),
+		)
+	}
 
-		confData := strings.Join(confLines, "\n")
-		fileName := path.Join(conf.Pwd, "containers/data/config/nginx.http.conf")
-		if f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
-			return errors.Wrapf(err, "open file %v", fileName)
-		} else {
-			defer f.Close()
-			if _, err = f.Write([]byte(confData)); err != nil {
-				return errors.Wrapf(err, "write file %v with %v", fileName, confData)
-			}
-		}
+	// Never write the config which fails nginx -t, so the active config is kept. The config is written if not
+	// validated, for example, no nginx in the container of platform, which is reloaded by the signal file.
+	if validation, err := validateNginxConfig(ctx, files); err != nil {
+		return errors.Wrapf(err, "validate")
+	} else if validation.Status == NginxValidationInvalid {
+		return &NginxCommandError{Command: "nginx -t", Output: validation.Output, ExitCode: validation.ExitCode}
 	}
-	if true {
-		confLines := []string{
-			"# !!! Important: This file is produced and maintained by the Oryx, please never modify it.",
-		}
-		confLines = append(confLines, uploadLimit...)
-		confLines = append(confLines, sslConf...)
-		confLines = append(confLines, "", "")
 
-		confData := strings.Join(confLines, "\n")
-		fileName := path.Join(conf.Pwd, "containers/data/config/nginx.server.conf")
+	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
+	// Write the config for NGINX.
+	for _, name := range []string{"nginx.http.conf", "nginx.server.conf"} {
+		confData := files[name]
+		fileName := path.Join(nginxConfigDir(), name)
 		if f, err := os.OpenFile(fileName, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
 			return errors.Wrapf(err, "open file %v", fileName)
 		} else {
@@ -866,6 +1335,7 @@ func nginxGenerateConfig(ctx context.Context) error {
 				return errors.Wrapf(err, "write file %v with %v", fileName, confData)
 			}
 		}
+		configHashes[fileName] = fmt.Sprintf("%x", sha256.Sum256([]byte(confData)))
 	}
 
 	////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
@@ -878,6 +1348,13 @@ func nginxGenerateConfig(ctx context.Context) error {
 			return nil
 		}
 
+		// Reload by the command in host mode, to get the output and exit code.
+		if conf.DeployMode == DeployModeHost {
+			if binary, err := exec.LookPath("nginx"); err == nil {
+				return reloadNginxByCommand(ctx, binary)
+			}
+		}
+
 		fileName := path.Join(conf.Pwd, fmt.Sprintf("containers/data/signals/nginx.reload.%v",
 			time.Now().UnixNano()/int64(time.Millisecond),
 		))
@@ -1158,6 +1635,24 @@ type M3u8VoDArtifact struct {
 	// The ts files of this m3u8.
 	Files []*TsFile `json:"files"`
 
+	// For record only.
+	// The HLS VoD playback URL.
+	PlaybackURL string `json:"playback,omitempty"`
+	// The storage driver which the files are archived to, empty for local disk only.
+	Storage StorageDriverName `json:"storage,omitempty"`
+	// The checksums of files when finalized, such as index.m3u8 and index.mp4, to verify the integrity.
+	Checksums []*FileChecksum `json:"checksums,omitempty"`
+	// The thumbnail sprites and WebVTT for the player to preview, generated in background after finalized.
+	Preview *RecordPreview `json:"preview,omitempty"`
+	// The error to generate the preview, for example, ffmpeg failed.
+	PreviewError string `json:"previewError,omitempty"`
+
+	// For clip only.
+	// The name of clip, specified by user.
+	Name string `json:"name,omitempty"`
+	// The source record UUID of clip.
+	Source string `json:"source,omitempty"`
+
 	// For DVR only.
 	// The COS bucket name.
 	Bucket string `json:"bucket"`
@@ -1288,6 +1783,8 @@ type SrsStream struct {
 	Client string `json:"client_id,omitempty"`
 
 	Update string `json:"update,omitempty"`
+	// Whether published by a temporary key of guest, see GuestKey.
+	Guest bool `json:"guest,omitempty"`
 }
 
 func (v *SrsStream) String() string {
@@ -1312,20 +1809,80 @@ func (v *SrsStream) IsRTC() bool {
 	return strings.Contains(v.Param, "upstream=rtc")
 }
 
-// ParseBody read the body from r, and unmarshal JSON to v.
-func ParseBody(ctx context.Context, r io.ReadCloser, v interface{}) error {
-	b, err := ioutil.ReadAll(r)
+// httpStatusError is an error with HTTP status, for example, 400 for malformed JSON. The code is optional,
+// which is responded with the localized message, see srsStackErrorCatalogs. The details is optional, which is
+// responded in data for UI, for example, the issues of each field.
+type httpStatusError struct {
+	status  int
+	code    SrsStackError
+	err     error
+	details interface{}
+}
+
+func newHttpStatusError(status int, err error) *httpStatusError {
+	return &httpStatusError{status: status, err: err}
+}
+
+func newHttpCodeError(status int, code SrsStackError, err error) *httpStatusError {
+	return &httpStatusError{status: status, code: code, err: err}
+}
+
+func (v *httpStatusError) Error() string {
+	return v.err.Error()
+}
+
+// Status is the HTTP status, see ohttp.HTTPStatus.
+func (v *httpStatusError) Status() int {
+	return v.status
+}
+
+// ParseBody read the body from r, and unmarshal JSON to v. The Content-Type must be JSON if there is body,
+// and never echo the body in error, because it might contain secrets.
+func ParseBody(ctx context.Context, r *http.Request, v interface{}) error {
+	b, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return errors.Wrapf(err, "read body")
 	}
-	defer r.Close()
+	defer r.Body.Close()
+
+	return unmarshalBody(ctx, r, b, v)
+}
 
+// ParseLimitedBody is similar to ParseBody, but fail with 413 if the body exceeds maxBytes, for the body which
+// contains secrets like password, to avoid reading a huge blob.
+func ParseLimitedBody(ctx context.Context, w http.ResponseWriter, r *http.Request, maxBytes int64, v interface{}) error {
+	b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxBytes))
+	if err != nil {
+		return newHttpStatusError(http.StatusRequestEntityTooLarge, errors.Wrapf(err, "read body"))
+	}
+	defer r.Body.Close()
+
+	return unmarshalBody(ctx, r, b, v)
+}
+
+func unmarshalBody(ctx context.Context, r *http.Request, b []byte, v interface{}) error {
 	if len(b) == 0 {
 		return nil
 	}
 
+	contentType := r.Header.Get("Content-Type")
+	if mediaType, _, err := mime.ParseMediaType(contentType); err != nil || mediaType != "application/json" {
+		return newHttpCodeError(http.StatusUnsupportedMediaType, SrsStackErrorContentType, errors.Errorf(
+			"invalid Content-Type %v, should be application/json", contentType,
+		))
+	}
+
 	if err := json.Unmarshal(b, v); err != nil {
-		return errors.Wrapf(err, "json unmarshal %v", string(b))
+		var msg string
+		switch err := err.(type) {
+		case *json.SyntaxError:
+			msg = fmt.Sprintf("malformed json at offset %v", err.Offset)
+		case *json.UnmarshalTypeError:
+			msg = fmt.Sprintf("invalid field %v, expect %v but got %v", err.Field, err.Type, err.Value)
+		default:
+			msg = "malformed json"
+		}
+		return newHttpCodeError(http.StatusBadRequest, SrsStackErrorInvalidBody, errors.Errorf("%v, size=%vB", msg, len(b)))
 	}
 
 	return nil
@@ -1335,9 +1892,21 @@ func ParseBody(ctx context.Context, r io.ReadCloser, v interface{}) error {
 // If use bearer secret, there is the header Authorization: Bearer {apiSecret}.
 // If use token, there is a JWT token which is signed by apiSecret.
 func Authenticate(ctx context.Context, apiSecret, token string, header http.Header) error {
+	// Fail closed if no secret, because the token signed by empty secret is valid for an empty HMAC key.
+	if err := checkApiSecret(apiSecret); err != nil {
+		return newHttpCodeError(http.StatusServiceUnavailable, SrsStackErrorNotConfigured, err)
+	}
+
+	if err := authenticate(ctx, apiSecret, token, header); err != nil {
+		return newHttpCodeError(http.StatusUnauthorized, SrsStackErrorAuth, err)
+	}
+	return nil
+}
+
+func authenticate(ctx context.Context, apiSecret, token string, header http.Header) error {
 	// Check system api secret.
-	if apiSecret == "" {
-		return errors.New("no api secret")
+	if err := checkApiSecret(apiSecret); err != nil {
+		return errors.Wrapf(err, "check api secret")
 	}
 
 	// Should use bearer secret or token.
@@ -1371,9 +1940,12 @@ func Authenticate(ctx context.Context, apiSecret, token string, header http.Head
 	// Verify token first, @see https://www.npmjs.com/package/jsonwebtoken#errors--codes
 	// See https://pkg.go.dev/github.com/golang-jwt/jwt/v4#example-Parse-Hmac
 	if _, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, errors.Errorf("invalid signing method %v", token.Header["alg"])
+		}
 		return []byte(apiSecret), nil
 	}); err != nil {
-		return errors.Wrapf(err, "verify token %v", token)
+		return errors.Wrapf(withClockHint(err), "verify token %v", token)
 	}
 
 	return nil
@@ -1439,6 +2011,100 @@ func RebuildStreamURL(rawURL string) (*url.URL, error) {
 	return url.Parse(rawURL)
 }
 
+// RedactStreamURL returns the stream URL without credentials, for example, the password in user information and the
+// secret or token in query, so it's safe to respond or log it.
+func RedactStreamURL(rawURL string) string {
+	u, err := RebuildStreamURL(rawURL)
+	if err != nil {
+		return "xxxxxx"
+	}
+
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "xxxxxx")
+		}
+	}
+
+	q := u.Query()
+	for k := range q {
+		switch strings.ToLower(k) {
+		case "secret", "token", "key", "passphrase", "password", "auth", "streamid":
+			q.Set(k, "xxxxxx")
+			// The SRT streamid such as #!::r=live/livestream,secret=xxx is parsed as fragment.
+			u.Fragment, u.RawFragment = "", ""
+		}
+	}
+	if len(q) > 0 {
+		u.RawQuery = q.Encode()
+	}
+	return u.String()
+}
+
+// The prefix of value encrypted by api secret, to identify the version of encryption.
+const apiSecretEncryptedPrefix = "enc:v1:"
+
+func apiSecretCipher() (cipher.AEAD, error) {
+	if envApiSecret() == "" {
+		return nil, errors.New("no api secret")
+	}
+
+	key := sha256.Sum256([]byte("oryx-encrypt:" + envApiSecret()))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, errors.Wrapf(err, "new cipher")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errors.Wrapf(err, "new gcm")
+	}
+	return gcm, nil
+}
+
+// encryptByApiSecret encrypt the plaintext by AES-GCM, with the key derived from the api secret, which is the source of
+// truth in redis, so it never changes after the first boot.
+func encryptByApiSecret(plaintext string) (string, error) {
+	gcm, err := apiSecretCipher()
+	if err != nil {
+		return "", errors.Wrapf(err, "cipher")
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := crand.Read(nonce); err != nil {
+		return "", errors.Wrapf(err, "nonce")
+	}
+
+	b := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return apiSecretEncryptedPrefix + base64.StdEncoding.EncodeToString(b), nil
+}
+
+// decryptByApiSecret decrypt the value encrypted by encryptByApiSecret.
+func decryptByApiSecret(ciphertext string) (string, error) {
+	if !strings.HasPrefix(ciphertext, apiSecretEncryptedPrefix) {
+		return "", errors.Errorf("invalid prefix of %vB", len(ciphertext))
+	}
+
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(ciphertext, apiSecretEncryptedPrefix))
+	if err != nil {
+		return "", errors.Wrapf(err, "decode base64")
+	}
+
+	gcm, err := apiSecretCipher()
+	if err != nil {
+		return "", errors.Wrapf(err, "cipher")
+	}
+
+	if len(b) < gcm.NonceSize() {
+		return "", errors.Errorf("invalid size %vB", len(b))
+	}
+
+	plaintext, err := gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", errors.Wrapf(err, "decrypt")
+	}
+	return string(plaintext), nil
+}
+
 // httpAllowCORS allow CORS for HTTP request.
 // Note that we always enable CROS because we enable HTTP cache.
 func httpAllowCORS(w http.ResponseWriter, r *http.Request) {
@@ -1456,6 +2122,111 @@ func httpAllowCORS(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 }
 
+// httpWriteData write the data to client, ignore if the client is gone, or the response is written.
+func httpWriteData(ctx context.Context, w http.ResponseWriter, r *http.Request, v interface{}) {
+	if err := r.Context().Err(); err != nil {
+		logger.Wf(ctx, "ignore response for client is gone, err %v", err)
+		return
+	}
+	if httpResponseWritten(w) {
+		logger.Wf(ctx, "ignore response for response is written")
+		return
+	}
+	ohttp.WriteData(ctx, w, r, v)
+}
+
+// httpResponseGuard tracks whether the response is written, to avoid writing the error after the response, which
+// causes superfluous WriteHeader and a corrupted body.
+type httpResponseGuard struct {
+	http.ResponseWriter
+	// Whether the header or body is written.
+	written bool
+}
+
+func newHttpResponseGuard(w http.ResponseWriter) *httpResponseGuard {
+	return &httpResponseGuard{ResponseWriter: w}
+}
+
+func (v *httpResponseGuard) WriteHeader(status int) {
+	v.written = true
+	v.ResponseWriter.WriteHeader(status)
+}
+
+func (v *httpResponseGuard) Write(b []byte) (int, error) {
+	v.written = true
+	return v.ResponseWriter.Write(b)
+}
+
+func (v *httpResponseGuard) Flush() {
+	if f, ok := v.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// httpResponseWritten whether the response is written, only for the writer guarded by httpResponseGuard.
+func httpResponseWritten(w http.ResponseWriter) bool {
+	if g, ok := w.(*httpResponseGuard); ok {
+		return g.written
+	}
+	return false
+}
+
+// httpWriteError write the error to client, ignore if the client is gone, or the response is written.
+func httpWriteError(ctx context.Context, w http.ResponseWriter, r *http.Request, err error) {
+	if r0 := r.Context().Err(); r0 != nil {
+		logger.Wf(ctx, "ignore error for client is gone, err %+v", err)
+		return
+	}
+	if httpResponseWritten(w) {
+		logger.Wf(ctx, "ignore error for response is written, err %+v", err)
+		return
+	}
+
+	// Response 504 with the elapsed time, if the deadline of route is exceeded, see httpRequestContext.
+	if r0 := httpDeadlineError(ctx, r, err); r0 != nil {
+		err = r0
+	}
+
+	// Response with the status of the cause, because ohttp only checks the status of err itself.
+	cause, ok := errors.Cause(err).(*httpStatusError)
+	if !ok {
+		ohttp.WriteError(ctx, w, r, err)
+		return
+	}
+	if cause.code == 0 {
+		ohttp.WriteError(ctx, w, r, newHttpStatusError(cause.status, err))
+		return
+	}
+
+	// Response the code with localized message, for UI to show it without parsing the error.
+	lang := negotiateLanguage(r)
+	logThrottle.Ef(ctx, fmt.Sprintf("%v %v", r.URL.Path, err.Error()),
+		"Serve %v failed, code=%v, lang=%v, err is %+v", r.URL.Path, cause.code, lang, err,
+	)
+
+	b, err := json.Marshal(&struct {
+		Code SrsStackError `json:"code"`
+		Data interface{}   `json:"data"`
+	}{
+		Code: cause.code, Data: &struct {
+			Message string      `json:"message"`
+			Error   string      `json:"error"`
+			Details interface{} `json:"details,omitempty"`
+		}{
+			Message: localizedErrorMessage(lang, cause.code), Error: err.Error(), Details: cause.details,
+		},
+	})
+	if err != nil {
+		ohttp.WriteError(ctx, w, r, err)
+		return
+	}
+
+	ohttp.SetHeader(w)
+	w.Header().Set("Content-Type", ohttp.HttpJson)
+	w.WriteHeader(cause.status)
+	w.Write(b)
+}
+
 // httpCreateProxy create a reverse proxy for target URL.
 func httpCreateProxy(targetURL string) (*httputil.ReverseProxy, error) {
 	target, err := url.Parse(targetURL)
@@ -1614,6 +2385,8 @@ type FFprobeSource struct {
 	Path string `json:"path"`
 	// The size in bytes.
 	Size uint64 `json:"size"`
+	// The SHA-256 of file in hex when upload completed, empty for stream.
+	SHA256 string `json:"sha256,omitempty"`
 	// The file UUID.
 	UUID string `json:"uuid"`
 	// The target file name.
@@ -1634,6 +2407,22 @@ func (v *FFprobeSource) String() string {
 	)
 }
 
+// TaskStatus is the runtime status of FFmpeg task, for example, forward and vLive task.
+type TaskStatus string
+
+const (
+	// The task is not enabled by user.
+	TaskStatusDisabled TaskStatus = "disabled"
+	// The task is configured, but waiting for the source, for example, no stream is published.
+	TaskStatusWaiting TaskStatus = "waiting"
+	// The task is held until SRS is accepting connections, for example, the platform starts before SRS.
+	TaskStatusWaitingSrs TaskStatus = "waiting-for-srs"
+	// The FFmpeg of task is running.
+	TaskStatusRunning TaskStatus = "running"
+	// The task failed, and will retry later.
+	TaskStatusError TaskStatus = "error"
+)
+
 // The FFmpegHeartbeat is used to manage the heartbeat of FFmpeg, the status of FFmpeg, by detecting the
 // log message from FFmpeg output.
 type FFmpegHeartbeat struct {
@@ -1655,6 +2444,8 @@ type FFmpegHeartbeat struct {
 	// FFmpeg's standard cycle logs every 1 second. Additional logs, such as FFmpeg error logs, are stored
 	// separately as extra logs.
 	extraLogs []string
+	// The lock for extra logs, which is read by the task history when FFmpeg quit.
+	extraLogsLock sync.Mutex
 	// Last line of FFmpeg log.
 	line, timestamp, speed string
 	// Total count of failed to parsed logs.
@@ -1707,6 +2498,25 @@ func NewFFmpegHeartbeat(cancelFFmpeg context.CancelFunc, opts ...func(*FFmpegHea
 	return v
 }
 
+func (v *FFmpegHeartbeat) appendExtraLog(line string) {
+	v.extraLogsLock.Lock()
+	defer v.extraLogsLock.Unlock()
+	v.extraLogs = append(v.extraLogs, line)
+}
+
+// StderrTail returns the last n lines of FFmpeg stderr, excluding the cycle logs of frames. Returns all lines if
+// n is not positive.
+func (v *FFmpegHeartbeat) StderrTail(n int) []string {
+	v.extraLogsLock.Lock()
+	defer v.extraLogsLock.Unlock()
+
+	logs := v.extraLogs
+	if n > 0 && len(logs) > n {
+		logs = logs[len(logs)-n:]
+	}
+	return append([]string{}, logs...)
+}
+
 // Parse the input URL u and update the configuration from query string. Note that it only works for
 // URL based input, not for file.
 func (v *FFmpegHeartbeat) Parse(u *url.URL) {
@@ -1736,7 +2546,7 @@ func (v *FFmpegHeartbeat) Polling(ctx context.Context, stderr io.Reader) {
 		logger.Tf(ctx, "FFmpeg: Quit exit-normally=%v, parsed=%v, failed=%v,<%v>, speed=%v,%v,%v,<%v>, not-change=%v,<%v>, extra logs is %v",
 			v.exitingNormally, v.parsedCount, v.failedParsedCount, v.lastFailedParsed, v.failedSpeedCount,
 			v.veryFastSpeedCount, v.verySlowSpeedCount, v.lastFailedSpeed, v.notChangedCount, v.lastNotChanged,
-			strings.Join(v.extraLogs, " "))
+			strings.Join(v.StderrTail(0), " "))
 	}()
 
 	// Monitor FFmpeg update, restart if not update for a while.
@@ -1780,11 +2590,11 @@ func (v *FFmpegHeartbeat) Polling(ctx context.Context, stderr io.Reader) {
 
 		// Handle the extra logs.
 		if !strings.Contains(line, "size=") && !strings.Contains(line, "time=") {
-			v.extraLogs = append(v.extraLogs, line)
+			v.appendExtraLog(line)
 			return
 		}
 		if strings.Contains(line, "time=N/A") || strings.Contains(line, "speed=N/A") {
-			v.extraLogs = append(v.extraLogs, line)
+			v.appendExtraLog(line)
 			return
 		}
 
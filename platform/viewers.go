@@ -0,0 +1,486 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// The interval to sample the viewers, which should be larger than the interval of HLS players to refresh playlist,
+// so the concurrent viewers are accurate within an interval.
+const viewerSampleInterval = 30 * time.Second
+
+// The delay to sample after the window ends, to wait for the buffered writes of HLS viewers.
+const viewerSampleDelay = 3 * time.Second
+
+// The samples of viewers are kept for a while, and the query range should not exceed it.
+const viewerHistoryExpire = 7 * 24 * time.Hour
+
+// The default range to query the viewers.
+const viewerQueryDefaultRange = 24 * time.Hour
+
+// The max number of HLS viewers to track in a window, because the playlist request is not authenticated.
+const viewerMaxHLSPerWindow = 100000
+
+// ViewerSample is the number of concurrent viewers of a stream at a time.
+type ViewerSample struct {
+	// The end time of sample window.
+	Time string `json:"time"`
+	// The viewers connected to SRS, for example, RTMP, HTTP-FLV and WebRTC.
+	Players int `json:"players"`
+	// The HLS viewers, which request the playlist in the window.
+	HLS int `json:"hls"`
+	// The total concurrent viewers.
+	Total int `json:"total"`
+}
+
+func (v *ViewerSample) String() string {
+	return fmt.Sprintf("time=%v, players=%v, hls=%v, total=%v", v.Time, v.Players, v.HLS, v.Total)
+}
+
+// ViewerStats is the current and history viewers of a stream.
+type ViewerStats struct {
+	// The stream URL, for example, live/livestream.
+	Stream string `json:"stream"`
+	// The last sample, nil if the stream has no viewers or is not alive.
+	Current *ViewerSample `json:"current,omitempty"`
+	// The max concurrent viewers in range.
+	Peak int `json:"peak"`
+	// The estimated unique HLS viewers by IP and User-Agent in range, by day.
+	Unique int64 `json:"unique"`
+	// The samples in range, the oldest first.
+	Samples []*ViewerSample `json:"samples"`
+}
+
+func viewerHistoryKey(stream string) string {
+	return fmt.Sprintf("%v:%v", SRS_STAT_VIEWERS, stream)
+}
+
+func viewerHLSKey(window int64) string {
+	return fmt.Sprintf("%v:%v", SRS_STAT_VIEWERS_HLS, window)
+}
+
+func viewerUniqueKey(stream string, t time.Time) string {
+	return fmt.Sprintf("%v:%v:%v", SRS_STAT_VIEWERS_UNIQUE, stream, t.UTC().Format("20060102"))
+}
+
+// viewerWindow returns the sample window of t.
+func viewerWindow(t time.Time) int64 {
+	return t.Unix() / int64(viewerSampleInterval.Seconds())
+}
+
+var viewerTracker *ViewerTracker
+
+// ViewerTracker tracks the HLS viewers by playlist requests, and samples the concurrent viewers of streams, including
+// the SRS players. Only one platform replica samples a window, while all replicas track the HLS viewers.
+type ViewerTracker struct {
+	// The HLS viewers seen in current window, to write redis once for each viewer in a window.
+	window int64
+	seen   map[string]bool
+	lock   sync.Mutex
+
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+func NewViewerTracker() *ViewerTracker {
+	return &ViewerTracker{seen: make(map[string]bool)}
+}
+
+func (v *ViewerTracker) Close() error {
+	if v.cancel != nil {
+		v.cancel()
+	}
+	v.wg.Wait()
+	return nil
+}
+
+func (v *ViewerTracker) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	v.cancel = cancel
+
+	ctx = logger.WithContext(ctx)
+	logger.Tf(ctx, "viewers start a worker, interval=%v", viewerSampleInterval)
+
+	v.wg.Add(1)
+	go func() {
+		defer v.wg.Done()
+
+		safeRestart(ctx, func() {
+			for {
+				// Sample the last window, after it ends.
+				now := time.Now()
+				next := time.Unix((viewerWindow(now)+1)*int64(viewerSampleInterval.Seconds()), 0)
+
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(next.Sub(now) + viewerSampleDelay):
+				}
+
+				if err := v.sample(ctx, viewerWindow(next)-1); err != nil {
+					logger.Wf(ctx, "viewers ignore sample err %+v", err)
+				}
+			}
+		})
+	}()
+
+	return nil
+}
+
+// OnHLSPlaylist tracks the HLS viewer by the playlist request, for example, /live/livestream.m3u8. The viewer is
+// identified by hash of IP and User-Agent, and never stores the IP.
+func (v *ViewerTracker) OnHLSPlaylist(ctx context.Context, r *http.Request) {
+	stream := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/"), ".m3u8")
+	// The viewers of time-shift playlist, such as timeshift/live/livestream.m3u8, are viewers of the stream.
+	stream = strings.TrimPrefix(stream, "timeshift/")
+	if stream == "" {
+		return
+	}
+
+	viewer := fmt.Sprintf("%x", sha256.Sum256([]byte(fmt.Sprintf("%v|%v", clientIP(r), r.UserAgent()))))[:16]
+
+	now := time.Now()
+	window := viewerWindow(now)
+	if !func() bool {
+		v.lock.Lock()
+		defer v.lock.Unlock()
+
+		if v.window != window {
+			v.window, v.seen = window, make(map[string]bool)
+		}
+
+		key := fmt.Sprintf("%v|%v", stream, viewer)
+		if v.seen[key] || len(v.seen) >= viewerMaxHLSPerWindow {
+			return false
+		}
+		v.seen[key] = true
+		return true
+	}() {
+		return
+	}
+
+	hlsKey := viewerHLSKey(window)
+	if err := bufferedRedisWrite(ctx, "hls viewer", func(ctx context.Context, pipe redis.Pipeliner) {
+		pipe.SAdd(ctx, hlsKey, fmt.Sprintf("%v|%v", stream, viewer))
+		pipe.Expire(ctx, hlsKey, 3*viewerSampleInterval)
+	}); err != nil {
+		logger.Wf(ctx, "viewers ignore hls %v err %+v", stream, err)
+	}
+}
+
+// sample saves the concurrent viewers of window, for all alive streams. The HLS viewers of streams not alive are
+// ignored, because anyone can request any playlist. It's ignored if the window is sampled by other replica.
+func (v *ViewerTracker) sample(ctx context.Context, window int64) error {
+	sampleKey := fmt.Sprintf("%v:%v", SRS_STAT_VIEWERS_SAMPLE, window)
+	if ok, err := rdb.SetNX(ctx, sampleKey, "1", 2*viewerSampleInterval).Result(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "setnx %v", sampleKey)
+	} else if !ok {
+		return nil
+	}
+
+	samples := make(map[string]*ViewerSample)
+	t := time.Unix((window+1)*int64(viewerSampleInterval.Seconds()), 0)
+	sampleOf := func(stream string) *ViewerSample {
+		if _, ok := samples[stream]; !ok {
+			samples[stream] = &ViewerSample{Time: t.Format(time.RFC3339)}
+		}
+		return samples[stream]
+	}
+
+	streams, err := queryLiveStreams(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query streams")
+	}
+	for _, stream := range streams {
+		sampleOf(stream)
+	}
+
+	// Ignore the players if SRS is not available, because the HLS viewers are still valid.
+	if players, err := querySrsPlayers(ctx); err != nil {
+		logger.Wf(ctx, "viewers ignore query players err %+v", err)
+	} else {
+		for stream, n := range players {
+			sampleOf(stream).Players = n
+		}
+	}
+
+	hlsKey := viewerHLSKey(window)
+	members, err := rdb.SMembers(ctx, hlsKey).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "smembers %v", hlsKey)
+	}
+	hlsViewers := make(map[string][]interface{})
+	for _, member := range members {
+		if i := strings.LastIndex(member, "|"); i > 0 {
+			if sample, ok := samples[member[:i]]; ok {
+				sample.HLS++
+				hlsViewers[member[:i]] = append(hlsViewers[member[:i]], member[i+1:])
+			}
+		}
+	}
+
+	// Save the samples, and the current viewers.
+	if _, err := rdb.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, SRS_STAT_VIEWERS_CURRENT)
+		for stream, sample := range samples {
+			sample.Total = sample.Players + sample.HLS
+
+			b, err := json.Marshal(sample)
+			if err != nil {
+				return errors.Wrapf(err, "marshal %v", sample.String())
+			}
+
+			key := viewerHistoryKey(stream)
+			pipe.ZAdd(ctx, key, &redis.Z{Score: float64(t.Unix()), Member: string(b)})
+			pipe.ZRemRangeByScore(ctx, key, "-inf", fmt.Sprintf("(%v", t.Add(-viewerHistoryExpire).Unix()))
+			pipe.SAdd(ctx, SRS_STAT_VIEWERS_STREAMS, stream)
+			pipe.HSet(ctx, SRS_STAT_VIEWERS_CURRENT, stream, string(b))
+
+			if viewers := hlsViewers[stream]; len(viewers) > 0 {
+				uniqueKey := viewerUniqueKey(stream, t)
+				pipe.PFAdd(ctx, uniqueKey, viewers...)
+				pipe.Expire(ctx, uniqueKey, viewerHistoryExpire+24*time.Hour)
+			}
+		}
+		return nil
+	}); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "save %v samples", len(samples))
+	}
+
+	// Remove the expired samples of streams without viewers, and the stream if no samples.
+	indexed, err := rdb.SMembers(ctx, SRS_STAT_VIEWERS_STREAMS).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "smembers %v", SRS_STAT_VIEWERS_STREAMS)
+	}
+	for _, stream := range indexed {
+		if _, ok := samples[stream]; ok {
+			continue
+		}
+
+		key := viewerHistoryKey(stream)
+		min := fmt.Sprintf("(%v", t.Add(-viewerHistoryExpire).Unix())
+		if err := rdb.ZRemRangeByScore(ctx, key, "-inf", min).Err(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "zremrangebyscore %v", key)
+		}
+		if n, err := rdb.ZCard(ctx, key).Result(); err != nil && err != redis.Nil {
+			return errors.Wrapf(err, "zcard %v", key)
+		} else if n == 0 {
+			if err := rdb.SRem(ctx, SRS_STAT_VIEWERS_STREAMS, stream).Err(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "srem %v %v", SRS_STAT_VIEWERS_STREAMS, stream)
+			}
+		}
+	}
+
+	logger.Tf(ctx, "viewers sample ok, window=%v, streams=%v, hls=%v", window, len(samples), len(members))
+	return nil
+}
+
+// querySrsPlayers returns the number of players of each stream in SRS, excluding the publisher.
+func querySrsPlayers(ctx context.Context) (map[string]int, error) {
+	api := fmt.Sprintf("%v/api/v1/streams?count=1000", envSrsApiServer())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, api, nil)
+	if err != nil {
+		return nil, errors.Wrapf(err, "new request %v", api)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "get %v", api)
+	}
+	defer res.Body.Close()
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "read %v", api)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("get %v, code=%v, body=%v", api, res.StatusCode, string(b))
+	}
+
+	var r struct {
+		Code    int `json:"code"`
+		Streams []struct {
+			App     string `json:"app"`
+			Name    string `json:"name"`
+			Clients int    `json:"clients"`
+			Publish struct {
+				Active bool `json:"active"`
+			} `json:"publish"`
+		} `json:"streams"`
+	}
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, errors.Wrapf(err, "unmarshal %v", string(b))
+	} else if r.Code != 0 {
+		return nil, errors.Errorf("get %v, code=%v, body=%v", api, r.Code, string(b))
+	}
+
+	players := make(map[string]int)
+	for _, stream := range r.Streams {
+		n := stream.Clients
+		if stream.Publish.Active {
+			n--
+		}
+		if n > 0 {
+			players[fmt.Sprintf("%v/%v", stream.App, stream.Name)] = n
+		}
+	}
+	return players, nil
+}
+
+// queryViewerStats returns the viewers of stream in [from, to], or all streams with history if stream is empty.
+func queryViewerStats(ctx context.Context, stream string, from, to time.Time) ([]*ViewerStats, error) {
+	streams := []string{stream}
+	if stream == "" {
+		indexed, err := rdb.SMembers(ctx, SRS_STAT_VIEWERS_STREAMS).Result()
+		if err != nil && err != redis.Nil {
+			return nil, errors.Wrapf(err, "smembers %v", SRS_STAT_VIEWERS_STREAMS)
+		}
+		streams = indexed
+		sort.Strings(streams)
+	}
+
+	current, err := rdb.HGetAll(ctx, SRS_STAT_VIEWERS_CURRENT).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_STAT_VIEWERS_CURRENT)
+	}
+
+	// The unique viewers are counted by day, so the range is aligned to days.
+	uniqueKeys := func(stream string) []string {
+		var keys []string
+		for day := from.UTC().Truncate(24 * time.Hour); !day.After(to); day = day.Add(24 * time.Hour) {
+			keys = append(keys, viewerUniqueKey(stream, day))
+		}
+		return keys
+	}
+
+	stats := make([]*ViewerStats, 0, len(streams))
+	for _, stream := range streams {
+		stat := &ViewerStats{Stream: stream, Samples: []*ViewerSample{}}
+
+		if value, ok := current[stream]; ok {
+			var sample ViewerSample
+			if err := json.Unmarshal([]byte(value), &sample); err != nil {
+				return nil, errors.Wrapf(err, "unmarshal %v", value)
+			}
+			stat.Current = &sample
+		}
+
+		key := viewerHistoryKey(stream)
+		values, err := rdb.ZRangeByScore(ctx, key, &redis.ZRangeBy{
+			Min: fmt.Sprintf("%v", from.Unix()), Max: fmt.Sprintf("%v", to.Unix()),
+		}).Result()
+		if err != nil && err != redis.Nil {
+			return nil, errors.Wrapf(err, "zrangebyscore %v", key)
+		}
+		for _, value := range values {
+			var sample ViewerSample
+			if err := json.Unmarshal([]byte(value), &sample); err != nil {
+				return nil, errors.Wrapf(err, "unmarshal %v", value)
+			}
+			stat.Samples = append(stat.Samples, &sample)
+			if sample.Total > stat.Peak {
+				stat.Peak = sample.Total
+			}
+		}
+
+		if keys := uniqueKeys(stream); len(keys) > 0 {
+			if n, err := rdb.PFCount(ctx, keys...).Result(); err != nil && err != redis.Nil {
+				return nil, errors.Wrapf(err, "pfcount %v", keys)
+			} else {
+				stat.Unique = n
+			}
+		}
+
+		stats = append(stats, stat)
+	}
+
+	return stats, nil
+}
+
+func handleMgmtViewerStats(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/mgmt/stats/viewers"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, stream, from, to string
+			if err := ParseBody(ctx, r, &struct {
+				Token  *string `json:"token"`
+				Stream *string `json:"stream"`
+				From   *string `json:"from"`
+				To     *string `json:"to"`
+			}{
+				Token: &token, Stream: &stream, From: &from, To: &to,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			// The range is [from, to] in RFC3339, default to the last day, and never exceed the history.
+			toTime, fromTime := time.Now(), time.Time{}
+			if to != "" {
+				if t, err := time.Parse(time.RFC3339, to); err != nil {
+					return errors.Wrapf(err, "parse to %v", to)
+				} else {
+					toTime = t
+				}
+			}
+			if fromTime = toTime.Add(-viewerQueryDefaultRange); from != "" {
+				if t, err := time.Parse(time.RFC3339, from); err != nil {
+					return errors.Wrapf(err, "parse from %v", from)
+				} else {
+					fromTime = t
+				}
+			}
+			if fromTime.After(toTime) {
+				return errors.Errorf("from %v after to %v", from, to)
+			}
+			if toTime.Sub(fromTime) > viewerHistoryExpire {
+				fromTime = toTime.Add(-viewerHistoryExpire)
+			}
+
+			stats, err := queryViewerStats(ctx, strings.TrimSpace(stream), fromTime, toTime)
+			if err != nil {
+				return errors.Wrapf(err, "query viewers")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				From    string         `json:"from"`
+				To      string         `json:"to"`
+				Streams []*ViewerStats `json:"streams"`
+			}{
+				From: fromTime.Format(time.RFC3339), To: toTime.Format(time.RFC3339), Streams: stats,
+			})
+			logger.Tf(ctx, "viewers query ok, stream=%v, from=%v, to=%v, streams=%v, token=%vB",
+				stream, fromTime.Format(time.RFC3339), toTime.Format(time.RFC3339), len(stats), len(token),
+			)
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestViewers_SampleAndQuery(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	// The SRS API, there is a publisher and 2 players of livestream, and a player waiting for other stream.
+	srs := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"code":0,"streams":[` +
+			`{"app":"live","name":"livestream","clients":3,"publish":{"active":true}},` +
+			`{"app":"live","name":"other","clients":1,"publish":{"active":false}}]}`,
+		))
+	}))
+	defer srs.Close()
+
+	oldApiServer := os.Getenv("SRS_API_SERVER")
+	os.Setenv("SRS_API_SERVER", srs.URL)
+	defer os.Setenv("SRS_API_SERVER", oldApiServer)
+
+	server.HSet(SRS_STREAM_ACTIVE, "live/livestream", `{"app":"live","stream":"livestream"}`)
+
+	// The HLS viewers, the same viewer only counts once, and the stream not alive is ignored.
+	tracker := NewViewerTracker()
+	for _, c := range []struct {
+		path, ip, ua string
+	}{
+		{"/live/livestream.m3u8", "10.0.0.1:1000", "Safari"},
+		{"/live/livestream.m3u8", "10.0.0.1:1001", "Safari"},
+		{"/live/livestream.m3u8", "10.0.0.1:1002", "Chrome"},
+		{"/live/livestream.m3u8", "10.0.0.2:1000", "Safari"},
+		{"/live/nobody.m3u8", "10.0.0.3:1000", "Safari"},
+	} {
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		r.RemoteAddr = c.ip
+		r.Header.Set("User-Agent", c.ua)
+		tracker.OnHLSPlaylist(ctx, r)
+	}
+
+	window := viewerWindow(time.Now())
+	if err := tracker.sample(ctx, window); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	// Ignore if the window is sampled.
+	if err := tracker.sample(ctx, window); err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+
+	stats, err := queryViewerStats(ctx, "", time.Now().Add(-time.Hour), time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	if len(stats) != 2 || stats[0].Stream != "live/livestream" || stats[1].Stream != "live/other" {
+		t.Fatalf("Fail for stats %v", len(stats))
+	}
+
+	if s := stats[0]; len(s.Samples) != 1 || s.Peak != 5 || s.Unique != 3 || s.Current == nil {
+		t.Errorf("Fail for samples=%v, peak=%v, unique=%v", len(s.Samples), s.Peak, s.Unique)
+	} else if c := s.Current; c.Players != 2 || c.HLS != 3 || c.Total != 5 {
+		t.Errorf("Fail for current %v", c.String())
+	}
+	if s := stats[1]; len(s.Samples) != 1 || s.Peak != 1 || s.Unique != 0 {
+		t.Errorf("Fail for samples=%v, peak=%v, unique=%v", len(s.Samples), s.Peak, s.Unique)
+	}
+
+	// Filter by stream and time range.
+	if stats, err := queryViewerStats(ctx, "live/livestream", time.Now().Add(time.Minute), time.Now().Add(time.Hour)); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	} else if len(stats) != 1 || len(stats[0].Samples) != 0 || stats[0].Peak != 0 {
+		t.Errorf("Fail for stats %v", len(stats))
+	}
+}
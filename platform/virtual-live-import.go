@@ -0,0 +1,409 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
+)
+
+// The status of vLive import task.
+type VLiveImportStatus string
+
+const VLiveImportStatusPending VLiveImportStatus = "pending"
+const VLiveImportStatusDownloading VLiveImportStatus = "downloading"
+const VLiveImportStatusDone VLiveImportStatus = "done"
+const VLiveImportStatusFailed VLiveImportStatus = "failed"
+
+// The platforms allowed to import from, match the host or the suffix of host.
+var vLiveImportPlatforms = []string{"youtube.com", "youtu.be", "bilibili.com", "b23.tv"}
+
+// The max size of output of youtube-dl, which should be some URLs.
+const vLiveImportMaxOutput = 64 * 1024
+
+// VLiveImport is a task to import the vLive source from a YouTube or Bilibili URL, which is stored in
+// redis so it's resumable across restarts.
+type VLiveImport struct {
+	// The task UUID.
+	UUID string `json:"uuid"`
+	// The platform URL, for example, https://www.youtube.com/watch?v=xxx
+	URL string `json:"url"`
+	// The status of task.
+	Status VLiveImportStatus `json:"status"`
+	// The target file in upload directory, available when done.
+	Target string `json:"target,omitempty"`
+	// The total size in bytes, 0 if unknown.
+	Size int64 `json:"size"`
+	// The downloaded size in bytes.
+	Downloaded int64 `json:"downloaded"`
+	// The error message if failed.
+	Error string `json:"error,omitempty"`
+	// The update time.
+	Update string `json:"update"`
+}
+
+func (v *VLiveImport) String() string {
+	return fmt.Sprintf("uuid=%v, url=%v, status=%v, target=%v, size=%v, downloaded=%v, error=%v",
+		v.UUID, v.URL, v.Status, v.Target, v.Size, v.Downloaded, v.Error,
+	)
+}
+
+func (v *VLiveImport) partFile() string {
+	return path.Join(dirUploadPath, fmt.Sprintf("%v.part", v.UUID))
+}
+
+func (v *VLiveImport) save(ctx context.Context) error {
+	v.Update = time.Now().Format(time.RFC3339)
+	if b, err := json.Marshal(v); err != nil {
+		return errors.Wrapf(err, "marshal %v", v.String())
+	} else if err = rdb.HSet(ctx, SRS_VLIVE_IMPORT, v.UUID, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_VLIVE_IMPORT, v.UUID, string(b))
+	}
+	return nil
+}
+
+// isBilibili returns whether the URL is from bilibili, which requires the referer to download.
+func (v *VLiveImport) isBilibili() bool {
+	u, err := url.Parse(v.URL)
+	return err == nil && (strings.HasSuffix(u.Hostname(), "bilibili.com") || u.Hostname() == "b23.tv")
+}
+
+// resolve uses youtube-dl, or yt-dlp which is compatible, to resolve the media URL of platform URL.
+func (v *VLiveImport) resolve(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, 60*time.Second)
+	defer cancel()
+
+	args := []string{"--get-url", "--format", "best[ext=mp4]/best"}
+	if proxy := envYtdlProxy(); proxy != "" {
+		args = append(args, "--proxy", proxy)
+	}
+	args = append(args, v.URL)
+
+	var stdout, stderr boundedBuffer
+	stdout.limit, stderr.limit = vLiveImportMaxOutput, vLiveImportMaxOutput
+
+	cmd := exec.CommandContext(ctx, "youtube-dl", args...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		// The error of youtube-dl is clear enough, for example, the video is unavailable in your country.
+		return "", errors.Wrapf(err, "resolve %v, %v", v.URL, lastLineOf(stderr.String()))
+	}
+
+	// Use the first URL, because there might be two URLs for video and audio.
+	mediaURL := strings.TrimSpace(strings.Split(strings.TrimSpace(stdout.String()), "\n")[0])
+	if !strings.HasPrefix(mediaURL, "http://") && !strings.HasPrefix(mediaURL, "https://") {
+		return "", errors.Errorf("invalid media url %v of %v", mediaURL, v.URL)
+	}
+	return mediaURL, nil
+}
+
+// download fetches the media URL to the part file, resume from the size of part file.
+func (v *VLiveImport) download(ctx context.Context, mediaURL string) error {
+	f, err := os.OpenFile(v.partFile(), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return errors.Wrapf(err, "open %v", v.partFile())
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return errors.Wrapf(err, "seek %v", v.partFile())
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
+	if err != nil {
+		return errors.Wrapf(err, "new request %v", mediaURL)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%v-", offset))
+	}
+	if v.isBilibili() {
+		req.Header.Set("Referer", "https://www.bilibili.com")
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return errors.Wrapf(err, "do request")
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+		v.Size = 0
+		if res.ContentLength > 0 {
+			v.Size = offset + res.ContentLength
+		}
+	case http.StatusOK:
+		// Server doesn't support range, download from start.
+		if err := f.Truncate(0); err != nil {
+			return errors.Wrapf(err, "truncate %v", v.partFile())
+		}
+		if offset, err = f.Seek(0, io.SeekStart); err != nil {
+			return errors.Wrapf(err, "seek %v", v.partFile())
+		}
+		v.Size = 0
+		if res.ContentLength > 0 {
+			v.Size = res.ContentLength
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Already downloaded all of the file.
+		if offset > 0 {
+			v.Size, v.Downloaded = offset, offset
+			return nil
+		}
+		return errors.Errorf("status %v", res.StatusCode)
+	case http.StatusForbidden, http.StatusNotFound:
+		return errors.Errorf("status %v, the url might be region-locked or expired", res.StatusCode)
+	default:
+		return errors.Errorf("status %v", res.StatusCode)
+	}
+	logger.Tf(ctx, "vLive: Import download %v, offset=%v, size=%v", v.String(), offset, v.Size)
+
+	// Report the progress every some seconds.
+	v.Downloaded = offset
+	lastReport := time.Now()
+	buf := make([]byte, 32*1024)
+	for {
+		nn, err := res.Body.Read(buf)
+		if nn > 0 {
+			if _, err := f.Write(buf[:nn]); err != nil {
+				return errors.Wrapf(err, "write %v", v.partFile())
+			}
+			v.Downloaded += int64(nn)
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "read body")
+		}
+
+		if time.Since(lastReport) > 3*time.Second {
+			lastReport = time.Now()
+			if err := v.save(ctx); err != nil {
+				return errors.Wrapf(err, "save")
+			}
+		}
+	}
+
+	if v.Size > 0 && v.Downloaded != v.Size {
+		return errors.Errorf("size mismatch, downloaded=%v, size=%v", v.Downloaded, v.Size)
+	}
+	return nil
+}
+
+// Run resolves and downloads the platform URL, then probes the file like an upload file.
+func (v *VLiveImport) Run(ctx context.Context) error {
+	v.Status = VLiveImportStatusDownloading
+	if err := v.save(ctx); err != nil {
+		return errors.Wrapf(err, "save")
+	}
+
+	err := func() error {
+		mediaURL, err := v.resolve(ctx)
+		if err != nil {
+			return errors.Wrapf(err, "resolve")
+		}
+
+		if err := v.download(ctx, mediaURL); err != nil {
+			return errors.Wrapf(err, "download")
+		}
+
+		target := path.Join(dirUploadPath, fmt.Sprintf("%v.mp4", v.UUID))
+		if _, _, _, err := FFprobeFileFormat(ctx, v.partFile()); err != nil {
+			return errors.Wrapf(err, "probe %v", v.partFile())
+		}
+		if err := os.Rename(v.partFile(), target); err != nil {
+			return errors.Wrapf(err, "rename %v to %v", v.partFile(), target)
+		}
+		v.Target = target
+		return nil
+	}()
+
+	// Keep the status when quit, so we're able to resume it.
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if err != nil {
+		v.Status, v.Error = VLiveImportStatusFailed, err.Error()
+		os.Remove(v.partFile())
+	} else {
+		v.Status = VLiveImportStatusDone
+	}
+
+	if err := v.save(ctx); err != nil {
+		return errors.Wrapf(err, "save")
+	}
+	return err
+}
+
+func (v *VLiveWorker) startImport(ctx context.Context, task *VLiveImport) {
+	v.wg.Add(1)
+	go safe(ctx, func() {
+		defer v.wg.Done()
+
+		if err := task.Run(ctx); err != nil {
+			logger.Wf(ctx, "vLive: Import %v err %+v", task.String(), err)
+		} else {
+			logger.Tf(ctx, "vLive: Import ok, %v", task.String())
+		}
+	})
+}
+
+// resumeImports restarts the import tasks which are not finished, for example, the platform restarts.
+func (v *VLiveWorker) resumeImports(ctx context.Context) error {
+	objs, err := rdb.HGetAll(ctx, SRS_VLIVE_IMPORT).Result()
+	if err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hgetall %v", SRS_VLIVE_IMPORT)
+	}
+
+	for id, obj := range objs {
+		var task VLiveImport
+		if err := json.Unmarshal([]byte(obj), &task); err != nil {
+			return errors.Wrapf(err, "unmarshal %v %v", id, obj)
+		}
+
+		if task.Status == VLiveImportStatusPending || task.Status == VLiveImportStatusDownloading {
+			logger.Tf(ctx, "vLive: Resume import %v", task.String())
+			v.startImport(ctx, &task)
+		}
+	}
+	return nil
+}
+
+func (v *VLiveWorker) handleImport(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/ffmpeg/vlive/import"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		// The import task outlives the request, so it runs in the context of worker.
+		parentCtx := ctx
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, platformURL string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				URL   *string `json:"url"`
+			}{
+				Token: &token, URL: &platformURL,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			u, err := url.Parse(platformURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return errors.Errorf("invalid url %v", platformURL)
+			}
+
+			var supported bool
+			for _, p := range vLiveImportPlatforms {
+				if u.Hostname() == p || strings.HasSuffix(u.Hostname(), "."+p) {
+					supported = true
+					break
+				}
+			}
+			if !supported {
+				return errors.Errorf("unsupported platform %v, should be %v", u.Hostname(), vLiveImportPlatforms)
+			}
+
+			task := &VLiveImport{UUID: uuid.NewString(), URL: platformURL, Status: VLiveImportStatusPending}
+			if err := task.save(ctx); err != nil {
+				return errors.Wrapf(err, "save %v", task.String())
+			}
+
+			v.startImport(logger.AliasContext(parentCtx, ctx), task)
+
+			httpWriteData(ctx, w, r, task)
+			logger.Tf(ctx, "vLive: Import start, %v, token=%vB", task.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/vlive/import/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, taskUUID string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				UUID  *string `json:"uuid"`
+			}{
+				Token: &token, UUID: &taskUUID,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if taskUUID == "" {
+				return errors.New("no uuid")
+			}
+
+			var task VLiveImport
+			if obj, err := rdb.HGet(ctx, SRS_VLIVE_IMPORT, taskUUID).Result(); err != nil && err != redis.Nil {
+				return errors.Wrapf(err, "hget %v %v", SRS_VLIVE_IMPORT, taskUUID)
+			} else if obj == "" {
+				return errors.Errorf("import %v not found", taskUUID)
+			} else if err := json.Unmarshal([]byte(obj), &task); err != nil {
+				return errors.Wrapf(err, "unmarshal %v", obj)
+			}
+
+			httpWriteData(ctx, w, r, &task)
+			logger.Tf(ctx, "vLive: Import query ok, %v, token=%vB", task.String(), len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
+
+// boundedBuffer is a buffer which drops the data exceed the limit, to avoid huge output of process.
+type boundedBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (v *boundedBuffer) Write(p []byte) (int, error) {
+	if left := v.limit - v.Buffer.Len(); left > 0 {
+		if len(p) > left {
+			v.Buffer.Write(p[:left])
+		} else {
+			v.Buffer.Write(p)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,445 @@
+// Copyright (c) 2022-2024 Winlin
+//
+// SPDX-License-Identifier: MIT
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	// From ossrs.
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+
+	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
+	"github.com/go-redis/redis/v8"
+)
+
+// VLiveLibraryReference is a vLive config which uses the file as source.
+type VLiveLibraryReference struct {
+	// The platform of vLive, for example, wx
+	Platform string `json:"platform"`
+	// The label of vLive.
+	Label string `json:"label,omitempty"`
+	// Whether the vLive is enabled, so the file is used by an active source.
+	Enabled bool `json:"enabled"`
+}
+
+// VLiveLibraryFile is a file in the media library of vLive.
+type VLiveLibraryFile struct {
+	// The path relative to the library root, for example, 3ECF0239.mp4 or intro/welcome.mp4
+	Path string `json:"path"`
+	// The name of file when uploaded, from the vLive config.
+	Name string `json:"name,omitempty"`
+	// The size in bytes.
+	Size int64 `json:"size"`
+	// The duration in seconds, from the cached probe data of vLive config, 0 if unknown.
+	Duration float64 `json:"duration,omitempty"`
+	// The modify time, in RFC3339.
+	Update string `json:"update"`
+	// The vLive configs which use the file.
+	References []*VLiveLibraryReference `json:"references"`
+}
+
+func (v *VLiveLibraryFile) String() string {
+	return fmt.Sprintf("path=%v, name=%v, size=%v, duration=%v, references=%v",
+		v.Path, v.Name, v.Size, v.Duration, len(v.References),
+	)
+}
+
+// Active returns whether the file is used by an enabled vLive.
+func (v *VLiveLibraryFile) Active() bool {
+	for _, ref := range v.References {
+		if ref.Enabled {
+			return true
+		}
+	}
+	return false
+}
+
+// VLiveLibraryUsage is the storage usage of media library.
+type VLiveLibraryUsage struct {
+	// The number of files, and the total size in bytes.
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// The size in bytes of files not used by any vLive, which are safe to remove.
+	Unused int64 `json:"unused"`
+}
+
+// resolveVLiveLibraryPath returns the path in library root, for example, vlive/intro/welcome.mp4 for
+// intro/welcome.mp4, and never allows the path out of the root.
+func resolveVLiveLibraryPath(p string) (string, error) {
+	rel := path.Clean(filepath.ToSlash(p))
+	if p == "" || strings.Contains(p, "\x00") || path.IsAbs(rel) || rel == "." || rel == ".." ||
+		strings.HasPrefix(rel, "../") || strings.HasPrefix(path.Base(rel), ".") {
+		return "", newHttpStatusError(http.StatusBadRequest, errors.Errorf("invalid path %v", p))
+	}
+	return path.Join(dirVLivePath, rel), nil
+}
+
+// queryVLiveLibraryConfigs returns all the vLive configs, sorted by platform.
+func queryVLiveLibraryConfigs(ctx context.Context) ([]*VLiveConfigure, error) {
+	values, err := rdb.HGetAll(ctx, SRS_VLIVE_CONFIG).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_VLIVE_CONFIG)
+	}
+
+	configs := make([]*VLiveConfigure, 0, len(values))
+	for platform, value := range values {
+		var config VLiveConfigure
+		if err := json.Unmarshal([]byte(value), &config); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", platform, value)
+		}
+		configs = append(configs, &config)
+	}
+
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].Platform < configs[j].Platform
+	})
+	return configs, nil
+}
+
+func saveVLiveLibraryConfig(ctx context.Context, config *VLiveConfigure) error {
+	if b, err := json.Marshal(config); err != nil {
+		return errors.Wrapf(err, "marshal %v", config.String())
+	} else if err = rdb.HSet(ctx, SRS_VLIVE_CONFIG, config.Platform, string(b)).Err(); err != nil && err != redis.Nil {
+		return errors.Wrapf(err, "hset %v %v %v", SRS_VLIVE_CONFIG, config.Platform, string(b))
+	}
+	return nil
+}
+
+// isVLiveLibrarySource returns whether the source of vLive is the file in library.
+func isVLiveLibrarySource(source *FFprobeSource, target string) bool {
+	return source.Type != FFprobeSourceTypeStream && path.Clean(source.Target) == target
+}
+
+// listVLiveLibrary returns the files in library with the vLive configs using them, sorted by path, and the usage.
+func listVLiveLibrary(ctx context.Context) ([]*VLiveLibraryFile, *VLiveLibraryUsage, error) {
+	configs, err := queryVLiveLibraryConfigs(ctx)
+	if err != nil {
+		return nil, nil, errors.Wrapf(err, "query configs")
+	}
+
+	files := []*VLiveLibraryFile{}
+	usage := &VLiveLibraryUsage{}
+	if _, err := os.Stat(dirVLivePath); err != nil && os.IsNotExist(err) {
+		return files, usage, nil
+	}
+
+	if err := filepath.Walk(dirVLivePath, func(filename string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Ignore the symbolic links, which might be out of the root, and the temporary files.
+		if !info.Mode().IsRegular() || strings.HasPrefix(info.Name(), ".") {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dirVLivePath, filename)
+		if err != nil {
+			return errors.Wrapf(err, "rel %v", filename)
+		}
+
+		file := &VLiveLibraryFile{
+			Path: filepath.ToSlash(rel), Size: info.Size(), Update: info.ModTime().Format(time.RFC3339),
+			References: []*VLiveLibraryReference{},
+		}
+		target := path.Join(dirVLivePath, file.Path)
+		for _, config := range configs {
+			for _, source := range config.Files {
+				if !isVLiveLibrarySource(source, target) {
+					continue
+				}
+
+				if file.Name == "" {
+					file.Name = source.Name
+				}
+				if source.Format != nil && file.Duration == 0 {
+					file.Duration, _ = strconv.ParseFloat(source.Format.Duration, 64)
+				}
+				file.References = append(file.References, &VLiveLibraryReference{
+					Platform: config.Platform, Label: config.Label, Enabled: config.Enabled,
+				})
+				break
+			}
+		}
+
+		files = append(files, file)
+		usage.Files, usage.Bytes = usage.Files+1, usage.Bytes+file.Size
+		if len(file.References) == 0 {
+			usage.Unused += file.Size
+		}
+		return nil
+	}); err != nil {
+		return nil, nil, errors.Wrapf(err, "walk %v", dirVLivePath)
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Path < files[j].Path
+	})
+	return files, usage, nil
+}
+
+// renameVLiveLibraryFile renames the file in library, and updates the vLive configs using it, which use the new file
+// when FFmpeg restarts, so the live stream is not interrupted.
+func renameVLiveLibraryFile(ctx context.Context, from, to string) error {
+	source, err := resolveVLiveLibraryPath(from)
+	if err != nil {
+		return errors.Wrapf(err, "resolve %v", from)
+	}
+	target, err := resolveVLiveLibraryPath(to)
+	if err != nil {
+		return errors.Wrapf(err, "resolve %v", to)
+	}
+
+	if info, err := os.Lstat(source); err != nil {
+		return newHttpStatusError(http.StatusNotFound, errors.Wrapf(err, "no file %v", from))
+	} else if !info.Mode().IsRegular() {
+		return newHttpStatusError(http.StatusBadRequest, errors.Errorf("not a regular file %v", from))
+	}
+	// Keep the extension, because FFmpeg might detect the format by it.
+	if !strings.EqualFold(path.Ext(source), path.Ext(target)) {
+		return newHttpStatusError(http.StatusBadRequest, errors.Errorf("should keep extension %v", path.Ext(source)))
+	}
+	if _, err := os.Lstat(target); err == nil {
+		return newHttpStatusError(http.StatusConflict, errors.Errorf("file %v exists", to))
+	}
+
+	if err := os.MkdirAll(path.Dir(target), 0755); err != nil {
+		return errors.Wrapf(err, "mkdir %v", path.Dir(target))
+	}
+	if err := os.Rename(source, target); err != nil {
+		return errors.Wrapf(err, "rename %v to %v", source, target)
+	}
+
+	configs, err := queryVLiveLibraryConfigs(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "query configs")
+	}
+	for _, config := range configs {
+		var changed bool
+		for _, f := range config.Files {
+			if isVLiveLibrarySource(f, source) {
+				f.Target, f.Name, changed = target, path.Base(target), true
+			}
+		}
+		if !changed {
+			continue
+		}
+
+		if err := saveVLiveLibraryConfig(ctx, config); err != nil {
+			return errors.Wrapf(err, "save %v", config.Platform)
+		}
+		if vLiveWorker == nil {
+			continue
+		}
+		if task := vLiveWorker.GetTask(config.Platform); task != nil {
+			if err := task.Reload(ctx); err != nil {
+				return errors.Wrapf(err, "reload task %v", config.Platform)
+			}
+		}
+	}
+	return nil
+}
+
+// removeVLiveLibraryFile removes the file in library, and removes it from the vLive configs. It's refused if the file
+// is used by an enabled vLive, unless forced, which disables and stops the vLive. Returns the stopped platforms.
+func removeVLiveLibraryFile(ctx context.Context, p string, force bool) ([]string, error) {
+	target, err := resolveVLiveLibraryPath(p)
+	if err != nil {
+		return nil, errors.Wrapf(err, "resolve %v", p)
+	}
+
+	if info, err := os.Lstat(target); err != nil {
+		return nil, newHttpStatusError(http.StatusNotFound, errors.Wrapf(err, "no file %v", p))
+	} else if !info.Mode().IsRegular() {
+		return nil, newHttpStatusError(http.StatusBadRequest, errors.Errorf("not a regular file %v", p))
+	}
+
+	configs, err := queryVLiveLibraryConfigs(ctx)
+	if err != nil {
+		return nil, errors.Wrapf(err, "query configs")
+	}
+
+	var references, actives []*VLiveConfigure
+	for _, config := range configs {
+		for _, f := range config.Files {
+			if isVLiveLibrarySource(f, target) {
+				references = append(references, config)
+				if config.Enabled {
+					actives = append(actives, config)
+				}
+				break
+			}
+		}
+	}
+
+	if len(actives) > 0 && !force {
+		var platforms []string
+		for _, config := range actives {
+			platforms = append(platforms, config.Platform)
+		}
+		return nil, newHttpCodeError(http.StatusConflict, SrsStackErrorMediaInUse,
+			errors.Errorf("file %v is used by vLive %v", p, strings.Join(platforms, ",")))
+	}
+
+	var stopped []string
+	for _, config := range references {
+		var files []*FFprobeSource
+		for _, f := range config.Files {
+			if !isVLiveLibrarySource(f, target) {
+				files = append(files, f)
+			}
+		}
+		config.Files = files
+
+		if config.Enabled {
+			config.Enabled = false
+			stopped = append(stopped, config.Platform)
+		}
+		if err := saveVLiveLibraryConfig(ctx, config); err != nil {
+			return nil, errors.Wrapf(err, "save %v", config.Platform)
+		}
+
+		if vLiveWorker == nil {
+			continue
+		}
+		if task := vLiveWorker.GetTask(config.Platform); task != nil {
+			if err := task.Restart(ctx); err != nil {
+				return nil, errors.Wrapf(err, "restart task %v", config.Platform)
+			}
+		}
+	}
+
+	if err := os.Remove(target); err != nil {
+		return nil, errors.Wrapf(err, "remove %v", target)
+	}
+	return stopped, nil
+}
+
+func (v *VLiveWorker) handleLibrary(ctx context.Context, handler *http.ServeMux) {
+	ep := "/terraform/v1/ffmpeg/vlive/library/query"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+			}{
+				Token: &token,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			files, usage, err := listVLiveLibrary(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "list library")
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Files []*VLiveLibraryFile `json:"files"`
+				Usage *VLiveLibraryUsage  `json:"usage"`
+			}{
+				Files: files, Usage: usage,
+			})
+			logger.Tf(ctx, "vLive: Library query ok, files=%v, bytes=%v, token=%vB", usage.Files, usage.Bytes, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/vlive/library/rename"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, from, to string
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				From  *string `json:"from"`
+				To    *string `json:"to"`
+			}{
+				Token: &token, From: &from, To: &to,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			if err := renameVLiveLibraryFile(ctx, from, to); err != nil {
+				return errors.Wrapf(err, "rename %v to %v", from, to)
+			}
+
+			httpWriteData(ctx, w, r, nil)
+			logger.Tf(ctx, "vLive: Library rename ok, from=%v, to=%v, token=%vB", from, to, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+
+	ep = "/terraform/v1/ffmpeg/vlive/library/remove"
+	logger.Tf(ctx, "Handle %v", ep)
+	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
+		if err := func() error {
+			var token, p string
+			var force bool
+			if err := ParseBody(ctx, r, &struct {
+				Token *string `json:"token"`
+				Path  *string `json:"path"`
+				Force *bool   `json:"force"`
+			}{
+				Token: &token, Path: &p, Force: &force,
+			}); err != nil {
+				return errors.Wrapf(err, "parse body")
+			}
+
+			apiSecret := envApiSecret()
+			if err := Authenticate(ctx, apiSecret, token, r.Header); err != nil {
+				return errors.Wrapf(err, "authenticate")
+			}
+
+			stopped, err := removeVLiveLibraryFile(ctx, p, force)
+			if err != nil {
+				return errors.Wrapf(err, "remove %v", p)
+			}
+
+			httpWriteData(ctx, w, r, &struct {
+				Stopped []string `json:"stopped"`
+			}{
+				Stopped: stopped,
+			})
+			logger.Tf(ctx, "vLive: Library remove ok, path=%v, force=%v, stopped=%v, token=%vB",
+				p, force, stopped, len(token))
+			return nil
+		}(); err != nil {
+			httpWriteError(ctx, w, r, err)
+		}
+	})
+}
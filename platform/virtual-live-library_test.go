@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/ossrs/go-oryx-lib/errors"
+	"github.com/ossrs/go-oryx-lib/logger"
+)
+
+func TestVLiveLibrary_Resolve(t *testing.T) {
+	for p, expect := range map[string]string{
+		"a.mp4": path.Join(dirVLivePath, "a.mp4"), "intro/a.mp4": path.Join(dirVLivePath, "intro/a.mp4"),
+		"intro/../a.mp4": path.Join(dirVLivePath, "a.mp4"),
+	} {
+		if target, err := resolveVLiveLibraryPath(p); err != nil || target != expect {
+			t.Errorf("Fail for %v, target=%v, err %+v", p, target, err)
+		}
+	}
+
+	for _, p := range []string{"", ".", "..", "../a.mp4", "a/../../a.mp4", "/etc/passwd", ".hidden.mp4", "a/.."} {
+		if _, err := resolveVLiveLibraryPath(p); err == nil {
+			t.Errorf("Fail for %v", p)
+		}
+	}
+}
+
+func TestVLiveLibrary_Files(t *testing.T) {
+	ctx := logger.WithContext(context.Background())
+
+	server := setupFakeRedis(t)
+
+	dir, err := ioutil.TempDir("", "vlive-library")
+	if err != nil {
+		t.Fatalf("Fail for err %+v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldDir := dirVLivePath
+	dirVLivePath = dir
+	defer func() {
+		dirVLivePath = oldDir
+	}()
+
+	for name, size := range map[string]int{"a.mp4": 100, "b.flv": 200, "c.mp4": 300, ".d.mp4": 400} {
+		if err := ioutil.WriteFile(path.Join(dir, name), make([]byte, size), 0644); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+	}
+
+	// The a.mp4 is used by enabled wx and disabled bilibili, the b.flv by disabled bilibili, and c.mp4 by none.
+	for _, config := range []*VLiveConfigure{
+		{Platform: "wx", Enabled: true, Files: []*FFprobeSource{
+			{Name: "a.mp4", Target: path.Join(dir, "a.mp4"), Type: FFprobeSourceTypeUpload,
+				Format: &FFprobeFormat{Duration: "12.5"}},
+		}},
+		{Platform: "bilibili", Files: []*FFprobeSource{
+			{Name: "a.mp4", Target: path.Join(dir, "a.mp4"), Type: FFprobeSourceTypeUpload},
+			{Name: "b.flv", Target: path.Join(dir, "b.flv"), Type: FFprobeSourceTypeUpload},
+		}},
+	} {
+		b, _ := json.Marshal(config)
+		server.HSet(SRS_VLIVE_CONFIG, config.Platform, string(b))
+	}
+	query := func(platform string) *VLiveConfigure {
+		var config VLiveConfigure
+		value, _ := server.HGet(SRS_VLIVE_CONFIG, platform)
+		if err := json.Unmarshal([]byte(value), &config); err != nil {
+			t.Fatalf("Fail for err %+v", err)
+		}
+		return &config
+	}
+
+	files, usage, err := listVLiveLibrary(ctx)
+	if err != nil || len(files) != 3 || usage.Files != 3 || usage.Bytes != 600 || usage.Unused != 300 {
+		t.Fatalf("Fail for files=%v, usage=%v, err %+v", files, usage, err)
+	}
+	if f := files[0]; f.Path != "a.mp4" || f.Duration != 12.5 || len(f.References) != 2 || !f.Active() {
+		t.Errorf("Fail for %v", f)
+	}
+	if f := files[1]; f.Path != "b.flv" || len(f.References) != 1 || f.Active() {
+		t.Errorf("Fail for %v", f)
+	}
+
+	// Rename must keep the extension, never overwrite, and update the configs.
+	if err := renameVLiveLibraryFile(ctx, "b.flv", "b.mp4"); err == nil {
+		t.Errorf("Fail for extension")
+	}
+	if err := renameVLiveLibraryFile(ctx, "a.mp4", "c.mp4"); err == nil {
+		t.Errorf("Fail for conflict")
+	} else if r0, ok := errors.Cause(err).(*httpStatusError); !ok || r0.status != http.StatusConflict {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if err := renameVLiveLibraryFile(ctx, "a.mp4", "../a.mp4"); err == nil {
+		t.Errorf("Fail for traversal")
+	}
+	if err := renameVLiveLibraryFile(ctx, "a.mp4", "intro/welcome.mp4"); err != nil {
+		t.Errorf("Fail for err %+v", err)
+	}
+	for _, platform := range []string{"wx", "bilibili"} {
+		if f := query(platform).Files[0]; f.Target != path.Join(dir, "intro/welcome.mp4") || f.Name != "welcome.mp4" {
+			t.Errorf("Fail for %v %v", platform, f)
+		}
+	}
+
+	// Remove the file used by disabled vLive, and refuse the active one unless forced.
+	if stopped, err := removeVLiveLibraryFile(ctx, "b.flv", false); err != nil || len(stopped) != 0 {
+		t.Errorf("Fail for stopped=%v, err %+v", stopped, err)
+	}
+	if config := query("bilibili"); len(config.Files) != 1 {
+		t.Errorf("Fail for %v", config)
+	}
+	if _, err := removeVLiveLibraryFile(ctx, "intro/welcome.mp4", false); err == nil {
+		t.Errorf("Fail for active")
+	} else if r0, ok := errors.Cause(err).(*httpStatusError); !ok || r0.code != SrsStackErrorMediaInUse {
+		t.Errorf("Fail for err %+v", err)
+	}
+	if stopped, err := removeVLiveLibraryFile(ctx, "intro/welcome.mp4", true); err != nil ||
+		len(stopped) != 1 || stopped[0] != "wx" {
+		t.Errorf("Fail for stopped=%v, err %+v", stopped, err)
+	}
+	if config := query("wx"); config.Enabled || len(config.Files) != 0 {
+		t.Errorf("Fail for %v", config)
+	}
+
+	if files, usage, err = listVLiveLibrary(ctx); err != nil || len(files) != 1 || usage.Unused != 300 {
+		t.Errorf("Fail for files=%v, usage=%v, err %+v", files, usage, err)
+	}
+}
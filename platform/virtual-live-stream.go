@@ -5,6 +5,8 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -18,11 +20,11 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/ossrs/go-oryx-lib/errors"
-	ohttp "github.com/ossrs/go-oryx-lib/http"
 	"github.com/ossrs/go-oryx-lib/logger"
 
 	// Use v8 because we use Go 1.16+, while v9 requires Go 1.18+
@@ -55,16 +57,23 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 	ep := "/terraform/v1/ffmpeg/vlive/secret"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token, action string
+			var push bool
 			var userConf VLiveConfigure
-			if err := ParseBody(ctx, r.Body, &struct {
+			validation, err := parseConfigBody(ctx, r, &struct {
 				Token  *string `json:"token"`
 				Action *string `json:"action"`
+				// For validate action, whether push a test stream to the target.
+				Push *bool `json:"push"`
 				*VLiveConfigure
 			}{
-				Token: &token, Action: &action, VLiveConfigure: &userConf,
-			}); err != nil {
+				Token: &token, Action: &action, Push: &push, VLiveConfigure: &userConf,
+			})
+			if err != nil {
 				return errors.Wrapf(err, "parse body")
 			}
 
@@ -73,34 +82,34 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Wrapf(err, "authenticate")
 			}
 
-			allowedActions := []string{"update"}
-			allowedPlatforms := []string{"wx", "bilibili", "kuaishou"}
+			validateConfigAction(validation, action, []string{"update", "validate"})
 			if action != "" {
-				if !slicesContains(allowedActions, action) {
-					return errors.Errorf("invalid action=%v", action)
-				}
-
-				if userConf.Platform == "" {
-					return errors.New("no platform")
-				}
-
-				// Platform should be specified platforms, or starts with vlive-.
-				if !slicesContains(allowedPlatforms, userConf.Platform) && !strings.Contains(userConf.Platform, "vlive-") {
-					return errors.Errorf("invalid platform=%v", userConf.Platform)
+				userConf.Validate(validation, action == "update")
+			}
+			if err := validation.Err(); err != nil {
+				return errors.Wrapf(err, "validate %v", userConf.String())
+			}
+			for _, issue := range validation.Warnings {
+				logger.Wf(ctx, "vLive: Ignore config issue, %v", issue.String())
+			}
+			if stream := localStreamName(userConf.Server, userConf.Secret); action == "update" && stream != "" {
+				if err := verifyStreamName(ctx, stream); err != nil {
+					return errors.Wrapf(err, "verify stream name")
 				}
+			}
 
-				if userConf.Server == "" {
-					return errors.New("no server")
-				}
-				if userConf.Server == "" && userConf.Secret == "" {
-					return errors.New("no secret")
-				}
-				if len(userConf.Files) == 0 {
-					return errors.New("no files")
+			if action == "validate" {
+				checker := NewStreamChecker()
+				for _, file := range userConf.Files {
+					checker.CheckSource(ctx, file)
 				}
-			}
+				checker.CheckTarget(ctx, userConf.Server, userConf.Secret, push)
 
-			if action == "update" {
+				httpWriteData(ctx, w, r, checker)
+				logger.Tf(ctx, "vLive: Validate secret ok, platform=%v, push=%v, %v, token=%vB",
+					userConf.Platform, push, checker.String(), len(token))
+				return nil
+			} else if action == "update" {
 				var targetConf VLiveConfigure
 				if config, err := rdb.HGet(ctx, SRS_VLIVE_CONFIG, userConf.Platform).Result(); err != nil && err != redis.Nil {
 					return errors.Wrapf(err, "hget %v %v", SRS_VLIVE_CONFIG, userConf.Platform)
@@ -126,8 +135,8 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 					}
 				}
 
-				ohttp.WriteData(ctx, w, r, nil)
-				logger.Tf(ctx, "vLive: Update secret ok, token=%vB", len(token))
+				httpWriteData(ctx, w, r, validation)
+				logger.Tf(ctx, "vLive: Update secret ok, warnings=%v, token=%vB", len(validation.Warnings), len(token))
 				return nil
 			} else {
 				confObjs := make(map[string]*VLiveConfigure)
@@ -143,24 +152,29 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 					}
 				}
 
-				ohttp.WriteData(ctx, w, r, confObjs)
+				httpWriteData(ctx, w, r, confObjs)
 				logger.Tf(ctx, "vLive: Query configures ok, token=%vB", len(token))
 				return nil
 			}
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ffmpeg/vlive/streams"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
-			if err := ParseBody(ctx, r.Body, &struct {
-				Token *string `json:"token"`
+			var history bool
+			if err := ParseBody(ctx, r, &struct {
+				Token   *string `json:"token"`
+				History *bool   `json:"history"`
 			}{
-				Token: &token,
+				Token: &token, History: &history,
 			}); err != nil {
 				return errors.Wrapf(err, "parse body")
 			}
@@ -182,8 +196,13 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 
 					var pid int32
 					var inputUUID, frame, update, starttime, ready string
+					status, taskErr := TaskStatusWaiting, ""
 					if task := vLiveWorker.GetTask(config.Platform); task != nil {
 						pid, inputUUID, frame, update, starttime, ready = task.queryFrame()
+						status, taskErr = task.queryStatus()
+					}
+					if !config.Enabled {
+						status, taskErr = TaskStatusDisabled, ""
 					}
 
 					elem := map[string]interface{}{
@@ -192,6 +211,11 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 						"custom":   config.Customed,
 						"label":    config.Label,
 						"files":    config.Files,
+						"status":   status,
+					}
+
+					if taskErr != "" {
+						elem["error"] = taskErr
 					}
 
 					if pid > 0 {
@@ -204,6 +228,15 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 						}
 					}
 
+					// Query the task history if required, the latest event first.
+					if task := vLiveWorker.GetTask(config.Platform); history && task != nil {
+						if events, err := queryTaskHistory(ctx, task.UUID); err != nil {
+							return errors.Wrapf(err, "query history of %v", task.String())
+						} else {
+							elem["history"] = events
+						}
+					}
+
 					res = append(res, elem)
 				}
 			}
@@ -212,19 +245,22 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return res[i]["platform"].(string) < res[j]["platform"].(string)
 			})
 
-			ohttp.WriteData(ctx, w, r, res)
+			httpWriteData(ctx, w, r, res)
 			logger.Tf(ctx, "vLive: Query vLive streams ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	streamUrlHandler := func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var qUrl string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token     *string `json:"token"`
 				StreamURL *string `json:"url"`
 			}{
@@ -258,7 +294,7 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 			}
 
 			targetUUID := uuid.NewString()
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				// The file name.
 				Name string `json:"name"`
 				// The file UUID.
@@ -274,7 +310,7 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 			logger.Tf(ctx, "vLive: Update stream url ok, url=%v, uuid=%v", qUrl, targetUUID)
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	}
 
@@ -289,10 +325,15 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 	ep = "/terraform/v1/ffmpeg/vlive/ytdl"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		// The cleanup of temporary files outlives the request, so it waits for the quit of worker.
+		parentCtx := ctx
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var qFile string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token   *string `json:"token"`
 				YtdlURL *string `json:"url"`
 			}{
@@ -334,7 +375,7 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				}
 
 				select {
-				case <-ctx.Done():
+				case <-parentCtx.Done():
 					logger.Tf(ctx, "ytdl: do cleanup immediately when quit")
 				case <-requestDone.Done():
 					time.Sleep(duration)
@@ -397,7 +438,7 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Wrapf(err, "lstat %v", targetFile)
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Name   string `json:"name"`
 				UUID   string `json:"uuid"`
 				Target string `json:"target"`
@@ -411,17 +452,23 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 			logger.Tf(ctx, "vLive: Got vlive ytdl file target=%v, size=%v", targetFileInfo.Name(), targetFileInfo.Size())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
+	v.handleImport(ctx, handler)
+	v.handleLibrary(ctx, handler)
+
 	ep = "/terraform/v1/ffmpeg/vlive/server"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			var token string
 			var qFile string
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token      *string `json:"token"`
 				StreamFile *string `json:"file"`
 			}{
@@ -481,7 +528,7 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Wrapf(err, "copy %v to %v", fileAbsPath, targetFileName)
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Name   string `json:"name"`
 				UUID   string `json:"uuid"`
 				Target string `json:"target"`
@@ -495,13 +542,18 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 			logger.Tf(ctx, "vLive: Got vlive local file target=%v, size=%v", targetFileName, info.Size())
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ffmpeg/vlive/upload/"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		// The cleanup of temporary files outlives the request, so it waits for the quit of worker.
+		parentCtx := ctx
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func(ctx context.Context) error {
 			filename := r.URL.Path[len("/terraform/v1/ffmpeg/vlive/upload/"):]
 
@@ -529,7 +581,7 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				}
 
 				select {
-				case <-ctx.Done():
+				case <-parentCtx.Done():
 					logger.Tf(ctx, "upload: do cleanup immediately when quit")
 				case <-requestDone.Done():
 					time.Sleep(duration)
@@ -554,7 +606,9 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				return errors.Wrapf(err, "multi reader")
 			}
 
+			// Hash the file while writing, to verify the archived copy.
 			starttime := time.Now()
+			h := sha256.New()
 			var written int64
 			for {
 				part, err := mr.NextPart()
@@ -571,7 +625,7 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				logger.Tf(ctx, "vLive: Start part for %v", targetFileName)
 
 				partStarttime := time.Now()
-				if nn, err := io.Copy(targetFile, part); err != nil {
+				if nn, err := io.Copy(io.MultiWriter(targetFile, h), part); err != nil {
 					return errors.Wrapf(err, "copy %v to %v", targetFile, filename)
 				} else {
 					written += nn
@@ -581,27 +635,53 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				}
 			}
 
+			// Archive a copy to the storage driver, while FFmpeg always uses the local file.
+			driver, err := queryStorageDriver(ctx)
+			if err != nil {
+				return errors.Wrapf(err, "query driver")
+			}
+			if driver.Name() != StorageDriverLocal {
+				if _, err := targetFile.Seek(0, io.SeekStart); err != nil {
+					return errors.Wrapf(err, "seek %v", targetFileName)
+				}
+				archived := sha256.New()
+				if err := driver.Put(ctx, targetFileName, io.TeeReader(targetFile, archived), written); err != nil {
+					return errors.Wrapf(err, "put %v to %v", targetFileName, driver.Name())
+				}
+				if expect, actual := hex.EncodeToString(h.Sum(nil)), hex.EncodeToString(archived.Sum(nil)); expect != actual {
+					return errors.Errorf("checksum mismatch %v, expect %v, actual %v", targetFileName, expect, actual)
+				}
+			}
+
 			// After write file success, set the upload done to keep the file.
 			uploadDone = true
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				// The file UUID.
 				UUID string `json:"uuid"`
 				// The target file name.
 				Target string `json:"target"`
+				// The storage driver of file.
+				Storage StorageDriverName `json:"storage"`
+				// The SHA-256 of file.
+				SHA256 string `json:"sha256"`
 			}{
-				UUID: targetUUID, Target: targetFileName,
+				UUID: targetUUID, Target: targetFileName, Storage: driver.Name(),
+				SHA256: hex.EncodeToString(h.Sum(nil)),
 			})
 			logger.Tf(ctx, "vLive: Got vlive target=%v, size=%v, done=%v, cost=%v", targetFileName, written, uploadDone, time.Now().Sub(starttime))
 			return nil
 		}(logger.WithContext(ctx)); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
 	ep = "/terraform/v1/ffmpeg/vlive/source"
 	logger.Tf(ctx, "Handle %v", ep)
 	handler.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := httpRequestContext(ctx, r)
+		defer cancel()
+
 		if err := func() error {
 			type VLiveTempFile struct {
 				// The file name.
@@ -620,7 +700,7 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 
 			var token, platform string
 			var files []*VLiveTempFile
-			if err := ParseBody(ctx, r.Body, &struct {
+			if err := ParseBody(ctx, r, &struct {
 				Token    *string           `json:"token"`
 				Platform *string           `json:"platform"`
 				Files    *[]*VLiveTempFile `json:"files"`
@@ -790,6 +870,13 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 					Format: &format.Format, Video: matchVideo, Audio: matchAudio,
 				}
 				if file.Type != FFprobeSourceTypeStream {
+					// Store the size and checksum of the uploaded file, for the verify job.
+					if checksum, err := checksumFile(ctx, file.Target, 0); err != nil {
+						return errors.Wrapf(err, "checksum %v", file.Target)
+					} else {
+						parsedFile.Size, parsedFile.SHA256 = uint64(checksum.Size), checksum.SHA256
+					}
+
 					parsedFile.Target = path.Join(dirVLivePath, fmt.Sprintf("%v%v", file.UUID, path.Ext(file.Target)))
 					if err = os.Rename(file.Target, parsedFile.Target); err != nil {
 						return errors.Wrapf(err, "rename %v to %v", file.Target, parsedFile.Target)
@@ -836,7 +923,7 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 				}
 			}
 
-			ohttp.WriteData(ctx, w, r, &struct {
+			httpWriteData(ctx, w, r, &struct {
 				Platform string           `json:"platform"`
 				Files    []*FFprobeSource `json:"files"`
 			}{
@@ -845,7 +932,7 @@ func (v *VLiveWorker) Handle(ctx context.Context, handler *http.ServeMux) error
 			logger.Tf(ctx, "vLive: Update vLive ok, token=%vB", len(token))
 			return nil
 		}(); err != nil {
-			ohttp.WriteError(ctx, w, r, err)
+			httpWriteError(ctx, w, r, err)
 		}
 	})
 
@@ -860,6 +947,24 @@ func (v *VLiveWorker) Close() error {
 	return nil
 }
 
+// Reset stops and removes all tasks, returns the number of tasks. The configures should be removed before, or the
+// tasks are created again, see resetVLive.
+func (v *VLiveWorker) Reset(ctx context.Context, reason string) int {
+	var n int
+	v.tasks.Range(func(key, value interface{}) bool {
+		task := value.(*VLiveTask)
+		v.tasks.Delete(key)
+		task.Stop(ctx, reason)
+		if task.close != nil {
+			task.close()
+		}
+		logger.Tf(ctx, "vLive: reset task %v, reason=%v", task.String(), reason)
+		n++
+		return true
+	})
+	return n
+}
+
 func (v *VLiveWorker) Start(ctx context.Context) error {
 	wg := &v.wg
 
@@ -869,26 +974,15 @@ func (v *VLiveWorker) Start(ctx context.Context) error {
 	ctx = logger.WithContext(ctx)
 	logger.Tf(ctx, "vLive: Start a worker")
 
-	// Load tasks from redis and force to kill all.
-	if objs, err := rdb.HGetAll(ctx, SRS_VLIVE_TASK).Result(); err != nil && err != redis.Nil {
-		return errors.Wrapf(err, "hgetall %v", SRS_VLIVE_TASK)
-	} else if len(objs) > 0 {
-		for uuid, obj := range objs {
-			logger.Tf(ctx, "vLive: Load task %v object %v", uuid, obj)
-
-			var task VLiveTask
-			if err = json.Unmarshal([]byte(obj), &task); err != nil {
-				return errors.Wrapf(err, "unmarshal %v %v", uuid, obj)
-			}
-
-			if task.PID > 0 {
-				task.cleanup(ctx)
-			}
-		}
+	// Reconcile the tasks in redis with the configures, and force to kill all.
+	taskUUIDs, err := v.reconcileTasks(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "reconcile tasks")
+	}
 
-		if err = rdb.Del(ctx, SRS_VLIVE_TASK).Err(); err != nil && err != redis.Nil {
-			return errors.Wrapf(err, "del %v", SRS_VLIVE_TASK)
-		}
+	// Resume the import tasks, which are not finished.
+	if err := v.resumeImports(ctx); err != nil {
+		return errors.Wrapf(err, "resume imports")
 	}
 
 	// Load all configurations from redis.
@@ -907,17 +1001,31 @@ func (v *VLiveWorker) Start(ctx context.Context) error {
 				return errors.Wrapf(err, "unmarshal %v %v", platform, configItem)
 			}
 
+			// Restore the task with the same UUID after restart.
+			taskUUID := taskUUIDs[config.Platform]
+			if taskUUID == "" {
+				taskUUID = uuid.NewString()
+			}
+
+			// The task quits when the worker quits, or closed by Reset.
+			taskCtx, taskClose := context.WithCancel(ctx)
+
 			var task *VLiveTask
 			if tv, loaded := v.tasks.LoadOrStore(config.Platform, &VLiveTask{
-				UUID:     uuid.NewString(),
+				UUID:     taskUUID,
 				Platform: config.Platform,
 				config:   &config,
+				close:    taskClose,
 			}); loaded {
 				// Ignore if exists.
+				taskClose()
 				continue
 			} else {
 				task = tv.(*VLiveTask)
 				logger.Tf(ctx, "vLive: Create platform=%v task is %v", platform, task.String())
+				recordTaskEvent(ctx, &TaskEvent{
+					Worker: "vlive", Task: task.UUID, Platform: task.Platform, Event: TaskEventCreated,
+				})
 			}
 
 			// Initialize object.
@@ -932,9 +1040,16 @@ func (v *VLiveWorker) Start(ctx context.Context) error {
 			go func() {
 				defer wg.Done()
 
-				if err := task.Run(ctx); err != nil {
+				if err := task.Run(taskCtx); err != nil {
 					logger.Wf(ctx, "run task %v err %+v", task.String(), err)
 				}
+
+				// Remove the task closed by Reset, but keep it to restore after restart if the worker quits.
+				if ctx.Err() == nil {
+					if err := rdb.HDel(ctx, SRS_VLIVE_TASK, task.UUID).Err(); err != nil && err != redis.Nil {
+						logger.Wf(ctx, "ignore hdel %v %v err %+v", SRS_VLIVE_TASK, task.UUID, err)
+					}
+				}
 			}()
 		}
 
@@ -955,7 +1070,7 @@ func (v *VLiveWorker) Start(ctx context.Context) error {
 		for ctx.Err() == nil {
 			duration := 3 * time.Second
 			if err := loadTasks(); err != nil {
-				logger.Wf(ctx, "ignore err %+v", err)
+				logThrottle.Wf(ctx, err.Error(), "ignore err %+v", err)
 				duration = 10 * time.Second
 			}
 
@@ -970,6 +1085,77 @@ func (v *VLiveWorker) Start(ctx context.Context) error {
 }
 
 // VLiveConfigure is the configure for vLive.
+// reconcileTasks reconciles the task records in redis, which is the runtime state, with the configures,
+// which is the desired state. It kills the stale FFmpeg, removes the tasks whose configure or source
+// files are gone, and returns the UUID of other tasks, key is platform, to restore them after restart.
+func (v *VLiveWorker) reconcileTasks(ctx context.Context) (map[string]string, error) {
+	configs, err := rdb.HGetAll(ctx, SRS_VLIVE_CONFIG).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_VLIVE_CONFIG)
+	}
+
+	objs, err := rdb.HGetAll(ctx, SRS_VLIVE_TASK).Result()
+	if err != nil && err != redis.Nil {
+		return nil, errors.Wrapf(err, "hgetall %v", SRS_VLIVE_TASK)
+	}
+
+	taskUUIDs := make(map[string]string)
+	for id, obj := range objs {
+		logger.Tf(ctx, "vLive: Load task %v object %v", id, obj)
+
+		var task VLiveTask
+		if err = json.Unmarshal([]byte(obj), &task); err != nil {
+			return nil, errors.Wrapf(err, "unmarshal %v %v", id, obj)
+		}
+
+		if task.PID > 0 {
+			task.cleanup(ctx)
+		}
+
+		var config VLiveConfigure
+		configItem, ok := configs[task.Platform]
+		if ok {
+			if err = json.Unmarshal([]byte(configItem), &config); err != nil {
+				return nil, errors.Wrapf(err, "unmarshal %v %v", task.Platform, configItem)
+			}
+		}
+
+		// Remove the task if its configure or source is gone, or there is already a task for the platform.
+		if !ok || vLiveSelectSource(config.Files) == nil || taskUUIDs[task.Platform] != "" {
+			if err = rdb.HDel(ctx, SRS_VLIVE_TASK, id).Err(); err != nil && err != redis.Nil {
+				return nil, errors.Wrapf(err, "hdel %v %v", SRS_VLIVE_TASK, id)
+			}
+			logger.Tf(ctx, "vLive: Remove stale task %v, platform=%v", id, task.Platform)
+			continue
+		}
+
+		// Reset the runtime state, which is updated when task runs.
+		task.config, task.PID, task.Status, task.Error = &config, 0, TaskStatusWaiting, ""
+		if err = task.saveTask(ctx); err != nil {
+			return nil, errors.Wrapf(err, "save task")
+		}
+		taskUUIDs[task.Platform] = task.UUID
+	}
+
+	return taskUUIDs, nil
+}
+
+// vLiveSelectSource returns the first available source, or nil if no source, or the local file of
+// source is removed.
+func vLiveSelectSource(files []*FFprobeSource) *FFprobeSource {
+	if len(files) == 0 {
+		return nil
+	}
+
+	file := files[0]
+	if file.Type != FFprobeSourceTypeStream {
+		if _, err := os.Stat(file.Target); err != nil {
+			return nil
+		}
+	}
+	return file
+}
+
 type VLiveConfigure struct {
 	// The platform name, for example, wx
 	Platform string `json:"platform"`
@@ -1005,6 +1191,32 @@ func (v *VLiveConfigure) Update(u *VLiveConfigure) error {
 	return nil
 }
 
+// Validate collects all issues of the configure, the target URL is only validated for update, because the validate
+// action reports it by the checker.
+func (v *VLiveConfigure) Validate(validation *ConfigValidation, update bool) {
+	// Platform should be specified platforms, or starts with vlive-.
+	validateConfigPlatform(validation, v.Platform, []string{"wx", "bilibili", "kuaishou"}, "vlive-")
+
+	if !update {
+		if v.Server == "" {
+			validation.AddError("server", ConfigIssueRequired, "server is required")
+		}
+	} else {
+		validateConfigTarget(validation, v.Server, v.Secret)
+	}
+
+	if len(v.Files) == 0 {
+		validation.AddError("files", ConfigIssueRequired, "files is required")
+	}
+	for i, file := range v.Files {
+		if file == nil {
+			validation.AddError(fmt.Sprintf("files[%v]", i), ConfigIssueInvalid, "file is null")
+		} else if file.Target == "" {
+			validation.AddError(fmt.Sprintf("files[%v].target", i), ConfigIssueRequired, "target is required")
+		}
+	}
+}
+
 // VLiveTask is a task for FFmpeg to vLive stream, with a configure.
 type VLiveTask struct {
 	// The ID for task.
@@ -1021,6 +1233,10 @@ type VLiveTask struct {
 
 	// FFmpeg pid.
 	PID int32 `json:"pid"`
+	// The runtime status of task.
+	Status TaskStatus `json:"status"`
+	// The last error of task, if status is error.
+	Error string `json:"error,omitempty"`
 	// FFmpeg last frame.
 	frame string
 	// The last update time.
@@ -1032,6 +1248,8 @@ type VLiveTask struct {
 
 	// The context for current task.
 	cancel context.CancelFunc
+	// To quit the task, see Reset.
+	close context.CancelFunc
 
 	// The configure for vLive task.
 	config *VLiveConfigure
@@ -1086,16 +1304,79 @@ func (v *VLiveTask) Restart(ctx context.Context) error {
 		v.cancel()
 	}
 
-	// Reload config from redis.
+	if err := v.reloadConfig(ctx); err != nil {
+		return errors.Wrapf(err, "reload")
+	}
+
+	recordTaskEvent(ctx, &TaskEvent{
+		Worker: "vlive", Task: v.UUID, Platform: v.Platform, Event: TaskEventRestarted, Message: "config changed",
+	})
+
+	return nil
+}
+
+// Reload the config without restart, for example, the source file is renamed, which is used when FFmpeg restarts. Note
+// that the caller should hold the lock.
+func (v *VLiveTask) reloadConfig(ctx context.Context) error {
 	if b, err := rdb.HGet(ctx, SRS_VLIVE_CONFIG, v.Platform).Result(); err != nil {
 		return errors.Wrapf(err, "hget %v %v", SRS_VLIVE_CONFIG, v.Platform)
 	} else if err = json.Unmarshal([]byte(b), v.config); err != nil {
 		return errors.Wrapf(err, "unmarshal %v", b)
 	}
-
 	return nil
 }
 
+// Reload the config from redis, without stopping the FFmpeg.
+func (v *VLiveTask) Reload(ctx context.Context) error {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.reloadConfig(ctx)
+}
+
+// Stop the FFmpeg if running, for example, the feature is disabled, and record the reason.
+func (v *VLiveTask) Stop(ctx context.Context, reason string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	if v.cancel == nil || v.PID <= 0 {
+		return
+	}
+	v.cancel()
+
+	recordTaskEvent(ctx, &TaskEvent{
+		Worker: "vlive", Task: v.UUID, Platform: v.Platform, Event: TaskEventStopped, PID: v.PID, Message: reason,
+	})
+}
+
+// updateStatus updates the runtime status, and returns whether it's changed.
+func (v *VLiveTask) updateStatus(status TaskStatus, err error) bool {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+
+	var msg string
+	if err != nil {
+		msg = err.Error()
+	}
+
+	changed := v.Status != status || v.Error != msg
+	v.Status, v.Error = status, msg
+	return changed
+}
+
+// setStatus updates the runtime status, and saves the task if changed.
+func (v *VLiveTask) setStatus(ctx context.Context, status TaskStatus, err error) error {
+	if !v.updateStatus(status, err) {
+		return nil
+	}
+	return v.saveTask(ctx)
+}
+
+func (v *VLiveTask) queryStatus() (TaskStatus, string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	return v.Status, v.Error
+}
+
 func (v *VLiveTask) updateFrame(frame string) {
 	v.lock.Lock()
 	defer v.lock.Unlock()
@@ -1146,25 +1427,38 @@ func (v *VLiveTask) Run(ctx context.Context) error {
 		v.lock.Lock()
 		defer v.lock.Unlock()
 
-		if len(v.config.Files) == 0 {
-			return nil
+		file := vLiveSelectSource(v.config.Files)
+		if file != nil {
+			logger.Tf(ctx, "vLive: Use file=%v as input for platform=%v", file.UUID, v.Platform)
 		}
-
-		file := v.config.Files[0]
-		logger.Tf(ctx, "vLive: Use file=%v as input for platform=%v", file.UUID, v.Platform)
 		return file
 	}
 
 	pfn := func(ctx context.Context) error {
+		// Ignore when the feature is disabled for this install.
+		if enabled, err := isFeatureEnabled(ctx, FeatureVLive); err != nil {
+			return errors.Wrapf(err, "query feature")
+		} else if !enabled {
+			return v.setStatus(ctx, TaskStatusDisabled, nil)
+		}
+
 		// Ignore when not enabled.
 		if !v.config.Enabled {
-			return nil
+			return v.setStatus(ctx, TaskStatusDisabled, nil)
+		}
+
+		// Wait for SRS to accept connections, for example, the platform starts before SRS after host reboot.
+		if !srsReadiness.Ready() {
+			return v.setStatus(ctx, TaskStatusWaitingSrs, nil)
 		}
 
 		// Use a active stream as input.
 		input := selectInputFile()
 		if input == nil {
-			return nil
+			if len(v.config.Files) > 0 {
+				return errors.Errorf("source %v not found", v.config.Files[0].Target)
+			}
+			return v.setStatus(ctx, TaskStatusWaiting, nil)
 		}
 
 		// Start vLive task.
@@ -1177,10 +1471,18 @@ func (v *VLiveTask) Run(ctx context.Context) error {
 
 	for ctx.Err() == nil {
 		if err := pfn(ctx); err != nil {
-			logger.Wf(ctx, "ignore %v err %+v", v.String(), err)
+			logThrottle.Wf(ctx, fmt.Sprintf("%v %v", v.UUID, err.Error()), "ignore %v err %+v", v.String(), err)
+
+			if ctx.Err() == nil {
+				if err := v.setStatus(ctx, TaskStatusError, err); err != nil {
+					logger.Wf(ctx, "ignore save status err %+v", err)
+				}
+			}
 
+			// Retry immediately once SRS is ready again.
 			select {
 			case <-ctx.Done():
+			case <-srsReadiness.Regained():
 			case <-time.After(3500 * time.Millisecond):
 			}
 			continue
@@ -1199,7 +1501,12 @@ func (v *VLiveTask) doVirtualLiveStream(ctx context.Context, input *FFprobeSourc
 	// Create context for current task.
 	parentCtx := ctx
 	ctx, cancel := context.WithCancel(ctx)
-	v.cancel = cancel
+	// Whether canceled by restart, to distinguish from the FFmpeg failure in task history.
+	var restarted int32
+	v.cancel = func() {
+		atomic.StoreInt32(&restarted, 1)
+		cancel()
+	}
 
 	// Build input URL.
 	host := "localhost"
@@ -1220,7 +1527,8 @@ func (v *VLiveTask) doVirtualLiveStream(ctx context.Context, input *FFprobeSourc
 
 	// Start FFmpeg process.
 	args := []string{}
-	if input.Type == FFprobeSourceTypeFile || input.Type == FFprobeSourceTypeUpload || input.Type == FFprobeSourceTypeYTDL {
+	if input.Type == FFprobeSourceTypeFile || input.Type == FFprobeSourceTypeUpload || input.Type == FFprobeSourceTypeYTDL ||
+		input.Type == FFprobeSourceTypePlatformURL {
 		args = append(args, "-stream_loop", "-1")
 		args = append(args, "-re")
 	}
@@ -1260,6 +1568,9 @@ func (v *VLiveTask) doVirtualLiveStream(ctx context.Context, input *FFprobeSourc
 	}
 
 	v.PID = int32(cmd.Process.Pid)
+	recordTaskEvent(ctx, &TaskEvent{
+		Worker: "vlive", Task: v.UUID, Platform: v.Platform, Event: TaskEventStarted, PID: v.PID,
+	})
 	v.Input, v.inputUUID, v.Output = input.Target, input.UUID, outputURL
 	defer func() {
 		// If we got a PID, sleep for a while, to avoid too fast restart.
@@ -1276,6 +1587,7 @@ func (v *VLiveTask) doVirtualLiveStream(ctx context.Context, input *FFprobeSourc
 	}()
 	logger.Tf(ctx, "vLive: Start, platform=%v, input=%v, pid=%v", v.Platform, input.Target, v.PID)
 
+	v.updateStatus(TaskStatusRunning, nil)
 	if err := v.saveTask(ctx); err != nil {
 		return errors.Wrapf(err, "save task %v", v.String())
 	}
@@ -1313,5 +1625,9 @@ func (v *VLiveTask) doVirtualLiveStream(ctx context.Context, input *FFprobeSourc
 		v.Platform, input.Target, v.PID, err,
 	)
 
+	// Record the exit in task history, use parentCtx because ctx might be cancelled.
+	stopped := parentCtx.Err() != nil || atomic.LoadInt32(&restarted) == 1
+	recordTaskExit(parentCtx, "vlive", v.UUID, v.Platform, v.PID, stopped, heartbeat, err)
+
 	return err
 }
@@ -44,6 +44,20 @@ func main() {
 		w.Write(b)
 	})
 
+	ep = "/terraform/v1/releases/versions"
+	fmt.Println(fmt.Sprintf("Serve at %v", ep))
+	http.HandleFunc(ep, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", fmt.Sprintf("Oryx/%v", api))
+
+		b, err := json.Marshal(components)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Write(b)
+	})
+
 	if err := http.ListenAndServe(listen, nil); err != nil {
 		panic(err)
 	}
@@ -17,3 +17,23 @@ const api = "v1.0.374"
 // We should keep the stable version as 193, because for new architecture, we don't support automatically upgrade, so
 // this feature is actually not used, but we should keep a specified version for compatibility.
 const stable = "v1.0.193"
+
+// The expected digest of the image of stable and latest version, for the platform to verify before upgrade. Empty if
+// the digest is not pinned, for example, the image is not published yet, and the platform only verifies the signature.
+const stableDigest = ""
+const latestDigest = ""
+
+// Component is the version of a component or a release channel, with the publish date and notes URL if known.
+type Component struct {
+	Version     string `json:"version"`
+	PublishedAt string `json:"publishedAt,omitempty"`
+	NotesURL    string `json:"notesUrl,omitempty"`
+	Digest      string `json:"digest,omitempty"`
+}
+
+// The components by name, for the richer form of releases, see /terraform/v1/releases/versions.
+var components = map[string]*Component{
+	"stable": {Version: stable, Digest: stableDigest},
+	"latest": {Version: latest, Digest: latestDigest},
+	"api":    {Version: api},
+}
@@ -554,6 +554,9 @@ func (v *testApi) Request(ctx context.Context, api string, data interface{}, aut
 		return errors.Wrapf(err, "new request")
 	}
 
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
 	if auth {
 		req.Header.Set("Authorization", fmt.Sprintf("Bearer %v", *apiSecret))
 	}
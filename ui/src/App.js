@@ -61,8 +61,11 @@ function AppPreImpl() {
   React.useEffect(() => {
     if (!setEnv) return;
 
+    // Request with the token for the full envs, or only the coarse envs for login page.
     axios.post('/terraform/v1/mgmt/envs', {
       locale: Locale.current()
+    }, {
+      headers: Token.loadBearerHeader(),
     }).then(res => {
       setEnv(res.data.data);
       console.log(`Env ok, ${JSON.stringify(res.data)}`);
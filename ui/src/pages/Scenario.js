@@ -22,6 +22,7 @@ import ScenarioLiveRoom from "./ScenarioLiveRoom";
 import ScenarioCamera from "./ScenarioCamera";
 import ScenarioDubbing from "./ScenarioDubbing";
 import ScenarioOCR from "./ScenarioOCR";
+import axios from "axios";
 
 export default function Scenario() {
   const [searchParams] = useSearchParams();
@@ -46,6 +47,15 @@ function ScenarioImpl({defaultActiveTab}) {
   const setSearchParams = useSearchParams()[1];
   const {t} = useTranslation();
   const urls = useUrls();
+  const [features, setFeatures] = React.useState({});
+
+  // Hide the panels of features which are disabled for this install, all enabled if failed.
+  React.useEffect(() => {
+    axios.post('/terraform/v1/mgmt/features').then(res => {
+      setFeatures(res.data.data || {});
+      console.log(`Features ok, ${JSON.stringify(res.data.data)}`);
+    }).catch(e => console.warn(`Features ignore err ${e}`));
+  }, []);
 
   const onSelectTab = React.useCallback((k) => {
     setSearchParams({'tab': k});
@@ -66,21 +76,21 @@ function ScenarioImpl({defaultActiveTab}) {
           <Tab eventKey="stream" title={t('scenario.stream')}>
             {activeTab === 'stream' && <ScenarioLiveRoom/>}
           </Tab>
-          <Tab eventKey="forward" title={t('scenario.forward')}>
+          {features.forward !== false && <Tab eventKey="forward" title={t('scenario.forward')}>
             {activeTab === 'forward' && <ScenarioForward/>}
-          </Tab>
-          <Tab eventKey="record" title={t('scenario.record')}>
+          </Tab>}
+          {features.record !== false && <Tab eventKey="record" title={t('scenario.record')}>
             {activeTab === 'record' && <ScenarioRecord/>}
-          </Tab>
-          <Tab eventKey="vlive" title={t('scenario.vlive')}>
+          </Tab>}
+          {features.vlive !== false && <Tab eventKey="vlive" title={t('scenario.vlive')}>
             {activeTab === 'vlive' && <ScenarioVLive/>}
-          </Tab>
+          </Tab>}
           <Tab eventKey="camera" title={t('scenario.camera')}>
             {activeTab === 'camera' && <ScenarioCamera/>}
           </Tab>
-          <Tab eventKey="transcode" title={t('scenario.transcode')}>
+          {features.transcode !== false && <Tab eventKey="transcode" title={t('scenario.transcode')}>
             {activeTab === 'transcode' && <ScenarioTranscode {...{urls}} />}
-          </Tab>
+          </Tab>}
           <Tab eventKey="transcript" title={t('transcript.title')}>
             {activeTab === 'transcript' && <ScenarioTranscript/>}
           </Tab>